@@ -5,7 +5,12 @@
 // Package apitype contains types for the Tailscale local API and control plane API.
 package apitype
 
-import "tailscale.com/tailcfg"
+import (
+	"time"
+
+	"tailscale.com/net/speedtest"
+	"tailscale.com/tailcfg"
+)
 
 // WhoIsResponse is the JSON type returned by tailscaled debug server's /whois?ip=$IP handler.
 type WhoIsResponse struct {
@@ -30,3 +35,133 @@ type WaitingFile struct {
 	Name string
 	Size int64
 }
+
+// SpeedTestResult is the result of a speedtest against a peer's
+// PeerAPI.
+type SpeedTestResult struct {
+	// NodeName is the name of the peer tested against.
+	NodeName string
+
+	// Results are the throughput of each interval of the test,
+	// combined across all streams, followed by the total.
+	Results []speedtest.Result
+
+	// CurAddr is the ip:port of the direct path to the peer at the end
+	// of the test, or empty if it was relayed via DERP.
+	CurAddr string `json:",omitempty"`
+
+	// Relay is the DERP region the peer's traffic is relayed through,
+	// if CurAddr is empty.
+	Relay string `json:",omitempty"`
+}
+
+// DNSStatus is the DNS configuration of tailscaled, as returned by the
+// LocalAPI's dns-status handler.
+type DNSStatus struct {
+	// OSConfigurator is how tailscaled configures the OS's DNS, such
+	// as "systemd-resolved" or "direct".
+	OSConfigurator string
+
+	// SupportsSplitDNS is whether the OSConfigurator can install
+	// resolvers for specific DNS suffixes.
+	SupportsSplitDNS bool
+
+	// Routes are the DNS suffixes that tailscaled's resolver
+	// (100.100.100.100) forwards to specific resolvers, with "." for
+	// the default route. A suffix without resolvers is answered only
+	// from MagicDNS records.
+	Routes map[string][]string `json:",omitempty"`
+
+	// DefaultResolvers are the resolvers for names without a route.
+	// If empty, the OS's own resolvers are used.
+	DefaultResolvers []string `json:",omitempty"`
+
+	SearchDomains []string `json:",omitempty"`
+
+	// MagicDNSHosts is the number of MagicDNS names.
+	MagicDNSHosts int
+
+	// OSNameservers and OSMatchDomains are the nameservers and the
+	// domains they're used for that tailscaled installed in the OS.
+	// With no OSMatchDomains, OSNameservers are used for all names.
+	OSNameservers  []string `json:",omitempty"`
+	OSMatchDomains []string `json:",omitempty"`
+}
+
+// DNSQueryLogEntry is a DNS query handled by tailscaled's resolver.
+type DNSQueryLogEntry struct {
+	Time time.Time
+	Name string
+	Type string // like "A" or "AAAA"
+
+	// Local is whether the query was answered from MagicDNS records,
+	// without forwarding it.
+	Local bool `json:",omitempty"`
+
+	// Route is the DNS suffix of the route the query was forwarded
+	// by, "." for the default route.
+	Route string `json:",omitempty"`
+
+	// Upstream is the resolver whose response was used.
+	Upstream string `json:",omitempty"`
+
+	RCode   string `json:",omitempty"` // like "NOERROR" or "NXDOMAIN"
+	Error   string `json:",omitempty"`
+	Latency time.Duration
+}
+
+// DNSQueryResult is the result of a DNS query made by tailscaled's
+// resolver on behalf of a LocalAPI client.
+type DNSQueryResult struct {
+	DNSQueryLogEntry
+
+	// Resolvers are the resolvers of the query's route.
+	Resolvers []string `json:",omitempty"`
+
+	// Response is the DNS response message, if any.
+	Response []byte `json:",omitempty"`
+}
+
+// ExitNodeUsage is the traffic that tailscaled, as an exit node,
+// forwarded between a peer and the internet, as returned by the
+// LocalAPI's exit-usage handler.
+type ExitNodeUsage struct {
+	// NodeID and Name identify the peer, if it's in the netmap.
+	NodeID tailcfg.StableNodeID `json:",omitempty"`
+	Name   string               `json:",omitempty"`
+
+	// IPs are the peer's Tailscale IPs that the traffic was from or to.
+	IPs []string
+
+	ExitNodeCounts
+
+	// BlockedPackets is the number of packets from the peer that
+	// were dropped due to the exit node's blocked ports.
+	BlockedPackets uint64 `json:",omitempty"`
+
+	// TopDestinations are the protocols and destination ports with
+	// the most traffic, in bytes.
+	TopDestinations []ExitNodeDestUsage `json:",omitempty"`
+}
+
+// ExitNodeDestUsage is the exit traffic of a peer to a protocol and
+// destination port.
+type ExitNodeDestUsage struct {
+	Proto string // like "TCP" or "UDP"
+
+	// Port is the destination port. It's zero for protocols without
+	// ports, and for the traffic to ports beyond the number that
+	// tailscaled tracks per peer.
+	Port uint16 `json:",omitempty"`
+
+	ExitNodeCounts
+}
+
+// ExitNodeCounts are counters of exit traffic. Tx is from the peer to
+// the internet and Rx is from the internet to the peer.
+type ExitNodeCounts struct {
+	TxPackets uint64
+	TxBytes   uint64
+	RxPackets uint64
+	RxBytes   uint64
+}
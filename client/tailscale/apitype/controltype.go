@@ -17,4 +17,5 @@ type DNSConfig struct {
 type DNSResolver struct {
 	Addr                string   `json:"addr"`
 	BootstrapResolution []string `json:"bootstrapResolution,omitempty"`
+	TLSPins             []string `json:"tlsPins,omitempty"`
 }
@@ -32,7 +32,9 @@
 	"tailscale.com/client/tailscale/apitype"
 	"tailscale.com/ipn"
 	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/logtail/filesink"
 	"tailscale.com/net/netutil"
+	"tailscale.com/net/speedtest"
 	"tailscale.com/paths"
 	"tailscale.com/safesocket"
 	"tailscale.com/tailcfg"
@@ -249,6 +251,27 @@ func (lc *LocalClient) Goroutines(ctx context.Context) ([]byte, error) {
 	return lc.get200(ctx, "/localapi/v0/goroutines")
 }
 
+// Logs returns the daemon's log records that match q, one JSON object
+// per line, oldest first. It requires the daemon to be keeping its logs
+// locally, with TS_LOG_TARGET=file:///path. The caller must close the
+// returned ReadCloser.
+func (lc *LocalClient) Logs(ctx context.Context, q filesink.Query) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://local-tailscaled.sock/localapi/v0/logs?"+q.Values().Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := lc.doLocalRequestNiceError(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != 200 {
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		return nil, bestError(fmt.Errorf("HTTP %s: %s", res.Status, body), body)
+	}
+	return res.Body, nil
+}
+
 // DaemonMetrics returns the Tailscale daemon's metrics in
 // the Prometheus text exposition format.
 func (lc *LocalClient) DaemonMetrics(ctx context.Context) ([]byte, error) {
@@ -680,6 +703,83 @@ func (lc *LocalClient) Ping(ctx context.Context, ip netaddr.IP, pingtype tailcfg
 	return pr, nil
 }
 
+// SpeedTest runs a speedtest in direction dir against the peer with
+// Tailscale IP ip, over streams parallel connections.
+func (lc *LocalClient) SpeedTest(ctx context.Context, ip netaddr.IP, dir speedtest.Direction, duration time.Duration, streams int) (*apitype.SpeedTestResult, error) {
+	v := url.Values{}
+	v.Set("ip", ip.String())
+	v.Set("direction", dir.String())
+	v.Set("duration", duration.String())
+	v.Set("streams", strconv.Itoa(streams))
+	body, err := lc.send(ctx, "POST", "/localapi/v0/speedtest?"+v.Encode(), 200, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error %w: %s", err, body)
+	}
+	res := new(apitype.SpeedTestResult)
+	if err := json.Unmarshal(body, res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// DNSStatus returns the DNS configuration of tailscaled and of the OS.
+func (lc *LocalClient) DNSStatus(ctx context.Context) (*apitype.DNSStatus, error) {
+	body, err := lc.get200(ctx, "/localapi/v0/dns-status")
+	if err != nil {
+		return nil, err
+	}
+	st := new(apitype.DNSStatus)
+	if err := json.Unmarshal(body, st); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// QueryDNS asks tailscaled's resolver to resolve name for the record type
+// typ (like "A" or "AAAA") and reports how it was handled.
+func (lc *LocalClient) QueryDNS(ctx context.Context, name, typ string) (*apitype.DNSQueryResult, error) {
+	v := url.Values{}
+	v.Set("name", name)
+	v.Set("type", typ)
+	body, err := lc.send(ctx, "POST", "/localapi/v0/dns-query?"+v.Encode(), 200, nil)
+	if err != nil {
+		return nil, err
+	}
+	res := new(apitype.DNSQueryResult)
+	if err := json.Unmarshal(body, res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// DNSQueryLog returns the most recent queries handled by tailscaled's
+// resolver, oldest first.
+func (lc *LocalClient) DNSQueryLog(ctx context.Context) ([]apitype.DNSQueryLogEntry, error) {
+	body, err := lc.get200(ctx, "/localapi/v0/dns-query-log")
+	if err != nil {
+		return nil, err
+	}
+	var log []apitype.DNSQueryLogEntry
+	if err := json.Unmarshal(body, &log); err != nil {
+		return nil, err
+	}
+	return log, nil
+}
+
+// ExitUsage returns the traffic that tailscaled, as an exit node,
+// forwarded for each peer, the peers with the most traffic first.
+func (lc *LocalClient) ExitUsage(ctx context.Context) ([]apitype.ExitNodeUsage, error) {
+	body, err := lc.get200(ctx, "/localapi/v0/exit-usage")
+	if err != nil {
+		return nil, err
+	}
+	var usage []apitype.ExitNodeUsage
+	if err := json.Unmarshal(body, &usage); err != nil {
+		return nil, err
+	}
+	return usage, nil
+}
+
 // tailscaledConnectHint gives a little thing about why tailscaled (or
 // platform equivalent) is not answering localapi connections.
 //
@@ -0,0 +1,149 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/tailscale/hujson"
+)
+
+// Config is the format of the --config file, which lists the tailnets
+// whose policy files are managed from one repo.
+//
+// An example config in HuJSON:
+//
+//	{
+//		"tailnets": [
+//			{"tailnet": "example.com", "policyFile": "example.com.hujson"},
+//			{
+//				"tailnet":    "staging.example.com",
+//				"policyFile": "staging.hujson",
+//				"apiKeyEnv":  "TS_API_KEY_STAGING",
+//				"cacheFile":  "staging-version-cache.json",
+//			},
+//		],
+//	}
+type Config struct {
+	Tailnets []TailnetConfig `json:"tailnets"`
+}
+
+// TailnetConfig is the configuration of one tailnet in a Config.
+// Relative paths are relative to the directory of the config file.
+type TailnetConfig struct {
+	// Tailnet is the tailnet's name.
+	Tailnet string `json:"tailnet"`
+
+	// PolicyFile is the path of the tailnet's policy file.
+	PolicyFile string `json:"policyFile"`
+
+	// APIKeyEnv is the environment variable holding the tailnet's API
+	// key. It defaults to TS_API_KEY.
+	APIKeyEnv string `json:"apiKeyEnv,omitempty"`
+
+	// CacheFile is the path of the file caching the tailnet's last
+	// known policy ETag. It defaults to
+	// "version-cache-<tailnet>.json".
+	CacheFile string `json:"cacheFile,omitempty"`
+}
+
+// tailnet is a tailnet whose policy file gitops-pusher manages.
+type tailnet struct {
+	name       string
+	apiKeyEnv  string
+	apiKey     string // empty if apiKeyEnv isn't set
+	policyFile string
+	cacheFile  string
+}
+
+// LoadConfig loads the Config in the HuJSON file fname and returns its
+// tailnets.
+func LoadConfig(fname string) ([]*tailnet, error) {
+	b, err := os.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	b, err = hujson.Standardize(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fname, err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	var c Config
+	if err := dec.Decode(&c); err != nil {
+		return nil, fmt.Errorf("%s: %w", fname, err)
+	}
+	if len(c.Tailnets) == 0 {
+		return nil, fmt.Errorf("%s: no tailnets", fname)
+	}
+
+	dir := filepath.Dir(fname)
+	rel := func(path string) string {
+		if filepath.IsAbs(path) {
+			return path
+		}
+		return filepath.Join(dir, path)
+	}
+	seen := map[string]bool{}
+	var ret []*tailnet
+	for i, tc := range c.Tailnets {
+		if tc.Tailnet == "" {
+			return nil, fmt.Errorf("%s: tailnets[%d]: missing tailnet", fname, i)
+		}
+		if seen[tc.Tailnet] {
+			return nil, fmt.Errorf("%s: duplicate tailnet %q", fname, tc.Tailnet)
+		}
+		seen[tc.Tailnet] = true
+		if tc.PolicyFile == "" {
+			return nil, fmt.Errorf("%s: tailnet %q: missing policyFile", fname, tc.Tailnet)
+		}
+		t := &tailnet{
+			name:       tc.Tailnet,
+			apiKeyEnv:  tc.APIKeyEnv,
+			policyFile: rel(tc.PolicyFile),
+			cacheFile:  tc.CacheFile,
+		}
+		if t.apiKeyEnv == "" {
+			t.apiKeyEnv = "TS_API_KEY"
+		}
+		t.apiKey = os.Getenv(t.apiKeyEnv)
+		if t.cacheFile == "" {
+			t.cacheFile = "version-cache-" + tc.Tailnet + ".json"
+		}
+		t.cacheFile = rel(t.cacheFile)
+		ret = append(ret, t)
+	}
+	return ret, nil
+}
+
+// tailnetFromEnv returns the single tailnet configured by the TS_TAILNET
+// and TS_API_KEY environment variables and the --policy-file and
+// --cache-file flags, for when there's no --config.
+func tailnetFromEnv() (*tailnet, error) {
+	name, ok := os.LookupEnv("TS_TAILNET")
+	if !ok {
+		return nil, errors.New("set envvar TS_TAILNET to your tailnet's name, or use --config")
+	}
+	return &tailnet{
+		name:       name,
+		apiKeyEnv:  "TS_API_KEY",
+		apiKey:     os.Getenv("TS_API_KEY"),
+		policyFile: *policyFname,
+		cacheFile:  *cacheFname,
+	}, nil
+}
+
+// checkAPIKey returns an error if t has no API key.
+func (t *tailnet) checkAPIKey() error {
+	if t.apiKey == "" {
+		return fmt.Errorf("set envvar %s to the Tailscale API key for %s", t.apiKeyEnv, t.name)
+	}
+	return nil
+}
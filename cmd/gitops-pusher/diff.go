@@ -0,0 +1,209 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+
+	"github.com/tailscale/hujson"
+)
+
+// diffPolicies writes to w a semantic diff between the policy files
+// old and new: differences in comments, formatting and key order are
+// ignored, and each change is printed as the path to the changed
+// value, prefixed by "-" for the old value and "+" for the new one.
+// It reports whether there were any changes.
+func diffPolicies(w io.Writer, old, new []byte) (changed bool, err error) {
+	ov, err := decodePolicyValue(old)
+	if err != nil {
+		return false, fmt.Errorf("old policy: %w", err)
+	}
+	nv, err := decodePolicyValue(new)
+	if err != nil {
+		return false, fmt.Errorf("new policy: %w", err)
+	}
+	d := &differ{w: w}
+	d.diff("", ov, nv)
+	return d.changed, nil
+}
+
+func decodePolicyValue(b []byte) (any, error) {
+	b, err := hujson.Standardize(b)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+type differ struct {
+	w       io.Writer
+	changed bool
+}
+
+func (d *differ) removed(path string, v any) {
+	d.changed = true
+	fmt.Fprintf(d.w, "- %s: %s\n", pathOrRoot(path), compactJSON(v))
+}
+
+func (d *differ) added(path string, v any) {
+	d.changed = true
+	fmt.Fprintf(d.w, "+ %s: %s\n", pathOrRoot(path), compactJSON(v))
+}
+
+func (d *differ) diff(path string, a, b any) {
+	switch a := a.(type) {
+	case map[string]any:
+		if b, ok := b.(map[string]any); ok {
+			d.diffObjects(path, a, b)
+			return
+		}
+	case []any:
+		if b, ok := b.([]any); ok {
+			d.diffArrays(path, a, b)
+			return
+		}
+	}
+	if compactJSON(a) != compactJSON(b) {
+		d.removed(path, a)
+		d.added(path, b)
+	}
+}
+
+func (d *differ) diffObjects(path string, a, b map[string]any) {
+	keys := make([]string, 0, len(a)+len(b))
+	for k := range a {
+		keys = append(keys, k)
+	}
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		av, inA := a[k]
+		bv, inB := b[k]
+		p := path + keyPath(k)
+		switch {
+		case !inB:
+			d.removed(p, av)
+		case !inA:
+			d.added(p, bv)
+		default:
+			d.diff(p, av, bv)
+		}
+	}
+}
+
+// diffArrays diffs two arrays by their longest common subsequence, so
+// that inserting or removing an element (such as an ACL rule) doesn't
+// show up as a change to every element after it. Where elements were
+// removed and others added in their place, the pairs are diffed
+// recursively.
+func (d *differ) diffArrays(path string, a, b []any) {
+	as := make([]string, len(a))
+	for i, v := range a {
+		as[i] = compactJSON(v)
+	}
+	bs := make([]string, len(b))
+	for i, v := range b {
+		bs[i] = compactJSON(v)
+	}
+	// lcs[i][j] is the length of the LCS of as[i:] and bs[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if as[i] == bs[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var dels, adds []int // pending indexes into a and b
+	flush := func() {
+		n := len(dels)
+		if len(adds) < n {
+			n = len(adds)
+		}
+		for k := 0; k < n; k++ {
+			d.diff(fmt.Sprintf("%s[%d]", path, adds[k]), a[dels[k]], b[adds[k]])
+		}
+		for _, i := range dels[n:] {
+			d.removed(fmt.Sprintf("%s[%d]", path, i), a[i])
+		}
+		for _, j := range adds[n:] {
+			d.added(fmt.Sprintf("%s[%d]", path, j), b[j])
+		}
+		dels, adds = dels[:0], adds[:0]
+	}
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && as[i] == bs[j]:
+			flush()
+			i++
+			j++
+		case j == len(b) || (i < len(a) && lcs[i+1][j] >= lcs[i][j+1]):
+			dels = append(dels, i)
+			i++
+		default:
+			adds = append(adds, j)
+			j++
+		}
+	}
+	flush()
+}
+
+func pathOrRoot(path string) string {
+	if path == "" {
+		return "(policy)"
+	}
+	if path[0] == '.' {
+		return path[1:]
+	}
+	return path
+}
+
+// keyPath returns the path element for the object key k: ".k" if k is
+// an identifier, or else `["k"]`.
+func keyPath(k string) string {
+	ident := k != ""
+	for i, r := range k {
+		if !(r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || i > 0 && r >= '0' && r <= '9') {
+			ident = false
+			break
+		}
+	}
+	if ident {
+		return "." + k
+	}
+	return "[" + strconv.Quote(k) + "]"
+}
+
+func compactJSON(v any) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(b)
+}
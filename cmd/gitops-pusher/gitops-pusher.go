@@ -8,11 +8,14 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
@@ -22,163 +25,279 @@
 
 	"github.com/peterbourgon/ff/v3/ffcli"
 	"github.com/tailscale/hujson"
+	"tailscale.com/policyfile"
+	"tailscale.com/util/multierr"
 )
 
 var (
 	rootFlagSet  = flag.NewFlagSet("gitops-pusher", flag.ExitOnError)
 	policyFname  = rootFlagSet.String("policy-file", "./policy.hujson", "filename for policy file")
 	cacheFname   = rootFlagSet.String("cache-file", "./version-cache.json", "filename for the previous known version hash")
+	configFname  = rootFlagSet.String("config", "", "if non-empty, a HuJSON file listing the tailnets and policy files to manage, instead of TS_TAILNET, --policy-file and --cache-file")
+	apiServer    = rootFlagSet.String("api-server", "https://api.tailscale.com", "base URL of the Tailscale API")
 	timeout      = rootFlagSet.Duration("timeout", 5*time.Minute, "timeout for the entire CI run")
 	githubSyntax = rootFlagSet.Bool("github-syntax", true, "use GitHub Action error syntax (https://docs.github.com/en/actions/using-workflows/workflow-commands-for-github-actions#setting-an-error-message)")
 
+	testFlagSet = flag.NewFlagSet("test", flag.ExitOnError)
+	testLocal   = testFlagSet.Bool("local", false, "only run the policy's tests locally, without validating the policy with the API")
+
 	modifiedExternallyFailure = make(chan struct{}, 1)
 )
 
-func modifiedExternallyError() {
+func modifiedExternallyError(t *tailnet) {
 	if *githubSyntax {
-		fmt.Printf("::error file=%s,line=1,col=1,title=Policy File Modified Externally::The policy file was modified externally in the admin console.\n", *policyFname)
+		fmt.Printf("::error file=%s,line=1,col=1,title=Policy File Modified Externally::The policy file for %s was modified externally in the admin console.\n", t.policyFile, t.name)
 	} else {
-		fmt.Printf("The policy file was modified externally in the admin console.\n")
+		fmt.Printf("The policy file for %s was modified externally in the admin console.\n", t.name)
+	}
+	select {
+	case modifiedExternallyFailure <- struct{}{}:
+	default:
+	}
+}
+
+// loadTailnets returns the tailnets to operate on, from --config if
+// set, or else from the environment.
+func loadTailnets() ([]*tailnet, error) {
+	if *configFname != "" {
+		return LoadConfig(*configFname)
+	}
+	t, err := tailnetFromEnv()
+	if err != nil {
+		return nil, err
 	}
-	modifiedExternallyFailure <- struct{}{}
+	return []*tailnet{t}, nil
 }
 
-func apply(cache *Cache, tailnet, apiKey string) func(context.Context, []string) error {
+// forEachTailnet returns an ffcli Exec func that runs fn for each
+// tailnet with its cache, saving the cache afterwards if fn changed it.
+// It runs fn for all tailnets even if some fail.
+func forEachTailnet(fn func(context.Context, *tailnet, *Cache) error) func(context.Context, []string) error {
 	return func(ctx context.Context, args []string) error {
-		controlEtag, err := getACLETag(ctx, tailnet, apiKey)
+		tailnets, err := loadTailnets()
 		if err != nil {
 			return err
 		}
-
-		localEtag, err := sumFile(*policyFname)
-		if err != nil {
-			return err
+		var errs []error
+		for _, t := range tailnets {
+			if len(tailnets) > 1 {
+				log.Printf("tailnet %s:", t.name)
+			}
+			cache, err := LoadCache(t.cacheFile)
+			if err != nil {
+				if !os.IsNotExist(err) {
+					return fmt.Errorf("error loading cache: %w", err)
+				}
+				cache = &Cache{}
+			}
+			orig := *cache
+			err = fn(ctx, t, cache)
+			if *cache != orig {
+				if err := cache.Save(t.cacheFile); err != nil {
+					errs = append(errs, fmt.Errorf("saving cache for %s: %w", t.name, err))
+				}
+			}
+			if err != nil {
+				if len(tailnets) > 1 {
+					err = fmt.Errorf("%s: %w", t.name, err)
+				}
+				errs = append(errs, err)
+			}
 		}
+		return multierr.New(errs...)
+	}
+}
 
-		if cache.PrevETag == "" {
-			log.Println("no previous etag found, assuming local file is correct and recording that")
-			cache.PrevETag = localEtag
-		}
+func apply(ctx context.Context, t *tailnet, cache *Cache) error {
+	controlEtag, err := getACLETag(ctx, t)
+	if err != nil {
+		return err
+	}
 
-		log.Printf("control: %s", controlEtag)
-		log.Printf("local:   %s", localEtag)
-		log.Printf("cache:   %s", cache.PrevETag)
+	localEtag, err := sumFile(t.policyFile)
+	if err != nil {
+		return err
+	}
 
-		if cache.PrevETag != controlEtag {
-			modifiedExternallyError()
-		}
+	if cache.PrevETag == "" {
+		log.Println("no previous etag found, assuming local file is correct and recording that")
+		cache.PrevETag = localEtag
+	}
 
-		if controlEtag == localEtag {
-			cache.PrevETag = localEtag
-			log.Println("no update needed, doing nothing")
-			return nil
-		}
+	log.Printf("control: %s", controlEtag)
+	log.Printf("local:   %s", localEtag)
+	log.Printf("cache:   %s", cache.PrevETag)
 
-		if err := applyNewACL(ctx, tailnet, apiKey, *policyFname, controlEtag); err != nil {
-			return err
-		}
+	if cache.PrevETag != controlEtag {
+		modifiedExternallyError(t)
+	}
 
+	if controlEtag == localEtag {
 		cache.PrevETag = localEtag
-
+		log.Println("no update needed, doing nothing")
 		return nil
 	}
-}
-
-func test(cache *Cache, tailnet, apiKey string) func(context.Context, []string) error {
-	return func(ctx context.Context, args []string) error {
-		controlEtag, err := getACLETag(ctx, tailnet, apiKey)
-		if err != nil {
-			return err
-		}
-
-		localEtag, err := sumFile(*policyFname)
-		if err != nil {
-			return err
-		}
-
-		if cache.PrevETag == "" {
-			log.Println("no previous etag found, assuming local file is correct and recording that")
-			cache.PrevETag = localEtag
-		}
 
-		log.Printf("control: %s", controlEtag)
-		log.Printf("local:   %s", localEtag)
-		log.Printf("cache:   %s", cache.PrevETag)
+	if err := applyNewACL(ctx, t, controlEtag); err != nil {
+		return err
+	}
 
-		if cache.PrevETag != controlEtag {
-			modifiedExternallyError()
-		}
+	cache.PrevETag = localEtag
 
-		if controlEtag == localEtag {
-			log.Println("no updates found, doing nothing")
-			return nil
-		}
+	return nil
+}
 
-		if err := testNewACLs(ctx, tailnet, apiKey, *policyFname); err != nil {
-			return err
-		}
+func test(ctx context.Context, t *tailnet, cache *Cache) error {
+	if err := runLocalTests(t); err != nil {
+		return err
+	}
+	if *testLocal {
 		return nil
 	}
-}
 
-func getChecksums(cache *Cache, tailnet, apiKey string) func(context.Context, []string) error {
-	return func(ctx context.Context, args []string) error {
-		controlEtag, err := getACLETag(ctx, tailnet, apiKey)
-		if err != nil {
-			return err
-		}
+	controlEtag, err := getACLETag(ctx, t)
+	if err != nil {
+		return err
+	}
 
-		localEtag, err := sumFile(*policyFname)
-		if err != nil {
-			return err
-		}
+	localEtag, err := sumFile(t.policyFile)
+	if err != nil {
+		return err
+	}
 
-		if cache.PrevETag == "" {
-			log.Println("no previous etag found, assuming local file is correct and recording that")
-			cache.PrevETag = Shuck(localEtag)
-		}
+	if cache.PrevETag == "" {
+		log.Println("no previous etag found, assuming local file is correct and recording that")
+		cache.PrevETag = localEtag
+	}
 
-		log.Printf("control: %s", controlEtag)
-		log.Printf("local:   %s", localEtag)
-		log.Printf("cache:   %s", cache.PrevETag)
+	log.Printf("control: %s", controlEtag)
+	log.Printf("local:   %s", localEtag)
+	log.Printf("cache:   %s", cache.PrevETag)
+
+	if cache.PrevETag != controlEtag {
+		modifiedExternallyError(t)
+	}
 
+	if controlEtag == localEtag {
+		log.Println("no updates found, doing nothing")
 		return nil
 	}
+
+	if err := testNewACLs(ctx, t); err != nil {
+		return err
+	}
+	return nil
 }
 
-func main() {
-	tailnet, ok := os.LookupEnv("TS_TAILNET")
-	if !ok {
-		log.Fatal("set envvar TS_TAILNET to your tailnet's name")
+// runLocalTests runs the tests in t's policy file against its ACLs,
+// without using the API.
+func runLocalTests(t *tailnet) error {
+	data, err := os.ReadFile(t.policyFile)
+	if err != nil {
+		return err
+	}
+	p, err := policyfile.Parse(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", t.policyFile, err)
 	}
-	apiKey, ok := os.LookupEnv("TS_API_KEY")
-	if !ok {
-		log.Fatal("set envvar TS_API_KEY to your Tailscale API key")
+	e, err := newEvaluator(p)
+	if err != nil {
+		return fmt.Errorf("%s: %w", t.policyFile, err)
 	}
-	cache, err := LoadCache(*cacheFname)
+	failures, err := e.runTests()
 	if err != nil {
-		if os.IsNotExist(err) {
-			cache = &Cache{}
+		return fmt.Errorf("%s: %w", t.policyFile, err)
+	}
+	if len(failures) == 0 {
+		log.Printf("%s: %d local ACL tests passed", t.policyFile, len(p.Tests))
+		return nil
+	}
+	for _, f := range failures {
+		if *githubSyntax {
+			fmt.Printf("::error file=%s,line=1,col=1,title=ACL Test Failed::%s\n", t.policyFile, f)
 		} else {
-			log.Fatalf("error loading cache: %v", err)
+			fmt.Println(f)
 		}
 	}
-	defer cache.Save(*cacheFname)
+	return fmt.Errorf("%s: %d of %d local ACL tests failed", t.policyFile, len(failures), len(p.Tests))
+}
+
+func diff(ctx context.Context, t *tailnet, cache *Cache) error {
+	controlACL, _, err := getACL(ctx, t)
+	if err != nil {
+		return err
+	}
+	localACL, err := os.ReadFile(t.policyFile)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "--- %s (control)\n+++ %s\n", t.name, t.policyFile)
+	changed, err := diffPolicies(&buf, controlACL, localACL)
+	if err != nil {
+		return err
+	}
+	if !changed {
+		fmt.Printf("%s: no changes\n", t.name)
+		return nil
+	}
+	_, err = os.Stdout.Write(buf.Bytes())
+	return err
+}
+
+func getChecksums(ctx context.Context, t *tailnet, cache *Cache) error {
+	controlEtag, err := getACLETag(ctx, t)
+	if err != nil {
+		return err
+	}
+
+	localEtag, err := sumFile(t.policyFile)
+	if err != nil {
+		return err
+	}
+
+	if cache.PrevETag == "" {
+		log.Println("no previous etag found, assuming local file is correct and recording that")
+		cache.PrevETag = Shuck(localEtag)
+	}
+
+	log.Printf("control: %s", controlEtag)
+	log.Printf("local:   %s", localEtag)
+	log.Printf("cache:   %s", cache.PrevETag)
+
+	return nil
+}
 
+func main() {
 	applyCmd := &ffcli.Command{
 		Name:       "apply",
 		ShortUsage: "gitops-pusher [options] apply",
 		ShortHelp:  "Pushes changes to CONTROL",
 		LongHelp:   `Pushes changes to CONTROL`,
-		Exec:       apply(cache, tailnet, apiKey),
+		Exec:       forEachTailnet(apply),
 	}
 
 	testCmd := &ffcli.Command{
 		Name:       "test",
-		ShortUsage: "gitops-pusher [options] test",
+		ShortUsage: "gitops-pusher [options] test [--local]",
 		ShortHelp:  "Tests ACL changes",
-		LongHelp:   "Tests ACL changes",
-		Exec:       test(cache, tailnet, apiKey),
+		LongHelp: strings.TrimSpace(`
+Tests ACL changes.
+
+The tests in the policy file's "tests" section are first run locally,
+using the same packet filter logic as tailscaled. Then, unless --local
+is given, the policy file is validated by CONTROL.
+`),
+		FlagSet: testFlagSet,
+		Exec:    forEachTailnet(test),
+	}
+
+	diffCmd := &ffcli.Command{
+		Name:       "diff",
+		ShortUsage: "gitops-pusher [options] diff",
+		ShortHelp:  "Shows what applying would change",
+		LongHelp:   "Prints a semantic diff between CONTROL's policy file and the local one, ignoring comments and formatting",
+		Exec:       forEachTailnet(diff),
 	}
 
 	cksumCmd := &ffcli.Command{
@@ -186,13 +305,13 @@ func main() {
 		ShortUsage: "Shows checksums of ACL files",
 		ShortHelp:  "Fetch checksum of CONTROL's ACL and the local ACL for comparison",
 		LongHelp:   "Fetch checksum of CONTROL's ACL and the local ACL for comparison",
-		Exec:       getChecksums(cache, tailnet, apiKey),
+		Exec:       forEachTailnet(getChecksums),
 	}
 
 	root := &ffcli.Command{
 		ShortUsage:  "gitops-pusher [options] <command>",
 		ShortHelp:   "Push Tailscale ACLs to CONTROL using a GitOps workflow",
-		Subcommands: []*ffcli.Command{applyCmd, cksumCmd, testCmd},
+		Subcommands: []*ffcli.Command{applyCmd, cksumCmd, diffCmd, testCmd},
 		FlagSet:     rootFlagSet,
 	}
 
@@ -233,19 +352,27 @@ func sumFile(fname string) (string, error) {
 	return fmt.Sprintf("%x", h.Sum(nil)), nil
 }
 
-func applyNewACL(ctx context.Context, tailnet, apiKey, policyFname, oldEtag string) error {
-	fin, err := os.Open(policyFname)
+// aclURL returns the API URL for t's policy file, plus suffix.
+func aclURL(t *tailnet, suffix string) string {
+	return fmt.Sprintf("%s/api/v2/tailnet/%s/acl%s", strings.TrimSuffix(*apiServer, "/"), t.name, suffix)
+}
+
+func applyNewACL(ctx context.Context, t *tailnet, oldEtag string) error {
+	if err := t.checkAPIKey(); err != nil {
+		return err
+	}
+	fin, err := os.Open(t.policyFile)
 	if err != nil {
 		return err
 	}
 	defer fin.Close()
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("https://api.tailscale.com/api/v2/tailnet/%s/acl", tailnet), fin)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, aclURL(t, ""), fin)
 	if err != nil {
 		return err
 	}
 
-	req.SetBasicAuth(apiKey, "")
+	req.SetBasicAuth(t.apiKey, "")
 	req.Header.Set("Content-Type", "application/hujson")
 	req.Header.Set("If-Match", `"`+oldEtag+`"`)
 
@@ -258,7 +385,7 @@ func applyNewACL(ctx context.Context, tailnet, apiKey, policyFname, oldEtag stri
 	got := resp.StatusCode
 	want := http.StatusOK
 	if got != want {
-		var ate ACLTestError
+		ate := ACLTestError{policyFile: t.policyFile}
 		err := json.NewDecoder(resp.Body).Decode(&ate)
 		if err != nil {
 			return err
@@ -270,19 +397,22 @@ func applyNewACL(ctx context.Context, tailnet, apiKey, policyFname, oldEtag stri
 	return nil
 }
 
-func testNewACLs(ctx context.Context, tailnet, apiKey, policyFname string) error {
-	fin, err := os.Open(policyFname)
+func testNewACLs(ctx context.Context, t *tailnet) error {
+	if err := t.checkAPIKey(); err != nil {
+		return err
+	}
+	fin, err := os.Open(t.policyFile)
 	if err != nil {
 		return err
 	}
 	defer fin.Close()
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("https://api.tailscale.com/api/v2/tailnet/%s/acl/validate", tailnet), fin)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, aclURL(t, "/validate"), fin)
 	if err != nil {
 		return err
 	}
 
-	req.SetBasicAuth(apiKey, "")
+	req.SetBasicAuth(t.apiKey, "")
 	req.Header.Set("Content-Type", "application/hujson")
 
 	resp, err := http.DefaultClient.Do(req)
@@ -291,7 +421,7 @@ func testNewACLs(ctx context.Context, tailnet, apiKey, policyFname string) error
 	}
 	defer resp.Body.Close()
 
-	var ate ACLTestError
+	ate := ACLTestError{policyFile: t.policyFile}
 	err = json.NewDecoder(resp.Body).Decode(&ate)
 	if err != nil {
 		return err
@@ -315,6 +445,8 @@ func testNewACLs(ctx context.Context, tailnet, apiKey, policyFname string) error
 type ACLTestError struct {
 	Message string               `json:"message"`
 	Data    []ACLTestErrorDetail `json:"data"`
+
+	policyFile string // the file the error is about
 }
 
 func (ate ACLTestError) Error() string {
@@ -327,7 +459,7 @@ func (ate ACLTestError) Error() string {
 		col := sp[2]
 		msg := sp[3]
 
-		fmt.Fprintf(&sb, "::error file=%s,line=%s,col=%s::%s", *policyFname, line, col, msg)
+		fmt.Fprintf(&sb, "::error file=%s,line=%s,col=%s::%s", ate.policyFile, line, col, msg)
 	} else {
 		fmt.Fprintln(&sb, ate.Message)
 	}
@@ -348,26 +480,44 @@ type ACLTestErrorDetail struct {
 	Errors []string `json:"errors"`
 }
 
-func getACLETag(ctx context.Context, tailnet, apiKey string) (string, error) {
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("https://api.tailscale.com/api/v2/tailnet/%s/acl", tailnet), nil)
+func getACLETag(ctx context.Context, t *tailnet) (string, error) {
+	_, etag, err := getACL(ctx, t)
+	return etag, err
+}
+
+// getACL returns CONTROL's current policy file for t, in HuJSON, and
+// its ETag.
+func getACL(ctx context.Context, t *tailnet) (acl []byte, etag string, err error) {
+	if err := t.checkAPIKey(); err != nil {
+		return nil, "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, aclURL(t, ""), nil)
 	if err != nil {
-		return "", err
+		return nil, "", err
 	}
 
-	req.SetBasicAuth(apiKey, "")
+	req.SetBasicAuth(t.apiKey, "")
 	req.Header.Set("Accept", "application/hujson")
 
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		return "", err
+		return nil, "", err
 	}
 	defer resp.Body.Close()
 
 	got := resp.StatusCode
 	want := http.StatusOK
 	if got != want {
-		return "", fmt.Errorf("wanted HTTP status code %d but got %d", want, got)
+		return nil, "", fmt.Errorf("wanted HTTP status code %d but got %d", want, got)
 	}
 
-	return Shuck(resp.Header.Get("ETag")), nil
+	etag = resp.Header.Get("ETag")
+	if len(etag) < 2 {
+		return nil, "", errors.New("missing ETag in response")
+	}
+	acl, err = io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	return acl, Shuck(etag), nil
 }
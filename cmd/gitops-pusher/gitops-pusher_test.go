@@ -0,0 +1,234 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/tailscale/hujson"
+	"tailscale.com/policyfile"
+)
+
+// fakeAPI is a stand-in for the policy file endpoints of the Tailscale
+// API.
+type fakeAPI struct {
+	keys map[string]string // tailnet => API key
+
+	mu        sync.Mutex
+	acls      map[string][]byte // tailnet => policy file
+	posts     int
+	validates int
+}
+
+func etagOf(acl []byte) string {
+	formatted, err := hujson.Format(acl)
+	if err != nil {
+		panic(err)
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(formatted))
+}
+
+func (f *fakeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/api/v2/tailnet/")
+	name, endpoint, _ := strings.Cut(rest, "/")
+	if key, _, _ := r.BasicAuth(); key == "" || key != f.keys[name] {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case endpoint == "acl" && r.Method == "GET":
+		w.Header().Set("ETag", `"`+etagOf(f.acls[name])+`"`)
+		w.Write(f.acls[name])
+	case endpoint == "acl" && r.Method == "POST":
+		f.posts++
+		body, _ := io.ReadAll(r.Body)
+		if r.Header.Get("If-Match") != `"`+etagOf(f.acls[name])+`"` {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			json.NewEncoder(w).Encode(ACLTestError{Message: "precondition failed"})
+			return
+		}
+		f.acls[name] = body
+		w.Write(body)
+	case endpoint == "acl/validate" && r.Method == "POST":
+		f.validates++
+		body, _ := io.ReadAll(r.Body)
+		if _, err := policyfile.Parse(body); err != nil {
+			json.NewEncoder(w).Encode(ACLTestError{Message: err.Error()})
+			return
+		}
+		w.Write([]byte("{}"))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func setFlag[T any](t *testing.T, p *T, v T) {
+	old := *p
+	*p = v
+	t.Cleanup(func() { *p = old })
+}
+
+func TestMultiTailnet(t *testing.T) {
+	const (
+		policyA = `{"acls": [{"action": "accept", "src": ["*"], "dst": ["*:*"]}]}`
+		policyB = `{
+			"tagOwners": {"tag:web": []},
+			"acls": [{"action": "accept", "src": ["autogroup:members"], "dst": ["tag:web:443"]}],
+			"tests": [{"src": "alice@b.example", "accept": ["tag:web:443"], "deny": ["tag:web:22"]}],
+		}`
+	)
+	api := &fakeAPI{
+		keys: map[string]string{"a.example": "key-a", "b.example": "key-b"},
+		acls: map[string][]byte{
+			"a.example": []byte(`{"acls": []}`),
+			"b.example": []byte(`{"acls": []}`),
+		},
+	}
+	srv := httptest.NewServer(api)
+	defer srv.Close()
+
+	dir := t.TempDir()
+	writeFile := func(name, contents string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile("a.hujson", policyA)
+	writeFile("b.hujson", policyB)
+	writeFile("config.hujson", `{
+		"tailnets": [
+			{"tailnet": "a.example", "policyFile": "a.hujson"},
+			{"tailnet": "b.example", "policyFile": "b.hujson", "apiKeyEnv": "TS_API_KEY_B", "cacheFile": "b-cache.json"},
+		],
+	}`)
+	t.Setenv("TS_API_KEY", "key-a")
+	t.Setenv("TS_API_KEY_B", "key-b")
+	setFlag(t, configFname, filepath.Join(dir, "config.hujson"))
+	setFlag(t, apiServer, srv.URL)
+	setFlag(t, githubSyntax, false)
+	ctx := context.Background()
+
+	if err := forEachTailnet(apply)(ctx, nil); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	if got := string(api.acls["a.example"]); got != policyA {
+		t.Errorf("a.example policy = %q", got)
+	}
+	if got := string(api.acls["b.example"]); got != policyB {
+		t.Errorf("b.example policy = %q", got)
+	}
+	for _, cf := range []string{"version-cache-a.example.json", "b-cache.json"} {
+		if _, err := LoadCache(filepath.Join(dir, cf)); err != nil {
+			t.Errorf("cache: %v", err)
+		}
+	}
+	// With no cache, the local policy files are assumed to be the last
+	// ones pushed, so CONTROL's differing ones look modified.
+	if len(modifiedExternallyFailure) != 1 {
+		t.Errorf("external modification not detected")
+	}
+	<-modifiedExternallyFailure
+
+	// Applying again is a no-op.
+	if err := forEachTailnet(apply)(ctx, nil); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	if api.posts != 2 {
+		t.Errorf("posts = %d; want 2", api.posts)
+	}
+	if len(modifiedExternallyFailure) != 0 {
+		t.Errorf("unexpected external modification")
+	}
+
+	// Local tests pass, and there's nothing to validate remotely.
+	if err := forEachTailnet(test)(ctx, nil); err != nil {
+		t.Errorf("test: %v", err)
+	}
+	if api.validates != 0 {
+		t.Errorf("validates = %d; want 0", api.validates)
+	}
+
+	// A change that breaks b's tests fails locally, before the API is
+	// asked to validate it.
+	writeFile("b.hujson", strings.Replace(policyB, "tag:web:443", "tag:web:*", 1))
+	err := forEachTailnet(test)(ctx, nil)
+	if err == nil || !strings.Contains(err.Error(), "b.example: ") || !strings.Contains(err.Error(), "1 of 1 local ACL tests failed") {
+		t.Errorf("test: got %v; want local test failure for b.example", err)
+	}
+	if api.validates != 0 {
+		t.Errorf("validates = %d; want 0", api.validates)
+	}
+
+	// A change that passes local tests is validated remotely, unless
+	// --local.
+	writeFile("a.hujson", `{"acls": []}`)
+	setFlag(t, testLocal, true)
+	writeFile("b.hujson", policyB)
+	if err := forEachTailnet(test)(ctx, nil); err != nil {
+		t.Errorf("test --local: %v", err)
+	}
+	if api.validates != 0 {
+		t.Errorf("validates = %d; want 0", api.validates)
+	}
+	*testLocal = false
+	if err := forEachTailnet(test)(ctx, nil); err != nil {
+		t.Errorf("test: %v", err)
+	}
+	if api.validates != 1 {
+		t.Errorf("validates = %d; want 1", api.validates)
+	}
+
+	if err := forEachTailnet(diff)(ctx, nil); err != nil {
+		t.Errorf("diff: %v", err)
+	}
+
+	// Someone edits a's policy in the admin console.
+	api.acls["a.example"] = []byte(`{"acls": [], "hosts": {"x": "1.2.3.4"}}`)
+	if err := forEachTailnet(apply)(ctx, nil); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	if len(modifiedExternallyFailure) != 1 {
+		t.Errorf("external modification not detected")
+	}
+	<-modifiedExternallyFailure
+}
+
+func TestMissingAPIKey(t *testing.T) {
+	dir := t.TempDir()
+	policy := filepath.Join(dir, "policy.hujson")
+	if err := os.WriteFile(policy, []byte(`{"acls": []}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TS_TAILNET", "example.com")
+	t.Setenv("TS_API_KEY", "")
+	setFlag(t, configFname, "")
+	setFlag(t, policyFname, policy)
+	setFlag(t, cacheFname, filepath.Join(dir, "cache.json"))
+
+	err := forEachTailnet(apply)(context.Background(), nil)
+	if err == nil || !strings.Contains(err.Error(), "set envvar TS_API_KEY") {
+		t.Errorf("apply: got %v; want missing API key error", err)
+	}
+
+	// Local tests don't need the API.
+	setFlag(t, testLocal, true)
+	if err := forEachTailnet(test)(context.Background(), nil); err != nil {
+		t.Errorf("test --local: %v", err)
+	}
+}
@@ -0,0 +1,247 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"inet.af/netaddr"
+	"tailscale.com/policyfile"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/logger"
+	"tailscale.com/wgengine/filter"
+)
+
+// evaluator evaluates a Policy's ACLs with the same packet filter
+// that tailscaled uses.
+//
+// As a policy file doesn't say which nodes exist, every user and tag
+// that the policy mentions is given a made-up node, with addresses
+// from ranges that real tailnets don't use.
+type evaluator struct {
+	p     *policyfile.Policy
+	addrs map[string][]netaddr.IPPrefix // by user login name or tag
+	users []string                      // sorted
+	filt  *filter.Filter
+}
+
+var (
+	nodeRange4 = netaddr.MustParseIPPrefix("240.0.0.0/8")
+	nodeRange6 = netaddr.MustParseIPPrefix("fd00:6769:746f:7073::/64")
+)
+
+func newEvaluator(p *policyfile.Policy) (*evaluator, error) {
+	e := &evaluator{p: p, addrs: map[string][]netaddr.IPPrefix{}}
+
+	var ids []string
+	addID := func(sel string) {
+		switch {
+		case sel == "*", strings.HasPrefix(sel, "group:"), strings.HasPrefix(sel, "autogroup:"):
+			return
+		}
+		if _, ok := p.Hosts[sel]; ok {
+			return
+		}
+		if _, err := policyfile.ParseIPOrPrefix(sel); err == nil {
+			return
+		}
+		if _, ok := e.addrs[sel]; !ok {
+			e.addrs[sel] = nil
+			ids = append(ids, sel)
+		}
+	}
+	for _, members := range p.Groups {
+		for _, m := range members {
+			addID(m)
+		}
+	}
+	for tag, owners := range p.TagOwners {
+		addID(tag)
+		for _, o := range owners {
+			addID(o)
+		}
+	}
+	for _, a := range p.ACLs {
+		for _, s := range a.Src {
+			addID(s)
+		}
+		for _, d := range a.Dst {
+			sel, _, _ := policyfile.SplitDst(d)
+			addID(sel)
+		}
+	}
+	for _, t := range p.Tests {
+		addID(t.Src)
+		for _, d := range append(append([]string(nil), t.Accept...), t.Deny...) {
+			sel, _, _ := policyfile.SplitTestDst(d)
+			addID(sel)
+		}
+	}
+	sort.Strings(ids)
+	if len(ids) >= 1<<16 {
+		return nil, errors.New("too many users and tags")
+	}
+	for i, id := range ids {
+		n := i + 1
+		a4 := nodeRange4.IP().As4()
+		a4[2], a4[3] = byte(n>>8), byte(n)
+		a16 := nodeRange6.IP().As16()
+		a16[14], a16[15] = byte(n>>8), byte(n)
+		e.addrs[id] = []netaddr.IPPrefix{
+			netaddr.IPPrefixFrom(netaddr.IPFrom4(a4), 32),
+			netaddr.IPPrefixFrom(netaddr.IPFrom16(a16), 128),
+		}
+		if !strings.HasPrefix(id, "tag:") {
+			e.users = append(e.users, id)
+		}
+	}
+
+	var rules []tailcfg.FilterRule
+	for i, a := range p.ACLs {
+		var srcIPs []string
+		for _, s := range a.Src {
+			pfxs, err := e.resolve(s)
+			if err != nil {
+				return nil, fmt.Errorf("acls[%d]: %w", i, err)
+			}
+			for _, pfx := range pfxs {
+				srcIPs = append(srcIPs, pfx.String())
+			}
+		}
+		var dstPorts []tailcfg.NetPortRange
+		for _, d := range a.Dst {
+			sel, ports, _ := policyfile.SplitDst(d)
+			pfxs, err := e.resolve(sel)
+			if err != nil {
+				return nil, fmt.Errorf("acls[%d]: %w", i, err)
+			}
+			for _, pfx := range pfxs {
+				for _, pr := range ports {
+					dstPorts = append(dstPorts, tailcfg.NetPortRange{IP: pfx.String(), Ports: pr})
+				}
+			}
+		}
+		proto, _ := policyfile.ParseProto(a.Proto)
+		rules = append(rules, tailcfg.FilterRule{
+			SrcIPs:   srcIPs,
+			DstPorts: dstPorts,
+			IPProto:  proto,
+		})
+	}
+	matches, err := filter.MatchesFromFilterRules(rules)
+	if err != nil {
+		return nil, err
+	}
+	var everything, none netaddr.IPSetBuilder
+	everything.AddPrefix(netaddr.IPPrefixFrom(netaddr.IPv4(0, 0, 0, 0), 0))
+	everything.AddPrefix(netaddr.IPPrefixFrom(netaddr.IPv6Unspecified(), 0))
+	localNets, _ := everything.IPSet()
+	logIPs, _ := none.IPSet()
+	e.filt = filter.New(matches, localNets, logIPs, nil, logger.Discard)
+	return e, nil
+}
+
+// resolve returns the IP prefixes selected by sel.
+func (e *evaluator) resolve(sel string) ([]netaddr.IPPrefix, error) {
+	switch {
+	case sel == "*":
+		return []netaddr.IPPrefix{
+			netaddr.IPPrefixFrom(netaddr.IPv4(0, 0, 0, 0), 0),
+			netaddr.IPPrefixFrom(netaddr.IPv6Unspecified(), 0),
+		}, nil
+	case sel == "autogroup:members":
+		var ret []netaddr.IPPrefix
+		for _, u := range e.users {
+			ret = append(ret, e.addrs[u]...)
+		}
+		return ret, nil
+	case strings.HasPrefix(sel, "autogroup:"):
+		return nil, fmt.Errorf("unsupported %q", sel)
+	case strings.HasPrefix(sel, "group:"):
+		members, ok := e.p.Groups[sel]
+		if !ok {
+			return nil, fmt.Errorf("unknown group %q", sel)
+		}
+		var ret []netaddr.IPPrefix
+		for _, m := range members {
+			ret = append(ret, e.addrs[m]...)
+		}
+		return ret, nil
+	case strings.HasPrefix(sel, "tag:"):
+		if _, ok := e.p.TagOwners[sel]; !ok {
+			return nil, fmt.Errorf("tag %q not in tagOwners", sel)
+		}
+		return e.addrs[sel], nil
+	}
+	if h, ok := e.p.Hosts[sel]; ok {
+		sel = h
+	}
+	if pfx, err := policyfile.ParseIPOrPrefix(sel); err == nil {
+		return []netaddr.IPPrefix{pfx}, nil
+	}
+	if !strings.Contains(sel, "@") {
+		return nil, fmt.Errorf("unknown host %q", sel)
+	}
+	return e.addrs[sel], nil
+}
+
+// runTests runs the policy's tests and returns a description of each
+// failure.
+func (e *evaluator) runTests() (failures []string, err error) {
+	for i, t := range e.p.Tests {
+		if t.Src == "*" {
+			return nil, fmt.Errorf("tests[%d]: src can't be \"*\"", i)
+		}
+		srcs, err := e.resolve(t.Src)
+		if err != nil {
+			return nil, fmt.Errorf("tests[%d]: %w", i, err)
+		}
+		proto, _ := policyfile.ParseTestProto(t.Proto)
+		check := func(dst string, wantAccept bool) error {
+			sel, port, _ := policyfile.SplitTestDst(dst)
+			dsts, err := e.resolve(sel)
+			if err != nil {
+				return err
+			}
+			checked := false
+			for _, src := range srcs {
+				for _, d := range dsts {
+					if src.IP().BitLen() != d.IP().BitLen() {
+						continue
+					}
+					checked = true
+					accepted := e.filt.Check(src.IP(), d.IP(), port, proto) == filter.Accept
+					if accepted == wantAccept {
+						continue
+					}
+					got := "denied"
+					if accepted {
+						got = "accepted"
+					}
+					failures = append(failures, fmt.Sprintf("tests[%d]: %s from %s (%v) to %s (%v) was %s", i, proto, t.Src, src.IP(), dst, d.IP(), got))
+					return nil
+				}
+			}
+			if !checked {
+				return fmt.Errorf("no addresses of the same IP family for %s and %s", t.Src, dst)
+			}
+			return nil
+		}
+		for _, dst := range t.Accept {
+			if err := check(dst, true); err != nil {
+				return nil, fmt.Errorf("tests[%d]: %w", i, err)
+			}
+		}
+		for _, dst := range t.Deny {
+			if err := check(dst, false); err != nil {
+				return nil, fmt.Errorf("tests[%d]: %w", i, err)
+			}
+		}
+	}
+	return failures, nil
+}
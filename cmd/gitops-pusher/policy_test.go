@@ -0,0 +1,200 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"tailscale.com/policyfile"
+)
+
+const testPolicy = `{
+	// Comments are fine.
+	"groups": {
+		"group:eng": ["alice@example.com", "bob@example.com"],
+	},
+	"tagOwners": {
+		"tag:server": ["group:eng"],
+		"tag:db":     ["group:eng"],
+	},
+	"hosts": {
+		"corp": "10.0.0.0/8",
+		"v6":   "fd00::/64",
+	},
+	"acls": [
+		{"action": "accept", "src": ["group:eng"], "dst": ["tag:server:22,80-90"]},
+		{"action": "accept", "src": ["tag:server"], "dst": ["tag:db:5432"]},
+		{"action": "accept", "src": ["carol@example.com"], "dst": ["corp:*"]},
+		{"action": "accept", "proto": "udp", "src": ["autogroup:members"], "dst": ["tag:server:53"]},
+	],
+	"ssh": [{"action": "check", "src": ["group:eng"], "dst": ["tag:server"], "users": ["root"]}],
+	"tests": [
+		{"src": "alice@example.com", "accept": ["tag:server:22", "tag:server:85"], "deny": ["tag:db:5432", "tag:server:443"]},
+		{"src": "group:eng", "accept": ["tag:server:80"]},
+		{"src": "tag:server", "accept": ["tag:db:5432"], "deny": ["alice@example.com:22"]},
+		{"src": "carol@example.com", "accept": ["corp:443", "10.1.2.3:22"], "deny": ["tag:server:22"]},
+		{"src": "carol@example.com", "proto": "udp", "accept": ["tag:server:53"], "deny": ["tag:server:22"]},
+		{"src": "carol@example.com", "deny": ["tag:server:53"]},
+		{"src": "bob@example.com", "deny": ["tag:server:22"]}, // fails
+	],
+}`
+
+func TestRunTests(t *testing.T) {
+	p, err := policyfile.Parse([]byte(testPolicy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := newEvaluator(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	failures, err := e.runTests()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"tests[6]: TCP from bob@example.com (240.0.0.2) to tag:server:22 (240.0.0.5) was accepted",
+	}
+	if !reflect.DeepEqual(failures, want) {
+		t.Errorf("failures:\n%s\nwant:\n%s", strings.Join(failures, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestPolicyErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  string
+		wantErr string
+	}{
+		{
+			name:    "bad-action",
+			policy:  `{"acls": [{"action": "deny", "src": ["*"], "dst": ["*:*"]}]}`,
+			wantErr: `acls[0]: unsupported action "deny"`,
+		},
+		{
+			name:    "bad-port",
+			policy:  `{"acls": [{"action": "accept", "src": ["*"], "dst": ["*:http"]}]}`,
+			wantErr: `invalid port range "http"`,
+		},
+		{
+			name:    "unknown-group",
+			policy:  `{"acls": [{"action": "accept", "src": ["group:nope"], "dst": ["*:*"]}]}`,
+			wantErr: `acls[0]: unknown group "group:nope"`,
+		},
+		{
+			name:    "unowned-tag",
+			policy:  `{"acls": [{"action": "accept", "src": ["*"], "dst": ["tag:nope:*"]}]}`,
+			wantErr: `acls[0]: tag "tag:nope" not in tagOwners`,
+		},
+		{
+			name:    "unknown-host",
+			policy:  `{"acls": [{"action": "accept", "src": ["nope"], "dst": ["*:*"]}]}`,
+			wantErr: `acls[0]: unknown host "nope"`,
+		},
+		{
+			name:    "test-port-range",
+			policy:  `{"acls": [], "tests": [{"src": "a@b", "accept": ["*:1-2"]}]}`,
+			wantErr: `tests[0]: test dst "*:1-2" has invalid port`,
+		},
+		{
+			name:    "test-proto",
+			policy:  `{"acls": [], "tests": [{"src": "a@b", "proto": "icmp"}]}`,
+			wantErr: `tests[0]: unsupported test proto "icmp"`,
+		},
+		{
+			name:    "test-wildcard-src",
+			policy:  `{"acls": [], "tests": [{"src": "*", "accept": ["a@b:22"]}]}`,
+			wantErr: `tests[0]: src can't be "*"`,
+		},
+		{
+			name:    "test-family-mismatch",
+			policy:  `{"hosts": {"v4": "10.0.0.1"}, "acls": [], "tests": [{"src": "fd00::1", "deny": ["v4:22"]}]}`,
+			wantErr: `tests[0]: no addresses of the same IP family`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := policyfile.Parse([]byte(tt.policy))
+			if err == nil {
+				var e *evaluator
+				e, err = newEvaluator(p)
+				if err == nil {
+					_, err = e.runTests()
+				}
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got error %v; want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDiffPolicies(t *testing.T) {
+	tests := []struct {
+		name     string
+		old, new string
+		want     string
+	}{
+		{
+			name: "formatting-only",
+			old:  `{"acls": [{"action": "accept", "src": ["*"], "dst": ["*:*"]}], "hosts": {"a": "1.2.3.4"}}`,
+			new: `{
+				// Reformatted and reordered.
+				"hosts": {"a": "1.2.3.4"},
+				"acls": [
+					{"src": ["*"], "dst": ["*:*"], "action": "accept"},
+				],
+			}`,
+			want: "",
+		},
+		{
+			name: "insert-rule",
+			old:  `{"acls": [{"src": ["a"]}, {"src": ["c"]}]}`,
+			new:  `{"acls": [{"src": ["a"]}, {"src": ["b"]}, {"src": ["c"]}]}`,
+			want: `+ acls[1]: {"src":["b"]}` + "\n",
+		},
+		{
+			name: "change-in-rule",
+			old:  `{"acls": [{"src": ["a"], "dst": ["x:22"]}, {"src": ["c"]}]}`,
+			new:  `{"acls": [{"src": ["a"], "dst": ["x:22", "y:80"]}, {"src": ["c"]}]}`,
+			want: `+ acls[0].dst[1]: "y:80"` + "\n",
+		},
+		{
+			name: "keys",
+			old:  `{"groups": {"group:eng": ["a@b"], "group:old": []}, "n": 1}`,
+			new:  `{"groups": {"group:eng": ["c@d"], "group:new": []}, "n": 2}`,
+			want: `- groups["group:eng"][0]: "a@b"` + "\n" +
+				`+ groups["group:eng"][0]: "c@d"` + "\n" +
+				`+ groups["group:new"]: []` + "\n" +
+				`- groups["group:old"]: []` + "\n" +
+				`- n: 1` + "\n" +
+				`+ n: 2` + "\n",
+		},
+		{
+			name: "remove-trailing",
+			old:  `{"tests": [1, 2, 3]}`,
+			new:  `{"tests": [1]}`,
+			want: "- tests[1]: 2\n- tests[2]: 3\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			changed, err := diffPolicies(&buf, []byte(tt.old), []byte(tt.new))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := buf.String(); got != tt.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, tt.want)
+			}
+			if changed != (tt.want != "") {
+				t.Errorf("changed = %v", changed)
+			}
+		})
+	}
+}
@@ -0,0 +1,360 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"tailscale.com/kube"
+	"tailscale.com/types/logger"
+)
+
+const (
+	// annotationExpose, set to "true" on a Service, exposes it on the
+	// tailnet.
+	annotationExpose = "tailscale.com/expose"
+
+	// annotationHostname optionally sets the tailnet hostname of an
+	// exposed Service. It defaults to "<namespace>-<name>-<hash>"; see
+	// defaultHostname.
+	annotationHostname = "tailscale.com/hostname"
+
+	// labelManaged is set to "true" on the Secrets the operator
+	// creates to hold the state of its proxies.
+	labelManaged = "tailscale.com/managed"
+
+	// labelParentNamespace and labelParentName are set on the Secrets
+	// of proxies to the namespace and name of their Service.
+	labelParentNamespace = "tailscale.com/parent-namespace"
+	labelParentName      = "tailscale.com/parent-name"
+)
+
+// minRetryDelay and maxRetryDelay bound how long reconcile waits before
+// retrying a Service whose proxy failed to start.
+const (
+	minRetryDelay = time.Second
+	maxRetryDelay = 5 * time.Minute
+)
+
+// proxyConfig is the configuration of the proxy for a Service. If it
+// changes, the proxy is restarted.
+type proxyConfig struct {
+	Hostname   string // tailnet hostname
+	SecretName string // in the operator's namespace; holds the node state
+	ClusterIP  string
+	Ports      []int // TCP ports, sorted
+}
+
+// startProxyFunc starts a proxy to a Service, returning a Closer that
+// stops it.
+type startProxyFunc func(cfg proxyConfig) (io.Closer, error)
+
+// controller runs a proxy for each Service annotated for exposure.
+type controller struct {
+	kc         *kube.Client
+	startProxy startProxyFunc
+	logf       logger.Logf
+
+	mu sync.Mutex // guards the following
+	// proxies are the running proxies, keyed by "namespace/name" of
+	// their Service.
+	proxies map[string]*runningProxy
+	// retries are the Services whose proxies failed to start, keyed
+	// like proxies.
+	retries map[string]*retry
+}
+
+type runningProxy struct {
+	cfg proxyConfig
+	c   io.Closer
+}
+
+// retry is a pending retry of reconciling a Service.
+type retry struct {
+	svc   *kube.Service
+	delay time.Duration // doubles after each failure
+	timer *time.Timer
+}
+
+func newController(kc *kube.Client, startProxy startProxyFunc, logf logger.Logf) *controller {
+	return &controller{
+		kc:         kc,
+		startProxy: startProxy,
+		logf:       logf,
+		proxies:    map[string]*runningProxy{},
+		retries:    map[string]*retry{},
+	}
+}
+
+// run lists and watches Services until ctx is done, keeping the
+// proxies in sync with them. It stops all proxies before returning.
+func (c *controller) run(ctx context.Context) error {
+	defer c.stopAll()
+	for {
+		rv, err := c.resync(ctx)
+		if err == nil {
+			err = c.kc.WatchServices(ctx, rv, func(eventType string, svc *kube.Service) error {
+				if eventType == "DELETED" {
+					c.reconcile(ctx, serviceKey(svc), nil)
+				} else {
+					c.reconcile(ctx, serviceKey(svc), svc)
+				}
+				return nil
+			})
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		c.logf("resyncing services: %v", err)
+		select {
+		case <-time.After(time.Second):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// resync lists all Services and reconciles them, stopping proxies for
+// Services that no longer exist and deleting Secrets left behind by
+// them. It returns the resource version of the list to watch from.
+func (c *controller) resync(ctx context.Context) (resourceVersion string, err error) {
+	l, err := c.kc.ListServices(ctx)
+	if err != nil {
+		return "", err
+	}
+	seen := map[string]bool{}
+	exposed := map[string]bool{}
+	for i := range l.Items {
+		svc := &l.Items[i]
+		k := serviceKey(svc)
+		seen[k] = true
+		exposed[k] = svc.Annotations[annotationExpose] == "true"
+		c.reconcile(ctx, k, svc)
+	}
+	c.mu.Lock()
+	var gone []string
+	for k := range c.proxies {
+		if !seen[k] {
+			gone = append(gone, k)
+		}
+	}
+	c.mu.Unlock()
+	for _, k := range gone {
+		c.reconcile(ctx, k, nil)
+	}
+
+	// Delete the state of proxies for Services that went away or were
+	// unexposed while the operator wasn't running.
+	secrets, err := c.kc.ListSecrets(ctx, labelManaged+"=true")
+	if err != nil {
+		return "", err
+	}
+	for _, s := range secrets.Items {
+		k := s.Labels[labelParentNamespace] + "/" + s.Labels[labelParentName]
+		if exposed[k] {
+			continue
+		}
+		c.logf("deleting orphaned secret %s for %s", s.Name, k)
+		if err := c.kc.DeleteSecret(ctx, s.Name); err != nil && !isNotFound(err) {
+			c.logf("deleting secret %s: %v", s.Name, err)
+		}
+	}
+	return l.ResourceVersion, nil
+}
+
+// reconcile makes the proxy for the Service k match svc, which is nil
+// if the Service was deleted. If the proxy can't be started, it's
+// retried with exponential backoff until it starts or svc changes.
+func (c *controller) reconcile(ctx context.Context, k string, svc *kube.Service) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.reconcileLocked(ctx, k, svc)
+}
+
+// reconcileLocked is reconcile with c.mu held.
+func (c *controller) reconcileLocked(ctx context.Context, k string, svc *kube.Service) {
+	if err := c.syncProxyLocked(ctx, k, svc); err != nil {
+		c.logf("%v", err)
+		c.retryLocked(ctx, k, svc)
+		return
+	}
+	if r := c.retries[k]; r != nil {
+		r.timer.Stop()
+		delete(c.retries, k)
+	}
+}
+
+// retryLocked schedules reconciling svc again, after twice the delay
+// of its previous retry.
+//
+// c.mu must be held.
+func (c *controller) retryLocked(ctx context.Context, k string, svc *kube.Service) {
+	r := c.retries[k]
+	if r == nil {
+		r = &retry{delay: minRetryDelay}
+		c.retries[k] = r
+	} else {
+		r.timer.Stop()
+		r.delay *= 2
+		if r.delay > maxRetryDelay {
+			r.delay = maxRetryDelay
+		}
+	}
+	r.svc = svc
+	c.logf("retrying %s in %v", k, r.delay)
+	r.timer = time.AfterFunc(r.delay, func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if ctx.Err() != nil || c.retries[k] != r {
+			return
+		}
+		c.reconcileLocked(ctx, k, r.svc)
+	})
+}
+
+// syncProxyLocked makes the proxy for the Service k match svc.
+//
+// c.mu must be held.
+func (c *controller) syncProxyLocked(ctx context.Context, k string, svc *kube.Service) error {
+	var want *proxyConfig
+	if svc != nil {
+		want = c.proxyConfigFor(svc)
+	}
+	cur := c.proxies[k]
+	if cur != nil && want != nil && reflect.DeepEqual(cur.cfg, *want) {
+		return nil
+	}
+	if cur != nil {
+		c.logf("stopping proxy %s for %s", cur.cfg.Hostname, k)
+		if err := cur.c.Close(); err != nil {
+			c.logf("stopping proxy %s: %v", cur.cfg.Hostname, err)
+		}
+		delete(c.proxies, k)
+		if want == nil {
+			if err := c.kc.DeleteSecret(ctx, cur.cfg.SecretName); err != nil && !isNotFound(err) {
+				c.logf("deleting secret %s: %v", cur.cfg.SecretName, err)
+			}
+		}
+	}
+	if want == nil {
+		return nil
+	}
+	if err := c.ensureSecret(ctx, svc, want.SecretName); err != nil {
+		return fmt.Errorf("creating secret for %s: %w", k, err)
+	}
+	c.logf("starting proxy %s for %s to %s ports %v", want.Hostname, k, want.ClusterIP, want.Ports)
+	closer, err := c.startProxy(*want)
+	if err != nil {
+		return fmt.Errorf("starting proxy %s: %w", want.Hostname, err)
+	}
+	c.proxies[k] = &runningProxy{cfg: *want, c: closer}
+	return nil
+}
+
+// proxyConfigFor returns the proxy configuration for svc, or nil if
+// it shouldn't be exposed.
+func (c *controller) proxyConfigFor(svc *kube.Service) *proxyConfig {
+	if svc.Annotations[annotationExpose] != "true" {
+		return nil
+	}
+	if svc.Spec.ClusterIP == "" || svc.Spec.ClusterIP == "None" {
+		c.logf("not exposing %s: no cluster IP", serviceKey(svc))
+		return nil
+	}
+	var ports []int
+	for _, p := range svc.Spec.Ports {
+		if p.Protocol == "" || p.Protocol == "TCP" {
+			ports = append(ports, int(p.Port))
+		}
+	}
+	if len(ports) == 0 {
+		c.logf("not exposing %s: no TCP ports", serviceKey(svc))
+		return nil
+	}
+	sort.Ints(ports)
+	hostname := svc.Annotations[annotationHostname]
+	if hostname == "" {
+		hostname = defaultHostname(svc)
+	}
+	return &proxyConfig{
+		Hostname:   hostname,
+		SecretName: secretName(svc),
+		ClusterIP:  svc.Spec.ClusterIP,
+		Ports:      ports,
+	}
+}
+
+// ensureSecret creates the Secret name for the state of the proxy to
+// svc, if it doesn't already exist. It's labeled so that it can be
+// deleted if svc goes away while the operator isn't running.
+func (c *controller) ensureSecret(ctx context.Context, svc *kube.Service, name string) error {
+	_, err := c.kc.GetSecret(ctx, name)
+	if err == nil || !isNotFound(err) {
+		return err
+	}
+	return c.kc.CreateSecret(ctx, &kube.Secret{
+		TypeMeta: kube.TypeMeta{
+			APIVersion: "v1",
+			Kind:       "Secret",
+		},
+		ObjectMeta: kube.ObjectMeta{
+			Name: name,
+			Labels: map[string]string{
+				labelManaged:         "true",
+				labelParentNamespace: svc.Namespace,
+				labelParentName:      svc.Name,
+			},
+		},
+	})
+}
+
+// defaultHostname returns the tailnet hostname of svc if it isn't set
+// with annotationHostname. Namespaces and Service names can both
+// contain hyphens, so a hash of both is appended to keep, for example,
+// Service "b-c" in namespace "a" and Service "c" in namespace "a-b"
+// apart.
+func defaultHostname(svc *kube.Service) string {
+	h := sha256.Sum256([]byte(serviceKey(svc)))
+	return svc.Namespace + "-" + svc.Name + "-" + hex.EncodeToString(h[:3])
+}
+
+// secretName returns the name of the Secret holding the state of the
+// proxy to svc. Namespaces and Service names are DNS labels, which
+// can't contain dots, so the dot separating them is unambiguous.
+func secretName(svc *kube.Service) string {
+	return "ts-" + svc.Namespace + "." + svc.Name
+}
+
+func (c *controller) stopAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, r := range c.retries {
+		r.timer.Stop()
+		delete(c.retries, k)
+	}
+	for k, p := range c.proxies {
+		if err := p.c.Close(); err != nil {
+			c.logf("stopping proxy %s: %v", p.cfg.Hostname, err)
+		}
+		delete(c.proxies, k)
+	}
+}
+
+func serviceKey(svc *kube.Service) string {
+	return svc.Namespace + "/" + svc.Name
+}
+
+func isNotFound(err error) bool {
+	st, ok := err.(*kube.Status)
+	return ok && st.Code == 404
+}
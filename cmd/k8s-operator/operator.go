@@ -0,0 +1,55 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// k8s-operator exposes Kubernetes Services on a tailnet.
+//
+// It watches the Services in all namespaces and, for each one annotated
+// with tailscale.com/expose: "true", runs a tsnet node that proxies the
+// Service's TCP ports to its cluster IP. The node's hostname is
+// "<namespace>-<name>-<hash>" unless set with the tailscale.com/hostname
+// annotation, and its state is kept in a Secret named
+// "ts-<namespace>.<name>" in the operator's namespace. Proxies that fail
+// to start are retried with exponential backoff.
+//
+// The operator must run in the cluster with a service account that can
+// list and watch Services cluster-wide, and manage Secrets in its own
+// namespace. Set TS_AUTHKEY to a reusable auth key for the proxies to
+// join the tailnet with.
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"tailscale.com/kube"
+)
+
+var (
+	stateDir = flag.String("state-dir", filepath.Join(os.TempDir(), "k8s-operator"), "Directory for the proxies' local, non-persistent state such as log configuration.")
+)
+
+func main() {
+	flag.Parse()
+	authKey := os.Getenv("TS_AUTHKEY")
+	if authKey == "" {
+		log.Printf("TS_AUTHKEY not set; proxies without state will log their auth URLs")
+	}
+	kc, err := kube.New()
+	if err != nil {
+		log.Fatalf("kube client: %v", err)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	c := newController(kc, newTSNetProxyStarter(kc, *stateDir, authKey, log.Printf), log.Printf)
+	log.Printf("k8s-operator running in namespace %s", kc.Namespace())
+	if err := c.run(ctx); err != nil && err != context.Canceled {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,444 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/store/kubestore"
+	"tailscale.com/kube"
+)
+
+const testNamespace = "tailscale"
+
+// fakeAPIServer is a minimal Kubernetes API server, implementing the
+// Service list and watch, and Secret endpoints that kube.Client uses.
+type fakeAPIServer struct {
+	t *testing.T
+
+	mu       sync.Mutex
+	rv       int
+	services map[string]kube.Service // by namespace/name
+	secrets  map[string]kube.Secret  // by name, in testNamespace
+	watchers []chan kube.WatchEvent
+}
+
+func newFakeAPIServer(t *testing.T) (*fakeAPIServer, *kube.Client) {
+	f := &fakeAPIServer{
+		t:        t,
+		services: map[string]kube.Service{},
+		secrets:  map[string]kube.Secret{},
+	}
+	ts := httptest.NewServer(f)
+	t.Cleanup(ts.Close)
+	return f, kube.NewWithToken(ts.URL, testNamespace, "token", ts.Client())
+}
+
+// setService adds or updates svc, notifying watchers.
+func (f *fakeAPIServer) setService(svc kube.Service) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.rv++
+	svc.ResourceVersion = strconv.Itoa(f.rv)
+	k := svc.Namespace + "/" + svc.Name
+	typ := "MODIFIED"
+	if _, ok := f.services[k]; !ok {
+		typ = "ADDED"
+	}
+	f.services[k] = svc
+	f.notifyLocked(typ, svc)
+}
+
+func (f *fakeAPIServer) deleteService(ns, name string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	k := ns + "/" + name
+	svc := f.services[k]
+	delete(f.services, k)
+	f.rv++
+	f.notifyLocked("DELETED", svc)
+}
+
+func (f *fakeAPIServer) notifyLocked(typ string, svc kube.Service) {
+	b, err := json.Marshal(svc)
+	if err != nil {
+		f.t.Error(err)
+		return
+	}
+	for _, w := range f.watchers {
+		w <- kube.WatchEvent{Type: typ, Object: b}
+	}
+}
+
+func (f *fakeAPIServer) secretNames() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var names []string
+	for n := range f.secrets {
+		names = append(names, n)
+	}
+	return names
+}
+
+func writeStatus(w http.ResponseWriter, code int, msg string) {
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(kube.Status{Status: "Failure", Message: msg, Code: code})
+}
+
+func (f *fakeAPIServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer token" {
+		writeStatus(w, 401, "unauthorized")
+		return
+	}
+	if r.URL.Path == "/api/v1/services" {
+		if r.URL.Query().Get("watch") != "" {
+			f.serveWatch(w, r)
+			return
+		}
+		f.mu.Lock()
+		l := kube.ServiceList{ListMeta: kube.ListMeta{ResourceVersion: strconv.Itoa(f.rv)}}
+		for _, svc := range f.services {
+			l.Items = append(l.Items, svc)
+		}
+		f.mu.Unlock()
+		json.NewEncoder(w).Encode(l)
+		return
+	}
+
+	prefix := "/api/v1/namespaces/" + testNamespace + "/secrets"
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		writeStatus(w, 404, "not found")
+		return
+	}
+	name := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, prefix), "/")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case name == "" && r.Method == "GET":
+		var l kube.SecretList
+		k, v, _ := strings.Cut(r.URL.Query().Get("labelSelector"), "=")
+		for _, s := range f.secrets {
+			if k == "" || s.Labels[k] == v {
+				l.Items = append(l.Items, s)
+			}
+		}
+		json.NewEncoder(w).Encode(l)
+	case name == "" && r.Method == "POST":
+		var s kube.Secret
+		if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+			writeStatus(w, 400, err.Error())
+			return
+		}
+		if _, ok := f.secrets[s.Name]; ok {
+			writeStatus(w, 409, "already exists")
+			return
+		}
+		f.secrets[s.Name] = s
+		w.WriteHeader(201)
+		json.NewEncoder(w).Encode(s)
+	case r.Method == "GET":
+		s, ok := f.secrets[name]
+		if !ok {
+			writeStatus(w, 404, "not found")
+			return
+		}
+		json.NewEncoder(w).Encode(s)
+	case r.Method == "PUT":
+		var s kube.Secret
+		if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+			writeStatus(w, 400, err.Error())
+			return
+		}
+		if _, ok := f.secrets[name]; !ok {
+			writeStatus(w, 404, "not found")
+			return
+		}
+		f.secrets[name] = s
+		json.NewEncoder(w).Encode(s)
+	case r.Method == "DELETE":
+		if _, ok := f.secrets[name]; !ok {
+			writeStatus(w, 404, "not found")
+			return
+		}
+		delete(f.secrets, name)
+		json.NewEncoder(w).Encode(kube.Status{Status: "Success"})
+	default:
+		writeStatus(w, 405, "method not allowed")
+	}
+}
+
+func (f *fakeAPIServer) serveWatch(w http.ResponseWriter, r *http.Request) {
+	ch := make(chan kube.WatchEvent, 16)
+	f.mu.Lock()
+	f.watchers = append(f.watchers, ch)
+	f.mu.Unlock()
+	defer func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		for i, c := range f.watchers {
+			if c == ch {
+				f.watchers = append(f.watchers[:i], f.watchers[i+1:]...)
+				break
+			}
+		}
+	}()
+	w.WriteHeader(200)
+	w.(http.Flusher).Flush()
+	for {
+		select {
+		case ev := <-ch:
+			json.NewEncoder(w).Encode(ev)
+			w.(http.Flusher).Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (f *fakeAPIServer) numWatchers() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.watchers)
+}
+
+func testService(ns, name string, annotations map[string]string, ports ...int32) kube.Service {
+	svc := kube.Service{
+		ObjectMeta: kube.ObjectMeta{Namespace: ns, Name: name, Annotations: annotations},
+		Spec:       kube.ServiceSpec{Type: "ClusterIP", ClusterIP: "10.0.0.1"},
+	}
+	for _, p := range ports {
+		svc.Spec.Ports = append(svc.Spec.Ports, kube.ServicePort{Protocol: "TCP", Port: p})
+	}
+	return svc
+}
+
+var exposed = map[string]string{annotationExpose: "true"}
+
+// fakeProxy records the starts and stops of proxies.
+type fakeProxy struct {
+	cfg    proxyConfig
+	events chan<- string
+}
+
+func (p *fakeProxy) Close() error {
+	p.events <- "stop " + p.cfg.Hostname
+	return nil
+}
+
+func TestController(t *testing.T) {
+	f, kc := newFakeAPIServer(t)
+	events := make(chan string, 16)
+	start := func(cfg proxyConfig) (io.Closer, error) {
+		events <- fmt.Sprintf("start %s %s %v", cfg.Hostname, cfg.ClusterIP, cfg.Ports)
+		return &fakeProxy{cfg: cfg, events: events}, nil
+	}
+	want := func(wantEvents ...string) {
+		t.Helper()
+		for _, w := range wantEvents {
+			select {
+			case got := <-events:
+				if got != w {
+					t.Fatalf("got event %q; want %q", got, w)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("timeout waiting for %q", w)
+			}
+		}
+	}
+
+	hostname := func(ns, name string) string {
+		return defaultHostname(&kube.Service{ObjectMeta: kube.ObjectMeta{Namespace: ns, Name: name}})
+	}
+	web, internal := hostname("default", "web"), hostname("default", "internal")
+
+	// State left behind by a previous run, for a Service that's gone.
+	f.secrets["ts-default.old"] = kube.Secret{ObjectMeta: kube.ObjectMeta{
+		Name:   "ts-default.old",
+		Labels: map[string]string{labelManaged: "true", labelParentNamespace: "default", labelParentName: "old"},
+	}}
+	f.setService(testService("default", "web", exposed, 80, 443))
+	f.setService(testService("default", "internal", nil, 80))
+	headless := testService("default", "headless", exposed, 80)
+	headless.Spec.ClusterIP = "None"
+	f.setService(headless)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c := newController(kc, start, t.Logf)
+	done := make(chan error)
+	go func() { done <- c.run(ctx) }()
+	want("start " + web + " 10.0.0.1 [80 443]")
+	for f.numWatchers() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if got := f.secretNames(); len(got) != 1 || got[0] != "ts-default.web" {
+		t.Errorf("secrets = %q; want [ts-default.web]", got)
+	}
+
+	f.setService(testService("prod", "db", map[string]string{annotationExpose: "true", annotationHostname: "db"}, 5432))
+	want("start db 10.0.0.1 [5432]")
+
+	// Changing the ports restarts the proxy.
+	f.setService(testService("default", "web", exposed, 80))
+	want("stop "+web, "start "+web+" 10.0.0.1 [80]")
+
+	// Unexposing or deleting the Service stops its proxy and deletes its
+	// state.
+	f.setService(testService("default", "web", nil, 80))
+	want("stop " + web)
+	f.deleteService("prod", "db")
+	want("stop db")
+	for {
+		if len(f.secretNames()) == 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	f.setService(testService("default", "internal", exposed, 8080))
+	want("start " + internal + " 10.0.0.1 [8080]")
+	cancel()
+	want("stop " + internal)
+	if err := <-done; err != context.Canceled {
+		t.Errorf("run = %v; want context.Canceled", err)
+	}
+}
+
+func TestControllerRetry(t *testing.T) {
+	f, kc := newFakeAPIServer(t)
+	events := make(chan string, 16)
+	var failures int32 = 2
+	start := func(cfg proxyConfig) (io.Closer, error) {
+		if atomic.AddInt32(&failures, -1) >= 0 {
+			events <- "fail"
+			return nil, errors.New("no")
+		}
+		events <- "start"
+		return &fakeProxy{cfg: cfg, events: events}, nil
+	}
+	f.setService(testService("default", "web", exposed, 80))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c := newController(kc, start, t.Logf)
+	done := make(chan error)
+	go func() { done <- c.run(ctx) }()
+	// The proxy is retried after 1s and then 2s, without waiting for
+	// the Service to change.
+	for _, w := range []string{"fail", "fail", "start"} {
+		select {
+		case got := <-events:
+			if got != w {
+				t.Fatalf("got event %q; want %q", got, w)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("timeout waiting for %q", w)
+		}
+	}
+	c.mu.Lock()
+	if n := len(c.retries); n != 0 {
+		t.Errorf("%d retries pending after start", n)
+	}
+	c.mu.Unlock()
+	cancel()
+	<-done
+}
+
+func TestNamesDontCollide(t *testing.T) {
+	svc := func(ns, name string) *kube.Service {
+		return &kube.Service{ObjectMeta: kube.ObjectMeta{Namespace: ns, Name: name}}
+	}
+	a, b := svc("a-b", "c"), svc("a", "b-c")
+	if defaultHostname(a) == defaultHostname(b) {
+		t.Errorf("hostnames collide: %q", defaultHostname(a))
+	}
+	if secretName(a) == secretName(b) {
+		t.Errorf("secret names collide: %q", secretName(a))
+	}
+}
+
+func TestKubeStore(t *testing.T) {
+	_, kc := newFakeAPIServer(t)
+	s := kubestore.NewWithClient(kc, "ts-state")
+	if _, err := s.ReadState("foo"); err != ipn.ErrStateNotExist {
+		t.Fatalf("ReadState of missing secret = %v; want ErrStateNotExist", err)
+	}
+	if err := s.WriteState("foo", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.WriteState("bar", []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	for k, want := range map[ipn.StateKey]string{"foo": "1", "bar": "2"} {
+		got, err := s.ReadState(k)
+		if err != nil || string(got) != want {
+			t.Errorf("ReadState(%q) = %q, %v; want %q", k, got, err, want)
+		}
+	}
+	if _, err := s.ReadState("baz"); err != ipn.ErrStateNotExist {
+		t.Errorf("ReadState of missing key = %v; want ErrStateNotExist", err)
+	}
+}
+
+func TestServeProxy(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	go func() {
+		for {
+			c, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				line, _ := bufio.NewReader(c).ReadString('\n')
+				io.WriteString(c, "echo: "+line)
+			}()
+		}
+	}()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		serveProxy(ln, backend.Addr().String(), t.Logf)
+		close(done)
+	}()
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	io.WriteString(c, "hello\n")
+	got, err := io.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "echo: hello\n" {
+		t.Errorf("got %q; want %q", got, "echo: hello\n")
+	}
+
+	ln.Close()
+	<-done
+}
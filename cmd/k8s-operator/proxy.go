@@ -0,0 +1,112 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"tailscale.com/ipn/store/kubestore"
+	"tailscale.com/kube"
+	"tailscale.com/tsnet"
+	"tailscale.com/types/logger"
+)
+
+// tsnetProxy is a tsnet node that proxies TCP connections to a Service.
+type tsnetProxy struct {
+	s   *tsnet.Server
+	lns []net.Listener
+}
+
+// newTSNetProxyStarter returns a startProxyFunc that runs each proxy as
+// a tsnet node, with its state in a Secret via kubestore and its logs
+// configuration under stateDir.
+func newTSNetProxyStarter(kc *kube.Client, stateDir, authKey string, logf logger.Logf) startProxyFunc {
+	return func(cfg proxyConfig) (io.Closer, error) {
+		dir := filepath.Join(stateDir, cfg.SecretName)
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, err
+		}
+		p := &tsnetProxy{
+			s: &tsnet.Server{
+				Dir:      dir,
+				Store:    kubestore.NewWithClient(kc, cfg.SecretName),
+				Hostname: cfg.Hostname,
+				AuthKey:  authKey,
+				Logf:     logger.WithPrefix(logf, cfg.Hostname+": "),
+			},
+		}
+		if err := p.s.Start(); err != nil {
+			return nil, err
+		}
+		plogf := logger.WithPrefix(logf, cfg.Hostname+": proxy: ")
+		for _, port := range cfg.Ports {
+			ln, err := p.s.Listen("tcp", fmt.Sprintf(":%d", port))
+			if err != nil {
+				p.Close()
+				return nil, err
+			}
+			p.lns = append(p.lns, ln)
+			go serveProxy(ln, net.JoinHostPort(cfg.ClusterIP, strconv.Itoa(port)), plogf)
+		}
+		return p, nil
+	}
+}
+
+func (p *tsnetProxy) Close() error {
+	// Close the listeners ourselves first, as tsnet.Server.Close
+	// can't close them without deadlocking.
+	for _, ln := range p.lns {
+		ln.Close()
+	}
+	return p.s.Close()
+}
+
+// serveProxy accepts connections on ln and proxies them to backend
+// until ln is closed.
+func serveProxy(ln net.Listener, backend string, logf logger.Logf) {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				logf("accept: %v", err)
+			}
+			return
+		}
+		go proxyConn(c, backend, logf)
+	}
+}
+
+func proxyConn(c net.Conn, backend string, logf logger.Logf) {
+	defer c.Close()
+	bc, err := net.DialTimeout("tcp", backend, 10*time.Second)
+	if err != nil {
+		logf("dialing %s for %s: %v", backend, c.RemoteAddr(), err)
+		return
+	}
+	defer bc.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	copyHalf := func(dst, src net.Conn) {
+		defer wg.Done()
+		io.Copy(dst, src)
+		if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		} else {
+			dst.Close()
+		}
+	}
+	go copyHalf(bc, c)
+	go copyHalf(c, bc)
+	wg.Wait()
+}
@@ -0,0 +1,427 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"tailscale.com/logtail"
+	"tailscale.com/logtail/filesink"
+	"tailscale.com/smallzstd"
+)
+
+// maxBodySize is the largest upload body accepted, before and after
+// decompression. logtail uploads are much smaller.
+const maxBodySize = 4 << 20
+
+// tailBuffer is how many records a tail subscriber may fall behind by
+// before it's disconnected.
+const tailBuffer = 256
+
+// sinkIdleTimeout is how long a stream's files are kept open after its
+// last upload.
+const sinkIdleTimeout = 5 * time.Minute
+
+// validCollection matches collection names, which are domain names.
+var validCollection = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9.-]*[a-zA-Z0-9])?$`)
+
+// collector is an http.Handler implementing the logtail upload
+// protocol and an API to read the uploaded logs:
+//
+//   - POST /c/<collection>/<private-id> uploads a JSON array of
+//     records, or a single record, optionally zstd compressed.
+//   - GET /c/<collection> returns a JSON array of the public IDs of
+//     the collection's streams.
+//   - GET /c/<collection>/<public-id> returns the stream's stored
+//     records, one JSON object per line, filtered by the query
+//     parameters described by filesink.ParseQuery. With stream=true,
+//     it instead follows the stream, returning matching records as
+//     they are uploaded.
+//
+// Each stream is stored in its own directory, <dir>/<collection>/<public-id>,
+// as rotated files written by filesink. Private IDs are never stored.
+type collector struct {
+	dir       string
+	sinkOpts  filesink.Options
+	readToken string // if non-empty, required as a bearer token to read logs
+	anyRead   bool   // if readToken is empty, whether anyone may read logs
+	dec       *zstd.Decoder
+
+	done chan struct{} // closed by Close to stop closeIdleLoop
+
+	mu      sync.Mutex
+	streams map[streamKey]*stream
+}
+
+type streamKey struct {
+	collection string
+	id         logtail.PublicID
+}
+
+// stream is the state of a stream that is being uploaded to or
+// tailed. Its fields are guarded by collector.mu.
+type stream struct {
+	sink      *filesink.Sink // or nil if not written to recently
+	lastWrite time.Time
+	subs      map[chan []byte]bool // tail subscribers
+}
+
+// newCollector returns a collector storing logs in dir. Reading logs
+// requires readToken or, if it's empty, insecureRead to be set.
+func newCollector(dir string, sinkOpts filesink.Options, readToken string, insecureRead bool) (*collector, error) {
+	dec, err := smallzstd.NewDecoder(nil, zstd.WithDecoderMaxMemory(maxBodySize))
+	if err != nil {
+		return nil, err
+	}
+	c := &collector{
+		dir:       dir,
+		sinkOpts:  sinkOpts,
+		readToken: readToken,
+		anyRead:   insecureRead,
+		dec:       dec,
+		done:      make(chan struct{}),
+		streams:   map[streamKey]*stream{},
+	}
+	go c.closeIdleLoop()
+	return c, nil
+}
+
+// Close closes all open streams.
+func (c *collector) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-c.done:
+	default:
+		close(c.done)
+	}
+	var errs []string
+	for k, s := range c.streams {
+		if s.sink != nil {
+			if err := s.sink.Close(); err != nil {
+				errs = append(errs, err.Error())
+			}
+		}
+		for ch := range s.subs {
+			close(ch)
+			delete(s.subs, ch)
+		}
+		delete(c.streams, k)
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/c/"), "/")
+	if !strings.HasPrefix(r.URL.Path, "/c/") || len(parts) > 2 || !validCollection.MatchString(parts[0]) {
+		http.NotFound(w, r)
+		return
+	}
+	collection := parts[0]
+	switch {
+	case len(parts) == 2 && r.Method == "POST":
+		id, err := logtail.ParsePrivateID(parts[1])
+		if err != nil {
+			http.Error(w, "bad private ID", http.StatusBadRequest)
+			return
+		}
+		c.serveUpload(w, r, streamKey{collection, id.Public()})
+	case r.Method == "GET":
+		if !c.readAuthorized(r) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if len(parts) == 1 {
+			c.serveList(w, collection)
+			return
+		}
+		id, err := logtail.ParsePublicID(parts[1])
+		if err != nil {
+			http.Error(w, "bad public ID", http.StatusBadRequest)
+			return
+		}
+		c.serveRead(w, r, streamKey{collection, id})
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (c *collector) readAuthorized(r *http.Request) bool {
+	if c.readToken == "" {
+		return c.anyRead
+	}
+	authz := r.Header.Get("Authorization")
+	tok := strings.TrimPrefix(authz, "Bearer ")
+	return tok != authz && subtle.ConstantTimeCompare([]byte(tok), []byte(c.readToken)) == 1
+}
+
+func (c *collector) streamDir(k streamKey) string {
+	return filepath.Join(c.dir, k.collection, k.id.String())
+}
+
+// The logtail client treats a 400 response as meaning that the upload
+// was saved anyway, so it doesn't retry bodies that will never be
+// accepted.
+func (c *collector) serveUpload(w http.ResponseWriter, r *http.Request, k streamKey) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	switch enc := r.Header.Get("Content-Encoding"); enc {
+	case "":
+	case "zstd":
+		body, err = c.dec.DecodeAll(body, nil)
+		if err != nil {
+			http.Error(w, "bad zstd body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "unsupported Content-Encoding "+enc, http.StatusBadRequest)
+		return
+	}
+	records, err := parseUpload(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(records) > 0 {
+		if err := c.write(k, records); err != nil {
+			log.Printf("writing %s/%s: %v", k.collection, k.id, err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// parseUpload parses an upload body, a JSON array of objects or a
+// single object, into compact records.
+func parseUpload(body []byte) ([]json.RawMessage, error) {
+	var records []json.RawMessage
+	if err := json.Unmarshal(body, &records); err != nil {
+		var one json.RawMessage
+		if json.Unmarshal(body, &one) != nil {
+			return nil, errors.New("body is not JSON")
+		}
+		records = []json.RawMessage{one}
+	}
+	for i, rec := range records {
+		var buf bytes.Buffer
+		if err := json.Compact(&buf, rec); err != nil {
+			return nil, err
+		}
+		if buf.Len() == 0 || buf.Bytes()[0] != '{' {
+			return nil, fmt.Errorf("record %d is not a JSON object", i)
+		}
+		records[i] = buf.Bytes()
+	}
+	return records, nil
+}
+
+func (c *collector) write(k streamKey, records []json.RawMessage) error {
+	batch, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.streamLocked(k)
+	if s.sink == nil {
+		s.sink, err = filesink.New(c.streamDir(k), c.sinkOpts)
+		if err != nil {
+			return err
+		}
+	}
+	s.lastWrite = time.Now()
+	if err := s.sink.WriteLogs(batch); err != nil {
+		return err
+	}
+	for ch := range s.subs {
+		if !sendAll(ch, records) {
+			// Too far behind; disconnect it.
+			close(ch)
+			delete(s.subs, ch)
+		}
+	}
+	return nil
+}
+
+// sendAll sends records to ch without blocking, and reports whether
+// they all fit.
+func sendAll(ch chan<- []byte, records []json.RawMessage) bool {
+	for _, rec := range records {
+		select {
+		case ch <- rec:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// streamLocked returns the stream for k, adding it if needed. It
+// doesn't open the stream's sink.
+//
+// c.mu must be held.
+func (c *collector) streamLocked(k streamKey) *stream {
+	if s := c.streams[k]; s != nil {
+		return s
+	}
+	s := &stream{subs: map[chan []byte]bool{}}
+	c.streams[k] = s
+	return s
+}
+
+// closeIdleLoop periodically closes the sinks of streams that haven't
+// been written to recently, until c is closed.
+func (c *collector) closeIdleLoop() {
+	t := time.NewTicker(sinkIdleTimeout / 5)
+	defer t.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case now := <-t.C:
+			c.mu.Lock()
+			c.closeIdleLocked(now)
+			c.mu.Unlock()
+		}
+	}
+}
+
+// closeIdleLocked closes the sinks of streams last written to more than
+// sinkIdleTimeout before now, and forgets streams that are neither open
+// nor tailed.
+//
+// c.mu must be held.
+func (c *collector) closeIdleLocked(now time.Time) {
+	for k, s := range c.streams {
+		if s.sink != nil && now.Sub(s.lastWrite) > sinkIdleTimeout {
+			if err := s.sink.Close(); err != nil {
+				log.Printf("closing %s/%s: %v", k.collection, k.id, err)
+			}
+			s.sink = nil
+		}
+		if s.sink == nil && len(s.subs) == 0 {
+			delete(c.streams, k)
+		}
+	}
+}
+
+func (c *collector) serveList(w http.ResponseWriter, collection string) {
+	des, err := os.ReadDir(filepath.Join(c.dir, collection))
+	if err != nil && !os.IsNotExist(err) {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	ids := []string{}
+	for _, de := range des {
+		if _, err := logtail.ParsePublicID(de.Name()); err == nil && de.IsDir() {
+			ids = append(ids, de.Name())
+		}
+	}
+	sort.Strings(ids)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ids)
+}
+
+func (c *collector) serveRead(w http.ResponseWriter, r *http.Request, k streamKey) {
+	q, err := filesink.ParseQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	if r.URL.Query().Get("stream") == "true" {
+		c.serveTail(w, r, k, q)
+		return
+	}
+	dir := c.streamDir(k)
+	if _, err := os.Stat(dir); err != nil {
+		http.Error(w, "no such stream", http.StatusNotFound)
+		return
+	}
+	bw := bufio.NewWriter(w)
+	err = filesink.Read(dir, q, func(rec *filesink.Record) error {
+		bw.Write(rec.Raw)
+		return bw.WriteByte('\n')
+	})
+	if err != nil {
+		log.Printf("reading %s/%s: %v", k.collection, k.id, err)
+	}
+	bw.Flush()
+}
+
+// serveTail streams records uploaded to k that match q until the
+// client goes away or falls too far behind. Only streams that have
+// been uploaded to can be tailed.
+func (c *collector) serveTail(w http.ResponseWriter, r *http.Request, k streamKey, q filesink.Query) {
+	ch := make(chan []byte, tailBuffer)
+	c.mu.Lock()
+	if c.streams[k] == nil {
+		if _, err := os.Stat(c.streamDir(k)); err != nil {
+			c.mu.Unlock()
+			http.Error(w, "no such stream", http.StatusNotFound)
+			return
+		}
+	}
+	s := c.streamLocked(k)
+	s.subs[ch] = true
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		delete(s.subs, ch)
+		if s.sink == nil && len(s.subs) == 0 && c.streams[k] == s {
+			delete(c.streams, k)
+		}
+	}()
+
+	f, _ := w.(http.Flusher)
+	w.WriteHeader(http.StatusOK)
+	if f != nil {
+		f.Flush()
+	}
+	unflushed := false
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case raw, ok := <-ch:
+			if !ok {
+				return
+			}
+			if rec, err := filesink.ParseRecord(raw); err == nil && q.Match(rec) {
+				w.Write(raw)
+				io.WriteString(w, "\n")
+				unflushed = true
+			}
+			if f != nil && unflushed && len(ch) == 0 {
+				f.Flush()
+				unflushed = false
+			}
+		}
+	}
+}
@@ -0,0 +1,306 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"tailscale.com/logtail"
+	"tailscale.com/logtail/filesink"
+	"tailscale.com/smallzstd"
+)
+
+// newTestCollector returns a collector requiring readToken to read
+// logs or, if it's empty, letting anyone read them.
+func newTestCollector(t *testing.T, readToken string) (*collector, *httptest.Server) {
+	t.Helper()
+	c, err := newCollector(t.TempDir(), filesink.Options{}, readToken, readToken == "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(c)
+	t.Cleanup(func() {
+		ts.Close()
+		c.Close()
+	})
+	return c, ts
+}
+
+func get(t *testing.T, url, token string) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	b, _ := io.ReadAll(res.Body)
+	return res.StatusCode, string(b)
+}
+
+func TestUploadAndRead(t *testing.T) {
+	_, ts := newTestCollector(t, "")
+	const collection = "test.log.example.com"
+	privID, err := logtail.NewPrivateID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	streamURL := ts.URL + "/c/" + collection + "/" + privID.Public().String()
+
+	// Only streams that exist can be followed.
+	if code, _ := get(t, streamURL+"?stream=true", ""); code != http.StatusNotFound {
+		t.Fatalf("tail of unknown stream: %d; want 404", code)
+	}
+	res, err := http.Post(ts.URL+"/c/"+collection+"/"+privID.String(), "application/json", strings.NewReader(`{"text":"first"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	// Follow the stream before the logger uploads anything.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", streamURL+"?stream=true&q=line", nil)
+	tailRes, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tailRes.Body.Close()
+
+	l := logtail.NewLogger(logtail.Config{
+		Collection: collection,
+		PrivateID:  privID,
+		BaseURL:    ts.URL,
+		NewZstdEncoder: func() logtail.Encoder {
+			w, err := smallzstd.NewEncoder(nil)
+			if err != nil {
+				panic(err)
+			}
+			return w
+		},
+	}, t.Logf)
+	// Long enough to be worth compressing.
+	line := "log line " + strings.Repeat("compressible ", 50)
+	l.Write([]byte(line))
+	l.Write([]byte("[v1] verbose line"))
+	if err := l.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	tail := bufio.NewScanner(tailRes.Body)
+	tail.Buffer(nil, 1<<20)
+	var tailed []string
+	for len(tailed) < 2 && tail.Scan() {
+		r, err := filesink.ParseRecord(tail.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		tailed = append(tailed, r.Text)
+	}
+	if len(tailed) != 2 || tailed[0] != line || tailed[1] != "verbose line" {
+		t.Errorf("tailed %q", tailed)
+	}
+
+	code, body := get(t, streamURL, "")
+	if code != 200 {
+		t.Fatalf("read: %d %s", code, body)
+	}
+	for _, want := range []string{"logtail started", "compressible", "verbose line"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("stored logs missing %q:\n%s", want, body)
+		}
+	}
+	if strings.Contains(body, privID.String()) {
+		t.Errorf("stored logs contain private ID")
+	}
+	if _, body := get(t, streamURL+"?level=0", ""); strings.Contains(body, "verbose line") {
+		t.Errorf("level=0 read returned verbose line:\n%s", body)
+	}
+
+	code, body = get(t, ts.URL+"/c/"+collection, "")
+	var ids []string
+	if err := json.Unmarshal([]byte(body), &ids); code != 200 || err != nil {
+		t.Fatalf("list: %d %q %v", code, body, err)
+	}
+	if len(ids) != 1 || ids[0] != privID.Public().String() {
+		t.Errorf("list = %q; want just %v", ids, privID.Public())
+	}
+}
+
+func TestUploadErrors(t *testing.T) {
+	_, ts := newTestCollector(t, "")
+	privID, _ := logtail.NewPrivateID()
+	tests := []struct {
+		name     string
+		path     string
+		encoding string
+		body     string
+		want     int
+	}{
+		{"ok_array", "/c/coll/" + privID.String(), "", `[{"text":"a"},{"text":"b"}]`, 200},
+		{"ok_object", "/c/coll/" + privID.String(), "", `{"text":"a"}`, 200},
+		{"not_json", "/c/coll/" + privID.String(), "", `hello`, 400},
+		{"not_object", "/c/coll/" + privID.String(), "", `[1]`, 400},
+		{"bad_zstd", "/c/coll/" + privID.String(), "zstd", `[{"text":"a"}]`, 400},
+		{"bad_encoding", "/c/coll/" + privID.String(), "gzip", `[{"text":"a"}]`, 400},
+		{"bad_id", "/c/coll/nothex", "", `[]`, 400},
+		{"public_id", "/c/coll/" + privID.Public().String() + "x", "", `[]`, 400},
+		{"bad_collection", "/c/..", "", `[]`, 404},
+		{"too_deep", "/c/coll/" + privID.String() + "/x", "", `[]`, 404},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest("POST", ts.URL+tt.path, strings.NewReader(tt.body))
+			if tt.encoding != "" {
+				req.Header.Set("Content-Encoding", tt.encoding)
+			}
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			if res.StatusCode != tt.want {
+				t.Errorf("status = %d; want %d", res.StatusCode, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadToken(t *testing.T) {
+	_, ts := newTestCollector(t, "s3cret")
+	privID, _ := logtail.NewPrivateID()
+	res, err := http.Post(ts.URL+"/c/coll/"+privID.String(), "application/json", strings.NewReader(`[{"text":"a"}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Fatalf("upload without token: %v", res.Status)
+	}
+	url := ts.URL + "/c/coll/" + privID.Public().String()
+	for _, tok := range []string{"", "wrong"} {
+		if code, _ := get(t, url, tok); code != http.StatusUnauthorized {
+			t.Errorf("read with token %q: %d; want 401", tok, code)
+		}
+	}
+	if code, body := get(t, url, "s3cret"); code != 200 || !strings.Contains(body, `"a"`) {
+		t.Errorf("read with token: %d %q", code, body)
+	}
+}
+
+func TestReadWithoutToken(t *testing.T) {
+	c, err := newCollector(t.TempDir(), filesink.Options{}, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(c)
+	defer ts.Close()
+	defer c.Close()
+	privID, _ := logtail.NewPrivateID()
+	for _, path := range []string{"/c/coll", "/c/coll/" + privID.Public().String()} {
+		if code, _ := get(t, ts.URL+path, ""); code != http.StatusUnauthorized {
+			t.Errorf("read %s without --insecure-read: %d; want 401", path, code)
+		}
+	}
+}
+
+func TestTailSlowReader(t *testing.T) {
+	c, err := newCollector(t.TempDir(), filesink.Options{}, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	privID, _ := logtail.NewPrivateID()
+	k := streamKey{"coll", privID.Public()}
+	c.mu.Lock()
+	ch := make(chan []byte, 1)
+	c.streamLocked(k).subs[ch] = true
+	c.mu.Unlock()
+
+	if err := c.write(k, []json.RawMessage{[]byte(`{"text":"a"}`), []byte(`{"text":"b"}`)}); err != nil {
+		t.Fatal(err)
+	}
+	<-ch
+	select {
+	case _, ok := <-ch:
+		if ok {
+			t.Fatal("slow subscriber got both records")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("slow subscriber not disconnected")
+	}
+}
+
+func TestReadUnknownStream(t *testing.T) {
+	c, ts := newTestCollector(t, "")
+	privID, _ := logtail.NewPrivateID()
+	url := ts.URL + "/c/coll/" + privID.Public().String()
+	for _, q := range []string{"", "?stream=true"} {
+		if code, _ := get(t, url+q, ""); code != http.StatusNotFound {
+			t.Errorf("read %q: %d; want 404", q, code)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(c.dir, "coll")); !os.IsNotExist(err) {
+		t.Errorf("read created collection directory: %v", err)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.streams) != 0 {
+		t.Errorf("read added %d streams", len(c.streams))
+	}
+}
+
+func TestCloseIdle(t *testing.T) {
+	c, err := newCollector(t.TempDir(), filesink.Options{}, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	privID, _ := logtail.NewPrivateID()
+	k := streamKey{"coll", privID.Public()}
+	if err := c.write(k, []json.RawMessage{[]byte(`{"text":"a"}`)}); err != nil {
+		t.Fatal(err)
+	}
+
+	c.mu.Lock()
+	c.closeIdleLocked(time.Now())
+	if s := c.streams[k]; s == nil || s.sink == nil {
+		t.Fatal("recently written stream closed")
+	}
+	c.closeIdleLocked(time.Now().Add(2 * sinkIdleTimeout))
+	if s := c.streams[k]; s != nil {
+		t.Fatal("idle stream not closed")
+	}
+	c.mu.Unlock()
+
+	// Writing again reopens it.
+	if err := c.write(k, []json.RawMessage{[]byte(`{"text":"b"}`)}); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	filesink.Read(c.streamDir(k), filesink.Query{}, func(r *filesink.Record) error {
+		got = append(got, r.Text)
+		return nil
+	})
+	if strings.Join(got, ",") != "a,b" {
+		t.Errorf("stored %q; want [a b]", got)
+	}
+}
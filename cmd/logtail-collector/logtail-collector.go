@@ -0,0 +1,83 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Program logtail-collector is a self-hosted log server for the
+// logtail upload protocol. Point clients at it with, for example,
+// TS_LOG_TARGET=http://logs.example.com:8420.
+//
+// Uploaded logs are stored on disk per collection and log stream, and
+// can be read back or followed with the HTTP API described on
+// collector.
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"tailscale.com/logtail/filesink"
+)
+
+var (
+	flagAddr         = flag.String("addr", ":8420", "address to serve on")
+	flagDir          = flag.String("dir", "", "directory to store logs in")
+	flagReadToken    = flag.String("read-token", "", "bearer token required to read logs")
+	flagInsecureRead = flag.Bool("insecure-read", false, "allow anyone to read logs when --read-token is empty")
+	flagMaxSize      = flag.Int64("max-file-size", 0, "size in bytes at which a stream's log file is rotated; 0 means 10 MiB")
+	flagMaxAge       = flag.Duration("max-file-age", 0, "age at which a stream's log file is rotated; 0 means 24h")
+	flagMaxFiles     = flag.Int("max-files", 0, "number of rotated files to keep per stream; 0 means 10")
+)
+
+func main() {
+	flag.Parse()
+	if *flagDir == "" {
+		log.Fatal("--dir is required")
+	}
+	if *flagReadToken == "" && !*flagInsecureRead {
+		log.Fatal("--read-token is required, unless --insecure-read is set to let anyone read logs")
+	}
+	c, err := newCollector(*flagDir, filesink.Options{
+		MaxSize:  *flagMaxSize,
+		MaxAge:   *flagMaxAge,
+		MaxFiles: *flagMaxFiles,
+	}, *flagReadToken, *flagInsecureRead)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/c/", c)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte("logtail-collector\n"))
+	})
+	srv := &http.Server{
+		Addr:              *flagAddr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigc
+		srv.Close()
+	}()
+
+	log.Printf("serving logtail uploads on %s, storing in %s", *flagAddr, *flagDir)
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	if err := c.Close(); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,213 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"tailscale.com/client/tailscale/apitype"
+)
+
+// authServer answers nginx auth_request subrequests.
+type authServer struct {
+	cfg     *Config // never nil
+	headers HeaderNames
+	whois   *whoisCache
+}
+
+func newAuthServer(cfg *Config, whois whoisFunc, cacheTTL time.Duration) *authServer {
+	if cfg == nil {
+		cfg = new(Config)
+	}
+	return &authServer{
+		cfg:     cfg,
+		headers: cfg.Headers.withDefaults(),
+		whois: &whoisCache{
+			lookup:  whois,
+			ttl:     cacheTTL,
+			timeNow: time.Now,
+		},
+	}
+}
+
+func (s *authServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	remoteHost := r.Header.Get("Remote-Addr")
+	remotePort := r.Header.Get("Remote-Port")
+	if remoteHost == "" || remotePort == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Println("set Remote-Addr to $remote_addr and Remote-Port to $remote_port in your nginx config")
+		return
+	}
+
+	remoteAddrStr := net.JoinHostPort(remoteHost, remotePort)
+	remoteAddr, err := netip.ParseAddrPort(remoteAddrStr)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		log.Printf("remote address and port are not valid: %v", err)
+		return
+	}
+
+	info, err := s.whois.get(r.Context(), remoteAddr)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		log.Printf("can't look up %s: %v", remoteAddr, err)
+		return
+	}
+	tagged := len(info.Node.Tags) != 0
+
+	if len(s.cfg.Rules) == 0 {
+		if tagged {
+			w.WriteHeader(http.StatusForbidden)
+			log.Printf("node %s is tagged", info.Node.Hostinfo.Hostname())
+			return
+		}
+	} else {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		reqPath, ok := requestPath(r.Header.Get("Original-URI"))
+		if !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			log.Printf("missing or invalid Original-URI %q; set it to $request_uri in your nginx config", r.Header.Get("Original-URI"))
+			return
+		}
+		rule := s.cfg.ruleFor(host, reqPath)
+		if rule == nil {
+			w.WriteHeader(http.StatusForbidden)
+			log.Printf("no rule for %s%s; set Host to $http_host in your nginx config", host, reqPath)
+			return
+		}
+		if !rule.allows(info) {
+			w.WriteHeader(http.StatusForbidden)
+			log.Printf("node %s (%s) not allowed to %s%s", info.Node.ComputedName, info.UserProfile.LoginName, host, reqPath)
+			return
+		}
+	}
+
+	_, tailnet, ok := strings.Cut(info.Node.Name, info.Node.ComputedName+".")
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		log.Printf("can't extract tailnet name from hostname %q", info.Node.Name)
+		return
+	}
+	tailnet, _, ok = strings.Cut(tailnet, ".beta.tailscale.net")
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		log.Printf("can't extract tailnet name from hostname %q", info.Node.Name)
+		return
+	}
+
+	if expectedTailnet := r.Header.Get("Expected-Tailnet"); expectedTailnet != "" && expectedTailnet != tailnet {
+		w.WriteHeader(http.StatusForbidden)
+		log.Printf("user is part of tailnet %s, wanted: %s", tailnet, url.QueryEscape(expectedTailnet))
+		return
+	}
+
+	h := w.Header()
+	set := func(name, v string) {
+		if name != "-" {
+			h.Set(name, v)
+		}
+	}
+	if tagged {
+		set(s.headers.Tags, strings.Join(info.Node.Tags, ","))
+	} else {
+		set(s.headers.Login, strings.Split(info.UserProfile.LoginName, "@")[0])
+		set(s.headers.User, info.UserProfile.LoginName)
+		set(s.headers.Name, info.UserProfile.DisplayName)
+		set(s.headers.ProfilePicture, info.UserProfile.ProfilePicURL)
+	}
+	set(s.headers.Tailnet, tailnet)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// requestPath returns the cleaned path of uri, a request URI as in
+// nginx's $request_uri, so that rules can't be bypassed with paths like
+// "/x/../admin" or "//admin". A trailing slash is kept, as rules may
+// have one. It reports false if uri isn't an absolute path.
+func requestPath(uri string) (string, bool) {
+	raw, _, _ := strings.Cut(uri, "?")
+	p, err := url.PathUnescape(raw)
+	if err != nil || !strings.HasPrefix(p, "/") {
+		return "", false
+	}
+	cleaned := path.Clean(p)
+	if strings.HasSuffix(p, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned, true
+}
+
+// whoisFunc looks up who is at a Tailscale IP:port, like
+// tailscale.WhoIs.
+type whoisFunc func(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error)
+
+// whoisCacheMaxSize is the number of entries at which a whoisCache
+// drops its expired entries.
+const whoisCacheMaxSize = 1000
+
+// whoisCache caches WhoIs lookups by IP, as nginx makes a subrequest
+// for every request but the node at an IP rarely changes.
+type whoisCache struct {
+	lookup  whoisFunc
+	ttl     time.Duration // zero disables caching
+	timeNow func() time.Time
+
+	mu sync.Mutex
+	m  map[netip.Addr]whoisEntry
+}
+
+type whoisEntry struct {
+	res     *apitype.WhoIsResponse
+	expires time.Time
+}
+
+// get returns who is at addr, from the cache if possible. Errors
+// aren't cached.
+func (c *whoisCache) get(ctx context.Context, addr netip.AddrPort) (*apitype.WhoIsResponse, error) {
+	if c.ttl <= 0 {
+		return c.lookup(ctx, addr.String())
+	}
+	now := c.timeNow()
+	c.mu.Lock()
+	e, ok := c.m[addr.Addr()]
+	c.mu.Unlock()
+	if ok && now.Before(e.expires) {
+		return e.res, nil
+	}
+
+	res, err := c.lookup(ctx, addr.String())
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.m == nil {
+		c.m = make(map[netip.Addr]whoisEntry)
+	}
+	if len(c.m) >= whoisCacheMaxSize {
+		for k, e := range c.m {
+			if !now.Before(e.expires) {
+				delete(c.m, k)
+			}
+		}
+	}
+	if len(c.m) < whoisCacheMaxSize {
+		c.m[addr.Addr()] = whoisEntry{res: res, expires: now.Add(c.ttl)}
+	}
+	return res, nil
+}
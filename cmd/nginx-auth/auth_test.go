@@ -0,0 +1,344 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+const testConfig = `{
+	"headers": {"user": "X-Webauth-User", "profilePicture": "-"},
+	"rules": [
+		{"host": "grafana.example.com", "domains": ["example.com"]},
+		{"host": "grafana.example.com", "pathPrefix": "/admin", "users": ["alice@example.com"]},
+		{"host": "*.internal.example.com", "users": ["*"], "tags": ["tag:monitoring"]},
+		{"pathPrefix": "/metrics", "tags": ["tag:prometheus"]},
+		{"host": "secret.example.com", "caps": ["https://example.com/cap/secret"]},
+	],
+}`
+
+var testNodes = map[string]*apitype.WhoIsResponse{
+	"100.64.0.1": {
+		Node:        &tailcfg.Node{Name: "alice-laptop.example.com.beta.tailscale.net.", ComputedName: "alice-laptop", Hostinfo: (&tailcfg.Hostinfo{Hostname: "alice-laptop"}).View()},
+		UserProfile: &tailcfg.UserProfile{LoginName: "alice@example.com", DisplayName: "Alice", ProfilePicURL: "https://example.com/alice.png"},
+	},
+	"100.64.0.2": {
+		Node:        &tailcfg.Node{Name: "bob-laptop.example.com.beta.tailscale.net.", ComputedName: "bob-laptop", Hostinfo: (&tailcfg.Hostinfo{Hostname: "bob-laptop"}).View()},
+		UserProfile: &tailcfg.UserProfile{LoginName: "bob@example.com", DisplayName: "Bob"},
+	},
+	"100.64.0.3": {
+		Node:        &tailcfg.Node{Name: "eve.example.com.beta.tailscale.net.", ComputedName: "eve", Hostinfo: (&tailcfg.Hostinfo{Hostname: "eve"}).View()},
+		UserProfile: &tailcfg.UserProfile{LoginName: "eve@evil.example"},
+	},
+	"100.64.0.4": {
+		Node:        &tailcfg.Node{Name: "prom.example.com.beta.tailscale.net.", ComputedName: "prom", Hostinfo: (&tailcfg.Hostinfo{Hostname: "prom"}).View(), Tags: []string{"tag:prometheus", "tag:monitoring"}},
+		UserProfile: &tailcfg.UserProfile{LoginName: "tagged-devices"},
+	},
+	"100.64.0.5": {
+		Node:        &tailcfg.Node{Name: "box.example.com.beta.tailscale.net.", ComputedName: "box", Hostinfo: (&tailcfg.Hostinfo{Hostname: "box"}).View(), Tags: []string{"tag:other"}},
+		UserProfile: &tailcfg.UserProfile{LoginName: "tagged-devices"},
+		Caps:        []string{"https://example.com/cap/secret"},
+	},
+}
+
+func testWhoIs(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error) {
+	ap, err := netip.ParseAddrPort(remoteAddr)
+	if err != nil {
+		return nil, err
+	}
+	if res, ok := testNodes[ap.Addr().String()]; ok {
+		return res, nil
+	}
+	return nil, errors.New("not found")
+}
+
+func TestAuth(t *testing.T) {
+	cfg, err := parseConfig([]byte(testConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name        string
+		noConfig    bool
+		ip          string
+		host        string
+		uri         string
+		wantCode    int
+		wantHeaders map[string]string
+	}{
+		{
+			name:     "domain",
+			ip:       "100.64.0.2",
+			host:     "grafana.example.com",
+			uri:      "/d/abc?x=1",
+			wantCode: http.StatusNoContent,
+			wantHeaders: map[string]string{
+				"Tailscale-Login":   "bob",
+				"X-Webauth-User":    "bob@example.com",
+				"Tailscale-Name":    "Bob",
+				"Tailscale-Tailnet": "example.com",
+			},
+		},
+		{
+			name:     "domain-wrong",
+			ip:       "100.64.0.3",
+			host:     "grafana.example.com",
+			uri:      "/",
+			wantCode: http.StatusForbidden,
+		},
+		{
+			name:     "admin-user",
+			ip:       "100.64.0.1",
+			host:     "grafana.example.com:443",
+			uri:      "/admin/users",
+			wantCode: http.StatusNoContent,
+		},
+		{
+			name:     "admin-other-user",
+			ip:       "100.64.0.2",
+			host:     "grafana.example.com",
+			uri:      "/admin",
+			wantCode: http.StatusForbidden,
+		},
+		{
+			name:     "admin-dot-dot",
+			ip:       "100.64.0.2",
+			host:     "grafana.example.com",
+			uri:      "/x/../admin",
+			wantCode: http.StatusForbidden,
+		},
+		{
+			name:     "admin-double-slash",
+			ip:       "100.64.0.2",
+			host:     "grafana.example.com",
+			uri:      "//admin/users",
+			wantCode: http.StatusForbidden,
+		},
+		{
+			name:     "admin-escaped",
+			ip:       "100.64.0.2",
+			host:     "grafana.example.com",
+			uri:      "/%2e%2e/admin%2Fusers",
+			wantCode: http.StatusForbidden,
+		},
+		{
+			name:     "missing-uri",
+			ip:       "100.64.0.2",
+			host:     "grafana.example.com",
+			uri:      "",
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			name:     "invalid-uri",
+			ip:       "100.64.0.2",
+			host:     "grafana.example.com",
+			uri:      "/%zz",
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			name:     "admin-prefix-not-segment",
+			ip:       "100.64.0.2",
+			host:     "grafana.example.com",
+			uri:      "/administrator",
+			wantCode: http.StatusNoContent,
+		},
+		{
+			name:     "wildcard-host-any-user",
+			ip:       "100.64.0.3",
+			host:     "wiki.internal.example.com",
+			uri:      "/",
+			wantCode: http.StatusNoContent,
+		},
+		{
+			name:     "wildcard-host-tag",
+			ip:       "100.64.0.4",
+			host:     "wiki.internal.example.com",
+			uri:      "/",
+			wantCode: http.StatusNoContent,
+			wantHeaders: map[string]string{
+				"Tailscale-Tags":    "tag:prometheus,tag:monitoring",
+				"Tailscale-Tailnet": "example.com",
+			},
+		},
+		{
+			name:     "tagged-not-a-user",
+			ip:       "100.64.0.5",
+			host:     "wiki.internal.example.com",
+			uri:      "/",
+			wantCode: http.StatusForbidden,
+		},
+		{
+			name:     "any-host-path",
+			ip:       "100.64.0.4",
+			host:     "app.example.com",
+			uri:      "/metrics",
+			wantCode: http.StatusNoContent,
+		},
+		{
+			name:     "specific-host-beats-any-host",
+			ip:       "100.64.0.4",
+			host:     "grafana.example.com",
+			uri:      "/metrics",
+			wantCode: http.StatusForbidden,
+		},
+		{
+			name:     "cap",
+			ip:       "100.64.0.5",
+			host:     "secret.example.com",
+			uri:      "/",
+			wantCode: http.StatusNoContent,
+		},
+		{
+			name:     "no-rule",
+			ip:       "100.64.0.1",
+			host:     "other.example.com",
+			uri:      "/",
+			wantCode: http.StatusForbidden,
+		},
+		{
+			name:     "unknown-ip",
+			ip:       "100.64.0.99",
+			host:     "grafana.example.com",
+			uri:      "/",
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			name:     "no-config-user",
+			noConfig: true,
+			ip:       "100.64.0.3",
+			host:     "other.example.com",
+			uri:      "/",
+			wantCode: http.StatusNoContent,
+			wantHeaders: map[string]string{
+				"Tailscale-User":            "eve@evil.example",
+				"Tailscale-Profile-Picture": "",
+			},
+		},
+		{
+			name:     "no-config-tagged",
+			noConfig: true,
+			ip:       "100.64.0.4",
+			host:     "other.example.com",
+			uri:      "/",
+			wantCode: http.StatusForbidden,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := cfg
+			if tt.noConfig {
+				c = nil
+			}
+			s := newAuthServer(c, testWhoIs, 0)
+			req := httptest.NewRequest("GET", "/auth", nil)
+			req.Host = tt.host
+			req.Header.Set("Remote-Addr", tt.ip)
+			req.Header.Set("Remote-Port", "12345")
+			req.Header.Set("Original-URI", tt.uri)
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, req)
+			if rec.Code != tt.wantCode {
+				t.Fatalf("code = %d; want %d", rec.Code, tt.wantCode)
+			}
+			for k, want := range tt.wantHeaders {
+				if got, ok := rec.Header()[k]; !ok || got[0] != want {
+					t.Errorf("header %s = %q; want %q", k, got, want)
+				}
+			}
+			if !tt.noConfig {
+				if _, ok := rec.Header()["Tailscale-Profile-Picture"]; ok {
+					t.Errorf("disabled header Tailscale-Profile-Picture set")
+				}
+			}
+		})
+	}
+}
+
+func TestRequestPath(t *testing.T) {
+	tests := []struct {
+		uri    string
+		want   string
+		wantOK bool
+	}{
+		{"/", "/", true},
+		{"/a/b?c=/d", "/a/b", true},
+		{"/a/b/", "/a/b/", true},
+		{"/a/./b/../c", "/a/c", true},
+		{"//a//b", "/a/b", true},
+		{"/../..", "/", true},
+		{"/a%2F..%2Fb", "/b", true},
+		{"", "", false},
+		{"a/b", "", false},
+		{"http://example.com/a", "", false},
+		{"/%zz", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := requestPath(tt.uri)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("requestPath(%q) = %q, %v; want %q, %v", tt.uri, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		wantErr string
+	}{
+		{"unknown-field", `{"rulez": []}`, "unknown field"},
+		{"allows-nobody", `{"rules": [{"host": "a"}]}`, "rules[0]: allows nobody"},
+		{"bad-path", `{"rules": [{"pathPrefix": "admin", "users": ["*"]}]}`, `rules[0]: pathPrefix "admin" doesn't start with /`},
+		{"bad-tag", `{"rules": [{"tags": ["prometheus"]}]}`, `rules[0]: tag "prometheus" doesn't start with "tag:"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseConfig([]byte(tt.config))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got error %v; want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestWhoisCache(t *testing.T) {
+	var lookups []string
+	now := time.Unix(1000, 0)
+	c := &whoisCache{
+		lookup: func(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error) {
+			lookups = append(lookups, remoteAddr)
+			return testWhoIs(ctx, remoteAddr)
+		},
+		ttl:     time.Minute,
+		timeNow: func() time.Time { return now },
+	}
+	get := func(addr string) {
+		t.Helper()
+		c.get(context.Background(), netip.MustParseAddrPort(addr))
+	}
+	get("100.64.0.1:1")
+	get("100.64.0.1:2") // cached, despite the different port
+	get("100.64.0.99:1")
+	get("100.64.0.99:1") // errors aren't cached
+	now = now.Add(time.Minute)
+	get("100.64.0.1:3") // expired
+	want := []string{"100.64.0.1:1", "100.64.0.99:1", "100.64.0.99:1", "100.64.0.1:3"}
+	if !reflect.DeepEqual(lookups, want) {
+		t.Errorf("lookups = %q; want %q", lookups, want)
+	}
+}
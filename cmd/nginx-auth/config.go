@@ -0,0 +1,233 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/tailscale/hujson"
+	"tailscale.com/client/tailscale/apitype"
+)
+
+// Config is the format of the HuJSON file passed with --config.
+//
+// An example config:
+//
+//	{
+//		"headers": {"user": "X-Webauth-User", "profilePicture": "-"},
+//		"rules": [
+//			{"host": "grafana.example.com", "domains": ["example.com"]},
+//			{"host": "grafana.example.com", "pathPrefix": "/admin", "users": ["alice@example.com"]},
+//			{"host": "*.internal.example.com", "tags": ["tag:monitoring"], "users": ["*"]},
+//		],
+//	}
+type Config struct {
+	// Headers optionally renames the response headers.
+	Headers HeaderNames `json:"headers"`
+
+	// Rules are the authorization rules. A request is allowed if
+	// the most specific rule matching its host and path allows the
+	// node it's from. If there are rules but none match, the request
+	// is denied. If there are no rules, all untagged nodes are
+	// allowed.
+	Rules []Rule `json:"rules"`
+}
+
+// HeaderNames are the names of the headers that nginx-auth sets on
+// allowed responses, for nginx to pass on with auth_request_set. Empty
+// names get the defaults below, and "-" omits the header.
+type HeaderNames struct {
+	Login          string `json:"login"`          // default Tailscale-Login
+	User           string `json:"user"`           // default Tailscale-User
+	Name           string `json:"name"`           // default Tailscale-Name
+	ProfilePicture string `json:"profilePicture"` // default Tailscale-Profile-Picture
+	Tailnet        string `json:"tailnet"`        // default Tailscale-Tailnet
+	Tags           string `json:"tags"`           // default Tailscale-Tags
+}
+
+var defaultHeaderNames = HeaderNames{
+	Login:          "Tailscale-Login",
+	User:           "Tailscale-User",
+	Name:           "Tailscale-Name",
+	ProfilePicture: "Tailscale-Profile-Picture",
+	Tailnet:        "Tailscale-Tailnet",
+	Tags:           "Tailscale-Tags",
+}
+
+// withDefaults returns h with empty names replaced by the defaults.
+func (h HeaderNames) withDefaults() HeaderNames {
+	def := func(v *string, d string) {
+		if *v == "" {
+			*v = d
+		}
+	}
+	def(&h.Login, defaultHeaderNames.Login)
+	def(&h.User, defaultHeaderNames.User)
+	def(&h.Name, defaultHeaderNames.Name)
+	def(&h.ProfilePicture, defaultHeaderNames.ProfilePicture)
+	def(&h.Tailnet, defaultHeaderNames.Tailnet)
+	def(&h.Tags, defaultHeaderNames.Tags)
+	return h
+}
+
+// Rule is an authorization rule in a Config.
+type Rule struct {
+	// Host is the nginx Host the rule applies to: a hostname, a
+	// wildcard such as "*.example.com" matching its subdomains, or
+	// empty or "*" for any host.
+	Host string `json:"host,omitempty"`
+
+	// PathPrefix, if non-empty, restricts the rule to paths equal
+	// to it or under it. A PathPrefix of "/admin" matches "/admin"
+	// and "/admin/users" but not "/administrator".
+	PathPrefix string `json:"pathPrefix,omitempty"`
+
+	// Users are the login names of the users allowed, or "*" for
+	// all users. Users never match tagged nodes.
+	Users []string `json:"users,omitempty"`
+
+	// Domains are the domains of the login names of the users
+	// allowed, such as "example.com".
+	Domains []string `json:"domains,omitempty"`
+
+	// Tags are the tags of the tagged nodes allowed.
+	Tags []string `json:"tags,omitempty"`
+
+	// Caps are capabilities granted to nodes by the tailnet policy
+	// that allow them.
+	Caps []string `json:"caps,omitempty"`
+}
+
+// LoadConfig loads the Config in the HuJSON file fname.
+func LoadConfig(fname string) (*Config, error) {
+	b, err := os.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	c, err := parseConfig(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fname, err)
+	}
+	return c, nil
+}
+
+func parseConfig(b []byte) (*Config, error) {
+	b, err := hujson.Standardize(b)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	c := new(Config)
+	if err := dec.Decode(c); err != nil {
+		return nil, err
+	}
+	for i, r := range c.Rules {
+		if r.PathPrefix != "" && !strings.HasPrefix(r.PathPrefix, "/") {
+			return nil, fmt.Errorf("rules[%d]: pathPrefix %q doesn't start with /", i, r.PathPrefix)
+		}
+		if len(r.Users)+len(r.Domains)+len(r.Tags)+len(r.Caps) == 0 {
+			return nil, fmt.Errorf("rules[%d]: allows nobody; set users, domains, tags or caps", i)
+		}
+		for _, t := range r.Tags {
+			if !strings.HasPrefix(t, "tag:") {
+				return nil, fmt.Errorf("rules[%d]: tag %q doesn't start with \"tag:\"", i, t)
+			}
+		}
+	}
+	return c, nil
+}
+
+// ruleFor returns the most specific rule in c that matches host and
+// path, or nil if none do. Rules for a specific host are more specific
+// than wildcard hosts, which are more specific than rules for any host;
+// then longer path prefixes are more specific. Among equally specific
+// rules, the first one wins.
+func (c *Config) ruleFor(host, path string) *Rule {
+	host = strings.ToLower(host)
+	var best *Rule
+	bestHost, bestPath := -1, -1
+	for i := range c.Rules {
+		r := &c.Rules[i]
+		hs := r.hostScore(host)
+		if hs < 0 || !r.matchesPath(path) {
+			continue
+		}
+		if hs > bestHost || hs == bestHost && len(r.PathPrefix) > bestPath {
+			best, bestHost, bestPath = r, hs, len(r.PathPrefix)
+		}
+	}
+	return best
+}
+
+// hostScore returns how specifically r matches host: 2 for an exact
+// match, 1 for a wildcard match, 0 for a rule for any host, or -1 if r
+// doesn't match host.
+func (r *Rule) hostScore(host string) int {
+	rh := strings.ToLower(r.Host)
+	switch {
+	case rh == "" || rh == "*":
+		return 0
+	case rh == host:
+		return 2
+	case strings.HasPrefix(rh, "*.") && strings.HasSuffix(host, rh[1:]):
+		return 1
+	}
+	return -1
+}
+
+func (r *Rule) matchesPath(path string) bool {
+	p := r.PathPrefix
+	if p == "" || strings.HasSuffix(p, "/") {
+		return strings.HasPrefix(path, p)
+	}
+	return path == p || strings.HasPrefix(path, p+"/")
+}
+
+// allows reports whether r allows the node described by who.
+func (r *Rule) allows(who *apitype.WhoIsResponse) bool {
+	for _, c := range who.Caps {
+		if contains(r.Caps, c) {
+			return true
+		}
+	}
+	if len(who.Node.Tags) > 0 {
+		for _, t := range who.Node.Tags {
+			if contains(r.Tags, t) {
+				return true
+			}
+		}
+		return false
+	}
+	login := who.UserProfile.LoginName
+	for _, u := range r.Users {
+		if u == "*" || strings.EqualFold(u, login) {
+			return true
+		}
+	}
+	if _, domain, ok := strings.Cut(login, "@"); ok {
+		for _, d := range r.Domains {
+			if strings.EqualFold(d, domain) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func contains(s []string, v string) bool {
+	for _, e := range s {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
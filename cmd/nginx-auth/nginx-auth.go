@@ -16,80 +16,33 @@
 	"log"
 	"net"
 	"net/http"
-	"net/netip"
-	"net/url"
 	"os"
-	"strings"
+	"time"
 
 	"github.com/coreos/go-systemd/activation"
 	"tailscale.com/client/tailscale"
 )
 
 var (
-	sockPath = flag.String("sockpath", "", "the filesystem path for the unix socket this service exposes")
+	sockPath   = flag.String("sockpath", "", "the filesystem path for the unix socket this service exposes")
+	configPath = flag.String("config", "", "if non-empty, the path of a HuJSON file with authorization rules and header names")
+	cacheTTL   = flag.Duration("whois-cache-ttl", 30*time.Second, "how long to cache the identity of each Tailscale IP; 0 disables caching")
 )
 
 func main() {
 	flag.Parse()
 
-	mux := http.NewServeMux()
-	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		remoteHost := r.Header.Get("Remote-Addr")
-		remotePort := r.Header.Get("Remote-Port")
-		if remoteHost == "" || remotePort == "" {
-			w.WriteHeader(http.StatusBadRequest)
-			log.Println("set Remote-Addr to $remote_addr and Remote-Port to $remote_port in your nginx config")
-			return
-		}
-
-		remoteAddrStr := net.JoinHostPort(remoteHost, remotePort)
-		remoteAddr, err := netip.ParseAddrPort(remoteAddrStr)
-		if err != nil {
-			w.WriteHeader(http.StatusUnauthorized)
-			log.Printf("remote address and port are not valid: %v", err)
-			return
-		}
-
-		info, err := tailscale.WhoIs(r.Context(), remoteAddr.String())
+	var cfg *Config
+	if *configPath != "" {
+		var err error
+		cfg, err = LoadConfig(*configPath)
 		if err != nil {
-			w.WriteHeader(http.StatusUnauthorized)
-			log.Printf("can't look up %s: %v", remoteAddr, err)
-			return
-		}
-
-		if len(info.Node.Tags) != 0 {
-			w.WriteHeader(http.StatusForbidden)
-			log.Printf("node %s is tagged", info.Node.Hostinfo.Hostname())
-			return
-		}
-
-		_, tailnet, ok := strings.Cut(info.Node.Name, info.Node.ComputedName+".")
-		if !ok {
-			w.WriteHeader(http.StatusUnauthorized)
-			log.Printf("can't extract tailnet name from hostname %q", info.Node.Name)
-			return
-		}
-		tailnet, _, ok = strings.Cut(tailnet, ".beta.tailscale.net")
-		if !ok {
-			w.WriteHeader(http.StatusUnauthorized)
-			log.Printf("can't extract tailnet name from hostname %q", info.Node.Name)
-			return
-		}
-
-		if expectedTailnet := r.Header.Get("Expected-Tailnet"); expectedTailnet != "" && expectedTailnet != tailnet {
-			w.WriteHeader(http.StatusForbidden)
-			log.Printf("user is part of tailnet %s, wanted: %s", tailnet, url.QueryEscape(expectedTailnet))
-			return
+			log.Fatalf("loading config: %v", err)
 		}
+	}
 
-		h := w.Header()
-		h.Set("Tailscale-Login", strings.Split(info.UserProfile.LoginName, "@")[0])
-		h.Set("Tailscale-User", info.UserProfile.LoginName)
-		h.Set("Tailscale-Name", info.UserProfile.DisplayName)
-		h.Set("Tailscale-Profile-Picture", info.UserProfile.ProfilePicURL)
-		h.Set("Tailscale-Tailnet", tailnet)
-		w.WriteHeader(http.StatusNoContent)
-	})
+	mux := http.NewServeMux()
+	mux.Handle("/", newAuthServer(cfg, tailscale.WhoIs, *cacheTTL))
 
 	if *sockPath != "" {
 		_ = os.Remove(*sockPath) // ignore error, this file may not already exist
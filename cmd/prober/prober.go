@@ -0,0 +1,100 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// The prober binary runs the probes in a HuJSON config file, as
+// described by prober.Config, and exports their results as
+// Prometheus metrics at /metrics.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"tailscale.com/prober"
+	"tailscale.com/tailcfg"
+	"tailscale.com/tsweb"
+)
+
+var (
+	configPath = flag.String("config", "", "path to the HuJSON probe config")
+	listen     = flag.String("listen", ":8030", "HTTP listen address")
+)
+
+func main() {
+	flag.Parse()
+	if *configPath == "" {
+		log.Fatal("--config is required")
+	}
+	b, err := os.ReadFile(*configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	cfg, err := prober.ParseConfig(b)
+	if err != nil {
+		log.Fatalf("%s: %v", *configPath, err)
+	}
+
+	var dm *tailcfg.DERPMap
+	if cfg.HasDERPProbes() {
+		if cfg.DERPMap == "" {
+			log.Fatalf("%s: derp probes need a derpMap", *configPath)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		dm, err = getDERPMap(ctx, cfg.DERPMap)
+		cancel()
+		if err != nil {
+			log.Fatalf("fetching DERP map: %v", err)
+		}
+	}
+
+	p := prober.New()
+	probes, err := p.RunConfig(cfg, dm)
+	if err != nil {
+		log.Fatalf("%s: %v", *configPath, err)
+	}
+	log.Printf("running %d probes", len(probes))
+	expvar.Publish("prober", p.Expvar())
+
+	mux := http.NewServeMux()
+	tsweb.Debugger(mux)
+	mux.HandleFunc("/metrics", tsweb.VarzHandler)
+	log.Fatal(http.ListenAndServe(*listen, mux))
+}
+
+var httpOrFileClient = &http.Client{Transport: httpOrFileTransport()}
+
+func httpOrFileTransport() http.RoundTripper {
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.RegisterProtocol("file", http.NewFileTransport(http.Dir("/")))
+	return tr
+}
+
+// getDERPMap fetches the DERP map from url, which may be https://,
+// http:// or file://.
+func getDERPMap(ctx context.Context, url string) (*tailcfg.DERPMap, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := httpOrFileClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("fetching %s: %s", url, res.Status)
+	}
+	dm := new(tailcfg.DERPMap)
+	if err := json.NewDecoder(res.Body).Decode(dm); err != nil {
+		return nil, fmt.Errorf("decoding %s JSON: %v", url, err)
+	}
+	return dm, nil
+}
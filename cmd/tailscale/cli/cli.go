@@ -163,6 +163,7 @@ func Run(args []string) (err error) {
 			ipCmd,
 			statusCmd,
 			pingCmd,
+			speedtestCmd,
 			ncCmd,
 			sshCmd,
 			versionCmd,
@@ -170,6 +171,7 @@ func Run(args []string) (err error) {
 			fileCmd,
 			bugReportCmd,
 			certCmd,
+			dnsCmd,
 		},
 		FlagSet:   rootfs,
 		Exec:      func(context.Context, []string) error { return flag.ErrHelp },
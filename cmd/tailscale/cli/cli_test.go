@@ -12,12 +12,16 @@
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	qt "github.com/frankban/quicktest"
 	"github.com/google/go-cmp/cmp"
 	"inet.af/netaddr"
+	"tailscale.com/client/tailscale/apitype"
 	"tailscale.com/ipn"
 	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/net/speedtest"
+	"tailscale.com/tailcfg"
 	"tailscale.com/tstest"
 	"tailscale.com/types/persist"
 	"tailscale.com/types/preftype"
@@ -569,6 +573,48 @@ func TestPrefsFromUpArgs(t *testing.T) {
 				NetfilterMode: preftype.NetfilterOn,
 			},
 		},
+		{
+			name: "dial_policy",
+			args: upArgsFromOSArgs("linux", "--dial-policy=*.corp.example.com:443=exit-node, [fd7a::/16]:22=direct,*=direct"),
+			want: &ipn.Prefs{
+				ControlURL:       ipn.DefaultControlURL,
+				WantRunning:      true,
+				AllowSingleHosts: true,
+				CorpDNS:          true,
+				DialPolicy: []preftype.DialRule{
+					{Dst: "*.corp.example.com", Ports: "443", Via: "exit-node"},
+					{Dst: "fd7a::/16", Ports: "22", Via: "direct"},
+					{Dst: "*", Via: "direct"},
+				},
+				NetfilterMode: preftype.NetfilterOn,
+			},
+		},
+		{
+			name: "error_dial_policy_bad_route",
+			args: upArgsT{
+				dialPolicy: "*=elsewhere",
+			},
+			wantErr: `--dial-policy: invalid dial rule route "elsewhere"; want "direct" or "exit-node"`,
+		},
+		{
+			name: "connector_domains",
+			args: upArgsFromOSArgs("linux", "--advertise-connector-domains=GitHub.com., *.example.org"),
+			want: &ipn.Prefs{
+				ControlURL:                ipn.DefaultControlURL,
+				WantRunning:               true,
+				AllowSingleHosts:          true,
+				CorpDNS:                   true,
+				AdvertiseConnectorDomains: []string{"github.com", "example.org"},
+				NetfilterMode:             preftype.NetfilterOn,
+			},
+		},
+		{
+			name: "error_connector_domain_wildcard",
+			args: upArgsT{
+				advertiseConnectorDomains: "foo.*.com",
+			},
+			wantErr: `--advertise-connector-domains: invalid domain "foo.*.com"`,
+		},
 		{
 			name: "error_advertise_route_invalid_ip",
 			args: upArgsT{
@@ -597,6 +643,120 @@ func TestPrefsFromUpArgs(t *testing.T) {
 			},
 			wantErr: `--exit-node-allow-lan-access can only be used with --exit-node`,
 		},
+		{
+			name: "exit_node_lan_routes",
+			args: upArgsT{
+				exitNodeIP:        "100.64.5.6",
+				exitNodeLANRoutes: "192.168.5.0/24, 10.8.0.0/16",
+				netfilterMode:     "off",
+			},
+			want: &ipn.Prefs{
+				WantRunning:       true,
+				ExitNodeIP:        netaddr.MustParseIP("100.64.5.6"),
+				ExitNodeLANRoutes: []netaddr.IPPrefix{netaddr.MustParseIPPrefix("192.168.5.0/24"), netaddr.MustParseIPPrefix("10.8.0.0/16")},
+				AdvertiseRoutes:   []netaddr.IPPrefix{},
+				NoSNAT:            true,
+				NetfilterMode:     preftype.NetfilterOff,
+			},
+		},
+		{
+			name: "error_exit_node_lan_routes_without_exit_node",
+			args: upArgsT{
+				exitNodeLANRoutes: "192.168.5.0/24",
+			},
+			wantErr: `--exit-node-lan-routes can only be used with --exit-node`,
+		},
+		{
+			name: "error_exit_node_lan_routes_default_route",
+			args: upArgsT{
+				exitNodeIP:        "100.64.5.6",
+				exitNodeLANRoutes: "0.0.0.0/0",
+			},
+			wantErr: `--exit-node-lan-routes: 0.0.0.0/0 would route all traffic directly; use no exit node instead`,
+		},
+		{
+			name: "exit_blocked_ports",
+			args: upArgsT{
+				advertiseDefaultRoute: true,
+				exitBlockedPorts:      "25, 137-139",
+				netfilterMode:         "off",
+			},
+			want: &ipn.Prefs{
+				WantRunning: true,
+				AdvertiseRoutes: []netaddr.IPPrefix{
+					netaddr.MustParseIPPrefix("0.0.0.0/0"),
+					netaddr.MustParseIPPrefix("::/0"),
+				},
+				ExitBlockedPorts: []tailcfg.PortRange{{First: 25, Last: 25}, {First: 137, Last: 139}},
+				NoSNAT:           true,
+				NetfilterMode:    preftype.NetfilterOff,
+			},
+		},
+		{
+			name: "error_exit_blocked_ports_without_exit_node",
+			args: upArgsT{
+				exitBlockedPorts: "25",
+			},
+			wantErr: `--exit-blocked-ports can only be used with --advertise-exit-node`,
+		},
+		{
+			name: "error_exit_blocked_ports_invalid",
+			args: upArgsT{
+				advertiseDefaultRoute: true,
+				exitBlockedPorts:      "139-137",
+			},
+			wantErr: `--exit-blocked-ports: "139-137" is not a valid port or port range`,
+		},
+		{
+			name: "advertise_nat64",
+			args: upArgsT{
+				advertiseRoutes: "192.168.1.0/24",
+				advertiseNAT64:  true,
+				netfilterMode:   "off",
+			},
+			want: &ipn.Prefs{
+				WantRunning: true,
+				AdvertiseRoutes: []netaddr.IPPrefix{
+					netaddr.MustParseIPPrefix("192.168.1.0/24"),
+				},
+				AdvertiseNAT64: true,
+				NoSNAT:         true,
+				NetfilterMode:  preftype.NetfilterOff,
+			},
+		},
+		{
+			name: "error_advertise_nat64_without_ipv4_routes",
+			args: upArgsT{
+				advertiseRoutes: "fd00::/64",
+				advertiseNAT64:  true,
+			},
+			wantErr: `--advertise-nat64 requires IPv4 routes in --advertise-routes`,
+		},
+		{
+			name: "dns64",
+			args: upArgsT{
+				acceptRoutes:  true,
+				acceptDNS:     true,
+				dns64:         true,
+				netfilterMode: "off",
+			},
+			want: &ipn.Prefs{
+				WantRunning:     true,
+				RouteAll:        true,
+				CorpDNS:         true,
+				DNS64:           true,
+				AdvertiseRoutes: []netaddr.IPPrefix{},
+				NoSNAT:          true,
+				NetfilterMode:   preftype.NetfilterOff,
+			},
+		},
+		{
+			name: "error_dns64_without_accept_routes",
+			args: upArgsT{
+				dns64: true,
+			},
+			wantErr: `--dns64 can only be used with --accept-routes`,
+		},
 		{
 			name: "error_tag_prefix",
 			args: upArgsT{
@@ -835,22 +995,28 @@ func TestUpdatePrefs(t *testing.T) {
 			},
 			env: upCheckEnv{backendState: "Running"},
 			wantJustEditMP: &ipn.MaskedPrefs{
-				AdvertiseRoutesSet:        true,
-				AdvertiseTagsSet:          true,
-				AllowSingleHostsSet:       true,
-				ControlURLSet:             true,
-				CorpDNSSet:                true,
-				ExitNodeAllowLANAccessSet: true,
-				ExitNodeIDSet:             true,
-				ExitNodeIPSet:             true,
-				HostnameSet:               true,
-				NetfilterModeSet:          true,
-				NoSNATSet:                 true,
-				OperatorUserSet:           true,
-				RouteAllSet:               true,
-				RunSSHSet:                 true,
-				ShieldsUpSet:              true,
-				WantRunningSet:            true,
+				AdvertiseConnectorDomainsSet: true,
+				AdvertiseNAT64Set:            true,
+				AdvertiseRoutesSet:           true,
+				AdvertiseTagsSet:             true,
+				AllowSingleHostsSet:          true,
+				ControlURLSet:                true,
+				CorpDNSSet:                   true,
+				DialPolicySet:                true,
+				DNS64Set:                     true,
+				ExitNodeAllowLANAccessSet:    true,
+				ExitNodeIDSet:                true,
+				ExitNodeIPSet:                true,
+				ExitBlockedPortsSet:          true,
+				ExitNodeLANRoutesSet:         true,
+				HostnameSet:                  true,
+				NetfilterModeSet:             true,
+				NoSNATSet:                    true,
+				OperatorUserSet:              true,
+				RouteAllSet:                  true,
+				RunSSHSet:                    true,
+				ShieldsUpSet:                 true,
+				WantRunningSet:               true,
 			},
 		},
 		{
@@ -985,3 +1151,123 @@ func TestCleanUpArgs(t *testing.T) {
 		c.Assert(got, qt.DeepEquals, tt.want)
 	}
 }
+
+func TestPrintSpeedTestResult(t *testing.T) {
+	tests := []struct {
+		name     string
+		res      apitype.SpeedTestResult
+		streams  int
+		wantPath string
+	}{
+		{"direct", apitype.SpeedTestResult{CurAddr: "1.2.3.4:41641", Relay: "nyc"}, 1, "Path: direct (1.2.3.4:41641)\n"},
+		{"derp", apitype.SpeedTestResult{Relay: "nyc"}, 4, "Path: via DERP (nyc)\nStreams: 4\n"},
+		{"unknown", apitype.SpeedTestResult{}, 1, "Path: unknown\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.res.Results = []speedtest.Result{
+				{Bytes: 125000, IntervalStart: 0, IntervalEnd: time.Second},
+				{Bytes: 125000, IntervalStart: 0, IntervalEnd: time.Second, Total: true},
+			}
+			var buf bytes.Buffer
+			printSpeedTestResult(&buf, &tt.res, tt.streams)
+			got := buf.String()
+			if !strings.HasPrefix(got, tt.wantPath) {
+				t.Errorf("got output:\n%s\nwant prefix %q", got, tt.wantPath)
+			}
+			if !strings.Contains(got, "1.0000") || !strings.Contains(got, "Mbits/sec") {
+				t.Errorf("output lacks bandwidth:\n%s", got)
+			}
+		})
+	}
+}
+
+func TestPrintDNSQueryResult(t *testing.T) {
+	tests := []struct {
+		name      string
+		res       apitype.DNSQueryResult
+		wantRoute string
+	}{
+		{
+			name:      "local",
+			res:       apitype.DNSQueryResult{DNSQueryLogEntry: apitype.DNSQueryLogEntry{Local: true, RCode: "NOERROR"}},
+			wantRoute: "Route: answered by tailscaled from MagicDNS records\n",
+		},
+		{
+			name: "split",
+			res: apitype.DNSQueryResult{
+				DNSQueryLogEntry: apitype.DNSQueryLogEntry{Route: "corp.example.", Upstream: "10.0.0.53", RCode: "NXDOMAIN"},
+				Resolvers:        []string{"10.0.0.53", "10.0.0.54"},
+			},
+			wantRoute: "Route: split DNS for corp.example., via 10.0.0.53, 10.0.0.54\nUpstream: 10.0.0.53\n",
+		},
+		{
+			name: "default",
+			res: apitype.DNSQueryResult{
+				DNSQueryLogEntry: apitype.DNSQueryLogEntry{Route: ".", Upstream: "1.1.1.1", RCode: "NOERROR"},
+				Resolvers:        []string{"1.1.1.1"},
+			},
+			wantRoute: "Route: default, via 1.1.1.1\nUpstream: 1.1.1.1\n",
+		},
+		{
+			name: "fallback",
+			res: apitype.DNSQueryResult{
+				DNSQueryLogEntry: apitype.DNSQueryLogEntry{Upstream: "192.168.1.1", RCode: "NOERROR"},
+				Resolvers:        []string{"192.168.1.1"},
+			},
+			wantRoute: "Route: no route matched; using fallback resolvers 192.168.1.1\nUpstream: 192.168.1.1\n",
+		},
+		{
+			name:      "none",
+			res:       apitype.DNSQueryResult{DNSQueryLogEntry: apitype.DNSQueryLogEntry{Error: "no upstream resolvers set"}},
+			wantRoute: "Route: none; no resolvers are configured for this name\nError: no upstream resolvers set",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.res.Name = "foo.example."
+			tt.res.Type = "A"
+			var buf bytes.Buffer
+			printDNSQueryResult(&buf, &tt.res)
+			got := buf.String()
+			if want := "Query: foo.example. A\n" + tt.wantRoute; !strings.HasPrefix(got, want) {
+				t.Errorf("got output:\n%s\nwant prefix:\n%s", got, want)
+			}
+		})
+	}
+}
+
+func TestPrintExitUsage(t *testing.T) {
+	var buf bytes.Buffer
+	printExitUsage(&buf, nil)
+	if got, want := buf.String(), "# No traffic forwarded as an exit node.\n"; got != want {
+		t.Errorf("got %q; want %q", got, want)
+	}
+
+	buf.Reset()
+	printExitUsage(&buf, []apitype.ExitNodeUsage{
+		{
+			Name:           "laptop",
+			IPs:            []string{"100.64.1.2"},
+			ExitNodeCounts: apitype.ExitNodeCounts{TxPackets: 3, TxBytes: 300, RxPackets: 2, RxBytes: 900},
+			BlockedPackets: 1,
+			TopDestinations: []apitype.ExitNodeDestUsage{
+				{Proto: "TCP", Port: 443, ExitNodeCounts: apitype.ExitNodeCounts{TxPackets: 2, TxBytes: 200, RxPackets: 2, RxBytes: 900}},
+				{Proto: "ICMPv4", ExitNodeCounts: apitype.ExitNodeCounts{TxPackets: 1, TxBytes: 100}},
+			},
+		},
+		{
+			IPs:            []string{"100.64.9.9"},
+			ExitNodeCounts: apitype.ExitNodeCounts{TxPackets: 1, TxBytes: 60},
+		},
+	})
+	want := `PEER        DESTINATION  TX PACKETS  TX BYTES  RX PACKETS  RX BYTES  BLOCKED
+laptop      *            3           300       2           900       1
+            TCP/443      2           200       2           900       -
+            ICMPv4       1           100       0           0         -
+100.64.9.9  *            1           60        0           0         0
+`
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
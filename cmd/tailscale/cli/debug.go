@@ -28,6 +28,7 @@
 	"tailscale.com/control/controlhttp"
 	"tailscale.com/hostinfo"
 	"tailscale.com/ipn"
+	"tailscale.com/logtail/filesink"
 	"tailscale.com/net/tsaddr"
 	"tailscale.com/paths"
 	"tailscale.com/safesocket"
@@ -118,6 +119,27 @@
 				return fs
 			})(),
 		},
+		{
+			Name:      "logs",
+			Exec:      runLogs,
+			ShortHelp: "print tailscaled's locally kept logs",
+			LongHelp: strings.TrimSpace(`
+"tailscale debug logs" prints the log records that tailscaled keeps
+locally when run with TS_LOG_TARGET=file:///path, instead of uploading
+them. It asks tailscaled for them, unless --dir is given, in which case
+it reads that directory itself.
+`),
+			FlagSet: (func() *flag.FlagSet {
+				fs := newFlagSet("logs")
+				fs.StringVar(&logsArgs.since, "since", "", "only print records from this time on; an RFC 3339 time, or a duration such as 1h meaning that long ago")
+				fs.StringVar(&logsArgs.until, "until", "", "only print records up to this time; same format as --since")
+				fs.IntVar(&logsArgs.level, "level", -1, "most verbose level to print; -1 means all")
+				fs.StringVar(&logsArgs.grep, "grep", "", "only print records containing this text")
+				fs.BoolVar(&logsArgs.json, "json", false, "print records as JSON, one per line, as logged")
+				fs.StringVar(&logsArgs.dir, "dir", "", "if non-empty, read logs from this directory rather than from tailscaled")
+				return fs
+			})(),
+		},
 		{
 			Name:      "via",
 			Exec:      runVia,
@@ -505,3 +527,81 @@ func runTS2021(ctx context.Context, args []string) error {
 	log.Printf("final underlying conn: %v / %v", conn.LocalAddr(), conn.RemoteAddr())
 	return nil
 }
+
+var logsArgs struct {
+	since string
+	until string
+	level int
+	grep  string
+	json  bool
+	dir   string
+}
+
+func runLogs(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return errors.New("unexpected arguments")
+	}
+	now := time.Now()
+	q := filesink.Query{
+		MaxLevel: logsArgs.level,
+		Text:     logsArgs.grep,
+	}
+	var err error
+	if q.Since, err = parseLogsTime(logsArgs.since, now); err != nil {
+		return fmt.Errorf("--since: %w", err)
+	}
+	if q.Until, err = parseLogsTime(logsArgs.until, now); err != nil {
+		return fmt.Errorf("--until: %w", err)
+	}
+
+	bw := bufio.NewWriter(Stdout)
+	defer bw.Flush()
+	print := func(r *filesink.Record) error {
+		if logsArgs.json || r.Text == "" {
+			bw.Write(r.Raw)
+			return bw.WriteByte('\n')
+		}
+		if !r.Time.IsZero() {
+			bw.WriteString(r.Time.Format(time.RFC3339Nano))
+			bw.WriteByte(' ')
+		}
+		if r.Level > 0 {
+			fmt.Fprintf(bw, "[v%d] ", r.Level)
+		}
+		bw.WriteString(strings.TrimSuffix(r.Text, "\n"))
+		return bw.WriteByte('\n')
+	}
+
+	if logsArgs.dir != "" {
+		return filesink.Read(logsArgs.dir, q, print)
+	}
+	rc, err := localClient.Logs(ctx, q)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	bs := bufio.NewScanner(rc)
+	bs.Buffer(nil, 1<<20)
+	for bs.Scan() {
+		r, err := filesink.ParseRecord(bs.Bytes())
+		if err != nil {
+			return err
+		}
+		if err := print(r); err != nil {
+			return err
+		}
+	}
+	return bs.Err()
+}
+
+// parseLogsTime parses v as either an RFC 3339 time or a duration
+// before now. The empty string is the zero time.
+func parseLogsTime(v string, now time.Time) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(v); err == nil {
+		return now.Add(-d), nil
+	}
+	return time.Parse(time.RFC3339Nano, v)
+}
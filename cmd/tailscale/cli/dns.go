@@ -0,0 +1,292 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/peterbourgon/ff/v3/ffcli"
+	"golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/client/tailscale/apitype"
+)
+
+var dnsCmd = &ffcli.Command{
+	Name:       "dns",
+	ShortUsage: "dns <status|query|log> ...",
+	ShortHelp:  "Diagnose DNS resolution",
+	LongHelp: strings.TrimSpace(`
+
+The 'tailscale dns' commands show how tailscaled's DNS resolver
+(100.100.100.100) and the OS's DNS are configured, and how queries
+are routed to MagicDNS and to split DNS resolvers.
+
+`),
+	Subcommands: []*ffcli.Command{
+		dnsStatusCmd,
+		dnsQueryCmd,
+		dnsLogCmd,
+	},
+	Exec: func(context.Context, []string) error {
+		return errors.New("dns subcommand required; run 'tailscale dns -h' for details")
+	},
+}
+
+var dnsStatusCmd = &ffcli.Command{
+	Name:       "status",
+	ShortUsage: "dns status [--json]",
+	ShortHelp:  "Show the DNS configuration",
+	Exec:       runDNSStatus,
+	FlagSet: (func() *flag.FlagSet {
+		fs := newFlagSet("status")
+		fs.BoolVar(&dnsArgs.json, "json", false, "output in JSON format")
+		return fs
+	})(),
+}
+
+var dnsQueryCmd = &ffcli.Command{
+	Name:       "query",
+	ShortUsage: "dns query [--json] <name> [type]",
+	ShortHelp:  "Resolve a name with tailscaled's resolver and explain how",
+	LongHelp: strings.TrimSpace(`
+
+The 'tailscale dns query' command asks tailscaled's resolver to resolve
+a name, for the record type A by default, and shows which route and
+upstream resolver it used. Supported types are A, AAAA, CNAME, MX, NS,
+PTR, SOA, SRV, TXT and ANY.
+
+`),
+	Exec: runDNSQuery,
+	FlagSet: (func() *flag.FlagSet {
+		fs := newFlagSet("query")
+		fs.BoolVar(&dnsArgs.json, "json", false, "output in JSON format")
+		return fs
+	})(),
+}
+
+var dnsLogCmd = &ffcli.Command{
+	Name:       "log",
+	ShortUsage: "dns log [--json]",
+	ShortHelp:  "Show recent queries handled by tailscaled's resolver",
+	Exec:       runDNSLog,
+	FlagSet: (func() *flag.FlagSet {
+		fs := newFlagSet("log")
+		fs.BoolVar(&dnsArgs.json, "json", false, "output in JSON format")
+		return fs
+	})(),
+}
+
+var dnsArgs struct {
+	json bool
+}
+
+func printJSON(v any) error {
+	j, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	printf("%s\n", j)
+	return nil
+}
+
+func runDNSStatus(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return errors.New("unexpected non-flag arguments to 'tailscale dns status'")
+	}
+	st, err := localClient.DNSStatus(ctx)
+	if err != nil {
+		return err
+	}
+	if dnsArgs.json {
+		return printJSON(st)
+	}
+	printDNSStatus(Stdout, st)
+	return nil
+}
+
+// printDNSStatus writes st to w.
+func printDNSStatus(w io.Writer, st *apitype.DNSStatus) {
+	split := "split DNS not supported"
+	if st.SupportsSplitDNS {
+		split = "split DNS supported"
+	}
+	fmt.Fprintf(w, "OS configurator: %s (%s)\n", st.OSConfigurator, split)
+	switch {
+	case len(st.OSNameservers) == 0:
+		fmt.Fprintln(w, "OS nameservers: unchanged")
+	case len(st.OSMatchDomains) == 0:
+		fmt.Fprintf(w, "OS nameservers: %s, for all names\n", strings.Join(st.OSNameservers, ", "))
+	default:
+		fmt.Fprintf(w, "OS nameservers: %s, for %s\n", strings.Join(st.OSNameservers, ", "), strings.Join(st.OSMatchDomains, ", "))
+	}
+	if len(st.SearchDomains) > 0 {
+		fmt.Fprintf(w, "Search domains: %s\n", strings.Join(st.SearchDomains, ", "))
+	}
+	fmt.Fprintf(w, "MagicDNS names: %d\n", st.MagicDNSHosts)
+	if len(st.DefaultResolvers) > 0 {
+		fmt.Fprintf(w, "Default resolvers: %s\n", strings.Join(st.DefaultResolvers, ", "))
+	}
+	if len(st.Routes) == 0 {
+		return
+	}
+	fmt.Fprintln(w, "Routes:")
+	suffixes := make([]string, 0, len(st.Routes))
+	for s := range st.Routes {
+		suffixes = append(suffixes, s)
+	}
+	sort.Strings(suffixes)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, s := range suffixes {
+		rs := st.Routes[s]
+		if len(rs) == 0 {
+			fmt.Fprintf(tw, "  %s\tMagicDNS only\n", s)
+			continue
+		}
+		fmt.Fprintf(tw, "  %s\t%s\n", s, strings.Join(rs, ", "))
+	}
+	tw.Flush()
+}
+
+func runDNSQuery(ctx context.Context, args []string) error {
+	if len(args) < 1 || len(args) > 2 || args[0] == "" {
+		return errors.New("usage: dns query [--json] <name> [type]")
+	}
+	typ := "A"
+	if len(args) == 2 {
+		typ = args[1]
+	}
+	res, err := localClient.QueryDNS(ctx, args[0], typ)
+	if err != nil {
+		return err
+	}
+	if dnsArgs.json {
+		return printJSON(res)
+	}
+	printDNSQueryResult(Stdout, res)
+	return nil
+}
+
+// printDNSQueryResult writes res and an explanation of how the query was
+// routed to w.
+func printDNSQueryResult(w io.Writer, res *apitype.DNSQueryResult) {
+	fmt.Fprintf(w, "Query: %s %s\n", res.Name, res.Type)
+	switch {
+	case res.Local:
+		fmt.Fprintln(w, "Route: answered by tailscaled from MagicDNS records")
+	case res.Route == "" && len(res.Resolvers) == 0:
+		fmt.Fprintln(w, "Route: none; no resolvers are configured for this name")
+	case res.Route == "":
+		fmt.Fprintf(w, "Route: no route matched; using fallback resolvers %s\n", strings.Join(res.Resolvers, ", "))
+	case res.Route == ".":
+		fmt.Fprintf(w, "Route: default, via %s\n", strings.Join(res.Resolvers, ", "))
+	default:
+		fmt.Fprintf(w, "Route: split DNS for %s, via %s\n", res.Route, strings.Join(res.Resolvers, ", "))
+	}
+	if res.Upstream != "" {
+		fmt.Fprintf(w, "Upstream: %s\n", res.Upstream)
+	}
+	if res.Error != "" {
+		fmt.Fprintf(w, "Error: %s (after %v)\n", res.Error, res.Latency.Round(time.Millisecond))
+	} else {
+		fmt.Fprintf(w, "Response: %s in %v\n", res.RCode, res.Latency.Round(time.Millisecond))
+	}
+	printDNSAnswers(w, res.Response)
+}
+
+// printDNSAnswers writes the answers in the DNS response msg to w.
+func printDNSAnswers(w io.Writer, msg []byte) {
+	var p dnsmessage.Parser
+	if _, err := p.Start(msg); err != nil {
+		return
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return
+	}
+	answers, err := p.AllAnswers()
+	if err != nil || len(answers) == 0 {
+		return
+	}
+	fmt.Fprintln(w, "Answers:")
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, a := range answers {
+		typ := strings.TrimPrefix(a.Header.Type.String(), "Type")
+		fmt.Fprintf(tw, "  %s\t%d\t%s\t%s\n", a.Header.Name, a.Header.TTL, typ, dnsRecordString(a.Body))
+	}
+	tw.Flush()
+}
+
+// dnsRecordString returns the data of the DNS record r.
+func dnsRecordString(r dnsmessage.ResourceBody) string {
+	switch r := r.(type) {
+	case *dnsmessage.AResource:
+		return net.IP(r.A[:]).String()
+	case *dnsmessage.AAAAResource:
+		return net.IP(r.AAAA[:]).String()
+	case *dnsmessage.CNAMEResource:
+		return r.CNAME.String()
+	case *dnsmessage.NSResource:
+		return r.NS.String()
+	case *dnsmessage.PTRResource:
+		return r.PTR.String()
+	case *dnsmessage.MXResource:
+		return fmt.Sprintf("%d %s", r.Pref, r.MX)
+	case *dnsmessage.SRVResource:
+		return fmt.Sprintf("%d %d %d %s", r.Priority, r.Weight, r.Port, r.Target)
+	case *dnsmessage.TXTResource:
+		return fmt.Sprintf("%q", r.TXT)
+	case *dnsmessage.SOAResource:
+		return fmt.Sprintf("%s %s %d", r.NS, r.MBox, r.Serial)
+	}
+	return fmt.Sprintf("%v", r)
+}
+
+func runDNSLog(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return errors.New("unexpected non-flag arguments to 'tailscale dns log'")
+	}
+	log, err := localClient.DNSQueryLog(ctx)
+	if err != nil {
+		return err
+	}
+	if dnsArgs.json {
+		return printJSON(log)
+	}
+	printDNSQueryLog(Stdout, log)
+	return nil
+}
+
+// printDNSQueryLog writes the entries of a DNS query log to w.
+func printDNSQueryLog(w io.Writer, log []apitype.DNSQueryLogEntry) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "TIME\tNAME\tTYPE\tROUTE\tUPSTREAM\tRESULT\tLATENCY")
+	for _, e := range log {
+		route, upstream := e.Route, e.Upstream
+		if e.Local {
+			route, upstream = "local", "-"
+		}
+		if route == "" {
+			route = "-"
+		}
+		if upstream == "" {
+			upstream = "-"
+		}
+		result := e.RCode
+		if e.Error != "" {
+			result = "error: " + e.Error
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%v\n",
+			e.Time.Local().Format("15:04:05.000"), e.Name, e.Type, route, upstream, result, e.Latency.Round(time.Millisecond))
+	}
+	tw.Flush()
+}
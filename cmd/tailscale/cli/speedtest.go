@@ -0,0 +1,107 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/peterbourgon/ff/v3/ffcli"
+	"inet.af/netaddr"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/net/speedtest"
+)
+
+var speedtestCmd = &ffcli.Command{
+	Name:       "speedtest",
+	ShortUsage: "speedtest [flags] <hostname-or-IP>",
+	ShortHelp:  "Measure throughput to a peer over Tailscale",
+	LongHelp: strings.TrimSpace(`
+
+The 'tailscale speedtest' command measures the throughput between this
+node and a peer, using the peer's peerapi. By default the peer sends
+and this node receives; use --reverse to test the other direction.
+
+The peer must be owned by the same user, or have granted this node the
+speedtest capability.
+
+`),
+	Exec: runSpeedtest,
+	FlagSet: (func() *flag.FlagSet {
+		fs := newFlagSet("speedtest")
+		fs.BoolVar(&speedtestArgs.reverse, "reverse", false, "send to the peer instead of receiving from it")
+		fs.DurationVar(&speedtestArgs.duration, "duration", speedtest.DefaultDuration, fmt.Sprintf("duration of the test, within %v and %v", speedtest.MinDuration, speedtest.MaxDuration))
+		fs.IntVar(&speedtestArgs.streams, "streams", 1, "number of parallel streams to use")
+		return fs
+	})(),
+}
+
+var speedtestArgs struct {
+	reverse  bool
+	duration time.Duration
+	streams  int
+}
+
+func runSpeedtest(ctx context.Context, args []string) error {
+	if len(args) != 1 || args[0] == "" {
+		return errors.New("usage: speedtest [flags] <hostname-or-IP>")
+	}
+	if speedtestArgs.duration < speedtest.MinDuration || speedtestArgs.duration > speedtest.MaxDuration {
+		return fmt.Errorf("--duration must be within %v and %v", speedtest.MinDuration, speedtest.MaxDuration)
+	}
+	if speedtestArgs.streams < 1 {
+		return errors.New("--streams must be at least 1")
+	}
+	ip, self, err := tailscaleIPFromArg(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	if self {
+		return fmt.Errorf("%v is local Tailscale IP", ip)
+	}
+	dir := speedtest.Download
+	if speedtestArgs.reverse {
+		dir = speedtest.Upload
+	}
+
+	printf("Starting a %v %s test with %s\n", speedtestArgs.duration, dir, args[0])
+	res, err := localClient.SpeedTest(ctx, netaddr.MustParseIP(ip), dir, speedtestArgs.duration, speedtestArgs.streams)
+	if err != nil {
+		return err
+	}
+	printSpeedTestResult(Stdout, res, speedtestArgs.streams)
+	return nil
+}
+
+// printSpeedTestResult writes res, the result of a test with the given
+// number of streams, to w.
+func printSpeedTestResult(w io.Writer, res *apitype.SpeedTestResult, streams int) {
+	switch {
+	case res.CurAddr != "":
+		fmt.Fprintf(w, "Path: direct (%s)\n", res.CurAddr)
+	case res.Relay != "":
+		fmt.Fprintf(w, "Path: via DERP (%s)\n", res.Relay)
+	default:
+		fmt.Fprintln(w, "Path: unknown")
+	}
+	if streams > 1 {
+		fmt.Fprintf(w, "Streams: %d\n", streams)
+	}
+	tw := tabwriter.NewWriter(w, 12, 0, 0, ' ', tabwriter.TabIndent)
+	fmt.Fprintln(tw, "Interval\t\tTransfer\t\tBandwidth\t\t")
+	for _, r := range res.Results {
+		if r.Total {
+			fmt.Fprintln(tw, "-------------------------------------------------------------------------")
+		}
+		fmt.Fprintf(tw, "%.2f-%.2f\tsec\t%.4f\tMBits\t%.4f\tMbits/sec\t\n", r.IntervalStart.Seconds(), r.IntervalEnd.Seconds(), r.MegaBits(), r.MBitsPerSecond())
+	}
+	tw.Flush()
+}
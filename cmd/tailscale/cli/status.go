@@ -11,14 +11,17 @@
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"os"
 	"strings"
+	"text/tabwriter"
 
 	"github.com/peterbourgon/ff/v3/ffcli"
 	"github.com/toqueteos/webbrowser"
 	"inet.af/netaddr"
+	"tailscale.com/client/tailscale/apitype"
 	"tailscale.com/ipn"
 	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/net/interfaces"
@@ -27,7 +30,7 @@
 
 var statusCmd = &ffcli.Command{
 	Name:       "status",
-	ShortUsage: "status [--active] [--web] [--json]",
+	ShortUsage: "status [--active] [--web] [--json] [--exit-usage]",
 	ShortHelp:  "Show state of tailscaled and its connections",
 	LongHelp: strings.TrimSpace(`
 
@@ -54,6 +57,7 @@
 		fs.BoolVar(&statusArgs.peers, "peers", true, "show status of peers")
 		fs.StringVar(&statusArgs.listen, "listen", "127.0.0.1:8384", "listen address for web mode; use port 0 for automatic")
 		fs.BoolVar(&statusArgs.browser, "browser", true, "Open a browser in web mode")
+		fs.BoolVar(&statusArgs.exitUsage, "exit-usage", false, "show the traffic this exit node forwarded for each peer, and the destinations with the most traffic")
 		return fs
 	})(),
 }
@@ -66,12 +70,25 @@
 	active  bool   // in CLI mode, filter output to only peers with active sessions
 	self    bool   // in CLI mode, show status of local machine
 	peers   bool   // in CLI mode, show status of peer machines
+
+	exitUsage bool // show exit node usage rather than status
 }
 
 func runStatus(ctx context.Context, args []string) error {
 	if len(args) > 0 {
 		return errors.New("unexpected non-flag arguments to 'tailscale status'")
 	}
+	if statusArgs.exitUsage {
+		usage, err := localClient.ExitUsage(ctx)
+		if err != nil {
+			return fixTailscaledConnectError(err)
+		}
+		if statusArgs.json {
+			return printJSON(usage)
+		}
+		printExitUsage(Stdout, usage)
+		return nil
+	}
 	getStatus := localClient.Status
 	if !statusArgs.peers {
 		getStatus = localClient.StatusWithoutPeers
@@ -190,6 +207,15 @@ func runStatus(ctx context.Context, args []string) error {
 		if anyTraffic {
 			f(", tx %d rx %d", ps.TxBytes, ps.RxBytes)
 		}
+		if ps.SubnetRouterUnhealthy {
+			f("; subnet router failing health checks")
+		}
+		if len(ps.FailoverRoutes) > 0 {
+			f("; failover router for %s", prefixesString(ps.FailoverRoutes))
+		}
+		if len(ps.StandbyRoutes) > 0 {
+			f("; standby router for %s", prefixesString(ps.StandbyRoutes))
+		}
 		f("\n")
 	}
 
@@ -213,6 +239,9 @@ func runStatus(ctx context.Context, args []string) error {
 			printPS(ps)
 		}
 	}
+	if es := st.ExitNodeStatus; es != nil && len(es.LocalRoutes) > 0 {
+		f("\n# Exit node: local routes accessed directly: %s\n", prefixesString(es.LocalRoutes))
+	}
 	Stdout.Write(buf.Bytes())
 	return nil
 }
@@ -266,3 +295,39 @@ func firstIPString(v []netaddr.IP) string {
 	}
 	return v[0].String()
 }
+
+func prefixesString(ps []netaddr.IPPrefix) string {
+	ss := make([]string, len(ps))
+	for i, p := range ps {
+		ss[i] = p.String()
+	}
+	return strings.Join(ss, ",")
+}
+
+// printExitUsage writes the exit traffic of each peer, and of its top
+// destinations, to w.
+func printExitUsage(w io.Writer, usage []apitype.ExitNodeUsage) {
+	if len(usage) == 0 {
+		fmt.Fprintln(w, "# No traffic forwarded as an exit node.")
+		return
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "PEER\tDESTINATION\tTX PACKETS\tTX BYTES\tRX PACKETS\tRX BYTES\tBLOCKED")
+	for _, u := range usage {
+		peer := strings.Join(u.IPs, ",")
+		if u.Name != "" {
+			peer = u.Name
+		}
+		fmt.Fprintf(tw, "%s\t*\t%d\t%d\t%d\t%d\t%d\n", peer,
+			u.TxPackets, u.TxBytes, u.RxPackets, u.RxBytes, u.BlockedPackets)
+		for _, d := range u.TopDestinations {
+			dest := d.Proto
+			if d.Port != 0 {
+				dest = fmt.Sprintf("%s/%d", d.Proto, d.Port)
+			}
+			fmt.Fprintf(tw, "\t%s\t%d\t%d\t%d\t%d\t-\n", dest,
+				d.TxPackets, d.TxBytes, d.RxPackets, d.RxBytes)
+		}
+	}
+	tw.Flush()
+}
@@ -17,6 +17,7 @@
 	"reflect"
 	"runtime"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -32,6 +33,7 @@
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/logger"
 	"tailscale.com/types/preftype"
+	"tailscale.com/util/dnsname"
 	"tailscale.com/version"
 	"tailscale.com/version/distro"
 )
@@ -95,16 +97,22 @@ func newUpFlagSet(goos string, upArgs *upArgsT) *flag.FlagSet {
 	upf.StringVar(&upArgs.server, "login-server", ipn.DefaultControlURL, "base URL of control server")
 	upf.BoolVar(&upArgs.acceptRoutes, "accept-routes", acceptRouteDefault(goos), "accept routes advertised by other Tailscale nodes")
 	upf.BoolVar(&upArgs.acceptDNS, "accept-dns", true, "accept DNS configuration from the admin panel")
+	upf.BoolVar(&upArgs.dns64, "dns64", false, "synthesize IPv6 addresses in MagicDNS for IPv4 addresses in other nodes' NAT64 subnet routes (requires --accept-routes)")
 	upf.BoolVar(&upArgs.singleRoutes, "host-routes", true, "install host routes to other Tailscale nodes")
 	upf.StringVar(&upArgs.exitNodeIP, "exit-node", "", "Tailscale exit node (IP or base name) for internet traffic, or empty string to not use an exit node")
 	upf.BoolVar(&upArgs.exitNodeAllowLANAccess, "exit-node-allow-lan-access", false, "Allow direct access to the local network when routing traffic via an exit node")
+	upf.StringVar(&upArgs.exitNodeLANRoutes, "exit-node-lan-routes", "", "local routes to access directly rather than via the exit node (comma-separated, e.g. \"192.168.5.0/24,10.8.0.0/16\")")
+	upf.StringVar(&upArgs.dialPolicy, "dial-policy", "", `comma-separated DST[:PORTS]=VIA rules routing userspace-networking proxy dials, where DST is "*", a domain, "*.domain" for its subdomains, an IP or CIDR, and VIA is "direct" or "exit-node" (e.g. "*.corp.example.com=exit-node,*=direct")`)
 	upf.BoolVar(&upArgs.shieldsUp, "shields-up", false, "don't allow incoming connections")
 	upf.BoolVar(&upArgs.runSSH, "ssh", false, "run an SSH server, permitting access per tailnet admin's declared policy")
 	upf.StringVar(&upArgs.advertiseTags, "advertise-tags", "", "comma-separated ACL tags to request; each must start with \"tag:\" (e.g. \"tag:eng,tag:montreal,tag:ssh\")")
 	upf.StringVar(&upArgs.authKeyOrFile, "auth-key", "", `node authorization key; if it begins with "file:", then it's a path to a file containing the authkey`)
 	upf.StringVar(&upArgs.hostname, "hostname", "", "hostname to use instead of the one provided by the OS")
 	upf.StringVar(&upArgs.advertiseRoutes, "advertise-routes", "", "routes to advertise to other nodes (comma-separated, e.g. \"10.0.0.0/8,192.168.0.0/24\") or empty string to not advertise routes")
+	upf.BoolVar(&upArgs.advertiseNAT64, "advertise-nat64", false, "also advertise the IPv4 routes of --advertise-routes as IPv6 routes in the Tailscale NAT64 range, translating their TCP and UDP traffic to IPv4; ACLs must allow the IPv6 routes")
 	upf.BoolVar(&upArgs.advertiseDefaultRoute, "advertise-exit-node", false, "offer to be an exit node for internet traffic for the tailnet")
+	upf.StringVar(&upArgs.exitBlockedPorts, "exit-blocked-ports", "", "TCP and UDP destination ports to not forward peers' internet traffic to as an exit node (comma-separated, e.g. \"25,137-139\")")
+	upf.StringVar(&upArgs.advertiseConnectorDomains, "advertise-connector-domains", "", "route peers' traffic for these domains and their subdomains through this node as an app connector (comma-separated, e.g. \"github.com,example.org\"), or empty string to not be an app connector")
 	if safesocket.GOOSUsesPeerCreds(goos) {
 		upf.StringVar(&upArgs.opUser, "operator", "", "Unix username to allow to operate on tailscaled without sudo")
 	}
@@ -128,28 +136,34 @@ func defaultNetfilterMode() string {
 }
 
 type upArgsT struct {
-	qr                     bool
-	reset                  bool
-	server                 string
-	acceptRoutes           bool
-	acceptDNS              bool
-	singleRoutes           bool
-	exitNodeIP             string
-	exitNodeAllowLANAccess bool
-	shieldsUp              bool
-	runSSH                 bool
-	forceReauth            bool
-	forceDaemon            bool
-	advertiseRoutes        string
-	advertiseDefaultRoute  bool
-	advertiseTags          string
-	snat                   bool
-	netfilterMode          string
-	authKeyOrFile          string // "secret" or "file:/path/to/secret"
-	hostname               string
-	opUser                 string
-	json                   bool
-	timeout                time.Duration
+	qr                        bool
+	reset                     bool
+	server                    string
+	acceptRoutes              bool
+	acceptDNS                 bool
+	dns64                     bool
+	singleRoutes              bool
+	exitNodeIP                string
+	exitNodeAllowLANAccess    bool
+	exitNodeLANRoutes         string
+	dialPolicy                string
+	shieldsUp                 bool
+	runSSH                    bool
+	forceReauth               bool
+	forceDaemon               bool
+	advertiseRoutes           string
+	advertiseNAT64            bool
+	advertiseDefaultRoute     bool
+	exitBlockedPorts          string
+	advertiseConnectorDomains string
+	advertiseTags             string
+	snat                      bool
+	netfilterMode             string
+	authKeyOrFile             string // "secret" or "file:/path/to/secret"
+	hostname                  string
+	opUser                    string
+	json                      bool
+	timeout                   time.Duration
 }
 
 func (a upArgsT) getAuthKey() (string, error) {
@@ -223,6 +237,71 @@ func validateViaPrefix(ipp netaddr.IPPrefix) error {
 	return nil
 }
 
+// calcExitNodeLANRoutes parses the comma-separated prefixes of
+// --exit-node-lan-routes.
+func calcExitNodeLANRoutes(s string) ([]netaddr.IPPrefix, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var routes []netaddr.IPPrefix
+	for _, r := range strings.Split(s, ",") {
+		ipp, err := netaddr.ParseIPPrefix(strings.TrimSpace(r))
+		if err != nil {
+			return nil, fmt.Errorf("--exit-node-lan-routes: %q is not a valid IP address or CIDR prefix", r)
+		}
+		if ipp != ipp.Masked() {
+			return nil, fmt.Errorf("--exit-node-lan-routes: %s has non-address bits set; expected %s", ipp, ipp.Masked())
+		}
+		if ipp.Bits() == 0 {
+			return nil, fmt.Errorf("--exit-node-lan-routes: %s would route all traffic directly; use no exit node instead", ipp)
+		}
+		routes = append(routes, ipp)
+	}
+	return routes, nil
+}
+
+// calcExitBlockedPorts parses the comma-separated ports and port
+// ranges of --exit-blocked-ports.
+func calcExitBlockedPorts(s string) ([]tailcfg.PortRange, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var prs []tailcfg.PortRange
+	for _, r := range strings.Split(s, ",") {
+		r = strings.TrimSpace(r)
+		first, last, ok := strings.Cut(r, "-")
+		if !ok {
+			last = first
+		}
+		f, ferr := strconv.ParseUint(first, 10, 16)
+		l, lerr := strconv.ParseUint(last, 10, 16)
+		if ferr != nil || lerr != nil || f == 0 || f > l {
+			return nil, fmt.Errorf("--exit-blocked-ports: %q is not a valid port or port range", r)
+		}
+		prs = append(prs, tailcfg.PortRange{First: uint16(f), Last: uint16(l)})
+	}
+	return prs, nil
+}
+
+// calcConnectorDomains parses the comma-separated domains of
+// --advertise-connector-domains. A leading "*." is allowed but
+// redundant, as a domain always covers its subdomains.
+func calcConnectorDomains(s string) ([]string, error) {
+	var domains []string
+	for _, d := range strings.Split(s, ",") {
+		d = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(d), "."))
+		d = strings.TrimPrefix(d, "*.")
+		if d == "" {
+			continue
+		}
+		if _, err := dnsname.ToFQDN(d); err != nil || strings.Contains(d, "*") {
+			return nil, fmt.Errorf("--advertise-connector-domains: invalid domain %q", d)
+		}
+		domains = append(domains, d)
+	}
+	return domains, nil
+}
+
 func calcAdvertiseRoutes(advertiseRoutes string, advertiseDefaultRoute bool) ([]netaddr.IPPrefix, error) {
 	routeMap := map[netaddr.IPPrefix]bool{}
 	if advertiseRoutes != "" {
@@ -286,6 +365,38 @@ func prefsFromUpArgs(upArgs upArgsT, warnf logger.Logf, st *ipnstate.Status, goo
 	if upArgs.exitNodeIP == "" && upArgs.exitNodeAllowLANAccess {
 		return nil, fmt.Errorf("--exit-node-allow-lan-access can only be used with --exit-node")
 	}
+	if upArgs.exitNodeIP == "" && upArgs.exitNodeLANRoutes != "" {
+		return nil, fmt.Errorf("--exit-node-lan-routes can only be used with --exit-node")
+	}
+	lanRoutes, err := calcExitNodeLANRoutes(upArgs.exitNodeLANRoutes)
+	if err != nil {
+		return nil, err
+	}
+
+	dialPolicy, err := preftype.ParseDialRules(upArgs.dialPolicy)
+	if err != nil {
+		return nil, fmt.Errorf("--dial-policy: %w", err)
+	}
+
+	connectorDomains, err := calcConnectorDomains(upArgs.advertiseConnectorDomains)
+	if err != nil {
+		return nil, err
+	}
+
+	exitBlockedPorts, err := calcExitBlockedPorts(upArgs.exitBlockedPorts)
+	if err != nil {
+		return nil, err
+	}
+	if len(exitBlockedPorts) > 0 && !tsaddr.ContainsExitRoutes(routes) {
+		return nil, fmt.Errorf("--exit-blocked-ports can only be used with --advertise-exit-node")
+	}
+
+	if upArgs.advertiseNAT64 && !hasIPv4SubnetRoutes(routes) {
+		return nil, fmt.Errorf("--advertise-nat64 requires IPv4 routes in --advertise-routes")
+	}
+	if upArgs.dns64 && !upArgs.acceptRoutes {
+		return nil, fmt.Errorf("--dns64 can only be used with --accept-routes")
+	}
 
 	var tags []string
 	if upArgs.advertiseTags != "" {
@@ -318,11 +429,17 @@ func prefsFromUpArgs(upArgs upArgsT, warnf logger.Logf, st *ipnstate.Status, goo
 	}
 
 	prefs.ExitNodeAllowLANAccess = upArgs.exitNodeAllowLANAccess
+	prefs.ExitNodeLANRoutes = lanRoutes
+	prefs.DialPolicy = dialPolicy
 	prefs.CorpDNS = upArgs.acceptDNS
+	prefs.DNS64 = upArgs.dns64
 	prefs.AllowSingleHosts = upArgs.singleRoutes
 	prefs.ShieldsUp = upArgs.shieldsUp
 	prefs.RunSSH = upArgs.runSSH
 	prefs.AdvertiseRoutes = routes
+	prefs.AdvertiseNAT64 = upArgs.advertiseNAT64
+	prefs.AdvertiseConnectorDomains = connectorDomains
+	prefs.ExitBlockedPorts = exitBlockedPorts
 	prefs.AdvertiseTags = tags
 	prefs.Hostname = upArgs.hostname
 	prefs.ForceDaemon = upArgs.forceDaemon
@@ -737,6 +854,12 @@ func init() {
 	addPrefFlagMapping("shields-up", "ShieldsUp")
 	addPrefFlagMapping("snat-subnet-routes", "NoSNAT")
 	addPrefFlagMapping("exit-node-allow-lan-access", "ExitNodeAllowLANAccess")
+	addPrefFlagMapping("exit-node-lan-routes", "ExitNodeLANRoutes")
+	addPrefFlagMapping("dial-policy", "DialPolicy")
+	addPrefFlagMapping("advertise-connector-domains", "AdvertiseConnectorDomains")
+	addPrefFlagMapping("advertise-nat64", "AdvertiseNAT64")
+	addPrefFlagMapping("dns64", "DNS64")
+	addPrefFlagMapping("exit-blocked-ports", "ExitBlockedPorts")
 	addPrefFlagMapping("unattended", "ForceDaemon")
 	addPrefFlagMapping("operator", "OperatorUser")
 	addPrefFlagMapping("ssh", "RunSSH")
@@ -947,12 +1070,32 @@ func prefsToFlags(env upCheckEnv, prefs *ipn.Prefs) (flagVal map[string]any) {
 			set(prefs.AllowSingleHosts)
 		case "accept-dns":
 			set(prefs.CorpDNS)
+		case "dns64":
+			set(prefs.DNS64)
 		case "shields-up":
 			set(prefs.ShieldsUp)
 		case "exit-node":
 			set(exitNodeIPStr())
 		case "exit-node-allow-lan-access":
 			set(prefs.ExitNodeAllowLANAccess)
+		case "exit-node-lan-routes":
+			var sb strings.Builder
+			for i, r := range prefs.ExitNodeLANRoutes {
+				if i > 0 {
+					sb.WriteByte(',')
+				}
+				sb.WriteString(r.String())
+			}
+			set(sb.String())
+		case "dial-policy":
+			var sb strings.Builder
+			for i, r := range prefs.DialPolicy {
+				if i > 0 {
+					sb.WriteByte(',')
+				}
+				sb.WriteString(r.String())
+			}
+			set(sb.String())
 		case "advertise-tags":
 			set(strings.Join(prefs.AdvertiseTags, ","))
 		case "hostname":
@@ -970,6 +1113,12 @@ func prefsToFlags(env upCheckEnv, prefs *ipn.Prefs) (flagVal map[string]any) {
 			set(sb.String())
 		case "advertise-exit-node":
 			set(hasExitNodeRoutes(prefs.AdvertiseRoutes))
+		case "advertise-nat64":
+			set(prefs.AdvertiseNAT64)
+		case "advertise-connector-domains":
+			set(strings.Join(prefs.AdvertiseConnectorDomains, ","))
+		case "exit-blocked-ports":
+			set(ipn.PortRangesString(prefs.ExitBlockedPorts))
 		case "snat-subnet-routes":
 			set(!prefs.NoSNAT)
 		case "netfilter-mode":
@@ -1021,6 +1170,17 @@ func withoutExitNodes(rr []netaddr.IPPrefix) []netaddr.IPPrefix {
 	return out
 }
 
+// hasIPv4SubnetRoutes reports whether rr has an IPv4 route other than
+// an exit node route.
+func hasIPv4SubnetRoutes(rr []netaddr.IPPrefix) bool {
+	for _, r := range rr {
+		if r.IP().Is4() && r.Bits() > 0 {
+			return true
+		}
+	}
+	return false
+}
+
 // exitNodeIP returns the exit node IP from p, using st to map
 // it from its ID form to an IP address if needed.
 func exitNodeIP(p *ipn.Prefs, st *ipnstate.Status) (ip netaddr.IP) {
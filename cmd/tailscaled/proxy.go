@@ -10,73 +10,425 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"net/http/httputil"
+	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/net/dstmatch"
+	"tailscale.com/net/socks5"
 )
 
+// httpProxyConfig is the configuration of the outbound HTTP proxy, as
+// read from --outbound-http-proxy-config or built from the individual
+// --outbound-http-proxy-* flags.
+type httpProxyConfig struct {
+	// CredentialsFile, if non-empty, is a file of "username:password"
+	// lines. Clients must then authenticate with one of them using
+	// Basic proxy authentication.
+	CredentialsFile string `json:",omitempty"`
+
+	// Allow, if non-empty, is the destinations clients may connect
+	// to, as dstmatch.Parse patterns.
+	Allow []string `json:",omitempty"`
+
+	// Deny is the destinations clients may not connect to. It takes
+	// precedence over Allow.
+	Deny []string `json:",omitempty"`
+
+	// AccessLog, if non-empty, is the path of a file to append a JSON
+	// record of each proxied request to.
+	AccessLog string `json:",omitempty"`
+}
+
+// loadHTTPProxyConfig loads the JSON httpProxyConfig in path.
+func loadHTTPProxyConfig(path string) (*httpProxyConfig, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	c := new(httpProxyConfig)
+	if err := dec.Decode(c); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return c, nil
+}
+
+// errProxyDenied is returned when dialing a destination the proxy's
+// policy doesn't permit.
+var errProxyDenied = errors.New("destination not permitted by proxy policy")
+
+// checkedDialFunc dials addr, like tsdial.Dialer.UserDialChecked: if
+// check is non-nil, it's called with the address addr resolved to
+// before dialing it, and the dial fails if check returns an error.
+type checkedDialFunc func(ctx context.Context, netw, addr string, check func(netaddr.IPPort) error) (net.Conn, error)
+
+// httpProxy is an outbound HTTP proxy, serving CONNECT and absolute-URL
+// requests via a backend dialer.
+type httpProxy struct {
+	dialer checkedDialFunc
+	rp     *httputil.ReverseProxy
+
+	creds  socks5.Credentials // if non-nil, clients must authenticate
+	policy *proxyPolicy       // if non-nil, restricts destinations
+
+	logMu     sync.Mutex
+	accessLog io.Writer // if non-nil, where JSON access records are written
+}
+
 // httpProxyHandler returns an HTTP proxy http.Handler using the
-// provided backend dialer.
-func httpProxyHandler(dialer func(ctx context.Context, netw, addr string) (net.Conn, error)) http.Handler {
-	rp := &httputil.ReverseProxy{
+// provided backend dialer and configuration. A nil cfg means no
+// authentication, no destination restrictions and no access log.
+func httpProxyHandler(dialer checkedDialFunc, cfg *httpProxyConfig) (http.Handler, error) {
+	p := &httpProxy{dialer: dialer}
+	p.rp = &httputil.ReverseProxy{
 		Director: func(r *http.Request) {}, // no change
 		Transport: &http.Transport{
-			DialContext: dialer,
+			DialContext: p.dial,
 		},
+		ErrorHandler: p.serveProxyError,
 	}
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != "CONNECT" {
-			backURL := r.RequestURI
-			if strings.HasPrefix(backURL, "/") || backURL == "*" {
-				http.Error(w, "bogus RequestURI; must be absolute URL or CONNECT", 400)
-				return
-			}
-			rp.ServeHTTP(w, r)
+	if cfg == nil {
+		return p, nil
+	}
+	if cfg.CredentialsFile != "" {
+		creds, err := loadProxyCredentials(cfg.CredentialsFile)
+		if err != nil {
+			return nil, err
+		}
+		p.creds = creds
+	}
+	if len(cfg.Allow) > 0 || len(cfg.Deny) > 0 {
+		pol, err := newProxyPolicy(cfg.Allow, cfg.Deny)
+		if err != nil {
+			return nil, err
+		}
+		p.policy = pol
+	}
+	if cfg.AccessLog != "" {
+		f, err := os.OpenFile(cfg.AccessLog, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return nil, err
+		}
+		p.accessLog = f
+	}
+	return p, nil
+}
+
+// proxyAccessRecord is the access log record of a proxied request.
+type proxyAccessRecord struct {
+	Time     time.Time
+	Client   string // client's IP:port
+	User     string `json:",omitempty"` // authenticated or attempted username
+	Method   string
+	Target   string  // CONNECT host:port, or the request URL
+	Status   int     // HTTP status returned to the client
+	BytesIn  int64   // body bytes from the client
+	BytesOut int64   // body bytes to the client
+	Duration float64 // seconds
+	Error    string  `json:",omitempty"`
+}
+
+func (p *httpProxy) logAccess(rec *proxyAccessRecord) {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return
+	}
+	b = append(b, '\n')
+	p.logMu.Lock()
+	defer p.logMu.Unlock()
+	p.accessLog.Write(b)
+}
+
+func (p *httpProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rec := &proxyAccessRecord{
+		Time:   time.Now(),
+		Client: r.RemoteAddr,
+		Method: r.Method,
+		Target: r.RequestURI,
+	}
+	if p.accessLog != nil {
+		defer func() {
+			rec.Duration = time.Since(rec.Time).Seconds()
+			p.logAccess(rec)
+		}()
+	}
+
+	if p.creds != nil {
+		user, pass, ok := parseProxyBasicAuth(r.Header.Get("Proxy-Authorization"))
+		rec.User = user
+		if !ok || !p.creds.Valid(user, pass) {
+			rec.Status = http.StatusProxyAuthRequired
+			w.Header().Set("Proxy-Authenticate", `Basic realm="tailscale"`)
+			http.Error(w, "proxy authentication required", rec.Status)
 			return
 		}
+	}
 
-		// CONNECT support:
+	if r.Method == "CONNECT" {
+		p.serveConnect(w, r, rec)
+		return
+	}
+	backURL := r.RequestURI
+	if strings.HasPrefix(backURL, "/") || backURL == "*" {
+		rec.Status = 400
+		http.Error(w, "bogus RequestURI; must be absolute URL or CONNECT", 400)
+		return
+	}
+	pw := &proxyResponseWriter{ResponseWriter: w}
+	var body *countingReader
+	if r.Body != nil {
+		body = &countingReader{r: r.Body}
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{body, r.Body}
+	}
+	p.rp.ServeHTTP(pw, r)
+	rec.Status = pw.status
+	rec.BytesOut = pw.n
+	if body != nil {
+		rec.BytesIn = body.n
+	}
+	if pw.err != nil {
+		rec.Error = pw.err.Error()
+	}
+}
 
-		dst := r.RequestURI
-		c, err := dialer(r.Context(), "tcp", dst)
-		if err != nil {
-			w.Header().Set("Tailscale-Connect-Error", err.Error())
-			http.Error(w, err.Error(), 500)
+func (p *httpProxy) serveConnect(w http.ResponseWriter, r *http.Request, rec *proxyAccessRecord) {
+	dst := r.RequestURI
+	c, err := p.dial(r.Context(), "tcp", dst)
+	if err != nil {
+		rec.Error = err.Error()
+		if errors.Is(err, errProxyDenied) {
+			rec.Status = http.StatusForbidden
+			http.Error(w, err.Error(), rec.Status)
 			return
 		}
-		defer c.Close()
+		rec.Status = 500
+		w.Header().Set("Tailscale-Connect-Error", err.Error())
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	defer c.Close()
+
+	cc, ccbuf, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		rec.Status = 500
+		rec.Error = err.Error()
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	defer cc.Close()
+
+	rec.Status = 200
+	io.WriteString(cc, "HTTP/1.1 200 OK\r\n\r\n")
+
+	var clientSrc io.Reader = ccbuf
+	if ccbuf.Reader.Buffered() == 0 {
+		// In the common case (with no
+		// buffered data), read directly from
+		// the underlying client connection to
+		// save some memory, letting the
+		// bufio.Reader/Writer get GC'ed.
+		clientSrc = cc
+	}
+
+	errc := make(chan error, 2)
+	go func() {
+		n, err := io.Copy(cc, c)
+		rec.BytesOut = n
+		errc <- err
+	}()
+	go func() {
+		n, err := io.Copy(c, clientSrc)
+		rec.BytesIn = n
+		errc <- err
+	}()
+	<-errc
+	// Stop the other direction too, and wait for it so that its
+	// byte count is complete.
+	c.Close()
+	cc.Close()
+	<-errc
+}
 
-		cc, ccbuf, err := w.(http.Hijacker).Hijack()
+// serveProxyError is the ReverseProxy's ErrorHandler.
+func (p *httpProxy) serveProxyError(w http.ResponseWriter, r *http.Request, err error) {
+	if pw, ok := w.(*proxyResponseWriter); ok {
+		pw.err = err
+	}
+	if errors.Is(err, errProxyDenied) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	w.WriteHeader(http.StatusBadGateway)
+}
+
+// dial dials addr for a client, enforcing p's destination policy, if
+// any.
+//
+// Hostname rules are checked against the requested name, and IP rules
+// against the address the name resolves to, before it's dialed, so
+// that a name can't be used to reach a denied IP.
+func (p *httpProxy) dial(ctx context.Context, netw, addr string) (net.Conn, error) {
+	if p.policy == nil {
+		return p.dialer(ctx, netw, addr, nil)
+	}
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port in %q", addr)
+	}
+	var name string
+	ip, err := netaddr.ParseIP(host)
+	if err == nil {
+		ip = ip.Unmap()
+	} else {
+		name = strings.ToLower(strings.TrimSuffix(host, "."))
+	}
+	if name == "" {
+		// The destination is fully known, so check it before dialing.
+		if !p.policy.allowed(name, ip, uint16(port)) {
+			return nil, errProxyDenied
+		}
+		return p.dialer(ctx, netw, addr, nil)
+	}
+	if p.policy.denied(name, ip, uint16(port)) {
+		return nil, errProxyDenied
+	}
+	return p.dialer(ctx, netw, addr, func(ipp netaddr.IPPort) error {
+		if !p.policy.allowed(name, ipp.IP().Unmap(), uint16(port)) {
+			return errProxyDenied
+		}
+		return nil
+	})
+}
+
+// parseProxyBasicAuth parses a Basic Proxy-Authorization header value.
+func parseProxyBasicAuth(auth string) (user, pass string, ok bool) {
+	const prefix = "Basic "
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return "", "", false
+	}
+	b, err := base64.StdEncoding.DecodeString(auth[len(prefix):])
+	if err != nil {
+		return "", "", false
+	}
+	return strings.Cut(string(b), ":")
+}
+
+// proxyResponseWriter is an http.ResponseWriter that records the
+// status and body size of a response, and the ReverseProxy's error.
+type proxyResponseWriter struct {
+	http.ResponseWriter
+	status int
+	n      int64
+	err    error
+}
+
+func (w *proxyResponseWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *proxyResponseWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = 200
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+func (w *proxyResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// countingReader is an io.Reader that counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// proxyPolicy is the outbound HTTP proxy's destination allow and deny
+// lists.
+type proxyPolicy struct {
+	allow []dstmatch.Pattern // if empty, everything not denied is allowed
+	deny  []dstmatch.Pattern
+}
+
+func newProxyPolicy(allow, deny []string) (*proxyPolicy, error) {
+	p := new(proxyPolicy)
+	for _, s := range allow {
+		r, err := dstmatch.Parse(s)
 		if err != nil {
-			http.Error(w, err.Error(), 500)
-			return
+			return nil, fmt.Errorf("invalid proxy rule: %w", err)
+		}
+		p.allow = append(p.allow, r)
+	}
+	for _, s := range deny {
+		r, err := dstmatch.Parse(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy rule: %w", err)
 		}
-		defer cc.Close()
-
-		io.WriteString(cc, "HTTP/1.1 200 OK\r\n\r\n")
-
-		var clientSrc io.Reader = ccbuf
-		if ccbuf.Reader.Buffered() == 0 {
-			// In the common case (with no
-			// buffered data), read directly from
-			// the underlying client connection to
-			// save some memory, letting the
-			// bufio.Reader/Writer get GC'ed.
-			clientSrc = cc
+		p.deny = append(p.deny, r)
+	}
+	return p, nil
+}
+
+// denied reports whether a deny rule matches the destination. name is
+// the lowercase hostname requested, if any, and ip the destination IP,
+// if known.
+func (p *proxyPolicy) denied(name string, ip netaddr.IP, port uint16) bool {
+	for _, r := range p.deny {
+		if r.Match(name, ip, port) {
+			return true
 		}
+	}
+	return false
+}
 
-		errc := make(chan error, 1)
-		go func() {
-			_, err := io.Copy(cc, c)
-			errc <- err
-		}()
-		go func() {
-			_, err := io.Copy(c, clientSrc)
-			errc <- err
-		}()
-		<-errc
-	})
+// allowed reports whether the destination is permitted: it must match
+// no deny rule and, if there are allow rules, at least one of those.
+func (p *proxyPolicy) allowed(name string, ip netaddr.IP, port uint16) bool {
+	if p.denied(name, ip, port) {
+		return false
+	}
+	if len(p.allow) == 0 {
+		return true
+	}
+	for _, r := range p.allow {
+		if r.Match(name, ip, port) {
+			return true
+		}
+	}
+	return false
 }
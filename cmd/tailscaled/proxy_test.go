@@ -0,0 +1,335 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"inet.af/netaddr"
+	"tailscale.com/net/socks5"
+)
+
+func TestProxyPolicy(t *testing.T) {
+	pol, err := newProxyPolicy(
+		[]string{"*.example.com:443", "api.test", "10.0.0.0/8:8000-8999", "[fd7a:115c:a1e0::/48]:*"},
+		[]string{"secret.example.com", "10.1.2.3"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		ip   string
+		port uint16
+		want bool
+	}{
+		{"www.example.com", "", 443, true},
+		{"www.example.com", "", 80, false},
+		{"example.com", "", 443, false},
+		{"secret.example.com", "", 443, false},
+		{"api.test", "", 1234, true},
+		{"", "10.2.3.4", 8080, true},
+		{"", "10.2.3.4", 9000, false},
+		{"", "10.1.2.3", 8080, false},
+		{"internal.test", "10.1.2.3", 8080, false}, // resolved to a denied IP
+		{"internal.test", "10.9.9.9", 8080, true},  // resolved to an allowed IP
+		{"", "fd7a:115c:a1e0::1", 22, true},
+		{"", "192.168.0.1", 443, false},
+	}
+	for _, tt := range tests {
+		var ip netaddr.IP
+		if tt.ip != "" {
+			ip = netaddr.MustParseIP(tt.ip)
+		}
+		if got := pol.allowed(tt.name, ip, tt.port); got != tt.want {
+			t.Errorf("allowed(%q, %v, %d) = %v; want %v", tt.name, tt.ip, tt.port, got, tt.want)
+		}
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) records(t *testing.T) []proxyAccessRecord {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var recs []proxyAccessRecord
+	dec := json.NewDecoder(bytes.NewReader(b.buf.Bytes()))
+	for dec.More() {
+		var r proxyAccessRecord
+		if err := dec.Decode(&r); err != nil {
+			t.Fatal(err)
+		}
+		recs = append(recs, r)
+	}
+	return recs
+}
+
+// testDialer is a checkedDialFunc resolving the names in hosts, and
+// IPs, and dialing them with a net.Dialer. It counts its dials.
+type testDialer struct {
+	hosts map[string]string // name => IP
+	dials int32             // accessed atomically
+}
+
+func (d *testDialer) dial(ctx context.Context, netw, addr string, check func(netaddr.IPPort) error) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if ip, ok := d.hosts[host]; ok {
+		host = ip
+	}
+	ipp, err := netaddr.ParseIPPort(net.JoinHostPort(host, port))
+	if err != nil {
+		return nil, err
+	}
+	if check != nil {
+		if err := check(ipp); err != nil {
+			return nil, err
+		}
+	}
+	atomic.AddInt32(&d.dials, 1)
+	var nd net.Dialer
+	return nd.DialContext(ctx, netw, ipp.String())
+}
+
+func TestHTTPProxy(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Header.Get("Proxy-Authorization") != "" {
+			t.Errorf("Proxy-Authorization forwarded to backend")
+		}
+		fmt.Fprintf(w, "got %q", body)
+	}))
+	defer backend.Close()
+	backendPort := backend.Listener.Addr().(*net.TCPAddr).Port
+
+	d := new(testDialer)
+	h, err := httpProxyHandler(d.dial, &httpProxyConfig{
+		Allow: []string{fmt.Sprintf("127.0.0.1:%d", backendPort)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := h.(*httpProxy)
+	p.creds = socks5.StaticCredentials{"alice": "hunter2"}
+	var log syncBuffer
+	p.accessLog = &log
+
+	ps := httptest.NewServer(p)
+	defer ps.Close()
+	proxyURL, _ := url.Parse(ps.URL)
+	client := func(user *url.Userinfo) *http.Client {
+		u := *proxyURL
+		u.User = user
+		return &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(&u)}}
+	}
+
+	// Without credentials.
+	res, err := client(nil).Get(backend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusProxyAuthRequired {
+		t.Errorf("no credentials: status = %v; want 407", res.Status)
+	}
+
+	// With credentials.
+	res, err = client(url.UserPassword("alice", "hunter2")).Post(backend.URL, "text/plain", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != 200 || string(body) != `got "hello"` {
+		t.Errorf("allowed: got %v, %q", res.Status, body)
+	}
+
+	// To a port that's not allowed.
+	res, err = client(url.UserPassword("alice", "hunter2")).Get(fmt.Sprintf("http://127.0.0.1:%d/", backendPort+1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("denied: status = %v; want 403", res.Status)
+	}
+
+	recs := log.records(t)
+	if len(recs) != 3 {
+		t.Fatalf("got %d access records; want 3", len(recs))
+	}
+	if r := recs[0]; r.Status != 407 || r.User != "" {
+		t.Errorf("record 0 = %+v", r)
+	}
+	if r := recs[1]; r.Status != 200 || r.User != "alice" || r.Method != "POST" ||
+		r.Target != backend.URL+"/" || r.BytesIn != 5 || r.BytesOut != int64(len(body)) {
+		t.Errorf("record 1 = %+v", r)
+	}
+	if r := recs[2]; r.Status != 403 || !strings.Contains(r.Error, errProxyDenied.Error()) {
+		t.Errorf("record 2 = %+v", r)
+	}
+}
+
+func TestHTTPProxyConnect(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				line, _ := bufio.NewReader(c).ReadString('\n')
+				io.WriteString(c, "echo: "+line)
+			}()
+		}
+	}()
+
+	d := &testDialer{hosts: map[string]string{"denied.test": "127.0.0.2"}}
+	h, err := httpProxyHandler(d.dial, &httpProxyConfig{
+		Deny: []string{"127.0.0.2"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var log syncBuffer
+	h.(*httpProxy).accessLog = &log
+	ps := httptest.NewServer(h)
+	defer ps.Close()
+
+	connect := func(dst string) (*http.Response, net.Conn) {
+		t.Helper()
+		c, err := net.Dial("tcp", ps.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(c, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", dst, dst)
+		res, err := http.ReadResponse(bufio.NewReader(c), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res, c
+	}
+
+	res, c := connect(ln.Addr().String())
+	if res.StatusCode != 200 {
+		t.Fatalf("CONNECT status = %v", res.Status)
+	}
+	io.WriteString(c, "hi\n")
+	got, _ := io.ReadAll(c)
+	c.Close()
+	if string(got) != "echo: hi\n" {
+		t.Errorf("got %q; want %q", got, "echo: hi\n")
+	}
+
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	res, c = connect("127.0.0.2:" + port)
+	c.Close()
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("denied CONNECT status = %v; want 403", res.Status)
+	}
+
+	// A name resolving to a denied IP is refused without dialing it.
+	dials := atomic.LoadInt32(&d.dials)
+	res, c = connect("denied.test:" + port)
+	c.Close()
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("denied name CONNECT status = %v; want 403", res.Status)
+	}
+	if n := atomic.LoadInt32(&d.dials) - dials; n != 0 {
+		t.Errorf("denied name was dialed %d times", n)
+	}
+
+	ps.Close() // wait for the handlers to finish
+	recs := log.records(t)
+	if len(recs) != 3 {
+		t.Fatalf("got %d access records; want 3", len(recs))
+	}
+	if r := recs[0]; r.Method != "CONNECT" || r.Status != 200 || r.BytesIn != 3 || r.BytesOut != 9 {
+		t.Errorf("record 0 = %+v", r)
+	}
+	if r := recs[1]; r.Status != 403 {
+		t.Errorf("record 1 = %+v", r)
+	}
+}
+
+func TestParseProxyBasicAuth(t *testing.T) {
+	enc := func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+	tests := []struct {
+		in         string
+		user, pass string
+		ok         bool
+	}{
+		{"Basic " + enc("alice:hunter2"), "alice", "hunter2", true},
+		{"basic " + enc("bob:a:b"), "bob", "a:b", true},
+		{"Basic " + enc("nopass"), "nopass", "", false},
+		{"Bearer xyz", "", "", false},
+		{"Basic !!!", "", "", false},
+		{"", "", "", false},
+	}
+	for _, tt := range tests {
+		user, pass, ok := parseProxyBasicAuth(tt.in)
+		if user != tt.user || pass != tt.pass || ok != tt.ok {
+			t.Errorf("parseProxyBasicAuth(%q) = %q, %q, %v; want %q, %q, %v", tt.in, user, pass, ok, tt.user, tt.pass, tt.ok)
+		}
+	}
+}
+
+func TestLoadHTTPProxyConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy.json")
+	if err := os.WriteFile(path, []byte(`{"Allow": ["*.example.com:443"], "AccessLog": "/tmp/log"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c, err := loadHTTPProxyConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Allow) != 1 || c.Allow[0] != "*.example.com:443" || c.AccessLog != "/tmp/log" {
+		t.Errorf("got %+v", c)
+	}
+
+	if err := os.WriteFile(path, []byte(`{"Allowed": ["*"]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadHTTPProxyConfig(path); err == nil {
+		t.Error("unknown field accepted")
+	}
+	if _, err := httpProxyHandler(nil, &httpProxyConfig{Deny: []string{"bad*"}}); err == nil {
+		t.Error("bad rule accepted")
+	}
+}
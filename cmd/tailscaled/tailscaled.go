@@ -46,6 +46,7 @@
 	"tailscale.com/net/tstun"
 	"tailscale.com/paths"
 	"tailscale.com/safesocket"
+	"tailscale.com/tailcfg"
 	"tailscale.com/tsweb"
 	"tailscale.com/types/flagtype"
 	"tailscale.com/types/logger"
@@ -112,7 +113,15 @@ func defaultTunName() string {
 	birdSocketPath string
 	verbose        int
 	socksAddr      string // listen address for SOCKS5 server
+	socksCredsFile string // file of SOCKS5 usernames and passwords
 	httpProxyAddr  string // listen address for HTTP proxy server
+
+	// Outbound HTTP proxy policy; see httpProxyConfig.
+	httpProxyConfig    string // path of JSON config file; exclusive with the following
+	httpProxyCredsFile string
+	httpProxyAllow     string // comma-separated
+	httpProxyDeny      string // comma-separated
+	httpProxyAccessLog string
 }
 
 var (
@@ -134,7 +143,13 @@ func main() {
 	flag.BoolVar(&args.cleanup, "cleanup", false, "clean up system state and exit")
 	flag.StringVar(&args.debug, "debug", "", "listen address ([ip]:port) of optional debug server")
 	flag.StringVar(&args.socksAddr, "socks5-server", "", `optional [ip]:port to run a SOCK5 server (e.g. "localhost:1080")`)
+	flag.StringVar(&args.socksCredsFile, "socks5-credentials-file", "", `optional file of "username:password" lines; if set, SOCKS5 clients must authenticate with one of them`)
 	flag.StringVar(&args.httpProxyAddr, "outbound-http-proxy-listen", "", `optional [ip]:port to run an outbound HTTP proxy (e.g. "localhost:8080")`)
+	flag.StringVar(&args.httpProxyConfig, "outbound-http-proxy-config", "", "optional path of a JSON file configuring the outbound HTTP proxy's credentials, allowed and denied destinations and access log, instead of the individual flags")
+	flag.StringVar(&args.httpProxyCredsFile, "outbound-http-proxy-credentials-file", "", `optional file of "username:password" lines; if set, outbound HTTP proxy clients must authenticate with one of them`)
+	flag.StringVar(&args.httpProxyAllow, "outbound-http-proxy-allow", "", `optional comma-separated destinations the outbound HTTP proxy may connect to, as HOST[:PORTS] where HOST is a hostname, "*.domain", IP or CIDR, and PORTS a port or "lo-hi" range (e.g. "*.example.com:443,100.64.0.0/10")`)
+	flag.StringVar(&args.httpProxyDeny, "outbound-http-proxy-deny", "", "optional comma-separated destinations the outbound HTTP proxy may not connect to, in the --outbound-http-proxy-allow syntax; takes precedence over it")
+	flag.StringVar(&args.httpProxyAccessLog, "outbound-http-proxy-access-log", "", "optional path of a file to append JSON access records of outbound HTTP proxy requests to")
 	flag.StringVar(&args.tunname, "tun", defaultTunName(), `tunnel interface name; use "userspace-networking" (beta) to not use TUN`)
 	flag.Var(flagtype.PortValue(&args.port, 0), "port", "UDP port to listen on for WireGuard and peer-to-peer traffic; 0 means automatically select")
 	flag.StringVar(&args.statepath, "state", "", "absolute path of state file; use 'kube:<secret-name>' to use Kubernetes secrets or 'arn:aws:ssm:...' to store in AWS SSM; use 'mem:' to not store state and register as an emphemeral node. If empty and --statedir is provided, the default is <statedir>/tailscaled.state. Default: "+paths.DefaultTailscaledStateFile())
@@ -370,13 +385,28 @@ func run() error {
 			_, ok := e.PeerForIP(ip)
 			return ok
 		}
+		dialer.NetstackPeerForIP = func(ip netaddr.IP) (*tailcfg.Node, netaddr.IPPrefix, bool) {
+			pip, ok := e.PeerForIP(ip)
+			return pip.Node, pip.Route, ok
+		}
 		dialer.NetstackDialTCP = func(ctx context.Context, dst netaddr.IPPort) (net.Conn, error) {
 			return ns.DialContextTCP(ctx, dst)
 		}
+		dialer.NetstackDialUDP = func(ctx context.Context, dst netaddr.IPPort) (net.Conn, error) {
+			return ns.DialContextUDP(ctx, dst)
+		}
 	}
 	if socksListener != nil || httpProxyListener != nil {
 		if httpProxyListener != nil {
-			hs := &http.Server{Handler: httpProxyHandler(dialer.UserDial)}
+			cfg, err := httpProxyConfigFromArgs()
+			if err != nil {
+				return err
+			}
+			h, err := httpProxyHandler(dialer.UserDialChecked, cfg)
+			if err != nil {
+				return fmt.Errorf("outbound HTTP proxy: %w", err)
+			}
+			hs := &http.Server{Handler: h}
 			go func() {
 				log.Fatalf("HTTP proxy exited: %v", hs.Serve(httpProxyListener))
 			}()
@@ -386,6 +416,13 @@ func run() error {
 				Logf:   logger.WithPrefix(logf, "socks5: "),
 				Dialer: dialer.UserDial,
 			}
+			if args.socksCredsFile != "" {
+				creds, err := loadProxyCredentials(args.socksCredsFile)
+				if err != nil {
+					return fmt.Errorf("--socks5-credentials-file: %w", err)
+				}
+				ss.Credentials = creds
+			}
 			go func() {
 				log.Fatalf("SOCKS5 server exited: %v", ss.Serve(socksListener))
 			}()
@@ -626,6 +663,60 @@ func mustStartProxyListeners(socksAddr, httpAddr string) (socksListener, httpLis
 	return socksListener, httpListener
 }
 
+// loadProxyCredentials loads the SOCKS5 or HTTP proxy credentials in
+// path, one "username:password" per line. Empty lines and lines
+// starting with # are ignored.
+func loadProxyCredentials(path string) (socks5.StaticCredentials, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	creds := socks5.StaticCredentials{}
+	for i, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, pass, ok := strings.Cut(line, ":")
+		if !ok || user == "" || len(user) > 255 || len(pass) > 255 {
+			return nil, fmt.Errorf("%s:%d: invalid credentials; want username:password", path, i+1)
+		}
+		creds[user] = pass
+	}
+	if len(creds) == 0 {
+		return nil, fmt.Errorf("%s: no credentials", path)
+	}
+	return creds, nil
+}
+
+// httpProxyConfigFromArgs returns the outbound HTTP proxy configuration
+// from --outbound-http-proxy-config or the individual flags.
+func httpProxyConfigFromArgs() (*httpProxyConfig, error) {
+	if args.httpProxyConfig != "" {
+		if args.httpProxyCredsFile != "" || args.httpProxyAllow != "" || args.httpProxyDeny != "" || args.httpProxyAccessLog != "" {
+			return nil, errors.New("--outbound-http-proxy-config can't be combined with other --outbound-http-proxy flags")
+		}
+		return loadHTTPProxyConfig(args.httpProxyConfig)
+	}
+	return &httpProxyConfig{
+		CredentialsFile: args.httpProxyCredsFile,
+		Allow:           splitCommaList(args.httpProxyAllow),
+		Deny:            splitCommaList(args.httpProxyDeny),
+		AccessLog:       args.httpProxyAccessLog,
+	}, nil
+}
+
+// splitCommaList splits s on commas, dropping empty elements.
+func splitCommaList(s string) []string {
+	var ret []string
+	for _, f := range strings.Split(s, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			ret = append(ret, f)
+		}
+	}
+	return ret
+}
+
 var beChildFunc = beChild
 
 func beChild(args []string) error {
@@ -4,10 +4,43 @@
 
 package main // import "tailscale.com/cmd/tailscaled"
 
-import "testing"
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"tailscale.com/net/socks5"
+)
 
 func TestNothing(t *testing.T) {
 	// This test does nothing on purpose, so we can run
 	// GODEBUG=memprofilerate=1 go test -v -run=Nothing -memprofile=prof.mem
 	// without any errors about no matching tests.
 }
+
+func TestLoadProxyCredentials(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, contents string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	got, err := loadProxyCredentials(write("good", "# comment\nalice:hunter2\n\nbob:pass:word\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := socks5.StaticCredentials{"alice": "hunter2", "bob": "pass:word"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v; want %v", got, want)
+	}
+
+	for _, bad := range []string{"", "# nothing\n", "alice\n", ":hunter2\n"} {
+		if _, err := loadProxyCredentials(write("bad", bad)); err == nil {
+			t.Errorf("loadProxyCredentials(%q) succeeded; want error", bad)
+		}
+	}
+}
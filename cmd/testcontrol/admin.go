@@ -0,0 +1,250 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/policyfile"
+	"tailscale.com/tailcfg"
+	"tailscale.com/tstest/integration/testcontrol"
+)
+
+// adminServer serves the admin HTTP API under /api/, and the pages
+// for approving interactive logins under /auth/.
+//
+// The API is:
+//
+//	GET    /api/nodes               list nodes
+//	DELETE /api/nodes/<id>          delete a node
+//	POST   /api/nodes/<id>/expire   expire a node's key now
+//	POST   /api/nodes/<id>/routes   set a node's approved routes: {"routes": ["10.0.0.0/24"]}
+//	GET    /api/keys                list auth keys
+//	POST   /api/keys                create an auth key: {"reusable": true, "expiry": "24h", "tags": ["tag:ci"]}
+//	DELETE /api/keys/<key>          revoke an auth key
+//	GET    /api/policy              get the policy as JSON
+//	POST   /api/policy              set the policy from HuJSON
+type adminServer struct {
+	control *testcontrol.Server
+
+	// token is the bearer token required for API requests. If
+	// empty, only requests from loopback addresses are allowed.
+	token string
+}
+
+// apiNode is a node as returned by the admin API.
+type apiNode struct {
+	ID               tailcfg.NodeID
+	StableID         tailcfg.StableNodeID
+	Hostname         string
+	User             string // login name
+	Addresses        []netaddr.IPPrefix
+	Tags             []string `json:",omitempty"`
+	Created          time.Time
+	KeyExpiry        time.Time `json:",omitempty"`
+	Expired          bool
+	AdvertisedRoutes []netaddr.IPPrefix `json:",omitempty"`
+	ApprovedRoutes   []netaddr.IPPrefix `json:",omitempty"`
+}
+
+type apiRoutesRequest struct {
+	Routes []netaddr.IPPrefix `json:"routes"`
+}
+
+type apiKeyRequest struct {
+	Reusable bool     `json:"reusable"`
+	Expiry   string   `json:"expiry"` // Go duration; empty means never
+	Tags     []string `json:"tags"`
+}
+
+func (a *adminServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !a.authorized(r, r.Header.Get("Authorization")) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/api/")
+	switch {
+	case path == "nodes":
+		if r.Method != "GET" {
+			http.Error(w, "GET required", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, a.nodes())
+	case strings.HasPrefix(path, "nodes/"):
+		a.serveNode(w, r, strings.TrimPrefix(path, "nodes/"))
+	case path == "keys":
+		a.serveKeys(w, r)
+	case strings.HasPrefix(path, "keys/"):
+		if r.Method != "DELETE" {
+			http.Error(w, "DELETE required", http.StatusMethodNotAllowed)
+			return
+		}
+		if !a.control.DeleteAuthKey(strings.TrimPrefix(path, "keys/")) {
+			http.Error(w, "no such key", http.StatusNotFound)
+		}
+	case path == "policy":
+		a.servePolicy(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// authorized reports whether the request r with the given
+// Authorization header value may use the API.
+func (a *adminServer) authorized(r *http.Request, authz string) bool {
+	if a.token == "" {
+		ipp, err := netaddr.ParseIPPort(r.RemoteAddr)
+		return err == nil && ipp.IP().IsLoopback()
+	}
+	return subtle.ConstantTimeCompare([]byte(authz), []byte("Bearer "+a.token)) == 1
+}
+
+func (a *adminServer) nodes() []*apiNode {
+	st := a.control.State()
+	ret := make([]*apiNode, 0, len(st.Nodes))
+	now := time.Now()
+	for _, n := range st.Nodes {
+		an := &apiNode{
+			ID:             n.ID,
+			StableID:       n.StableID,
+			Addresses:      n.Addresses,
+			Tags:           n.Tags,
+			Created:        n.Created,
+			KeyExpiry:      n.KeyExpiry,
+			Expired:        !n.KeyExpiry.IsZero() && !n.KeyExpiry.After(now),
+			ApprovedRoutes: st.ApprovedRoutes[n.ID],
+		}
+		if u := st.Users[n.Key]; u != nil {
+			an.User = u.LoginName
+		}
+		if n.Hostinfo.Valid() {
+			an.Hostname = n.Hostinfo.Hostname()
+			an.AdvertisedRoutes = n.Hostinfo.RoutableIPs().AsSlice()
+		}
+		ret = append(ret, an)
+	}
+	return ret
+}
+
+func (a *adminServer) serveNode(w http.ResponseWriter, r *http.Request, path string) {
+	idStr, action, _ := strings.Cut(path, "/")
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		http.Error(w, "bad node ID", http.StatusBadRequest)
+		return
+	}
+	nodeID := tailcfg.NodeID(id)
+	var ok bool
+	switch {
+	case action == "" && r.Method == "DELETE":
+		ok = a.control.DeleteNode(nodeID)
+	case action == "expire" && r.Method == "POST":
+		ok = a.control.ExpireNode(nodeID)
+	case action == "routes" && r.Method == "POST":
+		var req apiRoutesRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("bad request: %v", err), http.StatusBadRequest)
+			return
+		}
+		ok = a.control.SetApprovedRoutes(nodeID, req.Routes)
+	default:
+		http.Error(w, "bad method or action", http.StatusBadRequest)
+		return
+	}
+	if !ok {
+		http.Error(w, "no such node", http.StatusNotFound)
+	}
+}
+
+func (a *adminServer) serveKeys(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		writeJSON(w, a.control.AuthKeys())
+	case "POST":
+		var req apiKeyRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("bad request: %v", err), http.StatusBadRequest)
+			return
+		}
+		var expires time.Time
+		if req.Expiry != "" {
+			d, err := time.ParseDuration(req.Expiry)
+			if err != nil || d <= 0 {
+				http.Error(w, "bad expiry", http.StatusBadRequest)
+				return
+			}
+			expires = time.Now().Add(d).UTC()
+		}
+		for _, t := range req.Tags {
+			if !strings.HasPrefix(t, "tag:") {
+				http.Error(w, fmt.Sprintf("bad tag %q", t), http.StatusBadRequest)
+				return
+			}
+		}
+		writeJSON(w, a.control.NewAuthKey(req.Reusable, expires, req.Tags))
+	default:
+		http.Error(w, "GET or POST required", http.StatusMethodNotAllowed)
+	}
+}
+
+func (a *adminServer) servePolicy(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		writeJSON(w, a.control.Policy())
+	case "POST":
+		b, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		p, err := policyfile.Parse(b)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		a.control.SetPolicy(p)
+	default:
+		http.Error(w, "GET or POST required", http.StatusMethodNotAllowed)
+	}
+}
+
+// serveAuth serves the page that a node's AuthURL points to. Visiting
+// it shows a form that an administrator submits to approve the node.
+func (a *adminServer) serveAuth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprintf(w, `<html><body><h1>Approve node</h1>
+<form method="POST" action="%s">
+Admin token: <input type="password" name="token"> <input type="submit" value="Approve">
+</form></body></html>
+`, html.EscapeString(r.URL.Path))
+		return
+	}
+	if !a.authorized(r, "Bearer "+r.FormValue("token")) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if !a.control.CompleteAuth(r.URL.Path) {
+		http.Error(w, "unknown or expired login", http.StatusNotFound)
+		return
+	}
+	io.WriteString(w, "Node approved. You can close this page.\n")
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	e := json.NewEncoder(w)
+	e.SetIndent("", "\t")
+	e.Encode(v)
+}
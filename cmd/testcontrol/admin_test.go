@@ -0,0 +1,119 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"tailscale.com/tstest/integration/testcontrol"
+)
+
+func TestAdminAuthorized(t *testing.T) {
+	tests := []struct {
+		token      string
+		remoteAddr string
+		authz      string
+		want       bool
+	}{
+		{"", "127.0.0.1:1234", "", true},
+		{"", "[::1]:1234", "", true},
+		{"", "192.168.1.2:1234", "", false},
+		{"s3cret", "127.0.0.1:1234", "", false},
+		{"s3cret", "192.168.1.2:1234", "Bearer s3cret", true},
+		{"s3cret", "192.168.1.2:1234", "Bearer wrong", false},
+		{"s3cret", "192.168.1.2:1234", "s3cret", false},
+	}
+	for _, tt := range tests {
+		a := &adminServer{token: tt.token}
+		r := httptest.NewRequest("GET", "/api/nodes", nil)
+		r.RemoteAddr = tt.remoteAddr
+		if got := a.authorized(r, tt.authz); got != tt.want {
+			t.Errorf("token=%q remote=%v authz=%q: got %v; want %v", tt.token, tt.remoteAddr, tt.authz, got, tt.want)
+		}
+	}
+}
+
+func TestAdminAPI(t *testing.T) {
+	control := new(testcontrol.Server)
+	control.AddFakeNode()
+	nodeID := control.AllNodes()[0].ID
+	ts := httptest.NewServer(&adminServer{control: control, token: "s3cret"})
+	defer ts.Close()
+
+	do := func(method, path, body string) (int, string) {
+		t.Helper()
+		req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer s3cret")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		b, _ := io.ReadAll(res.Body)
+		return res.StatusCode, string(b)
+	}
+
+	code, body := do("POST", "/api/keys", `{"reusable": true, "expiry": "1h", "tags": ["tag:ci"]}`)
+	if code != 200 {
+		t.Fatalf("create key: %v, %s", code, body)
+	}
+	var ak testcontrol.AuthKey
+	if err := json.Unmarshal([]byte(body), &ak); err != nil {
+		t.Fatal(err)
+	}
+	if !ak.Reusable || ak.Expires.IsZero() || len(ak.Tags) != 1 {
+		t.Errorf("created key = %+v", ak)
+	}
+	if code, _ := do("POST", "/api/keys", `{"tags": ["ci"]}`); code != 400 {
+		t.Errorf("create key with bad tag: %v; want 400", code)
+	}
+	if code, _ := do("DELETE", "/api/keys/"+ak.Key, ""); code != 200 {
+		t.Errorf("delete key: %v", code)
+	}
+	if len(control.AuthKeys()) != 0 {
+		t.Errorf("key not deleted")
+	}
+
+	if code, body := do("GET", "/api/nodes", ""); code != 200 || !strings.Contains(body, fmt.Sprintf(`"ID": %d`, nodeID)) {
+		t.Errorf("list nodes: %v, %s", code, body)
+	}
+	if code, body := do("POST", fmt.Sprintf("/api/nodes/%d/routes", nodeID), `{"routes": ["10.0.0.0/24"]}`); code != 200 {
+		t.Errorf("set routes: %v, %s", code, body)
+	}
+	if got := control.ApprovedRoutes(nodeID); len(got) != 1 {
+		t.Errorf("approved routes = %v", got)
+	}
+	if code, _ := do("POST", fmt.Sprintf("/api/nodes/%d/expire", nodeID), ""); code != 200 {
+		t.Errorf("expire: %v", code)
+	}
+	if n := control.AllNodes()[0]; n.KeyExpiry.IsZero() {
+		t.Errorf("node not expired")
+	}
+	if code, _ := do("DELETE", fmt.Sprintf("/api/nodes/%d", nodeID), ""); code != 200 {
+		t.Errorf("delete node: %v", code)
+	}
+	if code, _ := do("DELETE", fmt.Sprintf("/api/nodes/%d", nodeID), ""); code != 404 {
+		t.Errorf("delete deleted node: %v; want 404", code)
+	}
+
+	if code, body := do("POST", "/api/policy", `{"acls": [{"action": "accept", "src": ["*"], "dst": ["*:*"]}], /* comment */}`); code != 200 {
+		t.Errorf("set policy: %v, %s", code, body)
+	}
+	if control.Policy() == nil {
+		t.Errorf("policy not set")
+	}
+	if code, _ := do("POST", "/api/policy", `{"acls": [{"action": "deny"}]}`); code != 400 {
+		t.Errorf("set bad policy: %v; want 400", code)
+	}
+}
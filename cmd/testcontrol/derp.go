@@ -0,0 +1,146 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"time"
+
+	"tailscale.com/derp"
+	"tailscale.com/derp/derphttp"
+	"tailscale.com/net/stun"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+	"tailscale.com/types/logger"
+)
+
+// derpRegionID is the region ID of the embedded DERP server, in the
+// range reserved for custom DERP regions.
+const derpRegionID = 900
+
+// runDERP starts an embedded DERP server on derpAddr and a STUN server
+// on stunAddr, and returns the DERP map for them. Nodes reach them at
+// host, which must be an IP address or a hostname they can resolve.
+//
+// The DERP server uses a self-signed certificate, so the DERP map
+// marks it as InsecureForTests.
+func runDERP(privKey key.NodePrivate, host, derpAddr, stunAddr string, logf logger.Logf) (*tailcfg.DERPMap, error) {
+	cert, err := selfSignedCert(host)
+	if err != nil {
+		return nil, err
+	}
+	ln, err := net.Listen("tcp", derpAddr)
+	if err != nil {
+		return nil, err
+	}
+	pc, err := net.ListenPacket("udp", stunAddr)
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+
+	d := derp.NewServer(privKey, logf)
+	srv := &http.Server{
+		Handler:  derphttp.Handler(d),
+		ErrorLog: logger.StdLogger(logf),
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+		},
+		// DERP needs HTTP/1.1 to upgrade the connection.
+		TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler)),
+	}
+	go func() {
+		log.Fatal(srv.ServeTLS(ln, "", ""))
+	}()
+	go serveSTUN(pc)
+	log.Printf("DERP server %v listening on %v; STUN on %v", d.PublicKey().ShortString(), ln.Addr(), pc.LocalAddr())
+
+	n := &tailcfg.DERPNode{
+		Name:             "900a",
+		RegionID:         derpRegionID,
+		HostName:         host,
+		DERPPort:         ln.Addr().(*net.TCPAddr).Port,
+		STUNPort:         pc.LocalAddr().(*net.UDPAddr).Port,
+		InsecureForTests: true,
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip.To4() != nil {
+			n.IPv4, n.IPv6 = host, "none"
+		} else {
+			n.IPv4, n.IPv6 = "none", host
+		}
+	}
+	return &tailcfg.DERPMap{
+		Regions: map[int]*tailcfg.DERPRegion{
+			derpRegionID: {
+				RegionID:   derpRegionID,
+				RegionCode: "lab",
+				RegionName: "Embedded DERP",
+				Nodes:      []*tailcfg.DERPNode{n},
+			},
+		},
+		OmitDefaultRegions: true,
+	}, nil
+}
+
+// serveSTUN answers STUN binding requests on pc until it's closed.
+func serveSTUN(pc net.PacketConn) {
+	var buf [64 << 10]byte
+	for {
+		n, addr, err := pc.ReadFrom(buf[:])
+		if err != nil {
+			log.Printf("STUN: %v", err)
+			return
+		}
+		ua, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		txid, err := stun.ParseBindingRequest(buf[:n])
+		if err != nil {
+			continue
+		}
+		pc.WriteTo(stun.Response(txid, ua.IP, uint16(ua.Port)), ua)
+	}
+}
+
+// selfSignedCert returns a new self-signed TLS certificate for host.
+func selfSignedCert(host string) (tls.Certificate, error) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := crand.Int(crand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(10 * 365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		tmpl.IPAddresses = []net.IP{ip}
+	} else {
+		tmpl.DNSNames = []string{host}
+	}
+	der, err := x509.CreateCertificate(crand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: priv}, nil
+}
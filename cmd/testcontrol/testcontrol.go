@@ -2,97 +2,185 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
-// Program testcontrol runs a simple test control server.
+// Program testcontrol runs a simple control server, built on
+// tstest/integration/testcontrol, for tests and offline labs.
+//
+// By default all state is in memory. With --state, nodes, users,
+// auth keys, approved routes and the policy are persisted to a JSON
+// file so the server can be restarted without its nodes noticing.
+//
+// It runs an embedded DERP and STUN server unless --derp-map is
+// given, and serves an admin HTTP API under /api/; see adminServer.
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"log"
+	"net"
 	"net/http"
-	"testing"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
-	"tailscale.com/tstest/integration"
+	"tailscale.com/jsondb"
+	"tailscale.com/policyfile"
+	"tailscale.com/tailcfg"
 	"tailscale.com/tstest/integration/testcontrol"
+	"tailscale.com/types/key"
 	"tailscale.com/types/logger"
 )
 
 var (
-	flagNFake = flag.Int("nfake", 0, "number of fake nodes to add to network")
+	flagAddr        = flag.String("addr", "127.0.0.1:9911", "address to serve control on")
+	flagURL         = flag.String("url", "", "base URL nodes use to reach the server (default http://<addr>)")
+	flagNFake       = flag.Int("nfake", 0, "number of fake nodes to add to network")
+	flagState       = flag.String("state", "", "if non-empty, path to a JSON file to persist state in")
+	flagRequireAuth = flag.Bool("require-auth", false, "require new nodes to use an auth key or be approved by an admin")
+	flagKeyExpiry   = flag.Duration("key-expiry", 0, "how long node keys are valid for; 0 means forever")
+	flagPolicy      = flag.String("policy", "", "if non-empty, path to a HuJSON policy file to use, replacing any stored policy")
+	flagAdminToken  = flag.String("admin-token", "", "bearer token for the admin API; if empty, the API is only available from loopback addresses")
+	flagDERPMap     = flag.String("derp-map", "", "if non-empty, path to a JSON DERP map to use instead of the embedded DERP server")
+	flagDERPHost    = flag.String("derp-host", "127.0.0.1", "IP address or hostname nodes use to reach the embedded DERP and STUN servers")
+	flagDERPAddr    = flag.String("derp-addr", ":3340", "address for the embedded DERP server to listen on")
+	flagSTUNAddr    = flag.String("stun-addr", ":3478", "address for the embedded STUN server to listen on")
+	flagVerbose     = flag.Bool("verbose", false, "verbose logging")
 )
 
+// dbState is what's persisted in the --state file.
+type dbState struct {
+	Control *testcontrol.State `json:",omitempty"`
+	DERPKey key.NodePrivate
+}
+
 func main() {
 	flag.Parse()
 
-	var t fakeTB
-	derpMap := integration.RunDERPAndSTUN(t, logger.Discard, "127.0.0.1")
+	var db *jsondb.DB[dbState]
+	if *flagState != "" {
+		var err error
+		db, err = jsondb.Open[dbState](*flagState)
+		if err != nil {
+			log.Fatalf("opening state: %v", err)
+		}
+	} else {
+		db = &jsondb.DB[dbState]{Data: new(dbState)}
+	}
+	if db.Data.DERPKey.IsZero() {
+		db.Data.DERPKey = key.NewNode()
+	}
+
+	baseURL := *flagURL
+	if baseURL == "" {
+		host, port, err := net.SplitHostPort(*flagAddr)
+		if err != nil {
+			log.Fatalf("bad --addr: %v", err)
+		}
+		if host == "" {
+			host = "127.0.0.1"
+		}
+		baseURL = "http://" + net.JoinHostPort(host, port)
+	}
+
+	derpMap, err := loadDERPMap(db.Data.DERPKey)
+	if err != nil {
+		log.Fatalf("DERP: %v", err)
+	}
 
 	control := &testcontrol.Server{
 		DERPMap:         derpMap,
-		ExplicitBaseURL: "http://127.0.0.1:9911",
+		ExplicitBaseURL: strings.TrimSuffix(baseURL, "/"),
+		RequireAuth:     *flagRequireAuth,
+		NodeKeyExpiry:   *flagKeyExpiry,
+		Verbose:         *flagVerbose,
+	}
+	if st := db.Data.Control; st != nil {
+		if err := control.Restore(st); err != nil {
+			log.Fatalf("restoring state: %v", err)
+		}
+		log.Printf("restored %d nodes from %s", len(st.Nodes), *flagState)
+	}
+	if *flagPolicy != "" {
+		b, err := os.ReadFile(*flagPolicy)
+		if err != nil {
+			log.Fatal(err)
+		}
+		p, err := policyfile.Parse(b)
+		if err != nil {
+			log.Fatalf("%s: %v", *flagPolicy, err)
+		}
+		control.SetPolicy(p)
 	}
 	for i := 0; i < *flagNFake; i++ {
 		control.AddFakeNode()
 	}
-	mux := http.NewServeMux()
-	mux.Handle("/", control)
-	addr := "127.0.0.1:9911"
-	log.Printf("listening on %s", addr)
-	err := http.ListenAndServe(addr, mux)
-	log.Fatal(err)
-}
 
-type fakeTB struct {
-	*testing.T
-}
+	if *flagState != "" {
+		var saveMu sync.Mutex
+		save := func() {
+			saveMu.Lock()
+			defer saveMu.Unlock()
+			db.Data.Control = control.State()
+			if err := db.Save(); err != nil {
+				log.Printf("saving state: %v", err)
+			}
+		}
+		save()
+		changed := make(chan struct{}, 1)
+		control.OnStateChange = func() {
+			select {
+			case changed <- struct{}{}:
+			default:
+			}
+		}
+		go func() {
+			for range changed {
+				save()
+				// Coalesce bursts of changes, like map
+				// requests from many nodes at startup.
+				time.Sleep(time.Second)
+			}
+		}()
+		sigc := make(chan os.Signal, 1)
+		signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
+		go func() {
+			<-sigc
+			save()
+			os.Exit(0)
+		}()
+	}
 
-func (t fakeTB) Cleanup(_ func()) {}
-func (t fakeTB) Error(args ...any) {
-	t.Fatal(args...)
-}
-func (t fakeTB) Errorf(format string, args ...any) {
-	t.Fatalf(format, args...)
-}
-func (t fakeTB) Fail() {
-	t.Fatal("failed")
-}
-func (t fakeTB) FailNow() {
-	t.Fatal("failed")
-}
-func (t fakeTB) Failed() bool {
-	return false
-}
-func (t fakeTB) Fatal(args ...any) {
-	log.Fatal(args...)
-}
-func (t fakeTB) Fatalf(format string, args ...any) {
-	log.Fatalf(format, args...)
-}
-func (t fakeTB) Helper() {}
-func (t fakeTB) Log(args ...any) {
-	log.Print(args...)
-}
-func (t fakeTB) Logf(format string, args ...any) {
-	log.Printf(format, args...)
-}
-func (t fakeTB) Name() string {
-	return "faketest"
-}
-func (t fakeTB) Setenv(key string, value string) {
-	panic("not implemented")
-}
-func (t fakeTB) Skip(args ...any) {
-	t.Fatal("skipped")
-}
-func (t fakeTB) SkipNow() {
-	t.Fatal("skipnow")
-}
-func (t fakeTB) Skipf(format string, args ...any) {
-	t.Logf(format, args...)
-	t.Fatal("skipped")
-}
-func (t fakeTB) Skipped() bool {
-	return false
+	admin := &adminServer{control: control, token: *flagAdminToken}
+	mux := http.NewServeMux()
+	// testcontrol.Server panics on requests it doesn't handle, so only
+	// give it the control protocol's paths.
+	mux.Handle("/key", control)
+	mux.Handle("/machine/", control)
+	mux.Handle("/api/", admin)
+	mux.HandleFunc("/auth/", admin.serveAuth)
+	mux.HandleFunc("/derpmap/default", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, derpMap)
+	})
+	log.Printf("listening on %s; base URL %s", *flagAddr, control.ExplicitBaseURL)
+	log.Fatal(http.ListenAndServe(*flagAddr, mux))
 }
-func (t fakeTB) TempDir() string {
-	panic("not implemented")
+
+// loadDERPMap returns the DERP map from --derp-map, or else starts the
+// embedded DERP server with the given key and returns its DERP map.
+func loadDERPMap(derpKey key.NodePrivate) (*tailcfg.DERPMap, error) {
+	if *flagDERPMap == "" {
+		return runDERP(derpKey, *flagDERPHost, *flagDERPAddr, *flagSTUNAddr, logger.WithPrefix(log.Printf, "derp: "))
+	}
+	b, err := os.ReadFile(*flagDERPMap)
+	if err != nil {
+		return nil, err
+	}
+	dm := new(tailcfg.DERPMap)
+	if err := json.Unmarshal(b, dm); err != nil {
+		return nil, err
+	}
+	return dm, nil
 }
@@ -0,0 +1,475 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tailscale/hujson"
+	"tailscale.com/client/tailscale/apitype"
+)
+
+const (
+	// codeLifetime is how long an authorization code can be
+	// redeemed for.
+	codeLifetime = 5 * time.Minute
+
+	// tokenLifetime is how long ID and access tokens are valid.
+	tokenLifetime = time.Hour
+)
+
+// Config is the format of the --config file.
+//
+// An example config in HuJSON:
+//
+//	{
+//		"clients": [
+//			{
+//				"id":           "grafana",
+//				"secret":       "hunter2",
+//				"redirectURIs": ["https://grafana.example.ts.net/login/generic_oauth"],
+//			},
+//			// A public client, which must use PKCE.
+//			{"id": "cli", "redirectURIs": ["http://localhost:8085/callback"]},
+//		],
+//	}
+type Config struct {
+	Clients []Client `json:"clients"`
+}
+
+// Client is an OIDC client (relying party) registration.
+type Client struct {
+	// ID is the client_id.
+	ID string `json:"id"`
+
+	// Secret is the client_secret. If empty, the client is a public
+	// client, which must use PKCE.
+	Secret string `json:"secret,omitempty"`
+
+	// RedirectURIs are the allowed redirect_uri values, which must
+	// match exactly.
+	RedirectURIs []string `json:"redirectURIs"`
+}
+
+// LoadConfig loads the Config in the HuJSON file fname.
+func LoadConfig(fname string) (*Config, error) {
+	b, err := os.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	c, err := parseConfig(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fname, err)
+	}
+	return c, nil
+}
+
+func parseConfig(b []byte) (*Config, error) {
+	b, err := hujson.Standardize(b)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	c := new(Config)
+	if err := dec.Decode(c); err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	for i, cl := range c.Clients {
+		if cl.ID == "" {
+			return nil, fmt.Errorf("clients[%d]: missing id", i)
+		}
+		if seen[cl.ID] {
+			return nil, fmt.Errorf("duplicate client %q", cl.ID)
+		}
+		seen[cl.ID] = true
+		if len(cl.RedirectURIs) == 0 {
+			return nil, fmt.Errorf("client %q: no redirectURIs", cl.ID)
+		}
+		for _, ru := range cl.RedirectURIs {
+			u, err := url.Parse(ru)
+			if err != nil || !u.IsAbs() || u.Fragment != "" {
+				return nil, fmt.Errorf("client %q: invalid redirect URI %q", cl.ID, ru)
+			}
+		}
+	}
+	return c, nil
+}
+
+// whoisFunc looks up who is at a Tailscale IP:port, like
+// tailscale.LocalClient.WhoIs.
+type whoisFunc func(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error)
+
+// idpServer is an OIDC provider that identifies users by the Tailscale
+// node they connect from, rather than by a password.
+type idpServer struct {
+	issuer  string // "https://host", without a trailing slash
+	clients map[string]*Client
+	key     *signingKey
+	whois   whoisFunc
+	timeNow func() time.Time
+
+	mu     sync.Mutex
+	codes  map[string]*authRequest // by authorization code
+	tokens map[string]*authRequest // by access token
+}
+
+// authRequest is an authorization that was granted to a client, which
+// is then redeemed for tokens.
+type authRequest struct {
+	client        *Client
+	redirectURI   string
+	nonce         string
+	codeChallenge string // PKCE S256 challenge, or empty
+	who           *apitype.WhoIsResponse
+	authTime      time.Time
+	expires       time.Time
+}
+
+func newIDPServer(issuer string, cfg *Config, key *signingKey, whois whoisFunc) *idpServer {
+	s := &idpServer{
+		issuer:  strings.TrimSuffix(issuer, "/"),
+		clients: map[string]*Client{},
+		key:     key,
+		whois:   whois,
+		timeNow: time.Now,
+		codes:   map[string]*authRequest{},
+		tokens:  map[string]*authRequest{},
+	}
+	for i := range cfg.Clients {
+		c := &cfg.Clients[i]
+		s.clients[c.ID] = c
+	}
+	return s
+}
+
+func (s *idpServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/.well-known/openid-configuration":
+		s.serveDiscovery(w, r)
+	case "/.well-known/jwks.json":
+		s.serveJWKS(w, r)
+	case "/authorize":
+		s.serveAuthorize(w, r)
+	case "/token":
+		s.serveToken(w, r)
+	case "/userinfo":
+		s.serveUserInfo(w, r)
+	case "/":
+		fmt.Fprintf(w, "tsidp: an OpenID Connect provider for your tailnet.\nDiscovery: %s/.well-known/openid-configuration\n", s.issuer)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (s *idpServer) serveDiscovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"issuer":                                s.issuer,
+		"authorization_endpoint":                s.issuer + "/authorize",
+		"token_endpoint":                        s.issuer + "/token",
+		"userinfo_endpoint":                     s.issuer + "/userinfo",
+		"jwks_uri":                              s.issuer + "/.well-known/jwks.json",
+		"response_types_supported":              []string{"code"},
+		"grant_types_supported":                 []string{"authorization_code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"scopes_supported":                      []string{"openid", "profile", "email"},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post", "none"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"claims_supported":                      []string{"sub", "iss", "aud", "exp", "iat", "auth_time", "nonce", "email", "name", "preferred_username", "picture"},
+	})
+}
+
+func (s *idpServer) serveJWKS(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"keys": []jwk{s.key.jwk()},
+	})
+}
+
+// serveAuthorize handles the authorization endpoint. Instead of
+// asking for a password, it identifies the user by the node the
+// request came from.
+func (s *idpServer) serveAuthorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if r.Method == "POST" {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "bad form", http.StatusBadRequest)
+			return
+		}
+		q = r.Form
+	}
+
+	// Errors with the client or redirect URI are shown to the user,
+	// as redirecting to an unregistered URI would be an open
+	// redirect.
+	client := s.clients[q.Get("client_id")]
+	if client == nil {
+		http.Error(w, "unknown client_id", http.StatusBadRequest)
+		return
+	}
+	redirectURI := q.Get("redirect_uri")
+	if !contains(client.RedirectURIs, redirectURI) {
+		http.Error(w, "redirect_uri not registered for client", http.StatusBadRequest)
+		return
+	}
+
+	fail := func(code, desc string) {
+		u, _ := url.Parse(redirectURI)
+		rq := u.Query()
+		rq.Set("error", code)
+		rq.Set("error_description", desc)
+		if st := q.Get("state"); st != "" {
+			rq.Set("state", st)
+		}
+		u.RawQuery = rq.Encode()
+		http.Redirect(w, r, u.String(), http.StatusFound)
+	}
+	if q.Get("response_type") != "code" {
+		fail("unsupported_response_type", "only the authorization code flow is supported")
+		return
+	}
+	if !contains(strings.Fields(q.Get("scope")), "openid") {
+		fail("invalid_scope", `scope must include "openid"`)
+		return
+	}
+	challenge := q.Get("code_challenge")
+	if challenge != "" && q.Get("code_challenge_method") != "S256" {
+		fail("invalid_request", "only the S256 code_challenge_method is supported")
+		return
+	}
+	if challenge == "" && client.Secret == "" {
+		fail("invalid_request", "public clients must use PKCE")
+		return
+	}
+
+	who, err := s.whois(r.Context(), r.RemoteAddr)
+	if err != nil {
+		log.Printf("authorize: can't identify %s: %v", r.RemoteAddr, err)
+		fail("access_denied", "can't identify the Tailscale node this request came from")
+		return
+	}
+	if len(who.Node.Tags) != 0 || who.UserProfile == nil || who.UserProfile.LoginName == "" {
+		fail("access_denied", "tagged nodes can't log in as a user")
+		return
+	}
+
+	now := s.timeNow()
+	code := randHex()
+	s.mu.Lock()
+	s.pruneLocked(now)
+	s.codes[code] = &authRequest{
+		client:        client,
+		redirectURI:   redirectURI,
+		nonce:         q.Get("nonce"),
+		codeChallenge: challenge,
+		who:           who,
+		authTime:      now,
+		expires:       now.Add(codeLifetime),
+	}
+	s.mu.Unlock()
+
+	log.Printf("authorize: issued code for %s to client %s", who.UserProfile.LoginName, client.ID)
+	u, _ := url.Parse(redirectURI)
+	rq := u.Query()
+	rq.Set("code", code)
+	if st := q.Get("state"); st != "" {
+		rq.Set("state", st)
+	}
+	u.RawQuery = rq.Encode()
+	http.Redirect(w, r, u.String(), http.StatusFound)
+}
+
+// pruneLocked removes expired codes and tokens.
+//
+// s.mu must be held.
+func (s *idpServer) pruneLocked(now time.Time) {
+	for k, ar := range s.codes {
+		if !now.Before(ar.expires) {
+			delete(s.codes, k)
+		}
+	}
+	for k, ar := range s.tokens {
+		if !now.Before(ar.expires) {
+			delete(s.tokens, k)
+		}
+	}
+}
+
+// tokenError writes an OAuth 2.0 token endpoint error response.
+func tokenError(w http.ResponseWriter, code int, errCode, desc string) {
+	writeJSON(w, code, map[string]string{
+		"error":             errCode,
+		"error_description": desc,
+	})
+}
+
+func (s *idpServer) serveToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		tokenError(w, http.StatusBadRequest, "invalid_request", "bad form")
+		return
+	}
+	if gt := r.PostForm.Get("grant_type"); gt != "authorization_code" {
+		tokenError(w, http.StatusBadRequest, "unsupported_grant_type", "only authorization_code is supported")
+		return
+	}
+
+	clientID, secret, basic := r.BasicAuth()
+	if basic {
+		// RFC 6749 section 2.3.1 form-encodes these.
+		clientID, _ = url.QueryUnescape(clientID)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		clientID = r.PostForm.Get("client_id")
+		secret = r.PostForm.Get("client_secret")
+	}
+	client := s.clients[clientID]
+	if client == nil || subtle.ConstantTimeCompare([]byte(client.Secret), []byte(secret)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Basic realm="tsidp"`)
+		tokenError(w, http.StatusUnauthorized, "invalid_client", "unknown client or bad secret")
+		return
+	}
+
+	now := s.timeNow()
+	code := r.PostForm.Get("code")
+	s.mu.Lock()
+	ar := s.codes[code]
+	if ar != nil && ar.client == client {
+		delete(s.codes, code) // codes are single use
+	} else {
+		ar = nil // other clients can't redeem or use up the code
+	}
+	s.mu.Unlock()
+	if ar == nil || !now.Before(ar.expires) {
+		tokenError(w, http.StatusBadRequest, "invalid_grant", "unknown or expired code")
+		return
+	}
+	if r.PostForm.Get("redirect_uri") != ar.redirectURI {
+		tokenError(w, http.StatusBadRequest, "invalid_grant", "redirect_uri doesn't match")
+		return
+	}
+	if ar.codeChallenge != "" {
+		sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if base64.RawURLEncoding.EncodeToString(sum[:]) != ar.codeChallenge {
+			tokenError(w, http.StatusBadRequest, "invalid_grant", "code_verifier doesn't match code_challenge")
+			return
+		}
+	}
+
+	claims := s.claims(ar)
+	claims["iss"] = s.issuer
+	claims["aud"] = client.ID
+	claims["iat"] = now.Unix()
+	claims["exp"] = now.Add(tokenLifetime).Unix()
+	claims["auth_time"] = ar.authTime.Unix()
+	if ar.nonce != "" {
+		claims["nonce"] = ar.nonce
+	}
+	idToken, err := s.key.sign(claims)
+	if err != nil {
+		tokenError(w, http.StatusInternalServerError, "server_error", err.Error())
+		return
+	}
+
+	accessToken := randHex()
+	s.mu.Lock()
+	s.tokens[accessToken] = &authRequest{
+		client:  client,
+		who:     ar.who,
+		expires: now.Add(tokenLifetime),
+	}
+	s.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   int(tokenLifetime.Seconds()),
+		"id_token":     idToken,
+	})
+}
+
+// claims returns the claims about the user of ar, for both ID tokens
+// and the userinfo endpoint.
+func (s *idpServer) claims(ar *authRequest) map[string]any {
+	up := ar.who.UserProfile
+	login := up.LoginName
+	username, _, _ := strings.Cut(login, "@")
+	c := map[string]any{
+		"sub":                "userid:" + strconv.FormatInt(int64(up.ID), 10),
+		"email":              login,
+		"preferred_username": username,
+	}
+	if up.DisplayName != "" {
+		c["name"] = up.DisplayName
+	}
+	if up.ProfilePicURL != "" {
+		c["picture"] = up.ProfilePicURL
+	}
+	return c
+}
+
+func (s *idpServer) serveUserInfo(w http.ResponseWriter, r *http.Request) {
+	authz := r.Header.Get("Authorization")
+	token := strings.TrimPrefix(authz, "Bearer ")
+	if token == authz || token == "" {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "missing bearer token", http.StatusUnauthorized)
+		return
+	}
+	s.mu.Lock()
+	ar := s.tokens[token]
+	s.mu.Unlock()
+	if ar == nil || !s.timeNow().Before(ar.expires) {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+	writeJSON(w, http.StatusOK, s.claims(ar))
+}
+
+// randHex returns a random 256-bit value in hex, for codes and tokens.
+func randHex() string {
+	var b [32]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b[:])
+}
+
+func contains(s []string, v string) bool {
+	for _, e := range s {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
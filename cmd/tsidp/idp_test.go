@@ -0,0 +1,445 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+const testConfig = `{
+	"clients": [
+		{"id": "grafana", "secret": "hunter2", "redirectURIs": ["https://grafana.example.com/cb"]},
+		// Public client.
+		{"id": "cli", "redirectURIs": ["http://localhost:8085/cb?x=1"]},
+	],
+}`
+
+var testNodes = map[string]*apitype.WhoIsResponse{
+	"100.64.0.1": {
+		Node:        &tailcfg.Node{ComputedName: "alice-laptop"},
+		UserProfile: &tailcfg.UserProfile{ID: 42, LoginName: "alice@example.com", DisplayName: "Alice", ProfilePicURL: "https://example.com/alice.png"},
+	},
+	"100.64.0.2": {
+		Node:        &tailcfg.Node{ComputedName: "server", Tags: []string{"tag:server"}},
+		UserProfile: &tailcfg.UserProfile{ID: 1, LoginName: "tagged-devices"},
+	},
+}
+
+func testWhoIs(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error) {
+	ap, err := netip.ParseAddrPort(remoteAddr)
+	if err != nil {
+		return nil, err
+	}
+	if res, ok := testNodes[ap.Addr().String()]; ok {
+		return res, nil
+	}
+	return nil, errors.New("not found")
+}
+
+var testKey = func() *signingKey {
+	k, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	return newSigningKey(k)
+}()
+
+func newTestServer(t *testing.T) *idpServer {
+	t.Helper()
+	cfg, err := parseConfig([]byte(testConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newIDPServer("https://idp.example.ts.net/", cfg, testKey, testWhoIs)
+}
+
+// authorize makes an authorization request from ip with the query
+// params q and returns the response.
+func authorize(s *idpServer, ip string, q url.Values) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "/authorize?"+q.Encode(), nil)
+	req.RemoteAddr = ip + ":1234"
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	return rec
+}
+
+// token redeems a code with the form params f, using HTTP basic auth
+// if basicUser is non-empty.
+func token(s *idpServer, f url.Values, basicUser, basicPass string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/token", strings.NewReader(f.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if basicUser != "" {
+		req.SetBasicAuth(basicUser, basicPass)
+	}
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	return rec
+}
+
+// redirectParams returns the query params of rec's redirect.
+func redirectParams(t *testing.T, rec *httptest.ResponseRecorder) url.Values {
+	t.Helper()
+	if rec.Code != http.StatusFound {
+		t.Fatalf("code = %d; want redirect; body: %s", rec.Code, rec.Body)
+	}
+	u, err := url.Parse(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u.Query()
+}
+
+func TestDiscovery(t *testing.T) {
+	s := newTestServer(t)
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest("GET", "/.well-known/openid-configuration", nil))
+	var disco struct {
+		Issuer  string `json:"issuer"`
+		Token   string `json:"token_endpoint"`
+		JWKSURI string `json:"jwks_uri"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &disco); err != nil {
+		t.Fatal(err)
+	}
+	if disco.Issuer != "https://idp.example.ts.net" || disco.Token != "https://idp.example.ts.net/token" || disco.JWKSURI != "https://idp.example.ts.net/.well-known/jwks.json" {
+		t.Errorf("bad discovery document: %+v", disco)
+	}
+
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest("GET", "/.well-known/jwks.json", nil))
+	var jwks struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &jwks); err != nil {
+		t.Fatal(err)
+	}
+	if len(jwks.Keys) != 1 {
+		t.Fatalf("got %d keys; want 1", len(jwks.Keys))
+	}
+	pub, err := jwks.Keys[0].publicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pub.Equal(&testKey.key.PublicKey) || jwks.Keys[0].Kid != testKey.kid {
+		t.Errorf("JWKS doesn't match the signing key")
+	}
+}
+
+func TestConfidentialClientFlow(t *testing.T) {
+	s := newTestServer(t)
+	now := time.Unix(1e9, 0)
+	s.timeNow = func() time.Time { return now }
+
+	rp := redirectParams(t, authorize(s, "100.64.0.1", url.Values{
+		"client_id":     {"grafana"},
+		"redirect_uri":  {"https://grafana.example.com/cb"},
+		"response_type": {"code"},
+		"scope":         {"openid email profile"},
+		"state":         {"st8"},
+		"nonce":         {"n0nce"},
+	}))
+	if rp.Get("state") != "st8" || rp.Get("code") == "" {
+		t.Fatalf("bad redirect params: %v", rp)
+	}
+	form := url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {rp.Get("code")},
+		"redirect_uri": {"https://grafana.example.com/cb"},
+	}
+	if rec := token(s, form, "grafana", "wrong"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("bad secret: code = %d; want 401", rec.Code)
+	}
+	otherForm := url.Values{"client_id": {"cli"}}
+	for k, v := range form {
+		otherForm[k] = v
+	}
+	if rec := token(s, otherForm, "", ""); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "invalid_grant") {
+		t.Errorf("other client: code = %d; body: %s", rec.Code, rec.Body)
+	}
+	rec := token(s, form, "grafana", "hunter2")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("token: code = %d; body: %s", rec.Code, rec.Body)
+	}
+	var tr struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		IDToken     string `json:"id_token"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &tr); err != nil {
+		t.Fatal(err)
+	}
+	if tr.TokenType != "Bearer" || tr.AccessToken == "" {
+		t.Errorf("bad token response: %s", rec.Body)
+	}
+
+	var claims map[string]any
+	if err := verifyJWT(tr.IDToken, &testKey.key.PublicKey, &claims); err != nil {
+		t.Fatalf("verifying ID token: %v", err)
+	}
+	want := map[string]any{
+		"iss":                "https://idp.example.ts.net",
+		"aud":                "grafana",
+		"sub":                "userid:42",
+		"email":              "alice@example.com",
+		"name":               "Alice",
+		"preferred_username": "alice",
+		"picture":            "https://example.com/alice.png",
+		"nonce":              "n0nce",
+		"iat":                float64(now.Unix()),
+		"exp":                float64(now.Add(tokenLifetime).Unix()),
+	}
+	for k, v := range want {
+		if claims[k] != v {
+			t.Errorf("claim %q = %v; want %v", k, claims[k], v)
+		}
+	}
+
+	// Codes can only be redeemed once.
+	if rec := token(s, form, "grafana", "hunter2"); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "invalid_grant") {
+		t.Errorf("code reuse: code = %d; body: %s", rec.Code, rec.Body)
+	}
+
+	req := httptest.NewRequest("GET", "/userinfo", nil)
+	req.Header.Set("Authorization", "Bearer "+tr.AccessToken)
+	urec := httptest.NewRecorder()
+	s.ServeHTTP(urec, req)
+	var ui map[string]any
+	if err := json.Unmarshal(urec.Body.Bytes(), &ui); err != nil {
+		t.Fatalf("userinfo: %v; body: %s", err, urec.Body)
+	}
+	if ui["sub"] != "userid:42" || ui["email"] != "alice@example.com" {
+		t.Errorf("bad userinfo: %v", ui)
+	}
+
+	now = now.Add(tokenLifetime)
+	urec = httptest.NewRecorder()
+	s.ServeHTTP(urec, req)
+	if urec.Code != http.StatusUnauthorized {
+		t.Errorf("expired access token: code = %d; want 401", urec.Code)
+	}
+}
+
+func TestPublicClientPKCE(t *testing.T) {
+	s := newTestServer(t)
+	const verifier = "a-long-random-code-verifier-0123456789abcdef"
+	sum := sha256.Sum256([]byte(verifier))
+	challenge := base64.RawURLEncoding.EncodeToString(sum[:])
+
+	q := url.Values{
+		"client_id":     {"cli"},
+		"redirect_uri":  {"http://localhost:8085/cb?x=1"},
+		"response_type": {"code"},
+		"scope":         {"openid"},
+	}
+	if rp := redirectParams(t, authorize(s, "100.64.0.1", q)); rp.Get("error") != "invalid_request" {
+		t.Errorf("public client without PKCE: got %v; want invalid_request", rp)
+	}
+	q.Set("code_challenge", challenge)
+	q.Set("code_challenge_method", "plain")
+	if rp := redirectParams(t, authorize(s, "100.64.0.1", q)); rp.Get("error") != "invalid_request" {
+		t.Errorf("plain PKCE: got %v; want invalid_request", rp)
+	}
+	q.Set("code_challenge_method", "S256")
+
+	redeem := func(verifier string) int {
+		rp := redirectParams(t, authorize(s, "100.64.0.1", q))
+		if rp.Get("x") != "1" {
+			t.Errorf("redirect lost query param: %v", rp)
+		}
+		return token(s, url.Values{
+			"grant_type":    {"authorization_code"},
+			"client_id":     {"cli"},
+			"code":          {rp.Get("code")},
+			"redirect_uri":  {"http://localhost:8085/cb?x=1"},
+			"code_verifier": {verifier},
+		}, "", "").Code
+	}
+	if code := redeem("wrong-verifier"); code != http.StatusBadRequest {
+		t.Errorf("wrong verifier: code = %d; want 400", code)
+	}
+	if code := redeem(verifier); code != http.StatusOK {
+		t.Errorf("right verifier: code = %d; want 200", code)
+	}
+}
+
+func TestAuthorizeErrors(t *testing.T) {
+	s := newTestServer(t)
+	base := url.Values{
+		"client_id":     {"grafana"},
+		"redirect_uri":  {"https://grafana.example.com/cb"},
+		"response_type": {"code"},
+		"scope":         {"openid"},
+	}
+	tests := []struct {
+		name      string
+		ip        string
+		set       map[string]string
+		wantCode  int    // if not a redirect
+		wantError string // error param of the redirect
+	}{
+		{name: "unknown-client", set: map[string]string{"client_id": "nope"}, wantCode: http.StatusBadRequest},
+		{name: "bad-redirect", set: map[string]string{"redirect_uri": "https://evil.example/cb"}, wantCode: http.StatusBadRequest},
+		{name: "implicit", set: map[string]string{"response_type": "id_token"}, wantError: "unsupported_response_type"},
+		{name: "no-openid", set: map[string]string{"scope": "email"}, wantError: "invalid_scope"},
+		{name: "tagged", ip: "100.64.0.2", wantError: "access_denied"},
+		{name: "unknown-node", ip: "100.64.0.99", wantError: "access_denied"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := url.Values{}
+			for k, v := range base {
+				q[k] = v
+			}
+			for k, v := range tt.set {
+				q.Set(k, v)
+			}
+			ip := tt.ip
+			if ip == "" {
+				ip = "100.64.0.1"
+			}
+			rec := authorize(s, ip, q)
+			if tt.wantCode != 0 {
+				if rec.Code != tt.wantCode {
+					t.Errorf("code = %d; want %d", rec.Code, tt.wantCode)
+				}
+				return
+			}
+			if got := redirectParams(t, rec).Get("error"); got != tt.wantError {
+				t.Errorf("error = %q; want %q", got, tt.wantError)
+			}
+		})
+	}
+}
+
+func TestTokenRedirectMismatch(t *testing.T) {
+	s := newTestServer(t)
+	rp := redirectParams(t, authorize(s, "100.64.0.1", url.Values{
+		"client_id":     {"grafana"},
+		"redirect_uri":  {"https://grafana.example.com/cb"},
+		"response_type": {"code"},
+		"scope":         {"openid"},
+	}))
+	rec := token(s, url.Values{
+		"grant_type":    {"authorization_code"},
+		"client_id":     {"grafana"},
+		"client_secret": {"hunter2"},
+		"code":          {rp.Get("code")},
+		"redirect_uri":  {"https://grafana.example.com/other"},
+	}, "", "")
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "invalid_grant") {
+		t.Errorf("code = %d; body: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		wantErr string
+	}{
+		{"unknown-field", `{"clientz": []}`, "unknown field"},
+		{"no-id", `{"clients": [{"redirectURIs": ["https://a/"]}]}`, "clients[0]: missing id"},
+		{"dup", `{"clients": [{"id": "a", "redirectURIs": ["https://a/"]}, {"id": "a", "redirectURIs": ["https://a/"]}]}`, `duplicate client "a"`},
+		{"no-redirect", `{"clients": [{"id": "a"}]}`, `client "a": no redirectURIs`},
+		{"relative-redirect", `{"clients": [{"id": "a", "redirectURIs": ["/cb"]}]}`, `invalid redirect URI "/cb"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseConfig([]byte(tt.config))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got error %v; want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadOrCreateSigningKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "key.pem")
+	k1, err := loadOrCreateSigningKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k2, err := loadOrCreateSigningKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !k1.key.Equal(k2.key) || k1.kid != k2.kid {
+		t.Error("reloaded key differs")
+	}
+}
+
+// publicKey returns the RSA public key in k.
+func (k jwk) publicKey() (*rsa.PublicKey, error) {
+	if k.Kty != "RSA" {
+		return nil, fmt.Errorf("unexpected kty %q", k.Kty)
+	}
+	n, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil {
+		return nil, err
+	}
+	e, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil {
+		return nil, err
+	}
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(n),
+		E: int(new(big.Int).SetBytes(e).Int64()),
+	}, nil
+}
+
+// verifyJWT checks that token is an RS256 JWT signed by the key pub,
+// as a relying party would, and decodes its claims into claims.
+func verifyJWT(token string, pub *rsa.PublicKey, claims any) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return errors.New("malformed JWT")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return err
+	}
+	if header.Alg != "RS256" {
+		return fmt.Errorf("unexpected JWT alg %q", header.Alg)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, sum[:], sig); err != nil {
+		return err
+	}
+	return decodeSegment(parts[1], claims)
+}
+
+func decodeSegment(seg string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
@@ -0,0 +1,97 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// tsidp is an OpenID Connect identity provider for a tailnet. It joins
+// the tailnet as its own node and, instead of asking for a password,
+// issues ID tokens for the Tailscale user of the node a request comes
+// from, as reported by WhoIs. Tagged nodes can't log in.
+//
+// Relying parties (clients) are registered in a HuJSON file passed
+// with --config; see Config. They discover the provider at
+// https://<hostname>.<tailnet>.ts.net/.well-known/openid-configuration.
+// Only the authorization code flow is supported, with PKCE (S256)
+// required for public clients.
+//
+// Set the TS_AUTHKEY environment variable to have this server
+// automatically join your tailnet, or look for the logged auth link on
+// first start. HTTPS must be enabled for the tailnet.
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"tailscale.com/tsnet"
+)
+
+var (
+	hostname     = flag.String("hostname", "idp", "Tailscale hostname to serve on, used as the base name for MagicDNS.")
+	tailscaleDir = flag.String("state-dir", "./", "Directory for Tailscale state and the token signing key.")
+	configFile   = flag.String("config", "", "Path to the HuJSON file of client registrations.")
+	issuerFlag   = flag.String("issuer", "", "Issuer URL to advertise, if not https://<hostname>.<tailnet>.ts.net.")
+)
+
+func main() {
+	flag.Parse()
+	if *hostname == "" || strings.Contains(*hostname, ".") {
+		log.Fatal("missing or invalid --hostname")
+	}
+	if *configFile == "" {
+		log.Fatal("missing --config")
+	}
+	cfg, err := LoadConfig(*configFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	key, err := loadOrCreateSigningKey(filepath.Join(*tailscaleDir, "tsidp-key.pem"))
+	if err != nil {
+		log.Fatalf("signing key: %v", err)
+	}
+
+	ts := &tsnet.Server{
+		Dir:      *tailscaleDir,
+		Hostname: *hostname,
+	}
+	if err := ts.Start(); err != nil {
+		log.Fatalf("Error starting tsnet.Server: %v", err)
+	}
+	localClient, _ := ts.LocalClient()
+
+	issuer := *issuerFlag
+	if issuer == "" {
+		// Wait for tailscale to start before looking up our name.
+		for i := 0; ; i++ {
+			st, err := localClient.Status(context.Background())
+			if err == nil && st.BackendState == "Running" {
+				break
+			}
+			if i == 60 {
+				log.Fatalf("tailscale not running; last status error: %v", err)
+			}
+			time.Sleep(time.Second)
+		}
+		name, ok := localClient.ExpandSNIName(context.Background(), *hostname)
+		if !ok {
+			log.Fatal("can't determine issuer URL; enable HTTPS for your tailnet or set --issuer")
+		}
+		issuer = "https://" + name
+	}
+
+	ln, err := ts.Listen("tcp", ":443")
+	if err != nil {
+		log.Fatal(err)
+	}
+	ln = tls.NewListener(ln, &tls.Config{
+		GetCertificate: localClient.GetCertificate,
+	})
+	srv := newIDPServer(issuer, cfg, key, localClient.WhoIs)
+	log.Printf("tsidp running at %s with %d clients", issuer, len(cfg.Clients))
+	log.Fatal(http.Serve(ln, srv))
+}
@@ -939,11 +939,6 @@ func (c *Direct) sendMapRequest(ctx context.Context, maxPolls int, readOnly bool
 			return errors.New("MapResponse lacked node")
 		}
 
-		if Debug.StripEndpoints {
-			for _, p := range resp.Peers {
-				p.Endpoints = nil
-			}
-		}
 		if Debug.StripCaps {
 			nm.SelfNode.Capabilities = nil
 		}
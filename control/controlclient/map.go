@@ -42,7 +42,8 @@ type mapSession struct {
 	lastParsedPacketFilter []filter.Match
 	lastSSHPolicy          *tailcfg.SSHPolicy
 	collectServices        bool
-	previousPeers          []*tailcfg.Node // for delta-purposes
+	previousPeers          []*tailcfg.Node // for delta-purposes; shared with the last netmap, so never mutated
+	lastMagicDNSSuffix     string
 	lastDomain             string
 	lastHealth             []string
 	lastPopBrowserURL      string
@@ -78,9 +79,13 @@ func (ms *mapSession) addUserProfile(userID tailcfg.UserID) {
 // or incremental MapResponse within the session, filling in omitted
 // information from prior MapResponse values.
 func (ms *mapSession) netmapForResponse(resp *tailcfg.MapResponse) *netmap.NetworkMap {
-	undeltaPeers(resp, ms.previousPeers)
+	prevPeers := ms.previousPeers
+	undeltaPeers(resp, prevPeers)
 
-	ms.previousPeers = cloneNodes(resp.Peers) // defensive/lazy clone, since this escapes to who knows where
+	// Only our own copy of the slice is kept; the nodes themselves are
+	// shared with the returned netmap and never mutated after this
+	// call, so unchanged peers needn't be cloned on the next delta.
+	ms.previousPeers = append([]*tailcfg.Node(nil), resp.Peers...)
 	for _, up := range resp.UserProfiles {
 		ms.lastUserProfile[up.ID] = up
 	}
@@ -155,7 +160,31 @@ func (ms *mapSession) netmapForResponse(resp *tailcfg.MapResponse) *netmap.Netwo
 	if nm.SelfNode != nil {
 		nm.SelfNode.InitDisplayNames(magicDNSSuffix)
 	}
-	for _, peer := range resp.Peers {
+	suffixChanged := magicDNSSuffix != ms.lastMagicDNSSuffix
+	ms.lastMagicDNSSuffix = magicDNSSuffix
+	for i, peer := range resp.Peers {
+		// Both resp.Peers and prevPeers are sorted by ID. Walk them
+		// together to find peers carried over unchanged from the
+		// previous netmap, which are already initialized.
+		for len(prevPeers) > 0 && prevPeers[0].ID < peer.ID {
+			prevPeers = prevPeers[1:]
+		}
+		if len(prevPeers) > 0 && prevPeers[0] == peer {
+			if !suffixChanged {
+				if !peer.Sharer.IsZero() && ms.keepSharerAndUserSplit {
+					ms.addUserProfile(peer.Sharer)
+				}
+				ms.addUserProfile(peer.User)
+				continue
+			}
+			// The previous netmap may still be in use.
+			peer = peer.Clone()
+			resp.Peers[i] = peer
+			ms.previousPeers[i] = peer
+		}
+		if Debug.StripEndpoints {
+			peer.Endpoints = nil
+		}
 		peer.InitDisplayNames(magicDNSSuffix)
 		if !peer.Sharer.IsZero() {
 			if ms.keepSharerAndUserSplit {
@@ -175,8 +204,12 @@ func (ms *mapSession) netmapForResponse(resp *tailcfg.MapResponse) *netmap.Netwo
 
 // undeltaPeers updates mapRes.Peers to be complete based on the
 // provided previous peer list and the PeersRemoved and PeersChanged
-// fields in mapRes, as well as the PeerSeenChange and OnlineChange
-// maps.
+// fields in mapRes, as well as the PeerSeenChange, OnlineChange and
+// PeersChangedPatch changes.
+//
+// The nodes in prev are not modified; patched nodes are cloned first,
+// and unchanged nodes are shared between prev and mapRes.Peers.
+// The prev slice itself may be re-sorted.
 //
 // It then also nils out the delta fields.
 func undeltaPeers(mapRes *tailcfg.MapResponse, prev []*tailcfg.Node) {
@@ -237,16 +270,28 @@ func undeltaPeers(mapRes *tailcfg.MapResponse, prev []*tailcfg.Node) {
 			}
 		}
 		sortNodes(newFull)
+	} else {
+		newFull = append([]*tailcfg.Node(nil), prev...)
 	}
 
 	if len(mapRes.PeerSeenChange) != 0 || len(mapRes.OnlineChange) != 0 || len(mapRes.PeersChangedPatch) != 0 {
-		peerByID := make(map[tailcfg.NodeID]*tailcfg.Node, len(newFull))
-		for _, n := range newFull {
-			peerByID[n.ID] = n
+		// cloned tracks which nodes in newFull have been cloned from
+		// prev and are thus safe to mutate.
+		cloned := make(map[tailcfg.NodeID]bool, len(mapRes.PeersChangedPatch)+len(mapRes.OnlineChange)+len(mapRes.PeerSeenChange))
+		mutablePeer := func(id tailcfg.NodeID) *tailcfg.Node {
+			i := sort.Search(len(newFull), func(i int) bool { return newFull[i].ID >= id })
+			if i == len(newFull) || newFull[i].ID != id {
+				return nil
+			}
+			if !cloned[id] {
+				newFull[i] = newFull[i].Clone()
+				cloned[id] = true
+			}
+			return newFull[i]
 		}
 		now := clockNow()
 		for nodeID, seen := range mapRes.PeerSeenChange {
-			if n, ok := peerByID[nodeID]; ok {
+			if n := mutablePeer(nodeID); n != nil {
 				if seen {
 					n.LastSeen = &now
 				} else {
@@ -255,19 +300,14 @@ func undeltaPeers(mapRes *tailcfg.MapResponse, prev []*tailcfg.Node) {
 			}
 		}
 		for nodeID, online := range mapRes.OnlineChange {
-			if n, ok := peerByID[nodeID]; ok {
+			if n := mutablePeer(nodeID); n != nil {
 				online := online
 				n.Online = &online
 			}
 		}
 		for _, ec := range mapRes.PeersChangedPatch {
-			if n, ok := peerByID[ec.NodeID]; ok {
-				if ec.DERPRegion != 0 {
-					n.DERP = fmt.Sprintf("%s:%v", tailcfg.DerpMagicIP, ec.DERPRegion)
-				}
-				if ec.Endpoints != nil {
-					n.Endpoints = ec.Endpoints
-				}
+			if n := mutablePeer(ec.NodeID); n != nil {
+				applyPeerChange(n, ec)
 			}
 		}
 	}
@@ -277,6 +317,36 @@ func undeltaPeers(mapRes *tailcfg.MapResponse, prev []*tailcfg.Node) {
 	mapRes.PeersRemoved = nil
 }
 
+// applyPeerChange applies the non-zero fields of pc to n.
+func applyPeerChange(n *tailcfg.Node, pc *tailcfg.PeerChange) {
+	if pc.DERPRegion != 0 {
+		n.DERP = fmt.Sprintf("%s:%v", tailcfg.DerpMagicIP, pc.DERPRegion)
+	}
+	if pc.Endpoints != nil {
+		n.Endpoints = pc.Endpoints
+	}
+	if pc.Key != nil {
+		n.Key = *pc.Key
+	}
+	if pc.DiscoKey != nil {
+		n.DiscoKey = *pc.DiscoKey
+	}
+	if pc.KeyExpiry != nil {
+		n.KeyExpiry = *pc.KeyExpiry
+	}
+	if pc.Online != nil {
+		online := *pc.Online
+		n.Online = &online
+	}
+	if pc.LastSeen != nil {
+		lastSeen := *pc.LastSeen
+		n.LastSeen = &lastSeen
+	}
+	if pc.Capabilities != nil {
+		n.Capabilities = *pc.Capabilities
+	}
+}
+
 func nodesSorted(v []*tailcfg.Node) bool {
 	for i, n := range v {
 		if i > 0 && n.ID <= v[i-1].ID {
@@ -290,17 +360,6 @@ func sortNodes(v []*tailcfg.Node) {
 	sort.Slice(v, func(i, j int) bool { return v[i].ID < v[j].ID })
 }
 
-func cloneNodes(v1 []*tailcfg.Node) []*tailcfg.Node {
-	if v1 == nil {
-		return nil
-	}
-	v2 := make([]*tailcfg.Node, len(v1))
-	for i, n := range v1 {
-		v2[i] = n.Clone()
-	}
-	return v2
-}
-
 var debugSelfIPv6Only = envknob.Bool("TS_DEBUG_SELF_V6_ONLY")
 
 func filterSelfAddresses(in []netaddr.IPPrefix) (ret []netaddr.IPPrefix) {
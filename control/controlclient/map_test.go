@@ -12,7 +12,9 @@
 	"testing"
 	"time"
 
+	"inet.af/netaddr"
 	"tailscale.com/tailcfg"
+	"tailscale.com/tstest/integration/testcontrol"
 	"tailscale.com/types/key"
 	"tailscale.com/types/netmap"
 )
@@ -192,6 +194,46 @@ func TestUndeltaPeers(t *testing.T) {
 			},
 			want: peers(n(1, "foo", withDERP("127.3.3.40:2"), withEP("1.2.3.4:56"))),
 		},
+		{
+			name: "patch_online_lastseen",
+			prev: peers(n(1, "foo"), n(2, "bar")),
+			mapRes: &tailcfg.MapResponse{
+				PeersChangedPatch: []*tailcfg.PeerChange{{
+					NodeID:   2,
+					Online:   ptrTo(true),
+					LastSeen: ptrTo(time.Unix(123, 0)),
+				}},
+			},
+			want: peers(n(1, "foo"), n(2, "bar", online(true), seenAt(time.Unix(123, 0)))),
+		},
+		{
+			name: "patch_keys_and_caps",
+			prev: peers(n(1, "foo", withKeys(key.NodePublic{}, key.DiscoPublic{}))),
+			mapRes: &tailcfg.MapResponse{
+				PeersChangedPatch: []*tailcfg.PeerChange{{
+					NodeID:       1,
+					Key:          ptrTo(testNodeKey),
+					DiscoKey:     ptrTo(testDiscoKey),
+					KeyExpiry:    ptrTo(time.Unix(456, 0)),
+					Capabilities: ptrTo([]string{"cap"}),
+				}},
+			},
+			want: peers(n(1, "foo", withKeys(testNodeKey, testDiscoKey), func(n *tailcfg.Node) {
+				n.KeyExpiry = time.Unix(456, 0)
+				n.Capabilities = []string{"cap"}
+			})),
+		},
+		{
+			name: "patch_unknown_node",
+			prev: peers(n(1, "foo")),
+			mapRes: &tailcfg.MapResponse{
+				PeersChangedPatch: []*tailcfg.PeerChange{{
+					NodeID:     2,
+					DERPRegion: 4,
+				}},
+			},
+			want: peers(n(1, "foo")),
+		},
 	}
 
 	for _, tt := range tests {
@@ -199,14 +241,37 @@ func TestUndeltaPeers(t *testing.T) {
 			if !tt.curTime.IsZero() {
 				curTime = tt.curTime
 			}
+			prevCopy := make([]*tailcfg.Node, len(tt.prev))
+			for i, n := range tt.prev {
+				prevCopy[i] = n.Clone()
+			}
 			undeltaPeers(tt.mapRes, tt.prev)
 			if !reflect.DeepEqual(tt.mapRes.Peers, tt.want) {
 				t.Errorf("wrong results\n got: %s\nwant: %s", formatNodes(tt.mapRes.Peers), formatNodes(tt.want))
 			}
+			for i, n := range tt.prev {
+				if !n.Equal(prevCopy[i]) {
+					t.Errorf("prev node %d was mutated", n.ID)
+				}
+			}
 		})
 	}
 }
 
+var (
+	testNodeKey  = key.NewNode().Public()
+	testDiscoKey = key.NewDisco().Public()
+)
+
+func ptrTo[T any](v T) *T { return &v }
+
+func withKeys(nk key.NodePublic, dk key.DiscoPublic) func(*tailcfg.Node) {
+	return func(n *tailcfg.Node) {
+		n.Key = nk
+		n.DiscoKey = dk
+	}
+}
+
 func formatNodes(nodes []*tailcfg.Node) string {
 	var sb strings.Builder
 	for i, n := range nodes {
@@ -361,3 +426,168 @@ func TestNetmapForResponse(t *testing.T) {
 		}
 	})
 }
+
+func TestNetmapForResponseSharesUnchangedPeers(t *testing.T) {
+	ms := newTestMapSession(t)
+	nm1 := ms.netmapForResponse(&tailcfg.MapResponse{
+		Node:  new(tailcfg.Node),
+		Peers: synthPeers(3),
+	})
+	nm2 := ms.netmapForResponse(&tailcfg.MapResponse{
+		PeersChangedPatch: []*tailcfg.PeerChange{{
+			NodeID:     nm1.Peers[1].ID,
+			DERPRegion: 7,
+		}},
+	})
+	if len(nm2.Peers) != 3 {
+		t.Fatalf("got %d peers; want 3", len(nm2.Peers))
+	}
+	if nm2.Peers[0] != nm1.Peers[0] || nm2.Peers[2] != nm1.Peers[2] {
+		t.Errorf("unchanged peers were copied")
+	}
+	if nm2.Peers[1] == nm1.Peers[1] {
+		t.Fatalf("patched peer shared with previous netmap")
+	}
+	if got, want := nm2.Peers[1].DERP, "127.3.3.40:7"; got != want {
+		t.Errorf("patched DERP = %q; want %q", got, want)
+	}
+	if got, want := nm1.Peers[1].DERP, "127.3.3.40:1"; got != want {
+		t.Errorf("previous netmap's DERP = %q; want unchanged %q", got, want)
+	}
+	if nm2.Peers[1].ComputedName == "" {
+		t.Errorf("patched peer missing ComputedName")
+	}
+}
+
+func TestNetmapForResponseStripEndpoints(t *testing.T) {
+	defer func(old bool) { Debug.StripEndpoints = old }(Debug.StripEndpoints)
+	Debug.StripEndpoints = true
+
+	ms := newTestMapSession(t)
+	nm1 := ms.netmapForResponse(&tailcfg.MapResponse{
+		Node:  new(tailcfg.Node),
+		Peers: synthPeers(2),
+	})
+	nm2 := ms.netmapForResponse(&tailcfg.MapResponse{
+		PeersChangedPatch: []*tailcfg.PeerChange{{
+			NodeID:    nm1.Peers[1].ID,
+			Endpoints: []string{"10.0.0.1:41641"},
+		}},
+	})
+	for _, nm := range []*netmap.NetworkMap{nm1, nm2} {
+		for _, p := range nm.Peers {
+			if len(p.Endpoints) != 0 {
+				t.Errorf("peer %d Endpoints = %v; want none", p.ID, p.Endpoints)
+			}
+		}
+	}
+	if nm2.Peers[0] != nm1.Peers[0] {
+		t.Errorf("unchanged peer was copied")
+	}
+}
+
+func TestNetmapForResponseTestcontrolDelta(t *testing.T) {
+	prev := synthPeers(100)
+	cur := synthPeers(101)[1:] // node 1 removed, node 101 added
+	for i, n := range cur {
+		switch i % 4 {
+		case 0:
+			n.Endpoints = []string{fmt.Sprintf("10.0.0.%d:41641", i)}
+		case 1:
+			n.DERP = "127.3.3.40:9"
+		case 2:
+			n.Name = fmt.Sprintf("renamed%d.", i) // not patchable
+		}
+	}
+	changed, removed, patches := testcontrol.PeerDelta(prev, cur)
+	if len(patches) == 0 {
+		t.Fatalf("no patches from testcontrol")
+	}
+
+	ms := newTestMapSession(t)
+	ms.netmapForResponse(&tailcfg.MapResponse{Node: new(tailcfg.Node), Peers: prev})
+	nm := ms.netmapForResponse(&tailcfg.MapResponse{
+		PeersChanged:      changed,
+		PeersRemoved:      removed,
+		PeersChangedPatch: patches,
+	})
+	if len(nm.Peers) != len(cur) {
+		t.Fatalf("got %d peers; want %d", len(nm.Peers), len(cur))
+	}
+	for i, n := range nm.Peers {
+		want := cur[i].Clone()
+		want.InitDisplayNames(nm.MagicDNSSuffix())
+		if !n.Equal(want) {
+			t.Errorf("peer %d differs after delta:\n got: %+v\nwant: %+v", n.ID, n, want)
+		}
+	}
+}
+
+// synthPeers returns n synthetic peers with IDs 1 through n.
+func synthPeers(n int) []*tailcfg.Node {
+	peers := make([]*tailcfg.Node, n)
+	for i := range peers {
+		id := tailcfg.NodeID(i + 1)
+		ip := netaddr.IPv4(100, 64, byte(id>>8), byte(id))
+		peers[i] = &tailcfg.Node{
+			ID:         id,
+			StableID:   tailcfg.StableNodeID(fmt.Sprintf("stable%d", id)),
+			Name:       fmt.Sprintf("peer%d.example.ts.net.", id),
+			Key:        key.NewNode().Public(),
+			DiscoKey:   key.NewDisco().Public(),
+			Addresses:  []netaddr.IPPrefix{netaddr.IPPrefixFrom(ip, 32)},
+			AllowedIPs: []netaddr.IPPrefix{netaddr.IPPrefixFrom(ip, 32)},
+			Endpoints:  []string{"192.168.0.1:41641", "[2001:db8::1]:41641"},
+			DERP:       "127.3.3.40:1",
+			Hostinfo:   (&tailcfg.Hostinfo{Hostname: fmt.Sprintf("peer%d", id)}).View(),
+		}
+	}
+	return peers
+}
+
+// BenchmarkNetmapForResponse measures the cost of processing a
+// MapResponse that changes one peer's endpoints in a 10k peer tailnet,
+// either as a full peer list or as a patch computed by testcontrol.
+func BenchmarkNetmapForResponse(b *testing.B) {
+	const numPeers = 10000
+	base := synthPeers(numPeers)
+	changedPeers := func(i int) []*tailcfg.Node {
+		cur := append([]*tailcfg.Node(nil), base...)
+		n := cur[i%numPeers].Clone()
+		n.Endpoints = []string{fmt.Sprintf("10.0.%d.%d:41641", byte(i>>8), byte(i))}
+		cur[i%numPeers] = n
+		return cur
+	}
+
+	b.Run("full", func(b *testing.B) {
+		ms := newMapSession(key.NewNode())
+		ms.netmapForResponse(&tailcfg.MapResponse{Node: new(tailcfg.Node), Peers: base})
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			peers := changedPeers(i)
+			for j, n := range peers {
+				peers[j] = n.Clone() // as if freshly decoded
+			}
+			b.StartTimer()
+			ms.netmapForResponse(&tailcfg.MapResponse{Peers: peers})
+		}
+	})
+	b.Run("patch", func(b *testing.B) {
+		ms := newMapSession(key.NewNode())
+		ms.netmapForResponse(&tailcfg.MapResponse{Node: new(tailcfg.Node), Peers: base})
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			changed, removed, patches := testcontrol.PeerDelta(base, changedPeers(i))
+			b.StartTimer()
+			ms.netmapForResponse(&tailcfg.MapResponse{
+				PeersChanged:      changed,
+				PeersRemoved:      removed,
+				PeersChangedPatch: patches,
+			})
+		}
+	})
+}
@@ -116,9 +116,11 @@ type Server struct {
 	packetsRecvOther             *expvar.Int
 	_                            pad32.Four
 	packetsDropped               expvar.Int
-	packetsDroppedReason         metrics.LabelMap
-	packetsDroppedReasonCounters []*expvar.Int // indexed by dropReason
-	packetsDroppedType           metrics.LabelMap
+	packetsDroppedReasonType     metrics.MultiLabelMap          // by reason and type
+	packetsDroppedReasonCounters [numDropReasons][2]*expvar.Int // indexed by dropReason, then 1 for disco
+	packetsDroppedReason         metrics.LabelMap               // deprecated; use packetsDroppedReasonType
+	packetsDroppedReasonOld      [numDropReasons]*expvar.Int    // indexed by dropReason
+	packetsDroppedType           metrics.LabelMap               // deprecated; use packetsDroppedReasonType
 	packetsDroppedTypeDisco      *expvar.Int
 	packetsDroppedTypeOther      *expvar.Int
 	_                            pad32.Four
@@ -139,7 +141,8 @@ type Server struct {
 	multiForwarderCreated        expvar.Int
 	multiForwarderDeleted        expvar.Int
 	removePktForwardOther        expvar.Int
-	avgQueueDuration             *uint64 // In milliseconds; accessed atomically
+	queueDuration                *metrics.Histogram // seconds from enqueuing packets to sending them
+	avgQueueDuration             *uint64            // deprecated; use queueDuration. In milliseconds; accessed atomically
 
 	// verifyClients only accepts client connections to the DERP server if the clientKey is a
 	// known peer in the network, as specified by a running tailscaled's client's local api.
@@ -313,19 +316,21 @@ func NewServer(privateKey key.NodePrivate, logf logger.Logf) *Server {
 		memSys0:              ms.Sys,
 		watchers:             map[*sclient]bool{},
 		sentTo:               map[key.NodePublic]map[key.NodePublic]int64{},
+		queueDuration:        metrics.NewHistogram(queueDurationBuckets),
 		avgQueueDuration:     new(uint64),
 		keyOfAddr:            map[netaddr.IPPort]key.NodePublic{},
 	}
 	s.initMetacert()
 	s.packetsRecvDisco = s.packetsRecvByKind.Get("disco")
 	s.packetsRecvOther = s.packetsRecvByKind.Get("other")
-	s.packetsDroppedReasonCounters = []*expvar.Int{
-		s.packetsDroppedReason.Get("unknown_dest"),
-		s.packetsDroppedReason.Get("unknown_dest_on_fwd"),
-		s.packetsDroppedReason.Get("gone"),
-		s.packetsDroppedReason.Get("queue_head"),
-		s.packetsDroppedReason.Get("queue_tail"),
-		s.packetsDroppedReason.Get("write_error"),
+	s.queueDuration.Help = "time from enqueuing packets to sending them, in seconds"
+	s.packetsDroppedReasonType.Type = "counter"
+	s.packetsDroppedReasonType.Help = "packets dropped, by reason and packet type"
+	s.packetsDroppedReasonType.Labels = []string{"reason", "type"}
+	for reason, label := range dropReasonLabels {
+		s.packetsDroppedReasonCounters[reason][0] = s.packetsDroppedReasonType.Get(label, "other")
+		s.packetsDroppedReasonCounters[reason][1] = s.packetsDroppedReasonType.Get(label, "disco")
+		s.packetsDroppedReasonOld[reason] = s.packetsDroppedReason.Get(label)
 	}
 	s.packetsDroppedTypeDisco = s.packetsDroppedType.Get("disco")
 	s.packetsDroppedTypeOther = s.packetsDroppedType.Get("other")
@@ -963,16 +968,38 @@ func (c *sclient) handleFrameSendPacket(ft frameType, fl uint32) error {
 	dropReasonQueueTail                          // destination queue is full, dropped packet at queue tail
 	dropReasonWriteError                         // OS write() failed
 	dropReasonDupClient                          // the public key is connected 2+ times (active/active, fighting)
+
+	numDropReasons = iota
 )
 
+// dropReasonLabels are the values of the "reason" label of the
+// packets_dropped_reason_type and counter_packets_dropped_reason
+// metrics, indexed by dropReason.
+var dropReasonLabels = [numDropReasons]string{
+	dropReasonUnknownDest:      "unknown_dest",
+	dropReasonUnknownDestOnFwd: "unknown_dest_on_fwd",
+	dropReasonGone:             "gone",
+	dropReasonQueueHead:        "queue_head",
+	dropReasonQueueTail:        "queue_tail",
+	dropReasonWriteError:       "write_error",
+	dropReasonDupClient:        "dup_client",
+}
+
+// queueDurationBuckets are the bucket upper bounds, in seconds, of the
+// queue_duration_seconds histogram.
+var queueDurationBuckets = []float64{.0001, .0005, .001, .005, .01, .05, .1, .5, 1, 5}
+
 func (s *Server) recordDrop(packetBytes []byte, srcKey, dstKey key.NodePublic, reason dropReason) {
 	s.packetsDropped.Add(1)
-	s.packetsDroppedReasonCounters[reason].Add(1)
+	s.packetsDroppedReasonOld[reason].Add(1)
+	isDisco := 0
 	if disco.LooksLikeDiscoWrapper(packetBytes) {
+		isDisco = 1
 		s.packetsDroppedTypeDisco.Add(1)
 	} else {
 		s.packetsDroppedTypeOther.Add(1)
 	}
+	s.packetsDroppedReasonCounters[reason][isDisco].Add(1)
 	if verboseDropKeys[dstKey] {
 		// Preformat the log string prior to calling limitedLogf. The
 		// limiter acts based on the format string, and we want to
@@ -1331,12 +1358,14 @@ func expMovingAverage(prev, newValue, alpha float64) float64 {
 	return alpha*newValue + (1-alpha)*prev
 }
 
-// recordQueueTime updates the average queue duration metric after a packet has been sent.
+// recordQueueTime updates the queue duration metrics after a packet has been sent.
 func (c *sclient) recordQueueTime(enqueuedAt time.Time) {
-	elapsed := float64(time.Since(enqueuedAt).Milliseconds())
+	elapsed := time.Since(enqueuedAt)
+	c.s.queueDuration.Observe(elapsed.Seconds())
+	ms := float64(elapsed.Milliseconds())
 	for {
 		old := atomic.LoadUint64(c.s.avgQueueDuration)
-		newAvg := expMovingAverage(math.Float64frombits(old), elapsed, 0.1)
+		newAvg := expMovingAverage(math.Float64frombits(old), ms, 0.1)
 		if atomic.CompareAndSwapUint64(c.s.avgQueueDuration, old, math.Float64bits(newAvg)) {
 			break
 		}
@@ -1682,6 +1711,9 @@ func (s *Server) ExpVar() expvar.Var {
 	m.Set("bytes_received", &s.bytesRecv)
 	m.Set("bytes_sent", &s.bytesSent)
 	m.Set("packets_dropped", &s.packetsDropped)
+	m.Set("packets_dropped_reason_type", &s.packetsDroppedReasonType)
+	// Deprecated: superseded by packets_dropped_reason_type, but kept for
+	// existing dashboards and alerts.
 	m.Set("counter_packets_dropped_reason", &s.packetsDroppedReason)
 	m.Set("counter_packets_dropped_type", &s.packetsDroppedType)
 	m.Set("counter_packets_received_kind", &s.packetsRecvByKind)
@@ -1698,6 +1730,8 @@ func (s *Server) ExpVar() expvar.Var {
 	m.Set("multiforwarder_created", &s.multiForwarderCreated)
 	m.Set("multiforwarder_deleted", &s.multiForwarderDeleted)
 	m.Set("packet_forwarder_delete_other_value", &s.removePktForwardOther)
+	m.Set("queue_duration_seconds", s.queueDuration)
+	// Deprecated: superseded by queue_duration_seconds.
 	m.Set("average_queue_duration_ms", expvar.Func(func() any {
 		return math.Float64frombits(atomic.LoadUint64(s.avgQueueDuration))
 	}))
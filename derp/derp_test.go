@@ -814,6 +814,34 @@ func TestMetaCert(t *testing.T) {
 	}
 }
 
+func TestRecordDropMetrics(t *testing.T) {
+	s := NewServer(key.NewNode(), t.Logf)
+	defer s.Close()
+	src, dst := key.NewNode().Public(), key.NewNode().Public()
+	for reason := dropReason(0); reason < numDropReasons; reason++ {
+		s.recordDrop([]byte("not disco"), src, dst, reason)
+	}
+	s.recordDrop([]byte("not disco"), src, dst, dropReasonDupClient)
+
+	if got := s.packetsDropped.Value(); got != numDropReasons+1 {
+		t.Errorf("packetsDropped = %d; want %d", got, numDropReasons+1)
+	}
+	if got := s.packetsDroppedReasonType.Get("dup_client", "other").Value(); got != 2 {
+		t.Errorf("dup_client drops = %d; want 2", got)
+	}
+	if got := s.packetsDroppedReasonType.Get("gone", "disco").Value(); got != 0 {
+		t.Errorf("gone disco drops = %d; want 0", got)
+	}
+
+	// The older single-label metrics are still maintained.
+	if got := s.packetsDroppedReason.Get("dup_client").Value(); got != 2 {
+		t.Errorf("counter_packets_dropped_reason dup_client = %d; want 2", got)
+	}
+	if got := s.packetsDroppedType.Get("other").Value(); got != numDropReasons+1 {
+		t.Errorf("counter_packets_dropped_type other = %d; want %d", got, numDropReasons+1)
+	}
+}
+
 type dummyNetConn struct {
 	net.Conn
 }
@@ -72,6 +72,11 @@
 	// the Windows network adapter's "category" (public, private, domain).
 	// If it's unhealthy, the Windows firewall rules won't match.
 	SysNetworkCategory = Subsystem("network-category")
+
+	// SysNetmapCache is the name of the ipnlocal netmap cache
+	// subsystem. It's unhealthy while the node is running on a
+	// netmap loaded from disk rather than one from control.
+	SysNetmapCache = Subsystem("netmap-cache")
 )
 
 type watchHandle byte
@@ -127,6 +132,14 @@ func SetNetworkCategoryHealth(err error) { set(SysNetworkCategory, err) }
 
 func NetworkCategoryHealth() error { return get(SysNetworkCategory) }
 
+// SetNetmapCacheHealth sets the state of ipnlocal's use of a cached
+// netmap. A non-nil error means the node is running without a fresh
+// netmap from the control plane.
+func SetNetmapCacheHealth(err error) { set(SysNetmapCache, err) }
+
+// NetmapCacheHealth returns the ipnlocal netmap cache error state.
+func NetmapCacheHealth() error { return get(SysNetmapCache) }
+
 func RegisterDebugHandler(typ string, h http.Handler) {
 	mu.Lock()
 	defer mu.Unlock()
@@ -21,8 +21,12 @@ func (src *Prefs) Clone() *Prefs {
 	}
 	dst := new(Prefs)
 	*dst = *src
+	dst.ExitNodeLANRoutes = append(src.ExitNodeLANRoutes[:0:0], src.ExitNodeLANRoutes...)
+	dst.DialPolicy = append(src.DialPolicy[:0:0], src.DialPolicy...)
 	dst.AdvertiseTags = append(src.AdvertiseTags[:0:0], src.AdvertiseTags...)
 	dst.AdvertiseRoutes = append(src.AdvertiseRoutes[:0:0], src.AdvertiseRoutes...)
+	dst.AdvertiseConnectorDomains = append(src.AdvertiseConnectorDomains[:0:0], src.AdvertiseConnectorDomains...)
+	dst.ExitBlockedPorts = append(src.ExitBlockedPorts[:0:0], src.ExitBlockedPorts...)
 	if dst.Persist != nil {
 		dst.Persist = new(persist.Persist)
 		*dst.Persist = *src.Persist
@@ -32,24 +36,30 @@ func (src *Prefs) Clone() *Prefs {
 
 // A compilation failure here means this code must be regenerated, with the command at the top of this file.
 var _PrefsCloneNeedsRegeneration = Prefs(struct {
-	ControlURL             string
-	RouteAll               bool
-	AllowSingleHosts       bool
-	ExitNodeID             tailcfg.StableNodeID
-	ExitNodeIP             netaddr.IP
-	ExitNodeAllowLANAccess bool
-	CorpDNS                bool
-	RunSSH                 bool
-	WantRunning            bool
-	LoggedOut              bool
-	ShieldsUp              bool
-	AdvertiseTags          []string
-	Hostname               string
-	NotepadURLs            bool
-	ForceDaemon            bool
-	AdvertiseRoutes        []netaddr.IPPrefix
-	NoSNAT                 bool
-	NetfilterMode          preftype.NetfilterMode
-	OperatorUser           string
-	Persist                *persist.Persist
+	ControlURL                string
+	RouteAll                  bool
+	AllowSingleHosts          bool
+	ExitNodeID                tailcfg.StableNodeID
+	ExitNodeIP                netaddr.IP
+	ExitNodeAllowLANAccess    bool
+	ExitNodeLANRoutes         []netaddr.IPPrefix
+	DialPolicy                []preftype.DialRule
+	CorpDNS                   bool
+	DNS64                     bool
+	RunSSH                    bool
+	WantRunning               bool
+	LoggedOut                 bool
+	ShieldsUp                 bool
+	AdvertiseTags             []string
+	Hostname                  string
+	NotepadURLs               bool
+	ForceDaemon               bool
+	AdvertiseRoutes           []netaddr.IPPrefix
+	AdvertiseNAT64            bool
+	AdvertiseConnectorDomains []string
+	ExitBlockedPorts          []tailcfg.PortRange
+	NoSNAT                    bool
+	NetfilterMode             preftype.NetfilterMode
+	OperatorUser              string
+	Persist                   *persist.Persist
 }{})
@@ -0,0 +1,418 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/ipn"
+	"tailscale.com/net/dns/resolver"
+	"tailscale.com/net/tsaddr"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+	"tailscale.com/types/netmap"
+	"tailscale.com/util/dnsname"
+	"tailscale.com/wgengine/wgcfg"
+)
+
+const (
+	// maxAppConnectorRoutes is the most routes learned for a single
+	// app connector, to bound the growth of the route table and of
+	// Hostinfo.
+	maxAppConnectorRoutes = 5000
+
+	// appConnectorRouteTTL is how long a learned route is kept after
+	// it was last seen in a DNS answer.
+	appConnectorRouteTTL = 24 * time.Hour
+)
+
+// appConnectorReconfigDelay is how long changes to the learned routes
+// are batched before reconfiguring, as a burst of DNS answers would
+// otherwise each cause a reconfiguration.
+var appConnectorReconfigDelay = time.Second
+
+// appConnectorRoutes tracks the routes learned from DNS answers for
+// the domains of app connectors.
+//
+// An app connector is a node that advertises domains (see
+// ipn.Prefs.AdvertiseConnectorDomains). Peers that accept routes
+// resolve those names via the connector's peerapi DNS server and
+// route the IPs in the answers via the connector, which also
+// advertises them as subnet routes.
+//
+// Routes are values of maps from the route to when it was last seen
+// in an answer, and expire appConnectorRouteTTL after that.
+type appConnectorRoutes struct {
+	// self is the routes learned by this node as an app
+	// connector, from the answers it served to peers.
+	self map[netaddr.IPPrefix]time.Time
+
+	// peers is the routes learned from answers for the domains of
+	// app connector peers, keyed by the connector's node key.
+	peers map[key.NodePublic]map[netaddr.IPPrefix]time.Time
+
+	// selfChanged and peersChanged are whether self and peers
+	// changed since the last flushAppConnectorRoutes.
+	selfChanged, peersChanged bool
+
+	timer    *time.Timer // pending flushAppConnectorRoutes, or nil
+	timerDue time.Time   // when timer fires
+}
+
+// appConnectorRoutable reports whether ip, from a DNS answer, may be
+// routed via an app connector. Tailscale, loopback, link-local,
+// multicast and private addresses never are, so that an answer can't
+// divert traffic for the tailnet or the local network.
+func appConnectorRoutable(ip netaddr.IP) bool {
+	return ip.IsValid() &&
+		!ip.IsUnspecified() &&
+		!ip.IsLoopback() &&
+		!ip.IsLinkLocalUnicast() &&
+		!ip.IsMulticast() &&
+		!ip.IsPrivate() &&
+		!tsaddr.IsTailscaleIP(ip) &&
+		ip != tsaddr.TailscaleServiceIP() &&
+		ip != tsaddr.TailscaleServiceIPv6()
+}
+
+// addRoutes adds a single-IP route for each routable IP in ips to m,
+// allocating it if needed, or marks it as seen at now if it's already
+// there. It reports whether any routes were new, and the routable IPs
+// that were dropped because m is full.
+func addRoutes(m *map[netaddr.IPPrefix]time.Time, ips []netaddr.IP, now time.Time) (changed bool, dropped []netaddr.IP) {
+	if *m == nil {
+		*m = make(map[netaddr.IPPrefix]time.Time)
+	}
+	for _, ip := range ips {
+		ip = ip.Unmap()
+		if !appConnectorRoutable(ip) {
+			continue
+		}
+		r := netaddr.IPPrefixFrom(ip, ip.BitLen())
+		if _, ok := (*m)[r]; !ok && len(*m) >= maxAppConnectorRoutes {
+			dropped = append(dropped, ip)
+			continue
+		} else if !ok {
+			changed = true
+		}
+		(*m)[r] = now
+	}
+	return changed, dropped
+}
+
+// expireRoutes removes the routes in m last seen more than
+// appConnectorRouteTTL before now, and reports whether there were any.
+func expireRoutes(m map[netaddr.IPPrefix]time.Time, now time.Time) (changed bool) {
+	for r, seen := range m {
+		if now.Sub(seen) > appConnectorRouteTTL {
+			delete(m, r)
+			changed = true
+		}
+	}
+	return changed
+}
+
+// sortedRoutes returns the routes in m, sorted.
+func sortedRoutes(m map[netaddr.IPPrefix]time.Time) []netaddr.IPPrefix {
+	if len(m) == 0 {
+		return nil
+	}
+	ret := make([]netaddr.IPPrefix, 0, len(m))
+	for r := range m {
+		ret = append(ret, r)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ipPrefixLess(ret[i], ret[j]) })
+	return ret
+}
+
+// appConnectorMatch reports whether name is domain or a subdomain of it.
+func appConnectorMatch(domain, name string) bool {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	return name == domain || dnsname.HasSuffix(name, domain)
+}
+
+// appConnectorSelfRoutesLocked returns the routes b learned as an app
+// connector, if it still is one.
+//
+// b.mu must be held.
+func (b *LocalBackend) appConnectorSelfRoutesLocked(prefs *ipn.Prefs) []netaddr.IPPrefix {
+	if prefs == nil || len(prefs.AdvertiseConnectorDomains) == 0 {
+		return nil
+	}
+	return sortedRoutes(b.appc.self)
+}
+
+// appConnectorPeerRoutesLocked returns the routes learned for the
+// domains of app connector peers, keyed by their node key, if prefs
+// accepts routes.
+//
+// b.mu must be held.
+func (b *LocalBackend) appConnectorPeerRoutesLocked(prefs *ipn.Prefs) map[key.NodePublic][]netaddr.IPPrefix {
+	if prefs == nil || !prefs.RouteAll || !prefs.CorpDNS || len(b.appc.peers) == 0 {
+		return nil
+	}
+	ret := make(map[key.NodePublic][]netaddr.IPPrefix, len(b.appc.peers))
+	for k, routes := range b.appc.peers {
+		ret[k] = sortedRoutes(routes)
+	}
+	return ret
+}
+
+// isAppConnector reports whether b is an app connector for any domains.
+func (b *LocalBackend) isAppConnector() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.prefs != nil && len(b.prefs.AdvertiseConnectorDomains) > 0
+}
+
+// appConnectorServesName reports whether b is an app connector for the
+// DNS name.
+func (b *LocalBackend) appConnectorServesName(name string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.prefs == nil {
+		return false
+	}
+	for _, d := range b.prefs.AdvertiseConnectorDomains {
+		if appConnectorMatch(d, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// learnAppConnectorRoutes records the IPs in res, a DNS response that
+// b served to a peer as an app connector, as routes to advertise.
+func (b *LocalBackend) learnAppConnectorRoutes(res []byte) {
+	name, ips, err := resolver.AnswerIPs(res)
+	if err != nil || len(ips) == 0 || !b.appConnectorServesName(string(name)) {
+		return
+	}
+	b.mu.Lock()
+	changed, dropped := addRoutes(&b.appc.self, ips, time.Now())
+	if changed {
+		b.appc.selfChanged = true
+		b.scheduleAppConnectorFlushLocked(appConnectorReconfigDelay)
+	}
+	b.mu.Unlock()
+
+	if len(dropped) > 0 {
+		b.logf("app connector: at the limit of %d routes; not advertising %v for %v", maxAppConnectorRoutes, dropped, name)
+	}
+	if changed {
+		b.logf("app connector: advertising %v for %v", ips, name)
+	}
+}
+
+// appConnectorCapPrefix is the prefix of the capabilities that allow
+// a node to be an app connector for a domain.
+const appConnectorCapPrefix = tailcfg.CapabilityAppConnector + "?domain="
+
+// appConnectorDomains returns the domains that the peer p advertises
+// being an app connector for and that control allowed it to be, with
+// a tailcfg.CapabilityAppConnector capability for the domain or a
+// parent of it.
+func appConnectorDomains(p *tailcfg.Node) []string {
+	if !p.Hostinfo.Valid() {
+		return nil
+	}
+	var allowed []string
+	for _, c := range p.Capabilities {
+		if strings.HasPrefix(c, appConnectorCapPrefix) {
+			allowed = append(allowed, strings.TrimPrefix(c, appConnectorCapPrefix))
+		}
+	}
+	if len(allowed) == 0 {
+		return nil
+	}
+	var ret []string
+	advertised := p.Hostinfo.AppConnector()
+	for i := 0; i < advertised.Len(); i++ {
+		d := advertised.At(i)
+		for _, a := range allowed {
+			if appConnectorMatch(a, d) {
+				ret = append(ret, d)
+				break
+			}
+		}
+	}
+	return ret
+}
+
+// appConnectorPeers returns the app connector peers in nm whose routes
+// prefs accepts and which serve DNS over the peerapi, with the domains
+// each is allowed to be a connector for.
+func appConnectorPeers(nm *netmap.NetworkMap, prefs *ipn.Prefs) (ret []appConnector) {
+	if nm == nil || prefs == nil || !prefs.RouteAll || !prefs.CorpDNS {
+		return nil
+	}
+	for _, p := range nm.Peers {
+		domains := appConnectorDomains(p)
+		if len(domains) == 0 {
+			continue
+		}
+		if _, ok := peerDoHURL(nm, p); ok {
+			ret = append(ret, appConnector{p, domains})
+		}
+	}
+	return ret
+}
+
+// appConnector is an app connector peer and the domains it's
+// allowed to be a connector for.
+type appConnector struct {
+	node    *tailcfg.Node
+	domains []string
+}
+
+// observeDNSAnswer is called by the resolver with the IPs it got from
+// upstream for the DNS name. If name is one of the domains of an app
+// connector peer, the IPs are routed via that peer.
+func (b *LocalBackend) observeDNSAnswer(name dnsname.FQDN, ips []netaddr.IP) {
+	b.mu.Lock()
+	var connector *tailcfg.Node
+peers:
+	for _, p := range appConnectorPeers(b.netMap, b.prefs) {
+		for _, d := range p.domains {
+			if appConnectorMatch(d, string(name)) {
+				connector = p.node
+				break peers
+			}
+		}
+	}
+	if connector == nil {
+		b.mu.Unlock()
+		return
+	}
+	if b.appc.peers == nil {
+		b.appc.peers = make(map[key.NodePublic]map[netaddr.IPPrefix]time.Time)
+	}
+	routes := b.appc.peers[connector.Key]
+	changed, dropped := addRoutes(&routes, ips, time.Now())
+	b.appc.peers[connector.Key] = routes
+	if changed {
+		b.appc.peersChanged = true
+		b.scheduleAppConnectorFlushLocked(appConnectorReconfigDelay)
+	}
+	b.mu.Unlock()
+
+	if len(dropped) > 0 {
+		b.logf("app connector: at the limit of %d routes via %v; not routing %v for %v", maxAppConnectorRoutes, connector.Key.ShortString(), dropped, name)
+	}
+	if changed {
+		b.logf("app connector: routing %v for %v via %v", ips, name, connector.Key.ShortString())
+	}
+}
+
+// scheduleAppConnectorFlushLocked arranges for flushAppConnectorRoutes
+// to run within d, unless it's already due sooner.
+//
+// b.mu must be held.
+func (b *LocalBackend) scheduleAppConnectorFlushLocked(d time.Duration) {
+	a := &b.appc
+	due := time.Now().Add(d)
+	if a.timer != nil {
+		if !a.timerDue.After(due) {
+			return
+		}
+		a.timer.Stop()
+	}
+	a.timerDue = due
+	a.timer = time.AfterFunc(d, b.flushAppConnectorRoutes)
+}
+
+// flushAppConnectorRoutes expires old learned routes and applies the
+// changes to the learned routes since it last ran: the advertised
+// routes in Hostinfo, the packet filter, and the engine's config.
+func (b *LocalBackend) flushAppConnectorRoutes() {
+	b.mu.Lock()
+	b.stopAppConnectorTimerLocked()
+	a := &b.appc
+	if b.shutdownCalled {
+		b.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	selfChanged := expireRoutes(a.self, now) || a.selfChanged
+	peersChanged := a.peersChanged
+	for k, routes := range a.peers {
+		if expireRoutes(routes, now) {
+			peersChanged = true
+		}
+		if len(routes) == 0 {
+			delete(a.peers, k)
+		}
+	}
+	a.selfChanged, a.peersChanged = false, false
+
+	// Come back when the next route expires.
+	var next time.Time
+	earliest := func(m map[netaddr.IPPrefix]time.Time) {
+		for _, seen := range m {
+			if next.IsZero() || seen.Before(next) {
+				next = seen
+			}
+		}
+	}
+	earliest(a.self)
+	for _, routes := range a.peers {
+		earliest(routes)
+	}
+	if !next.IsZero() {
+		b.scheduleAppConnectorFlushLocked(next.Add(appConnectorRouteTTL).Sub(now) + time.Second)
+	}
+
+	var newHi *tailcfg.Hostinfo
+	if selfChanged && b.hostinfo != nil {
+		newHi = b.hostinfo.Clone()
+		b.applyPrefsToHostinfo(newHi, b.prefs)
+		b.hostinfo = newHi
+		b.updateFilterLocked(b.netMap, b.prefs)
+	}
+	b.mu.Unlock()
+
+	if newHi != nil {
+		b.doSetHostinfoFilterServices(newHi)
+	}
+	if selfChanged || peersChanged {
+		b.authReconfig()
+	}
+}
+
+// stopAppConnectorTimerLocked stops any pending flushAppConnectorRoutes.
+//
+// b.mu must be held.
+func (b *LocalBackend) stopAppConnectorTimerLocked() {
+	if b.appc.timer != nil {
+		b.appc.timer.Stop()
+		b.appc.timer = nil
+	}
+}
+
+// addAppConnectorRoutes adds the routes learned for app connector peers
+// to their AllowedIPs in cfg.
+func addAppConnectorRoutes(cfg *wgcfg.Config, learned map[key.NodePublic][]netaddr.IPPrefix) {
+	for i := range cfg.Peers {
+		p := &cfg.Peers[i]
+		for _, r := range learned[p.PublicKey] {
+			if !containsPrefix(p.AllowedIPs, r) {
+				p.AllowedIPs = append(p.AllowedIPs, r)
+			}
+		}
+	}
+}
+
+func containsPrefix(ps []netaddr.IPPrefix, p netaddr.IPPrefix) bool {
+	for _, v := range ps {
+		if v == p {
+			return true
+		}
+	}
+	return false
+}
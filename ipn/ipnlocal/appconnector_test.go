@@ -0,0 +1,269 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"inet.af/netaddr"
+	"tailscale.com/ipn"
+	"tailscale.com/net/dns/resolver"
+	"tailscale.com/net/tsdial"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/ipproto"
+	"tailscale.com/types/key"
+	"tailscale.com/types/logger"
+	"tailscale.com/types/netmap"
+	"tailscale.com/wgengine"
+	"tailscale.com/wgengine/filter"
+	"tailscale.com/wgengine/wgcfg"
+)
+
+func TestAppConnectorMatch(t *testing.T) {
+	tests := []struct {
+		domain, name string
+		want         bool
+	}{
+		{"github.com", "github.com.", true},
+		{"github.com", "api.GitHub.com.", true},
+		{"github.com.", "a.b.github.com", true},
+		{"github.com", "notgithub.com.", false},
+		{"github.com", "github.com.evil.", false},
+		{"api.github.com", "github.com.", false},
+	}
+	for _, tt := range tests {
+		if got := appConnectorMatch(tt.domain, tt.name); got != tt.want {
+			t.Errorf("appConnectorMatch(%q, %q) = %v; want %v", tt.domain, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestObserveDNSAnswer(t *testing.T) {
+	b := &LocalBackend{
+		logf: t.Logf,
+		netMap: &netmap.NetworkMap{
+			Addresses: ipps("100.101.101.101"),
+			Peers:     []*tailcfg.Node{appConnectorPeer},
+		},
+		prefs: &ipn.Prefs{CorpDNS: true, RouteAll: true},
+	}
+	defer func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		b.stopAppConnectorTimerLocked()
+	}()
+	b.observeDNSAnswer("api.github.com.", ips("140.82.112.6", "::ffff:140.82.112.5"))
+	b.observeDNSAnswer("api.github.com.", ips("140.82.112.6"))
+	b.observeDNSAnswer("gitlab.com.", ips("172.65.251.78"))
+	// Addresses that must never be routed via a connector.
+	b.observeDNSAnswer("evil.github.com.", ips("100.101.101.101", "100.100.100.100", "fd7a:115c:a1e0::1",
+		"127.0.0.1", "169.254.169.254", "fe80::1", "224.0.0.251", "10.1.2.3", "192.168.1.1", "0.0.0.0"))
+	if b.appc.timer == nil {
+		t.Errorf("reconfiguration not scheduled")
+	}
+
+	want := map[key.NodePublic][]netaddr.IPPrefix{
+		appConnectorPeer.Key: ipps("140.82.112.5", "140.82.112.6"),
+	}
+	if got := b.appConnectorPeerRoutesLocked(b.prefs); !reflect.DeepEqual(got, want) {
+		t.Errorf("learned routes = %v; want %v", got, want)
+	}
+
+	// Without accepting routes, the learned ones aren't used.
+	if got := b.appConnectorPeerRoutesLocked(&ipn.Prefs{CorpDNS: true}); got != nil {
+		t.Errorf("learned routes without RouteAll = %v; want none", got)
+	}
+}
+
+func TestObserveDNSAnswerNotAllowed(t *testing.T) {
+	b := &LocalBackend{
+		logf: t.Logf,
+		netMap: &netmap.NetworkMap{
+			Addresses: ipps("100.101.101.101"),
+			Peers:     []*tailcfg.Node{rogueConnectorPeer},
+		},
+		prefs: &ipn.Prefs{CorpDNS: true, RouteAll: true},
+	}
+	defer func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		b.stopAppConnectorTimerLocked()
+	}()
+	b.observeDNSAnswer("api.github.com.", ips("140.82.112.6"))
+	b.observeDNSAnswer("www.gitlab.com.", ips("172.65.251.78"))
+	if b.appc.timer != nil {
+		t.Errorf("reconfiguration scheduled")
+	}
+	if got := b.appConnectorPeerRoutesLocked(b.prefs); got != nil {
+		t.Errorf("learned routes = %v; want none", got)
+	}
+}
+
+func TestAppConnectorRouteLimits(t *testing.T) {
+	var m map[netaddr.IPPrefix]time.Time
+	t0 := time.Now()
+	if changed, _ := addRoutes(&m, ips("140.82.112.5", "140.82.112.6"), t0); !changed {
+		t.Fatal("new routes not reported as changed")
+	}
+	t1 := t0.Add(appConnectorRouteTTL / 2)
+	if changed, _ := addRoutes(&m, ips("140.82.112.6"), t1); changed {
+		t.Error("seen route reported as changed")
+	}
+	if expireRoutes(m, t1) {
+		t.Error("routes expired early")
+	}
+	if !expireRoutes(m, t0.Add(appConnectorRouteTTL+time.Minute)) {
+		t.Error("old route not expired")
+	}
+	if want := ipps("140.82.112.6"); !reflect.DeepEqual(sortedRoutes(m), want) {
+		t.Errorf("routes after expiry = %v; want %v", sortedRoutes(m), want)
+	}
+
+	for i := 0; len(m) < maxAppConnectorRoutes; i++ {
+		addRoutes(&m, []netaddr.IP{netaddr.IPv4(8, byte(i>>16), byte(i>>8), byte(i))}, t1)
+	}
+	changed, dropped := addRoutes(&m, ips("140.82.112.6", "140.82.112.7"), t1)
+	if changed || !reflect.DeepEqual(dropped, ips("140.82.112.7")) {
+		t.Errorf("at limit: changed = %v, dropped = %v; want false, [140.82.112.7]", changed, dropped)
+	}
+}
+
+func TestAddAppConnectorRoutes(t *testing.T) {
+	k1, k2 := key.NewNode().Public(), key.NewNode().Public()
+	cfg := &wgcfg.Config{
+		Peers: []wgcfg.Peer{
+			{PublicKey: k1, AllowedIPs: ipps("100.102.0.9", "140.82.112.5")},
+			{PublicKey: k2, AllowedIPs: ipps("100.102.0.10")},
+		},
+	}
+	addAppConnectorRoutes(cfg, map[key.NodePublic][]netaddr.IPPrefix{
+		k1: ipps("140.82.112.5", "140.82.112.6"),
+	})
+	if got, want := cfg.Peers[0].AllowedIPs, ipps("100.102.0.9", "140.82.112.5", "140.82.112.6"); !reflect.DeepEqual(got, want) {
+		t.Errorf("connector AllowedIPs = %v; want %v", got, want)
+	}
+	if got, want := cfg.Peers[1].AllowedIPs, ipps("100.102.0.10"); !reflect.DeepEqual(got, want) {
+		t.Errorf("other peer AllowedIPs = %v; want %v", got, want)
+	}
+}
+
+// dnsResponseForTest returns a response to an A query for name with
+// the given answers.
+func dnsResponseForTest(t *testing.T, name string, answers ...netaddr.IP) []byte {
+	t.Helper()
+	n := dnsmessage.MustNewName(name)
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{Response: true})
+	b.StartQuestions()
+	b.Question(dnsmessage.Question{Name: n, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET})
+	b.StartAnswers()
+	for _, ip := range answers {
+		b.AResource(dnsmessage.ResourceHeader{Name: n, Class: dnsmessage.ClassINET, TTL: 60}, dnsmessage.AResource{A: ip.As4()})
+	}
+	res, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func TestLearnAppConnectorRoutes(t *testing.T) {
+	eng, err := wgengine.NewFakeUserspaceEngine(logger.Discard, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer eng.Close()
+	b := &LocalBackend{
+		logf:     t.Logf,
+		e:        eng,
+		hostinfo: &tailcfg.Hostinfo{},
+		netMap: &netmap.NetworkMap{
+			Addresses: ipps("100.101.101.101"),
+			PacketFilter: []filter.Match{{
+				IPProto: []ipproto.Proto{ipproto.TCP},
+				Srcs:    ipps("0.0.0.0/0"),
+				Dsts:    []filter.NetPortRange{{Net: netaddr.MustParseIPPrefix("0.0.0.0/0"), Ports: filter.PortRange{First: 0, Last: 65535}}},
+			}},
+		},
+		prefs: &ipn.Prefs{
+			AdvertiseRoutes:           ipps("10.0.0.0/8"),
+			AdvertiseConnectorDomains: []string{"github.com"},
+		},
+	}
+	defer func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		b.stopAppConnectorTimerLocked()
+	}()
+	b.learnAppConnectorRoutes(dnsResponseForTest(t, "api.github.com.", netaddr.MustParseIP("140.82.112.6")))
+	b.learnAppConnectorRoutes(dnsResponseForTest(t, "gitlab.com.", netaddr.MustParseIP("172.65.251.78")))
+	b.learnAppConnectorRoutes(dnsResponseForTest(t, "internal.github.com.", netaddr.MustParseIP("10.2.3.4")))
+	if len(b.hostinfo.RoutableIPs) != 0 {
+		t.Fatalf("routes advertised before the reconfig delay")
+	}
+	b.flushAppConnectorRoutes()
+
+	hi := b.hostinfo
+	if want := ipps("10.0.0.0/8", "140.82.112.6"); !reflect.DeepEqual(hi.RoutableIPs, want) {
+		t.Errorf("RoutableIPs = %v; want %v", hi.RoutableIPs, want)
+	}
+	if want := []string{"github.com"}; !reflect.DeepEqual(hi.AppConnector, want) {
+		t.Errorf("AppConnector = %v; want %v", hi.AppConnector, want)
+	}
+
+	// Peers' packets to the learned IPs, and only those, are accepted.
+	f := b.filterAtomic.Load().(*filter.Filter)
+	src := netaddr.MustParseIP("100.102.0.1")
+	if f.CheckTCP(src, netaddr.MustParseIP("140.82.112.6"), 443) != filter.Accept {
+		t.Errorf("packet to learned route dropped")
+	}
+	if f.CheckTCP(src, netaddr.MustParseIP("172.65.251.78"), 443) == filter.Accept {
+		t.Errorf("packet to unknown IP accepted")
+	}
+}
+
+func TestPeerAPIAppConnectorDNS(t *testing.T) {
+	b := &LocalBackend{logf: t.Logf, prefs: &ipn.Prefs{}}
+	h := &peerAPIHandler{
+		remoteAddr: netaddr.MustParseIPPort("100.150.151.152:12345"),
+		ps: &peerAPIServer{
+			b:        b,
+			resolver: resolver.New(logger.Discard, nil, nil, new(tsdial.Dialer)),
+		},
+	}
+	defer h.ps.resolver.Close()
+	query := func() *httptest.ResponseRecorder {
+		q := dnsQueryForName("gitlab.com", "A")
+		req := httptest.NewRequest("POST", "/dns-query", bytes.NewReader(q))
+		req.Header.Set("Content-Type", "application/dns-message")
+		rec := httptest.NewRecorder()
+		h.handleDNSQuery(rec, req)
+		return rec
+	}
+
+	if rec := query(); rec.Code != http.StatusForbidden {
+		t.Errorf("not a connector: status = %v; want 403", rec.Code)
+	}
+
+	// As an app connector, only its domains are resolved.
+	b.prefs = &ipn.Prefs{AdvertiseConnectorDomains: []string{"github.com"}}
+	rec := query()
+	if rec.Code != http.StatusOK {
+		t.Fatalf("connector: status = %v; want 200", rec.Code)
+	}
+	var p dnsmessage.Parser
+	hdr, err := p.Start(rec.Body.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hdr.RCode != dnsmessage.RCodeRefused {
+		t.Errorf("connector: RCode = %v; want refused", hdr.RCode)
+	}
+}
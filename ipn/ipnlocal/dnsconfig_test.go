@@ -15,6 +15,7 @@
 	"tailscale.com/tailcfg"
 	"tailscale.com/tstest"
 	"tailscale.com/types/dnstype"
+	"tailscale.com/types/key"
 	"tailscale.com/types/netmap"
 	"tailscale.com/util/cloudenv"
 	"tailscale.com/util/dnsname"
@@ -38,6 +39,41 @@ func ips(ss ...string) (ips []netaddr.IP) {
 	return
 }
 
+// appConnectorPeer is a peer that's an app connector for github.com
+// and example.org.
+var appConnectorPeer = &tailcfg.Node{
+	Name:      "conn.net",
+	Key:       key.NewNode().Public(),
+	Addresses: ipps("100.102.0.9"),
+	Capabilities: []string{
+		tailcfg.CapabilityAppConnector + "?domain=github.com",
+		tailcfg.CapabilityAppConnector + "?domain=example.org",
+	},
+	Hostinfo: (&tailcfg.Hostinfo{
+		Services: []tailcfg.Service{
+			{Proto: tailcfg.PeerAPI4, Port: 444},
+			{Proto: tailcfg.PeerAPIDNS, Port: 1},
+		},
+		AppConnector: []string{"github.com", "example.org"},
+	}).View(),
+}
+
+// rogueConnectorPeer is a peer that advertises being an app connector
+// for domains control didn't allow it to be one for.
+var rogueConnectorPeer = &tailcfg.Node{
+	Name:         "rogue.net",
+	Key:          key.NewNode().Public(),
+	Addresses:    ipps("100.102.0.10"),
+	Capabilities: []string{tailcfg.CapabilityAppConnector + "?domain=api.gitlab.com"},
+	Hostinfo: (&tailcfg.Hostinfo{
+		Services: []tailcfg.Service{
+			{Proto: tailcfg.PeerAPI4, Port: 444},
+			{Proto: tailcfg.PeerAPIDNS, Port: 1},
+		},
+		AppConnector: []string{"com", "gitlab.com", "github.com"},
+	}).View(),
+}
+
 func TestDNSConfigForNetmap(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -289,6 +325,107 @@ func TestDNSConfigForNetmap(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "app_connector",
+			nm: &netmap.NetworkMap{
+				Addresses: ipps("100.101.101.101"),
+				Peers:     []*tailcfg.Node{appConnectorPeer},
+			},
+			prefs: &ipn.Prefs{
+				CorpDNS:  true,
+				RouteAll: true,
+			},
+			want: &dns.Config{
+				Hosts: map[dnsname.FQDN][]netaddr.IP{
+					"conn.net.": ips("100.102.0.9"),
+				},
+				Routes: map[dnsname.FQDN][]*dnstype.Resolver{
+					"github.com.":  {{Addr: "http://100.102.0.9:444/dns-query"}},
+					"example.org.": {{Addr: "http://100.102.0.9:444/dns-query"}},
+				},
+			},
+		},
+		{
+			name: "app_connector_not_allowed",
+			nm: &netmap.NetworkMap{
+				Addresses: ipps("100.101.101.101"),
+				Peers:     []*tailcfg.Node{rogueConnectorPeer},
+			},
+			prefs: &ipn.Prefs{
+				CorpDNS:  true,
+				RouteAll: true,
+			},
+			want: &dns.Config{
+				Hosts: map[dnsname.FQDN][]netaddr.IP{
+					"rogue.net.": ips("100.102.0.10"),
+				},
+				Routes: map[dnsname.FQDN][]*dnstype.Resolver{},
+			},
+		},
+		{
+			name: "app_connector_routes_not_accepted",
+			nm: &netmap.NetworkMap{
+				Addresses: ipps("100.101.101.101"),
+				Peers:     []*tailcfg.Node{appConnectorPeer},
+			},
+			prefs: &ipn.Prefs{
+				CorpDNS: true,
+			},
+			want: &dns.Config{
+				Hosts: map[dnsname.FQDN][]netaddr.IP{
+					"conn.net.": ips("100.102.0.9"),
+				},
+				Routes: map[dnsname.FQDN][]*dnstype.Resolver{},
+			},
+		},
+		{
+			name: "dns64",
+			nm: &netmap.NetworkMap{
+				Addresses: ipps("100.101.101.101"),
+				Peers: []*tailcfg.Node{
+					{
+						Name:       "router.net",
+						Addresses:  ipps("100.102.0.7"),
+						AllowedIPs: ipps("100.102.0.7", "10.1.0.0/16", "fd7a:115c:a1e0:64::a01:0/112"),
+					},
+				},
+			},
+			prefs: &ipn.Prefs{
+				CorpDNS:  true,
+				RouteAll: true,
+				DNS64:    true,
+			},
+			want: &dns.Config{
+				Hosts: map[dnsname.FQDN][]netaddr.IP{
+					"router.net.": ips("100.102.0.7"),
+				},
+				Routes:      map[dnsname.FQDN][]*dnstype.Resolver{},
+				DNS64Routes: ipps("10.1.0.0/16"),
+			},
+		},
+		{
+			name: "dns64_routes_not_accepted",
+			nm: &netmap.NetworkMap{
+				Addresses: ipps("100.101.101.101"),
+				Peers: []*tailcfg.Node{
+					{
+						Name:       "router.net",
+						Addresses:  ipps("100.102.0.7"),
+						AllowedIPs: ipps("100.102.0.7", "fd7a:115c:a1e0:64::a01:0/112"),
+					},
+				},
+			},
+			prefs: &ipn.Prefs{
+				CorpDNS: true,
+				DNS64:   true,
+			},
+			want: &dns.Config{
+				Hosts: map[dnsname.FQDN][]netaddr.IP{
+					"router.net.": ips("100.102.0.7"),
+				},
+				Routes: map[dnsname.FQDN][]*dnstype.Resolver{},
+			},
+		},
 		{
 			name: "not_exit_node_NOT_need_fallbacks",
 			nm: &netmap.NetworkMap{
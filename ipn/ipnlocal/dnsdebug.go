@@ -0,0 +1,181 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/net/dns"
+	"tailscale.com/net/dns/resolver"
+	"tailscale.com/types/dnstype"
+	"tailscale.com/util/dnsname"
+	"tailscale.com/wgengine"
+)
+
+// dnsTypes are the DNS record types that can be queried by name with
+// QueryDNS.
+var dnsTypes = map[string]dnsmessage.Type{
+	"A":     dnsmessage.TypeA,
+	"AAAA":  dnsmessage.TypeAAAA,
+	"CNAME": dnsmessage.TypeCNAME,
+	"MX":    dnsmessage.TypeMX,
+	"NS":    dnsmessage.TypeNS,
+	"PTR":   dnsmessage.TypePTR,
+	"SOA":   dnsmessage.TypeSOA,
+	"SRV":   dnsmessage.TypeSRV,
+	"TXT":   dnsmessage.TypeTXT,
+	"ANY":   dnsmessage.TypeALL,
+}
+
+func dnsTypeString(t dnsmessage.Type) string {
+	for s, v := range dnsTypes {
+		if v == t {
+			return s
+		}
+	}
+	return strings.TrimPrefix(t.String(), "Type")
+}
+
+var dnsRCodes = map[dnsmessage.RCode]string{
+	dnsmessage.RCodeSuccess:        "NOERROR",
+	dnsmessage.RCodeFormatError:    "FORMERR",
+	dnsmessage.RCodeServerFailure:  "SERVFAIL",
+	dnsmessage.RCodeNameError:      "NXDOMAIN",
+	dnsmessage.RCodeNotImplemented: "NOTIMP",
+	dnsmessage.RCodeRefused:        "REFUSED",
+}
+
+func dnsRCodeString(rc dnsmessage.RCode) string {
+	if s, ok := dnsRCodes[rc]; ok {
+		return s
+	}
+	return strings.TrimPrefix(rc.String(), "RCode")
+}
+
+// dnsManager returns the engine's DNS manager.
+func (b *LocalBackend) dnsManager() (*dns.Manager, error) {
+	ig, ok := b.e.(wgengine.InternalsGetter)
+	if !ok {
+		return nil, errors.New("engine isn't InternalsGetter")
+	}
+	_, _, m, ok := ig.GetInternals()
+	if !ok || m == nil {
+		return nil, errors.New("failed to get DNS manager")
+	}
+	return m, nil
+}
+
+func resolverAddrs(rs []*dnstype.Resolver) []string {
+	ret := make([]string, 0, len(rs))
+	for _, r := range rs {
+		ret = append(ret, r.Addr)
+	}
+	return ret
+}
+
+// DNSStatus returns the DNS configuration of the resolver and the OS.
+func (b *LocalBackend) DNSStatus() (*apitype.DNSStatus, error) {
+	m, err := b.dnsManager()
+	if err != nil {
+		return nil, err
+	}
+	st := m.Status()
+	ret := &apitype.DNSStatus{
+		OSConfigurator:   st.OSConfiguratorMode,
+		SupportsSplitDNS: st.SupportsSplitDNS,
+		DefaultResolvers: resolverAddrs(st.Config.DefaultResolvers),
+		MagicDNSHosts:    len(st.Config.Hosts),
+	}
+	if len(st.Config.Routes) > 0 {
+		ret.Routes = make(map[string][]string, len(st.Config.Routes))
+		for suffix, rs := range st.Config.Routes {
+			ret.Routes[suffix.WithTrailingDot()] = resolverAddrs(rs)
+		}
+	}
+	for _, d := range st.Config.SearchDomains {
+		ret.SearchDomains = append(ret.SearchDomains, d.WithoutTrailingDot())
+	}
+	for _, ip := range st.OSConfig.Nameservers {
+		ret.OSNameservers = append(ret.OSNameservers, ip.String())
+	}
+	for _, d := range st.OSConfig.MatchDomains {
+		ret.OSMatchDomains = append(ret.OSMatchDomains, d.WithTrailingDot())
+	}
+	sort.Strings(ret.OSMatchDomains)
+	return ret, nil
+}
+
+func dnsQueryLogEntry(e resolver.QueryLogEntry) apitype.DNSQueryLogEntry {
+	ret := apitype.DNSQueryLogEntry{
+		Time:     e.Time,
+		Name:     e.Name.WithTrailingDot(),
+		Type:     dnsTypeString(e.Type),
+		Local:    e.Local,
+		Route:    string(e.Route),
+		Upstream: e.Upstream,
+		Latency:  e.Latency,
+	}
+	if e.Err != nil {
+		ret.Error = e.Err.Error()
+	} else {
+		ret.RCode = dnsRCodeString(e.RCode)
+	}
+	return ret
+}
+
+// DNSQueryLog returns the most recent queries handled by the resolver,
+// oldest first.
+func (b *LocalBackend) DNSQueryLog() ([]apitype.DNSQueryLogEntry, error) {
+	m, err := b.dnsManager()
+	if err != nil {
+		return nil, err
+	}
+	log := m.Resolver().QueryLog()
+	ret := make([]apitype.DNSQueryLogEntry, 0, len(log))
+	for _, e := range log {
+		ret = append(ret, dnsQueryLogEntry(e))
+	}
+	return ret, nil
+}
+
+// QueryDNS resolves name for the record type typ (like "A" or "AAAA")
+// with the resolver, as if queried by a client of it, and reports how
+// the query was handled.
+func (b *LocalBackend) QueryDNS(ctx context.Context, name, typ string) (*apitype.DNSQueryResult, error) {
+	fqdn, err := dnsname.ToFQDN(name)
+	if err != nil {
+		return nil, err
+	}
+	t, ok := dnsTypes[strings.ToUpper(typ)]
+	if !ok {
+		return nil, fmt.Errorf("unsupported DNS record type %q", typ)
+	}
+	m, err := b.dnsManager()
+	if err != nil {
+		return nil, err
+	}
+	r := m.Resolver()
+	res, e, err := r.DebugQuery(ctx, fqdn, t)
+	if err != nil && e.Time.IsZero() {
+		// The query wasn't made at all.
+		return nil, err
+	}
+	ret := &apitype.DNSQueryResult{
+		DNSQueryLogEntry: dnsQueryLogEntry(e),
+		Response:         res,
+	}
+	if !e.Local {
+		if _, rs, ok := r.Route(fqdn); ok {
+			ret.Resolvers = resolverAddrs(rs)
+		}
+	}
+	return ret, nil
+}
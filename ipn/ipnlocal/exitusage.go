@@ -0,0 +1,158 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"errors"
+	"sort"
+
+	"inet.af/netaddr"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/ipn"
+	"tailscale.com/net/exitusage"
+	"tailscale.com/net/tsaddr"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/netmap"
+	"tailscale.com/wgengine"
+)
+
+// exitUsageTracker returns the engine's tracker of exit traffic.
+func (b *LocalBackend) exitUsageTracker() (*exitusage.Tracker, error) {
+	ig, ok := b.e.(wgengine.InternalsGetter)
+	if !ok {
+		return nil, errors.New("engine isn't InternalsGetter")
+	}
+	tw, _, _, ok := ig.GetInternals()
+	if !ok || tw == nil {
+		return nil, errors.New("failed to get tun wrapper")
+	}
+	return tw.ExitUsage(), nil
+}
+
+// setExitUsageConfig configures the tracking and blocking of exit
+// traffic from prefs and the subnet routes this node serves, and
+// forgets the usage of peers no longer in nm.
+func (b *LocalBackend) setExitUsageConfig(prefs *ipn.Prefs, subnetRoutes []netaddr.IPPrefix, nm *netmap.NetworkMap) {
+	t, err := b.exitUsageTracker()
+	if err != nil {
+		return
+	}
+	var nonExit []netaddr.IPPrefix
+	for _, r := range subnetRoutes {
+		if r.Bits() != 0 {
+			nonExit = append(nonExit, r)
+		}
+	}
+	t.SetConfig(prefs.AdvertisesExitNode(), nonExit, prefs.ExitBlockedPorts)
+	t.PrunePeers(tsaddr.NewContainsIPFunc(peerSources(nm)))
+}
+
+// peerSources returns the prefixes that traffic from the peers in nm
+// may come from: their addresses and the subnets they route, other
+// than the default routes of exit nodes.
+func peerSources(nm *netmap.NetworkMap) []netaddr.IPPrefix {
+	var ret []netaddr.IPPrefix
+	for _, p := range nm.Peers {
+		ret = append(ret, p.Addresses...)
+		for _, r := range p.AllowedIPs {
+			if r.Bits() != 0 {
+				ret = append(ret, r)
+			}
+		}
+	}
+	return ret
+}
+
+func exitNodeCounts(c exitusage.Counts) apitype.ExitNodeCounts {
+	return apitype.ExitNodeCounts{
+		TxPackets: c.TxPackets,
+		TxBytes:   c.TxBytes,
+		RxPackets: c.RxPackets,
+		RxBytes:   c.RxBytes,
+	}
+}
+
+func addExitNodeCounts(a *apitype.ExitNodeCounts, b apitype.ExitNodeCounts) {
+	a.TxPackets += b.TxPackets
+	a.TxBytes += b.TxBytes
+	a.RxPackets += b.RxPackets
+	a.RxBytes += b.RxBytes
+}
+
+func exitNodeBytes(c apitype.ExitNodeCounts) uint64 {
+	return c.TxBytes + c.RxBytes
+}
+
+// ExitUsage returns the traffic that this node, as an exit node,
+// forwarded for each peer, the peers with the most traffic first.
+func (b *LocalBackend) ExitUsage() ([]apitype.ExitNodeUsage, error) {
+	t, err := b.exitUsageTracker()
+	if err != nil {
+		return nil, err
+	}
+	usage := t.Usage()
+
+	b.mu.Lock()
+	nodes := make([]*tailcfg.Node, len(usage))
+	for i, u := range usage {
+		nodes[i] = b.nodeByAddr[u.IP]
+	}
+	b.mu.Unlock()
+
+	return mergeExitUsage(usage, nodes), nil
+}
+
+// mergeExitUsage converts usage to its API type, merging the usage of
+// the IPs of the same node. nodes[i] is the node of usage[i], if known.
+func mergeExitUsage(usage []exitusage.PeerUsage, nodes []*tailcfg.Node) []apitype.ExitNodeUsage {
+	var ret []apitype.ExitNodeUsage
+	byNode := map[tailcfg.StableNodeID]int{} // index in ret
+	for i, u := range usage {
+		var e *apitype.ExitNodeUsage
+		if n := nodes[i]; n != nil {
+			if j, ok := byNode[n.StableID]; ok {
+				e = &ret[j]
+			} else {
+				byNode[n.StableID] = len(ret)
+				ret = append(ret, apitype.ExitNodeUsage{NodeID: n.StableID, Name: n.ComputedName})
+				e = &ret[len(ret)-1]
+			}
+		} else {
+			ret = append(ret, apitype.ExitNodeUsage{})
+			e = &ret[len(ret)-1]
+		}
+		e.IPs = append(e.IPs, u.IP.String())
+		addExitNodeCounts(&e.ExitNodeCounts, exitNodeCounts(u.Counts))
+		e.BlockedPackets += u.BlockedPackets
+	DestLoop:
+		for _, d := range u.TopDests {
+			proto := d.Proto.String()
+			for k := range e.TopDestinations {
+				if ed := &e.TopDestinations[k]; ed.Proto == proto && ed.Port == d.Port {
+					addExitNodeCounts(&ed.ExitNodeCounts, exitNodeCounts(d.Counts))
+					continue DestLoop
+				}
+			}
+			e.TopDestinations = append(e.TopDestinations, apitype.ExitNodeDestUsage{
+				Proto:          proto,
+				Port:           d.Port,
+				ExitNodeCounts: exitNodeCounts(d.Counts),
+			})
+		}
+	}
+	for i := range ret {
+		ds := ret[i].TopDestinations
+		sort.SliceStable(ds, func(i, j int) bool {
+			return exitNodeBytes(ds[i].ExitNodeCounts) > exitNodeBytes(ds[j].ExitNodeCounts)
+		})
+		if len(ds) > exitusage.MaxTopDests {
+			ret[i].TopDestinations = ds[:exitusage.MaxTopDests]
+		}
+	}
+	sort.SliceStable(ret, func(i, j int) bool {
+		return exitNodeBytes(ret[i].ExitNodeCounts) > exitNodeBytes(ret[j].ExitNodeCounts)
+	})
+	return ret
+}
@@ -0,0 +1,73 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"reflect"
+	"testing"
+
+	"inet.af/netaddr"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/net/exitusage"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/ipproto"
+)
+
+func TestMergeExitUsage(t *testing.T) {
+	laptop := &tailcfg.Node{StableID: "laptop", ComputedName: "laptop"}
+	https := exitusage.Dest{Proto: ipproto.TCP, Port: 443}
+	dns := exitusage.Dest{Proto: ipproto.UDP, Port: 53}
+	usage := []exitusage.PeerUsage{
+		{
+			IP:     netaddr.MustParseIP("100.64.1.2"),
+			Counts: exitusage.Counts{TxPackets: 3, TxBytes: 300, RxPackets: 3, RxBytes: 900},
+			TopDests: []exitusage.DestUsage{
+				{Dest: https, Counts: exitusage.Counts{TxPackets: 2, TxBytes: 200, RxPackets: 2, RxBytes: 800}},
+				{Dest: dns, Counts: exitusage.Counts{TxPackets: 1, TxBytes: 100, RxPackets: 1, RxBytes: 100}},
+			},
+		},
+		{
+			IP:             netaddr.MustParseIP("100.64.9.9"),
+			Counts:         exitusage.Counts{TxPackets: 1, TxBytes: 1000},
+			BlockedPackets: 4,
+			TopDests: []exitusage.DestUsage{
+				{Dest: dns, Counts: exitusage.Counts{TxPackets: 1, TxBytes: 1000}},
+			},
+		},
+		{
+			IP:             netaddr.MustParseIP("fd7a:115c:a1e0::1"),
+			Counts:         exitusage.Counts{TxPackets: 1, TxBytes: 500},
+			BlockedPackets: 1,
+			TopDests: []exitusage.DestUsage{
+				{Dest: dns, Counts: exitusage.Counts{TxPackets: 1, TxBytes: 500}},
+			},
+		},
+	}
+	got := mergeExitUsage(usage, []*tailcfg.Node{laptop, nil, laptop})
+	want := []apitype.ExitNodeUsage{
+		{
+			NodeID:         "laptop",
+			Name:           "laptop",
+			IPs:            []string{"100.64.1.2", "fd7a:115c:a1e0::1"},
+			ExitNodeCounts: apitype.ExitNodeCounts{TxPackets: 4, TxBytes: 800, RxPackets: 3, RxBytes: 900},
+			BlockedPackets: 1,
+			TopDestinations: []apitype.ExitNodeDestUsage{
+				{Proto: "TCP", Port: 443, ExitNodeCounts: apitype.ExitNodeCounts{TxPackets: 2, TxBytes: 200, RxPackets: 2, RxBytes: 800}},
+				{Proto: "UDP", Port: 53, ExitNodeCounts: apitype.ExitNodeCounts{TxPackets: 2, TxBytes: 600, RxPackets: 1, RxBytes: 100}},
+			},
+		},
+		{
+			IPs:            []string{"100.64.9.9"},
+			ExitNodeCounts: apitype.ExitNodeCounts{TxPackets: 1, TxBytes: 1000},
+			BlockedPackets: 4,
+			TopDestinations: []apitype.ExitNodeDestUsage{
+				{Proto: "UDP", Port: 53, ExitNodeCounts: apitype.ExitNodeCounts{TxPackets: 1, TxBytes: 1000}},
+			},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("mergeExitUsage:\n got %+v\nwant %+v", got, want)
+	}
+}
@@ -160,6 +160,9 @@ type LocalBackend struct {
 
 	filterAtomic            atomic.Value // of *filter.Filter
 	containsViaIPFuncAtomic atomic.Value // of func(netaddr.IP) bool
+	// containsNAT64IPFuncAtomic reports whether an IP is in the NAT64
+	// routes this node advertises.
+	containsNAT64IPFuncAtomic atomic.Value // of func(netaddr.IP) bool
 
 	broker      *Broker // sse
 	messageChan chan []byte
@@ -214,6 +217,21 @@ type LocalBackend struct {
 	directFileRoot          string
 	directFileDoFinalRename bool // false on macOS, true on several NAS platforms
 
+	// usingCachedNetmap is whether netMap was loaded from the
+	// state store at Start rather than received from control.
+	usingCachedNetmap bool
+	cachedNetmapTimer *time.Timer // or nil; fires when the cached netmap expires
+	netmapCache       netmapCacheWriter
+
+	subnetHA         subnetHA           // health of subnet routers sharing routes
+	stopSubnetHALoop context.CancelFunc // or nil if subnetHALoop isn't running
+
+	appc appConnectorRoutes // routes learned for the domains of app connectors
+
+	// exitNodeLocalRoutes are the local routes kept off the exit node
+	// in the last router config.
+	exitNodeLocalRoutes []netaddr.IPPrefix
+
 	// statusLock must be held before calling statusChanged.Wait() or
 	// statusChanged.Broadcast().
 	statusLock    sync.Mutex
@@ -289,6 +307,11 @@ func NewLocalBackend(logf logger.Logf, logid string, store ipn.StateStore, diale
 	if !wiredPeerAPIPort {
 		b.logf("[unexpected] failed to wire up peer API port for engine %T", e)
 	}
+	if re, ok := e.(wgengine.ResolvingEngine); ok {
+		if r, ok := re.GetResolver(); ok {
+			r.SetAnswerObserver(b.observeDNSAnswer)
+		}
+	}
 
 	return b, nil
 }
@@ -394,9 +417,15 @@ func (b *LocalBackend) Shutdown() {
 		b.sshServer.Shutdown()
 		b.sshServer = nil
 	}
+	if b.cachedNetmapTimer != nil {
+		b.cachedNetmapTimer.Stop()
+		b.cachedNetmapTimer = nil
+	}
+	b.stopAppConnectorTimerLocked()
 	b.closePeerAPIListenersLocked()
 	b.mu.Unlock()
 
+	b.flushNetmapCache() // don't lose a rate-limited write
 	b.unregisterLinkMon()
 	b.unregisterHealthWatch()
 	if cc != nil {
@@ -483,9 +512,11 @@ func (b *LocalBackend) updateStatus(sb *ipnstate.StatusBuilder, extraLocked func
 						online = *exitPeer.Online
 					}
 					s.ExitNodeStatus = &ipnstate.ExitNodeStatus{
-						ID:           b.prefs.ExitNodeID,
-						Online:       online,
-						TailscaleIPs: exitPeer.Addresses,
+						ID:             b.prefs.ExitNodeID,
+						Online:         online,
+						TailscaleIPs:   exitPeer.Addresses,
+						AllowLANAccess: b.prefs.ExitNodeAllowLANAccess,
+						LocalRoutes:    append([]netaddr.IPPrefix(nil), b.exitNodeLocalRoutes...),
 					}
 				}
 
@@ -528,6 +559,7 @@ func (b *LocalBackend) populatePeerStatusLocked(sb *ipnstate.StatusBuilder) {
 	for id, up := range b.netMap.UserProfiles {
 		sb.AddUser(id, up)
 	}
+	haCands := b.subnetRouterCandidatesLocked()
 	for _, p := range b.netMap.Peers {
 		var lastSeen time.Time
 		if p.LastSeen != nil {
@@ -573,6 +605,9 @@ func (b *LocalBackend) populatePeerStatusLocked(sb *ipnstate.StatusBuilder) {
 			ExitNodeOption: exitNodeOption,
 			SSH_HostKeys:   p.Hostinfo.SSH_HostKeys().AsSlice(),
 		}
+		if len(haCands) > 0 {
+			peer.StandbyRoutes, peer.FailoverRoutes, peer.SubnetRouterUnhealthy = b.subnetHAStatusLocked(haCands, p)
+		}
 
 		sb.AddPeer(p.Key, peer)
 
@@ -709,6 +744,7 @@ func (b *LocalBackend) setClientStatus(st controlclient.Status) {
 		// Since st.NetMap==nil means "netmap is unchanged", there is
 		// no other way to represent this change.
 		b.setNetMapLocked(nil)
+		b.noteFreshNetmapLocked()
 		b.e.SetNetworkMap(new(netmap.NetworkMap))
 	}
 
@@ -716,6 +752,7 @@ func (b *LocalBackend) setClientStatus(st controlclient.Status) {
 	stateKey := b.stateKey
 	netMap := b.netMap
 	interact := b.interact
+	machinePrivKey := b.machinePrivKey
 
 	if prefs.ControlURL == "" {
 		// Once we get a message from the control plane, set
@@ -737,6 +774,7 @@ func (b *LocalBackend) setClientStatus(st controlclient.Status) {
 			prefsChanged = true
 		}
 		b.setNetMapLocked(st.NetMap)
+		b.noteFreshNetmapLocked()
 	}
 	if st.URL != "" {
 		b.authURL = st.URL
@@ -770,7 +808,11 @@ func (b *LocalBackend) setClientStatus(st controlclient.Status) {
 		}
 		b.send(ipn.Notify{Prefs: prefs})
 	}
+	if st.LogoutFinished != nil {
+		b.clearNetmapCache(stateKey)
+	}
 	if st.NetMap != nil {
+		b.writeNetmapCache(stateKey, machinePrivKey, st.NetMap)
 		if netMap != nil {
 			diff := st.NetMap.ConciseDiffFrom(netMap)
 			if strings.TrimSpace(diff) == "" {
@@ -1063,10 +1105,27 @@ func (b *LocalBackend) Start(opts ipn.Options) error {
 	b.applyPrefsToHostinfo(hostinfo, b.prefs)
 
 	b.setNetMapLocked(nil)
+	b.noteFreshNetmapLocked()
 	persistv := b.prefs.Persist
 	b.updateFilterLocked(nil, nil)
+
+	// If enabled, start with the last netmap we got from control so
+	// the node can reach its peers even if control is unreachable.
+	// controlclient replaces it as soon as it gets a fresh one.
+	var cachedNM *netmap.NetworkMap
+	if wantRunning && !loggedOut {
+		if c := b.loadCachedNetmapLocked(); c != nil {
+			b.useCachedNetmapLocked(c)
+			cachedNM = c.NetMap
+		}
+	}
 	b.mu.Unlock()
 
+	if cachedNM != nil {
+		b.e.SetNetworkMap(cachedNM)
+		b.e.SetDERPMap(cachedNM.DERPMap)
+	}
+
 	if b.portpoll != nil {
 		b.portpollOnce.Do(func() {
 			go b.portpoll.Run(b.ctx)
@@ -1155,6 +1214,9 @@ func (b *LocalBackend) Start(opts ipn.Options) error {
 	b.logf("Backend: logs: be:%v fe:%v", blid, opts.FrontendLogID)
 	b.send(ipn.Notify{BackendLogID: &blid})
 	b.send(ipn.Notify{Prefs: prefs})
+	if cachedNM != nil {
+		b.send(ipn.Notify{NetMap: cachedNM})
+	}
 
 	if !loggedOut && b.hasNodeKey() {
 		// Even if !WantRunning, we should verify our key, if there
@@ -1224,6 +1286,12 @@ func (b *LocalBackend) updateFilterLocked(netMap *netmap.NetworkMap, prefs *ipn.
 			}
 		}
 	}
+	for _, r := range b.appConnectorSelfRoutesLocked(prefs) {
+		localNetsB.AddPrefix(r)
+	}
+	for _, r := range nat64Routes(prefs) {
+		localNetsB.AddPrefix(r)
+	}
 	localNets, _ := localNetsB.IPSet()
 	logNets, _ := logNetsB.IPSet()
 	var sshPol tailcfg.SSHPolicy
@@ -1731,8 +1799,8 @@ func (b *LocalBackend) loadStateLocked(key ipn.StateKey, prefs *ipn.Prefs) (err
 	return nil
 }
 
-// setAtomicValuesFromPrefs populates sshAtomicBool and containsViaIPFuncAtomic
-// from the prefs p, which may be nil.
+// setAtomicValuesFromPrefs populates sshAtomicBool, containsViaIPFuncAtomic
+// and containsNAT64IPFuncAtomic from the prefs p, which may be nil.
 func (b *LocalBackend) setAtomicValuesFromPrefs(p *ipn.Prefs) {
 	b.sshAtomicBool.Set(p != nil && p.RunSSH && canSSH)
 
@@ -1741,6 +1809,7 @@ func (b *LocalBackend) setAtomicValuesFromPrefs(p *ipn.Prefs) {
 	} else {
 		b.containsViaIPFuncAtomic.Store(tsaddr.NewContainsIPFunc(tsaddr.FilterPrefixesCopy(p.AdvertiseRoutes, tsaddr.IsViaPrefix)))
 	}
+	b.containsNAT64IPFuncAtomic.Store(tsaddr.NewContainsIPFunc(nat64Routes(p)))
 }
 
 // State returns the backend state machine's current state.
@@ -2247,6 +2316,10 @@ func (b *LocalBackend) authReconfig() {
 	nm := b.netMap
 	hasPAC := b.prevIfState.HasPAC()
 	disableSubnetsIfPAC := nm != nil && nm.Debug != nil && nm.Debug.DisableSubnetsIfPAC.EqualBool(true)
+	b.updateSubnetHALoopLocked()
+	subnetRouters := b.subnetHA.active
+	appcSelf := b.appConnectorSelfRoutesLocked(prefs)
+	appcPeers := b.appConnectorPeerRoutesLocked(prefs)
 	b.mu.Unlock()
 
 	if blocked {
@@ -2284,15 +2357,23 @@ func (b *LocalBackend) authReconfig() {
 	} else {
 		b.dialer.SetExitDNSDoH("")
 	}
+	b.dialer.SetDialPolicy(prefs.DialPolicy)
 
-	cfg, err := nmcfg.WGCfg(nm, b.logf, flags, prefs.ExitNodeID)
+	cfg, err := nmcfg.WGCfg(nm, b.logf, flags, prefs.ExitNodeID, subnetRouters)
 	if err != nil {
 		b.logf("wgcfg: %v", err)
 		return
 	}
+	addAppConnectorRoutes(cfg, appcPeers)
 
 	oneCGNATRoute := shouldUseOneCGNATRoute(nm, b.logf, version.OS())
 	rcfg := b.routerConfig(cfg, prefs, oneCGNATRoute)
+	rcfg.SubnetRoutes = append(rcfg.SubnetRoutes, appcSelf...)
+	b.dialer.SetLocalRoutes(rcfg.LocalRoutes)
+	b.setExitUsageConfig(prefs, rcfg.SubnetRoutes, nm)
+	b.mu.Lock()
+	b.exitNodeLocalRoutes = rcfg.LocalRoutes
+	b.mu.Unlock()
 	dcfg := dnsConfigForNetmap(nm, prefs, b.logf, version.OS())
 
 	err = b.e.Reconfig(cfg, rcfg, dcfg, nm.Debug)
@@ -2436,6 +2517,26 @@ func dnsConfigForNetmap(nm *netmap.NetworkMap, prefs *ipn.Prefs, logf logger.Log
 		}
 	}
 
+	// Resolve the domains of app connectors via the connectors, so
+	// the IPs they answer with get routed through them. Routes from
+	// the control plane, added below, take precedence.
+	for _, p := range appConnectorPeers(nm, prefs) {
+		dohURL, _ := peerDoHURL(nm, p.node)
+		for _, d := range p.domains {
+			fqdn, err := dnsname.ToFQDN(d)
+			if err != nil {
+				continue
+			}
+			dcfg.Routes[fqdn] = append(dcfg.Routes[fqdn], &dnstype.Resolver{Addr: dohURL})
+		}
+	}
+
+	// Synthesize AAAA records for the subnets that peers route via
+	// NAT64, if we accept their routes.
+	if prefs.DNS64 && prefs.RouteAll {
+		dcfg.DNS64Routes = peerNAT64Routes(nm)
+	}
+
 	// If we're using an exit node and that exit node is new enough (1.19.x+)
 	// to run a DoH DNS proxy, then send all our DNS traffic through it.
 	if dohURL, ok := exitNodeCanProxyDNS(nm, prefs.ExitNodeID); ok {
@@ -2775,19 +2876,12 @@ func (b *LocalBackend) routerConfig(cfg *wgcfg.Config, prefs *ipn.Prefs, oneCGNA
 		if err != nil {
 			b.logf("failed to discover interface ips: %v", err)
 		}
-		if runtime.GOOS == "linux" || runtime.GOOS == "darwin" || runtime.GOOS == "windows" {
-			rs.LocalRoutes = internalIPs // unconditionally allow access to guest VM networks
-			if prefs.ExitNodeAllowLANAccess {
-				rs.LocalRoutes = append(rs.LocalRoutes, externalIPs...)
-				if len(externalIPs) != 0 {
-					b.logf("allowing exit node access to internal IPs: %v", internalIPs)
-				}
-			} else {
-				// Explicitly add routes to the local network so that we do not
-				// leak any traffic.
-				rs.Routes = append(rs.Routes, externalIPs...)
-			}
+		if prefs.ExitNodeAllowLANAccess && len(externalIPs) != 0 {
+			b.logf("allowing exit node access to local IPs: %v", externalIPs)
 		}
+		routes, localRoutes := exitNodeLANRoutes(prefs, internalIPs, externalIPs, runtime.GOOS, wgengine.IsNetstackRouter(b.e))
+		rs.Routes = append(rs.Routes, routes...)
+		rs.LocalRoutes = localRoutes
 	}
 
 	if tsaddr.PrefixesContainsFunc(rs.LocalAddrs, tsaddr.PrefixIs4) {
@@ -2797,6 +2891,53 @@ func (b *LocalBackend) routerConfig(cfg *wgcfg.Config, prefs *ipn.Prefs, oneCGNA
 	return rs
 }
 
+// exitNodeLANRoutes returns the routes to add into Tailscale and the
+// local routes to keep off of it when an exit node is in use, given the
+// internal and external interface routes (see
+// internalAndExternalInterfaces).
+//
+// Local routes are only supported by the routers of some OSes, and by
+// netstack (see tsdial.Dialer.SetLocalRoutes).
+func exitNodeLANRoutes(prefs *ipn.Prefs, internal, external []netaddr.IPPrefix, goos string, isNetstack bool) (routes, localRoutes []netaddr.IPPrefix) {
+	if goos != "linux" && goos != "darwin" && goos != "windows" && !isNetstack {
+		return nil, nil
+	}
+	var lanRoutes []netaddr.IPPrefix
+	for _, r := range unmapIPPrefixes(prefs.ExitNodeLANRoutes) {
+		if r.IsValid() && r.Bits() != 0 { // never the exit node's default routes
+			lanRoutes = append(lanRoutes, r.Masked())
+		}
+	}
+	localRoutes = append(localRoutes, internal...) // unconditionally allow access to guest VM networks
+	if prefs.ExitNodeAllowLANAccess {
+		localRoutes = append(localRoutes, external...)
+	} else {
+		// Explicitly add routes to the local network so that we do not
+		// leak any traffic, except to the parts of it that are allowed.
+		for _, r := range external {
+			if !prefixesCover(lanRoutes, r) {
+				routes = append(routes, r)
+			}
+		}
+	}
+	for _, r := range lanRoutes {
+		if !prefixesCover(localRoutes, r) {
+			localRoutes = append(localRoutes, r)
+		}
+	}
+	return routes, localRoutes
+}
+
+// prefixesCover reports whether any of pp contains all of p.
+func prefixesCover(pp []netaddr.IPPrefix, p netaddr.IPPrefix) bool {
+	for _, q := range pp {
+		if q.Bits() <= p.Bits() && q.Contains(p.IP()) {
+			return true
+		}
+	}
+	return false
+}
+
 func unmapIPPrefix(ipp netaddr.IPPrefix) netaddr.IPPrefix {
 	return netaddr.IPPrefixFrom(ipp.IP().Unmap(), ipp.Bits())
 }
@@ -2816,6 +2957,9 @@ func (b *LocalBackend) applyPrefsToHostinfo(hi *tailcfg.Hostinfo, prefs *ipn.Pre
 		hi.Hostname = h
 	}
 	hi.RoutableIPs = append(prefs.AdvertiseRoutes[:0:0], prefs.AdvertiseRoutes...)
+	hi.RoutableIPs = append(hi.RoutableIPs, b.appConnectorSelfRoutesLocked(prefs)...)
+	hi.RoutableIPs = append(hi.RoutableIPs, nat64Routes(prefs)...)
+	hi.AppConnector = append(prefs.AdvertiseConnectorDomains[:0:0], prefs.AdvertiseConnectorDomains...)
 	hi.RequestTags = append(prefs.AdvertiseTags[:0:0], prefs.AdvertiseTags...)
 	hi.ShieldsUp = prefs.ShieldsUp
 
@@ -3490,15 +3634,21 @@ func exitNodeCanProxyDNS(nm *netmap.NetworkMap, exitNodeID tailcfg.StableNodeID)
 		return "", false
 	}
 	for _, p := range nm.Peers {
-		if p.StableID != exitNodeID {
-			continue
+		if p.StableID == exitNodeID {
+			return peerDoHURL(nm, p)
 		}
-		services := p.Hostinfo.Services()
-		for i, n := 0, services.Len(); i < n; i++ {
-			s := services.At(i)
-			if s.Proto == tailcfg.PeerAPIDNS && s.Port >= 1 {
-				return peerAPIBase(nm, p) + "/dns-query", true
-			}
+	}
+	return "", false
+}
+
+// peerDoHURL returns the DoH base URL ("http://foo/dns-query") of the
+// peer's peerapi DNS service, if it runs one.
+func peerDoHURL(nm *netmap.NetworkMap, p *tailcfg.Node) (dohURL string, ok bool) {
+	services := p.Hostinfo.Services()
+	for i, n := 0, services.Len(); i < n; i++ {
+		s := services.At(i)
+		if s.Proto == tailcfg.PeerAPIDNS && s.Port >= 1 {
+			return peerAPIBase(nm, p) + "/dns-query", true
 		}
 	}
 	return "", false
@@ -9,6 +9,7 @@
 	"net"
 	"net/http"
 	"reflect"
+	"runtime"
 	"testing"
 	"time"
 
@@ -637,3 +638,129 @@ type interfacePrefix struct {
 		})
 	}
 }
+
+func TestExitNodeLANRoutes(t *testing.T) {
+	pfxs := func(ss ...string) (ret []netaddr.IPPrefix) {
+		for _, s := range ss {
+			ret = append(ret, netaddr.MustParseIPPrefix(s))
+		}
+		return ret
+	}
+	internal := pfxs("127.0.0.0/8", "192.168.122.0/24")
+	external := pfxs("192.168.1.0/24", "10.20.0.0/16")
+
+	tests := []struct {
+		name      string
+		goos      string
+		netstack  bool
+		prefs     ipn.Prefs
+		wantRoute []netaddr.IPPrefix
+		wantLocal []netaddr.IPPrefix
+	}{
+		{
+			name:      "linux_no_lan_access",
+			goos:      "linux",
+			wantRoute: external,
+			wantLocal: internal,
+		},
+		{
+			name:      "linux_lan_access",
+			goos:      "linux",
+			prefs:     ipn.Prefs{ExitNodeAllowLANAccess: true},
+			wantLocal: pfxs("127.0.0.0/8", "192.168.122.0/24", "192.168.1.0/24", "10.20.0.0/16"),
+		},
+		{
+			name: "linux_lan_routes",
+			goos: "linux",
+			prefs: ipn.Prefs{ExitNodeLANRoutes: pfxs(
+				"192.168.1.0/24", // covers an interface's whole network
+				"10.20.5.0/24",   // part of an interface's network
+				"10.8.0.0/16",    // another VPN
+				"0.0.0.0/0",      // ignored
+			)},
+			wantRoute: pfxs("10.20.0.0/16"),
+			wantLocal: pfxs("127.0.0.0/8", "192.168.122.0/24", "192.168.1.0/24", "10.20.5.0/24", "10.8.0.0/16"),
+		},
+		{
+			name: "linux_lan_access_and_routes",
+			goos: "linux",
+			prefs: ipn.Prefs{
+				ExitNodeAllowLANAccess: true,
+				ExitNodeLANRoutes:      pfxs("192.168.1.128/25", "10.8.0.0/16", "172.16.0.0/12"),
+			},
+			wantLocal: pfxs("127.0.0.0/8", "192.168.122.0/24", "192.168.1.0/24", "10.20.0.0/16", "10.8.0.0/16", "172.16.0.0/12"),
+		},
+		{
+			name:  "freebsd_unsupported",
+			goos:  "freebsd",
+			prefs: ipn.Prefs{ExitNodeLANRoutes: pfxs("10.8.0.0/16")},
+		},
+		{
+			name:      "freebsd_userspace",
+			goos:      "freebsd",
+			netstack:  true,
+			prefs:     ipn.Prefs{ExitNodeLANRoutes: pfxs("10.8.0.0/16")},
+			wantRoute: external,
+			wantLocal: pfxs("127.0.0.0/8", "192.168.122.0/24", "10.8.0.0/16"),
+		},
+		{
+			name:      "linux_userspace",
+			goos:      "linux",
+			netstack:  true,
+			prefs:     ipn.Prefs{ExitNodeLANRoutes: pfxs("192.168.1.0/24")},
+			wantRoute: pfxs("10.20.0.0/16"),
+			wantLocal: pfxs("127.0.0.0/8", "192.168.122.0/24", "192.168.1.0/24"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			routes, local := exitNodeLANRoutes(&tt.prefs, internal, external, tt.goos, tt.netstack)
+			if !reflect.DeepEqual(routes, tt.wantRoute) {
+				t.Errorf("routes = %v; want %v", routes, tt.wantRoute)
+			}
+			if !reflect.DeepEqual(local, tt.wantLocal) {
+				t.Errorf("local routes = %v; want %v", local, tt.wantLocal)
+			}
+		})
+	}
+}
+
+func TestRouterConfigExitNodeLANRoutes(t *testing.T) {
+	switch runtime.GOOS {
+	case "linux", "darwin", "windows":
+	default:
+		t.Skipf("local routes not supported on %v", runtime.GOOS)
+	}
+	eng, err := wgengine.NewFakeUserspaceEngine(logger.Discard, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(eng.Close)
+	b, err := NewLocalBackend(logger.Discard, "logid", new(mem.Store), nil, eng, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lanRoute := netaddr.MustParseIPPrefix("198.18.0.0/15")
+	cfg := &wgcfg.Config{
+		Addresses: []netaddr.IPPrefix{netaddr.MustParseIPPrefix("100.101.102.103/32")},
+	}
+	rcfg := b.routerConfig(cfg, &ipn.Prefs{
+		ExitNodeID:        "exit",
+		ExitNodeLANRoutes: []netaddr.IPPrefix{lanRoute},
+	}, false)
+	for _, want := range []netaddr.IPPrefix{ipv4Default, ipv6Default} {
+		if !containsPrefix(rcfg.Routes, want) {
+			t.Errorf("routes %v lack %v", rcfg.Routes, want)
+		}
+	}
+	if !containsPrefix(rcfg.LocalRoutes, lanRoute) {
+		t.Errorf("local routes %v lack %v", rcfg.LocalRoutes, lanRoute)
+	}
+
+	// Without an exit node, there are no local routes.
+	rcfg = b.routerConfig(cfg, &ipn.Prefs{ExitNodeLANRoutes: []netaddr.IPPrefix{lanRoute}}, false)
+	if len(rcfg.LocalRoutes) != 0 {
+		t.Errorf("local routes without exit node: %v", rcfg.LocalRoutes)
+	}
+}
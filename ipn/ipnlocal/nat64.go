@@ -0,0 +1,54 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"inet.af/netaddr"
+	"tailscale.com/ipn"
+	"tailscale.com/net/tsaddr"
+	"tailscale.com/types/netmap"
+)
+
+// nat64Routes returns the routes in the Tailscale NAT64 range of the
+// IPv4 subnet routes that prefs advertises, if it advertises NAT64.
+func nat64Routes(prefs *ipn.Prefs) []netaddr.IPPrefix {
+	if prefs == nil || !prefs.AdvertiseNAT64 {
+		return nil
+	}
+	var ret []netaddr.IPPrefix
+	for _, r := range prefs.AdvertiseRoutes {
+		if !r.IP().Is4() || r.Bits() == 0 {
+			continue
+		}
+		if p, err := tsaddr.MapNAT64Prefix(r); err == nil {
+			ret = append(ret, p)
+		}
+	}
+	return ret
+}
+
+// peerNAT64Routes returns the IPv4 prefixes that peers in nm route via
+// NAT64.
+func peerNAT64Routes(nm *netmap.NetworkMap) []netaddr.IPPrefix {
+	var ret []netaddr.IPPrefix
+	for _, p := range nm.Peers {
+		for _, r := range p.AllowedIPs {
+			if v4, ok := tsaddr.UnmapNAT64Prefix(r); ok {
+				ret = append(ret, v4)
+			}
+		}
+	}
+	return ret
+}
+
+// ShouldHandleNAT64IP reports whether ip is an IPv6 address in the
+// Tailscale NAT64 range embedding an IPv4 address in a subnet that
+// this node translates to.
+func (b *LocalBackend) ShouldHandleNAT64IP(ip netaddr.IP) bool {
+	if f, ok := b.containsNAT64IPFuncAtomic.Load().(func(netaddr.IP) bool); ok {
+		return f(ip)
+	}
+	return false
+}
@@ -0,0 +1,49 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"reflect"
+	"testing"
+
+	"inet.af/netaddr"
+	"tailscale.com/ipn"
+)
+
+func TestNAT64Routes(t *testing.T) {
+	routes := ipps("192.168.1.0/24", "10.0.0.0/8", "fd00::/64", "0.0.0.0/0", "::/0")
+	tests := []struct {
+		name  string
+		prefs *ipn.Prefs
+		want  []netaddr.IPPrefix
+	}{
+		{"nil", nil, nil},
+		{"not_nat64", &ipn.Prefs{AdvertiseRoutes: routes}, nil},
+		{
+			name:  "nat64",
+			prefs: &ipn.Prefs{AdvertiseRoutes: routes, AdvertiseNAT64: true},
+			want:  ipps("fd7a:115c:a1e0:64::c0a8:100/120", "fd7a:115c:a1e0:64::a00:0/104"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := nat64Routes(tt.prefs); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("nat64Routes = %v; want %v", got, tt.want)
+			}
+		})
+	}
+
+	var b LocalBackend
+	b.setAtomicValuesFromPrefs(&ipn.Prefs{AdvertiseRoutes: routes, AdvertiseNAT64: true})
+	for ip, want := range map[string]bool{
+		"fd7a:115c:a1e0:64::c0a8:105":  true,  // 192.168.1.5
+		"fd7a:115c:a1e0:64::ac10:1":    false, // 172.16.0.1
+		"fd7a:115c:a1e0:b1a::c0a8:105": false,
+	} {
+		if got := b.ShouldHandleNAT64IP(netaddr.MustParseIP(ip)); got != want {
+			t.Errorf("ShouldHandleNAT64IP(%v) = %v; want %v", ip, got, want)
+		}
+	}
+}
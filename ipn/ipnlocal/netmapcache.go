@@ -0,0 +1,323 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"tailscale.com/envknob"
+	"tailscale.com/health"
+	"tailscale.com/ipn"
+	"tailscale.com/net/dns"
+	"tailscale.com/types/key"
+	"tailscale.com/types/netmap"
+	"tailscale.com/util/deephash"
+	"tailscale.com/wgengine/router"
+	"tailscale.com/wgengine/wgcfg"
+)
+
+// useCachedNetmap is whether LocalBackend persists the last netmap
+// received from control and, at Start, brings the engine up with it
+// while controlclient is still trying to reach the control plane.
+var useCachedNetmap = envknob.Bool("TS_USE_CACHED_NETMAP")
+
+// cachedNetmapMaxAge bounds how old a cached netmap may be (measured
+// from when it was received from control) and still be used.
+var cachedNetmapMaxAge = cachedNetmapMaxAgeFromEnv()
+
+const defaultCachedNetmapMaxAge = 72 * time.Hour
+
+func cachedNetmapMaxAgeFromEnv() time.Duration {
+	v := envknob.String("TS_CACHED_NETMAP_MAX_AGE")
+	if v == "" {
+		return defaultCachedNetmapMaxAge
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return defaultCachedNetmapMaxAge
+	}
+	return d
+}
+
+// netmapCacheWriteInterval is the minimum time between writes of the
+// netmap cache. Netmaps that arrive sooner are written when it has
+// passed, the latest one only.
+var netmapCacheWriteInterval = time.Minute
+
+// netmapCacheRefreshInterval is how often the netmap cache is
+// rewritten even if the netmap hasn't changed, so that its age,
+// bounded by cachedNetmapMaxAge, stays that of a recent netmap.
+const netmapCacheRefreshInterval = time.Hour
+
+// netmapCacheWriter rate-limits the writes of the netmap cache and
+// skips those that wouldn't change it.
+type netmapCacheWriter struct {
+	mu       sync.Mutex
+	stateKey ipn.StateKey // of the last write
+	sum      deephash.Sum // of the netmap of the last write
+	written  time.Time    // of the last write; zero if none
+	timer    *time.Timer  // or nil; fires to write pending
+	pending  *pendingNetmapCache
+}
+
+type pendingNetmapCache struct {
+	stateKey ipn.StateKey
+	mk       key.MachinePrivate
+	nm       *netmap.NetworkMap
+	sum      deephash.Sum
+}
+
+// netmapCacheVersion is the version of the cachedNetmap encoding.
+// Caches of any other version are ignored.
+const netmapCacheVersion = 1
+
+// cachedNetmap is the value stored (sealed) in the state store.
+type cachedNetmap struct {
+	Version int
+	Saved   time.Time // when the netmap was received from control
+	NetMap  *netmap.NetworkMap
+}
+
+// netmapCacheStateKey returns the ipn.StateKey under which the
+// netmap for the prefs stored under k is cached.
+func netmapCacheStateKey(k ipn.StateKey) ipn.StateKey {
+	return "_netmap-" + k
+}
+
+// sealNetmapCache encodes nm and seals it to the machine key, so that
+// a cache that was corrupted or written by anything other than this
+// machine fails to open.
+func sealNetmapCache(mk key.MachinePrivate, nm *netmap.NetworkMap, now time.Time) ([]byte, error) {
+	js, err := json.Marshal(cachedNetmap{
+		Version: netmapCacheVersion,
+		Saved:   now.UTC(),
+		NetMap:  nm,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return mk.SealTo(mk.Public(), js), nil
+}
+
+// openNetmapCache is the inverse of sealNetmapCache.
+func openNetmapCache(mk key.MachinePrivate, sealed []byte) (*cachedNetmap, error) {
+	js, ok := mk.OpenFrom(mk.Public(), sealed)
+	if !ok {
+		return nil, errors.New("integrity check failed")
+	}
+	c := new(cachedNetmap)
+	if err := json.Unmarshal(js, c); err != nil {
+		return nil, err
+	}
+	if c.Version != netmapCacheVersion {
+		return nil, fmt.Errorf("unsupported version %d", c.Version)
+	}
+	if c.NetMap == nil {
+		return nil, errors.New("no netmap")
+	}
+	return c, nil
+}
+
+// validate reports whether c can still be used at time now by the
+// node whose current node key is nodeKey.
+func (c *cachedNetmap) validate(nodeKey key.NodePublic, now time.Time, maxAge time.Duration) error {
+	nm := c.NetMap
+	if nodeKey.IsZero() || nm.NodeKey != nodeKey {
+		return errors.New("node key changed")
+	}
+	if !nm.Expiry.IsZero() && nm.Expiry.Before(now) {
+		return fmt.Errorf("node key expired at %v", nm.Expiry.Format(time.RFC3339))
+	}
+	if age := now.Sub(c.Saved); age > maxAge {
+		return fmt.Errorf("too old (%v > %v)", age.Round(time.Second), maxAge)
+	}
+	return nil
+}
+
+// expiresAt returns the time after which c must no longer be used.
+func (c *cachedNetmap) expiresAt(maxAge time.Duration) time.Time {
+	t := c.Saved.Add(maxAge)
+	if exp := c.NetMap.Expiry; !exp.IsZero() && exp.Before(t) {
+		t = exp
+	}
+	return t
+}
+
+// loadCachedNetmapLocked returns the cached netmap for the current
+// state key, or nil if there's none or it can't be used.
+//
+// b.mu must be held.
+func (b *LocalBackend) loadCachedNetmapLocked() *cachedNetmap {
+	if !useCachedNetmap || b.stateKey == "" || b.machinePrivKey.IsZero() {
+		return nil
+	}
+	if b.prefs == nil || b.prefs.Persist == nil {
+		return nil
+	}
+	k := netmapCacheStateKey(b.stateKey)
+	sealed, err := b.store.ReadState(k)
+	if err != nil || len(sealed) == 0 {
+		if err != nil && err != ipn.ErrStateNotExist {
+			b.logf("netmap cache: %v", err)
+		}
+		return nil
+	}
+	c, err := openNetmapCache(b.machinePrivKey, sealed)
+	if err != nil {
+		b.logf("netmap cache: ignoring %q: %v", k, err)
+		return nil
+	}
+	if err := c.validate(b.prefs.Persist.PrivateNodeKey.Public(), time.Now(), cachedNetmapMaxAge); err != nil {
+		b.logf("netmap cache: ignoring %q: %v", k, err)
+		return nil
+	}
+	return c
+}
+
+// useCachedNetmapLocked installs the netmap from c as the current
+// netmap until a fresh one arrives from control or c expires.
+//
+// b.mu must be held.
+func (b *LocalBackend) useCachedNetmapLocked(c *cachedNetmap) {
+	b.logf("netmap cache: starting with netmap from %v", c.Saved.Format(time.RFC3339))
+	b.setNetMapLocked(c.NetMap)
+	b.updateFilterLocked(c.NetMap, b.prefs)
+	b.usingCachedNetmap = true
+
+	if b.cachedNetmapTimer != nil {
+		b.cachedNetmapTimer.Stop()
+	}
+	b.cachedNetmapTimer = time.AfterFunc(time.Until(c.expiresAt(cachedNetmapMaxAge)), b.expireCachedNetmap)
+	health.SetNetmapCacheHealth(fmt.Errorf("control plane unreachable; using cached netmap from %v", c.Saved.Format(time.RFC3339)))
+}
+
+// noteFreshNetmapLocked ends any use of a cached netmap, either
+// because a netmap was received from control or because the current
+// netmap was otherwise replaced.
+//
+// b.mu must be held.
+func (b *LocalBackend) noteFreshNetmapLocked() {
+	if b.cachedNetmapTimer != nil {
+		b.cachedNetmapTimer.Stop()
+		b.cachedNetmapTimer = nil
+	}
+	if b.usingCachedNetmap {
+		b.usingCachedNetmap = false
+		b.logf("netmap cache: no longer using cached netmap")
+		health.SetNetmapCacheHealth(nil)
+	}
+}
+
+// expireCachedNetmap drops the cached netmap once it's past its
+// expiry bound and control still hasn't sent a fresh one.
+func (b *LocalBackend) expireCachedNetmap() {
+	b.mu.Lock()
+	if !b.usingCachedNetmap {
+		b.mu.Unlock()
+		return
+	}
+	b.usingCachedNetmap = false
+	b.cachedNetmapTimer = nil
+	b.setNetMapLocked(nil)
+	b.updateFilterLocked(nil, b.prefs)
+	b.mu.Unlock()
+
+	b.logf("netmap cache: cached netmap expired")
+	health.SetNetmapCacheHealth(errors.New("control plane unreachable and cached netmap expired"))
+	b.e.SetNetworkMap(new(netmap.NetworkMap))
+	if err := b.e.Reconfig(&wgcfg.Config{}, &router.Config{}, &dns.Config{}, nil); err != nil {
+		b.logf("Reconfig(down): %v", err)
+	}
+	b.stateMachine()
+}
+
+// writeNetmapCache persists nm as the netmap to use at the next Start
+// for stateKey, if netmap caching is enabled.
+//
+// The write is skipped if the cache already holds nm and was written
+// within netmapCacheRefreshInterval, and delayed so that writes are at
+// least netmapCacheWriteInterval apart.
+//
+// b.mu must not be held.
+func (b *LocalBackend) writeNetmapCache(stateKey ipn.StateKey, mk key.MachinePrivate, nm *netmap.NetworkMap) {
+	if !useCachedNetmap || stateKey == "" || mk.IsZero() {
+		return
+	}
+	sum := deephash.Hash(nm)
+
+	w := &b.netmapCache
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	now := time.Now()
+	if stateKey == w.stateKey && sum == w.sum && now.Sub(w.written) < netmapCacheRefreshInterval {
+		w.pending = nil
+		return
+	}
+	w.pending = &pendingNetmapCache{stateKey, mk, nm, sum}
+	if wait := netmapCacheWriteInterval - now.Sub(w.written); wait > 0 {
+		if w.timer == nil {
+			w.timer = time.AfterFunc(wait, b.flushNetmapCache)
+		}
+		return
+	}
+	b.flushNetmapCacheLocked()
+}
+
+// flushNetmapCache writes the pending netmap cache, if any.
+func (b *LocalBackend) flushNetmapCache() {
+	b.netmapCache.mu.Lock()
+	defer b.netmapCache.mu.Unlock()
+	b.netmapCache.timer = nil
+	b.flushNetmapCacheLocked()
+}
+
+// flushNetmapCacheLocked writes the pending netmap cache, if any.
+//
+// b.netmapCache.mu must be held.
+func (b *LocalBackend) flushNetmapCacheLocked() {
+	w := &b.netmapCache
+	p := w.pending
+	if p == nil {
+		return
+	}
+	w.pending = nil
+	now := time.Now()
+	sealed, err := sealNetmapCache(p.mk, p.nm, now)
+	if err != nil {
+		b.logf("netmap cache: %v", err)
+		return
+	}
+	if err := b.store.WriteState(netmapCacheStateKey(p.stateKey), sealed); err != nil {
+		b.logf("netmap cache: %v", err)
+		return
+	}
+	w.stateKey, w.sum, w.written = p.stateKey, p.sum, now
+}
+
+// clearNetmapCache removes any cached netmap for stateKey, and drops
+// any pending write of it.
+//
+// b.mu must not be held.
+func (b *LocalBackend) clearNetmapCache(stateKey ipn.StateKey) {
+	if !useCachedNetmap || stateKey == "" {
+		return
+	}
+	w := &b.netmapCache
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+	w.pending = nil
+	w.stateKey, w.sum, w.written = "", deephash.Sum{}, time.Time{}
+	if err := b.store.WriteState(netmapCacheStateKey(stateKey), nil); err != nil {
+		b.logf("netmap cache: %v", err)
+	}
+}
@@ -0,0 +1,206 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/store/mem"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+	"tailscale.com/types/logger"
+	"tailscale.com/types/netmap"
+	"tailscale.com/types/persist"
+)
+
+func TestNetmapCacheRoundTrip(t *testing.T) {
+	mk := key.NewMachine()
+	nk := key.NewNode()
+	now := time.Date(2022, 8, 1, 0, 0, 0, 0, time.UTC)
+	nm := &netmap.NetworkMap{
+		NodeKey:    nk.Public(),
+		PrivateKey: nk,
+		Expiry:     now.Add(90 * 24 * time.Hour),
+		Addresses:  []netaddr.IPPrefix{netaddr.MustParseIPPrefix("100.64.1.1/32")},
+		Peers: []*tailcfg.Node{{
+			ID:        2,
+			Key:       key.NewNode().Public(),
+			Addresses: []netaddr.IPPrefix{netaddr.MustParseIPPrefix("100.64.1.2/32")},
+		}},
+	}
+
+	sealed, err := sealNetmapCache(mk, nm, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := openNetmapCache(mk, sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.Saved.Equal(now) {
+		t.Errorf("Saved = %v; want %v", c.Saved, now)
+	}
+	if got := c.NetMap.ConciseDiffFrom(nm); strings.TrimSpace(got) != "" {
+		t.Errorf("netmap changed in round trip:\n%s", got)
+	}
+	if !c.NetMap.PrivateKey.Equal(nk) {
+		t.Errorf("private key not preserved")
+	}
+
+	if _, err := openNetmapCache(key.NewMachine(), sealed); err == nil {
+		t.Errorf("opened cache sealed to a different machine key")
+	}
+	tampered := append([]byte(nil), sealed...)
+	tampered[len(tampered)-1] ^= 1
+	if _, err := openNetmapCache(mk, tampered); err == nil {
+		t.Errorf("opened tampered cache")
+	}
+}
+
+func TestNetmapCacheValidate(t *testing.T) {
+	nk := key.NewNode().Public()
+	saved := time.Date(2022, 8, 1, 0, 0, 0, 0, time.UTC)
+	const maxAge = 24 * time.Hour
+
+	tests := []struct {
+		name    string
+		nodeKey key.NodePublic
+		expiry  time.Time
+		now     time.Time
+		wantErr string
+	}{
+		{"ok", nk, time.Time{}, saved.Add(time.Hour), ""},
+		{"ok_before_expiry", nk, saved.Add(2 * time.Hour), saved.Add(time.Hour), ""},
+		{"other_node_key", key.NewNode().Public(), time.Time{}, saved.Add(time.Hour), "node key changed"},
+		{"zero_node_key", key.NodePublic{}, time.Time{}, saved.Add(time.Hour), "node key changed"},
+		{"key_expired", nk, saved.Add(time.Minute), saved.Add(time.Hour), "node key expired"},
+		{"too_old", nk, time.Time{}, saved.Add(maxAge + time.Second), "too old"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &cachedNetmap{
+				Version: netmapCacheVersion,
+				Saved:   saved,
+				NetMap:  &netmap.NetworkMap{NodeKey: nk, Expiry: tt.expiry},
+			}
+			err := c.validate(tt.nodeKey, tt.now, maxAge)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("error = %v; want containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNetmapCacheExpiresAt(t *testing.T) {
+	saved := time.Date(2022, 8, 1, 0, 0, 0, 0, time.UTC)
+	c := &cachedNetmap{Saved: saved, NetMap: &netmap.NetworkMap{}}
+	if got, want := c.expiresAt(time.Hour), saved.Add(time.Hour); !got.Equal(want) {
+		t.Errorf("no key expiry: got %v; want %v", got, want)
+	}
+	c.NetMap.Expiry = saved.Add(time.Minute)
+	if got, want := c.expiresAt(time.Hour), saved.Add(time.Minute); !got.Equal(want) {
+		t.Errorf("with key expiry: got %v; want %v", got, want)
+	}
+}
+
+func TestLoadCachedNetmap(t *testing.T) {
+	defer func(old bool) { useCachedNetmap = old }(useCachedNetmap)
+	useCachedNetmap = true
+
+	mk := key.NewMachine()
+	nk := key.NewNode()
+	store := new(mem.Store)
+	b := &LocalBackend{
+		logf:           logger.Discard,
+		store:          store,
+		stateKey:       ipn.GlobalDaemonStateKey,
+		machinePrivKey: mk,
+		prefs: &ipn.Prefs{
+			Persist: &persist.Persist{PrivateNodeKey: nk},
+		},
+	}
+	if c := b.loadCachedNetmapLocked(); c != nil {
+		t.Fatalf("got cached netmap from empty store")
+	}
+
+	b.writeNetmapCache(b.stateKey, mk, &netmap.NetworkMap{NodeKey: nk.Public()})
+	if c := b.loadCachedNetmapLocked(); c == nil {
+		t.Fatalf("didn't load written netmap")
+	}
+
+	b.clearNetmapCache(b.stateKey)
+	if c := b.loadCachedNetmapLocked(); c != nil {
+		t.Fatalf("loaded netmap after clear")
+	}
+
+	useCachedNetmap = false
+	b.writeNetmapCache(b.stateKey, mk, &netmap.NetworkMap{NodeKey: nk.Public()})
+	if bs, _ := store.ReadState(netmapCacheStateKey(b.stateKey)); len(bs) != 0 {
+		t.Fatalf("wrote netmap cache while disabled")
+	}
+}
+
+func TestWriteNetmapCacheRateLimit(t *testing.T) {
+	defer func(old bool) { useCachedNetmap = old }(useCachedNetmap)
+	useCachedNetmap = true
+	defer func(old time.Duration) { netmapCacheWriteInterval = old }(netmapCacheWriteInterval)
+	netmapCacheWriteInterval = time.Hour
+
+	mk := key.NewMachine()
+	nk := key.NewNode()
+	store := new(mem.Store)
+	b := &LocalBackend{
+		logf:  logger.Discard,
+		store: store,
+	}
+	k := netmapCacheStateKey(ipn.GlobalDaemonStateKey)
+	read := func() *netmap.NetworkMap {
+		t.Helper()
+		sealed, err := store.ReadState(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := openNetmapCache(mk, sealed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c.NetMap
+	}
+
+	nm1 := &netmap.NetworkMap{NodeKey: nk.Public(), Name: "one"}
+	b.writeNetmapCache(ipn.GlobalDaemonStateKey, mk, nm1)
+	sealed1, _ := store.ReadState(k)
+	if got := read().Name; got != "one" {
+		t.Fatalf("first write: got netmap %q", got)
+	}
+
+	// The same netmap again isn't written.
+	b.writeNetmapCache(ipn.GlobalDaemonStateKey, mk, &netmap.NetworkMap{NodeKey: nk.Public(), Name: "one"})
+	if sealed, _ := store.ReadState(k); string(sealed) != string(sealed1) {
+		t.Fatalf("unchanged netmap was rewritten")
+	}
+
+	// A changed netmap is held until the write interval passes,
+	// and only the latest is written.
+	b.writeNetmapCache(ipn.GlobalDaemonStateKey, mk, &netmap.NetworkMap{NodeKey: nk.Public(), Name: "two"})
+	b.writeNetmapCache(ipn.GlobalDaemonStateKey, mk, &netmap.NetworkMap{NodeKey: nk.Public(), Name: "three"})
+	if got := read().Name; got != "one" {
+		t.Fatalf("write within interval: got netmap %q; want one", got)
+	}
+	b.flushNetmapCache()
+	if got := read().Name; got != "three" {
+		t.Fatalf("after flush: got netmap %q; want three", got)
+	}
+}
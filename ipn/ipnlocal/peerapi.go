@@ -40,6 +40,7 @@
 	"tailscale.com/net/dns/resolver"
 	"tailscale.com/net/interfaces"
 	"tailscale.com/net/netutil"
+	"tailscale.com/net/speedtest"
 	"tailscale.com/syncs"
 	"tailscale.com/tailcfg"
 	"tailscale.com/util/clientmetric"
@@ -570,6 +571,9 @@ func (h *peerAPIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	case "/v0/interfaces":
 		h.handleServeInterfaces(w, r)
 		return
+	case "/v0/speedtest":
+		h.handleServeSpeedtest(w, r)
+		return
 	}
 	who := h.peerUser.DisplayName
 	fmt.Fprintf(w, `<html>
@@ -692,6 +696,11 @@ func (h *peerAPIHandler) canWakeOnLAN() bool {
 	return h.isSelf || h.peerHasCap(tailcfg.CapabilityWakeOnLAN)
 }
 
+// canSpeedtest reports whether h can run a speedtest against this node.
+func (h *peerAPIHandler) canSpeedtest() bool {
+	return h.isSelf || h.peerHasCap(tailcfg.CapabilitySpeedtest)
+}
+
 func (h *peerAPIHandler) peerHasCap(wantCap string) bool {
 	for _, hasCap := range h.ps.b.PeerCaps(h.remoteAddr.IP()) {
 		if hasCap == wantCap {
@@ -950,6 +959,56 @@ func (h *peerAPIHandler) handleWakeOnLAN(w http.ResponseWriter, r *http.Request)
 	json.NewEncoder(w).Encode(res)
 }
 
+// speedtestUpgradeProto is the HTTP Upgrade protocol that a speedtest
+// stream runs over after a request to the peerapi's /v0/speedtest.
+const speedtestUpgradeProto = "ts-speedtest"
+
+// speedtestSem limits the number of speedtest streams served at once.
+var speedtestSem = syncs.NewSemaphore(8)
+
+func (h *peerAPIHandler) handleServeSpeedtest(w http.ResponseWriter, r *http.Request) {
+	if !h.canSpeedtest() {
+		http.Error(w, "denied; no speedtest access", http.StatusForbidden)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	if !strings.Contains(strings.ToLower(r.Header.Get("Connection")), "upgrade") ||
+		r.Header.Get("Upgrade") != speedtestUpgradeProto {
+		http.Error(w, "bad speedtest upgrade", http.StatusBadRequest)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "make request over HTTP/1", http.StatusBadRequest)
+		return
+	}
+	if !speedtestSem.TryAcquire() {
+		http.Error(w, "too many speedtests in progress", http.StatusServiceUnavailable)
+		return
+	}
+	defer speedtestSem.Release()
+
+	w.Header().Set("Upgrade", speedtestUpgradeProto)
+	w.Header().Set("Connection", "upgrade")
+	w.WriteHeader(http.StatusSwitchingProtocols)
+	conn, brw, err := hijacker.Hijack()
+	if err != nil {
+		h.logf("speedtest Hijack error: %v", err)
+		return
+	}
+	if err := brw.Flush(); err != nil {
+		conn.Close()
+		return
+	}
+	h.logf("speedtest from %v", h.remoteAddr)
+	if err := speedtest.ServeConn(netutil.NewDrainBufConn(conn, brw.Reader)); err != nil {
+		h.logf("speedtest from %v: %v", h.remoteAddr, err)
+	}
+}
+
 func (h *peerAPIHandler) replyToDNSQueries() bool {
 	if h.isSelf {
 		// If the peer is owned by the same user, just allow it
@@ -999,9 +1058,15 @@ func (h *peerAPIHandler) handleDNSQuery(w http.ResponseWriter, r *http.Request)
 		http.Error(w, "DNS not wired up", http.StatusNotImplemented)
 		return
 	}
+	allowName := h.ps.b.allowExitNodeDNSProxyToServeName
 	if !h.replyToDNSQueries() {
-		http.Error(w, "DNS access denied", http.StatusForbidden)
-		return
+		if !h.ps.b.isAppConnector() {
+			http.Error(w, "DNS access denied", http.StatusForbidden)
+			return
+		}
+		// Peers may still resolve the domains we're an app
+		// connector for.
+		allowName = h.ps.b.appConnectorServesName
 	}
 	pretty := false // non-DoH debug mode for humans
 	q, publicError := dohQuery(r)
@@ -1023,7 +1088,7 @@ func (h *peerAPIHandler) handleDNSQuery(w http.ResponseWriter, r *http.Request)
 
 	ctx, cancel := context.WithTimeout(r.Context(), arbitraryTimeout)
 	defer cancel()
-	res, err := h.ps.resolver.HandleExitNodeDNSQuery(ctx, q, h.remoteAddr, h.ps.b.allowExitNodeDNSProxyToServeName)
+	res, err := h.ps.resolver.HandleExitNodeDNSQuery(ctx, q, h.remoteAddr, allowName)
 	if err != nil {
 		h.logf("handleDNS fwd error: %v", err)
 		if err := ctx.Err(); err != nil {
@@ -1033,6 +1098,11 @@ func (h *peerAPIHandler) handleDNSQuery(w http.ResponseWriter, r *http.Request)
 		}
 		return
 	}
+	if h.ps.b.isAppConnector() {
+		// Advertise routes to the answer's IPs before the peer
+		// gets it and starts sending to them.
+		h.ps.b.learnAppConnectorRoutes(res)
+	}
 	if pretty {
 		// Non-standard response for interactive debugging.
 		w.Header().Set("Content-Type", "application/json")
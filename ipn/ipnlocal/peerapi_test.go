@@ -11,6 +11,7 @@
 	"io/fs"
 	"io/ioutil"
 	"math/rand"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
@@ -18,9 +19,11 @@
 	"runtime"
 	"strings"
 	"testing"
+	"time"
 
 	"inet.af/netaddr"
 	"tailscale.com/ipn"
+	"tailscale.com/net/speedtest"
 	"tailscale.com/tailcfg"
 	"tailscale.com/tstest"
 	"tailscale.com/types/logger"
@@ -151,6 +154,27 @@ func TestHandlePeerAPI(t *testing.T) {
 				bodyContains("ServeHTTP"),
 			),
 		},
+		{
+			name:   "speedtest_deny",
+			isSelf: false,
+			req:    httptest.NewRequest("POST", "/v0/speedtest", nil),
+			checks: checks(httpStatus(403)),
+		},
+		{
+			name:   "speedtest_bad_method",
+			isSelf: true,
+			req:    httptest.NewRequest("GET", "/v0/speedtest", nil),
+			checks: checks(httpStatus(405)),
+		},
+		{
+			name:   "speedtest_no_upgrade",
+			isSelf: true,
+			req:    httptest.NewRequest("POST", "/v0/speedtest", nil),
+			checks: checks(
+				httpStatus(400),
+				bodyContains("bad speedtest upgrade"),
+			),
+		},
 		{
 			name:       "reject_non_owner_put",
 			isSelf:     false,
@@ -443,6 +467,37 @@ func TestHandlePeerAPI(t *testing.T) {
 	}
 }
 
+func TestPeerAPISpeedtestUpgrade(t *testing.T) {
+	ph := &peerAPIHandler{
+		isSelf: true,
+		peerNode: &tailcfg.Node{
+			ComputedName: "some-peer-name",
+		},
+		ps: &peerAPIServer{
+			b: &LocalBackend{logf: t.Logf},
+		},
+	}
+	ts := httptest.NewServer(ph)
+	defer ts.Close()
+	hostPort := strings.TrimPrefix(ts.URL, "http://")
+
+	c, err := net.Dial("tcp", hostPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	sc, err := upgradeToSpeedtest(c, hostPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A duration the server rejects ends the test after the config
+	// exchange, which is enough to know the stream was upgraded.
+	_, err = speedtest.RunClientConn(sc, speedtest.Download, time.Second)
+	if err == nil || !strings.Contains(err.Error(), "test duration must be within") {
+		t.Errorf("RunClientConn = %v; want duration error from server", err)
+	}
+}
+
 // Windows likes to hold on to file descriptors for some indeterminate
 // amount of time after you close them and not let you delete them for
 // a bit. So test that we work around that sufficiently.
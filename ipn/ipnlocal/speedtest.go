@@ -0,0 +1,135 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/net/netutil"
+	"tailscale.com/net/speedtest"
+)
+
+// SpeedTest runs a speedtest in direction dir against the peerapi of the
+// peer with Tailscale IP ip, over streams parallel connections.
+func (b *LocalBackend) SpeedTest(ctx context.Context, ip netaddr.IP, dir speedtest.Direction, duration time.Duration, streams int) (*apitype.SpeedTestResult, error) {
+	nm := b.NetMap()
+	if nm == nil {
+		return nil, errors.New("no netmap")
+	}
+	peer, ok := nm.PeerByTailscaleIP(ip)
+	if !ok {
+		return nil, fmt.Errorf("no peer found with Tailscale IP %v", ip)
+	}
+	base := peerAPIBase(nm, peer)
+	if base == "" {
+		return nil, fmt.Errorf("no peer API base found for peer %v (%v)", peer.ID, ip)
+	}
+	u, err := url.Parse(base)
+	if err != nil {
+		return nil, err
+	}
+
+	// Close the streams if ctx is done, as the speedtest itself
+	// doesn't take a context.
+	var mu sync.Mutex
+	var conns []net.Conn
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			mu.Lock()
+			defer mu.Unlock()
+			for _, c := range conns {
+				c.Close()
+			}
+		case <-done:
+		}
+	}()
+	dial := func() (net.Conn, error) {
+		c, err := b.dialPeerSpeedtest(ctx, u.Host)
+		if err != nil {
+			return nil, err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		conns = append(conns, c)
+		return c, nil
+	}
+	results, err := speedtest.RunClientParallel(dial, dir, duration, streams)
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	res := &apitype.SpeedTestResult{
+		NodeName: peer.Name,
+		Results:  results,
+	}
+	if ps, ok := b.Status().Peer[peer.Key]; ok {
+		res.CurAddr = ps.CurAddr
+		res.Relay = ps.Relay
+	}
+	return res, nil
+}
+
+// dialPeerSpeedtest connects to the peerapi at hostPort and upgrades
+// the connection to a speedtest stream.
+func (b *LocalBackend) dialPeerSpeedtest(ctx context.Context, hostPort string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	conn, err := b.Dialer().PeerAPITransport().DialContext(ctx, "tcp", hostPort)
+	if err != nil {
+		return nil, err
+	}
+	if d, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(d)
+	}
+	sc, err := upgradeToSpeedtest(conn, hostPort)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return sc, nil
+}
+
+// upgradeToSpeedtest makes the peerapi request on conn to upgrade it to
+// a speedtest stream, and returns the stream.
+func upgradeToSpeedtest(conn net.Conn, hostPort string) (net.Conn, error) {
+	req, err := http.NewRequest("POST", "http://"+hostPort+"/v0/speedtest", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Upgrade", speedtestUpgradeProto)
+	req.Header.Set("Connection", "upgrade")
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 1<<10))
+		return nil, fmt.Errorf("peer speedtest: %v: %s", res.Status, strings.TrimSpace(string(body)))
+	}
+	return netutil.NewDrainBufConn(conn, br), nil
+}
@@ -0,0 +1,289 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/envknob"
+	"tailscale.com/tailcfg"
+	"tailscale.com/wgengine/wgcfg/nmcfg"
+)
+
+// subnetHAInterval is how often subnet routers that offer the same
+// route as another peer are health checked.
+var subnetHAInterval = subnetHAIntervalFromEnv()
+
+const defaultSubnetHAInterval = 10 * time.Second
+
+func subnetHAIntervalFromEnv() time.Duration {
+	d, err := time.ParseDuration(envknob.String("TS_DEBUG_SUBNET_HA_INTERVAL"))
+	if err != nil || d <= 0 {
+		return defaultSubnetHAInterval
+	}
+	return d
+}
+
+const (
+	// subnetHAPingTimeout is how long a health check ping may take,
+	// or subnetHAInterval if that's shorter.
+	subnetHAPingTimeout = 3 * time.Second
+
+	// subnetHAMaxFailures is the number of consecutive failed health
+	// checks after which a subnet router is considered down.
+	subnetHAMaxFailures = 3
+)
+
+// subnetHA tracks the health of subnet routers that offer the same
+// routes, and chooses which of them to route each such route via.
+//
+// Control picks a primary router for each route, which is used while
+// it passes health checks. When it fails subnetHAMaxFailures health
+// checks in a row, the next healthy router is used instead, until the
+// primary passes a health check again.
+type subnetHA struct {
+	failures map[tailcfg.StableNodeID]int // consecutive failed health checks
+	active   map[netaddr.IPPrefix]tailcfg.StableNodeID
+}
+
+// healthy reports whether the router with the given ID isn't
+// considered down.
+func (h *subnetHA) healthy(id tailcfg.StableNodeID) bool {
+	return h.failures[id] < subnetHAMaxFailures
+}
+
+// selectRouters updates h.active for the shared routes cands, as
+// returned by nmcfg.SubnetRouterCandidates, and reports whether it
+// changed.
+func (h *subnetHA) selectRouters(cands map[netaddr.IPPrefix][]*tailcfg.Node) (changed bool) {
+	active := make(map[netaddr.IPPrefix]tailcfg.StableNodeID, len(cands))
+	for r, peers := range cands {
+		sel := peers[0].StableID
+		if h.failures[sel] > 0 {
+			// Stick with the current router unless it's down,
+			// so a flaky primary doesn't cause flapping.
+			if cur, ok := h.active[r]; ok && h.healthy(cur) && candidateIndex(peers, cur) >= 0 {
+				sel = cur
+			}
+			if !h.healthy(sel) {
+				for _, p := range peers {
+					if h.healthy(p.StableID) {
+						sel = p.StableID
+						break
+					}
+				}
+			}
+		}
+		active[r] = sel
+		if h.active[r] != sel {
+			changed = true
+		}
+	}
+	if len(active) != len(h.active) {
+		changed = true
+	}
+	h.active = active
+	return changed
+}
+
+// notePing records the result of a health check of the router with
+// the given ID.
+func (h *subnetHA) notePing(id tailcfg.StableNodeID, ok bool) {
+	if ok {
+		delete(h.failures, id)
+		return
+	}
+	if h.failures == nil {
+		h.failures = map[tailcfg.StableNodeID]int{}
+	}
+	h.failures[id]++
+}
+
+func candidateIndex(peers []*tailcfg.Node, id tailcfg.StableNodeID) int {
+	for i, p := range peers {
+		if p.StableID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// updateSubnetHALoopLocked starts subnetHALoop if subnet routes are
+// accepted and some route is offered by more than one peer, and stops
+// it otherwise.
+//
+// b.mu must be held.
+func (b *LocalBackend) updateSubnetHALoopLocked() {
+	need := len(b.subnetRouterCandidatesLocked()) > 0
+	switch {
+	case need && b.stopSubnetHALoop == nil:
+		ctx, cancel := context.WithCancel(b.ctx)
+		b.stopSubnetHALoop = cancel
+		go b.subnetHALoop(ctx)
+	case !need && b.stopSubnetHALoop != nil:
+		b.stopSubnetHALoop()
+		b.stopSubnetHALoop = nil
+		b.subnetHA = subnetHA{}
+	}
+}
+
+// subnetHALoop health checks subnet routers that offer the same routes,
+// reconfiguring the engine when the router to use for a route changes.
+// It runs until ctx is done.
+func (b *LocalBackend) subnetHALoop(ctx context.Context) {
+	t := time.NewTicker(subnetHAInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		b.checkSubnetRouters(ctx)
+	}
+}
+
+// checkSubnetRouters pings every subnet router that shares a route
+// with another, and reconfigures the engine if that changes which
+// router a route should use.
+func (b *LocalBackend) checkSubnetRouters(ctx context.Context) {
+	b.mu.Lock()
+	cands := b.subnetRouterCandidatesLocked()
+	if len(cands) == 0 {
+		b.subnetHA = subnetHA{}
+	}
+	b.mu.Unlock()
+	if len(cands) == 0 {
+		return
+	}
+
+	routers := map[tailcfg.StableNodeID]netaddr.IP{}
+	for _, peers := range cands {
+		for _, p := range peers {
+			if ip, ok := nodeTailscaleIP(p); ok {
+				routers[p.StableID] = ip
+			}
+		}
+	}
+	timeout := subnetHAPingTimeout
+	if subnetHAInterval < timeout {
+		timeout = subnetHAInterval
+	}
+	results := make(map[tailcfg.StableNodeID]bool, len(routers))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for id, ip := range routers {
+		id, ip := id, ip
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			pr, err := b.Ping(ctx, ip, tailcfg.PingDisco)
+			mu.Lock()
+			defer mu.Unlock()
+			results[id] = err == nil && pr.Err == ""
+		}()
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return
+	}
+
+	b.mu.Lock()
+	for id := range b.subnetHA.failures {
+		if _, ok := routers[id]; !ok {
+			delete(b.subnetHA.failures, id)
+		}
+	}
+	for id, ok := range results {
+		wasHealthy := b.subnetHA.healthy(id)
+		b.subnetHA.notePing(id, ok)
+		if h := b.subnetHA.healthy(id); h != wasHealthy {
+			b.logf("subnet HA: router %v healthy=%v", id, h)
+		}
+	}
+	// The netmap may have changed while pinging.
+	changed := b.subnetHA.selectRouters(b.subnetRouterCandidatesLocked())
+	if changed {
+		b.logf("subnet HA: routing %v", logSubnetHARoutes(b.subnetHA.active))
+	}
+	b.mu.Unlock()
+	if changed {
+		b.authReconfig()
+	}
+}
+
+// subnetRouterCandidatesLocked returns the subnet routes that more than
+// one peer offers, as nmcfg.SubnetRouterCandidates, if subnet routes
+// are accepted at all.
+//
+// b.mu must be held.
+func (b *LocalBackend) subnetRouterCandidatesLocked() map[netaddr.IPPrefix][]*tailcfg.Node {
+	if b.netMap == nil || b.prefs == nil || !b.prefs.RouteAll {
+		return nil
+	}
+	return nmcfg.SubnetRouterCandidates(b.netMap)
+}
+
+// nodeTailscaleIP returns n's first Tailscale IP address.
+func nodeTailscaleIP(n *tailcfg.Node) (netaddr.IP, bool) {
+	for _, a := range n.Addresses {
+		if a.IsSingleIP() {
+			return a.IP(), true
+		}
+	}
+	return netaddr.IP{}, false
+}
+
+func logSubnetHARoutes(active map[netaddr.IPPrefix]tailcfg.StableNodeID) []string {
+	var ret []string
+	for r, id := range active {
+		ret = append(ret, r.String()+" via "+string(id))
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// subnetHAStatusLocked returns, for the peer p, the shared subnet
+// routes it's on standby for, those it's serving even though it's
+// not control's primary for them, and whether it's failing health
+// checks. cands is as returned by nmcfg.SubnetRouterCandidates.
+//
+// b.mu must be held.
+func (b *LocalBackend) subnetHAStatusLocked(cands map[netaddr.IPPrefix][]*tailcfg.Node, p *tailcfg.Node) (standby, failover []netaddr.IPPrefix, unhealthy bool) {
+	for r, peers := range cands {
+		i := candidateIndex(peers, p.StableID)
+		if i < 0 {
+			continue
+		}
+		sel, ok := b.subnetHA.active[r]
+		if !ok {
+			sel = peers[0].StableID
+		}
+		switch {
+		case sel != p.StableID:
+			standby = append(standby, r)
+		case i > 0:
+			failover = append(failover, r)
+		}
+	}
+	sortPrefixes(standby)
+	sortPrefixes(failover)
+	return standby, failover, !b.subnetHA.healthy(p.StableID)
+}
+
+func sortPrefixes(ps []netaddr.IPPrefix) {
+	sort.Slice(ps, func(i, j int) bool {
+		if ps[i].IP() != ps[j].IP() {
+			return ps[i].IP().Less(ps[j].IP())
+		}
+		return ps[i].Bits() < ps[j].Bits()
+	})
+}
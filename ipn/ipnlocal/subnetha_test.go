@@ -0,0 +1,162 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"context"
+	"testing"
+
+	"inet.af/netaddr"
+	"tailscale.com/ipn"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/netmap"
+)
+
+func TestSubnetHASelectRouters(t *testing.T) {
+	route := netaddr.MustParseIPPrefix("10.0.0.0/24")
+	cands := map[netaddr.IPPrefix][]*tailcfg.Node{
+		route: {{StableID: "primary"}, {StableID: "second"}, {StableID: "third"}},
+	}
+	type ping struct {
+		id tailcfg.StableNodeID
+		ok bool
+	}
+	fail := func(id tailcfg.StableNodeID, n int) []ping {
+		var ret []ping
+		for i := 0; i < n; i++ {
+			ret = append(ret, ping{id, false})
+		}
+		return ret
+	}
+	tests := []struct {
+		name        string
+		pings       [][]ping // pings before each selection
+		want        tailcfg.StableNodeID
+		wantChanged bool // of the last selection
+	}{
+		{
+			name:        "initial",
+			pings:       [][]ping{nil},
+			want:        "primary",
+			wantChanged: true,
+		},
+		{
+			name:  "primary_flaky",
+			pings: [][]ping{nil, fail("primary", subnetHAMaxFailures-1)},
+			want:  "primary",
+		},
+		{
+			name:        "primary_down",
+			pings:       [][]ping{nil, fail("primary", subnetHAMaxFailures)},
+			want:        "second",
+			wantChanged: true,
+		},
+		{
+			name:        "primary_and_second_down",
+			pings:       [][]ping{nil, append(fail("primary", subnetHAMaxFailures), fail("second", subnetHAMaxFailures)...)},
+			want:        "third",
+			wantChanged: true,
+		},
+		{
+			name: "primary_recovering_stays_on_second",
+			pings: [][]ping{
+				nil,
+				fail("primary", subnetHAMaxFailures),
+				// Still failing sometimes; not recovered yet.
+				append([]ping{{"primary", true}}, fail("primary", 1)...),
+			},
+			want: "second",
+		},
+		{
+			name: "primary_recovered",
+			pings: [][]ping{
+				nil,
+				fail("primary", subnetHAMaxFailures),
+				{{"primary", true}},
+			},
+			want:        "primary",
+			wantChanged: true,
+		},
+		{
+			name:  "all_down",
+			pings: [][]ping{nil, append(append(fail("primary", subnetHAMaxFailures), fail("second", subnetHAMaxFailures)...), fail("third", subnetHAMaxFailures)...)},
+			want:  "primary",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var h subnetHA
+			var changed bool
+			for _, pings := range tt.pings {
+				for _, p := range pings {
+					h.notePing(p.id, p.ok)
+				}
+				changed = h.selectRouters(cands)
+			}
+			if got := h.active[route]; got != tt.want {
+				t.Errorf("active = %v; want %v", got, tt.want)
+			}
+			if changed != tt.wantChanged {
+				t.Errorf("changed = %v; want %v", changed, tt.wantChanged)
+			}
+		})
+	}
+}
+
+func TestUpdateSubnetHALoop(t *testing.T) {
+	route := netaddr.MustParseIPPrefix("10.0.0.0/24")
+	router := func(id tailcfg.NodeID, ip string, primary bool) *tailcfg.Node {
+		addr := netaddr.MustParseIPPrefix(ip + "/32")
+		n := &tailcfg.Node{
+			ID:         id,
+			StableID:   tailcfg.StableNodeID(ip),
+			Addresses:  []netaddr.IPPrefix{addr},
+			AllowedIPs: []netaddr.IPPrefix{addr, route},
+			Hostinfo:   (&tailcfg.Hostinfo{RoutableIPs: []netaddr.IPPrefix{route}}).View(),
+		}
+		if primary {
+			n.PrimaryRoutes = []netaddr.IPPrefix{route}
+		}
+		return n
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	b := &LocalBackend{ctx: ctx}
+	running := func() bool { return b.stopSubnetHALoop != nil }
+
+	tests := []struct {
+		name  string
+		nm    *netmap.NetworkMap
+		prefs *ipn.Prefs
+		want  bool
+	}{
+		{"no_netmap", nil, &ipn.Prefs{RouteAll: true}, false},
+		{
+			name:  "one_router",
+			nm:    &netmap.NetworkMap{Peers: []*tailcfg.Node{router(1, "100.64.0.1", true)}},
+			prefs: &ipn.Prefs{RouteAll: true},
+			want:  false,
+		},
+		{
+			name:  "shared_route",
+			nm:    &netmap.NetworkMap{Peers: []*tailcfg.Node{router(1, "100.64.0.1", true), router(2, "100.64.0.2", false)}},
+			prefs: &ipn.Prefs{RouteAll: true},
+			want:  true,
+		},
+		{
+			name:  "routes_not_accepted",
+			nm:    &netmap.NetworkMap{Peers: []*tailcfg.Node{router(1, "100.64.0.1", true), router(2, "100.64.0.2", false)}},
+			prefs: &ipn.Prefs{},
+			want:  false,
+		},
+	}
+	for _, tt := range tests {
+		b.netMap, b.prefs = tt.nm, tt.prefs
+		b.updateSubnetHALoopLocked()
+		if got := running(); got != tt.want {
+			t.Errorf("%s: loop running = %v; want %v", tt.name, got, tt.want)
+		}
+	}
+}
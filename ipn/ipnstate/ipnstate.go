@@ -97,6 +97,15 @@ type ExitNodeStatus struct {
 
 	// TailscaleIPs are the exit node's IP addresses assigned to the node.
 	TailscaleIPs []netaddr.IPPrefix
+
+	// AllowLANAccess is whether the local network is routed directly
+	// rather than via the exit node.
+	AllowLANAccess bool `json:",omitempty"`
+
+	// LocalRoutes are the local prefixes routed directly rather than
+	// via the exit node: the local network if AllowLANAccess, guest
+	// VM networks, and the prefixes configured by the user.
+	LocalRoutes []netaddr.IPPrefix `json:",omitempty"`
 }
 
 func (s *Status) Peers() []key.NodePublic {
@@ -138,6 +147,21 @@ type PeerStatus struct {
 	// not include the IPs in TailscaleIPs.
 	PrimaryRoutes *views.IPPrefixSlice `json:",omitempty"`
 
+	// StandbyRoutes are the subnet routes this node offers that other
+	// peers offer too, and that are currently routed via one of those
+	// instead.
+	StandbyRoutes []netaddr.IPPrefix `json:",omitempty"`
+
+	// FailoverRoutes are the subnet routes that are routed via this
+	// node because the node control chose as their primary subnet
+	// router is failing health checks.
+	FailoverRoutes []netaddr.IPPrefix `json:",omitempty"`
+
+	// SubnetRouterUnhealthy is whether this node offers subnet
+	// routes that other peers offer too, and is failing the health
+	// checks that decide which of them to route via.
+	SubnetRouterUnhealthy bool `json:",omitempty"`
+
 	// Endpoints:
 	Addrs   []string
 	CurAddr string // one of Addrs, or unique if roaming
@@ -304,6 +328,15 @@ func (sb *StatusBuilder) AddPeer(peer key.NodePublic, st *PeerStatus) (e *PeerSt
 	if v := st.Tags; v != nil && !v.IsNil() {
 		e.Tags = v
 	}
+	if v := st.StandbyRoutes; v != nil {
+		e.StandbyRoutes = v
+	}
+	if v := st.FailoverRoutes; v != nil {
+		e.FailoverRoutes = v
+	}
+	if st.SubnetRouterUnhealthy {
+		e.SubnetRouterUnhealthy = true
+	}
 	if v := st.OS; v != "" {
 		e.OS = st.OS
 	}
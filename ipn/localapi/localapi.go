@@ -6,6 +6,7 @@
 package localapi
 
 import (
+	"bufio"
 	"bytes"
 	"crypto/rand"
 	"encoding/hex"
@@ -29,7 +30,10 @@
 	"tailscale.com/ipn"
 	"tailscale.com/ipn/ipnlocal"
 	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/logpolicy"
+	"tailscale.com/logtail/filesink"
 	"tailscale.com/net/netutil"
+	"tailscale.com/net/speedtest"
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/logger"
 	"tailscale.com/util/clientmetric"
@@ -114,6 +118,8 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		h.serveWhoIs(w, r)
 	case "/localapi/v0/goroutines":
 		h.serveGoroutines(w, r)
+	case "/localapi/v0/logs":
+		h.serveLogs(w, r)
 	case "/localapi/v0/profile":
 		h.serveProfile(w, r)
 	case "/localapi/v0/status":
@@ -126,6 +132,8 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		h.servePrefs(w, r)
 	case "/localapi/v0/ping":
 		h.servePing(w, r)
+	case "/localapi/v0/speedtest":
+		h.serveSpeedTest(w, r)
 	case "/localapi/v0/check-prefs":
 		h.serveCheckPrefs(w, r)
 	case "/localapi/v0/check-ip-forwarding":
@@ -136,6 +144,14 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		h.serveFileTargets(w, r)
 	case "/localapi/v0/set-dns":
 		h.serveSetDNS(w, r)
+	case "/localapi/v0/dns-status":
+		h.serveDNSStatus(w, r)
+	case "/localapi/v0/dns-query":
+		h.serveDNSQuery(w, r)
+	case "/localapi/v0/dns-query-log":
+		h.serveDNSQueryLog(w, r)
+	case "/localapi/v0/exit-usage":
+		h.serveExitUsage(w, r)
 	case "/localapi/v0/derpmap":
 		h.serveDERPMap(w, r)
 	case "/localapi/v0/metrics":
@@ -253,6 +269,38 @@ func (h *Handler) serveWhoIs(w http.ResponseWriter, r *http.Request) {
 	w.Write(j)
 }
 
+// serveLogs streams the log records matching the filesink.Query in the
+// request's query parameters, one JSON object per line, when logs are
+// kept locally rather than uploaded.
+func (h *Handler) serveLogs(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitWrite {
+		http.Error(w, "log access denied", http.StatusForbidden)
+		return
+	}
+	dir := logpolicy.LocalLogsDir()
+	if dir == "" {
+		http.Error(w, "logs are not being kept locally; see TS_LOG_TARGET=file:///path", http.StatusNotFound)
+		return
+	}
+	q, err := filesink.ParseQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	bw := bufio.NewWriter(w)
+	err = filesink.Read(dir, q, func(rec *filesink.Record) error {
+		bw.Write(rec.Raw)
+		return bw.WriteByte('\n')
+	})
+	if err != nil {
+		// Too late for an HTTP error if anything was written, but
+		// log it at least.
+		h.logf("localapi: reading logs: %v", err)
+	}
+	bw.Flush()
+}
+
 func (h *Handler) serveGoroutines(w http.ResponseWriter, r *http.Request) {
 	// Require write access out of paranoia that the goroutine dump
 	// (at least its arguments) might contain something sensitive.
@@ -616,6 +664,77 @@ func (h *Handler) serveSetDNS(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(struct{}{})
 }
 
+func (h *Handler) serveDNSStatus(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitRead {
+		http.Error(w, "dns-status access denied", http.StatusForbidden)
+		return
+	}
+	st, err := h.b.DNSStatus()
+	if err != nil {
+		writeErrorJSON(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(st)
+}
+
+func (h *Handler) serveDNSQuery(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitRead {
+		http.Error(w, "dns-query access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "want POST", 400)
+		return
+	}
+	name := r.FormValue("name")
+	if name == "" {
+		http.Error(w, "missing 'name' parameter", 400)
+		return
+	}
+	typ := r.FormValue("type")
+	if typ == "" {
+		typ = "A"
+	}
+	res, err := h.b.QueryDNS(r.Context(), name, typ)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+func (h *Handler) serveDNSQueryLog(w http.ResponseWriter, r *http.Request) {
+	// The names queried are as private as the logs.
+	if !h.PermitWrite {
+		http.Error(w, "dns-query-log access denied", http.StatusForbidden)
+		return
+	}
+	log, err := h.b.DNSQueryLog()
+	if err != nil {
+		writeErrorJSON(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(log)
+}
+
+func (h *Handler) serveExitUsage(w http.ResponseWriter, r *http.Request) {
+	// Which peers use the exit node, and for what, is private.
+	if !h.PermitWrite {
+		http.Error(w, "exit-usage access denied", http.StatusForbidden)
+		return
+	}
+	usage, err := h.b.ExitUsage()
+	if err != nil {
+		writeErrorJSON(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(usage)
+}
+
 func (h *Handler) serveDERPMap(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "GET" {
 		http.Error(w, "want GET", 400)
@@ -686,6 +805,58 @@ func (h *Handler) servePing(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(res)
 }
 
+// maxSpeedTestStreams is the most parallel streams a speedtest may use.
+const maxSpeedTestStreams = 8
+
+func (h *Handler) serveSpeedTest(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitRead {
+		http.Error(w, "speedtest access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "want POST", 400)
+		return
+	}
+	ip, err := netaddr.ParseIP(r.FormValue("ip"))
+	if err != nil {
+		http.Error(w, "invalid or missing 'ip' parameter", 400)
+		return
+	}
+	var dir speedtest.Direction
+	switch v := r.FormValue("direction"); v {
+	case "", "download":
+		dir = speedtest.Download
+	case "upload":
+		dir = speedtest.Upload
+	default:
+		http.Error(w, "invalid 'direction' parameter", 400)
+		return
+	}
+	duration := speedtest.DefaultDuration
+	if v := r.FormValue("duration"); v != "" {
+		duration, err = time.ParseDuration(v)
+		if err != nil || duration < speedtest.MinDuration || duration > speedtest.MaxDuration {
+			http.Error(w, fmt.Sprintf("'duration' must be within %v and %v", speedtest.MinDuration, speedtest.MaxDuration), 400)
+			return
+		}
+	}
+	streams := 1
+	if v := r.FormValue("streams"); v != "" {
+		streams, err = strconv.Atoi(v)
+		if err != nil || streams < 1 || streams > maxSpeedTestStreams {
+			http.Error(w, fmt.Sprintf("'streams' must be within 1 and %d", maxSpeedTestStreams), 400)
+			return
+		}
+	}
+	res, err := h.b.SpeedTest(r.Context(), ip, dir, duration, streams)
+	if err != nil {
+		writeErrorJSON(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
 func (h *Handler) serveDial(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		http.Error(w, "POST required", http.StatusMethodNotAllowed)
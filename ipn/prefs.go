@@ -104,10 +104,35 @@ type Prefs struct {
 	// routed directly or via the exit node.
 	ExitNodeAllowLANAccess bool
 
+	// ExitNodeLANRoutes are local prefixes, such as a printer subnet
+	// or another VPN's range, that are routed directly rather than
+	// via the exit node, in addition to the local network if
+	// ExitNodeAllowLANAccess is set. More specific routes from peers
+	// still take precedence.
+	//
+	// It only affects routing. It doesn't change which DNS resolvers
+	// are used with an exit node, though a resolver within one of
+	// these prefixes is reached directly.
+	ExitNodeLANRoutes []netaddr.IPPrefix `json:",omitempty"`
+
+	// DialPolicy routes the dials tailscaled makes on behalf of
+	// users, such as for its SOCKS5 and HTTP proxies, per
+	// destination: directly, or via the exit node. The first
+	// matching rule wins; dials matching none are routed as usual.
+	//
+	// It only has an effect in userspace-networking mode.
+	DialPolicy []preftype.DialRule `json:",omitempty"`
+
 	// CorpDNS specifies whether to install the Tailscale network's
 	// DNS configuration, if it exists.
 	CorpDNS bool
 
+	// DNS64 specifies whether MagicDNS synthesizes AAAA records for
+	// names whose only addresses are IPv4 ones in subnets that peers
+	// route via NAT64 (see AdvertiseNAT64), so that IPv6-only
+	// clients can reach them.
+	DNS64 bool `json:",omitempty"`
+
 	// RunSSH bool is whether this node should run an SSH
 	// server, permitting access to peers according to the
 	// policies as configured by the Tailnet's admin(s).
@@ -169,6 +194,31 @@ type Prefs struct {
 	// node.
 	AdvertiseRoutes []netaddr.IPPrefix
 
+	// AdvertiseNAT64 specifies whether to also advertise the IPv4
+	// routes of AdvertiseRoutes in the Tailscale NAT64 range (see
+	// tsaddr.TailscaleNAT64Range), translating the IPv6 traffic to
+	// them into IPv4.
+	//
+	// Only TCP and UDP are translated; ICMP, such as ping, to NAT64
+	// addresses isn't handled. Peers' traffic is filtered by its IPv6
+	// destination, so ACLs must grant access to the NAT64 addresses
+	// (fd7a:115c:a1e0:64::/96, or the part of it for a subnet) rather
+	// than to the IPv4 subnet.
+	AdvertiseNAT64 bool `json:",omitempty"`
+
+	// AdvertiseConnectorDomains, if non-empty, makes this node an app
+	// connector for the given domains and their subdomains: peers
+	// resolve those names via this node's DNS server and route the
+	// resulting IPs through it, and this node advertises the routes
+	// it learns from those answers.
+	AdvertiseConnectorDomains []string `json:",omitempty"`
+
+	// ExitBlockedPorts are the TCP and UDP destination ports to which
+	// this node, when advertising itself as an exit node, doesn't
+	// forward traffic from its peers to the internet. Traffic to
+	// Tailscale IPs and to AdvertiseRoutes is never blocked.
+	ExitBlockedPorts []tailcfg.PortRange `json:",omitempty"`
+
 	// NoSNAT specifies whether to source NAT traffic going to
 	// destinations in AdvertiseRoutes. The default is to apply source
 	// NAT, which makes the traffic appear to come from the router
@@ -201,25 +251,31 @@ type Prefs struct {
 type MaskedPrefs struct {
 	Prefs
 
-	ControlURLSet             bool `json:",omitempty"`
-	RouteAllSet               bool `json:",omitempty"`
-	AllowSingleHostsSet       bool `json:",omitempty"`
-	ExitNodeIDSet             bool `json:",omitempty"`
-	ExitNodeIPSet             bool `json:",omitempty"`
-	ExitNodeAllowLANAccessSet bool `json:",omitempty"`
-	CorpDNSSet                bool `json:",omitempty"`
-	RunSSHSet                 bool `json:",omitempty"`
-	WantRunningSet            bool `json:",omitempty"`
-	LoggedOutSet              bool `json:",omitempty"`
-	ShieldsUpSet              bool `json:",omitempty"`
-	AdvertiseTagsSet          bool `json:",omitempty"`
-	HostnameSet               bool `json:",omitempty"`
-	NotepadURLsSet            bool `json:",omitempty"`
-	ForceDaemonSet            bool `json:",omitempty"`
-	AdvertiseRoutesSet        bool `json:",omitempty"`
-	NoSNATSet                 bool `json:",omitempty"`
-	NetfilterModeSet          bool `json:",omitempty"`
-	OperatorUserSet           bool `json:",omitempty"`
+	ControlURLSet                bool `json:",omitempty"`
+	RouteAllSet                  bool `json:",omitempty"`
+	AllowSingleHostsSet          bool `json:",omitempty"`
+	ExitNodeIDSet                bool `json:",omitempty"`
+	ExitNodeIPSet                bool `json:",omitempty"`
+	ExitNodeAllowLANAccessSet    bool `json:",omitempty"`
+	ExitNodeLANRoutesSet         bool `json:",omitempty"`
+	DialPolicySet                bool `json:",omitempty"`
+	CorpDNSSet                   bool `json:",omitempty"`
+	DNS64Set                     bool `json:",omitempty"`
+	RunSSHSet                    bool `json:",omitempty"`
+	WantRunningSet               bool `json:",omitempty"`
+	LoggedOutSet                 bool `json:",omitempty"`
+	ShieldsUpSet                 bool `json:",omitempty"`
+	AdvertiseTagsSet             bool `json:",omitempty"`
+	HostnameSet                  bool `json:",omitempty"`
+	NotepadURLsSet               bool `json:",omitempty"`
+	ForceDaemonSet               bool `json:",omitempty"`
+	AdvertiseRoutesSet           bool `json:",omitempty"`
+	AdvertiseNAT64Set            bool `json:",omitempty"`
+	AdvertiseConnectorDomainsSet bool `json:",omitempty"`
+	ExitBlockedPortsSet          bool `json:",omitempty"`
+	NoSNATSet                    bool `json:",omitempty"`
+	NetfilterModeSet             bool `json:",omitempty"`
+	OperatorUserSet              bool `json:",omitempty"`
 }
 
 // ApplyEdits mutates p, assigning fields from m.Prefs for each MaskedPrefs
@@ -293,6 +349,9 @@ func (p *Prefs) pretty(goos string) string {
 		sb.WriteString("mesh=false ")
 	}
 	fmt.Fprintf(&sb, "dns=%v want=%v ", p.CorpDNS, p.WantRunning)
+	if p.DNS64 {
+		sb.WriteString("dns64=true ")
+	}
 	if p.RunSSH {
 		sb.WriteString("ssh=true ")
 	}
@@ -313,9 +372,24 @@ func (p *Prefs) pretty(goos string) string {
 	} else if !p.ExitNodeID.IsZero() {
 		fmt.Fprintf(&sb, "exit=%v lan=%t ", p.ExitNodeID, p.ExitNodeAllowLANAccess)
 	}
+	if (!p.ExitNodeIP.IsZero() || !p.ExitNodeID.IsZero()) && len(p.ExitNodeLANRoutes) > 0 {
+		fmt.Fprintf(&sb, "lanroutes=%v ", p.ExitNodeLANRoutes)
+	}
+	if len(p.DialPolicy) > 0 {
+		fmt.Fprintf(&sb, "dialpolicy=%v ", p.DialPolicy)
+	}
 	if len(p.AdvertiseRoutes) > 0 || goos == "linux" {
 		fmt.Fprintf(&sb, "routes=%v ", p.AdvertiseRoutes)
 	}
+	if p.AdvertiseNAT64 {
+		sb.WriteString("nat64=true ")
+	}
+	if len(p.AdvertiseConnectorDomains) > 0 {
+		fmt.Fprintf(&sb, "connector=%s ", strings.Join(p.AdvertiseConnectorDomains, ","))
+	}
+	if len(p.ExitBlockedPorts) > 0 {
+		fmt.Fprintf(&sb, "exitblocked=%s ", PortRangesString(p.ExitBlockedPorts))
+	}
 	if len(p.AdvertiseRoutes) > 0 || p.NoSNAT {
 		fmt.Fprintf(&sb, "snat=%v ", !p.NoSNAT)
 	}
@@ -366,7 +440,10 @@ func (p *Prefs) Equals(p2 *Prefs) bool {
 		p.ExitNodeID == p2.ExitNodeID &&
 		p.ExitNodeIP == p2.ExitNodeIP &&
 		p.ExitNodeAllowLANAccess == p2.ExitNodeAllowLANAccess &&
+		compareIPNets(p.ExitNodeLANRoutes, p2.ExitNodeLANRoutes) &&
+		compareDialRules(p.DialPolicy, p2.DialPolicy) &&
 		p.CorpDNS == p2.CorpDNS &&
+		p.DNS64 == p2.DNS64 &&
 		p.RunSSH == p2.RunSSH &&
 		p.WantRunning == p2.WantRunning &&
 		p.LoggedOut == p2.LoggedOut &&
@@ -378,6 +455,9 @@ func (p *Prefs) Equals(p2 *Prefs) bool {
 		p.Hostname == p2.Hostname &&
 		p.ForceDaemon == p2.ForceDaemon &&
 		compareIPNets(p.AdvertiseRoutes, p2.AdvertiseRoutes) &&
+		p.AdvertiseNAT64 == p2.AdvertiseNAT64 &&
+		compareStrings(p.AdvertiseConnectorDomains, p2.AdvertiseConnectorDomains) &&
+		comparePortRanges(p.ExitBlockedPorts, p2.ExitBlockedPorts) &&
 		compareStrings(p.AdvertiseTags, p2.AdvertiseTags) &&
 		p.Persist.Equals(p2.Persist)
 }
@@ -394,6 +474,47 @@ func compareIPNets(a, b []netaddr.IPPrefix) bool {
 	return true
 }
 
+func comparePortRanges(a, b []tailcfg.PortRange) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// PortRangesString returns prs in the form "25,137-139", as accepted by
+// tailscale up --exit-blocked-ports.
+func PortRangesString(prs []tailcfg.PortRange) string {
+	var sb strings.Builder
+	for i, pr := range prs {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		if pr.First == pr.Last {
+			fmt.Fprintf(&sb, "%d", pr.First)
+		} else {
+			fmt.Fprintf(&sb, "%d-%d", pr.First, pr.Last)
+		}
+	}
+	return sb.String()
+}
+
+func compareDialRules(a, b []preftype.DialRule) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
 func compareStrings(a, b []string) bool {
 	if len(a) != len(b) {
 		return false
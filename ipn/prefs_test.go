@@ -42,7 +42,10 @@ func TestPrefsEqual(t *testing.T) {
 		"ExitNodeID",
 		"ExitNodeIP",
 		"ExitNodeAllowLANAccess",
+		"ExitNodeLANRoutes",
+		"DialPolicy",
 		"CorpDNS",
+		"DNS64",
 		"RunSSH",
 		"WantRunning",
 		"LoggedOut",
@@ -52,6 +55,9 @@ func TestPrefsEqual(t *testing.T) {
 		"NotepadURLs",
 		"ForceDaemon",
 		"AdvertiseRoutes",
+		"AdvertiseNAT64",
+		"AdvertiseConnectorDomains",
+		"ExitBlockedPorts",
 		"NoSNAT",
 		"NetfilterMode",
 		"OperatorUser",
@@ -158,6 +164,38 @@ func TestPrefsEqual(t *testing.T) {
 			true,
 		},
 
+		{
+			&Prefs{},
+			&Prefs{ExitNodeLANRoutes: nets("192.168.5.0/24")},
+			false,
+		},
+		{
+			&Prefs{ExitNodeLANRoutes: nets("192.168.5.0/24")},
+			&Prefs{ExitNodeLANRoutes: nets("10.8.0.0/16")},
+			false,
+		},
+		{
+			&Prefs{ExitNodeLANRoutes: nets("192.168.5.0/24")},
+			&Prefs{ExitNodeLANRoutes: nets("192.168.5.0/24")},
+			true,
+		},
+
+		{
+			&Prefs{},
+			&Prefs{DialPolicy: []preftype.DialRule{{Dst: "*", Via: "direct"}}},
+			false,
+		},
+		{
+			&Prefs{DialPolicy: []preftype.DialRule{{Dst: "*", Via: "direct"}}},
+			&Prefs{DialPolicy: []preftype.DialRule{{Dst: "*", Via: "exit-node"}}},
+			false,
+		},
+		{
+			&Prefs{DialPolicy: []preftype.DialRule{{Dst: "*", Via: "direct"}}},
+			&Prefs{DialPolicy: []preftype.DialRule{{Dst: "*", Via: "direct"}}},
+			true,
+		},
+
 		{
 			&Prefs{CorpDNS: true},
 			&Prefs{CorpDNS: false},
@@ -169,6 +207,22 @@ func TestPrefsEqual(t *testing.T) {
 			true,
 		},
 
+		{
+			&Prefs{DNS64: true},
+			&Prefs{DNS64: false},
+			false,
+		},
+		{
+			&Prefs{AdvertiseNAT64: true},
+			&Prefs{AdvertiseNAT64: false},
+			false,
+		},
+		{
+			&Prefs{AdvertiseNAT64: true},
+			&Prefs{AdvertiseNAT64: true},
+			true,
+		},
+
 		{
 			&Prefs{WantRunning: true},
 			&Prefs{WantRunning: false},
@@ -250,6 +304,28 @@ func TestPrefsEqual(t *testing.T) {
 			true,
 		},
 
+		{
+			&Prefs{AdvertiseConnectorDomains: []string{"github.com"}},
+			&Prefs{AdvertiseConnectorDomains: []string{"github.com"}},
+			true,
+		},
+		{
+			&Prefs{AdvertiseConnectorDomains: []string{"github.com"}},
+			&Prefs{AdvertiseConnectorDomains: []string{"gitlab.com"}},
+			false,
+		},
+
+		{
+			&Prefs{ExitBlockedPorts: []tailcfg.PortRange{{First: 25, Last: 25}}},
+			&Prefs{ExitBlockedPorts: []tailcfg.PortRange{{First: 25, Last: 25}}},
+			true,
+		},
+		{
+			&Prefs{ExitBlockedPorts: []tailcfg.PortRange{{First: 25, Last: 25}}},
+			&Prefs{ExitBlockedPorts: []tailcfg.PortRange{{First: 25, Last: 26}}},
+			false,
+		},
+
 		{
 			&Prefs{NetfilterMode: preftype.NetfilterOff},
 			&Prefs{NetfilterMode: preftype.NetfilterOn},
@@ -435,6 +511,32 @@ func TestPrefsPretty(t *testing.T) {
 			"linux",
 			`Prefs{ra=false mesh=false dns=false want=false exit=myNodeABC lan=true routes=[] nf=off Persist=nil}`,
 		},
+		{
+			Prefs{
+				ExitNodeID:        tailcfg.StableNodeID("myNodeABC"),
+				ExitNodeLANRoutes: []netaddr.IPPrefix{netaddr.MustParseIPPrefix("192.168.5.0/24")},
+			},
+			"linux",
+			`Prefs{ra=false mesh=false dns=false want=false exit=myNodeABC lan=false lanroutes=[192.168.5.0/24] routes=[] nf=off Persist=nil}`,
+		},
+		{
+			Prefs{
+				AdvertiseRoutes:  []netaddr.IPPrefix{netaddr.MustParseIPPrefix("0.0.0.0/0")},
+				ExitBlockedPorts: []tailcfg.PortRange{{First: 25, Last: 25}, {First: 137, Last: 139}},
+			},
+			"linux",
+			`Prefs{ra=false mesh=false dns=false want=false routes=[0.0.0.0/0] exitblocked=25,137-139 snat=true nf=off Persist=nil}`,
+		},
+		{
+			Prefs{
+				CorpDNS:         true,
+				DNS64:           true,
+				AdvertiseRoutes: []netaddr.IPPrefix{netaddr.MustParseIPPrefix("192.168.1.0/24")},
+				AdvertiseNAT64:  true,
+			},
+			"linux",
+			`Prefs{ra=false mesh=false dns=true want=false dns64=true routes=[192.168.1.0/24] nat64=true snat=true nf=off Persist=nil}`,
+		},
 		{
 			Prefs{
 				ExitNodeAllowLANAccess: true,
@@ -27,10 +27,16 @@ func New(_ logger.Logf, secretName string) (*Store, error) {
 	if err != nil {
 		return nil, err
 	}
+	return NewWithClient(c, secretName), nil
+}
+
+// NewWithClient returns a new Store that persists to the named secret
+// using the Kubernetes client c.
+func NewWithClient(c *kube.Client, secretName string) *Store {
 	return &Store{
 		client:     c,
 		secretName: secretName,
-	}, nil
+	}
 }
 
 func (s *Store) String() string { return "kube.Store" }
@@ -77,6 +83,9 @@ func (s *Store) WriteState(id ipn.StateKey, bs []byte) error {
 		}
 		return err
 	}
+	if secret.Data == nil {
+		secret.Data = map[string][]byte{}
+	}
 	secret.Data[string(id)] = bs
 	if err := s.client.UpdateSecret(ctx, secret); err != nil {
 		return err
@@ -4,7 +4,10 @@
 
 package kube
 
-import "time"
+import (
+	"encoding/json"
+	"time"
+)
 
 // Note: The API types are copied from k8s.io/api{,machinery} to not introduce a
 // module dependency on the Kubernetes API as it pulls in many more dependencies.
@@ -148,6 +151,88 @@ type Secret struct {
 	Data map[string][]byte `json:"data,omitempty"`
 }
 
+// SecretList is a list of Secrets.
+type SecretList struct {
+	TypeMeta `json:",inline"`
+	ListMeta `json:"metadata"`
+
+	Items []Secret `json:"items"`
+}
+
+// ListMeta describes metadata that synthetic resources must have,
+// including lists.
+type ListMeta struct {
+	// String that identifies the server's internal version of this object
+	// that can be used by clients to determine when objects have changed.
+	// Value must be treated as opaque by clients and passed unmodified back
+	// to the server.
+	// +optional
+	ResourceVersion string `json:"resourceVersion,omitempty"`
+}
+
+// Service is a named abstraction of software service (for example,
+// mysql) consisting of local port (for example 3306) that the proxy
+// listens on, and the selector that determines which pods will answer
+// requests sent through the proxy.
+type Service struct {
+	TypeMeta   `json:",inline"`
+	ObjectMeta `json:"metadata"`
+
+	// Spec defines the behavior of a service.
+	// +optional
+	Spec ServiceSpec `json:"spec,omitempty"`
+}
+
+// ServiceSpec describes the attributes that a user creates on a service.
+type ServiceSpec struct {
+	// Type determines how the Service is exposed: ClusterIP, NodePort,
+	// LoadBalancer or ExternalName.
+	// +optional
+	Type string `json:"type,omitempty"`
+
+	// ClusterIP is the IP address of the service. It is "None" for
+	// headless services.
+	// +optional
+	ClusterIP string `json:"clusterIP,omitempty"`
+
+	// The list of ports that are exposed by this service.
+	// +optional
+	Ports []ServicePort `json:"ports,omitempty"`
+}
+
+// ServicePort contains information on service's port.
+type ServicePort struct {
+	// The name of this port within the service.
+	// +optional
+	Name string `json:"name,omitempty"`
+
+	// The IP protocol for this port. Supports "TCP", "UDP", and "SCTP".
+	// Default is TCP.
+	// +optional
+	Protocol string `json:"protocol,omitempty"`
+
+	// The port that will be exposed by this service.
+	Port int32 `json:"port"`
+}
+
+// ServiceList holds a list of services.
+type ServiceList struct {
+	TypeMeta `json:",inline"`
+	ListMeta `json:"metadata"`
+
+	Items []Service `json:"items"`
+}
+
+// WatchEvent is an event in a watch stream.
+type WatchEvent struct {
+	// Type is "ADDED", "MODIFIED", "DELETED", "BOOKMARK" or "ERROR".
+	Type string `json:"type"`
+
+	// Object is the object that changed, or a Status for "ERROR"
+	// events.
+	Object json.RawMessage `json:"object"`
+}
+
 // Status is a return value for calls that don't return other objects.
 type Status struct {
 	TypeMeta `json:",inline"`
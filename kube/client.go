@@ -16,6 +16,7 @@
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"sync"
@@ -40,6 +41,7 @@ type Client struct {
 	client      *http.Client
 	token       string
 	tokenExpiry time.Time
+	staticToken bool // token is never renewed
 }
 
 // New returns a new client
@@ -69,6 +71,29 @@ func New() (*Client, error) {
 	}, nil
 }
 
+// NewWithToken returns a client for the API server at apiURL that
+// authenticates with a fixed bearer token and uses namespace ns. It is
+// for use outside a cluster, such as against a fake API server in tests.
+// If hc is nil, http.DefaultClient is used.
+func NewWithToken(apiURL, ns, token string, hc *http.Client) *Client {
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	return &Client{
+		url:         apiURL,
+		ns:          ns,
+		client:      hc,
+		token:       token,
+		staticToken: true,
+	}
+}
+
+// Namespace returns the namespace of the client, in which it manages
+// Secrets.
+func (c *Client) Namespace() string {
+	return c.ns
+}
+
 func (c *Client) expireToken() {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -79,7 +104,7 @@ func (c *Client) getOrRenewToken() (string, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	tk, te := c.token, c.tokenExpiry
-	if time.Now().Before(te) {
+	if c.staticToken || time.Now().Before(te) {
 		return tk, nil
 	}
 
@@ -100,7 +125,8 @@ func (c *Client) secretURL(name string) string {
 }
 
 func getError(resp *http.Response) error {
-	if resp.StatusCode == 200 {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		// 201 Created is returned for POSTs.
 		return nil
 	}
 	st := &Status{}
@@ -110,39 +136,58 @@ func getError(resp *http.Response) error {
 	return st
 }
 
-func (c *Client) doRequest(ctx context.Context, method, url string, in, out any) error {
+func (c *Client) newRequest(ctx context.Context, method, url string, in any) (*http.Request, error) {
 	tk, err := c.getOrRenewToken()
 	if err != nil {
-		return err
+		return nil, err
 	}
 	var body io.Reader
 	if in != nil {
 		var b bytes.Buffer
 		if err := json.NewEncoder(&b).Encode(in); err != nil {
-			return err
+			return nil, err
 		}
 		body = &b
 	}
 	req, err := http.NewRequestWithContext(ctx, method, url, body)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if body != nil {
 		req.Header.Add("Content-Type", "application/json")
 	}
 	req.Header.Add("Accept", "application/json")
 	req.Header.Add("Authorization", "Bearer "+tk)
+	return req, nil
+}
+
+// do sends req and returns the response if it was successful. The
+// caller must close the response body.
+func (c *Client) do(req *http.Request) (*http.Response, error) {
 	resp, err := c.client.Do(req)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer resp.Body.Close()
 	if err := getError(resp); err != nil {
+		resp.Body.Close()
 		if st, ok := err.(*Status); ok && st.Code == 401 {
 			c.expireToken()
 		}
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (c *Client) doRequest(ctx context.Context, method, url string, in, out any) error {
+	req, err := c.newRequest(ctx, method, url, in)
+	if err != nil {
 		return err
 	}
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
 	if out != nil {
 		return json.NewDecoder(resp.Body).Decode(out)
 	}
@@ -168,3 +213,79 @@ func (c *Client) CreateSecret(ctx context.Context, s *Secret) error {
 func (c *Client) UpdateSecret(ctx context.Context, s *Secret) error {
 	return c.doRequest(ctx, "PUT", c.secretURL(s.Name), s, nil)
 }
+
+// ListSecrets lists the secrets in the client's namespace that match
+// labelSelector, such as "app=foo". An empty labelSelector matches all
+// secrets.
+func (c *Client) ListSecrets(ctx context.Context, labelSelector string) (*SecretList, error) {
+	u := c.secretURL("")
+	if labelSelector != "" {
+		u += "?labelSelector=" + url.QueryEscape(labelSelector)
+	}
+	l := &SecretList{}
+	if err := c.doRequest(ctx, "GET", u, nil, l); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// DeleteSecret deletes the named secret from the Kubernetes API.
+func (c *Client) DeleteSecret(ctx context.Context, name string) error {
+	return c.doRequest(ctx, "DELETE", c.secretURL(name), nil, nil)
+}
+
+// ListServices lists the services in all namespaces.
+func (c *Client) ListServices(ctx context.Context) (*ServiceList, error) {
+	l := &ServiceList{}
+	if err := c.doRequest(ctx, "GET", c.url+"/api/v1/services", nil, l); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// WatchServices watches the services in all namespaces for changes
+// after resourceVersion, which is typically that of a ServiceList. It
+// calls fn with the type of each change ("ADDED", "MODIFIED" or
+// "DELETED") and the service, until ctx is done, the API server ends
+// the watch, or fn returns an error. It always returns a non-nil
+// error, and the caller should list the services again before
+// resuming the watch.
+func (c *Client) WatchServices(ctx context.Context, resourceVersion string, fn func(eventType string, svc *Service) error) error {
+	u := c.url + "/api/v1/services?watch=1&resourceVersion=" + url.QueryEscape(resourceVersion)
+	req, err := c.newRequest(ctx, "GET", u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var ev WatchEvent
+		if err := dec.Decode(&ev); err != nil {
+			if err == io.EOF {
+				return fmt.Errorf("kube: watch ended")
+			}
+			return err
+		}
+		if ev.Type == "ERROR" {
+			st := &Status{}
+			if err := json.Unmarshal(ev.Object, st); err != nil {
+				return err
+			}
+			return st
+		}
+		if ev.Type == "BOOKMARK" {
+			continue
+		}
+		svc := &Service{}
+		if err := json.Unmarshal(ev.Object, svc); err != nil {
+			return err
+		}
+		if err := fn(ev.Type, svc); err != nil {
+			return err
+		}
+	}
+}
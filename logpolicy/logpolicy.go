@@ -35,6 +35,7 @@
 	"tailscale.com/log/filelogger"
 	"tailscale.com/logtail"
 	"tailscale.com/logtail/filch"
+	"tailscale.com/logtail/filesink"
 	"tailscale.com/net/dnscache"
 	"tailscale.com/net/dnsfallback"
 	"tailscale.com/net/netknob"
@@ -74,12 +75,28 @@ func getLogTarget() string {
 // LogHost returns the hostname only (without port) of the configured
 // logtail server, or the default.
 func LogHost() string {
-	if v := getLogTarget(); v != "" {
+	if v := getLogTarget(); v != "" && LocalLogsDir() == "" {
 		return v
 	}
 	return logtail.DefaultHost
 }
 
+// LocalLogsDir returns the directory that logs are written to instead
+// of being uploaded, if the log target is a file:// URL, such as
+// TS_LOG_TARGET=file:///var/log/tailscale. Otherwise it returns the
+// empty string.
+func LocalLogsDir() string {
+	u, err := url.Parse(getLogTarget())
+	if err != nil || u.Scheme != "file" || u.Path == "" {
+		return ""
+	}
+	p := u.Path
+	if runtime.GOOS == "windows" && len(p) > 2 && p[0] == '/' && p[2] == ':' {
+		p = p[1:] // file:///C:/foo
+	}
+	return filepath.FromSlash(p)
+}
+
 // Config represents an instance of logs in a collection.
 type Config struct {
 	Collection string
@@ -539,7 +556,14 @@ func New(collection string) *Policy {
 		c.IncludeProcSequence = true
 	}
 
-	if val := getLogTarget(); val != "" {
+	if dir := LocalLogsDir(); dir != "" {
+		sink, err := filesink.New(dir, filesink.Options{})
+		if err != nil {
+			log.Fatalf("logpolicy: opening local log directory: %v", err)
+		}
+		log.Printf("Logs are being written to %s instead of being uploaded.", dir)
+		c.LocalSink = sink
+	} else if val := getLogTarget(); val != "" {
 		log.Println("You have enabled a non-default log target. Doing without being told to by Tailscale staff or your network administrator will make getting support difficult.")
 		c.BaseURL = val
 		u, _ := url.Parse(val)
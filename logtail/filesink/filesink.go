@@ -0,0 +1,272 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package filesink writes logtail log records to local files instead
+// of uploading them, rotating the files by size and age, and reads
+// them back.
+//
+// Records are stored one JSON object per line, exactly as logtail
+// would have uploaded them, in a directory containing the current
+// file, logs.jsonl, and rotated files named logs-<time>.jsonl, where
+// <time> is when the file was rotated.
+package filesink
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	currentName     = "logs.jsonl"
+	rotatedPrefix   = "logs-"
+	rotatedSuffix   = ".jsonl"
+	rotatedTimeFmt  = "20060102T150405.000000000Z"
+	defaultMaxSize  = 10 << 20
+	defaultMaxAge   = 24 * time.Hour
+	defaultMaxFiles = 10
+
+	// maxRecordSize is the size of the longest line Read reads.
+	maxRecordSize = 1 << 20
+)
+
+// Options are options for New.
+type Options struct {
+	// MaxSize is the size in bytes at which the current file is
+	// rotated. Zero means 10 MiB.
+	MaxSize int64
+
+	// MaxAge is how long after being started the current file is
+	// rotated. Zero means 24 hours.
+	MaxAge time.Duration
+
+	// MaxFiles is the number of rotated files to keep. Zero means 10.
+	MaxFiles int
+
+	// TimeNow, if set, substitutes uses of time.Now.
+	TimeNow func() time.Time
+}
+
+// Sink writes log records to files in a directory. It implements
+// logtail.LocalSink.
+type Sink struct {
+	dir  string
+	opts Options
+
+	mu      sync.Mutex
+	f       *os.File // the current file, or nil if closed
+	size    int64
+	started time.Time // when f was started, or this Sink created
+}
+
+// New returns a Sink writing to dir, creating it if needed. If dir
+// already has a current file, new records are appended to it.
+func New(dir string, opts Options) (*Sink, error) {
+	if opts.MaxSize <= 0 {
+		opts.MaxSize = defaultMaxSize
+	}
+	if opts.MaxAge <= 0 {
+		opts.MaxAge = defaultMaxAge
+	}
+	if opts.MaxFiles <= 0 {
+		opts.MaxFiles = defaultMaxFiles
+	}
+	if opts.TimeNow == nil {
+		opts.TimeNow = time.Now
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	s := &Sink{dir: dir, opts: opts}
+	if err := s.openLocked(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// openLocked opens the current file for appending.
+//
+// s.mu must be held.
+func (s *Sink) openLocked() error {
+	f, err := os.OpenFile(filepath.Join(s.dir, currentName), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.f = f
+	s.size = fi.Size()
+	s.started = s.opts.TimeNow()
+	return nil
+}
+
+// WriteLogs writes batch, a JSON array of log records, to the current
+// file, one record per line, rotating the file first if it's due.
+func (s *Sink) WriteLogs(batch []byte) error {
+	var records []json.RawMessage
+	if err := json.Unmarshal(batch, &records); err != nil {
+		return fmt.Errorf("filesink: decoding batch: %w", err)
+	}
+	var buf []byte
+	for _, r := range records {
+		buf = append(buf, r...)
+		buf = append(buf, '\n')
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return os.ErrClosed
+	}
+	if s.size > 0 && (s.size+int64(len(buf)) > s.opts.MaxSize || s.opts.TimeNow().Sub(s.started) >= s.opts.MaxAge) {
+		if err := s.rotateLocked(); err != nil {
+			return fmt.Errorf("filesink: rotating: %w", err)
+		}
+	}
+	n, err := s.f.Write(buf)
+	s.size += int64(n)
+	return err
+}
+
+// rotateLocked renames the current file out of the way, starts a new
+// one, and deletes the oldest rotated files beyond s.opts.MaxFiles.
+//
+// s.mu must be held.
+func (s *Sink) rotateLocked() error {
+	if err := s.f.Close(); err != nil {
+		return err
+	}
+	s.f = nil
+	name := rotatedPrefix + s.opts.TimeNow().UTC().Format(rotatedTimeFmt) + rotatedSuffix
+	if err := os.Rename(filepath.Join(s.dir, currentName), filepath.Join(s.dir, name)); err != nil {
+		return err
+	}
+	if err := s.openLocked(); err != nil {
+		return err
+	}
+	rotated, err := rotatedFiles(s.dir)
+	if err != nil {
+		return err
+	}
+	for len(rotated) > s.opts.MaxFiles {
+		if err := os.Remove(rotated[0]); err != nil {
+			return err
+		}
+		rotated = rotated[1:]
+	}
+	return nil
+}
+
+// Close closes the current file. Later writes fail.
+func (s *Sink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return nil
+	}
+	err := s.f.Close()
+	s.f = nil
+	return err
+}
+
+// rotatedFiles returns the paths of the rotated files in dir, oldest
+// first.
+func rotatedFiles(dir string) ([]string, error) {
+	des, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var ret []string
+	for _, de := range des {
+		name := de.Name()
+		if de.Type().IsRegular() && strings.HasPrefix(name, rotatedPrefix) && strings.HasSuffix(name, rotatedSuffix) {
+			ret = append(ret, filepath.Join(dir, name))
+		}
+	}
+	// The rotation times sort lexically.
+	sort.Strings(ret)
+	return ret, nil
+}
+
+// Files returns the paths of the log files in dir, oldest first.
+func Files(dir string) ([]string, error) {
+	files, err := rotatedFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	cur := filepath.Join(dir, currentName)
+	if _, err := os.Stat(cur); err == nil {
+		files = append(files, cur)
+	}
+	return files, nil
+}
+
+// Read calls fn for each record in the log files in dir that matches
+// q, oldest first, until fn returns an error, which Read then returns.
+// Lines that aren't JSON objects or are longer than 1 MiB are skipped.
+func Read(dir string, q Query, fn func(*Record) error) error {
+	files, err := Files(dir)
+	if err != nil {
+		return err
+	}
+	for _, path := range files {
+		if err := readFile(path, q, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readFile(path string, q Query, fn func(*Record) error) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		// Rotated away since we listed the directory.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	var line []byte
+	tooLong := false
+	for {
+		chunk, err := br.ReadSlice('\n')
+		if !tooLong {
+			if len(line)+len(chunk) > maxRecordSize {
+				tooLong = true
+			} else {
+				line = append(line, chunk...)
+			}
+		}
+		if err == bufio.ErrBufferFull {
+			continue // more of the line to come
+		}
+		if !tooLong {
+			if r, perr := ParseRecord(bytes.TrimSuffix(line, []byte("\n"))); perr == nil && q.Match(r) {
+				if err := fn(r); err != nil {
+					return err
+				}
+			}
+		}
+		line, tooLong = line[:0], false
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
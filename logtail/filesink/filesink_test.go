@@ -0,0 +1,206 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package filesink
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func record(t time.Time, level int, text string) string {
+	return fmt.Sprintf(`{"logtail":{"client_time":%q},"v":%d,"text":%q}`, t.UTC().Format(time.RFC3339Nano), level, text)
+}
+
+func readTexts(t *testing.T, dir string, q Query) []string {
+	t.Helper()
+	var got []string
+	err := Read(dir, q, func(r *Record) error {
+		got = append(got, r.Text)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func TestRotation(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Date(2022, 8, 1, 12, 0, 0, 0, time.UTC)
+	s, err := New(dir, Options{
+		MaxSize:  200,
+		MaxAge:   time.Hour,
+		MaxFiles: 2,
+		TimeNow:  func() time.Time { return now },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	var want []string
+	write := func(text string) {
+		t.Helper()
+		rec := record(now, 0, text)
+		if err := s.WriteLogs([]byte("[" + rec + "]")); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, text)
+	}
+	files := func() int {
+		t.Helper()
+		f, err := Files(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(f)
+	}
+
+	write("one")
+	now = now.Add(time.Second)
+	write("two")
+	if got := files(); got != 1 {
+		t.Fatalf("files after two small writes = %d; want 1", got)
+	}
+
+	// Exceeding MaxSize rotates.
+	now = now.Add(time.Second)
+	write("three")
+	if got := files(); got != 2 {
+		t.Fatalf("files after exceeding size = %d; want 2", got)
+	}
+
+	// So does MaxAge, even for a small file.
+	now = now.Add(time.Hour)
+	write("four")
+	if got := files(); got != 3 {
+		t.Fatalf("files after exceeding age = %d; want 3", got)
+	}
+	if got := readTexts(t, dir, Query{MaxLevel: -1}); !reflect.DeepEqual(got, want) {
+		t.Fatalf("read %q; want %q", got, want)
+	}
+
+	// Only MaxFiles rotated files are kept.
+	now = now.Add(time.Hour)
+	write("five")
+	if got := files(); got != 3 {
+		t.Fatalf("files after pruning = %d; want 3", got)
+	}
+	if got, want := readTexts(t, dir, Query{MaxLevel: -1}), []string{"three", "four", "five"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("read %q; want %q", got, want)
+	}
+
+	// A new Sink appends to the current file.
+	s.Close()
+	s2, err := New(dir, Options{TimeNow: func() time.Time { return now }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s2.Close()
+	if err := s2.WriteLogs([]byte("[" + record(now, 0, "six") + "]")); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := readTexts(t, dir, Query{MaxLevel: -1}), []string{"three", "four", "five", "six"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("read %q; want %q", got, want)
+	}
+}
+
+func TestWriteLogsBadBatch(t *testing.T) {
+	s, err := New(t.TempDir(), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := s.WriteLogs([]byte(`{"not":"an array"}`)); err == nil {
+		t.Fatal("WriteLogs of non-array succeeded")
+	}
+}
+
+func TestQuery(t *testing.T) {
+	dir := t.TempDir()
+	t0 := time.Date(2022, 8, 1, 12, 0, 0, 0, time.UTC)
+	lines := []string{
+		record(t0, 0, "starting up"),
+		record(t0.Add(time.Minute), 1, "verbose detail"),
+		record(t0.Add(2*time.Minute), 2, "very verbose detail"),
+		record(t0.Add(3*time.Minute), 0, "shutting down"),
+		`{"logtail":{"client_time":"2022-08-01T12:04:00Z"},"metric":"up"}`,
+		`not json`,
+		`{"text":"no time"}`,
+	}
+	var data []byte
+	for _, l := range lines {
+		data = append(data, l+"\n"...)
+	}
+	if err := os.WriteFile(filepath.Join(dir, currentName), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		q    Query
+		want []string
+	}{
+		{"all", Query{MaxLevel: -1}, []string{"starting up", "verbose detail", "very verbose detail", "shutting down", "", "no time"}},
+		{"level0", Query{}, []string{"starting up", "shutting down", "", "no time"}},
+		{"level1", Query{MaxLevel: 1}, []string{"starting up", "verbose detail", "shutting down", "", "no time"}},
+		{"since", Query{MaxLevel: -1, Since: t0.Add(2 * time.Minute)}, []string{"very verbose detail", "shutting down", ""}},
+		{"until", Query{MaxLevel: -1, Until: t0.Add(time.Minute)}, []string{"starting up", "verbose detail"}},
+		{"range", Query{MaxLevel: -1, Since: t0.Add(time.Minute), Until: t0.Add(2 * time.Minute)}, []string{"verbose detail", "very verbose detail"}},
+		{"text", Query{MaxLevel: -1, Text: "detail"}, []string{"verbose detail", "very verbose detail"}},
+		{"text_in_fields", Query{MaxLevel: -1, Text: `"metric"`}, []string{""}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := readTexts(t, dir, tt.q)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQueryValues(t *testing.T) {
+	t0 := time.Date(2022, 8, 1, 12, 0, 0, 5, time.UTC)
+	for _, q := range []Query{
+		{MaxLevel: -1},
+		{MaxLevel: 2, Text: "foo bar"},
+		{Since: t0, Until: t0.Add(time.Hour)},
+	} {
+		got, err := ParseQuery(q.Values())
+		if err != nil {
+			t.Fatalf("ParseQuery(%v): %v", q.Values(), err)
+		}
+		if !reflect.DeepEqual(got, q) {
+			t.Errorf("round trip of %+v = %+v", q, got)
+		}
+	}
+	if q, err := ParseQuery(url.Values{}); err != nil || q.MaxLevel != -1 {
+		t.Errorf("ParseQuery(empty) = %+v, %v; want all levels", q, err)
+	}
+	if _, err := ParseQuery(url.Values{"since": {"yesterday"}}); err == nil {
+		t.Error("ParseQuery with bad since succeeded")
+	}
+}
+
+func TestReadSkipsLongLines(t *testing.T) {
+	dir := t.TempDir()
+	t0 := time.Date(2022, 8, 1, 12, 0, 0, 0, time.UTC)
+	long := record(t0, 0, strings.Repeat("x", maxRecordSize))
+	data := record(t0, 0, "before") + "\n" + long + "\n" + record(t0, 0, "after") // no final newline
+	if err := os.WriteFile(filepath.Join(dir, currentName), []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	got := readTexts(t, dir, Query{})
+	if want := []string{"before", "after"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q; want %q", got, want)
+	}
+}
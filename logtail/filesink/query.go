@@ -0,0 +1,132 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package filesink
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Record is a log record read back from a Sink's files.
+type Record struct {
+	// Time is the record's client time, or the zero time if it has
+	// none.
+	Time time.Time
+
+	// Level is the record's verbosity level, from its "v" field. Zero
+	// is the default level.
+	Level int
+
+	// Text is the record's "text" field, which is empty for
+	// structured records.
+	Text string
+
+	// Raw is the whole record as it was logged.
+	Raw json.RawMessage
+}
+
+// ParseRecord parses one line of a log file.
+func ParseRecord(line []byte) (*Record, error) {
+	var v struct {
+		Logtail struct {
+			ClientTime time.Time `json:"client_time"`
+		} `json:"logtail"`
+		Level int    `json:"v"`
+		Text  string `json:"text"`
+	}
+	if err := json.Unmarshal(line, &v); err != nil {
+		return nil, err
+	}
+	return &Record{
+		Time:  v.Logtail.ClientTime,
+		Level: v.Level,
+		Text:  v.Text,
+		Raw:   append(json.RawMessage(nil), line...),
+	}, nil
+}
+
+// Query selects log records. The zero Query matches all records at
+// the default level; set MaxLevel to -1 to also match verbose ones.
+type Query struct {
+	// Since and Until, if non-zero, bound the records' times,
+	// inclusively. Records without a time never match a bounded
+	// Query.
+	Since, Until time.Time
+
+	// MaxLevel is the most verbose level to match. Negative means
+	// all levels.
+	MaxLevel int
+
+	// Text, if non-empty, is a substring that the record, as logged,
+	// must contain.
+	Text string
+}
+
+// Match reports whether r matches q.
+func (q Query) Match(r *Record) bool {
+	if !q.Since.IsZero() || !q.Until.IsZero() {
+		if r.Time.IsZero() {
+			return false
+		}
+		if !q.Since.IsZero() && r.Time.Before(q.Since) {
+			return false
+		}
+		if !q.Until.IsZero() && r.Time.After(q.Until) {
+			return false
+		}
+	}
+	if q.MaxLevel >= 0 && r.Level > q.MaxLevel {
+		return false
+	}
+	if q.Text != "" && !bytes.Contains(r.Raw, []byte(q.Text)) {
+		return false
+	}
+	return true
+}
+
+// Values returns q encoded as URL query parameters, for ParseQuery.
+func (q Query) Values() url.Values {
+	v := url.Values{}
+	if !q.Since.IsZero() {
+		v.Set("since", q.Since.UTC().Format(time.RFC3339Nano))
+	}
+	if !q.Until.IsZero() {
+		v.Set("until", q.Until.UTC().Format(time.RFC3339Nano))
+	}
+	v.Set("level", strconv.Itoa(q.MaxLevel))
+	if q.Text != "" {
+		v.Set("q", q.Text)
+	}
+	return v
+}
+
+// ParseQuery parses a Query from URL query parameters, as returned by
+// Query.Values. A missing level means all levels.
+func ParseQuery(v url.Values) (Query, error) {
+	q := Query{MaxLevel: -1}
+	var err error
+	if s := v.Get("since"); s != "" {
+		if q.Since, err = time.Parse(time.RFC3339Nano, s); err != nil {
+			return Query{}, fmt.Errorf("bad since: %w", err)
+		}
+	}
+	if s := v.Get("until"); s != "" {
+		if q.Until, err = time.Parse(time.RFC3339Nano, s); err != nil {
+			return Query{}, fmt.Errorf("bad until: %w", err)
+		}
+	}
+	if s := v.Get("level"); s != "" {
+		if q.MaxLevel, err = strconv.Atoi(s); err != nil {
+			return Query{}, errors.New("bad level")
+		}
+	}
+	q.Text = v.Get("q")
+	return q, nil
+}
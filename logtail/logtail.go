@@ -76,6 +76,19 @@ type Config struct {
 	// being included in the logs. The sequence number is incremented for each
 	// log message sent, but is not peristed across process restarts.
 	IncludeProcSequence bool
+
+	// LocalSink, if non-nil, is where logs are written instead of
+	// being uploaded to a log server. BaseURL, HTTPC and
+	// NewZstdEncoder are then unused.
+	LocalSink LocalSink
+}
+
+// LocalSink stores logs locally instead of uploading them.
+// See package tailscale.com/logtail/filesink for an implementation.
+type LocalSink interface {
+	// WriteLogs writes batch, a JSON array of log records, in the
+	// form in which they would have been uploaded.
+	WriteLogs(batch []byte) error
 }
 
 func NewLogger(cfg Config, logf tslogger.Logf) *Logger {
@@ -124,6 +137,7 @@ func NewLogger(cfg Config, logf tslogger.Logf) *Logger {
 		timeNow:        cfg.TimeNow,
 		bo:             backoff.NewBackoff("logtail", logf, 30*time.Second),
 		metricsDelta:   cfg.MetricsDelta,
+		localSink:      cfg.LocalSink,
 
 		procID:              procID,
 		includeProcSequence: cfg.IncludeProcSequence,
@@ -131,7 +145,7 @@ func NewLogger(cfg Config, logf tslogger.Logf) *Logger {
 		shutdownStart: make(chan struct{}),
 		shutdownDone:  make(chan struct{}),
 	}
-	if cfg.NewZstdEncoder != nil {
+	if cfg.NewZstdEncoder != nil && cfg.LocalSink == nil {
 		l.zstdEncoder = cfg.NewZstdEncoder()
 	}
 
@@ -164,6 +178,7 @@ type Logger struct {
 	explainedRaw   bool
 	metricsDelta   func() string // or nil
 	privateID      PrivateID
+	localSink      LocalSink // or nil
 
 	procID              uint32
 	includeProcSequence bool
@@ -340,9 +355,16 @@ func (l *Logger) uploading(ctx context.Context) {
 				return
 			default:
 			}
-			uploaded, err := l.upload(ctx, body, origlen)
+			var uploaded bool
+			var err error
+			if l.localSink != nil {
+				err = l.localSink.WriteLogs(body)
+				uploaded = err == nil
+			} else {
+				uploaded, err = l.upload(ctx, body, origlen)
+			}
 			if err != nil {
-				if !l.internetUp() {
+				if l.localSink == nil && !l.internetUp() {
 					fmt.Fprintf(l.stderr, "logtail: internet down; waiting\n")
 					l.awaitInternetUp(ctx)
 					continue
@@ -96,6 +96,38 @@ func TestDrainPendingMessages(t *testing.T) {
 	}
 }
 
+type chanSink chan []byte
+
+func (c chanSink) WriteLogs(batch []byte) error {
+	c <- append([]byte(nil), batch...)
+	return nil
+}
+
+func TestLocalSink(t *testing.T) {
+	sink := make(chanSink, 2+logLines)
+	l := NewLogger(Config{
+		BaseURL:   "http://invalid.example", // never used
+		LocalSink: sink,
+	}, t.Logf)
+	l.Write([]byte("log line"))
+
+	var body string
+	for !strings.Contains(body, "log line") {
+		b := <-sink
+		var records []map[string]any
+		if err := json.Unmarshal(b, &records); err != nil {
+			t.Fatalf("sink got %q: %v", b, err)
+		}
+		body += string(b)
+	}
+	if !strings.Contains(body, "logtail started") {
+		t.Errorf("sink didn't get start message; got %q", body)
+	}
+	if err := l.Shutdown(context.Background()); err != nil {
+		t.Error(err)
+	}
+}
+
 func TestEncodeAndUploadMessages(t *testing.T) {
 	ts, l := NewLogtailTestHarness(t)
 
@@ -0,0 +1,174 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// timeNow is time.Now, pulled out for tests.
+var timeNow = time.Now
+
+// Histogram is a cumulative histogram of observed values with fixed
+// bucket upper bounds. tsweb exports it as a Prometheus histogram.
+//
+// Observations may carry an exemplar, such as a trace ID, which is
+// included in the OpenMetrics exposition of the bucket it falls in.
+type Histogram struct {
+	// Help, if non-empty, is the metric's help text.
+	Help string
+
+	bounds []float64 // bucket upper bounds, increasing; +Inf is implicit
+
+	mu        sync.Mutex
+	counts    []uint64    // per bucket, not cumulative; len(bounds)+1
+	exemplars []*exemplar // latest per bucket, or nil; len(bounds)+1
+	sum       float64
+	count     uint64
+}
+
+type exemplar struct {
+	labels [][2]string // sorted by name
+	value  float64
+	time   time.Time
+}
+
+// NewHistogram returns a Histogram with the given bucket upper
+// bounds, which must be increasing. A final +Inf bucket is implicit.
+func NewHistogram(buckets []float64) *Histogram {
+	if !sort.Float64sAreSorted(buckets) {
+		panic("metrics: histogram buckets not sorted")
+	}
+	for i := 1; i < len(buckets); i++ {
+		if buckets[i] == buckets[i-1] {
+			panic("metrics: duplicate histogram bucket")
+		}
+	}
+	return &Histogram{
+		bounds:    append([]float64(nil), buckets...),
+		counts:    make([]uint64, len(buckets)+1),
+		exemplars: make([]*exemplar, len(buckets)+1),
+	}
+}
+
+// Observe records v.
+func (h *Histogram) Observe(v float64) {
+	h.observe(v, nil)
+}
+
+// ObserveWithExemplar records v along with an exemplar, labels such as
+// {"trace_id": "..."}, identifying where it came from. The exemplar
+// replaces any previous one of the bucket that v falls in.
+func (h *Histogram) ObserveWithExemplar(v float64, labels map[string]string) {
+	e := &exemplar{value: v, time: timeNow()}
+	for k, v := range labels {
+		e.labels = append(e.labels, [2]string{k, v})
+	}
+	sort.Slice(e.labels, func(i, j int) bool { return e.labels[i][0] < e.labels[j][0] })
+	h.observe(v, e)
+}
+
+func (h *Histogram) observe(v float64, e *exemplar) {
+	i := sort.SearchFloat64s(h.bounds, v) // first bound >= v
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.counts[i]++
+	h.sum += v
+	h.count++
+	if e != nil {
+		h.exemplars[i] = e
+	}
+}
+
+// String implements expvar.Var. It returns a JSON object with the
+// cumulative bucket counts, sum and count.
+func (h *Histogram) String() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var b bytes.Buffer
+	b.WriteString(`{"buckets": {`)
+	var cum uint64
+	for i, c := range h.counts {
+		cum += c
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		fmt.Fprintf(&b, "%q: %d", h.le(i), cum)
+	}
+	fmt.Fprintf(&b, `}, "sum": %v, "count": %d}`, h.sum, h.count)
+	return b.String()
+}
+
+// le returns the "le" label value of bucket i.
+func (h *Histogram) le(i int) string {
+	if i == len(h.bounds) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(h.bounds[i], 'g', -1, 64)
+}
+
+// WritePrometheus writes h to w as the histogram metric name, in the
+// Prometheus text format.
+func (h *Histogram) WritePrometheus(w io.Writer, name string) {
+	h.write(w, name, false)
+}
+
+// WriteOpenMetrics writes h to w as the histogram metric name, in the
+// OpenMetrics text format, including exemplars.
+func (h *Histogram) WriteOpenMetrics(w io.Writer, name string) {
+	h.write(w, name, true)
+}
+
+// WritePrometheusSamples writes h's samples to w as the histogram
+// metric name, in the Prometheus text format, adding labels, which
+// are formatted as inside braces (`a="b",c="d"`), to each. Unlike
+// WritePrometheus, it writes no HELP or TYPE line, so that histograms
+// with different labels can be written as one metric.
+func (h *Histogram) WritePrometheusSamples(w io.Writer, name, labels string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.writeSamplesLocked(w, name, labels, false)
+}
+
+func (h *Histogram) write(w io.Writer, name string, openMetrics bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.Help != "" {
+		fmt.Fprintf(w, "# HELP %s %s\n", name, h.Help)
+	}
+	fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+	h.writeSamplesLocked(w, name, "", openMetrics)
+}
+
+func (h *Histogram) writeSamplesLocked(w io.Writer, name, labels string, openMetrics bool) {
+	bucketLabels, sumLabels := "", ""
+	if labels != "" {
+		bucketLabels, sumLabels = labels+",", "{"+labels+"}"
+	}
+	var cum uint64
+	for i, c := range h.counts {
+		cum += c
+		fmt.Fprintf(w, "%s_bucket{%sle=\"%s\"} %d", name, bucketLabels, h.le(i), cum)
+		if e := h.exemplars[i]; openMetrics && e != nil {
+			io.WriteString(w, " # {")
+			for j, l := range e.labels {
+				if j > 0 {
+					io.WriteString(w, ",")
+				}
+				fmt.Fprintf(w, "%s=\"%s\"", l[0], EscapeLabelValue(l[1]))
+			}
+			fmt.Fprintf(w, "} %v %s", e.value, strconv.FormatFloat(float64(e.time.UnixMilli())/1000, 'f', 3, 64))
+		}
+		io.WriteString(w, "\n")
+	}
+	fmt.Fprintf(w, "%s_sum%s %v\n", name, sumLabels, h.sum)
+	fmt.Fprintf(w, "%s_count%s %d\n", name, sumLabels, h.count)
+}
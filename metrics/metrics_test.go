@@ -5,9 +5,11 @@
 package metrics
 
 import (
+	"bytes"
 	"os"
 	"runtime"
 	"testing"
+	"time"
 
 	"tailscale.com/tstest"
 )
@@ -51,3 +53,114 @@ func BenchmarkCurrentFileDescriptors(b *testing.B) {
 		_ = CurrentFDs()
 	}
 }
+
+func TestMultiLabelMap(t *testing.T) {
+	m := &MultiLabelMap{
+		Type:   "counter",
+		Help:   "things, by color and size",
+		Labels: []string{"color", "size"},
+	}
+	m.Get("red", "big").Add(2)
+	m.Get("blue", "small").Add(1)
+	m.Get("red", "big").Add(1)
+	m.Get("blue", "with \"quotes\"\n").Add(4)
+
+	if got, want := m.String(), `{"color=blue,size=small": 1, "color=blue,size=with \"quotes\"\n": 4, "color=red,size=big": 3}`; got != want {
+		t.Errorf("String = %s; want %s", got, want)
+	}
+
+	var buf bytes.Buffer
+	m.WritePrometheus(&buf, "things")
+	if got, want := buf.String(), `# HELP things things, by color and size
+# TYPE things counter
+things{color="blue",size="small"} 1
+things{color="blue",size="with \"quotes\"\n"} 4
+things{color="red",size="big"} 3
+`; got != want {
+		t.Errorf("Prometheus:\n got: %s\nwant: %s", got, want)
+	}
+
+	buf.Reset()
+	m.WriteOpenMetrics(&buf, "things")
+	if got, want := buf.String(), `# HELP things things, by color and size
+# TYPE things counter
+things_total{color="blue",size="small"} 1
+things_total{color="blue",size="with \"quotes\"\n"} 4
+things_total{color="red",size="big"} 3
+`; got != want {
+		t.Errorf("OpenMetrics:\n got: %s\nwant: %s", got, want)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Get with wrong number of values didn't panic")
+		}
+	}()
+	m.Get("red")
+}
+
+func TestHistogram(t *testing.T) {
+	defer func(old func() time.Time) { timeNow = old }(timeNow)
+	timeNow = func() time.Time { return time.Unix(1660000000, 123456789) }
+
+	h := NewHistogram([]float64{0.1, 1, 10})
+	h.Help = "how long things took"
+	h.Observe(0.05)
+	h.Observe(0.1) // upper bounds are inclusive
+	h.Observe(5)
+	h.ObserveWithExemplar(0.5, map[string]string{"trace_id": "abc", "a": "b"})
+	h.Observe(100)
+
+	if got, want := h.String(), `{"buckets": {"0.1": 2, "1": 3, "10": 4, "+Inf": 5}, "sum": 105.65, "count": 5}`; got != want {
+		t.Errorf("String = %s; want %s", got, want)
+	}
+
+	var buf bytes.Buffer
+	h.WritePrometheus(&buf, "took_seconds")
+	if got, want := buf.String(), `# HELP took_seconds how long things took
+# TYPE took_seconds histogram
+took_seconds_bucket{le="0.1"} 2
+took_seconds_bucket{le="1"} 3
+took_seconds_bucket{le="10"} 4
+took_seconds_bucket{le="+Inf"} 5
+took_seconds_sum 105.65
+took_seconds_count 5
+`; got != want {
+		t.Errorf("Prometheus:\n got: %s\nwant: %s", got, want)
+	}
+
+	buf.Reset()
+	h.WriteOpenMetrics(&buf, "took_seconds")
+	if got, want := buf.String(), `# HELP took_seconds how long things took
+# TYPE took_seconds histogram
+took_seconds_bucket{le="0.1"} 2
+took_seconds_bucket{le="1"} 3 # {a="b",trace_id="abc"} 0.5 1660000000.123
+took_seconds_bucket{le="10"} 4
+took_seconds_bucket{le="+Inf"} 5
+took_seconds_sum 105.65
+took_seconds_count 5
+`; got != want {
+		t.Errorf("OpenMetrics:\n got: %s\nwant: %s", got, want)
+	}
+
+	buf.Reset()
+	h.WritePrometheusSamples(&buf, "took_seconds", `job="x"`)
+	if got, want := buf.String(), `took_seconds_bucket{job="x",le="0.1"} 2
+took_seconds_bucket{job="x",le="1"} 3
+took_seconds_bucket{job="x",le="10"} 4
+took_seconds_bucket{job="x",le="+Inf"} 5
+took_seconds_sum{job="x"} 105.65
+took_seconds_count{job="x"} 5
+`; got != want {
+		t.Errorf("Prometheus samples:\n got: %s\nwant: %s", got, want)
+	}
+}
+
+func TestNewHistogramUnsorted(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("NewHistogram with unsorted buckets didn't panic")
+		}
+	}()
+	NewHistogram([]float64{1, 0.5})
+}
@@ -0,0 +1,182 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package metrics
+
+import (
+	"bytes"
+	"expvar"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// MultiLabelMap is a collection of counters or gauges of the same
+// metric, broken down by the values of several labels. For example,
+// dropped packets by both drop reason and packet type.
+//
+// Use this rather than LabelMap when there's more than one label.
+// tsweb exports it as a single metric family with one series per
+// combination of label values.
+type MultiLabelMap struct {
+	// Type is the Prometheus type of the metric, "counter" or
+	// "gauge".
+	Type string
+
+	// Help, if non-empty, is the metric's help text.
+	Help string
+
+	// Labels are the names of the labels, in the order in which Get
+	// and GetFloat take their values.
+	Labels []string
+
+	mu sync.RWMutex
+	m  map[string]*labeledVar // keyed by labelKey
+}
+
+type labeledVar struct {
+	values []string
+	v      expvar.Var // *expvar.Int or *expvar.Float
+}
+
+func labelKey(values []string) string {
+	return strings.Join(values, "\x00")
+}
+
+// Get returns a direct pointer to the expvar.Int for the given label
+// values, creating it if necessary. It panics if the number of values
+// doesn't match m.Labels, or if the var was created by GetFloat.
+func (m *MultiLabelMap) Get(values ...string) *expvar.Int {
+	return m.get(values, func() expvar.Var { return new(expvar.Int) }).(*expvar.Int)
+}
+
+// GetFloat returns a direct pointer to the expvar.Float for the given
+// label values, creating it if necessary. It panics if the number of
+// values doesn't match m.Labels, or if the var was created by Get.
+func (m *MultiLabelMap) GetFloat(values ...string) *expvar.Float {
+	return m.get(values, func() expvar.Var { return new(expvar.Float) }).(*expvar.Float)
+}
+
+func (m *MultiLabelMap) get(values []string, newVar func() expvar.Var) expvar.Var {
+	if len(values) != len(m.Labels) {
+		panic(fmt.Sprintf("metrics: MultiLabelMap with labels %q got %d values", m.Labels, len(values)))
+	}
+	k := labelKey(values)
+	m.mu.RLock()
+	lv := m.m[k]
+	m.mu.RUnlock()
+	if lv != nil {
+		return lv.v
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if lv := m.m[k]; lv != nil {
+		return lv.v
+	}
+	if m.m == nil {
+		m.m = map[string]*labeledVar{}
+	}
+	lv = &labeledVar{values: append([]string(nil), values...), v: newVar()}
+	m.m[k] = lv
+	return lv.v
+}
+
+// Do calls f for each set of label values and its var, in
+// lexicographical order of the label values.
+func (m *MultiLabelMap) Do(f func(values []string, v expvar.Var)) {
+	m.mu.RLock()
+	keys := make([]string, 0, len(m.m))
+	for k := range m.m {
+		keys = append(keys, k)
+	}
+	vars := make([]*labeledVar, len(keys))
+	sort.Strings(keys)
+	for i, k := range keys {
+		vars[i] = m.m[k]
+	}
+	m.mu.RUnlock()
+	for _, lv := range vars {
+		f(lv.values, lv.v)
+	}
+}
+
+// String implements expvar.Var. It returns a JSON object mapping
+// "label=value,label=value" to each var's value.
+func (m *MultiLabelMap) String() string {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	first := true
+	m.Do(func(values []string, v expvar.Var) {
+		if !first {
+			b.WriteString(", ")
+		}
+		first = false
+		var k strings.Builder
+		for i, l := range m.Labels {
+			if i > 0 {
+				k.WriteByte(',')
+			}
+			k.WriteString(l)
+			k.WriteByte('=')
+			k.WriteString(values[i])
+		}
+		fmt.Fprintf(&b, "%q: %v", k.String(), v)
+	})
+	b.WriteByte('}')
+	return b.String()
+}
+
+// WritePrometheus writes m to w as the metric name, in the Prometheus
+// text format.
+func (m *MultiLabelMap) WritePrometheus(w io.Writer, name string) {
+	m.write(w, name, false)
+}
+
+// WriteOpenMetrics writes m to w as the metric name, in the
+// OpenMetrics text format.
+func (m *MultiLabelMap) WriteOpenMetrics(w io.Writer, name string) {
+	m.write(w, name, true)
+}
+
+func (m *MultiLabelMap) write(w io.Writer, name string, openMetrics bool) {
+	family, sample := name, name
+	if openMetrics && m.Type == "counter" {
+		family, sample = CounterNames(name)
+	}
+	if m.Help != "" {
+		fmt.Fprintf(w, "# HELP %s %s\n", family, m.Help)
+	}
+	if m.Type != "" {
+		fmt.Fprintf(w, "# TYPE %s %s\n", family, m.Type)
+	}
+	m.Do(func(values []string, v expvar.Var) {
+		io.WriteString(w, sample)
+		io.WriteString(w, "{")
+		for i, l := range m.Labels {
+			if i > 0 {
+				io.WriteString(w, ",")
+			}
+			fmt.Fprintf(w, "%s=\"%s\"", l, EscapeLabelValue(values[i]))
+		}
+		fmt.Fprintf(w, "} %v\n", v)
+	})
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// EscapeLabelValue escapes v for use between the double quotes of a
+// label value in the Prometheus and OpenMetrics text formats.
+func EscapeLabelValue(v string) string {
+	return labelValueEscaper.Replace(v)
+}
+
+// CounterNames returns the metric family name and sample name of the
+// counter name in the OpenMetrics text format, where counter samples
+// end in "_total" but their family name doesn't.
+func CounterNames(name string) (family, sample string) {
+	family = strings.TrimSuffix(name, "_total")
+	return family, family + "_total"
+}
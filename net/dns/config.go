@@ -44,6 +44,12 @@ type Config struct {
 	// OnlyIPv6, if true, uses the IPv6 service IP (for MagicDNS)
 	// instead of the IPv4 version (100.100.100.100).
 	OnlyIPv6 bool
+	// DNS64Routes are the IPv4 prefixes that peers translate to from
+	// the Tailscale NAT64 range. If non-empty, 100.100.100.100
+	// answers AAAA queries for names without AAAA records but with A
+	// records in these prefixes with synthesized records (DNS64), and
+	// so must be the OS's resolver for all names.
+	DNS64Routes []netaddr.IPPrefix
 }
 
 func (c *Config) serviceIP() netaddr.IP {
@@ -64,13 +70,20 @@ func (c *Config) WriteToBufioWriter(w *bufio.Writer) {
 
 	fmt.Fprintf(w, " SearchDomains:%v", c.SearchDomains)
 	fmt.Fprintf(w, " Hosts:%v", len(c.Hosts))
+	if c.hasDNS64() {
+		fmt.Fprintf(w, " DNS64Routes:%v", c.DNS64Routes)
+	}
 	w.WriteString("}")
 }
 
 // needsAnyResolvers reports whether c requires a resolver to be set
 // at the OS level.
 func (c Config) needsOSResolver() bool {
-	return c.hasDefaultResolvers() || c.hasRoutes()
+	return c.hasDefaultResolvers() || c.hasRoutes() || c.hasDNS64()
+}
+
+func (c Config) hasDNS64() bool {
+	return len(c.DNS64Routes) > 0
 }
 
 func (c Config) hasRoutes() bool {
@@ -139,6 +152,21 @@ func sameResolverNames(a, b []*dnstype.Resolver) bool {
 		if !sameIPs(a[i].BootstrapResolution, b[i].BootstrapResolution) {
 			return false
 		}
+		if !sameStrings(a[i].TLSPins, b[i].TLSPins) {
+			return false
+		}
+	}
+	return true
+}
+
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
 	}
 	return true
 }
@@ -140,6 +140,8 @@ func (m *resolvconfManager) SupportsSplitDNS() bool {
 	return false
 }
 
+func (m *resolvconfManager) Mode() string { return "debian-resolvconf" }
+
 func (m *resolvconfManager) GetBaseConfig() (OSConfig, error) {
 	var bs bytes.Buffer
 
@@ -337,6 +337,8 @@ func (m *directManager) SupportsSplitDNS() bool {
 	return false
 }
 
+func (m *directManager) Mode() string { return "direct" }
+
 func (m *directManager) GetBaseConfig() (OSConfig, error) {
 	owned, err := m.ownedByTailscale()
 	if err != nil {
@@ -12,6 +12,7 @@
 	"io"
 	"net"
 	"runtime"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -88,6 +89,10 @@ type Manager struct {
 
 	resolver *resolver.Resolver
 	os       OSConfigurator
+
+	mu   sync.Mutex // guards following
+	cfg  Config     // last config successfully compiled by Set
+	ocfg OSConfig   // OS config compiled from cfg
 }
 
 // NewManagers created a new manager from the given config.
@@ -110,6 +115,33 @@ func NewManager(logf logger.Logf, oscfg OSConfigurator, linkMon *monitor.Mon, di
 // Resolver returns the Manager's DNS Resolver.
 func (m *Manager) Resolver() *resolver.Resolver { return m.resolver }
 
+// Status is the state of a Manager, for diagnostics.
+type Status struct {
+	// Config is the last config applied by Set.
+	Config Config
+	// OSConfig is the configuration applied to the OS for Config.
+	OSConfig OSConfig
+	// OSConfiguratorMode is how the OS's DNS is configured.
+	// See OSConfiguratorMode.
+	OSConfiguratorMode string
+	// SupportsSplitDNS is whether the OS configurator can install
+	// resolvers for specific DNS suffixes.
+	SupportsSplitDNS bool
+}
+
+// Status returns the current state of m.
+func (m *Manager) Status() Status {
+	m.mu.Lock()
+	cfg, ocfg := m.cfg, m.ocfg
+	m.mu.Unlock()
+	return Status{
+		Config:             cfg,
+		OSConfig:           ocfg,
+		OSConfiguratorMode: OSConfiguratorMode(m.os),
+		SupportsSplitDNS:   m.os.SupportsSplitDNS(),
+	}
+}
+
 func (m *Manager) Set(cfg Config) error {
 	m.logf("Set: %v", logger.ArgWriter(func(w *bufio.Writer) {
 		cfg.WriteToBufioWriter(w)
@@ -125,6 +157,10 @@ func (m *Manager) Set(cfg Config) error {
 	}))
 	m.logf("OScfg: %+v", ocfg)
 
+	m.mu.Lock()
+	m.cfg, m.ocfg = cfg, ocfg
+	m.mu.Unlock()
+
 	if err := m.resolver.SetConfig(rcfg); err != nil {
 		return err
 	}
@@ -144,6 +180,7 @@ func (m *Manager) compileConfig(cfg Config) (rcfg resolver.Config, ocfg OSConfig
 	// authoritative suffixes, even if we don't propagate MagicDNS to
 	// the OS.
 	rcfg.Hosts = cfg.Hosts
+	rcfg.DNS64Routes = cfg.DNS64Routes
 	routes := map[dnsname.FQDN][]*dnstype.Resolver{} // assigned conditionally to rcfg.Routes below.
 	for suffix, resolvers := range cfg.Routes {
 		if len(resolvers) == 0 {
@@ -162,7 +199,7 @@ func (m *Manager) compileConfig(cfg Config) (rcfg resolver.Config, ocfg OSConfig
 		// case where cfg is entirely zero, in which case these
 		// configs clear all Tailscale DNS settings.
 		return rcfg, ocfg, nil
-	case cfg.hasDefaultIPResolversOnly():
+	case cfg.hasDefaultIPResolversOnly() && !cfg.hasDNS64():
 		// Trivial CorpDNS configuration, just override the OS
 		// resolver.
 		// TODO: for OSes that support it, pass IP:port and DoH
@@ -200,7 +237,10 @@ func (m *Manager) compileConfig(cfg Config) (rcfg resolver.Config, ocfg OSConfig
 	// This bool is used in a couple of places below to implement this
 	// workaround.
 	isWindows := runtime.GOOS == "windows"
-	if cfg.singleResolverSet() != nil && m.os.SupportsSplitDNS() && !isWindows {
+	// DNS64 likewise needs quad-100 to see the queries for all names,
+	// to synthesize AAAA records for them.
+	fullProxy := isWindows || cfg.hasDNS64()
+	if cfg.singleResolverSet() != nil && m.os.SupportsSplitDNS() && !fullProxy {
 		// Split DNS configuration requested, where all split domains
 		// go to the same resolvers. We can let the OS do it.
 		ocfg.Nameservers = toIPsOnly(cfg.singleResolverSet())
@@ -216,10 +256,10 @@ func (m *Manager) compileConfig(cfg Config) (rcfg resolver.Config, ocfg OSConfig
 
 	// If the OS can't do native split-dns, read out the underlying
 	// resolver config and blend it into our config.
-	if m.os.SupportsSplitDNS() {
+	if m.os.SupportsSplitDNS() && !cfg.hasDNS64() {
 		ocfg.MatchDomains = cfg.matchDomains()
 	}
-	if !m.os.SupportsSplitDNS() || isWindows {
+	if !m.os.SupportsSplitDNS() || fullProxy {
 		bcfg, err := m.os.GetBaseConfig()
 		if err != nil {
 			health.SetDNSOSHealth(err)
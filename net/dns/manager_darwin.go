@@ -35,6 +35,8 @@ func (c *darwinConfigurator) SupportsSplitDNS() bool {
 	return true
 }
 
+func (c *darwinConfigurator) Mode() string { return "darwin" }
+
 func (c *darwinConfigurator) SetDNS(cfg OSConfig) error {
 	var buf bytes.Buffer
 	buf.WriteString(macResolverFileHeader)
@@ -371,6 +371,29 @@ func TestManager(t *testing.T) {
 				LocalDomains: fqdns("ts.com."),
 			},
 		},
+		{
+			name: "dns64-split",
+			in: Config{
+				Routes:        upstreams("corp.com", "2.2.2.2"),
+				SearchDomains: fqdns("tailscale.com", "universe.tf"),
+				DNS64Routes:   []netaddr.IPPrefix{netaddr.MustParseIPPrefix("10.0.0.0/8")},
+			},
+			split: true,
+			bs: OSConfig{
+				Nameservers:   mustIPs("8.8.8.8"),
+				SearchDomains: fqdns("coffee.shop"),
+			},
+			os: OSConfig{
+				Nameservers:   mustIPs("100.100.100.100"),
+				SearchDomains: fqdns("tailscale.com", "universe.tf", "coffee.shop"),
+			},
+			rs: resolver.Config{
+				Routes: upstreams(
+					".", "8.8.8.8",
+					"corp.com.", "2.2.2.2"),
+				DNS64Routes: []netaddr.IPPrefix{netaddr.MustParseIPPrefix("10.0.0.0/8")},
+			},
+		},
 		{
 			name: "exit-node-forward",
 			in: Config{
@@ -394,6 +417,7 @@ func TestManager(t *testing.T) {
 	}
 
 	trIP := cmp.Transformer("ipStr", func(ip netaddr.IP) string { return ip.String() })
+	trIPPrefix := cmp.Transformer("ippfxStr", func(p netaddr.IPPrefix) string { return p.String() })
 	trIPPort := cmp.Transformer("ippStr", func(ipp netaddr.IPPort) string {
 		if ipp.Port() == 53 {
 			return ipp.IP().String()
@@ -413,10 +437,10 @@ func TestManager(t *testing.T) {
 			if err := m.Set(test.in); err != nil {
 				t.Fatalf("m.Set: %v", err)
 			}
-			if diff := cmp.Diff(f.OSConfig, test.os, trIP, trIPPort, cmpopts.EquateEmpty()); diff != "" {
+			if diff := cmp.Diff(f.OSConfig, test.os, trIP, trIPPort, trIPPrefix, cmpopts.EquateEmpty()); diff != "" {
 				t.Errorf("wrong OSConfig (-got+want)\n%s", diff)
 			}
-			if diff := cmp.Diff(f.ResolverConfig, test.rs, trIP, trIPPort, cmpopts.EquateEmpty()); diff != "" {
+			if diff := cmp.Diff(f.ResolverConfig, test.rs, trIP, trIPPort, trIPPrefix, cmpopts.EquateEmpty()); diff != "" {
 				t.Errorf("wrong resolver.Config (-got+want)\n%s", diff)
 			}
 		})
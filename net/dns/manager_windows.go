@@ -296,6 +296,8 @@ func (m windowsManager) SupportsSplitDNS() bool {
 	return m.nrptDB != nil
 }
 
+func (m windowsManager) Mode() string { return "windows" }
+
 func (m windowsManager) Close() error {
 	err := m.SetDNS(OSConfig{})
 	if m.nrptDB != nil {
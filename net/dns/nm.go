@@ -272,6 +272,8 @@ func (m *nmManager) SupportsSplitDNS() bool {
 	return mode == "dnsmasq" || mode == "systemd-resolved"
 }
 
+func (m *nmManager) Mode() string { return "network-manager" }
+
 func (m *nmManager) GetBaseConfig() (OSConfig, error) {
 	conn, err := dbus.SystemBus()
 	if err != nil {
@@ -52,6 +52,8 @@ func (m openresolvManager) SupportsSplitDNS() bool {
 	return false
 }
 
+func (m openresolvManager) Mode() string { return "openresolv" }
+
 func (m openresolvManager) GetBaseConfig() (OSConfig, error) {
 	// List the names of all config snippets openresolv is aware
 	// of. Snippets get listed in priority order (most to least),
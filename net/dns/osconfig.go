@@ -6,6 +6,7 @@
 
 import (
 	"errors"
+	"fmt"
 
 	"inet.af/netaddr"
 	"tailscale.com/util/dnsname"
@@ -87,6 +88,15 @@ func (a OSConfig) Equal(b OSConfig) bool {
 	return true
 }
 
+// OSConfiguratorMode returns a short name for how c configures the OS's
+// DNS, such as "systemd-resolved" or "direct", for diagnostics.
+func OSConfiguratorMode(c OSConfigurator) string {
+	if m, ok := c.(interface{ Mode() string }); ok {
+		return m.Mode()
+	}
+	return fmt.Sprintf("%T", c)
+}
+
 // ErrGetBaseConfigNotSupported is the error
 // OSConfigurator.GetBaseConfig returns when the OSConfigurator
 // doesn't support reading the underlying configuration out of the OS.
@@ -74,6 +74,8 @@ func (m *resolvdManager) SupportsSplitDNS() bool {
 	return false
 }
 
+func (m *resolvdManager) Mode() string { return "resolvd" }
+
 func (m *resolvdManager) GetBaseConfig() (OSConfig, error) {
 	cfg, err := m.readResolvConf()
 	if err != nil {
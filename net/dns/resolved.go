@@ -390,6 +390,8 @@ func (m *resolvedManager) SupportsSplitDNS() bool {
 	return true
 }
 
+func (m *resolvedManager) Mode() string { return "systemd-resolved" }
+
 func (m *resolvedManager) GetBaseConfig() (OSConfig, error) {
 	return OSConfig{}, ErrGetBaseConfigNotSupported
 }
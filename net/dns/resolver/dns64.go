@@ -0,0 +1,141 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package resolver
+
+import (
+	"context"
+
+	dns "golang.org/x/net/dns/dnsmessage"
+	"inet.af/netaddr"
+	"tailscale.com/net/tsaddr"
+)
+
+// dns64 returns the response to query, an AAAA query whose forwarded
+// response res has no AAAA records, with AAAA records in the Tailscale
+// NAT64 range synthesized (per RFC 6147) from the name's A records in
+// the DNS64 routes. ok is false if query isn't eligible for DNS64 or
+// the name has no such A records, in which case res should be used.
+func (r *Resolver) dns64(ctx context.Context, query, res []byte, from netaddr.IPPort) (out []byte, ok bool) {
+	r.mu.Lock()
+	isDNS64IP := r.isDNS64IP
+	r.mu.Unlock()
+	if isDNS64IP == nil {
+		return nil, false
+	}
+	aQuery, ok := dns64Query(query, res)
+	if !ok {
+		return nil, false
+	}
+	responses := make(chan packet, 1)
+	defer close(responses)
+	if err := r.forwarder.forwardWithDestChan(ctx, packet{aQuery, from}, responses); err != nil {
+		return nil, false
+	}
+	aRes := <-responses
+	out, ok = synthesizeAAAA(res, aRes.bs, isDNS64IP)
+	if ok {
+		metricDNSQueryDNS64.Add(1)
+	}
+	return out, ok
+}
+
+// dns64Query returns the A query to make for DNS64 if query is an AAAA
+// query and res a successful response to it without AAAA records.
+func dns64Query(query, res []byte) (aQuery []byte, ok bool) {
+	var p dns.Parser
+	h, err := p.Start(query)
+	if err != nil {
+		return nil, false
+	}
+	q, err := p.Question()
+	if err != nil || q.Type != dns.TypeAAAA || q.Class != dns.ClassINET {
+		return nil, false
+	}
+
+	rh, err := p.Start(res)
+	if err != nil || rh.RCode != dns.RCodeSuccess {
+		return nil, false
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return nil, false
+	}
+	for {
+		ah, err := p.AnswerHeader()
+		if err == dns.ErrSectionDone {
+			break
+		}
+		if err != nil || ah.Type == dns.TypeAAAA {
+			return nil, false
+		}
+		if err := p.SkipAnswer(); err != nil {
+			return nil, false
+		}
+	}
+
+	b := dns.NewBuilder(nil, dns.Header{ID: h.ID, RecursionDesired: h.RecursionDesired})
+	b.StartQuestions()
+	b.Question(dns.Question{Name: q.Name, Type: dns.TypeA, Class: dns.ClassINET})
+	aQuery, err = b.Finish()
+	return aQuery, err == nil
+}
+
+// synthesizeAAAA returns res, a response to an AAAA query, with AAAA
+// records in the Tailscale NAT64 range for the A records of aRes, the
+// response to the A query for the same name, whose IPs match isDNS64IP.
+// CNAME records of aRes are kept. ok is false if there are no such A
+// records.
+func synthesizeAAAA(res, aRes []byte, isDNS64IP func(netaddr.IP) bool) (out []byte, ok bool) {
+	var p dns.Parser
+	h, err := p.Start(res)
+	if err != nil {
+		return nil, false
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil, false
+	}
+
+	if _, err := p.Start(aRes); err != nil {
+		return nil, false
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return nil, false
+	}
+	answers, err := p.AllAnswers()
+	if err != nil {
+		return nil, false
+	}
+
+	h.Authoritative = false
+	b := dns.NewBuilder(nil, h)
+	b.EnableCompression()
+	b.StartQuestions()
+	b.Question(q)
+	b.StartAnswers()
+	for _, a := range answers {
+		switch body := a.Body.(type) {
+		case *dns.CNAMEResource:
+			if err := b.CNAMEResource(a.Header, *body); err != nil {
+				return nil, false
+			}
+		case *dns.AResource:
+			ip := netaddr.IPFrom4(body.A)
+			if !isDNS64IP(ip) {
+				continue
+			}
+			ah := a.Header
+			ah.Type = dns.TypeAAAA
+			if err := b.AAAAResource(ah, dns.AAAAResource{AAAA: tsaddr.MapNAT64(ip).As16()}); err != nil {
+				return nil, false
+			}
+			ok = true
+		}
+	}
+	if !ok {
+		return nil, false
+	}
+	out, err = b.Finish()
+	return out, err == nil
+}
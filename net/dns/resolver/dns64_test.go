@@ -0,0 +1,101 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package resolver
+
+import (
+	"testing"
+
+	dns "golang.org/x/net/dns/dnsmessage"
+	"inet.af/netaddr"
+	"tailscale.com/types/dnstype"
+	"tailscale.com/util/dnsname"
+)
+
+// answerIPs returns the IPs of the A and AAAA records in res.
+func answerIPs(t *testing.T, res []byte) []netaddr.IP {
+	t.Helper()
+	var p dns.Parser
+	if _, err := p.Start(res); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		t.Fatal(err)
+	}
+	answers, err := p.AllAnswers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ips []netaddr.IP
+	for _, a := range answers {
+		switch body := a.Body.(type) {
+		case *dns.AResource:
+			ips = append(ips, netaddr.IPFrom4(body.A))
+		case *dns.AAAAResource:
+			ips = append(ips, netaddr.IPFrom16(body.AAAA))
+		}
+	}
+	return ips
+}
+
+func TestDNS64(t *testing.T) {
+	v4server := serveDNS(t, "127.0.0.1:0",
+		"v4.site.", resolveToIPv4Only(netaddr.MustParseIP("192.168.1.5")),
+		"other.site.", resolveToIPv4Only(netaddr.MustParseIP("10.0.0.1")),
+		"v6.site.", resolveToIP(testipv4, testipv6, "dns.v6.site."))
+	defer v4server.Shutdown()
+
+	r := newResolver(t)
+	defer r.Close()
+
+	cfg := dnsCfg
+	cfg.Routes = map[dnsname.FQDN][]*dnstype.Resolver{
+		".": {{Addr: v4server.PacketConn.LocalAddr().String()}},
+	}
+	cfg.DNS64Routes = []netaddr.IPPrefix{netaddr.MustParseIPPrefix("192.168.1.0/24")}
+	r.SetConfig(cfg)
+
+	tests := []struct {
+		name string
+		typ  dns.Type
+		want []string
+	}{
+		{"v4.site.", dns.TypeAAAA, []string{"fd7a:115c:a1e0:64::c0a8:105"}},
+		{"v4.site.", dns.TypeA, []string{"192.168.1.5"}},
+		{"other.site.", dns.TypeAAAA, nil}, // not in DNS64Routes
+		{"v6.site.", dns.TypeAAAA, []string{testipv6.String()}},
+		{"test1.ipn.dev.", dns.TypeAAAA, nil}, // MagicDNS names aren't synthesized
+	}
+	for _, tt := range tests {
+		t.Run(tt.name+"/"+tt.typ.String(), func(t *testing.T) {
+			res, err := syncRespond(r, dnspacket(dnsname.FQDN(tt.name), tt.typ, noEdns))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, ip := range answerIPs(t, res) {
+				got = append(got, ip.String())
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("answers = %v; want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("answers = %v; want %v", got, tt.want)
+				}
+			}
+		})
+	}
+
+	// Without DNS64Routes, nothing is synthesized.
+	cfg.DNS64Routes = nil
+	r.SetConfig(cfg)
+	res, err := syncRespond(r, dnspacket("v4.site.", dns.TypeAAAA, noEdns))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ips := answerIPs(t, res); len(ips) != 0 {
+		t.Errorf("answers without DNS64Routes = %v; want none", ips)
+	}
+}
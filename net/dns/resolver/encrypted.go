@@ -0,0 +1,385 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package resolver
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	dns "golang.org/x/net/dns/dnsmessage"
+	"inet.af/netaddr"
+	"tailscale.com/net/dnscache"
+	"tailscale.com/net/netns"
+	"tailscale.com/types/dnstype"
+	"tailscale.com/types/logger"
+)
+
+const (
+	// encryptedFallbackDelay is how long to wait before querying each
+	// DNS-over-HTTPS or DNS-over-TLS resolver of a route after the one
+	// listed before it, and before querying any plain DNS resolvers
+	// listed in the same route.
+	encryptedFallbackDelay = 1 * time.Second
+
+	// dotIdleTimeout is how long to keep idle DNS-over-TLS
+	// connections open for reuse.
+	dotIdleTimeout = dohTransportTimeout
+
+	// maxIdleDoTConns is the maximum number of idle DNS-over-TLS
+	// connections to keep per resolver.
+	maxIdleDoTConns = 4
+)
+
+// isEncrypted reports whether r is a DNS-over-HTTPS or DNS-over-TLS
+// resolver.
+func isEncrypted(r *dnstype.Resolver) bool {
+	return strings.HasPrefix(r.Addr, "https://") || strings.HasPrefix(r.Addr, "tls://")
+}
+
+// encryptedUpstream is a DNS-over-HTTPS or DNS-over-TLS resolver, other
+// than the well-known DoH providers of the publicdns package.
+type encryptedUpstream struct {
+	key       string // in forwarder.upstreams
+	hostPort  string // TCP address to dial
+	dial      dnscache.DialContextFunc
+	tlsConfig *tls.Config
+
+	// doh is the client for a DNS-over-HTTPS resolver.
+	// It is nil for DNS-over-TLS.
+	doh *http.Client
+
+	// idle are the idle DNS-over-TLS connections, most recently
+	// used last. It's guarded by forwarder.mu.
+	idle []idleDoTConn
+}
+
+type idleDoTConn struct {
+	c     *tls.Conn
+	since time.Time
+}
+
+// closeIdleLocked closes u's idle connections.
+//
+// forwarder.mu must be held.
+func (u *encryptedUpstream) closeIdleLocked() {
+	for _, ic := range u.idle {
+		ic.c.Close()
+	}
+	u.idle = nil
+	if u.doh != nil {
+		u.doh.CloseIdleConnections()
+	}
+}
+
+// encryptedUpstreamKey returns the key for r in forwarder.upstreams.
+func encryptedUpstreamKey(r *dnstype.Resolver) string {
+	var sb strings.Builder
+	sb.WriteString(r.Addr)
+	for _, ip := range r.BootstrapResolution {
+		sb.WriteByte(' ')
+		sb.WriteString(ip.String())
+	}
+	for _, pin := range r.TLSPins {
+		sb.WriteString(" pin=")
+		sb.WriteString(pin)
+	}
+	return sb.String()
+}
+
+// newEncryptedUpstream returns a new upstream for the https:// or tls://
+// resolver r.
+func newEncryptedUpstream(logf logger.Logf, r *dnstype.Resolver) (*encryptedUpstream, error) {
+	u, err := url.Parse(r.Addr)
+	if err != nil {
+		return nil, err
+	}
+	var defaultPort string
+	switch u.Scheme {
+	case "https":
+		defaultPort = "443"
+	case "tls":
+		defaultPort = "853"
+		if u.Path != "" && u.Path != "/" {
+			return nil, fmt.Errorf("unexpected path in DNS-over-TLS resolver %q", r.Addr)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported resolver %q", r.Addr)
+	}
+	host := u.Hostname()
+	if host == "" {
+		return nil, fmt.Errorf("no host in resolver %q", r.Addr)
+	}
+	port := u.Port()
+	if port == "" {
+		port = defaultPort
+	}
+	for _, pin := range r.TLSPins {
+		if b, err := base64.StdEncoding.DecodeString(pin); err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("invalid TLS pin %q for resolver %q", pin, r.Addr)
+		}
+	}
+
+	// The resolver's name is never looked up: the system resolver
+	// may well be this one, via MagicDNS, so the lookup would loop.
+	addrs := r.BootstrapResolution
+	if ip, err := netaddr.ParseIP(host); err == nil {
+		addrs = []netaddr.IP{ip}
+	} else if len(addrs) == 0 {
+		return nil, fmt.Errorf("resolver %q has a hostname but no bootstrap resolution", r.Addr)
+	}
+	dnsCache := &dnscache.Resolver{
+		SingleHost:             host,
+		SingleHostStaticResult: addrs,
+	}
+	nsDialer := netns.NewDialer(logf)
+	ret := &encryptedUpstream{
+		key:       encryptedUpstreamKey(r),
+		hostPort:  net.JoinHostPort(host, port),
+		dial:      dnscache.Dialer(nsDialer.DialContext, dnsCache),
+		tlsConfig: &tls.Config{ServerName: host},
+	}
+	if len(r.TLSPins) > 0 {
+		// The standard verification is done by verifyTLSPins, if
+		// the leaf certificate isn't pinned.
+		ret.tlsConfig.InsecureSkipVerify = true
+		ret.tlsConfig.VerifyConnection = verifyTLSPins(r.TLSPins)
+	}
+	if u.Scheme == "https" {
+		ret.doh = &http.Client{
+			Transport: &http.Transport{
+				ForceAttemptHTTP2: true,
+				IdleConnTimeout:   dohTransportTimeout,
+				TLSClientConfig:   ret.tlsConfig,
+				DialContext: func(ctx context.Context, netw, addr string) (net.Conn, error) {
+					if !strings.HasPrefix(netw, "tcp") {
+						return nil, fmt.Errorf("unexpected network %q", netw)
+					}
+					return ret.dial(ctx, netw, addr)
+				},
+			},
+		}
+	}
+	return ret, nil
+}
+
+// spkiHash returns the base64 SHA-256 hash of the SubjectPublicKeyInfo of
+// c, in the form of dnstype.Resolver.TLSPins.
+func spkiHash(c *x509.Certificate) string {
+	sum := sha256.Sum256(c.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func matchesTLSPin(c *x509.Certificate, pins []string) bool {
+	h := spkiHash(c)
+	for _, pin := range pins {
+		if pin == h {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyTLSPins returns a tls.Config.VerifyConnection func that accepts
+// connections whose leaf certificate matches one of pins, or whose
+// certificate chain verifies against the system roots and contains a
+// certificate matching one of pins.
+func verifyTLSPins(pins []string) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return errors.New("no peer certificates")
+		}
+		leaf := cs.PeerCertificates[0]
+		if matchesTLSPin(leaf, pins) {
+			return nil
+		}
+		opts := x509.VerifyOptions{
+			DNSName:       cs.ServerName,
+			Intermediates: x509.NewCertPool(),
+		}
+		for _, c := range cs.PeerCertificates[1:] {
+			opts.Intermediates.AddCert(c)
+		}
+		chains, err := leaf.Verify(opts)
+		if err != nil {
+			return err
+		}
+		for _, chain := range chains {
+			for _, c := range chain {
+				if matchesTLSPin(c, pins) {
+					return nil
+				}
+			}
+		}
+		return errors.New("no certificate matches the resolver's TLS pins")
+	}
+}
+
+// getEncryptedUpstream returns the upstream for the https:// or tls://
+// resolver r, creating it if needed.
+func (f *forwarder) getEncryptedUpstream(r *dnstype.Resolver) (*encryptedUpstream, error) {
+	k := encryptedUpstreamKey(r)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if u, ok := f.upstreams[k]; ok {
+		return u, nil
+	}
+	u, err := newEncryptedUpstream(f.logf, r)
+	if err != nil {
+		return nil, err
+	}
+	if f.upstreams == nil {
+		f.upstreams = map[string]*encryptedUpstream{}
+	}
+	f.upstreams[u.key] = u
+	return u, nil
+}
+
+// getDoTConn returns an idle connection to u if there is one, else it
+// dials a new one.
+func (f *forwarder) getDoTConn(ctx context.Context, u *encryptedUpstream) (c *tls.Conn, reused bool, err error) {
+	f.mu.Lock()
+	for len(u.idle) > 0 {
+		ic := u.idle[len(u.idle)-1]
+		u.idle = u.idle[:len(u.idle)-1]
+		if time.Since(ic.since) < dotIdleTimeout {
+			c = ic.c
+			break
+		}
+		ic.c.Close()
+	}
+	f.mu.Unlock()
+	if c != nil {
+		return c, true, nil
+	}
+
+	conn, err := u.dial(ctx, "tcp", u.hostPort)
+	if err != nil {
+		return nil, false, err
+	}
+	c = tls.Client(conn, u.tlsConfig)
+	if err := c.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, false, err
+	}
+	return c, false, nil
+}
+
+// putIdleDoTConn returns c to u's idle connections for reuse.
+func (f *forwarder) putIdleDoTConn(u *encryptedUpstream, c *tls.Conn) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.upstreams[u.key] != u || len(u.idle) >= maxIdleDoTConns {
+		c.Close()
+		return
+	}
+	u.idle = append(u.idle, idleDoTConn{c, time.Now()})
+}
+
+// exchangeDoT sends the query in fq over c and returns the response.
+func exchangeDoT(ctx context.Context, fq *forwardQuery, c *tls.Conn) ([]byte, error) {
+	fq.closeOnCtxDone.Add(c)
+	defer fq.closeOnCtxDone.Remove(c)
+	if dl, ok := ctx.Deadline(); ok {
+		c.SetDeadline(dl)
+		defer c.SetDeadline(time.Time{})
+	}
+
+	// Messages are prefixed by their two byte length, as in DNS over
+	// TCP (RFC 7766). Send it in one write, as recommended.
+	buf := make([]byte, 2+len(fq.packet))
+	binary.BigEndian.PutUint16(buf, uint16(len(fq.packet)))
+	copy(buf[2:], fq.packet)
+	if _, err := c.Write(buf); err != nil {
+		return nil, err
+	}
+
+	var lenBuf [2]byte
+	if _, err := io.ReadFull(c, lenBuf[:]); err != nil {
+		return nil, err
+	}
+	out := make([]byte, binary.BigEndian.Uint16(lenBuf[:]))
+	if _, err := io.ReadFull(c, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// sendDoT sends the query in fq to the DNS-over-TLS resolver u, reusing
+// an idle connection if possible.
+func (f *forwarder) sendDoT(ctx context.Context, fq *forwardQuery, u *encryptedUpstream) ([]byte, error) {
+	metricDNSFwdDoT.Add(1)
+	for {
+		c, reused, err := f.getDoTConn(ctx, u)
+		if err != nil {
+			metricDNSFwdDoTErrorDial.Add(1)
+			return nil, err
+		}
+		out, err := exchangeDoT(ctx, fq, c)
+		if err != nil {
+			c.Close()
+			if reused && ctx.Err() == nil {
+				// The resolver may have closed the idle
+				// connection. Try again.
+				continue
+			}
+			metricDNSFwdDoTErrorIO.Add(1)
+			return nil, err
+		}
+		if len(out) < headerBytes || getTxID(out) != fq.txid {
+			c.Close()
+			metricDNSFwdDoTErrorTxID.Add(1)
+			return nil, errors.New("txid doesn't match")
+		}
+		f.putIdleDoTConn(u, c)
+
+		// don't forward transient errors back to the client when the server fails
+		if rcode := getRCode(out); rcode == dns.RCodeServerFailure {
+			f.logf("recv: response code indicating server failure: %d", rcode)
+			metricDNSFwdDoTErrorServer.Add(1)
+			return nil, errServerFailure
+		}
+		if truncatedFlagSet(out) {
+			metricDNSFwdTruncated.Add(1)
+		}
+		metricDNSFwdDoTSuccess.Add(1)
+		return out, nil
+	}
+}
+
+// closeUnusedUpstreamsLocked closes and forgets the upstreams not used
+// by routes.
+//
+// f.mu must be held.
+func (f *forwarder) closeUnusedUpstreamsLocked(routes []route) {
+	if len(f.upstreams) == 0 {
+		return
+	}
+	used := map[string]bool{}
+	for _, r := range routes {
+		for _, rr := range r.Resolvers {
+			if isEncrypted(rr.name) {
+				used[encryptedUpstreamKey(rr.name)] = true
+			}
+		}
+	}
+	for k, u := range f.upstreams {
+		if !used[k] {
+			u.closeIdleLocked()
+			delete(f.upstreams, k)
+		}
+	}
+}
@@ -0,0 +1,304 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package resolver
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"inet.af/netaddr"
+	"tailscale.com/types/dnstype"
+)
+
+// testCert returns a self-signed certificate for 127.0.0.1 and its
+// TLS pin.
+func testCert(t *testing.T) (tls.Certificate, string) {
+	t.Helper()
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "dns.test"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: priv, Leaf: leaf}, spkiHash(leaf)
+}
+
+// testAnswerIP is the answer of the stand-in DoH and DoT servers.
+var testAnswerIP = netaddr.MustParseIP("192.0.2.53")
+
+// testDNSResponse returns a response to query with testAnswerIP.
+func testDNSResponse(t *testing.T, query []byte) []byte {
+	var p dnsmessage.Parser
+	h, err := p.Start(query)
+	if err != nil {
+		t.Error(err)
+		return nil
+	}
+	q, err := p.Question()
+	if err != nil {
+		t.Error(err)
+		return nil
+	}
+	h.Response = true
+	b := dnsmessage.NewBuilder(nil, h)
+	b.StartQuestions()
+	b.Question(q)
+	b.StartAnswers()
+	b.AResource(dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: 60}, dnsmessage.AResource{A: testAnswerIP.As4()})
+	res, err := b.Finish()
+	if err != nil {
+		t.Error(err)
+	}
+	return res
+}
+
+// startDoTServer starts a DNS-over-TLS stand-in server and returns its
+// address and the number of connections it accepted.
+func startDoTServer(t *testing.T) (addr string, pin string, accepted *int32) {
+	cert, pin := testCert(t)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	accepted = new(int32)
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(accepted, 1)
+			go func() {
+				defer c.Close()
+				for {
+					var lenBuf [2]byte
+					if _, err := io.ReadFull(c, lenBuf[:]); err != nil {
+						return
+					}
+					q := make([]byte, binary.BigEndian.Uint16(lenBuf[:]))
+					if _, err := io.ReadFull(c, q); err != nil {
+						return
+					}
+					res := testDNSResponse(t, q)
+					out := make([]byte, 2+len(res))
+					binary.BigEndian.PutUint16(out, uint16(len(res)))
+					copy(out[2:], res)
+					if _, err := c.Write(out); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return "tls://" + ln.Addr().String(), pin, accepted
+}
+
+// queryForwarder sends a query via f to resolvers and returns the
+// answer's IP.
+func queryForwarder(t *testing.T, f *forwarder, resolvers ...*dnstype.Resolver) (netaddr.IP, error) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ch := make(chan packet, 1)
+	if err := f.forwardWithDestChan(ctx, packet{bs: someDNSQuestion(t)}, ch, resolversWithDelays(resolvers)...); err != nil {
+		return netaddr.IP{}, err
+	}
+	res := <-ch
+	var p dnsmessage.Parser
+	h, err := p.Start(res.bs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.ID != someDNSID {
+		t.Errorf("response DNS ID = %v; want %v", h.ID, someDNSID)
+	}
+	p.SkipAllQuestions()
+	aa, err := p.AllAnswers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(aa) != 1 {
+		t.Fatalf("got %d answers; want 1", len(aa))
+	}
+	a, ok := aa[0].Body.(*dnsmessage.AResource)
+	if !ok {
+		t.Fatalf("answer is %T; want A", aa[0].Body)
+	}
+	return netaddr.IPFrom4(a.A), nil
+}
+
+func TestDoTUpstream(t *testing.T) {
+	addr, pin, accepted := startDoTServer(t)
+	f := newForwarder(t.Logf, nil, nil, nil)
+	defer f.Close()
+
+	r := &dnstype.Resolver{Addr: addr, TLSPins: []string{pin}}
+	for i := 0; i < 3; i++ {
+		ip, err := queryForwarder(t, f, r)
+		if err != nil {
+			t.Fatalf("query %d: %v", i, err)
+		}
+		if ip != testAnswerIP {
+			t.Errorf("query %d: answer = %v; want %v", i, ip, testAnswerIP)
+		}
+	}
+	if n := atomic.LoadInt32(accepted); n != 1 {
+		t.Errorf("server accepted %d connections; want 1 reused", n)
+	}
+
+	// Idle connections closed by the server are redialed.
+	f.mu.Lock()
+	for _, u := range f.upstreams {
+		for _, ic := range u.idle {
+			ic.c.NetConn().Close()
+		}
+	}
+	f.mu.Unlock()
+	if _, err := queryForwarder(t, f, r); err != nil {
+		t.Fatalf("query after close: %v", err)
+	}
+	if n := atomic.LoadInt32(accepted); n != 2 {
+		t.Errorf("server accepted %d connections; want 2", n)
+	}
+}
+
+func TestDoTUpstreamPinMismatch(t *testing.T) {
+	addr, _, _ := startDoTServer(t)
+	_, otherPin := testCert(t)
+	f := newForwarder(t.Logf, nil, nil, nil)
+	defer f.Close()
+
+	if _, err := queryForwarder(t, f, &dnstype.Resolver{Addr: addr, TLSPins: []string{otherPin}}); err == nil {
+		t.Fatal("query succeeded with mismatched pin")
+	}
+	// Without pins, the self-signed certificate isn't trusted either.
+	if _, err := queryForwarder(t, f, &dnstype.Resolver{Addr: addr}); err == nil {
+		t.Fatal("query succeeded with untrusted certificate")
+	}
+	if _, err := queryForwarder(t, f, &dnstype.Resolver{Addr: addr, TLSPins: []string{"bogus"}}); err == nil {
+		t.Fatal("query succeeded with invalid pin")
+	}
+}
+
+func TestEncryptedUpstreamBootstrap(t *testing.T) {
+	addr, pin, _ := startDoTServer(t)
+	_, port, err := net.SplitHostPort(strings.TrimPrefix(addr, "tls://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	named := "tls://dns.test:" + port
+	f := newForwarder(t.Logf, nil, nil, nil)
+	defer f.Close()
+
+	// The name is never looked up, as the lookup could loop back
+	// through MagicDNS.
+	if _, err := queryForwarder(t, f, &dnstype.Resolver{Addr: named, TLSPins: []string{pin}}); err == nil {
+		t.Fatal("query succeeded without bootstrap resolution")
+	}
+	ip, err := queryForwarder(t, f, &dnstype.Resolver{
+		Addr:                named,
+		BootstrapResolution: []netaddr.IP{netaddr.MustParseIP("127.0.0.1")},
+		TLSPins:             []string{pin},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip != testAnswerIP {
+		t.Errorf("answer = %v; want %v", ip, testAnswerIP)
+	}
+}
+
+func TestEncryptedUpstreamFallback(t *testing.T) {
+	addr, pin, _ := startDoTServer(t)
+	_, otherPin := testCert(t)
+	f := newForwarder(t.Logf, nil, nil, nil)
+	defer f.Close()
+
+	ip, err := queryForwarder(t, f,
+		&dnstype.Resolver{Addr: addr, TLSPins: []string{otherPin}},
+		&dnstype.Resolver{Addr: addr, TLSPins: []string{pin}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip != testAnswerIP {
+		t.Errorf("answer = %v; want %v", ip, testAnswerIP)
+	}
+}
+
+func TestDoHUpstream(t *testing.T) {
+	cert, pin := testCert(t)
+	var gotHTTP2 int32
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor == 2 {
+			atomic.StoreInt32(&gotHTTP2, 1)
+		}
+		if r.Method != "POST" || r.Header.Get("Content-Type") != dohType {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		q, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", dohType)
+		w.Write(testDNSResponse(t, q))
+	}))
+	ts.EnableHTTP2 = true
+	ts.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	ts.StartTLS()
+	defer ts.Close()
+
+	f := newForwarder(t.Logf, nil, nil, nil)
+	defer f.Close()
+
+	ip, err := queryForwarder(t, f, &dnstype.Resolver{Addr: ts.URL + "/dns-query", TLSPins: []string{pin}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip != testAnswerIP {
+		t.Errorf("answer = %v; want %v", ip, testAnswerIP)
+	}
+	if atomic.LoadInt32(&gotHTTP2) == 0 {
+		t.Error("query not sent over HTTP/2")
+	}
+
+	_, otherPin := testCert(t)
+	if _, err := queryForwarder(t, f, &dnstype.Resolver{Addr: ts.URL + "/dns-query", TLSPins: []string{otherPin}}); err == nil {
+		t.Fatal("query succeeded with mismatched pin")
+	}
+}
@@ -195,6 +195,11 @@ type forwarder struct {
 
 	dohClient map[string]*http.Client // urlBase -> client
 
+	// upstreams are the DNS-over-HTTPS and DNS-over-TLS resolvers in
+	// use, other than well-known DoH providers, keyed by
+	// encryptedUpstreamKey.
+	upstreams map[string]*encryptedUpstream
+
 	// routes are per-suffix resolvers to use, with
 	// the most specific routes first.
 	routes []route
@@ -251,12 +256,22 @@ func newForwarder(logf logger.Logf, linkMon *monitor.Mon, linkSel ForwardLinkSel
 
 func (f *forwarder) Close() error {
 	f.ctxCancel()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for k, u := range f.upstreams {
+		u.closeIdleLocked()
+		delete(f.upstreams, k)
+	}
 	return nil
 }
 
 // resolversWithDelays maps from a set of DNS server names to a slice of a type
 // that included a startDelay, upgrading any well-known DoH (DNS-over-HTTP)
 // servers in the process, insert a DoH lookup first before UDP fallbacks.
+//
+// Explicitly configured DoH and DoT resolvers are queried in the order
+// listed, each encryptedFallbackDelay after the previous one, and any
+// plain DNS resolvers only after all of them.
 func resolversWithDelays(resolvers []*dnstype.Resolver) []resolverAndDelay {
 	rr := make([]resolverAndDelay, 0, len(resolvers)+2)
 
@@ -280,7 +295,20 @@ type hostAndFam struct {
 		bits uint8  // either 32 or 128 for IPv4 vs IPv6s address family
 	}
 	done := map[hostAndFam]int{}
+	var encryptedDelay time.Duration
+	for _, r := range resolvers {
+		if isEncrypted(r) {
+			rr = append(rr, resolverAndDelay{
+				name:       r,
+				startDelay: encryptedDelay,
+			})
+			encryptedDelay += encryptedFallbackDelay
+		}
+	}
 	for _, r := range resolvers {
+		if isEncrypted(r) {
+			continue
+		}
 		ipp, ok := r.IPPort()
 		if !ok {
 			// Pass non-IP ones through unchanged, without delay.
@@ -301,7 +329,7 @@ type hostAndFam struct {
 		}
 		rr = append(rr, resolverAndDelay{
 			name:       r,
-			startDelay: startDelay,
+			startDelay: encryptedDelay + startDelay,
 		})
 	}
 	return rr
@@ -362,6 +390,7 @@ func (f *forwarder) setRoutes(routesBySuffix map[dnsname.FQDN][]*dnstype.Resolve
 	defer f.mu.Unlock()
 	f.routes = routes
 	f.cloudHostFallback = cloudHostFallback
+	f.closeUnusedUpstreamsLocked(routes)
 }
 
 var stdNetPacketListener packetListener = new(net.ListenConfig)
@@ -497,22 +526,30 @@ func (f *forwarder) send(ctx context.Context, fq *forwardQuery, rr resolverAndDe
 		return f.sendDoH(ctx, rr.name.Addr, f.dialer.PeerAPIHTTPClient(), fq.packet)
 	}
 	if strings.HasPrefix(rr.name.Addr, "https://") {
-		// Only known DoH providers are supported currently. Specifically, we
-		// only support DoH providers where we can TCP connect to them on port
-		// 443 at the same IP address they serve normal UDP DNS from (1.1.1.1,
-		// 8.8.8.8, 9.9.9.9, etc.) That's why OpenDNS and custon DoH providers
-		// aren't currently supported. There's no backup DNS resolution path for
-		// them.
+		// Known DoH providers (where we can TCP connect to them on port
+		// 443 at the same IP address they serve normal UDP DNS from,
+		// like 1.1.1.1, 8.8.8.8, 9.9.9.9) are dialed at their
+		// statically known IPs, unless configured otherwise.
 		urlBase := rr.name.Addr
-		if hc, ok := f.getKnownDoHClientForProvider(urlBase); ok {
-			return f.sendDoH(ctx, urlBase, hc, fq.packet)
+		if len(rr.name.BootstrapResolution) == 0 && len(rr.name.TLSPins) == 0 {
+			if hc, ok := f.getKnownDoHClientForProvider(urlBase); ok {
+				return f.sendDoH(ctx, urlBase, hc, fq.packet)
+			}
 		}
-		metricDNSFwdErrorType.Add(1)
-		return nil, fmt.Errorf("arbitrary https:// resolvers not supported yet")
+		u, err := f.getEncryptedUpstream(rr.name)
+		if err != nil {
+			metricDNSFwdErrorType.Add(1)
+			return nil, err
+		}
+		return f.sendDoH(ctx, urlBase, u.doh, fq.packet)
 	}
 	if strings.HasPrefix(rr.name.Addr, "tls://") {
-		metricDNSFwdErrorType.Add(1)
-		return nil, fmt.Errorf("tls:// resolvers not supported yet")
+		u, err := f.getEncryptedUpstream(rr.name)
+		if err != nil {
+			metricDNSFwdErrorType.Add(1)
+			return nil, err
+		}
+		return f.sendDoT(ctx, fq, u)
 	}
 
 	return f.sendUDP(ctx, fq, rr)
@@ -610,16 +647,24 @@ func (f *forwarder) sendUDP(ctx context.Context, fq *forwardQuery, rr resolverAn
 
 // resolvers returns the resolvers to use for domain.
 func (f *forwarder) resolvers(domain dnsname.FQDN) []resolverAndDelay {
+	_, rr, _ := f.route(domain)
+	return rr
+}
+
+// route returns the suffix and resolvers of the route to use for
+// domain. If no route matches, it returns the cloud host fallback
+// resolvers, if any, with an empty suffix.
+func (f *forwarder) route(domain dnsname.FQDN) (suffix dnsname.FQDN, rr []resolverAndDelay, ok bool) {
 	f.mu.Lock()
 	routes := f.routes
 	cloudHostFallback := f.cloudHostFallback
 	f.mu.Unlock()
 	for _, route := range routes {
 		if route.Suffix == "." || route.Suffix.Contains(domain) {
-			return route.Resolvers
+			return route.Suffix, route.Resolvers, true
 		}
 	}
-	return cloudHostFallback // or nil if no fallback
+	return "", cloudHostFallback, len(cloudHostFallback) > 0 // or nil if no fallback
 }
 
 // forwardQuery is information and state about a forwarded DNS query that's
@@ -692,7 +737,9 @@ func (f *forwarder) forwardWithDestChan(ctx context.Context, query packet, respo
 	clampEDNSSize(query.bs, maxResponseBytes)
 
 	if len(resolvers) == 0 {
-		resolvers = f.resolvers(domain)
+		var suffix dnsname.FQDN
+		suffix, resolvers, _ = f.route(domain)
+		traceRoute(ctx, suffix)
 		if len(resolvers) == 0 {
 			metricDNSFwdErrorNoUpstream.Add(1)
 			return errNoUpstreams
@@ -706,7 +753,11 @@ func (f *forwarder) forwardWithDestChan(ctx context.Context, query packet, respo
 	}
 	defer fq.closeOnCtxDone.Close()
 
-	resc := make(chan []byte, 1) // it's fine buffered or not
+	type result struct {
+		bs []byte
+		rr *resolverAndDelay
+	}
+	resc := make(chan result, 1) // it's fine buffered or not
 	errc := make(chan error, 1)  // it's fine buffered or not too
 	for i := range resolvers {
 		go func(rr *resolverAndDelay) {
@@ -728,7 +779,7 @@ func (f *forwarder) forwardWithDestChan(ctx context.Context, query packet, respo
 				return
 			}
 			select {
-			case resc <- resb:
+			case resc <- result{resb, rr}:
 			case <-ctx.Done():
 			}
 		}(&resolvers[i])
@@ -739,11 +790,12 @@ func (f *forwarder) forwardWithDestChan(ctx context.Context, query packet, respo
 	for {
 		select {
 		case v := <-resc:
+			traceUpstream(ctx, v.rr.name)
 			select {
 			case <-ctx.Done():
 				metricDNSFwdErrorContext.Add(1)
 				return ctx.Err()
-			case responseChan <- packet{v, query.addr}:
+			case responseChan <- packet{v.bs, query.addr}:
 				metricDNSFwdSuccess.Add(1)
 				return nil
 			}
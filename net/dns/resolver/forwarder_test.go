@@ -79,6 +79,16 @@ func TestResolversWithDelays(t *testing.T) {
 			in:   q("9.9.9.9", "2620:fe::fe"),
 			want: o("https://dns.quad9.net/dns-query", "9.9.9.9+0.5s", "2620:fe::fe+0.5s"),
 		},
+		{
+			name: "encrypted-in-order-then-plain",
+			in:   q("1.2.3.4", "tls://dns.example", "https://dns.example/dns-query"),
+			want: o("tls://dns.example", "https://dns.example/dns-query+1s", "1.2.3.4+2s"),
+		},
+		{
+			name: "encrypted-with-known-doh",
+			in:   q("https://dns.example/dns-query", "8.8.8.8", "8.8.4.4"),
+			want: o("https://dns.google/dns-query", "https://dns.example/dns-query", "8.8.8.8+1.5s", "8.8.4.4+1.7s"),
+		},
 	}
 
 	for _, tt := range tests {
@@ -0,0 +1,180 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package resolver
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	dns "golang.org/x/net/dns/dnsmessage"
+	"inet.af/netaddr"
+	"tailscale.com/types/dnstype"
+	"tailscale.com/util/dnsname"
+)
+
+// queryLogSize is the number of recent queries kept in a Resolver's
+// query log.
+const queryLogSize = 256
+
+// QueryLogEntry describes a DNS query handled by a Resolver.
+type QueryLogEntry struct {
+	Time time.Time
+	Name dnsname.FQDN
+	Type dns.Type
+
+	// Local is whether the query was answered from the Resolver's
+	// own records (MagicDNS names and local domains), without
+	// forwarding it. The Resolver doesn't cache forwarded responses.
+	Local bool
+
+	// Route is the DNS suffix of the route the query was forwarded
+	// by, "." for the default route. It's empty if the query wasn't
+	// forwarded, or if no route matched.
+	Route dnsname.FQDN
+
+	// Upstream is the Addr of the resolver whose response was used,
+	// if the query was forwarded.
+	Upstream string
+
+	// RCode is the response code of the response, if any.
+	RCode dns.RCode
+
+	// Err is the error handling the query, if any.
+	Err error
+
+	// Latency is how long the query took to answer.
+	Latency time.Duration
+}
+
+// queryLog is a ring of recent QueryLogEntry values.
+type queryLog struct {
+	mu  sync.Mutex
+	pos int // ent[pos] is next entry
+	ent []QueryLogEntry
+}
+
+func (l *queryLog) add(e QueryLogEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.ent == nil {
+		l.ent = make([]QueryLogEntry, 0, queryLogSize)
+	}
+	if len(l.ent) < queryLogSize {
+		l.ent = append(l.ent, e)
+		return
+	}
+	l.ent[l.pos] = e
+	l.pos = (l.pos + 1) % queryLogSize
+}
+
+// entries returns the logged entries, oldest first.
+func (l *queryLog) entries() []QueryLogEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	ret := make([]QueryLogEntry, 0, len(l.ent))
+	ret = append(ret, l.ent[l.pos:]...)
+	return append(ret, l.ent[:l.pos]...)
+}
+
+// QueryLog returns the most recent queries handled by r, oldest first.
+func (r *Resolver) QueryLog() []QueryLogEntry {
+	return r.queryLog.entries()
+}
+
+// queryTrace records how a forwarded query was routed.
+// It's passed to the forwarder in the query's context.
+type queryTrace struct {
+	mu       sync.Mutex
+	route    dnsname.FQDN
+	upstream string
+}
+
+type queryTraceKey struct{}
+
+func withQueryTrace(ctx context.Context, tr *queryTrace) context.Context {
+	return context.WithValue(ctx, queryTraceKey{}, tr)
+}
+
+// traceRoute records the route suffix chosen for the query in ctx, if
+// it's traced.
+func traceRoute(ctx context.Context, suffix dnsname.FQDN) {
+	if tr, ok := ctx.Value(queryTraceKey{}).(*queryTrace); ok {
+		tr.mu.Lock()
+		defer tr.mu.Unlock()
+		tr.route = suffix
+	}
+}
+
+// traceUpstream records the upstream whose response was used for the
+// query in ctx, if it's traced.
+func traceUpstream(ctx context.Context, r *dnstype.Resolver) {
+	if tr, ok := ctx.Value(queryTraceKey{}).(*queryTrace); ok {
+		tr.mu.Lock()
+		defer tr.mu.Unlock()
+		tr.upstream = r.Addr
+	}
+}
+
+// logQuery adds an entry for query, answered by res and err, to r's
+// query log.
+func (r *Resolver) logQuery(query, res []byte, err error, start time.Time, tr *queryTrace) QueryLogEntry {
+	e := QueryLogEntry{
+		Time:    start,
+		Local:   tr == nil,
+		Err:     err,
+		Latency: time.Since(start),
+	}
+	var p dns.Parser
+	if _, perr := p.Start(query); perr == nil {
+		if q, perr := p.Question(); perr == nil {
+			e.Name, _ = dnsname.ToFQDN(rawNameToLower(q.Name.Data[:q.Name.Length]))
+			e.Type = q.Type
+		}
+	}
+	if len(res) >= headerBytes {
+		e.RCode = getRCode(res)
+	}
+	if tr != nil {
+		tr.mu.Lock()
+		e.Route = tr.route
+		e.Upstream = tr.upstream
+		tr.mu.Unlock()
+	}
+	r.queryLog.add(e)
+	return e
+}
+
+// DebugQuery resolves name for record type typ as if queried by a
+// client of r, and returns the response and how it was handled.
+// The query is also added to r's query log.
+func (r *Resolver) DebugQuery(ctx context.Context, name dnsname.FQDN, typ dns.Type) ([]byte, QueryLogEntry, error) {
+	n, err := dns.NewName(name.WithTrailingDot())
+	if err != nil {
+		return nil, QueryLogEntry{}, err
+	}
+	b := dns.NewBuilder(nil, dns.Header{
+		ID:               uint16(rand.Uint32()),
+		RecursionDesired: true,
+	})
+	b.StartQuestions()
+	b.Question(dns.Question{Name: n, Type: typ, Class: dns.ClassINET})
+	q, err := b.Finish()
+	if err != nil {
+		return nil, QueryLogEntry{}, err
+	}
+	return r.query(ctx, q, netaddr.IPPort{})
+}
+
+// Route returns the suffix and resolvers of the route that queries for
+// name are forwarded by, if any. ok is false if no route matches.
+func (r *Resolver) Route(name dnsname.FQDN) (suffix dnsname.FQDN, resolvers []*dnstype.Resolver, ok bool) {
+	suffix, rr, ok := r.forwarder.route(name)
+	for _, v := range rr {
+		resolvers = append(resolvers, v.name)
+	}
+	return suffix, resolvers, ok
+}
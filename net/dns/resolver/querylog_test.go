@@ -0,0 +1,96 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package resolver
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	dns "golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/types/dnstype"
+	"tailscale.com/util/dnsname"
+)
+
+func TestQueryLog(t *testing.T) {
+	server := serveDNS(t, "127.0.0.1:0",
+		"test.site.", resolveToIP(testipv4, testipv6, "dns.test.site."))
+	defer server.Shutdown()
+	upstream := server.PacketConn.LocalAddr().String()
+
+	r := newResolver(t)
+	defer r.Close()
+
+	cfg := dnsCfg
+	cfg.Routes = map[dnsname.FQDN][]*dnstype.Resolver{
+		"site.": {{Addr: upstream}},
+	}
+	r.SetConfig(cfg)
+
+	for _, q := range [][]byte{
+		dnspacket("test.site.", dns.TypeA, noEdns),
+		dnspacket("test1.ipn.dev.", dns.TypeA, noEdns),
+		dnspacket("test.example.", dns.TypeA, noEdns),
+	} {
+		syncRespond(r, q)
+	}
+	res, e, err := r.DebugQuery(context.Background(), "test.site.", dns.TypeAAAA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if getRCode(res) != dns.RCodeSuccess || e.Upstream != upstream {
+		t.Errorf("DebugQuery = rcode %v, %+v", getRCode(res), e)
+	}
+
+	type entry struct {
+		Name     dnsname.FQDN
+		Type     dns.Type
+		Local    bool
+		Route    dnsname.FQDN
+		Upstream string
+		RCode    dns.RCode
+		Err      bool
+	}
+	var got []entry
+	for _, e := range r.QueryLog() {
+		got = append(got, entry{e.Name, e.Type, e.Local, e.Route, e.Upstream, e.RCode, e.Err != nil})
+		if e.Time.IsZero() || e.Latency <= 0 {
+			t.Errorf("entry for %v lacks time or latency: %+v", e.Name, e)
+		}
+	}
+	want := []entry{
+		{Name: "test.site.", Type: dns.TypeA, Route: "site.", Upstream: upstream},
+		{Name: "test1.ipn.dev.", Type: dns.TypeA, Local: true},
+		{Name: "test.example.", Type: dns.TypeA, Err: true}, // no upstreams
+		{Name: "test.site.", Type: dns.TypeAAAA, Route: "site.", Upstream: upstream},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("query log:\n got %+v\nwant %+v", got, want)
+	}
+
+	suffix, resolvers, ok := r.Route("a.test.site.")
+	if !ok || suffix != "site." || len(resolvers) != 1 || resolvers[0].Addr != upstream {
+		t.Errorf("Route = %v, %v, %v", suffix, resolvers, ok)
+	}
+	if _, _, ok := r.Route("test.example."); ok {
+		t.Errorf("Route for name without route succeeded")
+	}
+}
+
+func TestQueryLogRing(t *testing.T) {
+	var l queryLog
+	for i := 0; i < queryLogSize+10; i++ {
+		l.add(QueryLogEntry{Type: dns.Type(i)})
+	}
+	got := l.entries()
+	if len(got) != queryLogSize {
+		t.Fatalf("got %d entries; want %d", len(got), queryLogSize)
+	}
+	for i, e := range got {
+		if want := dns.Type(i + 10); e.Type != want {
+			t.Fatalf("entry %d = %v; want %v", i, e.Type, want)
+		}
+	}
+}
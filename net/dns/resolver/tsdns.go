@@ -73,6 +73,10 @@ type Config struct {
 	// LocalDomains is a list of DNS name suffixes that should not be
 	// routed to upstream resolvers.
 	LocalDomains []dnsname.FQDN
+	// DNS64Routes are the IPv4 prefixes for whose addresses AAAA
+	// records in the Tailscale NAT64 range are synthesized, when a
+	// forwarded AAAA query has no answers.
+	DNS64Routes []netaddr.IPPrefix
 }
 
 // WriteToBufioWriter write a debug version of c for logs to w, omitting
@@ -194,6 +198,14 @@ type Resolver struct {
 	localDomains []dnsname.FQDN
 	hostToIP     map[dnsname.FQDN][]netaddr.IP
 	ipToHost     map[netaddr.IP]dnsname.FQDN
+	// isDNS64IP reports whether an IPv4 address is in the DNS64
+	// routes. It's nil if there are none.
+	isDNS64IP func(netaddr.IP) bool
+	// answerObserver, if non-nil, is called with the IPs in
+	// forwarded responses. See SetAnswerObserver.
+	answerObserver func(name dnsname.FQDN, ips []netaddr.IP)
+
+	queryLog queryLog
 }
 
 type ForwardLinkSelector interface {
@@ -238,14 +250,31 @@ func (r *Resolver) SetConfig(cfg Config) error {
 
 	r.forwarder.setRoutes(cfg.Routes)
 
+	var isDNS64IP func(netaddr.IP) bool
+	if len(cfg.DNS64Routes) > 0 {
+		isDNS64IP = tsaddr.NewContainsIPFunc(cfg.DNS64Routes)
+	}
+
 	r.mu.Lock()
 	defer r.mu.Unlock()
 	r.localDomains = cfg.LocalDomains
 	r.hostToIP = cfg.Hosts
 	r.ipToHost = reverse
+	r.isDNS64IP = isDNS64IP
 	return nil
 }
 
+// SetAnswerObserver sets fn to be called with the question name and
+// the A and AAAA record IPs of each successful response to a Query
+// that was forwarded upstream. It's called synchronously before the
+// response is returned, so fn can act on the answer (e.g. add routes
+// to the IPs) before the querier sees it.
+func (r *Resolver) SetAnswerObserver(fn func(name dnsname.FQDN, ips []netaddr.IP)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.answerObserver = fn
+}
+
 // Close shuts down the resolver and ensures poll goroutines have exited.
 // The Resolver cannot be used again after Close is called.
 func (r *Resolver) Close() {
@@ -266,18 +295,26 @@ func (r *Resolver) Close() {
 const dnsQueryTimeout = 10 * time.Second
 
 func (r *Resolver) Query(ctx context.Context, bs []byte, from netaddr.IPPort) ([]byte, error) {
+	res, _, err := r.query(ctx, bs, from)
+	return res, err
+}
+
+// query is Query, also returning the query's entry in r's query log.
+func (r *Resolver) query(ctx context.Context, bs []byte, from netaddr.IPPort) ([]byte, QueryLogEntry, error) {
 	metricDNSQueryLocal.Add(1)
 	select {
 	case <-r.closed:
 		metricDNSQueryErrorClosed.Add(1)
-		return nil, net.ErrClosed
+		return nil, QueryLogEntry{}, net.ErrClosed
 	default:
 	}
 
+	start := time.Now()
 	out, err := r.respond(bs)
 	if err == errNotOurName {
+		tr := new(queryTrace)
 		responses := make(chan packet, 1)
-		ctx, cancel := context.WithTimeout(ctx, dnsQueryTimeout)
+		ctx, cancel := context.WithTimeout(withQueryTrace(ctx, tr), dnsQueryTimeout)
 		defer close(responses)
 		defer cancel()
 		err = r.forwarder.forwardWithDestChan(ctx, packet{bs, from}, responses)
@@ -287,15 +324,94 @@ func (r *Resolver) Query(ctx context.Context, bs []byte, from netaddr.IPPort) ([
 			// This is present in some errors paths, such as when all upstream
 			// DNS servers replied with an error.
 			case resp := <-responses:
-				return resp.bs, err
+				return resp.bs, r.logQuery(bs, resp.bs, err, start, tr), err
 			default:
-				return nil, err
+				return nil, r.logQuery(bs, nil, err, start, tr), err
 			}
 		}
-		return (<-responses).bs, nil
+		resp := <-responses
+		if out, ok := r.dns64(ctx, bs, resp.bs, from); ok {
+			resp.bs = out
+		}
+		r.observeAnswer(resp.bs)
+		return resp.bs, r.logQuery(bs, resp.bs, nil, start, tr), nil
 	}
 
-	return out, err
+	return out, r.logQuery(bs, out, err, start, nil), err
+}
+
+// observeAnswer passes the IPs in res, a response from an upstream
+// nameserver, to the answer observer, if any.
+func (r *Resolver) observeAnswer(res []byte) {
+	r.mu.Lock()
+	fn := r.answerObserver
+	r.mu.Unlock()
+	if fn == nil {
+		return
+	}
+	name, ips, err := AnswerIPs(res)
+	if err != nil || len(ips) == 0 {
+		return
+	}
+	fn(name, ips)
+}
+
+// AnswerIPs returns the question name and the IPs in the A and AAAA
+// records of the answer section of the DNS response res.
+func AnswerIPs(res []byte) (name dnsname.FQDN, ips []netaddr.IP, err error) {
+	var p dns.Parser
+	hdr, err := p.Start(res)
+	if err != nil {
+		return "", nil, err
+	}
+	if !hdr.Response || hdr.RCode != dns.RCodeSuccess {
+		return "", nil, nil
+	}
+	q, err := p.Question()
+	if err != nil {
+		return "", nil, err
+	}
+	name, err = dnsname.ToFQDN(q.Name.String())
+	if err != nil {
+		return "", nil, err
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return "", nil, err
+	}
+	for {
+		h, err := p.AnswerHeader()
+		if err == dns.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		if h.Class != dns.ClassINET {
+			if err := p.SkipAnswer(); err != nil {
+				return "", nil, err
+			}
+			continue
+		}
+		switch h.Type {
+		case dns.TypeA:
+			r, err := p.AResource()
+			if err != nil {
+				return "", nil, err
+			}
+			ips = append(ips, netaddr.IPv4(r.A[0], r.A[1], r.A[2], r.A[3]))
+		case dns.TypeAAAA:
+			r, err := p.AAAAResource()
+			if err != nil {
+				return "", nil, err
+			}
+			ips = append(ips, netaddr.IPFrom16(r.AAAA))
+		default:
+			if err := p.SkipAnswer(); err != nil {
+				return "", nil, err
+			}
+		}
+	}
+	return name, ips, nil
 }
 
 // parseExitNodeQuery parses a DNS request packet.
@@ -1223,6 +1339,7 @@ func unARPA(a string) (ipStr string, ok bool) {
 var (
 	metricDNSQueryLocal       = clientmetric.NewCounter("dns_query_local")
 	metricDNSQueryErrorClosed = clientmetric.NewCounter("dns_query_local_error_closed")
+	metricDNSQueryDNS64       = clientmetric.NewCounter("dns_query_dns64")
 
 	metricDNSErrorParseNoQ   = clientmetric.NewCounter("dns_query_respond_error_no_question")
 	metricDNSErrorParseQuery = clientmetric.NewCounter("dns_query_respond_error_parse")
@@ -1262,6 +1379,13 @@ func unARPA(a string) (ipStr string, ok bool) {
 	metricDNSFwdDoHErrorTransport = clientmetric.NewCounter("dns_query_fwd_doh_error_transport")
 	metricDNSFwdDoHErrorBody      = clientmetric.NewCounter("dns_query_fwd_doh_error_body")
 
+	metricDNSFwdDoT            = clientmetric.NewCounter("dns_query_fwd_dot")
+	metricDNSFwdDoTErrorDial   = clientmetric.NewCounter("dns_query_fwd_dot_error_dial")
+	metricDNSFwdDoTErrorIO     = clientmetric.NewCounter("dns_query_fwd_dot_error_io")
+	metricDNSFwdDoTErrorTxID   = clientmetric.NewCounter("dns_query_fwd_dot_error_txid")
+	metricDNSFwdDoTErrorServer = clientmetric.NewCounter("dns_query_fwd_dot_error_server")
+	metricDNSFwdDoTSuccess     = clientmetric.NewCounter("dns_query_fwd_dot_success")
+
 	metricDNSResolveLocal             = clientmetric.NewCounter("dns_resolve_local")
 	metricDNSResolveLocalErrorOnion   = clientmetric.NewCounter("dns_resolve_local_error_onion")
 	metricDNSResolveLocalErrorMissing = clientmetric.NewCounter("dns_resolve_local_error_missing")
@@ -332,3 +332,31 @@ func serveDNS(tb testing.TB, addr string, records ...any) *dns.Server {
 	<-waitch
 	return server
 }
+
+// resolveToIPv4Only returns a handler function which responds to
+// queries of type A it receives with an A record containing ipv4,
+// and to queries of other types with no records.
+func resolveToIPv4Only(ipv4 netaddr.IP) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+
+		if len(req.Question) != 1 {
+			panic("not a single-question request")
+		}
+		question := req.Question[0]
+
+		if question.Qtype == dns.TypeA {
+			m.Answer = append(m.Answer, &dns.A{
+				Hdr: dns.RR_Header{
+					Name:   question.Name,
+					Rrtype: dns.TypeA,
+					Class:  dns.ClassINET,
+					Ttl:    60,
+				},
+				A: ipv4.IPAddr().IP,
+			})
+		}
+		w.WriteMsg(m)
+	}
+}
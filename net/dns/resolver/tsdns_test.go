@@ -706,6 +706,48 @@ func TestDelegateSplitRoute(t *testing.T) {
 	}
 }
 
+func TestAnswerObserver(t *testing.T) {
+	server := serveDNS(t, "127.0.0.1:0",
+		"test.site.", resolveToIP(testipv4, testipv6, "dns.test.site."))
+	defer server.Shutdown()
+
+	r := newResolver(t)
+	defer r.Close()
+
+	cfg := dnsCfg
+	cfg.Routes = map[dnsname.FQDN][]*dnstype.Resolver{
+		".": {{Addr: server.PacketConn.LocalAddr().String()}},
+	}
+	r.SetConfig(cfg)
+
+	type observed struct {
+		name dnsname.FQDN
+		ips  []netaddr.IP
+	}
+	var got []observed
+	r.SetAnswerObserver(func(name dnsname.FQDN, ips []netaddr.IP) {
+		got = append(got, observed{name, ips})
+	})
+
+	for _, q := range [][]byte{
+		dnspacket("test.site.", dns.TypeA, noEdns),
+		dnspacket("test.site.", dns.TypeAAAA, noEdns),
+		dnspacket("test.site.", dns.TypeNS, noEdns),    // no IPs
+		dnspacket("test1.ipn.dev.", dns.TypeA, noEdns), // answered locally
+	} {
+		if _, err := syncRespond(r, q); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []observed{
+		{"test.site.", []netaddr.IP{testipv4}},
+		{"test.site.", []netaddr.IP{testipv6}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("observed %v; want %v", got, want)
+	}
+}
+
 var allResponse = []byte{
 	0x00, 0x00, // transaction id: 0
 	0x84, 0x00, // flags: response, authoritative, no error
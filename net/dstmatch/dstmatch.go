@@ -0,0 +1,122 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package dstmatch matches the destinations of outbound connections
+// against HOST[:PORTS] patterns, as used by tailscaled's dial policies
+// and outbound HTTP proxy rules.
+package dstmatch
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"inet.af/netaddr"
+)
+
+// Pattern is a parsed destination pattern.
+type Pattern struct {
+	host   string           // "*", "*.suffix" or a lowercase hostname; empty if prefix is set
+	prefix netaddr.IPPrefix // if valid, the IPs matched
+	lo, hi uint16           // the ports matched
+}
+
+// Parse parses a destination pattern of the form HOST[:PORTS].
+//
+// HOST is "*" for any destination, a hostname, "*.example.com" for any
+// subdomain of example.com (but not example.com itself), or an IP
+// address or CIDR prefix. IPv6 addresses and prefixes followed by
+// PORTS must be in brackets.
+//
+// PORTS is a port number, a range like "8000-8999", or "*". Without
+// PORTS, all ports match.
+func Parse(s string) (Pattern, error) {
+	host, ports, err := SplitHostPorts(s)
+	if err != nil {
+		return Pattern{}, err
+	}
+	return New(host, ports)
+}
+
+// SplitHostPorts splits the HOST[:PORTS] pattern s, described by
+// Parse, into its HOST and PORTS, without validating them. Brackets
+// around HOST are removed.
+func SplitHostPorts(s string) (host, ports string, err error) {
+	if strings.HasPrefix(s, "[") {
+		i := strings.Index(s, "]")
+		if i < 0 {
+			return "", "", fmt.Errorf("invalid destination %q: missing ']'", s)
+		}
+		host, ports = s[1:i], s[i+1:]
+		if ports != "" {
+			if ports[0] != ':' {
+				return "", "", fmt.Errorf("invalid destination %q", s)
+			}
+			ports = ports[1:]
+		}
+		return host, ports, nil
+	}
+	if strings.Count(s, ":") == 1 {
+		host, ports, _ = strings.Cut(s, ":")
+		return host, ports, nil
+	}
+	return s, "", nil
+}
+
+// New returns the pattern matching host and ports, with the syntax
+// described by Parse. An empty ports matches all ports.
+func New(host, ports string) (Pattern, error) {
+	p := Pattern{lo: 0, hi: 65535}
+	if ports != "" && ports != "*" {
+		loStr, hiStr, isRange := strings.Cut(ports, "-")
+		lo, err := strconv.ParseUint(loStr, 10, 16)
+		if err != nil {
+			return Pattern{}, fmt.Errorf("invalid destination ports %q", ports)
+		}
+		hi := lo
+		if isRange {
+			hi, err = strconv.ParseUint(hiStr, 10, 16)
+			if err != nil || hi < lo {
+				return Pattern{}, fmt.Errorf("invalid destination ports %q", ports)
+			}
+		}
+		p.lo, p.hi = uint16(lo), uint16(hi)
+	}
+
+	if pfx, err := netaddr.ParseIPPrefix(host); err == nil {
+		p.prefix = pfx.Masked()
+		return p, nil
+	}
+	if ip, err := netaddr.ParseIP(host); err == nil {
+		p.prefix = netaddr.IPPrefixFrom(ip, ip.BitLen())
+		return p, nil
+	}
+	h := strings.ToLower(strings.TrimSuffix(host, "."))
+	if h == "" || strings.ContainsAny(h, ":/[] ") ||
+		strings.Contains(strings.TrimPrefix(h, "*"), "*") ||
+		(strings.HasPrefix(h, "*") && h != "*" && !strings.HasPrefix(h, "*.")) {
+		return Pattern{}, fmt.Errorf("invalid destination host %q", host)
+	}
+	p.host = h
+	return p, nil
+}
+
+// Match reports whether p matches a destination. name is the lowercase
+// hostname requested, if any, and ip the destination IP, if known.
+func (p Pattern) Match(name string, ip netaddr.IP, port uint16) bool {
+	if port < p.lo || port > p.hi {
+		return false
+	}
+	if p.prefix.IsValid() {
+		return !ip.IsZero() && p.prefix.Contains(ip)
+	}
+	switch {
+	case p.host == "*":
+		return true
+	case strings.HasPrefix(p.host, "*."):
+		return strings.HasSuffix(name, p.host[1:])
+	default:
+		return name != "" && name == p.host
+	}
+}
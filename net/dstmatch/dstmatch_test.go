@@ -0,0 +1,81 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dstmatch
+
+import (
+	"testing"
+
+	"inet.af/netaddr"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Pattern
+		wantErr bool
+	}{
+		{in: "*", want: Pattern{host: "*", hi: 65535}},
+		{in: "Example.COM.", want: Pattern{host: "example.com", hi: 65535}},
+		{in: "*.example.com:443", want: Pattern{host: "*.example.com", lo: 443, hi: 443}},
+		{in: "*:80-81", want: Pattern{host: "*", lo: 80, hi: 81}},
+		{in: "10.1.2.3/8", want: Pattern{prefix: netaddr.MustParseIPPrefix("10.0.0.0/8"), hi: 65535}},
+		{in: "1.2.3.4:*", want: Pattern{prefix: netaddr.MustParseIPPrefix("1.2.3.4/32"), hi: 65535}},
+		{in: "fd7a::1", want: Pattern{prefix: netaddr.MustParseIPPrefix("fd7a::1/128"), hi: 65535}},
+		{in: "[fd7a::/16]:443", want: Pattern{prefix: netaddr.MustParseIPPrefix("fd7a::/16"), lo: 443, hi: 443}},
+		{in: "", wantErr: true},
+		{in: ":443", wantErr: true},
+		{in: "foo*.com", wantErr: true},
+		{in: "*foo.com", wantErr: true},
+		{in: "a.*.com", wantErr: true},
+		{in: "host:99999", wantErr: true},
+		{in: "host:90-80", wantErr: true},
+		{in: "[fd7a::1", wantErr: true},
+		{in: "[fd7a::1]443", wantErr: true},
+		{in: "[host/path]", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := Parse(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Parse(%q) error = %v; wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("Parse(%q) = %+v; want %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	ip := netaddr.MustParseIP
+	tests := []struct {
+		pattern string
+		name    string
+		ip      netaddr.IP
+		port    uint16
+		want    bool
+	}{
+		{"example.com", "example.com", ip("1.2.3.4"), 80, true},
+		{"example.com", "www.example.com", ip("1.2.3.4"), 80, false},
+		{"*.example.com.", "www.example.com", ip("1.2.3.4"), 80, true},
+		{"*.example.com", "example.com", ip("1.2.3.4"), 80, false},
+		{"*.example.com", "notexample.com", ip("1.2.3.4"), 80, false},
+		{"example.com", "", ip("1.2.3.4"), 80, false},
+		{"10.0.0.0/8", "", ip("10.9.9.9"), 80, true},
+		{"10.0.0.0/8", "foo.internal", ip("10.9.9.9"), 80, true},
+		{"10.0.0.0/8", "foo.internal", netaddr.IP{}, 80, false},
+		{"10.0.0.0/8", "", ip("11.0.0.1"), 80, false},
+		{"*:80-90", "", ip("1.2.3.4"), 85, true},
+		{"*:80-90", "", ip("1.2.3.4"), 91, false},
+	}
+	for _, tt := range tests {
+		p, err := Parse(tt.pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := p.Match(tt.name, tt.ip, tt.port); got != tt.want {
+			t.Errorf("%q.Match(%q, %v, %d) = %v; want %v", tt.pattern, tt.name, tt.ip, tt.port, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,328 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package exitusage accounts for and restricts the traffic that an exit
+// node forwards between its peers and the internet.
+package exitusage
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"inet.af/netaddr"
+	"tailscale.com/net/packet"
+	"tailscale.com/net/tsaddr"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/ipproto"
+)
+
+const (
+	// maxPeers is the number of distinct peer IPs tracked. Traffic
+	// of others isn't accounted for, but is still blocked.
+	maxPeers = 1024
+
+	// maxDests is the number of distinct Dests tracked per peer IP.
+	// Traffic to others is accounted to the Dest with port 0.
+	maxDests = 64
+
+	// MaxTopDests is the number of Dests reported per peer IP.
+	MaxTopDests = 10
+)
+
+// Dest is a kind of destination of exit traffic: a transport protocol
+// and, for TCP and UDP, a destination port.
+type Dest struct {
+	Proto ipproto.Proto
+	Port  uint16
+}
+
+// Counts are counters of exit traffic.
+type Counts struct {
+	TxPackets uint64 // from the peer to the internet
+	TxBytes   uint64
+	RxPackets uint64 // from the internet to the peer
+	RxBytes   uint64
+}
+
+func (c *Counts) bytes() uint64 { return c.TxBytes + c.RxBytes }
+
+// DestUsage is the exit traffic of a peer IP to a Dest.
+type DestUsage struct {
+	Dest
+	Counts
+}
+
+// PeerUsage is the exit traffic of a peer IP.
+type PeerUsage struct {
+	IP netaddr.IP
+	Counts
+
+	// BlockedPackets is the number of packets from the peer that
+	// were dropped due to the blocked ports.
+	BlockedPackets uint64
+
+	// TopDests are the Dests with the most traffic, in bytes,
+	// at most MaxTopDests of them.
+	TopDests []DestUsage
+}
+
+// Tracker tracks exit traffic per peer IP. The zero value is a valid
+// Tracker that tracks nothing until configured with SetConfig.
+//
+// Inbound and Outbound, called for every packet, take no locks: the
+// maps they read are replaced rather than modified, and the counters
+// are updated atomically.
+type Tracker struct {
+	cfg   atomic.Value // of *config; nil if not an exit node
+	peers atomic.Value // of map[netaddr.IP]*peerUsage
+
+	mu sync.Mutex // serializes replacing peers
+}
+
+type config struct {
+	isSubnetIP func(netaddr.IP) bool
+	blocked    []tailcfg.PortRange
+}
+
+type peerUsage struct {
+	counts  atomicCounts
+	blocked uint64       // atomic
+	dests   atomic.Value // of map[Dest]*atomicCounts
+
+	mu sync.Mutex // serializes replacing dests
+}
+
+// atomicCounts are Counts updated atomically.
+type atomicCounts struct {
+	txPackets, txBytes, rxPackets, rxBytes uint64
+}
+
+func (c *atomicCounts) addTx(n uint64) {
+	atomic.AddUint64(&c.txPackets, 1)
+	atomic.AddUint64(&c.txBytes, n)
+}
+
+func (c *atomicCounts) addRx(n uint64) {
+	atomic.AddUint64(&c.rxPackets, 1)
+	atomic.AddUint64(&c.rxBytes, n)
+}
+
+func (c *atomicCounts) load() Counts {
+	return Counts{
+		TxPackets: atomic.LoadUint64(&c.txPackets),
+		TxBytes:   atomic.LoadUint64(&c.txBytes),
+		RxPackets: atomic.LoadUint64(&c.rxPackets),
+		RxBytes:   atomic.LoadUint64(&c.rxBytes),
+	}
+}
+
+// SetConfig sets whether the node is an exit node, the routes it
+// advertises as a subnet router, whose traffic isn't exit traffic,
+// and the destination ports to which exit traffic over TCP and UDP is
+// blocked.
+func (t *Tracker) SetConfig(exitNode bool, subnetRoutes []netaddr.IPPrefix, blockedPorts []tailcfg.PortRange) {
+	if !exitNode {
+		t.cfg.Store((*config)(nil))
+		t.mu.Lock()
+		t.peers.Store(map[netaddr.IP]*peerUsage(nil))
+		t.mu.Unlock()
+		return
+	}
+	t.cfg.Store(&config{
+		isSubnetIP: tsaddr.NewContainsIPFunc(subnetRoutes),
+		blocked:    append([]tailcfg.PortRange(nil), blockedPorts...),
+	})
+}
+
+func (t *Tracker) config() *config {
+	c, _ := t.cfg.Load().(*config)
+	return c
+}
+
+// isExit reports whether traffic to or from the non-peer address ip is
+// exit traffic.
+func (c *config) isExit(ip netaddr.IP) bool {
+	return !tsaddr.IsTailscaleIP(ip) && !ip.IsMulticast() && !ip.IsLinkLocalUnicast() && !c.isSubnetIP(ip)
+}
+
+func (c *config) isBlocked(d Dest) bool {
+	if d.Proto != ipproto.TCP && d.Proto != ipproto.UDP {
+		return false
+	}
+	for _, pr := range c.blocked {
+		if d.Port >= pr.First && d.Port <= pr.Last {
+			return true
+		}
+	}
+	return false
+}
+
+func destOf(proto ipproto.Proto, port uint16) Dest {
+	if proto != ipproto.TCP && proto != ipproto.UDP {
+		port = 0
+	}
+	return Dest{Proto: proto, Port: port}
+}
+
+// PrunePeers stops tracking, and forgets the usage of, the peer IPs
+// for which keep returns false, such as those no longer in the
+// netmap.
+func (t *Tracker) PrunePeers(keep func(netaddr.IP) bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	old := t.loadPeers()
+	m := make(map[netaddr.IP]*peerUsage, len(old))
+	for ip, pu := range old {
+		if keep(ip) {
+			m[ip] = pu
+		}
+	}
+	if len(m) != len(old) {
+		t.peers.Store(m)
+	}
+}
+
+func (t *Tracker) loadPeers() map[netaddr.IP]*peerUsage {
+	m, _ := t.peers.Load().(map[netaddr.IP]*peerUsage)
+	return m
+}
+
+// peer returns the usage of the peer with IP ip, creating it if
+// needed, or nil if there are already maxPeers.
+func (t *Tracker) peer(ip netaddr.IP) *peerUsage {
+	peers := t.loadPeers()
+	if pu, ok := peers[ip]; ok {
+		return pu
+	}
+	if len(peers) >= maxPeers {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	old := t.loadPeers()
+	if pu, ok := old[ip]; ok {
+		return pu
+	}
+	if len(old) >= maxPeers {
+		return nil
+	}
+	m := make(map[netaddr.IP]*peerUsage, len(old)+1)
+	for k, v := range old {
+		m[k] = v
+	}
+	pu := new(peerUsage)
+	m[ip] = pu
+	t.peers.Store(m)
+	return pu
+}
+
+func (pu *peerUsage) loadDests() map[Dest]*atomicCounts {
+	m, _ := pu.dests.Load().(map[Dest]*atomicCounts)
+	return m
+}
+
+// dest returns the counts of pu for d, creating them if needed.
+func (pu *peerUsage) dest(d Dest) *atomicCounts {
+	if c, ok := pu.loadDests()[d]; ok {
+		return c
+	}
+	pu.mu.Lock()
+	defer pu.mu.Unlock()
+	old := pu.loadDests()
+	if len(old) >= maxDests {
+		d.Port = 0
+	}
+	if c, ok := old[d]; ok {
+		return c
+	}
+	m := make(map[Dest]*atomicCounts, len(old)+1)
+	for k, v := range old {
+		m[k] = v
+	}
+	c := new(atomicCounts)
+	m[d] = c
+	pu.dests.Store(m)
+	return c
+}
+
+// Inbound accounts for p, a packet from a peer, if it's exit traffic,
+// and reports whether it may be forwarded.
+func (t *Tracker) Inbound(p *packet.Parsed) bool {
+	c := t.config()
+	if c == nil || !c.isExit(p.Dst.IP()) {
+		return true
+	}
+	d := destOf(p.IPProto, p.Dst.Port())
+	blocked := c.isBlocked(d)
+	n := uint64(len(p.Buffer()))
+
+	pu := t.peer(p.Src.IP())
+	if blocked {
+		if pu != nil {
+			atomic.AddUint64(&pu.blocked, 1)
+		}
+		return false
+	}
+	if pu != nil {
+		pu.counts.addTx(n)
+		pu.dest(d).addTx(n)
+	}
+	return true
+}
+
+// Outbound accounts for p, a packet to a peer, if it's exit traffic.
+func (t *Tracker) Outbound(p *packet.Parsed) {
+	c := t.config()
+	if c == nil || !c.isExit(p.Src.IP()) {
+		return
+	}
+	d := destOf(p.IPProto, p.Src.Port())
+	n := uint64(len(p.Buffer()))
+
+	if pu := t.peer(p.Dst.IP()); pu != nil {
+		pu.counts.addRx(n)
+		pu.dest(d).addRx(n)
+	}
+}
+
+// Usage returns the exit traffic of each peer IP, the peers with the
+// most traffic first.
+func (t *Tracker) Usage() []PeerUsage {
+	peers := t.loadPeers()
+	ret := make([]PeerUsage, 0, len(peers))
+	for ip, pu := range peers {
+		dests := pu.loadDests()
+		u := PeerUsage{
+			IP:             ip,
+			Counts:         pu.counts.load(),
+			BlockedPackets: atomic.LoadUint64(&pu.blocked),
+			TopDests:       make([]DestUsage, 0, len(dests)),
+		}
+		for d, c := range dests {
+			u.TopDests = append(u.TopDests, DestUsage{Dest: d, Counts: c.load()})
+		}
+		sort.Slice(u.TopDests, func(i, j int) bool {
+			a, b := &u.TopDests[i], &u.TopDests[j]
+			if a.bytes() != b.bytes() {
+				return a.bytes() > b.bytes()
+			}
+			if a.Proto != b.Proto {
+				return a.Proto < b.Proto
+			}
+			return a.Port < b.Port
+		})
+		if len(u.TopDests) > MaxTopDests {
+			u.TopDests = u.TopDests[:MaxTopDests]
+		}
+		ret = append(ret, u)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].bytes() != ret[j].bytes() {
+			return ret[i].bytes() > ret[j].bytes()
+		}
+		return ret[i].IP.Less(ret[j].IP)
+	})
+	return ret
+}
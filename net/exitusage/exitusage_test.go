@@ -0,0 +1,150 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package exitusage
+
+import (
+	"reflect"
+	"testing"
+
+	"inet.af/netaddr"
+	"tailscale.com/net/packet"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/ipproto"
+)
+
+func udp4(src, dst string, sport, dport uint16) *packet.Parsed {
+	h := &packet.UDP4Header{
+		IP4Header: packet.IP4Header{
+			Src: netaddr.MustParseIP(src),
+			Dst: netaddr.MustParseIP(dst),
+		},
+		SrcPort: sport,
+		DstPort: dport,
+	}
+	p := new(packet.Parsed)
+	p.Decode(packet.Generate(h, []byte("payload")))
+	return p
+}
+
+func TestTracker(t *testing.T) {
+	const (
+		peer  = "100.101.102.103"
+		peer2 = "100.101.102.104"
+		inet  = "8.8.8.8"
+	)
+	var tr Tracker
+
+	// Not an exit node: nothing is tracked or blocked.
+	if !tr.Inbound(udp4(peer, inet, 1234, 53)) {
+		t.Errorf("packet blocked when not an exit node")
+	}
+	if u := tr.Usage(); len(u) != 0 {
+		t.Errorf("usage when not an exit node: %+v", u)
+	}
+
+	tr.SetConfig(true, []netaddr.IPPrefix{netaddr.MustParseIPPrefix("192.168.0.0/24")}, []tailcfg.PortRange{{First: 25, Last: 25}, {First: 137, Last: 139}})
+
+	tests := []struct {
+		name    string
+		p       *packet.Parsed
+		inbound bool
+		want    bool
+	}{
+		{"dns", udp4(peer, inet, 1234, 53), true, true},
+		{"dns_reply", udp4(inet, peer, 53, 1234), false, true},
+		{"dns_again", udp4(peer, inet, 1235, 53), true, true},
+		{"smtp", udp4(peer, inet, 1234, 25), true, false},
+		{"netbios", udp4(peer, inet, 1234, 138), true, false},
+		{"subnet", udp4(peer, "192.168.0.1", 1234, 25), true, true},
+		{"peer_to_peer", udp4(peer, peer2, 1234, 25), true, true},
+		{"peer2", udp4(peer2, "1.1.1.1", 1234, 443), true, true},
+	}
+	var n uint64
+	for _, tt := range tests {
+		if tt.inbound {
+			if got := tr.Inbound(tt.p); got != tt.want {
+				t.Errorf("%s: Inbound = %v; want %v", tt.name, got, tt.want)
+			}
+		} else {
+			tr.Outbound(tt.p)
+		}
+		n = uint64(len(tt.p.Buffer()))
+	}
+
+	dns := Dest{Proto: ipproto.UDP, Port: 53}
+	want := []PeerUsage{
+		{
+			IP:             netaddr.MustParseIP(peer),
+			Counts:         Counts{TxPackets: 2, TxBytes: 2 * n, RxPackets: 1, RxBytes: n},
+			BlockedPackets: 2,
+			TopDests: []DestUsage{
+				{Dest: dns, Counts: Counts{TxPackets: 2, TxBytes: 2 * n, RxPackets: 1, RxBytes: n}},
+			},
+		},
+		{
+			IP:     netaddr.MustParseIP(peer2),
+			Counts: Counts{TxPackets: 1, TxBytes: n},
+			TopDests: []DestUsage{
+				{Dest: Dest{Proto: ipproto.UDP, Port: 443}, Counts: Counts{TxPackets: 1, TxBytes: n}},
+			},
+		},
+	}
+	if got := tr.Usage(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Usage:\n got %+v\nwant %+v", got, want)
+	}
+
+	tr.PrunePeers(func(ip netaddr.IP) bool { return ip == netaddr.MustParseIP(peer) })
+	if u := tr.Usage(); len(u) != 1 || u[0].IP != netaddr.MustParseIP(peer) {
+		t.Errorf("Usage after prune = %+v; want only %v", u, peer)
+	}
+
+	tr.SetConfig(false, nil, nil)
+	if !tr.Inbound(udp4(peer, inet, 1234, 25)) {
+		t.Errorf("packet blocked after exit node disabled")
+	}
+	if u := tr.Usage(); len(u) != 0 {
+		t.Errorf("usage after exit node disabled: %+v", u)
+	}
+}
+
+func TestTrackerMaxPeers(t *testing.T) {
+	var tr Tracker
+	tr.SetConfig(true, nil, []tailcfg.PortRange{{First: 25, Last: 25}})
+	for i := 0; i < maxPeers+10; i++ {
+		src := netaddr.IPv4(100, 64, byte(i>>8), byte(i)).String()
+		if !tr.Inbound(udp4(src, "8.8.8.8", 1234, 53)) {
+			t.Fatalf("packet from %v blocked", src)
+		}
+	}
+	if n := len(tr.Usage()); n != maxPeers {
+		t.Errorf("tracked %d peers; want %d", n, maxPeers)
+	}
+	if tr.Inbound(udp4("100.65.0.1", "8.8.8.8", 1234, 25)) {
+		t.Errorf("packet from untracked peer not blocked")
+	}
+}
+
+func TestTrackerMaxDests(t *testing.T) {
+	var tr Tracker
+	tr.SetConfig(true, nil, nil)
+	for port := uint16(1); port <= maxDests+10; port++ {
+		tr.Inbound(udp4("100.101.102.103", "8.8.8.8", 1234, port))
+	}
+	dests := tr.loadPeers()[netaddr.MustParseIP("100.101.102.103")].loadDests()
+	if len(dests) != maxDests+1 {
+		t.Errorf("tracked %d dests; want %d", len(dests), maxDests+1)
+	}
+	if c := dests[Dest{Proto: ipproto.UDP}]; c == nil || c.load().TxPackets != 10 {
+		t.Errorf("overflow dest = %+v; want 10 packets", c)
+	}
+
+	u := tr.Usage()
+	if len(u) != 1 || len(u[0].TopDests) != MaxTopDests {
+		t.Fatalf("Usage = %+v; want 1 peer with %d dests", u, MaxTopDests)
+	}
+	if d := u[0].TopDests[0].Dest; d.Port != 0 {
+		t.Errorf("top dest = %+v; want the overflow dest", d)
+	}
+}
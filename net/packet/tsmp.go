@@ -100,6 +100,10 @@ func (r TailscaleRejectReason) IsZero() bool { return r == TailscaleRejectReason
 	// RejectedDueToHostFirewall means that the target host's
 	// firewall is blocking the traffic.
 	RejectedDueToHostFirewall TailscaleRejectReason = 'W'
+
+	// RejectedDueToExitPolicy means that the exit node blocks
+	// traffic to the destination port.
+	RejectedDueToExitPolicy TailscaleRejectReason = 'E'
 )
 
 func (r TailscaleRejectReason) String() string {
@@ -112,6 +116,8 @@ func (r TailscaleRejectReason) String() string {
 		return "host-ip-forwarding-unavailable"
 	case RejectedDueToHostFirewall:
 		return "host-firewall"
+	case RejectedDueToExitPolicy:
+		return "exit-policy"
 	}
 	return fmt.Sprintf("0x%02x", byte(r))
 }
@@ -14,8 +14,11 @@
 package socks5
 
 import (
+	"bytes"
 	"context"
+	"crypto/subtle"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -27,7 +30,9 @@
 )
 
 const (
+	// Authentication methods, as defined in RFC 1928 section 3.
 	noAuthRequired   byte = 0
+	passwordAuth     byte = 2
 	noAcceptableAuth byte = 255
 
 	// socks5Version is the byte that represents the SOCKS version
@@ -35,6 +40,13 @@
 	socks5Version byte = 5
 )
 
+// Username/password authentication, as defined in RFC 1929.
+const (
+	passwordAuthVersion byte = 1
+	passwordAuthSuccess byte = 0
+	passwordAuthFailure byte = 1
+)
+
 // commandType are the bytes sent in SOCKS5 packets
 // that represent the kind of connection the client needs.
 type commandType byte
@@ -83,7 +95,32 @@ type Server struct {
 
 	// Dialer optionally specifies the dialer to use for outgoing connections.
 	// If nil, the net package's standard dialer is used.
+	//
+	// It's called with network "tcp" for CONNECT requests and "udp"
+	// for each destination of a UDP ASSOCIATE request.
 	Dialer func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// Credentials optionally specifies the username/password
+	// credentials that clients must authenticate with. If nil, no
+	// authentication is required.
+	Credentials Credentials
+}
+
+// Credentials validates the username and password a client
+// authenticates with (RFC 1929).
+type Credentials interface {
+	// Valid reports whether password is the password of username.
+	Valid(username, password string) bool
+}
+
+// StaticCredentials is a Credentials of a fixed set of usernames,
+// mapped to their passwords.
+type StaticCredentials map[string]string
+
+// Valid implements Credentials.
+func (sc StaticCredentials) Valid(username, password string) bool {
+	want, ok := sc[username]
+	return ok && subtle.ConstantTimeCompare([]byte(want), []byte(password)) == 1
 }
 
 func (s *Server) dial(ctx context.Context, network, addr string) (net.Conn, error) {
@@ -135,31 +172,84 @@ type Conn struct {
 
 // Run starts the new connection.
 func (c *Conn) Run() error {
-	err := parseClientGreeting(c.clientConn)
+	authMethod := noAuthRequired
+	if c.srv.Credentials != nil {
+		authMethod = passwordAuth
+	}
+	err := parseClientGreeting(c.clientConn, authMethod)
 	if err != nil {
 		c.clientConn.Write([]byte{socks5Version, noAcceptableAuth})
 		return err
 	}
-	c.clientConn.Write([]byte{socks5Version, noAuthRequired})
+	c.clientConn.Write([]byte{socks5Version, authMethod})
+	if authMethod == passwordAuth {
+		user, pwd, err := parseClientAuth(c.clientConn)
+		if err != nil {
+			c.clientConn.Write([]byte{passwordAuthVersion, passwordAuthFailure})
+			return err
+		}
+		if !c.srv.Credentials.Valid(user, pwd) {
+			c.clientConn.Write([]byte{passwordAuthVersion, passwordAuthFailure})
+			return fmt.Errorf("invalid credentials for user %q", user)
+		}
+		c.clientConn.Write([]byte{passwordAuthVersion, passwordAuthSuccess})
+	}
 	return c.handleRequest()
 }
 
 func (c *Conn) handleRequest() error {
 	req, err := parseClientRequest(c.clientConn)
 	if err != nil {
-		res := &response{reply: generalFailure}
-		buf, _ := res.marshal()
-		c.clientConn.Write(buf)
+		c.writeFailure(generalFailure)
 		return err
 	}
-	if req.command != connect {
-		res := &response{reply: commandNotSupported}
-		buf, _ := res.marshal()
-		c.clientConn.Write(buf)
+	c.request = req
+	switch req.command {
+	case connect:
+		return c.handleConnect()
+	case udpAssociate:
+		return c.handleUDPAssociate()
+	default:
+		c.writeFailure(commandNotSupported)
 		return fmt.Errorf("unsupported command %v", req.command)
 	}
-	c.request = req
+}
+
+// writeFailure writes a reply with the failure code to the client.
+func (c *Conn) writeFailure(code replyCode) {
+	res := &response{reply: code}
+	buf, _ := res.marshal()
+	c.clientConn.Write(buf)
+}
+
+// writeSuccess writes a success reply with the bind address addr
+// ("host:port") to the client.
+func (c *Conn) writeSuccess(addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		c.writeFailure(generalFailure)
+		return err
+	}
+	port, _ := strconv.Atoi(portStr)
+	res := &response{
+		reply:        success,
+		bindAddrType: addrTypeOf(host),
+		bindAddr:     host,
+		bindPort:     uint16(port),
+	}
+	buf, err := res.marshal()
+	if err != nil {
+		res = &response{reply: generalFailure}
+		buf, _ = res.marshal()
+	}
+	_, werr := c.clientConn.Write(buf)
+	if err != nil {
+		return err
+	}
+	return werr
+}
 
+func (c *Conn) handleConnect() error {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 	srv, err := c.srv.dial(
@@ -168,40 +258,13 @@ func (c *Conn) handleRequest() error {
 		net.JoinHostPort(c.request.destination, strconv.Itoa(int(c.request.port))),
 	)
 	if err != nil {
-		res := &response{reply: generalFailure}
-		buf, _ := res.marshal()
-		c.clientConn.Write(buf)
+		c.writeFailure(generalFailure)
 		return err
 	}
 	defer srv.Close()
-	serverAddr, serverPortStr, err := net.SplitHostPort(srv.LocalAddr().String())
-	if err != nil {
+	if err := c.writeSuccess(srv.LocalAddr().String()); err != nil {
 		return err
 	}
-	serverPort, _ := strconv.Atoi(serverPortStr)
-
-	var bindAddrType addrType
-	if ip := net.ParseIP(serverAddr); ip != nil {
-		if ip.To4() != nil {
-			bindAddrType = ipv4
-		} else {
-			bindAddrType = ipv6
-		}
-	} else {
-		bindAddrType = domainName
-	}
-	res := &response{
-		reply:        success,
-		bindAddrType: bindAddrType,
-		bindAddr:     serverAddr,
-		bindPort:     uint16(serverPort),
-	}
-	buf, err := res.marshal()
-	if err != nil {
-		res = &response{reply: generalFailure}
-		buf, _ = res.marshal()
-	}
-	c.clientConn.Write(buf)
 
 	errc := make(chan error, 2)
 	go func() {
@@ -221,10 +284,181 @@ func (c *Conn) handleRequest() error {
 	return <-errc
 }
 
+// handleUDPAssociate relays UDP datagrams between the client and
+// their destinations until the client closes the TCP connection the
+// association was requested on, as described in RFC 1928 section 7.
+func (c *Conn) handleUDPAssociate() error {
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: addrIP(c.clientConn.LocalAddr())})
+	if err != nil {
+		c.writeFailure(generalFailure)
+		return err
+	}
+	defer pc.Close()
+	if err := c.writeSuccess(pc.LocalAddr().String()); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		// The association ends when the TCP connection does.
+		io.Copy(io.Discard, c.clientConn)
+		cancel()
+		pc.Close()
+	}()
+
+	r := &udpRelay{
+		srv:      c.srv,
+		pc:       pc,
+		clientIP: addrIP(c.clientConn.RemoteAddr()),
+		conns:    map[string]net.Conn{},
+	}
+	if ip := net.ParseIP(c.request.destination); ip != nil && !ip.IsUnspecified() && c.request.port != 0 {
+		// The client told us where it'll send datagrams from.
+		r.clientAddr = &net.UDPAddr{IP: ip, Port: int(c.request.port)}
+	}
+	err = r.serve(ctx)
+	r.close()
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// maxUDPPacketSize is the largest UDP datagram the relay handles.
+const maxUDPPacketSize = 65535
+
+// maxUDPDestinations is the maximum number of destinations a UDP
+// association can send datagrams to.
+const maxUDPDestinations = 256
+
+// udpRelay relays the datagrams of a UDP association.
+type udpRelay struct {
+	srv      *Server
+	pc       *net.UDPConn // the relay's socket the client sends to
+	clientIP net.IP       // datagrams from other IPs are dropped
+
+	// clientAddr is where the client sends datagrams from. If not
+	// given in the request, it's set by the first datagram, before any
+	// replies can be sent.
+	clientAddr *net.UDPAddr
+
+	// conns are the connections to destinations, by host:port. It's
+	// only accessed by the serve goroutine.
+	conns map[string]net.Conn
+}
+
+// serve relays datagrams from the client to their destinations until
+// reading from the relay's socket fails.
+func (r *udpRelay) serve(ctx context.Context) error {
+	buf := make([]byte, maxUDPPacketSize)
+	for {
+		n, from, err := r.pc.ReadFromUDP(buf)
+		if err != nil {
+			return err
+		}
+		if !from.IP.Equal(r.clientIP) {
+			continue
+		}
+		if r.clientAddr == nil {
+			r.clientAddr = from
+		} else if !from.IP.Equal(r.clientAddr.IP) || from.Port != r.clientAddr.Port {
+			continue
+		}
+		hdr, data, err := parseUDPRequest(buf[:n])
+		if err != nil {
+			r.srv.logf("udp: %v", err)
+			continue
+		}
+		if hdr.frag != 0 {
+			// Fragmentation is optional, and we don't support it.
+			continue
+		}
+		dst, err := r.conn(ctx, hdr)
+		if err != nil {
+			r.srv.logf("udp: %v", err)
+			continue
+		}
+		dst.Write(data)
+	}
+}
+
+// conn returns the connection to the destination of hdr, dialing it if
+// needed.
+func (r *udpRelay) conn(ctx context.Context, hdr *udpRequest) (net.Conn, error) {
+	addr := net.JoinHostPort(hdr.destination, strconv.Itoa(int(hdr.port)))
+	if c, ok := r.conns[addr]; ok {
+		return c, nil
+	}
+	if len(r.conns) >= maxUDPDestinations {
+		return nil, fmt.Errorf("too many destinations; dropping datagram to %s", addr)
+	}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	c, err := r.srv.dial(ctx, "udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	r.conns[addr] = c
+	go r.relayReplies(c, hdr)
+	return c, nil
+}
+
+// relayReplies relays the datagrams received from the destination of
+// hdr back to the client, until c is closed.
+func (r *udpRelay) relayReplies(c net.Conn, hdr *udpRequest) {
+	buf := []byte{0, 0, 0, byte(hdr.destAddrType)} // RSV, FRAG, ATYP
+	buf, err := appendAddr(buf, hdr.destAddrType, hdr.destination, hdr.port)
+	if err != nil {
+		r.srv.logf("udp: %v", err)
+		return
+	}
+	hdrLen := len(buf)
+	buf = append(buf, make([]byte, maxUDPPacketSize-hdrLen)...)
+	for {
+		n, err := c.Read(buf[hdrLen:])
+		if err != nil {
+			return
+		}
+		r.pc.WriteToUDP(buf[:hdrLen+n], r.clientAddr)
+	}
+}
+
+func (r *udpRelay) close() {
+	for _, c := range r.conns {
+		c.Close()
+	}
+}
+
+// addrIP returns the IP of a TCP or UDP address, or nil.
+func addrIP(a net.Addr) net.IP {
+	switch a := a.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	host, _, err := net.SplitHostPort(a.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// addrTypeOf returns the type of the address host.
+func addrTypeOf(host string) addrType {
+	if ip := net.ParseIP(host); ip != nil {
+		if ip.To4() != nil {
+			return ipv4
+		}
+		return ipv6
+	}
+	return domainName
+}
+
 // parseClientGreeting parses a request initiation packet
-// and returns a slice that contains the acceptable auth methods
-// for the client.
-func parseClientGreeting(r io.Reader) error {
+// and returns an error if the client doesn't support authMethod.
+func parseClientGreeting(r io.Reader, authMethod byte) error {
 	var hdr [2]byte
 	_, err := io.ReadFull(r, hdr[:])
 	if err != nil {
@@ -240,13 +474,38 @@ func parseClientGreeting(r io.Reader) error {
 		return fmt.Errorf("could not read methods")
 	}
 	for _, m := range methods {
-		if m == noAuthRequired {
+		if m == authMethod {
 			return nil
 		}
 	}
 	return fmt.Errorf("no acceptable auth methods")
 }
 
+// parseClientAuth parses a username/password authentication request,
+// as defined in RFC 1929.
+func parseClientAuth(r io.Reader) (username, password string, err error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return "", "", fmt.Errorf("could not read auth packet header")
+	}
+	if hdr[0] != passwordAuthVersion {
+		return "", "", fmt.Errorf("incompatible auth version")
+	}
+	user := make([]byte, int(hdr[1]))
+	if _, err := io.ReadFull(r, user); err != nil {
+		return "", "", fmt.Errorf("could not read username")
+	}
+	var passLen [1]byte
+	if _, err := io.ReadFull(r, passLen[:]); err != nil {
+		return "", "", fmt.Errorf("could not read password length")
+	}
+	pass := make([]byte, int(passLen[0]))
+	if _, err := io.ReadFull(r, pass); err != nil {
+		return "", "", fmt.Errorf("could not read password")
+	}
+	return string(user), string(pass), nil
+}
+
 // request represents data contained within a SOCKS5
 // connection request packet.
 type request struct {
@@ -266,53 +525,86 @@ func parseClientRequest(r io.Reader) (*request, error) {
 	}
 	cmd := hdr[1]
 	destAddrType := addrType(hdr[3])
+	destination, port, err := parseAddr(r, destAddrType)
+	if err != nil {
+		return nil, err
+	}
+	return &request{
+		command:      commandType(cmd),
+		destination:  destination,
+		port:         port,
+		destAddrType: destAddrType,
+	}, nil
+}
 
-	var destination string
-	var port uint16
-
+// parseAddr reads an address of type destAddrType and a port from r.
+func parseAddr(r io.Reader, destAddrType addrType) (destination string, port uint16, err error) {
 	if destAddrType == ipv4 {
 		var ip [4]byte
 		_, err = io.ReadFull(r, ip[:])
 		if err != nil {
-			return nil, fmt.Errorf("could not read IPv4 address")
+			return "", 0, fmt.Errorf("could not read IPv4 address")
 		}
 		destination = net.IP(ip[:]).String()
 	} else if destAddrType == domainName {
 		var dstSizeByte [1]byte
 		_, err = io.ReadFull(r, dstSizeByte[:])
 		if err != nil {
-			return nil, fmt.Errorf("could not read domain name size")
+			return "", 0, fmt.Errorf("could not read domain name size")
 		}
 		dstSize := int(dstSizeByte[0])
 		domainName := make([]byte, dstSize)
 		_, err = io.ReadFull(r, domainName)
 		if err != nil {
-			return nil, fmt.Errorf("could not read domain name")
+			return "", 0, fmt.Errorf("could not read domain name")
 		}
 		destination = string(domainName)
 	} else if destAddrType == ipv6 {
 		var ip [16]byte
 		_, err = io.ReadFull(r, ip[:])
 		if err != nil {
-			return nil, fmt.Errorf("could not read IPv6 address")
+			return "", 0, fmt.Errorf("could not read IPv6 address")
 		}
 		destination = net.IP(ip[:]).String()
 	} else {
-		return nil, fmt.Errorf("unsupported address type")
+		return "", 0, fmt.Errorf("unsupported address type")
 	}
 	var portBytes [2]byte
 	_, err = io.ReadFull(r, portBytes[:])
 	if err != nil {
-		return nil, fmt.Errorf("could not read port")
+		return "", 0, fmt.Errorf("could not read port")
 	}
 	port = binary.BigEndian.Uint16(portBytes[:])
+	return destination, port, nil
+}
 
-	return &request{
-		command:      commandType(cmd),
+// udpRequest is the header of a UDP datagram sent through the relay,
+// as defined in RFC 1928 section 7.
+type udpRequest struct {
+	frag         byte
+	destination  string
+	port         uint16
+	destAddrType addrType
+}
+
+// parseUDPRequest parses the header of the datagram b, and returns it
+// and the data following it.
+func parseUDPRequest(b []byte) (*udpRequest, []byte, error) {
+	if len(b) < 4 {
+		return nil, nil, errors.New("short datagram")
+	}
+	destAddrType := addrType(b[3])
+	r := bytes.NewReader(b[4:])
+	destination, port, err := parseAddr(r, destAddrType)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &udpRequest{
+		frag:         b[2],
 		destination:  destination,
 		port:         port,
 		destAddrType: destAddrType,
-	}, nil
+	}, b[len(b)-r.Len():], nil
 }
 
 // response contains the contents of
@@ -339,33 +631,32 @@ func (res *response) marshal() ([]byte, error) {
 		return pkt, nil
 	}
 
-	var addr []byte
-	switch res.bindAddrType {
+	return appendAddr(pkt, res.bindAddrType, res.bindAddr, res.bindPort)
+}
+
+// appendAddr appends the address addr of type typ and port to b.
+func appendAddr(b []byte, typ addrType, addr string, port uint16) ([]byte, error) {
+	switch typ {
 	case ipv4:
-		addr = net.ParseIP(res.bindAddr).To4()
-		if addr == nil {
-			return nil, fmt.Errorf("invalid IPv4 address for binding")
+		ip := net.ParseIP(addr).To4()
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IPv4 address %q", addr)
 		}
+		b = append(b, ip...)
 	case domainName:
-		if len(res.bindAddr) > 255 {
-			return nil, fmt.Errorf("invalid domain name for binding")
+		if len(addr) > 255 {
+			return nil, fmt.Errorf("invalid domain name %q", addr)
 		}
-		addr = make([]byte, 0, len(res.bindAddr)+1)
-		addr = append(addr, byte(len(res.bindAddr)))
-		addr = append(addr, []byte(res.bindAddr)...)
+		b = append(b, byte(len(addr)))
+		b = append(b, addr...)
 	case ipv6:
-		addr = net.ParseIP(res.bindAddr).To16()
-		if addr == nil {
-			return nil, fmt.Errorf("invalid IPv6 address for binding")
+		ip := net.ParseIP(addr).To16()
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IPv6 address %q", addr)
 		}
+		b = append(b, ip...)
 	default:
 		return nil, fmt.Errorf("unsupported address type")
 	}
-
-	pkt = append(pkt, addr...)
-	port := make([]byte, 2)
-	binary.BigEndian.PutUint16(port, uint16(res.bindPort))
-	pkt = append(pkt, port...)
-
-	return pkt, nil
+	return append(b, byte(port>>8), byte(port)), nil
 }
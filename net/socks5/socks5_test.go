@@ -5,10 +5,15 @@
 package socks5
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"net"
+	"sync"
 	"testing"
+	"time"
 
 	"golang.org/x/net/proxy"
 )
@@ -75,3 +80,222 @@ func TestRead(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestAuth(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	go func() {
+		for {
+			c, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			c.Write([]byte("Test"))
+			c.Close()
+		}
+	}()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{
+		Logf:        t.Logf,
+		Credentials: StaticCredentials{"alice": "hunter2"},
+	}
+	go srv.Serve(ln)
+	defer ln.Close()
+
+	tests := []struct {
+		name   string
+		auth   *proxy.Auth
+		wantOK bool
+	}{
+		{"valid", &proxy.Auth{User: "alice", Password: "hunter2"}, true},
+		{"wrong-password", &proxy.Auth{User: "alice", Password: "hunter3"}, false},
+		{"unknown-user", &proxy.Auth{User: "bob", Password: "hunter2"}, false},
+		{"no-auth", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := proxy.SOCKS5("tcp", ln.Addr().String(), tt.auth, proxy.Direct)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c, err := d.Dial("tcp", backend.Addr().String())
+			if !tt.wantOK {
+				if err == nil {
+					c.Close()
+					t.Fatal("dial succeeded; want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			buf := make([]byte, 4)
+			if _, err := io.ReadFull(c, buf); err != nil {
+				t.Fatal(err)
+			}
+			if string(buf) != "Test" {
+				t.Fatalf("got: %q want: Test", buf)
+			}
+		})
+	}
+}
+
+// udpEchoDialer is a Server.Dialer for "udp" whose connections are in
+// memory, and echo each datagram written to them prefixed by the
+// address they were dialed to.
+type udpEchoDialer struct {
+	mu     sync.Mutex
+	dialed []string
+}
+
+func (d *udpEchoDialer) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	if network != "udp" {
+		return nil, fmt.Errorf("unexpected network %q", network)
+	}
+	d.mu.Lock()
+	d.dialed = append(d.dialed, addr)
+	d.mu.Unlock()
+	c1, c2 := net.Pipe()
+	go func() {
+		defer c2.Close()
+		buf := make([]byte, 1500)
+		for {
+			n, err := c2.Read(buf)
+			if err != nil {
+				return
+			}
+			if _, err := c2.Write([]byte(addr + " " + string(buf[:n]))); err != nil {
+				return
+			}
+		}
+	}()
+	return c1, nil
+}
+
+func TestUDPAssociate(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	d := &udpEchoDialer{}
+	srv := &Server{Logf: t.Logf, Dialer: d.dial}
+	go srv.Serve(ln)
+
+	// Negotiate a UDP association.
+	tc, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tc.Close()
+	tc.SetDeadline(time.Now().Add(5 * time.Second))
+	tc.Write([]byte{socks5Version, 1, noAuthRequired})
+	mustRead(t, tc, []byte{socks5Version, noAuthRequired})
+	tc.Write([]byte{socks5Version, byte(udpAssociate), 0, byte(ipv4), 0, 0, 0, 0, 0, 0})
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(tc, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[1] != byte(success) || addrType(reply[3]) != ipv4 {
+		t.Fatalf("bad reply %v", reply)
+	}
+	relayAddr := &net.UDPAddr{IP: net.IP(reply[4:8]), Port: int(binary.BigEndian.Uint16(reply[8:10]))}
+
+	uc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uc.Close()
+	uc.SetDeadline(time.Now().Add(5 * time.Second))
+
+	roundTrip := func(typ addrType, host string, port uint16, data string) {
+		t.Helper()
+		pkt, err := appendAddr([]byte{0, 0, 0, byte(typ)}, typ, host, port)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hdrLen := len(pkt)
+		pkt = append(pkt, data...)
+		if _, err := uc.WriteToUDP(pkt, relayAddr); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 1500)
+		n, _, err := uc.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The reply has the same header, as it's from the same
+		// destination.
+		if !bytes.Equal(buf[:hdrLen], pkt[:hdrLen]) {
+			t.Errorf("reply header = %v; want %v", buf[:hdrLen], pkt[:hdrLen])
+		}
+		want := net.JoinHostPort(host, fmt.Sprint(port)) + " " + data
+		if got := string(buf[hdrLen:n]); got != want {
+			t.Errorf("reply = %q; want %q", got, want)
+		}
+	}
+	roundTrip(ipv4, "100.64.0.1", 53, "query1")
+	roundTrip(domainName, "example.com", 443, "quic")
+	roundTrip(ipv6, "fd7a:115c:a1e0::1", 53, "query2")
+	roundTrip(ipv4, "100.64.0.1", 53, "query3")
+
+	d.mu.Lock()
+	dialed := fmt.Sprint(d.dialed)
+	d.mu.Unlock()
+	if want := "[100.64.0.1:53 example.com:443 [fd7a:115c:a1e0::1]:53]"; dialed != want {
+		t.Errorf("dialed %s; want %s", dialed, want)
+	}
+
+	// Closing the TCP connection ends the association.
+	tc.Close()
+	for i := 0; ; i++ {
+		pkt, _ := appendAddr([]byte{0, 0, 0, byte(ipv4)}, ipv4, "100.64.0.1", 53)
+		uc.WriteToUDP(append(pkt, "late"...), relayAddr)
+		uc.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		if _, _, err := uc.ReadFromUDP(make([]byte, 1500)); err != nil {
+			break
+		}
+		if i == 100 {
+			t.Fatal("association still relaying after TCP connection closed")
+		}
+	}
+}
+
+func TestParseUDPRequest(t *testing.T) {
+	pkt, err := appendAddr([]byte{0, 0, 1, byte(domainName)}, domainName, "example.com", 53)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkt = append(pkt, "data"...)
+	hdr, data, err := parseUDPRequest(pkt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hdr.frag != 1 || hdr.destination != "example.com" || hdr.port != 53 || string(data) != "data" {
+		t.Errorf("got %+v, %q", hdr, data)
+	}
+	for _, bad := range [][]byte{nil, {0, 0, 0}, {0, 0, 0, byte(ipv4), 1, 2}, {0, 0, 0, 9, 1, 2, 3, 4, 0, 53}} {
+		if _, _, err := parseUDPRequest(bad); err == nil {
+			t.Errorf("parseUDPRequest(%v) succeeded; want error", bad)
+		}
+	}
+}
+
+func mustRead(t *testing.T, r io.Reader, want []byte) {
+	t.Helper()
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(r, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("read %v; want %v", got, want)
+	}
+}
@@ -7,7 +7,9 @@
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net"
+	"sync"
 	"time"
 )
 
@@ -19,19 +21,24 @@ func RunClient(direction Direction, duration time.Duration, host string) ([]Resu
 	if err != nil {
 		return nil, err
 	}
+	return RunClientConn(conn, direction, duration)
+}
 
+// RunClientConn runs a speedtest over conn, which is connected to a
+// speedtest server, and closes conn.
+func RunClientConn(conn net.Conn, direction Direction, duration time.Duration) ([]Result, error) {
 	conf := config{TestDuration: duration, Version: version, Direction: direction}
 
 	defer conn.Close()
 	encoder := json.NewEncoder(conn)
 
-	if err = encoder.Encode(conf); err != nil {
+	if err := encoder.Encode(conf); err != nil {
 		return nil, err
 	}
 
 	var response configResponse
 	decoder := json.NewDecoder(conn)
-	if err = decoder.Decode(&response); err != nil {
+	if err := decoder.Decode(&response); err != nil {
 		return nil, err
 	}
 	if response.Error != "" {
@@ -40,3 +47,77 @@ func RunClient(direction Direction, duration time.Duration, host string) ([]Resu
 
 	return doTest(conn, conf)
 }
+
+// RunClientParallel runs a speedtest over streams connections at once,
+// each made by dial, and returns the combined results of all streams.
+func RunClientParallel(dial func() (net.Conn, error), direction Direction, duration time.Duration, streams int) ([]Result, error) {
+	if streams < 1 {
+		return nil, fmt.Errorf("invalid number of streams %d", streams)
+	}
+	conns := make([]net.Conn, 0, streams)
+	for i := 0; i < streams; i++ {
+		c, err := dial()
+		if err != nil {
+			for _, c := range conns {
+				c.Close()
+			}
+			return nil, err
+		}
+		conns = append(conns, c)
+	}
+
+	var wg sync.WaitGroup
+	results := make([][]Result, streams)
+	errs := make([]error, streams)
+	for i, c := range conns {
+		wg.Add(1)
+		go func(i int, c net.Conn) {
+			defer wg.Done()
+			results[i], errs[i] = RunClientConn(c, direction, duration)
+		}(i, c)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return mergeResults(results), nil
+}
+
+// mergeResults combines the results of parallel streams. The nth
+// intervals of the streams are combined into one, as are the totals.
+func mergeResults(streams [][]Result) []Result {
+	var merged []Result
+	var total Result
+	total.Total = true
+	for _, rs := range streams {
+		i := 0
+		for _, r := range rs {
+			if r.Total {
+				total.Bytes += r.Bytes
+				if r.IntervalEnd > total.IntervalEnd {
+					total.IntervalEnd = r.IntervalEnd
+				}
+				continue
+			}
+			if i == len(merged) {
+				merged = append(merged, r)
+			} else {
+				m := &merged[i]
+				m.Bytes += r.Bytes
+				if r.IntervalStart < m.IntervalStart {
+					m.IntervalStart = r.IntervalStart
+				}
+				if r.IntervalEnd > m.IntervalEnd {
+					m.IntervalEnd = r.IntervalEnd
+				}
+			}
+			i++
+		}
+	}
+	if total.IntervalEnd > 0 {
+		merged = append(merged, total)
+	}
+	return merged
+}
@@ -27,19 +27,19 @@ func Serve(l net.Listener) error {
 		if err != nil {
 			return err
 		}
-		err = handleConnection(conn)
+		err = ServeConn(conn)
 		if err != nil {
 			return err
 		}
 	}
 }
 
-// handleConnection handles the initial exchange between the server and the client.
+// ServeConn runs the server side of a speedtest on conn, and closes it.
 // It reads the testconfig message into a config struct. If any errors occur with
-// the testconfig (specifically, if there is a version mismatch), it will return those
-// errors to the client with a configResponse. After the exchange, it will start
-// the speed test.
-func handleConnection(conn net.Conn) error {
+// the testconfig (specifically, if there is a version mismatch or the
+// duration is out of range), it will return those errors to the client
+// with a configResponse. After the exchange, it will start the speed test.
+func ServeConn(conn net.Conn) error {
 	defer conn.Close()
 	var conf config
 
@@ -61,6 +61,11 @@ func handleConnection(conn net.Conn) error {
 		encoder.Encode(configResponse{Error: err.Error()})
 		return err
 	}
+	if conf.TestDuration < MinDuration || conf.TestDuration > MaxDuration {
+		err = fmt.Errorf("test duration must be within %v and %v", MinDuration, MaxDuration)
+		encoder.Encode(configResponse{Error: err.Error()})
+		return err
+	}
 
 	// Start the test
 	encoder.Encode(configResponse{})
@@ -6,7 +6,10 @@
 
 import (
 	"net"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestDownload(t *testing.T) {
@@ -79,3 +82,40 @@ type state struct {
 		t.Error("server error:", err)
 	}
 }
+
+func TestDurationLimits(t *testing.T) {
+	for _, d := range []time.Duration{time.Second, MaxDuration + time.Second} {
+		c1, c2 := net.Pipe()
+		go ServeConn(c2)
+		_, err := RunClientConn(c1, Download, d)
+		if err == nil || !strings.Contains(err.Error(), "test duration must be within") {
+			t.Errorf("duration %v: got error %v", d, err)
+		}
+	}
+}
+
+func TestMergeResults(t *testing.T) {
+	sec := func(n float64) time.Duration { return time.Duration(n * float64(time.Second)) }
+	streams := [][]Result{
+		{
+			{Bytes: 100, IntervalStart: 0, IntervalEnd: sec(1.01)},
+			{Bytes: 200, IntervalStart: sec(1.01), IntervalEnd: sec(2)},
+			{Bytes: 300, IntervalStart: 0, IntervalEnd: sec(2), Total: true},
+		},
+		{
+			{Bytes: 10, IntervalStart: 0, IntervalEnd: sec(1.02)},
+			{Bytes: 20, IntervalStart: sec(1.02), IntervalEnd: sec(2.01)},
+			{Bytes: 5, IntervalStart: sec(2.01), IntervalEnd: sec(2.1)},
+			{Bytes: 35, IntervalStart: 0, IntervalEnd: sec(2.1), Total: true},
+		},
+	}
+	want := []Result{
+		{Bytes: 110, IntervalStart: 0, IntervalEnd: sec(1.02)},
+		{Bytes: 220, IntervalStart: sec(1.01), IntervalEnd: sec(2.01)},
+		{Bytes: 5, IntervalStart: sec(2.01), IntervalEnd: sec(2.1)},
+		{Bytes: 335, IntervalStart: 0, IntervalEnd: sec(2.1), Total: true},
+	}
+	if got := mergeResults(streams); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v\nwant %+v", got, want)
+	}
+}
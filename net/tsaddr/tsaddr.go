@@ -37,6 +37,7 @@ func CGNATRange() netaddr.IPPrefix {
 	ulaRange     oncePrefix
 	tsUlaRange   oncePrefix
 	tsViaRange   oncePrefix
+	tsNAT64Range oncePrefix
 	ula4To6Range oncePrefix
 	ulaEph6Range oncePrefix
 	serviceIPv6  oncePrefix
@@ -83,6 +84,17 @@ func TailscaleViaRange() netaddr.IPPrefix {
 	return tsViaRange.v
 }
 
+// TailscaleNAT64Range returns the IPv6 Unique Local Address subset
+// range of TailscaleULARange that subnet routers in NAT64 mode
+// translate to IPv4: the last 32 bits of an address in it are the IPv4
+// address, as with an RFC 6052 /96 prefix.
+func TailscaleNAT64Range() netaddr.IPPrefix {
+	// Mnemonic: "64" as in NAT64. It doesn't conflict with the other
+	// subsets of TailscaleULARange.
+	tsNAT64Range.Do(func() { mustPrefix(&tsNAT64Range.v, "fd7a:115c:a1e0:64::/96") })
+	return tsNAT64Range.v
+}
+
 // Tailscale4To6Range returns the subset of TailscaleULARange used for
 // auto-translated Tailscale ipv4 addresses.
 func Tailscale4To6Range() netaddr.IPPrefix {
@@ -295,6 +307,54 @@ func UnmapVia(ip netaddr.IP) netaddr.IP {
 	return ip
 }
 
+// IsNAT64Prefix reports whether p is a CIDR in the Tailscale NAT64
+// range. See TailscaleNAT64Range.
+func IsNAT64Prefix(p netaddr.IPPrefix) bool {
+	return TailscaleNAT64Range().Contains(p.IP())
+}
+
+// UnmapNAT64 returns the IPv4 address that corresponds to the provided
+// Tailscale NAT64 address.
+//
+// If ip is not a NAT64 address, it returns ip unchanged.
+func UnmapNAT64(ip netaddr.IP) netaddr.IP {
+	if TailscaleNAT64Range().Contains(ip) {
+		a := ip.As16()
+		return netaddr.IPFrom4(*(*[4]byte)(a[12:16]))
+	}
+	return ip
+}
+
+// MapNAT64 returns the Tailscale NAT64 address of the IPv4 address ip.
+// It returns a zero IP if ip isn't IPv4.
+func MapNAT64(ip netaddr.IP) netaddr.IP {
+	if !ip.Is4() {
+		return netaddr.IP{}
+	}
+	a := TailscaleNAT64Range().IP().As16()
+	ip4a := ip.As4()
+	copy(a[12:], ip4a[:])
+	return netaddr.IPFrom16(a)
+}
+
+// MapNAT64Prefix returns the Tailscale NAT64 route of an IPv4 CIDR.
+func MapNAT64Prefix(v4 netaddr.IPPrefix) (netaddr.IPPrefix, error) {
+	if !v4.IP().Is4() {
+		return netaddr.IPPrefix{}, errors.New("want IPv4 CIDR")
+	}
+	return netaddr.IPPrefixFrom(MapNAT64(v4.IP()), v4.Bits()+96), nil
+}
+
+// UnmapNAT64Prefix returns the IPv4 CIDR of a Tailscale NAT64 route.
+// ok is false if p isn't a NAT64 route covering at most the IPv4
+// address space.
+func UnmapNAT64Prefix(p netaddr.IPPrefix) (v4 netaddr.IPPrefix, ok bool) {
+	if !IsNAT64Prefix(p) || p.Bits() < 96 {
+		return netaddr.IPPrefix{}, false
+	}
+	return netaddr.IPPrefixFrom(UnmapNAT64(p.IP()), p.Bits()-96), true
+}
+
 // MapVia returns an IPv6 "via" route for an IPv4 CIDR in a given siteID.
 func MapVia(siteID uint32, v4 netaddr.IPPrefix) (via netaddr.IPPrefix, err error) {
 	if !v4.IP().Is4() {
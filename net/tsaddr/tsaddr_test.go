@@ -104,3 +104,44 @@ func TestUnmapVia(t *testing.T) {
 		}
 	}
 }
+
+func TestNAT64(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{"1.2.3.4", "1.2.3.4"}, // unchanged v4
+		{"fd7a:115c:a1e0:64::10.2.1.3", "10.2.1.3"},
+		{"fd7a:115c:a1e0:64:1::10.2.1.3", "fd7a:115c:a1e0:64:1:0:a02:103"}, // outside the /96
+	}
+	for _, tt := range tests {
+		if got := UnmapNAT64(netaddr.MustParseIP(tt.ip)).String(); got != tt.want {
+			t.Errorf("for %q: got %q, want %q", tt.ip, got, tt.want)
+		}
+	}
+
+	if got, want := MapNAT64(netaddr.MustParseIP("192.168.1.1")), netaddr.MustParseIP("fd7a:115c:a1e0:64::c0a8:101"); got != want {
+		t.Errorf("MapNAT64 = %v; want %v", got, want)
+	}
+	if got := MapNAT64(netaddr.MustParseIP("::1")); !got.IsZero() {
+		t.Errorf("MapNAT64 of IPv6 = %v; want zero", got)
+	}
+
+	v4 := netaddr.MustParseIPPrefix("192.168.1.0/24")
+	p, err := MapNAT64Prefix(v4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := netaddr.MustParseIPPrefix("fd7a:115c:a1e0:64::c0a8:100/120"); p != want {
+		t.Errorf("MapNAT64Prefix = %v; want %v", p, want)
+	}
+	if got, ok := UnmapNAT64Prefix(p); !ok || got != v4 {
+		t.Errorf("UnmapNAT64Prefix(%v) = %v, %v; want %v", p, got, ok, v4)
+	}
+	if got, ok := UnmapNAT64Prefix(netaddr.MustParseIPPrefix("fd7a:115c:a1e0:64::/64")); ok {
+		t.Errorf("UnmapNAT64Prefix of /64 = %v; want !ok", got)
+	}
+	if _, err := MapNAT64Prefix(netaddr.MustParseIPPrefix("fd7a::/64")); err == nil {
+		t.Errorf("MapNAT64Prefix of IPv6 succeeded")
+	}
+}
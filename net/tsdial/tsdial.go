@@ -23,8 +23,10 @@
 	"tailscale.com/net/interfaces"
 	"tailscale.com/net/netknob"
 	"tailscale.com/net/netns"
+	"tailscale.com/tailcfg"
 	"tailscale.com/types/logger"
 	"tailscale.com/types/netmap"
+	"tailscale.com/types/preftype"
 	"tailscale.com/util/mak"
 	"tailscale.com/wgengine/monitor"
 )
@@ -35,14 +37,25 @@
 // Extension, none), user-selected route acceptance prefs, etc.
 type Dialer struct {
 	Logf logger.Logf
-	// UseNetstackForIP if non-nil is whether NetstackDialTCP (if
-	// it's non-nil) should be used to dial the provided IP.
+	// UseNetstackForIP if non-nil is whether NetstackDialTCP or
+	// NetstackDialUDP (if non-nil) should be used to dial the
+	// provided IP.
 	UseNetstackForIP func(netaddr.IP) bool
 
 	// NetstackDialTCP dials the provided IPPort using netstack.
 	// If nil, it's not used.
 	NetstackDialTCP func(context.Context, netaddr.IPPort) (net.Conn, error)
 
+	// NetstackDialUDP dials the provided IPPort using netstack.
+	// If nil, it's not used.
+	NetstackDialUDP func(context.Context, netaddr.IPPort) (net.Conn, error)
+
+	// NetstackPeerForIP, if non-nil, returns the node that netstack
+	// dials to the provided IP are routed to and the route that
+	// matched, if any. It's required to apply dial policies (see
+	// SetDialPolicy).
+	NetstackPeerForIP func(netaddr.IP) (n *tailcfg.Node, route netaddr.IPPrefix, ok bool)
+
 	peerDialControlFuncAtomic atomic.Value // of func() func(network, address string, c syscall.RawConn) error
 
 	peerClientOnce sync.Once
@@ -62,6 +75,8 @@ type Dialer struct {
 	linkMonUnregister func()
 	exitDNSDoHBase    string                 // non-empty if DoH-proxying exit node in use; base URL+path (without '?')
 	dnsCache          *dnscache.MessageCache // nil until first first non-empty SetExitDNSDoH
+	dialPolicy        *preftype.DialPolicy
+	localRoutes       []netaddr.IPPrefix
 	nextSysConnID     int
 	activeSysConns    map[int]net.Conn // active connections not yet closed
 }
@@ -117,6 +132,54 @@ func (d *Dialer) SetExitDNSDoH(doh string) {
 	}
 }
 
+// SetDialPolicy sets the rules routing UserDial's dials per
+// destination. It only has an effect in netstack mode, with
+// NetstackPeerForIP set.
+func (d *Dialer) SetDialPolicy(rules []preftype.DialRule) {
+	p, err := preftype.NewDialPolicy(rules)
+	if err != nil && d.Logf != nil {
+		d.Logf("tsdial: ignoring invalid dial rules: %v", err)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.dialPolicy = p
+}
+
+// SetLocalRoutes sets the routes that UserDial dials directly rather
+// than via netstack, such as the local network while an exit node is
+// in use. As with router.Config.LocalRoutes, a more specific netstack
+// route still takes precedence. It only has an effect in netstack
+// mode, with NetstackPeerForIP set.
+func (d *Dialer) SetLocalRoutes(routes []netaddr.IPPrefix) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.localRoutes = routes
+}
+
+// isLocalRoute reports whether ip is in a local route (see
+// SetLocalRoutes) more specific than the netstack route to it.
+func (d *Dialer) isLocalRoute(ip netaddr.IP) bool {
+	if d.NetstackPeerForIP == nil {
+		return false
+	}
+	d.mu.Lock()
+	routes := d.localRoutes
+	d.mu.Unlock()
+	if len(routes) == 0 {
+		return false
+	}
+	_, route, ok := d.NetstackPeerForIP(ip)
+	if !ok {
+		return false
+	}
+	for _, r := range routes {
+		if r.Bits() > route.Bits() && r.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
 func (d *Dialer) Close() error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
@@ -305,21 +368,80 @@ func (d *Dialer) SystemDial(ctx context.Context, network, addr string) (net.Conn
 // UserDial connects to the provided network address as if a user were initiating the dial.
 // (e.g. from a SOCKS or HTTP outbound proxy)
 func (d *Dialer) UserDial(ctx context.Context, network, addr string) (net.Conn, error) {
+	return d.UserDialChecked(ctx, network, addr, nil)
+}
+
+// UserDialChecked is like UserDial, but if check is non-nil, it's
+// called with the address addr resolved to before anything is dialed,
+// and the dial fails with check's error if it returns one.
+func (d *Dialer) UserDialChecked(ctx context.Context, network, addr string, check func(netaddr.IPPort) error) (net.Conn, error) {
 	ipp, err := d.userDialResolve(ctx, network, addr)
 	if err != nil {
 		return nil, err
 	}
-	if d.UseNetstackForIP != nil && d.UseNetstackForIP(ipp.IP()) {
-		if d.NetstackDialTCP == nil {
-			return nil, errors.New("Dialer not initialized correctly")
+	if check != nil {
+		if err := check(ipp); err != nil {
+			return nil, err
 		}
-		return d.NetstackDialTCP(ctx, ipp)
+	}
+	if r, ok := d.dialRuleFor(addr, ipp); ok {
+		return d.userDialVia(ctx, network, ipp, r.Via)
+	}
+	if d.UseNetstackForIP != nil && d.UseNetstackForIP(ipp.IP()) && !d.isLocalRoute(ipp.IP()) {
+		return d.netstackDial(ctx, network, ipp)
 	}
 	// TODO(bradfitz): netns, etc
 	var stdDialer net.Dialer
 	return stdDialer.DialContext(ctx, network, ipp.String())
 }
 
+func (d *Dialer) netstackDial(ctx context.Context, network string, ipp netaddr.IPPort) (net.Conn, error) {
+	dial := d.NetstackDialTCP
+	if strings.HasPrefix(network, "udp") {
+		dial = d.NetstackDialUDP
+	}
+	if dial == nil {
+		return nil, errors.New("Dialer not initialized correctly")
+	}
+	return dial(ctx, ipp)
+}
+
+// dialRuleFor returns the first dial policy rule matching a dial of
+// addr, resolved to ipp, if any.
+func (d *Dialer) dialRuleFor(addr string, ipp netaddr.IPPort) (r preftype.DialRule, ok bool) {
+	if d.NetstackPeerForIP == nil {
+		return r, false
+	}
+	d.mu.Lock()
+	policy := d.dialPolicy
+	d.mu.Unlock()
+	if policy == nil {
+		return r, false
+	}
+	var name string
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		if _, err := netaddr.ParseIP(host); err != nil {
+			name = strings.ToLower(strings.TrimSuffix(host, "."))
+		}
+	}
+	return policy.Match(name, ipp.IP(), ipp.Port())
+}
+
+// userDialVia dials ipp via the route of a dial policy rule.
+func (d *Dialer) userDialVia(ctx context.Context, network string, ipp netaddr.IPPort, via string) (net.Conn, error) {
+	switch via {
+	case preftype.DialDirect:
+		var stdDialer net.Dialer
+		return stdDialer.DialContext(ctx, network, ipp.String())
+	case preftype.DialViaExitNode:
+		if _, route, ok := d.NetstackPeerForIP(ipp.IP()); !ok || route.Bits() != 0 {
+			return nil, fmt.Errorf("dial policy routes %v via the exit node, but none is in use", ipp)
+		}
+		return d.netstackDial(ctx, network, ipp)
+	}
+	return nil, fmt.Errorf("invalid dial policy route %q", via)
+}
+
 // dialPeerAPI connects to a Tailscale peer's peerapi over TCP.
 //
 // network must a "tcp" type, and addr must be an ip:port. Name resolution
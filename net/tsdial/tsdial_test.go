@@ -0,0 +1,233 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tsdial
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+
+	"inet.af/netaddr"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/preftype"
+)
+
+func TestUserDialPolicy(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	port := strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+
+	node := func(ip string) *tailcfg.Node {
+		return &tailcfg.Node{Addresses: []netaddr.IPPrefix{netaddr.MustParseIPPrefix(ip + "/32")}}
+	}
+	peer := node("100.64.0.2")
+	subnetRouter := node("100.64.0.3")
+	exitNode := node("100.64.0.9")
+	useExitNode := true
+	peerForIP := func(ip netaddr.IP) (*tailcfg.Node, netaddr.IPPrefix, bool) {
+		switch {
+		case ip == netaddr.MustParseIP("100.64.0.2"):
+			return peer, netaddr.MustParseIPPrefix("100.64.0.2/32"), true
+		case netaddr.MustParseIPPrefix("10.0.0.0/8").Contains(ip):
+			return subnetRouter, netaddr.MustParseIPPrefix("10.0.0.0/8"), true
+		case useExitNode:
+			return exitNode, netaddr.MustParseIPPrefix("0.0.0.0/0"), true
+		}
+		return nil, netaddr.IPPrefix{}, false
+	}
+
+	var netstackDials []string
+	d := &Dialer{
+		UseNetstackForIP: func(ip netaddr.IP) bool {
+			_, _, ok := peerForIP(ip)
+			return ok
+		},
+		NetstackDialTCP: func(ctx context.Context, ipp netaddr.IPPort) (net.Conn, error) {
+			netstackDials = append(netstackDials, ipp.String())
+			c1, c2 := net.Pipe()
+			c2.Close()
+			return c1, nil
+		},
+		NetstackPeerForIP: peerForIP,
+	}
+
+	tests := []struct {
+		name        string
+		policy      string
+		localRoutes string // comma-separated
+		noExitNode  bool
+		addr        string
+		viaNetstack bool   // whether the dial should go via netstack
+		wantErr     string // if non-empty, a substring of the expected error
+	}{
+		{
+			name:        "no_policy_exit_node",
+			addr:        "127.0.0.1:" + port,
+			viaNetstack: true,
+		},
+		{
+			name:   "direct_by_name",
+			policy: "localhost=direct",
+			addr:   "localhost:" + port,
+		},
+		{
+			name:   "direct_by_cidr_and_port",
+			policy: "127.0.0.0/8:" + port + "=direct",
+			addr:   "127.0.0.1:" + port,
+		},
+		{
+			name:        "port_mismatch",
+			policy:      "127.0.0.0/8:1-2=direct",
+			addr:        "127.0.0.1:" + port,
+			viaNetstack: true,
+		},
+		{
+			name:        "first_match_wins",
+			policy:      "127.0.0.1=exit-node,*=direct",
+			addr:        "127.0.0.1:" + port,
+			viaNetstack: true,
+		},
+		{
+			name:       "exit_node_not_in_use",
+			policy:     "*=exit-node",
+			noExitNode: true,
+			addr:       "127.0.0.1:" + port,
+			wantErr:    "none is in use",
+		},
+		{
+			name:        "local_route_direct",
+			localRoutes: "127.0.0.0/8",
+			addr:        "127.0.0.1:" + port,
+		},
+		{
+			name:        "local_route_less_specific_than_subnet",
+			localRoutes: "10.0.0.0/7",
+			addr:        "10.1.2.3:80",
+			viaNetstack: true,
+		},
+		{
+			name:        "local_route_same_as_subnet",
+			localRoutes: "10.0.0.0/8",
+			addr:        "10.1.2.3:80",
+			viaNetstack: true,
+		},
+		{
+			name:        "local_route_tailnet_peer",
+			localRoutes: "100.64.0.0/10",
+			addr:        "100.64.0.2:80",
+			viaNetstack: true,
+		},
+		{
+			name:        "policy_before_local_route",
+			policy:      "127.0.0.1=exit-node",
+			localRoutes: "127.0.0.0/8",
+			addr:        "127.0.0.1:" + port,
+			viaNetstack: true,
+		},
+		{
+			name:    "tailnet_peer_not_exit_node",
+			policy:  "100.64.0.0/10=exit-node",
+			addr:    "100.64.0.2:80",
+			wantErr: "none is in use",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules, err := preftype.ParseDialRules(tt.policy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			d.SetDialPolicy(rules)
+			var localRoutes []netaddr.IPPrefix
+			if tt.localRoutes != "" {
+				for _, s := range strings.Split(tt.localRoutes, ",") {
+					localRoutes = append(localRoutes, netaddr.MustParseIPPrefix(s))
+				}
+			}
+			d.SetLocalRoutes(localRoutes)
+			useExitNode = !tt.noExitNode
+			netstackDials = nil
+
+			c, err := d.UserDial(context.Background(), "tcp", tt.addr)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("UserDial error = %v; want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			c.Close()
+			if got := len(netstackDials) > 0; got != tt.viaNetstack {
+				t.Errorf("dialed via netstack = %v; want %v", got, tt.viaNetstack)
+			}
+		})
+	}
+
+	// Without netstack's routing information, the policy is ignored.
+	d.NetstackPeerForIP = nil
+	d.SetLocalRoutes(nil)
+	d.SetDialPolicy([]preftype.DialRule{{Dst: "*", Via: preftype.DialDirect}})
+	netstackDials = nil
+	c, err := d.UserDial(context.Background(), "tcp", "100.64.0.2:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if len(netstackDials) != 1 {
+		t.Errorf("policy applied without NetstackPeerForIP")
+	}
+}
+
+func TestUserDialChecked(t *testing.T) {
+	var dials []string
+	d := &Dialer{
+		UseNetstackForIP: func(netaddr.IP) bool { return true },
+		NetstackDialTCP: func(ctx context.Context, ipp netaddr.IPPort) (net.Conn, error) {
+			dials = append(dials, ipp.String())
+			c1, c2 := net.Pipe()
+			c2.Close()
+			return c1, nil
+		},
+	}
+	var checked []netaddr.IPPort
+	check := func(ipp netaddr.IPPort) error {
+		checked = append(checked, ipp)
+		if ipp.IP() == netaddr.MustParseIP("100.64.0.2") {
+			return errors.New("denied")
+		}
+		return nil
+	}
+	if _, err := d.UserDialChecked(context.Background(), "tcp", "100.64.0.2:80", check); err == nil || err.Error() != "denied" {
+		t.Errorf("denied dial: err = %v", err)
+	}
+	c, err := d.UserDialChecked(context.Background(), "tcp", "100.64.0.3:80", check)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if len(checked) != 2 {
+		t.Errorf("checked %v; want both dials checked", checked)
+	}
+	if len(dials) != 1 || dials[0] != "100.64.0.3:80" {
+		t.Errorf("dialed %q; want just 100.64.0.3:80", dials)
+	}
+}
@@ -22,6 +22,7 @@
 	"gvisor.dev/gvisor/pkg/tcpip/stack"
 	"inet.af/netaddr"
 	"tailscale.com/disco"
+	"tailscale.com/net/exitusage"
 	"tailscale.com/net/packet"
 	"tailscale.com/net/tsaddr"
 	"tailscale.com/tstime/mono"
@@ -165,6 +166,10 @@ type Wrapper struct {
 
 	// disableTSMPRejected disables TSMP rejected responses. For tests.
 	disableTSMPRejected bool
+
+	// exitUsage accounts for and restricts the traffic forwarded
+	// when this node is an exit node.
+	exitUsage exitusage.Tracker
 }
 
 // tunReadResult is the result of a TUN read, or an injected result pretending to be a TUN read.
@@ -559,6 +564,7 @@ func (t *Wrapper) Read(buf []byte, offset int) (int, error) {
 			return 0, nil
 		}
 	}
+	t.exitUsage.Outbound(p)
 
 	t.noteActivity()
 	return n, nil
@@ -632,24 +638,18 @@ func (t *Wrapper) filterIn(buf []byte) filter.Response {
 		// Their host networking stack can translate this into ICMP
 		// or whatnot as required. But notably, their GUI or tailscale CLI
 		// can show them a rejection history with reasons.
-		if p.IPVersion == 4 && p.IPProto == ipproto.TCP && p.TCPFlags&packet.TCPSyn != 0 && !t.disableTSMPRejected {
-			rj := packet.TailscaleRejectedHeader{
-				IPSrc:  p.Dst.IP(),
-				IPDst:  p.Src.IP(),
-				Src:    p.Src,
-				Dst:    p.Dst,
-				Proto:  p.IPProto,
-				Reason: packet.RejectedDueToACLs,
-			}
-			if filt.ShieldsUp() {
-				rj.Reason = packet.RejectedDueToShieldsUp
-			}
-			pkt := packet.Generate(rj, nil)
-			t.InjectOutbound(pkt)
-
-			// TODO(bradfitz): also send a TCP RST, after the TSMP message.
+		reason := packet.RejectedDueToACLs
+		if filt.ShieldsUp() {
+			reason = packet.RejectedDueToShieldsUp
 		}
+		t.maybeSendTSMPRejected(p, reason)
+		return filter.Drop
+	}
 
+	if !t.exitUsage.Inbound(p) {
+		metricPacketInDropExitPolicy.Add(1)
+		t.limitedLogf("dropping exit traffic from %v to blocked port %v", p.Src.IP(), p.Dst)
+		t.maybeSendTSMPRejected(p, packet.RejectedDueToExitPolicy)
 		return filter.Drop
 	}
 
@@ -706,6 +706,31 @@ func (t *Wrapper) SetFilter(filt *filter.Filter) {
 	t.filter.Store(filt)
 }
 
+// maybeSendTSMPRejected tells the sender of p, if it's the start of an
+// IPv4 TCP connection, that it was rejected for reason.
+func (t *Wrapper) maybeSendTSMPRejected(p *packet.Parsed, reason packet.TailscaleRejectReason) {
+	if p.IPVersion != 4 || p.IPProto != ipproto.TCP || p.TCPFlags&packet.TCPSyn == 0 || t.disableTSMPRejected {
+		return
+	}
+	rj := packet.TailscaleRejectedHeader{
+		IPSrc:  p.Dst.IP(),
+		IPDst:  p.Src.IP(),
+		Src:    p.Src,
+		Dst:    p.Dst,
+		Proto:  p.IPProto,
+		Reason: reason,
+	}
+	pkt := packet.Generate(rj, nil)
+	t.InjectOutbound(pkt)
+
+	// TODO(bradfitz): also send a TCP RST, after the TSMP message.
+}
+
+// ExitUsage returns the tracker of the traffic t forwards as an exit node.
+func (t *Wrapper) ExitUsage() *exitusage.Tracker {
+	return &t.exitUsage
+}
+
 // InjectInboundPacketBuffer makes the Wrapper device behave as if a packet
 // with the given contents was received from the network.
 // It takes ownership of one reference count on the packet. The injected
@@ -832,10 +857,11 @@ func (t *Wrapper) Unwrap() tun.Device {
 }
 
 var (
-	metricPacketIn              = clientmetric.NewCounter("tstun_in_from_wg")
-	metricPacketInDrop          = clientmetric.NewCounter("tstun_in_from_wg_drop")
-	metricPacketInDropFilter    = clientmetric.NewCounter("tstun_in_from_wg_drop_filter")
-	metricPacketInDropSelfDisco = clientmetric.NewCounter("tstun_in_from_wg_drop_self_disco")
+	metricPacketIn               = clientmetric.NewCounter("tstun_in_from_wg")
+	metricPacketInDrop           = clientmetric.NewCounter("tstun_in_from_wg_drop")
+	metricPacketInDropFilter     = clientmetric.NewCounter("tstun_in_from_wg_drop_filter")
+	metricPacketInDropSelfDisco  = clientmetric.NewCounter("tstun_in_from_wg_drop_self_disco")
+	metricPacketInDropExitPolicy = clientmetric.NewCounter("tstun_in_from_wg_drop_exit_policy")
 
 	metricPacketOut              = clientmetric.NewCounter("tstun_out_to_wg")
 	metricPacketOutDrop          = clientmetric.NewCounter("tstun_out_to_wg_drop")
@@ -18,6 +18,7 @@
 	"inet.af/netaddr"
 	"tailscale.com/disco"
 	"tailscale.com/net/packet"
+	"tailscale.com/tailcfg"
 	"tailscale.com/tstest"
 	"tailscale.com/tstime/mono"
 	"tailscale.com/types/ipproto"
@@ -491,6 +492,74 @@ func TestPeerAPIBypass(t *testing.T) {
 	}
 }
 
+func TestExitUsage(t *testing.T) {
+	var sb netaddr.IPSetBuilder
+	sb.AddPrefix(netaddr.MustParseIPPrefix("0.0.0.0/0"))
+	ipSet, _ := sb.IPSet()
+	matches := []filter.Match{
+		{IPProto: []ipproto.Proto{ipproto.TCP}, Srcs: nets("100.64.1.2"), Dsts: netports("0.0.0.0/0:*")},
+	}
+	tw := &Wrapper{logf: logger.Discard, limitedLogf: logger.Discard}
+	tw.SetFilter(filter.New(matches, ipSet, ipSet, nil, logger.Discard))
+	tw.disableTSMPRejected = true
+	tw.ExitUsage().SetConfig(true, nil, []tailcfg.PortRange{{First: 25, Last: 25}})
+
+	tests := []struct {
+		name string
+		pkt  []byte
+		want filter.Response
+	}{
+		{"https", tcp4syn("100.64.1.2", "1.2.3.4", 1234, 443), filter.Accept},
+		{"smtp", tcp4syn("100.64.1.2", "1.2.3.4", 1234, 25), filter.Drop},
+		{"smtp_peer", tcp4syn("100.64.1.2", "100.64.1.3", 1234, 25), filter.Accept},
+	}
+	for _, tt := range tests {
+		if got := tw.filterIn(tt.pkt); got != tt.want {
+			t.Errorf("%s: got = %v; want %v", tt.name, got, tt.want)
+		}
+	}
+
+	u := tw.ExitUsage().Usage()
+	if len(u) != 1 || u[0].TxPackets != 1 || u[0].BlockedPackets != 1 {
+		t.Fatalf("usage = %+v; want 1 packet and 1 blocked packet", u)
+	}
+	if d := u[0].TopDests[0]; d.Proto != ipproto.TCP || d.Port != 443 {
+		t.Errorf("top dest = %+v; want TCP port 443", d)
+	}
+}
+
+func TestExitUsageRejected(t *testing.T) {
+	_, tw := newChannelTUN(t.Logf, false)
+	defer tw.Close()
+	tw.disableFilter = false
+	var sb netaddr.IPSetBuilder
+	sb.AddPrefix(netaddr.MustParseIPPrefix("0.0.0.0/0"))
+	ipSet, _ := sb.IPSet()
+	matches := []filter.Match{
+		{IPProto: []ipproto.Proto{ipproto.TCP}, Srcs: nets("100.64.1.2"), Dsts: netports("0.0.0.0/0:*")},
+	}
+	tw.SetFilter(filter.New(matches, ipSet, ipSet, nil, logger.Discard))
+	tw.ExitUsage().SetConfig(true, nil, []tailcfg.PortRange{{First: 25, Last: 25}})
+
+	if got := tw.filterIn(tcp4syn("100.64.1.2", "1.2.3.4", 1234, 25)); got != filter.Drop {
+		t.Fatalf("got = %v; want %v", got, filter.Drop)
+	}
+	var buf [MaxPacketSize]byte
+	n, err := tw.Read(buf[:], 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var p packet.Parsed
+	p.Decode(buf[:n])
+	rj, ok := p.AsTailscaleRejectedHeader()
+	if !ok {
+		t.Fatalf("read %v; want a TSMP rejection", &p)
+	}
+	if rj.Reason != packet.RejectedDueToExitPolicy || rj.Dst != netaddr.MustParseIPPort("1.2.3.4:25") {
+		t.Errorf("rejection = %v; want %v of 1.2.3.4:25", rj, packet.RejectedDueToExitPolicy)
+	}
+}
+
 // Issue 1526: drop disco frames from ourselves.
 func TestFilterDiscoLoop(t *testing.T) {
 	var memLog tstest.MemLogger
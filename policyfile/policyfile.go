@@ -0,0 +1,290 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package policyfile parses tailnet policy files, the HuJSON (JSON
+// with comments and trailing commas) documents defining a tailnet's
+// groups, tags, ACLs, SSH rules and ACL tests.
+//
+// It supports the subset of the policy format that's evaluated
+// outside of the control plane, by testcontrol and gitops-pusher.
+package policyfile
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/tailscale/hujson"
+	"inet.af/netaddr"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/ipproto"
+)
+
+// Policy is a tailnet policy file.
+//
+// Users are referred to by their login names.
+type Policy struct {
+	// Groups maps "group:name" to the user login names in it.
+	Groups map[string][]string `json:"groups,omitempty"`
+
+	// TagOwners maps "tag:name" to the users and groups allowed
+	// to apply that tag to their nodes with --advertise-tags.
+	TagOwners map[string][]string `json:"tagOwners,omitempty"`
+
+	// Hosts maps host alias names to an IP address or CIDR.
+	Hosts map[string]string `json:"hosts,omitempty"`
+
+	// ACLs are the network access rules. Traffic not accepted by
+	// any of them is dropped.
+	ACLs []ACL `json:"acls"`
+
+	// SSH are the Tailscale SSH access rules.
+	SSH []SSHRule `json:"ssh,omitempty"`
+
+	// Tests are assertions about what the ACLs allow.
+	Tests []ACLTest `json:"tests,omitempty"`
+
+	// The policy file sections below are accepted, so that full
+	// policy files parse, but not interpreted.
+	AutoApprovers       json.RawMessage `json:"autoApprovers,omitempty"`
+	DERPMap             json.RawMessage `json:"derpMap,omitempty"`
+	DisableIPv4         json.RawMessage `json:"disableIPv4,omitempty"`
+	NodeAttrs           json.RawMessage `json:"nodeAttrs,omitempty"`
+	OneCGNATRoute       json.RawMessage `json:"oneCGNATRoute,omitempty"`
+	RandomizeClientPort json.RawMessage `json:"randomizeClientPort,omitempty"`
+	SSHTests            json.RawMessage `json:"sshTests,omitempty"`
+}
+
+// ACL is a network access rule in a Policy.
+type ACL struct {
+	// Action must be "accept".
+	Action string `json:"action"`
+
+	// Proto optionally restricts the rule to one IP protocol, by
+	// name ("tcp", "udp", "icmp", ...) or IANA protocol number.
+	Proto string `json:"proto,omitempty"`
+
+	// Src are the sources: "*", user login names, "group:name",
+	// "tag:name", "autogroup:members", host aliases, IPs or CIDRs.
+	Src []string `json:"src"`
+
+	// Dst are the destinations, each of the form "selector:ports",
+	// where selector is as in Src and ports is "*" or a
+	// comma-separated list of ports or port ranges ("22,80-90").
+	Dst []string `json:"dst"`
+}
+
+// SSHRule is a Tailscale SSH access rule in a Policy.
+type SSHRule struct {
+	// Action is "accept", or "check" to require the user to have
+	// recently reauthenticated.
+	Action string `json:"action"`
+
+	// Src are the users, groups or tags that may connect, or "*".
+	Src []string `json:"src"`
+
+	// Dst are the nodes that may be connected to, by user login
+	// name, group or tag, or "*".
+	Dst []string `json:"dst"`
+
+	// Users are the SSH users that may be logged in as. The value
+	// "autogroup:nonroot" means any user except root.
+	Users []string `json:"users"`
+
+	// CheckPeriod is how recently users must have reauthenticated
+	// for "check" rules.
+	CheckPeriod string `json:"checkPeriod,omitempty"`
+}
+
+// ACLTest is a test in a Policy: traffic from Src to each of Accept
+// must be allowed, and to each of Deny must not be.
+type ACLTest struct {
+	// Src is the user login name, group, tag, host alias or IP the
+	// traffic is from. For a group, the test must hold for every
+	// member.
+	Src string `json:"src"`
+
+	// Proto is the protocol of the traffic: "tcp" (the default),
+	// "udp" or "sctp".
+	Proto string `json:"proto,omitempty"`
+
+	// Accept and Deny are destinations of the form "selector:port",
+	// with selector as in ACL.Src.
+	Accept []string `json:"accept,omitempty"`
+	Deny   []string `json:"deny,omitempty"`
+}
+
+// Parse parses a HuJSON policy file and checks it for errors.
+// Unknown fields are errors, as they are for the control plane.
+func Parse(b []byte) (*Policy, error) {
+	b, err := hujson.Standardize(b)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	p := new(Policy)
+	if err := dec.Decode(p); err != nil {
+		return nil, err
+	}
+	if err := p.check(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// check reports the first error found in p.
+func (p *Policy) check() error {
+	for name := range p.Groups {
+		if !strings.HasPrefix(name, "group:") {
+			return fmt.Errorf("group %q doesn't start with \"group:\"", name)
+		}
+	}
+	for tag := range p.TagOwners {
+		if err := tailcfg.CheckTag(tag); err != nil {
+			return fmt.Errorf("tagOwners: %w", err)
+		}
+	}
+	for name, v := range p.Hosts {
+		if _, err := ParseIPOrPrefix(v); err != nil {
+			return fmt.Errorf("host %q: %w", name, err)
+		}
+	}
+	for i, a := range p.ACLs {
+		if a.Action != "accept" {
+			return fmt.Errorf("acls[%d]: unsupported action %q", i, a.Action)
+		}
+		if _, err := ParseProto(a.Proto); err != nil {
+			return fmt.Errorf("acls[%d]: %w", i, err)
+		}
+		for _, dst := range a.Dst {
+			if _, _, err := SplitDst(dst); err != nil {
+				return fmt.Errorf("acls[%d]: %w", i, err)
+			}
+		}
+	}
+	for i, r := range p.SSH {
+		if r.Action != "accept" && r.Action != "check" {
+			return fmt.Errorf("ssh[%d]: unsupported action %q", i, r.Action)
+		}
+		if len(r.Users) == 0 {
+			return fmt.Errorf("ssh[%d]: no users", i)
+		}
+	}
+	for i, t := range p.Tests {
+		if t.Src == "" {
+			return fmt.Errorf("tests[%d]: missing src", i)
+		}
+		if _, err := ParseTestProto(t.Proto); err != nil {
+			return fmt.Errorf("tests[%d]: %w", i, err)
+		}
+		for _, dst := range append(append([]string(nil), t.Accept...), t.Deny...) {
+			if _, _, err := SplitTestDst(dst); err != nil {
+				return fmt.Errorf("tests[%d]: %w", i, err)
+			}
+		}
+	}
+	return nil
+}
+
+// SplitDst splits an ACL destination into its selector and port ranges.
+func SplitDst(dst string) (sel string, ports []tailcfg.PortRange, err error) {
+	i := strings.LastIndexByte(dst, ':')
+	if i == -1 {
+		return "", nil, fmt.Errorf("dst %q missing port", dst)
+	}
+	sel, portsStr := dst[:i], dst[i+1:]
+	if sel == "" {
+		return "", nil, fmt.Errorf("dst %q missing selector", dst)
+	}
+	if portsStr == "*" {
+		return sel, []tailcfg.PortRange{tailcfg.PortRangeAny}, nil
+	}
+	for _, ps := range strings.Split(portsStr, ",") {
+		first, last, isRange := strings.Cut(ps, "-")
+		if !isRange {
+			last = first
+		}
+		f, err1 := strconv.ParseUint(first, 10, 16)
+		l, err2 := strconv.ParseUint(last, 10, 16)
+		if err1 != nil || err2 != nil || f > l {
+			return "", nil, fmt.Errorf("dst %q has invalid port range %q", dst, ps)
+		}
+		ports = append(ports, tailcfg.PortRange{First: uint16(f), Last: uint16(l)})
+	}
+	return sel, ports, nil
+}
+
+// SplitTestDst splits an ACLTest destination into its selector and
+// port.
+func SplitTestDst(dst string) (sel string, port uint16, err error) {
+	i := strings.LastIndexByte(dst, ':')
+	if i == -1 || i == 0 {
+		return "", 0, fmt.Errorf("test dst %q not of form selector:port", dst)
+	}
+	n, err := strconv.ParseUint(dst[i+1:], 10, 16)
+	if err != nil {
+		return "", 0, fmt.Errorf("test dst %q has invalid port", dst)
+	}
+	return dst[:i], uint16(n), nil
+}
+
+var protoNumbers = map[string]int{
+	"icmp":      1,
+	"igmp":      2,
+	"tcp":       6,
+	"udp":       17,
+	"gre":       47,
+	"esp":       50,
+	"ah":        51,
+	"ipv6-icmp": 58,
+	"sctp":      132,
+}
+
+// ParseProto returns the FilterRule.IPProto value for an ACL's Proto.
+func ParseProto(proto string) ([]int, error) {
+	if proto == "" {
+		return nil, nil
+	}
+	if n, ok := protoNumbers[proto]; ok {
+		if n == 1 {
+			// Like the real control plane, "icmp" covers both families.
+			return []int{1, 58}, nil
+		}
+		return []int{n}, nil
+	}
+	n, err := strconv.Atoi(proto)
+	if err != nil || n < 0 || n > 255 {
+		return nil, fmt.Errorf("unknown proto %q", proto)
+	}
+	return []int{n}, nil
+}
+
+// ParseTestProto returns the protocol for an ACLTest's Proto.
+func ParseTestProto(proto string) (ipproto.Proto, error) {
+	switch proto {
+	case "", "tcp":
+		return ipproto.TCP, nil
+	case "udp":
+		return ipproto.UDP, nil
+	case "sctp":
+		return ipproto.SCTP, nil
+	}
+	return 0, fmt.Errorf("unsupported test proto %q", proto)
+}
+
+// ParseIPOrPrefix parses s, an IP address or CIDR prefix, as a prefix.
+func ParseIPOrPrefix(s string) (netaddr.IPPrefix, error) {
+	if strings.Contains(s, "/") {
+		return netaddr.ParseIPPrefix(s)
+	}
+	ip, err := netaddr.ParseIP(s)
+	if err != nil {
+		return netaddr.IPPrefix{}, errors.New("not an IP or CIDR")
+	}
+	return netaddr.IPPrefixFrom(ip, ip.BitLen()), nil
+}
@@ -0,0 +1,51 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package policyfile
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	p, err := Parse([]byte(`{
+		// Comments, trailing commas and sections evaluated only by
+		// the control plane are fine.
+		"groups": {"group:eng": ["alice@example.com"]},
+		"acls": [{"action": "accept", "src": ["group:eng"], "dst": ["*:22"]}],
+		"nodeAttrs": [{"target": ["*"], "attr": ["funnel"]}],
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.ACLs) != 1 || len(p.Groups["group:eng"]) != 1 {
+		t.Errorf("got %+v", p)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name, policy, wantErr string
+	}{
+		{"unknown_field", `{"acl": []}`, "unknown field"},
+		{"bad_action", `{"acls": [{"action": "drop", "src": ["*"], "dst": ["*:*"]}]}`, "unsupported action"},
+		{"bad_proto", `{"acls": [{"action": "accept", "proto": "foo", "src": ["*"], "dst": ["*:*"]}]}`, "unknown proto"},
+		{"no_port", `{"acls": [{"action": "accept", "src": ["*"], "dst": ["tag:x"]}]}`, "invalid port range"},
+		{"bad_ports", `{"acls": [{"action": "accept", "src": ["*"], "dst": ["*:90-80"]}]}`, "invalid port range"},
+		{"bad_group", `{"groups": {"eng": []}, "acls": []}`, "doesn't start with"},
+		{"bad_host", `{"hosts": {"h": "nope"}, "acls": []}`, "not an IP"},
+		{"bad_ssh_action", `{"acls": [], "ssh": [{"action": "drop", "src": ["*"], "dst": ["*"], "users": ["root"]}]}`, "unsupported action"},
+		{"ssh_no_users", `{"acls": [], "ssh": [{"action": "accept", "src": ["*"], "dst": ["*"]}]}`, "no users"},
+		{"bad_test_dst", `{"acls": [], "tests": [{"src": "a@b.c", "accept": ["*:1-2"]}]}`, "invalid port"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse([]byte(tt.policy))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("error = %v; want containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package prober
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// alertTimeout is how long an AlertSink has to send an alert.
+const alertTimeout = 30 * time.Second
+
+// Alert is a notification that a probe started or stopped failing.
+type Alert struct {
+	Probe  string            `json:"probe"`
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// Failing is true if the probe started failing, and false if it
+	// recovered.
+	Failing bool `json:"failing"`
+
+	// ConsecutiveFailures is the number of probe runs that had
+	// failed in a row when the probe started failing.
+	ConsecutiveFailures int `json:"consecutiveFailures,omitempty"`
+
+	// Error is the error from the last probe run, if it failed.
+	Error string `json:"error,omitempty"`
+
+	// Time is when the probe run that caused the alert finished.
+	Time time.Time `json:"time"`
+}
+
+// AlertSink sends alerts somewhere.
+type AlertSink interface {
+	SendAlert(context.Context, *Alert) error
+}
+
+// Webhook returns an AlertSink that POSTs each alert as JSON to url,
+// and expects a 2xx response.
+func Webhook(url string) AlertSink {
+	return webhook(url)
+}
+
+type webhook string
+
+func (url webhook) SendAlert(ctx context.Context, a *Alert) error {
+	body, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", string(url), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook returned %s", res.Status)
+	}
+	return nil
+}
+
+// AlertConfig configures when probes are considered to be failing,
+// and where to send alerts when that changes.
+type AlertConfig struct {
+	// Sink is where alerts are sent.
+	Sink AlertSink
+
+	// FailAfter is how many probe runs must fail in a row for the
+	// probe to be considered failing. Zero means 1.
+	FailAfter int
+
+	// RecoverAfter is how many probe runs must succeed in a row for a
+	// failing probe to be considered recovered. Zero means 1.
+	RecoverAfter int
+}
+
+func (c *AlertConfig) failAfter() int {
+	if c == nil || c.FailAfter <= 0 {
+		return 1
+	}
+	return c.FailAfter
+}
+
+func (c *AlertConfig) recoverAfter() int {
+	if c == nil || c.RecoverAfter <= 0 {
+		return 1
+	}
+	return c.RecoverAfter
+}
+
+// SetAlerts configures alerting for all of p's probes. Alerts are sent
+// asynchronously, so a slow sink doesn't delay probes.
+func (p *Prober) SetAlerts(c AlertConfig) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.alerts = &c
+}
+
+func (p *Prober) sendAlert(sink AlertSink, a *Alert) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), alertTimeout)
+		defer cancel()
+		if err := sink.SendAlert(ctx, a); err != nil {
+			log.Printf("probe %s: sending alert: %v", a.Probe, err)
+		}
+	}()
+}
+
+// updateFailingLocked updates whether p is considered failing after a
+// run, according to c, which may be nil for the default thresholds. It
+// returns an Alert if that changed, or else nil.
+//
+// p.mu must be held.
+func (p *Probe) updateFailingLocked(c *AlertConfig) *Alert {
+	switch {
+	case !p.failing && p.consecutiveFailures >= c.failAfter():
+		p.failing = true
+		a := &Alert{
+			Probe:               p.name,
+			Labels:              p.labels,
+			Failing:             true,
+			ConsecutiveFailures: p.consecutiveFailures,
+			Time:                p.end,
+		}
+		if p.lastErr != nil {
+			a.Error = p.lastErr.Error()
+		}
+		return a
+	case p.failing && p.consecutiveSuccesses >= c.recoverAfter():
+		p.failing = false
+		return &Alert{
+			Probe:  p.name,
+			Labels: p.labels,
+			Time:   p.end,
+		}
+	}
+	return nil
+}
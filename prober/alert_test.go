@@ -0,0 +1,156 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package prober
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"tailscale.com/metrics"
+)
+
+type chanSink chan *Alert
+
+func (c chanSink) SendAlert(ctx context.Context, a *Alert) error {
+	c <- a
+	return nil
+}
+
+func TestAlerts(t *testing.T) {
+	clk := newFakeTime()
+	p := newForTest(clk.Now, clk.NewTicker)
+	sink := make(chanSink, 10)
+	p.SetAlerts(AlertConfig{Sink: sink, FailAfter: 2, RecoverAfter: 2})
+	probe := &Probe{prober: p, name: "probe", labels: map[string]string{"label": "value"}, latency: metrics.NewHistogram(latencyBuckets)}
+
+	errFail := errors.New("failing, as instructed by test")
+	run := func(err error) {
+		t.Helper()
+		start := clk.Now()
+		clk.Advance(aFewMillis)
+		probe.recordEnd(start, err)
+		clk.Advance(probeInterval)
+	}
+	wantAlert := func(failing bool) *Alert {
+		t.Helper()
+		select {
+		case a := <-sink:
+			if a.Failing != failing {
+				t.Fatalf("got alert %+v; want failing=%v", a, failing)
+			}
+			return a
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no alert; want failing=%v", failing)
+		}
+		return nil
+	}
+	noAlert := func() {
+		t.Helper()
+		select {
+		case a := <-sink:
+			t.Fatalf("unexpected alert %+v", a)
+		case <-time.After(aFewMillis):
+		}
+	}
+
+	run(errFail)
+	noAlert()
+	run(nil) // resets the failure streak
+	run(errFail)
+	noAlert()
+	run(errFail)
+	a := wantAlert(true)
+	if a.Probe != "probe" || a.Labels["label"] != "value" || a.ConsecutiveFailures != 2 || a.Error != errFail.Error() {
+		t.Errorf("failing alert = %+v", a)
+	}
+	run(errFail)
+	noAlert() // still failing
+	run(nil)
+	noAlert()
+	run(nil)
+	a = wantAlert(false)
+	if a.Error != "" || a.ConsecutiveFailures != 0 {
+		t.Errorf("recovery alert = %+v", a)
+	}
+	run(nil)
+	noAlert()
+}
+
+func TestSuccessRatio(t *testing.T) {
+	clk := newFakeTime()
+	p := newForTest(clk.Now, clk.NewTicker)
+	probe := &Probe{prober: p, name: "probe", latency: metrics.NewHistogram(latencyBuckets)}
+
+	ratio := func(window time.Duration) float64 {
+		t.Helper()
+		probe.mu.Lock()
+		defer probe.mu.Unlock()
+		r, ok := probe.successRatioLocked(clk.Now(), window)
+		if !ok {
+			t.Fatalf("no success ratio for %v window", window)
+		}
+		return r
+	}
+
+	probe.recordEnd(clk.Now(), errors.New("fail"))
+	for i := 0; i < 3; i++ {
+		clk.Advance(2 * time.Minute)
+		probe.recordEnd(clk.Now(), nil)
+	}
+	// 6 minutes in, the failure has left the 5 minute window.
+	if got, want := ratio(5*time.Minute), 1.0; got != want {
+		t.Errorf("5m ratio = %v; want %v", got, want)
+	}
+	if got, want := ratio(time.Hour), 0.75; got != want {
+		t.Errorf("1h ratio = %v; want %v", got, want)
+	}
+
+	clk.Advance(2 * time.Hour)
+	probe.recordEnd(clk.Now(), nil)
+	probe.mu.Lock()
+	n := len(probe.recent)
+	probe.mu.Unlock()
+	if n != 1 {
+		t.Errorf("kept %d results after 2h; want 1", n)
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	got := make(chan *Alert, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/fail" {
+			http.Error(w, "failing, as instructed by test", 500)
+			return
+		}
+		if r.Method != "POST" || r.Header.Get("Content-Type") != "application/json" {
+			http.Error(w, "bad request", 400)
+			return
+		}
+		a := new(Alert)
+		if err := json.NewDecoder(r.Body).Decode(a); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		got <- a
+	}))
+	defer ts.Close()
+
+	want := &Alert{Probe: "probe", Failing: true, ConsecutiveFailures: 3, Error: "boom", Time: epoch.UTC()}
+	ctx := context.Background()
+	if err := Webhook(ts.URL).SendAlert(ctx, want); err != nil {
+		t.Fatal(err)
+	}
+	if a := <-got; a.Probe != want.Probe || !a.Failing || a.ConsecutiveFailures != 3 || a.Error != "boom" || !a.Time.Equal(want.Time) {
+		t.Errorf("webhook got %+v; want %+v", a, want)
+	}
+	if err := Webhook(ts.URL+"/fail").SendAlert(ctx, want); err == nil {
+		t.Errorf("webhook returning 500 succeeded")
+	}
+}
@@ -0,0 +1,319 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package prober
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tailscale/hujson"
+	"golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/tailcfg"
+)
+
+// defaultInterval is how often a probe in a Config runs if it doesn't
+// say.
+const defaultInterval = 30 * time.Second
+
+// Config is a declarative set of probes, as loaded by ParseConfig.
+//
+// An example config in HuJSON:
+//
+//	{
+//		"derpMap": "https://login.tailscale.com/derpmap/default",
+//		"alerts": {"webhook": "https://alerts.example.com/hook", "failAfter": 3},
+//		"probes": [
+//			{"name": "www", "type": "http", "url": "https://example.com/", "want": "Example"},
+//			{"name": "ssh", "type": "tcp", "addr": "example.com:22", "interval": "1m"},
+//			{"name": "cert", "type": "tls", "hostname": "example.com"},
+//			{"name": "stun", "type": "stun", "addr": "derp1.example.com:3478"},
+//			{"name": "dns", "type": "dns", "resolver": "8.8.8.8", "query": "example.com", "qtype": "A"},
+//			{"name": "derp-nyc", "type": "derp", "region": 1, "labels": {"team": "derp"}},
+//		],
+//	}
+type Config struct {
+	// DERPMap is the URL of the DERP map for "derp" probes to use.
+	// This package doesn't fetch it; see Prober.RunConfig.
+	DERPMap string `json:"derpMap,omitempty"`
+
+	// Alerts, if non-nil, configures alerting for the probes.
+	Alerts *AlertsConfig `json:"alerts,omitempty"`
+
+	Probes []*ProbeConfig `json:"probes"`
+}
+
+// AlertsConfig is the alerting configuration in a Config. See
+// AlertConfig.
+type AlertsConfig struct {
+	// Webhook is the URL to POST alerts to as JSON.
+	Webhook string `json:"webhook"`
+
+	FailAfter    int `json:"failAfter,omitempty"`
+	RecoverAfter int `json:"recoverAfter,omitempty"`
+}
+
+// ProbeConfig is the configuration of one probe in a Config.
+type ProbeConfig struct {
+	// Name is the probe's name. It must be unique within a Config.
+	Name string `json:"name"`
+
+	// Type is the probe type: "http", "tcp", "tls", "stun", "dns" or
+	// "derp".
+	Type string `json:"type"`
+
+	// Interval is how often the probe runs, as a Go duration. It
+	// defaults to 30s.
+	Interval string `json:"interval,omitempty"`
+
+	// Labels are static labels to export with the probe's metrics.
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// URL is the URL to fetch, for "http" probes.
+	URL string `json:"url,omitempty"`
+
+	// Want is the text the response body must contain, for "http"
+	// probes, or the answer that must be present, for "dns" probes.
+	Want string `json:"want,omitempty"`
+
+	// Addr is the host:port to connect to, for "tcp" and "stun"
+	// probes.
+	Addr string `json:"addr,omitempty"`
+
+	// Hostname is the host to connect to on port 443, for "tls"
+	// probes.
+	Hostname string `json:"hostname,omitempty"`
+
+	// Resolver, Query and QType are the resolver to query, the name
+	// to look up and the record type to look up ("A" by default), for
+	// "dns" probes.
+	Resolver string `json:"resolver,omitempty"`
+	Query    string `json:"query,omitempty"`
+	QType    string `json:"qtype,omitempty"`
+
+	// Region is the DERP region to probe, for "derp" probes. A "derp"
+	// probe config is expanded into one probe per pair of nodes in
+	// the region, named "<name>/<from>/<to>" and labeled with the
+	// region, from and to nodes.
+	Region int `json:"region,omitempty"`
+}
+
+// ParseConfig parses a probe config in HuJSON format.
+func ParseConfig(b []byte) (*Config, error) {
+	b, err := hujson.Standardize(b)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	c := new(Config)
+	if err := dec.Decode(c); err != nil {
+		return nil, err
+	}
+	if a := c.Alerts; a != nil {
+		if a.Webhook == "" {
+			return nil, errors.New(`alerts: missing "webhook"`)
+		}
+		if a.FailAfter < 0 || a.RecoverAfter < 0 {
+			return nil, errors.New("alerts: thresholds must not be negative")
+		}
+	}
+	seen := map[string]bool{}
+	for i, pc := range c.Probes {
+		if pc == nil || pc.Name == "" {
+			return nil, fmt.Errorf("probe %d: missing name", i)
+		}
+		if seen[pc.Name] {
+			return nil, fmt.Errorf("probe %q: duplicate name", pc.Name)
+		}
+		seen[pc.Name] = true
+		if err := pc.validate(); err != nil {
+			return nil, fmt.Errorf("probe %q: %w", pc.Name, err)
+		}
+	}
+	return c, nil
+}
+
+// HasDERPProbes reports whether c has any "derp" probes, which need a
+// DERP map to run.
+func (c *Config) HasDERPProbes() bool {
+	for _, pc := range c.Probes {
+		if pc.Type == "derp" {
+			return true
+		}
+	}
+	return false
+}
+
+func (pc *ProbeConfig) validate() error {
+	if _, err := pc.interval(); err != nil {
+		return err
+	}
+	need := func(field, v string) error {
+		if v == "" {
+			return fmt.Errorf("%s probes need %q", pc.Type, field)
+		}
+		return nil
+	}
+	switch pc.Type {
+	case "http":
+		return need("url", pc.URL)
+	case "tcp", "stun":
+		return need("addr", pc.Addr)
+	case "tls":
+		return need("hostname", pc.Hostname)
+	case "dns":
+		if err := need("resolver", pc.Resolver); err != nil {
+			return err
+		}
+		if err := need("query", pc.Query); err != nil {
+			return err
+		}
+		_, err := pc.qtype()
+		return err
+	case "derp":
+		if pc.Region == 0 {
+			return errors.New(`derp probes need "region"`)
+		}
+		return nil
+	case "":
+		return errors.New("missing type")
+	}
+	return fmt.Errorf("unknown type %q", pc.Type)
+}
+
+func (pc *ProbeConfig) interval() (time.Duration, error) {
+	if pc.Interval == "" {
+		return defaultInterval, nil
+	}
+	d, err := time.ParseDuration(pc.Interval)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("bad interval %q", pc.Interval)
+	}
+	return d, nil
+}
+
+var dnsQTypes = map[string]dnsmessage.Type{
+	"A":     dnsmessage.TypeA,
+	"AAAA":  dnsmessage.TypeAAAA,
+	"CNAME": dnsmessage.TypeCNAME,
+	"NS":    dnsmessage.TypeNS,
+	"PTR":   dnsmessage.TypePTR,
+	"TXT":   dnsmessage.TypeTXT,
+}
+
+func (pc *ProbeConfig) qtype() (dnsmessage.Type, error) {
+	if pc.QType == "" {
+		return dnsmessage.TypeA, nil
+	}
+	t, ok := dnsQTypes[strings.ToUpper(pc.QType)]
+	if !ok {
+		return 0, fmt.Errorf("unsupported qtype %q", pc.QType)
+	}
+	return t, nil
+}
+
+// RunConfig runs all the probes in c, using dm for "derp" probes, and
+// returns them. dm may be nil if c has no "derp" probes. If c
+// configures alerts, RunConfig also sets them up for all of p's
+// probes.
+//
+// If c is invalid for dm, RunConfig returns an error without running
+// any probes.
+func (p *Prober) RunConfig(c *Config, dm *tailcfg.DERPMap) ([]*Probe, error) {
+	type probeSpec struct {
+		name     string
+		interval time.Duration
+		labels   map[string]string
+		fun      ProbeFunc
+	}
+	var specs []probeSpec
+	for _, pc := range c.Probes {
+		interval, err := pc.interval()
+		if err != nil {
+			return nil, fmt.Errorf("probe %q: %w", pc.Name, err)
+		}
+		add := func(name string, labels map[string]string, fun ProbeFunc) {
+			specs = append(specs, probeSpec{name, interval, labels, fun})
+		}
+		switch pc.Type {
+		case "http":
+			add(pc.Name, pc.Labels, HTTP(pc.URL, pc.Want))
+		case "tcp":
+			add(pc.Name, pc.Labels, TCP(pc.Addr))
+		case "tls":
+			add(pc.Name, pc.Labels, TLS(pc.Hostname))
+		case "stun":
+			add(pc.Name, pc.Labels, STUN(pc.Addr))
+		case "dns":
+			qtype, err := pc.qtype()
+			if err != nil {
+				return nil, fmt.Errorf("probe %q: %w", pc.Name, err)
+			}
+			add(pc.Name, pc.Labels, DNS(pc.Resolver, pc.Query, qtype, pc.Want))
+		case "derp":
+			var region *tailcfg.DERPRegion
+			if dm != nil {
+				region = dm.Regions[pc.Region]
+			}
+			if region == nil || len(region.Nodes) == 0 {
+				return nil, fmt.Errorf("probe %q: no DERP region %d", pc.Name, pc.Region)
+			}
+			for _, from := range region.Nodes {
+				for _, to := range region.Nodes {
+					labels := map[string]string{
+						"region": strconv.Itoa(region.RegionID),
+						"from":   from.Name,
+						"to":     to.Name,
+					}
+					for k, v := range pc.Labels {
+						labels[k] = v
+					}
+					add(pc.Name+"/"+from.Name+"/"+to.Name, labels, DERP(region, from.Name, to.Name))
+				}
+			}
+		default:
+			return nil, fmt.Errorf("probe %q: unknown type %q", pc.Name, pc.Type)
+		}
+	}
+
+	// Check for names clashing after expansion before running
+	// anything, as Run panics on them.
+	names := map[string]bool{}
+	p.mu.Lock()
+	for name := range p.probes {
+		names[name] = true
+	}
+	p.mu.Unlock()
+	var dups []string
+	for _, s := range specs {
+		if names[s.name] {
+			dups = append(dups, s.name)
+		}
+		names[s.name] = true
+	}
+	if len(dups) > 0 {
+		sort.Strings(dups)
+		return nil, fmt.Errorf("duplicate probe names: %q", dups)
+	}
+
+	if a := c.Alerts; a != nil {
+		p.SetAlerts(AlertConfig{
+			Sink:         Webhook(a.Webhook),
+			FailAfter:    a.FailAfter,
+			RecoverAfter: a.RecoverAfter,
+		})
+	}
+	ret := make([]*Probe, 0, len(specs))
+	for _, s := range specs {
+		ret = append(ret, p.Run(s.name, s.interval, s.labels, s.fun))
+	}
+	return ret, nil
+}
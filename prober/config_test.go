@@ -0,0 +1,168 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package prober
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"tailscale.com/tailcfg"
+)
+
+func TestParseConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		wantErr string // substring; empty means success
+	}{
+		{
+			name: "all_types",
+			in: `{
+				// A comment.
+				"derpMap": "file:///derpmap.json",
+				"alerts": {"webhook": "https://example.com/hook", "failAfter": 3},
+				"probes": [
+					{"name": "www", "type": "http", "url": "https://example.com/", "want": "Example"},
+					{"name": "ssh", "type": "tcp", "addr": "example.com:22", "interval": "1m"},
+					{"name": "cert", "type": "tls", "hostname": "example.com"},
+					{"name": "stun", "type": "stun", "addr": "example.com:3478"},
+					{"name": "dns", "type": "dns", "resolver": "8.8.8.8", "query": "example.com", "qtype": "aaaa"},
+					{"name": "derp", "type": "derp", "region": 1, "labels": {"team": "derp"}},
+				],
+			}`,
+		},
+		{
+			name:    "unknown_field",
+			in:      `{"probes": [{"name": "a", "type": "tcp", "addr": "x:1", "port": 1}]}`,
+			wantErr: "unknown field",
+		},
+		{
+			name:    "duplicate_name",
+			in:      `{"probes": [{"name": "a", "type": "tcp", "addr": "x:1"}, {"name": "a", "type": "tls", "hostname": "x"}]}`,
+			wantErr: "duplicate name",
+		},
+		{
+			name:    "missing_name",
+			in:      `{"probes": [{"type": "tcp", "addr": "x:1"}]}`,
+			wantErr: "missing name",
+		},
+		{
+			name:    "unknown_type",
+			in:      `{"probes": [{"name": "a", "type": "icmp"}]}`,
+			wantErr: "unknown type",
+		},
+		{
+			name:    "missing_field",
+			in:      `{"probes": [{"name": "a", "type": "http"}]}`,
+			wantErr: `need "url"`,
+		},
+		{
+			name:    "bad_interval",
+			in:      `{"probes": [{"name": "a", "type": "tcp", "addr": "x:1", "interval": "-1s"}]}`,
+			wantErr: "bad interval",
+		},
+		{
+			name:    "alerts_without_webhook",
+			in:      `{"alerts": {"failAfter": 3}, "probes": []}`,
+			wantErr: `missing "webhook"`,
+		},
+		{
+			name:    "bad_qtype",
+			in:      `{"probes": [{"name": "a", "type": "dns", "resolver": "x", "query": "y", "qtype": "MX"}]}`,
+			wantErr: "unsupported qtype",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := ParseConfig([]byte(tt.in))
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(c.Probes) != 6 || !c.HasDERPProbes() {
+					t.Errorf("parsed %d probes, HasDERPProbes=%v", len(c.Probes), c.HasDERPProbes())
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got error %v; want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRunConfig(t *testing.T) {
+	clk := newFakeTime()
+	p := newForTest(clk.Now, clk.NewTicker)
+	c, err := ParseConfig([]byte(`{
+		"probes": [
+			{"name": "tcp", "type": "tcp", "addr": "127.0.0.1:1", "interval": "1h", "labels": {"env": "test"}},
+			{"name": "derp", "type": "derp", "region": 1, "labels": {"team": "derp"}},
+		],
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := p.RunConfig(c, nil); err == nil {
+		t.Fatal("RunConfig without a DERP map succeeded")
+	}
+	if n := p.activeProbes(); n != 0 {
+		t.Fatalf("failed RunConfig left %d probes running", n)
+	}
+
+	dm := &tailcfg.DERPMap{
+		Regions: map[int]*tailcfg.DERPRegion{
+			1: {
+				RegionID: 1,
+				Nodes: []*tailcfg.DERPNode{
+					// Unresolvable, so the probes fail quickly.
+					{Name: "1a", RegionID: 1, HostName: "1a.invalid"},
+					{Name: "1b", RegionID: 1, HostName: "1b.invalid"},
+				},
+			},
+		},
+	}
+	probes, err := p.RunConfig(c, dm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		for _, probe := range probes {
+			probe.Close()
+		}
+	}()
+	got := map[string]map[string]string{}
+	for _, probe := range probes {
+		got[probe.name] = probe.labels
+		if probe.name == "tcp" && probe.interval != time.Hour {
+			t.Errorf("tcp probe interval = %v; want 1h", probe.interval)
+		}
+	}
+	derpLabels := func(from, to string) map[string]string {
+		return map[string]string{"region": "1", "from": from, "to": to, "team": "derp"}
+	}
+	want := map[string]map[string]string{
+		"tcp":        {"env": "test"},
+		"derp/1a/1a": derpLabels("1a", "1a"),
+		"derp/1a/1b": derpLabels("1a", "1b"),
+		"derp/1b/1a": derpLabels("1b", "1a"),
+		"derp/1b/1b": derpLabels("1b", "1b"),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("probes = %v; want %v", got, want)
+	}
+
+	// Running the same config again clashes with the running probes.
+	_, err = p.RunConfig(c, dm)
+	if err == nil || !strings.Contains(err.Error(), "duplicate probe names") {
+		t.Errorf("second RunConfig: got %v; want duplicate names error", err)
+	}
+	if n := p.activeProbes(); n != len(want) {
+		t.Errorf("%d probes running after failed RunConfig; want %d", n, len(want))
+	}
+}
@@ -0,0 +1,224 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package prober
+
+import (
+	"bytes"
+	"context"
+	crand "crypto/rand"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"tailscale.com/derp"
+	"tailscale.com/derp/derphttp"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+)
+
+// DERP returns a Probe that healthchecks a DERP region by sending a
+// packet between two DERP clients.
+//
+// The ProbeFunc connects one client to the node in region named from
+// and another to the node named to, which may be the same node, sends
+// a packet from the first client to the second and back, and verifies
+// that both arrive intact. The clients stay connected between probe
+// runs unless a run fails, so after the first run the probe's latency
+// is the round-trip time through the region.
+func DERP(region *tailcfg.DERPRegion, from, to string) ProbeFunc {
+	p := &derpProbe{region: region, from: from, to: to}
+	return p.probe
+}
+
+type derpProbe struct {
+	region   *tailcfg.DERPRegion
+	from, to string
+
+	mu    sync.Mutex // held while probing
+	fromc *derpProbeClient
+	toc   *derpProbeClient
+}
+
+func (p *derpProbe) probe(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.connect(ctx); err != nil {
+		p.closeClients()
+		return err
+	}
+	if err := p.roundTrip(ctx); err != nil {
+		p.closeClients()
+		return err
+	}
+	return nil
+}
+
+// connect connects p's clients, if they aren't already connected.
+//
+// p.mu must be held.
+func (p *derpProbe) connect(ctx context.Context) error {
+	if p.fromc != nil && p.toc != nil {
+		return nil
+	}
+	p.closeClients()
+	fromNode, err := derpNode(p.region, p.from)
+	if err != nil {
+		return err
+	}
+	toNode, err := derpNode(p.region, p.to)
+	if err != nil {
+		return err
+	}
+	if p.fromc, err = newDERPProbeClient(ctx, p.region, fromNode); err != nil {
+		return err
+	}
+	if p.toc, err = newDERPProbeClient(ctx, p.region, toNode); err != nil {
+		return err
+	}
+	if fromNode.Name != toNode.Name {
+		// Wait a bit for the from node to hear about the to client
+		// from its mesh peer.
+		select {
+		case <-time.After(100 * time.Millisecond): // pretty arbitrary
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// roundTrip sends a random packet from p.fromc to p.toc, and another
+// one back.
+//
+// p.mu must be held.
+func (p *derpProbe) roundTrip(ctx context.Context) error {
+	if err := derpSendRecv(ctx, p.fromc, p.toc); err != nil {
+		return err
+	}
+	return derpSendRecv(ctx, p.toc, p.fromc)
+}
+
+// closeClients closes p's clients, if any.
+//
+// p.mu must be held.
+func (p *derpProbe) closeClients() {
+	for _, c := range []*derpProbeClient{p.fromc, p.toc} {
+		if c != nil {
+			c.Close()
+		}
+	}
+	p.fromc, p.toc = nil, nil
+}
+
+func derpNode(region *tailcfg.DERPRegion, name string) (*tailcfg.DERPNode, error) {
+	for _, n := range region.Nodes {
+		if n.Name == name {
+			return n, nil
+		}
+	}
+	return nil, fmt.Errorf("no node %q in DERP region %d", name, region.RegionID)
+}
+
+// derpSendRecv sends a random packet from src to dst, and waits for
+// dst to receive it.
+func derpSendRecv(ctx context.Context, src, dst *derpProbeClient) error {
+	pkt := make([]byte, 8)
+	crand.Read(pkt)
+	if err := src.Send(dst.SelfPublicKey(), pkt); err != nil {
+		return fmt.Errorf("sending via %q: %w", src.node.Name, err)
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("timeout receiving via %q: %w", dst.node.Name, ctx.Err())
+		case err := <-dst.errc:
+			return fmt.Errorf("receiving via %q: %w", dst.node.Name, err)
+		case rp := <-dst.recvc:
+			if rp.Source != src.SelfPublicKey() || !bytes.Equal(rp.Data, pkt) {
+				// Probably a packet from a previous probe run
+				// that timed out.
+				continue
+			}
+			return nil
+		}
+	}
+}
+
+// derpProbeClient is a DERP client connected to a single DERP node,
+// with a goroutine receiving packets for it.
+type derpProbeClient struct {
+	*derphttp.Client
+	node  *tailcfg.DERPNode
+	recvc chan derp.ReceivedPacket
+	errc  chan error // gets the error that stopped receiving
+}
+
+func newDERPProbeClient(ctx context.Context, region *tailcfg.DERPRegion, n *tailcfg.DERPNode) (*derpProbeClient, error) {
+	dc := derphttp.NewRegionClient(key.NewNode(), log.Printf, func() *tailcfg.DERPRegion {
+		return &tailcfg.DERPRegion{
+			RegionID:   region.RegionID,
+			RegionCode: fmt.Sprintf("%s-%s", region.RegionCode, n.Name),
+			RegionName: region.RegionName,
+			Nodes:      []*tailcfg.DERPNode{n},
+		}
+	})
+	dc.IsProber = true
+	if err := dc.Connect(ctx); err != nil {
+		dc.Close()
+		return nil, fmt.Errorf("connecting to %q: %w", n.Name, err)
+	}
+	c := &derpProbeClient{
+		Client: dc,
+		node:   n,
+		recvc:  make(chan derp.ReceivedPacket, 8),
+		errc:   make(chan error, 1),
+	}
+	first := make(chan error, 1)
+	go c.recvLoop(first)
+	select {
+	case err := <-first:
+		if err != nil {
+			dc.Close()
+			return nil, fmt.Errorf("connecting to %q: %w", n.Name, err)
+		}
+	case <-ctx.Done():
+		dc.Close()
+		return nil, fmt.Errorf("timeout waiting for ServerInfoMessage from %q: %w", n.Name, ctx.Err())
+	}
+	return c, nil
+}
+
+// recvLoop receives messages for c until its connection fails. The
+// result of the first receive, which must be a ServerInfoMessage, is
+// sent to first.
+func (c *derpProbeClient) recvLoop(first chan<- error) {
+	m, err := c.Recv()
+	if err == nil {
+		if _, ok := m.(derp.ServerInfoMessage); !ok {
+			err = fmt.Errorf("unexpected first message type %T", m)
+		}
+	}
+	first <- err
+	if err != nil {
+		return
+	}
+	for {
+		m, err := c.Recv()
+		if err != nil {
+			c.errc <- err
+			return
+		}
+		if rp, ok := m.(derp.ReceivedPacket); ok {
+			// Copy the packet; Recv reuses its buffer.
+			rp.Data = append([]byte(nil), rp.Data...)
+			select {
+			case c.recvc <- rp:
+			default:
+				// Nobody's waiting; drop it.
+			}
+		}
+	}
+}
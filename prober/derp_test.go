@@ -0,0 +1,68 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package prober
+
+import (
+	"context"
+	"net"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"tailscale.com/derp"
+	"tailscale.com/derp/derphttp"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+)
+
+func TestDERP(t *testing.T) {
+	s := derp.NewServer(key.NewNode(), t.Logf)
+	defer s.Close()
+	hs := httptest.NewTLSServer(derphttp.Handler(s))
+	defer hs.Close()
+	host, portStr, err := net.SplitHostPort(hs.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, _ := strconv.Atoi(portStr)
+	region := &tailcfg.DERPRegion{
+		RegionID:   900,
+		RegionCode: "test",
+		Nodes: []*tailcfg.DERPNode{{
+			Name:             "900a",
+			RegionID:         900,
+			HostName:         host,
+			IPv4:             host,
+			IPv6:             "none",
+			DERPPort:         port,
+			InsecureForTests: true,
+		}},
+	}
+
+	probe := DERP(region, "900a", "900a")
+	for i := 0; i < 2; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err := probe(ctx)
+		cancel()
+		if err != nil {
+			t.Fatalf("run %d: %v", i, err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := DERP(region, "900a", "nope")(ctx); err == nil {
+		t.Errorf("probe to unknown node succeeded")
+	}
+
+	s.Close()
+	hs.Close()
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := probe(ctx); err == nil {
+		t.Errorf("probe of stopped server succeeded")
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package prober
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"inet.af/netaddr"
+)
+
+// DNS returns a Probe that healthchecks a DNS resolver.
+//
+// The ProbeFunc queries resolver, a host or host:port (with port 53
+// by default), over UDP for records of type qtype for name, and
+// verifies that the response has at least one such record. If want
+// is non-empty, one of the records must also match it: an IP address
+// for A and AAAA records, a domain name for CNAME, NS and PTR records,
+// or the text of a TXT record.
+func DNS(resolver, name string, qtype dnsmessage.Type, want string) ProbeFunc {
+	if _, _, err := net.SplitHostPort(resolver); err != nil {
+		resolver = net.JoinHostPort(resolver, "53")
+	}
+	return func(ctx context.Context) error {
+		return probeDNS(ctx, resolver, name, qtype, want)
+	}
+}
+
+func probeDNS(ctx context.Context, resolver, name string, qtype dnsmessage.Type, want string) error {
+	qname, err := dnsmessage.NewName(dnsFQDN(name))
+	if err != nil {
+		return fmt.Errorf("bad name %q: %w", name, err)
+	}
+	id := uint16(rand.Uint32())
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, RecursionDesired: true})
+	b.EnableCompression()
+	b.StartQuestions()
+	b.Question(dnsmessage.Question{Name: qname, Type: qtype, Class: dnsmessage.ClassINET})
+	query, err := b.Finish()
+	if err != nil {
+		return fmt.Errorf("building query: %w", err)
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", resolver)
+	if err != nil {
+		return fmt.Errorf("dialing %q: %w", resolver, err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if _, err := conn.Write(query); err != nil {
+		return fmt.Errorf("sending query to %q: %w", resolver, err)
+	}
+	buf := make([]byte, 4096)
+	var msg dnsmessage.Message
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return fmt.Errorf("reading response from %q: %w", resolver, err)
+		}
+		if err := msg.Unpack(buf[:n]); err != nil {
+			return fmt.Errorf("parsing response from %q: %w", resolver, err)
+		}
+		if msg.ID == id && msg.Response {
+			break
+		}
+		// A late response to some other query; keep waiting.
+	}
+	if msg.RCode != dnsmessage.RCodeSuccess {
+		return fmt.Errorf("%v %v query to %q: %v", name, qtype, resolver, msg.RCode)
+	}
+
+	var got []string
+	for _, rr := range msg.Answers {
+		if rr.Header.Type != qtype {
+			continue
+		}
+		s := dnsAnswerString(rr.Body)
+		if want == "" || dnsAnswerMatches(qtype, s, want) {
+			return nil
+		}
+		got = append(got, s)
+	}
+	if len(got) == 0 {
+		return fmt.Errorf("%v %v query to %q: no answers", name, qtype, resolver)
+	}
+	return fmt.Errorf("%v %v query to %q: got %q, want %q", name, qtype, resolver, got, want)
+}
+
+func dnsAnswerString(body dnsmessage.ResourceBody) string {
+	switch r := body.(type) {
+	case *dnsmessage.AResource:
+		return netaddr.IPFrom4(r.A).String()
+	case *dnsmessage.AAAAResource:
+		return netaddr.IPv6Raw(r.AAAA).String()
+	case *dnsmessage.CNAMEResource:
+		return r.CNAME.String()
+	case *dnsmessage.NSResource:
+		return r.NS.String()
+	case *dnsmessage.PTRResource:
+		return r.PTR.String()
+	case *dnsmessage.TXTResource:
+		return strings.Join(r.TXT, "")
+	}
+	return body.GoString()
+}
+
+func dnsAnswerMatches(qtype dnsmessage.Type, got, want string) bool {
+	switch qtype {
+	case dnsmessage.TypeA, dnsmessage.TypeAAAA:
+		gotIP, err1 := netaddr.ParseIP(got)
+		wantIP, err2 := netaddr.ParseIP(want)
+		return err1 == nil && err2 == nil && gotIP == wantIP
+	case dnsmessage.TypeCNAME, dnsmessage.TypeNS, dnsmessage.TypePTR:
+		return strings.EqualFold(got, dnsFQDN(want))
+	}
+	return got == want
+}
+
+func dnsFQDN(name string) string {
+	if !strings.HasSuffix(name, ".") {
+		return name + "."
+	}
+	return name
+}
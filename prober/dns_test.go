@@ -0,0 +1,82 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package prober
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// serveDNS answers A queries for example.com with 192.0.2.1 and
+// fails all others with NXDOMAIN, until pc is closed.
+func serveDNS(pc net.PacketConn) {
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		var q dnsmessage.Message
+		if err := q.Unpack(buf[:n]); err != nil || len(q.Questions) != 1 {
+			continue
+		}
+		res := dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: q.ID, Response: true},
+			Questions: q.Questions,
+		}
+		qq := q.Questions[0]
+		if qq.Name.String() == "example.com." && qq.Type == dnsmessage.TypeA {
+			res.Answers = []dnsmessage.Resource{{
+				Header: dnsmessage.ResourceHeader{Name: qq.Name, Type: qq.Type, Class: qq.Class, TTL: 60},
+				Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}},
+			}}
+		} else {
+			res.RCode = dnsmessage.RCodeNameError
+		}
+		b, err := res.Pack()
+		if err != nil {
+			continue
+		}
+		pc.WriteTo(b, addr)
+	}
+}
+
+func TestDNS(t *testing.T) {
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	go serveDNS(pc)
+	resolver := pc.LocalAddr().String()
+
+	tests := []struct {
+		name    string
+		qname   string
+		qtype   dnsmessage.Type
+		want    string
+		wantErr bool
+	}{
+		{"any_answer", "example.com", dnsmessage.TypeA, "", false},
+		{"matching_answer", "example.com.", dnsmessage.TypeA, "192.0.2.1", false},
+		{"wrong_answer", "example.com", dnsmessage.TypeA, "192.0.2.2", true},
+		{"nxdomain", "nope.example.com", dnsmessage.TypeA, "", true},
+		{"no_answers", "example.com", dnsmessage.TypeAAAA, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			err := DNS(resolver, tt.qname, tt.qtype, tt.want)(ctx)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v; want error: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -19,6 +19,9 @@
 	"strings"
 	"sync"
 	"time"
+
+	"tailscale.com/metrics"
+	"tailscale.com/util/mak"
 )
 
 // ProbeFunc is a function that probes something and reports whether
@@ -34,6 +37,7 @@ type Prober struct {
 
 	mu     sync.Mutex // protects all following fields
 	probes map[string]*Probe
+	alerts *AlertConfig // or nil
 }
 
 // New returns a new Prober.
@@ -77,6 +81,7 @@ func (p *Prober) Run(name string, interval time.Duration, labels map[string]stri
 		interval: interval,
 		tick:     ticker,
 		labels:   labels,
+		latency:  metrics.NewHistogram(latencyBuckets),
 	}
 	p.probes[name] = probe
 	go probe.loop()
@@ -97,6 +102,11 @@ func (p *Prober) activeProbes() int {
 	return len(p.probes)
 }
 
+// latencyBuckets are the upper bounds, in seconds, of the buckets of
+// probe latency histograms. They're the Prometheus client's default
+// buckets, which suit network probes well.
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
 // Probe is a probe that healthchecks something and updates Prometheus
 // metrics with the results.
 type Probe struct {
@@ -110,11 +120,68 @@ type Probe struct {
 	interval time.Duration
 	tick     ticker
 	labels   map[string]string
+	latency  *metrics.Histogram // of all doProbe calls, in seconds
+
+	mu        sync.Mutex
+	start     time.Time // last time doProbe started
+	end       time.Time // last time doProbe returned
+	result    bool      // whether the last doProbe call succeeded
+	lastErr   error     // error from the last doProbe call, or nil
+	successes int64     // number of doProbe calls that succeeded
+	failures  int64     // number of doProbe calls that failed
+	recent    []runResult
+
+	// consecutiveFailures and consecutiveSuccesses are the
+	// lengths of the current streak of failed or successful runs.
+	// At most one of them is non-zero.
+	consecutiveFailures  int
+	consecutiveSuccesses int
+
+	// failing is whether the probe is considered to be failing, for
+	// alerting purposes. See AlertConfig.
+	failing bool
+}
+
+// runResult is the result of one run of a probe, kept for computing
+// success ratios over successWindows.
+type runResult struct {
+	end time.Time
+	ok  bool
+}
+
+// successWindows are the sliding windows over which probes' success
+// ratios are exported.
+var successWindows = []struct {
+	name string
+	d    time.Duration
+}{
+	{"5m", 5 * time.Minute},
+	{"1h", time.Hour},
+}
+
+// maxSuccessWindow is the longest of successWindows.
+const maxSuccessWindow = time.Hour
 
-	mu     sync.Mutex
-	start  time.Time // last time doProbe started
-	end    time.Time // last time doProbe returned
-	result bool      // whether the last doProbe call succeeded
+// successRatioLocked returns the fraction of p's runs that ended in
+// the window before now that succeeded, or false if none did.
+//
+// p.mu must be held.
+func (p *Probe) successRatioLocked(now time.Time, window time.Duration) (float64, bool) {
+	var ok, total int
+	for i := len(p.recent) - 1; i >= 0; i-- {
+		r := p.recent[i]
+		if now.Sub(r.end) > window {
+			break
+		}
+		total++
+		if r.ok {
+			ok++
+		}
+	}
+	if total == 0 {
+		return 0, false
+	}
+	return float64(ok) / float64(total), true
 }
 
 // Close shuts down the Probe and unregisters it from its Prober.
@@ -182,10 +249,36 @@ func (p *Probe) recordStart() time.Time {
 
 func (p *Probe) recordEnd(start time.Time, err error) {
 	end := p.prober.now()
+	p.prober.mu.Lock()
+	alerts := p.prober.alerts
+	p.prober.mu.Unlock()
+
 	p.mu.Lock()
 	defer p.mu.Unlock()
 	p.end = end
 	p.result = err == nil
+	p.lastErr = err
+	p.latency.Observe(end.Sub(start).Seconds())
+	if err == nil {
+		p.successes++
+		p.consecutiveSuccesses++
+		p.consecutiveFailures = 0
+	} else {
+		p.failures++
+		p.consecutiveFailures++
+		p.consecutiveSuccesses = 0
+	}
+
+	// Forget results that are too old for any window.
+	drop := 0
+	for drop < len(p.recent) && end.Sub(p.recent[drop].end) > maxSuccessWindow {
+		drop++
+	}
+	p.recent = append(p.recent[drop:], runResult{end, err == nil})
+
+	if a := p.updateFailingLocked(alerts); a != nil && alerts != nil && alerts.Sink != nil {
+		p.prober.sendAlert(alerts.Sink, a)
+	}
 }
 
 type varExporter struct {
@@ -195,11 +288,14 @@ type varExporter struct {
 // probeInfo is the state of a Probe. Used in expvar-format debug
 // data.
 type probeInfo struct {
-	Labels  map[string]string
-	Start   time.Time
-	End     time.Time
-	Latency string // as a string because time.Duration doesn't encode readably to JSON
-	Result  bool
+	Labels              map[string]string
+	Start               time.Time
+	End                 time.Time
+	Latency             string // as a string because time.Duration doesn't encode readably to JSON
+	Result              bool
+	Error               string             `json:",omitempty"` // from the last run
+	ConsecutiveFailures int                `json:",omitempty"`
+	SuccessRatio        map[string]float64 `json:",omitempty"` // by window, for windows with runs in them
 }
 
 // String implements expvar.Var, returning the prober's state as an
@@ -221,10 +317,21 @@ func (v varExporter) String() string {
 			Start:  probe.start,
 			End:    probe.end,
 			Result: probe.result,
+
+			ConsecutiveFailures: probe.consecutiveFailures,
 		}
 		if probe.end.After(probe.start) {
 			inf.Latency = probe.end.Sub(probe.start).String()
 		}
+		if probe.lastErr != nil {
+			inf.Error = probe.lastErr.Error()
+		}
+		now := v.p.now()
+		for _, w := range successWindows {
+			if r, ok := probe.successRatioLocked(now, w.d); ok {
+				mak.Set(&inf.SuccessRatio, w.name, r)
+			}
+		}
 		out[probe.name] = inf
 		probe.mu.Unlock()
 	}
@@ -238,14 +345,22 @@ func (v varExporter) String() string {
 
 // WritePrometheus writes the the state of all probes to w.
 //
-// For each probe, WritePrometheus exports 5 variables:
-//  - <prefix>_interval_secs, how frequently the probe runs.
-//  - <prefix>_start_secs, when the probe last started running, in seconds since epoch.
-//  - <prefix>_end_secs, when the probe last finished running, in seconds since epoch.
-//  - <prefix>_latency_millis, how long the last probe cycle took, in
-//    milliseconds. This is just (end_secs-start_secs) in an easier to
-//    graph form.
-//  - <prefix>_result, 1 if the last probe succeeded, 0 if it failed.
+// For each probe, WritePrometheus exports these variables:
+//   - <prefix>_interval_secs, how frequently the probe runs.
+//   - <prefix>_start_secs, when the probe last started running, in seconds since epoch.
+//   - <prefix>_end_secs, when the probe last finished running, in seconds since epoch.
+//   - <prefix>_latency_millis, how long the last probe cycle took, in
+//     milliseconds. This is just (end_secs-start_secs) in an easier to
+//     graph form.
+//   - <prefix>_result, 1 if the last probe succeeded, 0 if it failed.
+//   - <prefix>_latency_seconds, a histogram of how long all probe
+//     cycles took.
+//   - <prefix>_successes_total and <prefix>_failures_total, the
+//     number of probe cycles that succeeded and failed.
+//   - <prefix>_consecutive_failures, the number of probe cycles that
+//     have failed since the last one that succeeded.
+//   - <prefix>_success_ratio, with a window label, the fraction of
+//     probe cycles in the last 5m and 1h that succeeded.
 //
 // Each probe has a set of static key/value labels (defined once at
 // probe creation), which are added as Prometheus metric labels to
@@ -288,6 +403,16 @@ func (v varExporter) WritePrometheus(w io.Writer, prefix string) {
 			} else {
 				fmt.Fprintf(w, "%s_result{%s} 0\n", prefix, labels)
 			}
+			probe.latency.WritePrometheusSamples(w, prefix+"_latency_seconds", labels)
+			fmt.Fprintf(w, "%s_successes_total{%s} %d\n", prefix, labels, probe.successes)
+			fmt.Fprintf(w, "%s_failures_total{%s} %d\n", prefix, labels, probe.failures)
+			fmt.Fprintf(w, "%s_consecutive_failures{%s} %d\n", prefix, labels, probe.consecutiveFailures)
+			now := v.p.now()
+			for _, sw := range successWindows {
+				if r, ok := probe.successRatioLocked(now, sw.d); ok {
+					fmt.Fprintf(w, "%s_success_ratio{%s,window=%q} %v\n", prefix, labels, sw.name, r)
+				}
+			}
 		}
 		probe.mu.Unlock()
 	}
@@ -170,6 +170,10 @@ func TestExpvar(t *testing.T) {
 		End:     epoch.Add(aFewMillis),
 		Latency: aFewMillis.String(),
 		Result:  false,
+
+		Error:               "failing, as instructed by test",
+		ConsecutiveFailures: 1,
+		SuccessRatio:        map[string]float64{"5m": 0, "1h": 0},
 	})
 
 	succeed.Set(true)
@@ -182,6 +186,8 @@ func TestExpvar(t *testing.T) {
 		End:     st.Add(aFewMillis),
 		Latency: aFewMillis.String(),
 		Result:  true,
+
+		SuccessRatio: map[string]float64{"5m": 0.5, "1h": 0.5},
 	})
 }
 
@@ -209,7 +215,13 @@ func TestPrometheus(t *testing.T) {
 probe_end_secs{name="testprobe",label="value"} %d
 probe_latency_millis{name="testprobe",label="value"} %d
 probe_result{name="testprobe",label="value"} 0
-`, probeInterval.Seconds(), epoch.Unix(), epoch.Add(aFewMillis).Unix(), aFewMillis.Milliseconds()))
+%s
+probe_successes_total{name="testprobe",label="value"} 0
+probe_failures_total{name="testprobe",label="value"} 1
+probe_consecutive_failures{name="testprobe",label="value"} 1
+probe_success_ratio{name="testprobe",label="value",window="5m"} 0
+probe_success_ratio{name="testprobe",label="value",window="1h"} 0
+`, probeInterval.Seconds(), epoch.Unix(), epoch.Add(aFewMillis).Unix(), aFewMillis.Milliseconds(), latencyHistogram(1)))
 		if diff := cmp.Diff(strings.TrimSpace(b.String()), want); diff != "" {
 			return fmt.Errorf("wrong probe stats (-got+want):\n%s", diff)
 		}
@@ -233,7 +245,13 @@ func TestPrometheus(t *testing.T) {
 probe_end_secs{name="testprobe",label="value"} %d
 probe_latency_millis{name="testprobe",label="value"} %d
 probe_result{name="testprobe",label="value"} 1
-`, probeInterval.Seconds(), start.Unix(), end.Unix(), aFewMillis.Milliseconds()))
+%s
+probe_successes_total{name="testprobe",label="value"} 1
+probe_failures_total{name="testprobe",label="value"} 1
+probe_consecutive_failures{name="testprobe",label="value"} 0
+probe_success_ratio{name="testprobe",label="value",window="5m"} 0.5
+probe_success_ratio{name="testprobe",label="value",window="1h"} 0.5
+`, probeInterval.Seconds(), start.Unix(), end.Unix(), aFewMillis.Milliseconds(), latencyHistogram(2)))
 		if diff := cmp.Diff(strings.TrimSpace(b.String()), want); diff != "" {
 			return fmt.Errorf("wrong probe stats (-got+want):\n%s", diff)
 		}
@@ -244,6 +262,27 @@ func TestPrometheus(t *testing.T) {
 	}
 }
 
+// latencyHistogram returns the expected latency histogram of testprobe
+// in TestPrometheus after n runs that took aFewMillis each.
+func latencyHistogram(n int) string {
+	return strings.TrimSpace(fmt.Sprintf(`
+probe_latency_seconds_bucket{name="testprobe",label="value",le="0.005"} 0
+probe_latency_seconds_bucket{name="testprobe",label="value",le="0.01"} 0
+probe_latency_seconds_bucket{name="testprobe",label="value",le="0.025"} %[1]d
+probe_latency_seconds_bucket{name="testprobe",label="value",le="0.05"} %[1]d
+probe_latency_seconds_bucket{name="testprobe",label="value",le="0.1"} %[1]d
+probe_latency_seconds_bucket{name="testprobe",label="value",le="0.25"} %[1]d
+probe_latency_seconds_bucket{name="testprobe",label="value",le="0.5"} %[1]d
+probe_latency_seconds_bucket{name="testprobe",label="value",le="1"} %[1]d
+probe_latency_seconds_bucket{name="testprobe",label="value",le="2.5"} %[1]d
+probe_latency_seconds_bucket{name="testprobe",label="value",le="5"} %[1]d
+probe_latency_seconds_bucket{name="testprobe",label="value",le="10"} %[1]d
+probe_latency_seconds_bucket{name="testprobe",label="value",le="+Inf"} %[1]d
+probe_latency_seconds_sum{name="testprobe",label="value"} %[2]v
+probe_latency_seconds_count{name="testprobe",label="value"} %[1]d
+`, n, (time.Duration(n) * aFewMillis).Seconds()))
+}
+
 type fakeTicker struct {
 	ch       chan time.Time
 	interval time.Duration
@@ -0,0 +1,72 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package prober
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"tailscale.com/net/stun"
+)
+
+// STUN returns a Probe that healthchecks a STUN server.
+//
+// The ProbeFunc sends a STUN binding request to addr, a host:port, and
+// verifies that it gets back a binding response for the same
+// transaction with a mapped address in it.
+func STUN(addr string) ProbeFunc {
+	return func(ctx context.Context) error {
+		return probeSTUN(ctx, addr)
+	}
+}
+
+func probeSTUN(ctx context.Context, addr string) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", addr)
+	if err != nil {
+		return fmt.Errorf("dialing %q: %w", addr, err)
+	}
+	defer conn.Close()
+
+	tx := stun.NewTxID()
+	req := stun.Request(tx)
+	buf := make([]byte, 1500)
+	for {
+		if _, err := conn.Write(req); err != nil {
+			return fmt.Errorf("sending STUN request to %q: %w", addr, err)
+		}
+		// UDP is lossy, so resend the request every second until
+		// the context expires.
+		rd := time.Now().Add(time.Second)
+		if deadline, ok := ctx.Deadline(); ok && deadline.Before(rd) {
+			rd = deadline
+		}
+		conn.SetReadDeadline(rd)
+		n, err := conn.Read(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return fmt.Errorf("no STUN response from %q: %w", addr, ctx.Err())
+			}
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			return fmt.Errorf("reading STUN response from %q: %w", addr, err)
+		}
+		txBack, ip, port, err := stun.ParseResponse(buf[:n])
+		if err != nil {
+			return fmt.Errorf("parsing STUN response from %q: %w", addr, err)
+		}
+		if txBack != tx {
+			// A late response to a previous request; keep waiting.
+			continue
+		}
+		if len(ip) == 0 || port == 0 {
+			return fmt.Errorf("STUN response from %q has no mapped address", addr)
+		}
+		return nil
+	}
+}
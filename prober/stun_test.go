@@ -0,0 +1,37 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package prober
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"tailscale.com/net/stun/stuntest"
+)
+
+func TestSTUN(t *testing.T) {
+	addr, cleanup := stuntest.Serve(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := STUN(addr.String())(ctx); err != nil {
+		t.Errorf("STUN probe of working server: %v", err)
+	}
+
+	// A UDP port nobody answers on.
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := STUN(pc.LocalAddr().String())(ctx); err == nil {
+		t.Errorf("STUN probe of silent server succeeded")
+	}
+}
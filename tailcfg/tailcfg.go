@@ -68,7 +68,8 @@
 //    31: 2022-04-15: PingRequest & PingResponse TSMP & disco support
 //    32: 2022-04-17: client knows FilterRule.CapMatch
 //    33: 2022-07-20: added MapResponse.PeersChangedPatch (DERPRegion + Endpoints)
-const CurrentCapabilityVersion CapabilityVersion = 33
+//    34: 2022-08-02: client understands PeerChange.{Key,DiscoKey,KeyExpiry,Online,LastSeen,Capabilities}
+const CurrentCapabilityVersion CapabilityVersion = 34
 
 type StableID string
 
@@ -469,6 +470,7 @@ type Hostinfo struct {
 	RoutableIPs   []netaddr.IPPrefix `json:",omitempty"` // set of IP ranges this client can route
 	RequestTags   []string           `json:",omitempty"` // set of ACL tags this node wants to claim
 	Services      []Service          `json:",omitempty"` // services advertised by this machine
+	AppConnector  []string           `json:",omitempty"` // domains this node is an app connector for (see ipn.Prefs.AdvertiseConnectorDomains)
 	NetInfo       *NetInfo           `json:",omitempty"`
 	SSH_HostKeys  []string           `json:"sshHostKeys,omitempty"` // if advertised
 	Cloud         string             `json:",omitempty"`
@@ -1495,6 +1497,12 @@ type Oauth2Token struct {
 	CapabilitySSH         = "https://tailscale.com/cap/ssh"         // feature enabled/available
 	CapabilitySSHRuleIn   = "https://tailscale.com/cap/ssh-rule-in" // some SSH rule reach this node
 
+	// CapabilityAppConnector, followed by "?domain=" and a domain,
+	// allows a node to be an app connector for that domain and its
+	// subdomains. Peers only use the domains in a node's
+	// Hostinfo.AppConnector that it has this capability for.
+	CapabilityAppConnector = "https://tailscale.com/cap/app-connector"
+
 	// Inter-node capabilities.
 
 	// CapabilityFileSharingSend grants the ability to receive files from a
@@ -1505,6 +1513,9 @@ type Oauth2Token struct {
 	CapabilityDebugPeer = "https://tailscale.com/cap/debug-peer"
 	// CapabilityWakeOnLAN grants the ability to send a Wake-On-LAN packet.
 	CapabilityWakeOnLAN = "https://tailscale.com/cap/wake-on-lan"
+	// CapabilitySpeedtest grants the ability to run a speedtest against
+	// a node that's owned by a different user.
+	CapabilitySpeedtest = "https://tailscale.com/cap/speedtest"
 )
 
 // SetDNSRequest is a request to add a DNS record.
@@ -1750,6 +1761,26 @@ type PeerChange struct {
 	// Endpoints, if non-empty, means that NodeID's UDP Endpoints
 	// have changed to these.
 	Endpoints []string `json:",omitempty"`
+
+	// Key, if non-nil, means that the NodeID's wireguard public key changed.
+	Key *key.NodePublic `json:",omitempty"`
+
+	// DiscoKey, if non-nil, means that the NodeID's discokey changed.
+	DiscoKey *key.DiscoPublic `json:",omitempty"`
+
+	// KeyExpiry, if non-nil, changes the NodeID's key expiry.
+	KeyExpiry *time.Time `json:",omitempty"`
+
+	// Online, if non-nil, means that the NodeID's online status changed.
+	Online *bool `json:",omitempty"`
+
+	// LastSeen, if non-nil, changes the NodeID's LastSeen time.
+	LastSeen *time.Time `json:",omitempty"`
+
+	// Capabilities, if non-nil, means that the NodeID's capabilities changed.
+	// It's a pointer to a slice for "omitempty", to allow differentiating
+	// a change to empty from no change.
+	Capabilities *[]string `json:",omitempty"`
 }
 
 // DerpMagicIP is a fake WireGuard endpoint IP address that means to
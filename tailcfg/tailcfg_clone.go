@@ -105,6 +105,7 @@ func (src *Hostinfo) Clone() *Hostinfo {
 	dst.RoutableIPs = append(src.RoutableIPs[:0:0], src.RoutableIPs...)
 	dst.RequestTags = append(src.RequestTags[:0:0], src.RequestTags...)
 	dst.Services = append(src.Services[:0:0], src.Services...)
+	dst.AppConnector = append(src.AppConnector[:0:0], src.AppConnector...)
 	dst.NetInfo = src.NetInfo.Clone()
 	dst.SSH_HostKeys = append(src.SSH_HostKeys[:0:0], src.SSH_HostKeys...)
 	return dst
@@ -127,6 +128,7 @@ func (src *Hostinfo) Clone() *Hostinfo {
 	RoutableIPs   []netaddr.IPPrefix
 	RequestTags   []string
 	Services      []Service
+	AppConnector  []string
 	NetInfo       *NetInfo
 	SSH_HostKeys  []string
 	Cloud         string
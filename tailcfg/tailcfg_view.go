@@ -263,6 +263,7 @@ func (v HostinfoView) RoutableIPs() views.IPPrefixSlice {
 }
 func (v HostinfoView) RequestTags() views.Slice[string]  { return views.SliceOf(v.ж.RequestTags) }
 func (v HostinfoView) Services() views.Slice[Service]    { return views.SliceOf(v.ж.Services) }
+func (v HostinfoView) AppConnector() views.Slice[string] { return views.SliceOf(v.ж.AppConnector) }
 func (v HostinfoView) NetInfo() NetInfoView              { return v.ж.NetInfo.View() }
 func (v HostinfoView) SSH_HostKeys() views.Slice[string] { return views.SliceOf(v.ж.SSH_HostKeys) }
 func (v HostinfoView) Cloud() string                     { return v.ж.Cloud }
@@ -285,6 +286,7 @@ func (v HostinfoView) Equal(v2 HostinfoView) bool        { return v.ж.Equal(v2.
 	RoutableIPs   []netaddr.IPPrefix
 	RequestTags   []string
 	Services      []Service
+	AppConnector  []string
 	NetInfo       *NetInfo
 	SSH_HostKeys  []string
 	Cloud         string
@@ -36,6 +36,7 @@
 	"tailscale.com/net/nettest"
 	"tailscale.com/net/tsdial"
 	"tailscale.com/smallzstd"
+	"tailscale.com/tailcfg"
 	"tailscale.com/types/logger"
 	"tailscale.com/wgengine"
 	"tailscale.com/wgengine/monitor"
@@ -276,9 +277,16 @@ func (s *Server) start() error {
 		_, ok := eng.PeerForIP(ip)
 		return ok
 	}
+	s.dialer.NetstackPeerForIP = func(ip netaddr.IP) (*tailcfg.Node, netaddr.IPPrefix, bool) {
+		pip, ok := eng.PeerForIP(ip)
+		return pip.Node, pip.Route, ok
+	}
 	s.dialer.NetstackDialTCP = func(ctx context.Context, dst netaddr.IPPort) (net.Conn, error) {
 		return ns.DialContextTCP(ctx, dst)
 	}
+	s.dialer.NetstackDialUDP = func(ctx context.Context, dst netaddr.IPPort) (net.Conn, error) {
+		return ns.DialContextUDP(ctx, dst)
+	}
 
 	if s.Store == nil {
 		stateFile := filepath.Join(s.rootPath, "tailscaled.state")
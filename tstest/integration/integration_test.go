@@ -21,6 +21,7 @@
 	"os"
 	"os/exec"
 	"path/filepath"
+	"reflect"
 	"regexp"
 	"runtime"
 	"strings"
@@ -34,6 +35,7 @@
 	"tailscale.com/ipn"
 	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/ipn/store"
+	"tailscale.com/policyfile"
 	"tailscale.com/safesocket"
 	"tailscale.com/tailcfg"
 	"tailscale.com/tstest"
@@ -249,6 +251,110 @@ func TestOneNodeUpAuth(t *testing.T) {
 	d1.MustCleanShutdown(t)
 }
 
+func TestOneNodeUpAuthKey(t *testing.T) {
+	t.Parallel()
+	env := newTestEnv(t, configureControl(func(control *testcontrol.Server) {
+		control.RequireAuth = true
+	}))
+	ak := env.Control.NewAuthKey(false, time.Time{}, []string{"tag:server"})
+
+	n1 := newTestNode(t, env)
+	d1 := n1.StartDaemon()
+	n1.AwaitListening()
+	n1.MustUp("--authkey=" + ak.Key)
+	n1.AwaitRunning()
+	if nodes := env.Control.AllNodes(); len(nodes) != 1 || !reflect.DeepEqual(nodes[0].Tags, []string{"tag:server"}) {
+		t.Errorf("nodes = %v; want one node tagged tag:server", nodes)
+	}
+
+	// The key can only be used once.
+	n2 := newTestNode(t, env)
+	d2 := n2.StartDaemon()
+	n2.AwaitListening()
+	cmd := n2.Tailscale("up", "--login-server="+env.ControlServer.URL, "--authkey="+ak.Key)
+	cmd.Stdout = nil // in case --verbose-tailscale was set
+	cmd.Stderr = nil // in case --verbose-tailscale was set
+	if out, err := cmd.CombinedOutput(); err == nil {
+		t.Errorf("up with used auth key succeeded: %s", out)
+	} else if !strings.Contains(string(out), "already used") {
+		t.Errorf("up with used auth key: %v, %s", err, out)
+	}
+
+	d1.MustCleanShutdown(t)
+	d2.MustCleanShutdown(t)
+}
+
+func TestSubnetRouterFailover(t *testing.T) {
+	t.Parallel()
+	env := newTestEnv(t)
+	route := netaddr.MustParseIPPrefix("10.99.0.0/24")
+
+	// Bring the routers up one at a time so the first gets the lower
+	// node ID, making it control's primary for the route.
+	var routers []*testNode
+	var daemons []*Daemon
+	for i := 0; i < 2; i++ {
+		n := newTestNode(t, env)
+		d := n.StartDaemon()
+		n.AwaitListening()
+		n.MustUp("--advertise-routes=" + route.String())
+		n.AwaitRunning()
+		node := env.Control.Node(n.MustStatus().Self.PublicKey)
+		if node == nil {
+			t.Fatalf("router %d not registered", i)
+		}
+		env.Control.SetApprovedRoutes(node.ID, []netaddr.IPPrefix{route})
+		routers = append(routers, n)
+		daemons = append(daemons, d)
+	}
+	primaryKey := routers[0].MustStatus().Self.PublicKey
+	secondKey := routers[1].MustStatus().Self.PublicKey
+
+	client := newTestNode(t, env)
+	client.daemonEnv = []string{"TS_DEBUG_SUBNET_HA_INTERVAL=1s"}
+	dc := client.StartDaemon()
+	client.AwaitListening()
+	client.MustUp("--accept-routes")
+	client.AwaitRunning()
+
+	awaitPeers := func(what string, ok func(primary, second *ipnstate.PeerStatus) bool) {
+		t.Helper()
+		if err := tstest.WaitFor(30*time.Second, func() error {
+			st := client.MustStatus()
+			primary, second := st.Peer[primaryKey], st.Peer[secondKey]
+			if primary == nil || second == nil {
+				return errors.New("routers not in netmap yet")
+			}
+			if !ok(primary, second) {
+				return fmt.Errorf("primary=%+v, second=%+v", primary, second)
+			}
+			return nil
+		}); err != nil {
+			t.Fatalf("%s: %v", what, err)
+		}
+	}
+	isRoute := func(rs []netaddr.IPPrefix) bool {
+		return len(rs) == 1 && rs[0] == route
+	}
+
+	awaitPeers("second router on standby", func(primary, second *ipnstate.PeerStatus) bool {
+		return isRoute(second.StandbyRoutes) && len(primary.StandbyRoutes) == 0 && !primary.SubnetRouterUnhealthy
+	})
+
+	// Control still says the first router is primary after it goes
+	// away; the client has to notice and fail over by itself.
+	if err := daemons[0].Process.Kill(); err != nil {
+		t.Fatal(err)
+	}
+	daemons[0].Process.Wait()
+	awaitPeers("failover to second router", func(primary, second *ipnstate.PeerStatus) bool {
+		return isRoute(second.FailoverRoutes) && isRoute(primary.StandbyRoutes) && primary.SubnetRouterUnhealthy
+	})
+
+	daemons[1].MustCleanShutdown(t)
+	dc.MustCleanShutdown(t)
+}
+
 func TestTwoNodes(t *testing.T) {
 	t.Parallel()
 	env := newTestEnv(t)
@@ -373,6 +479,52 @@ func TestAddPingRequest(t *testing.T) {
 	t.Error("all ping attempts failed")
 }
 
+// TestPolicyDropsTraffic tests that a testcontrol policy is enforced
+// on nodes: traffic it allows gets through and the rest is dropped.
+func TestPolicyDropsTraffic(t *testing.T) {
+	t.Parallel()
+	env := newTestEnv(t)
+
+	n1 := newTestNode(t, env)
+	d1 := n1.StartDaemon()
+	n2 := newTestNode(t, env)
+	d2 := n2.StartDaemon()
+
+	n1.AwaitListening()
+	n2.AwaitListening()
+	n1.MustUp()
+	n2.MustUp()
+	n1.AwaitRunning()
+	n2.AwaitRunning()
+	ip1, ip2 := n1.AwaitIP(), n2.AwaitIP()
+
+	// Only allow n1 to reach n2, and not the other way around.
+	p, err := policyfile.Parse([]byte(fmt.Sprintf(`{
+		"hosts": {"n1": %q, "n2": %q},
+		// n2 may not connect to n1.
+		"acls": [{"action": "accept", "src": ["n1"], "dst": ["n2:*"]}],
+	}`, ip1, ip2)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.Control.SetPolicy(p)
+
+	icmpPing := func(from, to *testNode) error {
+		return from.Tailscale("ping", "--icmp", "-c=1", "--timeout=2s", to.AwaitIP().String()).Run()
+	}
+	if err := tstest.WaitFor(20*time.Second, func() error {
+		return icmpPing(n1, n2)
+	}); err != nil {
+		t.Fatalf("n1 -> n2 not allowed: %v", err)
+	}
+	if err := icmpPing(n2, n1); err == nil {
+		t.Errorf("n2 -> n1 allowed; want dropped")
+	}
+
+	d1.MustCleanShutdown(t)
+	d2.MustCleanShutdown(t)
+}
+
 // Issue 2434: when "down" (WantRunning false), tailscaled shouldn't
 // be connected to control.
 func TestNoControlConnWhenDown(t *testing.T) {
@@ -559,7 +711,8 @@ type testNode struct {
 	dir        string // temp dir for sock & state
 	sockFile   string
 	stateFile  string
-	upFlagGOOS string // if non-empty, sets TS_DEBUG_UP_FLAG_GOOS for cmd/tailscale CLI
+	upFlagGOOS string   // if non-empty, sets TS_DEBUG_UP_FLAG_GOOS for cmd/tailscale CLI
+	daemonEnv  []string // extra environment variables for tailscaled
 
 	mu        sync.Mutex
 	onLogLine []func([]byte)
@@ -742,6 +895,7 @@ func (n *testNode) StartDaemonAsIPNGOOS(ipnGOOS string) *Daemon {
 		"TS_DEBUG_TAILSCALED_IPN_GOOS="+ipnGOOS,
 		"TS_LOGS_DIR="+t.TempDir(),
 	)
+	cmd.Env = append(cmd.Env, n.daemonEnv...)
 	cmd.Stderr = &nodeOutputParser{n: n}
 	if *verboseTailscaled {
 		cmd.Stdout = os.Stdout
@@ -0,0 +1,98 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package testcontrol
+
+import (
+	crand "crypto/rand"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"tailscale.com/util/mak"
+)
+
+// AuthKey is a pre-authentication key, which lets nodes register
+// (with "tailscale up --authkey=...") without an interactive login.
+type AuthKey struct {
+	Key      string
+	Created  time.Time
+	Expires  time.Time `json:",omitempty"` // zero means never
+	Reusable bool      `json:",omitempty"` // else it can only be used once
+	Used     bool      `json:",omitempty"`
+
+	// Tags are the tags given to nodes registered with the key.
+	// They don't need to be permitted by the policy's tagOwners.
+	Tags []string `json:",omitempty"`
+}
+
+// NewAuthKey issues a new auth key. A zero expires means the key
+// never expires.
+func (s *Server) NewAuthKey(reusable bool, expires time.Time, tags []string) *AuthKey {
+	var b [12]byte
+	crand.Read(b[:])
+	k := &AuthKey{
+		Key:      fmt.Sprintf("tskey-%x", b),
+		Created:  time.Now().UTC(),
+		Expires:  expires,
+		Reusable: reusable,
+		Tags:     append([]string(nil), tags...),
+	}
+	s.mu.Lock()
+	mak.Set(&s.authKeys, k.Key, k)
+	s.mu.Unlock()
+	s.stateChanged()
+	return k.clone()
+}
+
+// AuthKeys returns all auth keys, including used and expired ones,
+// in order of creation.
+func (s *Server) AuthKeys() []*AuthKey {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ret := make([]*AuthKey, 0, len(s.authKeys))
+	for _, k := range s.authKeys {
+		ret = append(ret, k.clone())
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Created.Before(ret[j].Created) })
+	return ret
+}
+
+// DeleteAuthKey revokes the auth key k, and reports whether it existed.
+// Nodes already registered with it are unaffected.
+func (s *Server) DeleteAuthKey(k string) bool {
+	s.mu.Lock()
+	_, ok := s.authKeys[k]
+	delete(s.authKeys, k)
+	s.mu.Unlock()
+	if ok {
+		s.stateChanged()
+	}
+	return ok
+}
+
+// useAuthKeyLocked validates the auth key k for a node registration,
+// marking it as used.
+//
+// s.mu must be held.
+func (s *Server) useAuthKeyLocked(k string) (*AuthKey, error) {
+	ak := s.authKeys[k]
+	switch {
+	case ak == nil:
+		return nil, errors.New("invalid auth key")
+	case !ak.Expires.IsZero() && ak.Expires.Before(time.Now()):
+		return nil, errors.New("auth key expired")
+	case ak.Used && !ak.Reusable:
+		return nil, errors.New("auth key already used")
+	}
+	ak.Used = true
+	return ak, nil
+}
+
+func (k *AuthKey) clone() *AuthKey {
+	k2 := *k
+	k2.Tags = append([]string(nil), k.Tags...)
+	return &k2
+}
@@ -0,0 +1,243 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package testcontrol
+
+import (
+	"sort"
+	"strings"
+
+	"inet.af/netaddr"
+	"tailscale.com/policyfile"
+	"tailscale.com/tailcfg"
+)
+
+// policyNode is a node as seen by the policy compiler.
+type policyNode struct {
+	node      *tailcfg.Node
+	loginName string // of the node's user; empty for tagged nodes
+}
+
+// policyView is a Policy bound to the current set of nodes.
+type policyView struct {
+	p     *policyfile.Policy
+	nodes []policyNode
+}
+
+// userInSelector reports whether the user loginName is matched by
+// the user or group selector sel.
+func (v *policyView) userInSelector(sel, loginName string) bool {
+	if loginName == "" {
+		return false
+	}
+	if sel == "*" || sel == loginName {
+		return true
+	}
+	if strings.HasPrefix(sel, "group:") {
+		for _, m := range v.p.Groups[sel] {
+			if m == loginName {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// nodeMatches reports whether sel selects the node pn.
+func (v *policyView) nodeMatches(sel string, pn policyNode) bool {
+	if strings.HasPrefix(sel, "tag:") {
+		for _, t := range pn.node.Tags {
+			if t == sel {
+				return true
+			}
+		}
+		return false
+	}
+	if sel == "*" {
+		return true
+	}
+	return v.userInSelector(sel, pn.loginName)
+}
+
+// resolve returns the IP prefixes selected by sel.
+func (v *policyView) resolve(sel string) []netaddr.IPPrefix {
+	if h, ok := v.p.Hosts[sel]; ok {
+		sel = h
+	}
+	if pfx, err := policyfile.ParseIPOrPrefix(sel); err == nil {
+		return []netaddr.IPPrefix{pfx}
+	}
+	var ret []netaddr.IPPrefix
+	for _, pn := range v.nodes {
+		if v.nodeMatches(sel, pn) {
+			ret = append(ret, pn.node.Addresses...)
+		}
+	}
+	return ret
+}
+
+// filterForNode returns the packet filter for the node dst.
+func (v *policyView) filterForNode(dst *tailcfg.Node) []tailcfg.FilterRule {
+	var rules []tailcfg.FilterRule
+	for _, a := range v.p.ACLs {
+		var dstPorts []tailcfg.NetPortRange
+		for _, d := range a.Dst {
+			sel, ports, _ := policyfile.SplitDst(d)
+			if sel == "*" {
+				for _, pr := range ports {
+					dstPorts = append(dstPorts, tailcfg.NetPortRange{IP: "*", Ports: pr})
+				}
+				continue
+			}
+			for _, pfx := range v.resolve(sel) {
+				if !prefixOverlapsAny(pfx, dst.AllowedIPs) {
+					continue
+				}
+				for _, pr := range ports {
+					dstPorts = append(dstPorts, tailcfg.NetPortRange{IP: pfx.String(), Ports: pr})
+				}
+			}
+		}
+		if len(dstPorts) == 0 {
+			continue
+		}
+		var srcIPs []string
+		for _, s := range a.Src {
+			if s == "*" {
+				srcIPs = []string{"*"}
+				break
+			}
+			for _, pfx := range v.resolve(s) {
+				srcIPs = append(srcIPs, pfx.String())
+			}
+		}
+		if len(srcIPs) == 0 {
+			continue
+		}
+		proto, _ := policyfile.ParseProto(a.Proto)
+		rules = append(rules, tailcfg.FilterRule{
+			SrcIPs:   srcIPs,
+			DstPorts: dstPorts,
+			IPProto:  proto,
+		})
+	}
+	if len(rules) == 0 {
+		// An empty MapResponse.PacketFilter means "unchanged", so
+		// deny everything with a rule that matches no sources.
+		rules = append(rules, tailcfg.FilterRule{SrcIPs: []string{}})
+	}
+	return rules
+}
+
+// sshPolicyForNode returns the SSH policy for the node dst, or nil
+// if no SSH rule applies to it.
+func (v *policyView) sshPolicyForNode(dst policyNode) *tailcfg.SSHPolicy {
+	var rules []*tailcfg.SSHRule
+	for _, r := range v.p.SSH {
+		if r.Action != "accept" {
+			// testcontrol can't ask users to reauthenticate, so
+			// "check" rules grant no access.
+			continue
+		}
+		matchesDst := false
+		for _, d := range r.Dst {
+			if v.nodeMatches(d, dst) {
+				matchesDst = true
+				break
+			}
+		}
+		if !matchesDst {
+			continue
+		}
+		principals := v.sshPrincipals(r.Src)
+		if len(principals) == 0 {
+			continue
+		}
+		rules = append(rules, &tailcfg.SSHRule{
+			Principals: principals,
+			SSHUsers:   sshUsers(r.Users),
+			Action: &tailcfg.SSHAction{
+				Accept:                   true,
+				AllowAgentForwarding:     true,
+				AllowLocalPortForwarding: true,
+			},
+		})
+	}
+	if len(rules) == 0 {
+		return nil
+	}
+	return &tailcfg.SSHPolicy{Rules: rules}
+}
+
+func (v *policyView) sshPrincipals(srcs []string) []*tailcfg.SSHPrincipal {
+	var ret []*tailcfg.SSHPrincipal
+	logins := map[string]bool{}
+	for _, s := range srcs {
+		switch {
+		case s == "*":
+			return []*tailcfg.SSHPrincipal{{Any: true}}
+		case strings.HasPrefix(s, "tag:"):
+			for _, pn := range v.nodes {
+				if v.nodeMatches(s, pn) {
+					ret = append(ret, &tailcfg.SSHPrincipal{Node: pn.node.StableID})
+				}
+			}
+		case strings.HasPrefix(s, "group:"):
+			for _, m := range v.p.Groups[s] {
+				logins[m] = true
+			}
+		default:
+			logins[s] = true
+		}
+	}
+	sorted := make([]string, 0, len(logins))
+	for l := range logins {
+		sorted = append(sorted, l)
+	}
+	sort.Strings(sorted)
+	for _, l := range sorted {
+		ret = append(ret, &tailcfg.SSHPrincipal{UserLogin: l})
+	}
+	return ret
+}
+
+func sshUsers(users []string) map[string]string {
+	m := map[string]string{}
+	for _, u := range users {
+		if u == "autogroup:nonroot" {
+			m["*"] = "="
+			if _, ok := m["root"]; !ok {
+				m["root"] = ""
+			}
+			continue
+		}
+		m[u] = u
+	}
+	return m
+}
+
+// tagsAllowed returns the subset of requested tags that the user
+// loginName may apply to its node under the policy p.
+func tagsAllowed(p *policyfile.Policy, requested []string, loginName string) []string {
+	v := &policyView{p: p}
+	var ret []string
+	for _, tag := range requested {
+		for _, owner := range p.TagOwners[tag] {
+			if v.userInSelector(owner, loginName) {
+				ret = append(ret, tag)
+				break
+			}
+		}
+	}
+	return ret
+}
+
+func prefixOverlapsAny(p netaddr.IPPrefix, ps []netaddr.IPPrefix) bool {
+	for _, q := range ps {
+		if p.Overlaps(q) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,172 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package testcontrol
+
+import (
+	"reflect"
+	"testing"
+
+	"inet.af/netaddr"
+	"tailscale.com/policyfile"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/logger"
+	"tailscale.com/wgengine/filter"
+)
+
+const testPolicy = `{
+	// Comments and trailing commas are fine.
+	"groups": {
+		"group:eng": ["alice@example.com"],
+	},
+	"tagOwners": {
+		"tag:server": ["group:eng"],
+	},
+	"hosts": {
+		"lan": "192.168.1.0/24",
+	},
+	"acls": [
+		{"action": "accept", "src": ["group:eng"], "dst": ["tag:server:22,80-81"]},
+		{"action": "accept", "proto": "udp", "src": ["bob@example.com"], "dst": ["tag:server:53"]},
+		{"action": "accept", "src": ["tag:server"], "dst": ["lan:*"]},
+	],
+	"ssh": [
+		{"action": "accept", "src": ["group:eng"], "dst": ["tag:server"], "users": ["autogroup:nonroot"]},
+	],
+}`
+
+func testNodes() (alice, bob, server policyNode) {
+	mk := func(id tailcfg.NodeID, ip string, tags ...string) *tailcfg.Node {
+		pfx := netaddr.MustParseIPPrefix(ip + "/32")
+		return &tailcfg.Node{
+			ID:         id,
+			StableID:   tailcfg.StableNodeID("node" + ip),
+			Addresses:  []netaddr.IPPrefix{pfx},
+			AllowedIPs: []netaddr.IPPrefix{pfx},
+			Tags:       tags,
+		}
+	}
+	alice = policyNode{node: mk(1, "100.64.0.1"), loginName: "alice@example.com"}
+	bob = policyNode{node: mk(2, "100.64.0.2"), loginName: "bob@example.com"}
+	server = policyNode{node: mk(3, "100.64.0.3", "tag:server")}
+	server.node.AllowedIPs = append(server.node.AllowedIPs, netaddr.MustParseIPPrefix("192.168.1.0/24"))
+	return
+}
+
+func TestPolicyFilter(t *testing.T) {
+	p, err := policyfile.Parse([]byte(testPolicy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, bob, server := testNodes()
+	v := &policyView{p: p, nodes: []policyNode{alice, bob, server}}
+
+	newFilter := func(n policyNode) *filter.Filter {
+		t.Helper()
+		matches, err := filter.MatchesFromFilterRules(v.filterForNode(n.node))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var localNets netaddr.IPSetBuilder
+		for _, pfx := range n.node.AllowedIPs {
+			localNets.AddPrefix(pfx)
+		}
+		ls, _ := localNets.IPSet()
+		return filter.New(matches, ls, &netaddr.IPSet{}, nil, logger.Discard)
+	}
+	ip := func(n policyNode) netaddr.IP { return n.node.Addresses[0].IP() }
+
+	serverFilter := newFilter(server)
+	tests := []struct {
+		name     string
+		f        *filter.Filter
+		src, dst netaddr.IP
+		port     uint16
+		want     filter.Response
+	}{
+		{"alice_to_server_ssh", serverFilter, ip(alice), ip(server), 22, filter.Accept},
+		{"alice_to_server_http", serverFilter, ip(alice), ip(server), 81, filter.Accept},
+		{"alice_to_server_other", serverFilter, ip(alice), ip(server), 443, filter.Drop},
+		{"bob_to_server_tcp", serverFilter, ip(bob), ip(server), 22, filter.Drop},
+		{"server_to_lan", serverFilter, ip(server), netaddr.MustParseIP("192.168.1.5"), 9000, filter.Accept},
+		{"alice_to_lan", serverFilter, ip(alice), netaddr.MustParseIP("192.168.1.5"), 9000, filter.Drop},
+		{"server_to_alice", newFilter(alice), ip(server), ip(alice), 22, filter.Drop},
+		{"alice_to_bob", newFilter(bob), ip(alice), ip(bob), 22, filter.Drop},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.f.CheckTCP(tt.src, tt.dst, tt.port); got != tt.want {
+				t.Errorf("CheckTCP(%v, %v, %d) = %v; want %v", tt.src, tt.dst, tt.port, got, tt.want)
+			}
+		})
+	}
+
+	// Only the UDP rule lets bob in, and only on port 53.
+	var sawUDP bool
+	for _, r := range v.filterForNode(server.node) {
+		if reflect.DeepEqual(r.IPProto, []int{17}) {
+			sawUDP = true
+			if want := []string{"100.64.0.2/32"}; !reflect.DeepEqual(r.SrcIPs, want) {
+				t.Errorf("udp rule SrcIPs = %q; want %q", r.SrcIPs, want)
+			}
+		}
+	}
+	if !sawUDP {
+		t.Errorf("no udp rule for server")
+	}
+
+	// Nodes with no allowed inbound traffic get a non-empty
+	// filter that matches nothing, since empty means unchanged.
+	if got := v.filterForNode(bob.node); len(got) != 1 || len(got[0].SrcIPs) != 0 {
+		t.Errorf("bob's filter = %+v; want a single match-nothing rule", got)
+	}
+}
+
+func TestPolicySSH(t *testing.T) {
+	p, err := policyfile.Parse([]byte(testPolicy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, bob, server := testNodes()
+	v := &policyView{p: p, nodes: []policyNode{alice, bob, server}}
+
+	if got := v.sshPolicyForNode(alice); got != nil {
+		t.Errorf("alice's SSH policy = %+v; want nil", got)
+	}
+	got := v.sshPolicyForNode(server)
+	if got == nil || len(got.Rules) != 1 {
+		t.Fatalf("server's SSH policy = %+v; want one rule", got)
+	}
+	r := got.Rules[0]
+	if want := []*tailcfg.SSHPrincipal{{UserLogin: "alice@example.com"}}; !reflect.DeepEqual(r.Principals, want) {
+		t.Errorf("Principals = %+v; want %+v", r.Principals, want)
+	}
+	if want := map[string]string{"*": "=", "root": ""}; !reflect.DeepEqual(r.SSHUsers, want) {
+		t.Errorf("SSHUsers = %v; want %v", r.SSHUsers, want)
+	}
+	if r.Action == nil || !r.Action.Accept {
+		t.Errorf("Action = %+v; want accept", r.Action)
+	}
+
+	// "check" rules grant nothing, as users can't be asked to
+	// reauthenticate.
+	p.SSH[0].Action = "check"
+	if got := v.sshPolicyForNode(server); got != nil {
+		t.Errorf("server's SSH policy with a check rule = %+v; want nil", got)
+	}
+}
+
+func TestPolicyTagsAllowed(t *testing.T) {
+	p, err := policyfile.Parse([]byte(testPolicy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := []string{"tag:server", "tag:other"}
+	if got, want := tagsAllowed(p, req, "alice@example.com"), []string{"tag:server"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("alice's tags = %q; want %q", got, want)
+	}
+	if got := tagsAllowed(p, req, "bob@example.com"); len(got) != 0 {
+		t.Errorf("bob's tags = %q; want none", got)
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package testcontrol
+
+import (
+	"inet.af/netaddr"
+	"tailscale.com/tailcfg"
+	"tailscale.com/util/mak"
+)
+
+// SetApprovedRoutes sets the subnet routes that the node with the
+// given ID may serve, and reports whether there was such a node.
+//
+// Only approved routes that the node also advertises (with
+// "tailscale up --advertise-routes") are added to its AllowedIPs.
+func (s *Server) SetApprovedRoutes(id tailcfg.NodeID, routes []netaddr.IPPrefix) bool {
+	s.mu.Lock()
+	n := s.nodeByIDLocked(id)
+	if n == nil {
+		s.mu.Unlock()
+		return false
+	}
+	if len(routes) == 0 {
+		delete(s.approvedRoutes, id)
+	} else {
+		mak.Set(&s.approvedRoutes, id, append([]netaddr.IPPrefix(nil), routes...))
+	}
+	s.refreshRoutesLocked()
+	s.updateLocked("SetApprovedRoutes", s.nodeIDsLocked())
+	s.mu.Unlock()
+	s.stateChanged()
+	return true
+}
+
+// ApprovedRoutes returns the routes approved for the node with the
+// given ID.
+func (s *Server) ApprovedRoutes(id tailcfg.NodeID) []netaddr.IPPrefix {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]netaddr.IPPrefix(nil), s.approvedRoutes[id]...)
+}
+
+// refreshRoutesLocked sets the AllowedIPs and PrimaryRoutes of all
+// nodes from their addresses and the routes they both advertise and
+// are approved for.
+//
+// When more than one node serves a route, they all get it in their
+// AllowedIPs, so that clients know the standby routers control
+// approved, and the one picked as its primary router, here the one
+// with the lowest node ID, also gets it in its PrimaryRoutes.
+//
+// s.mu must be held.
+func (s *Server) refreshRoutesLocked() {
+	primary := map[netaddr.IPPrefix]tailcfg.NodeID{}
+	for _, n := range s.nodes {
+		for _, r := range s.servedRoutesLocked(n) {
+			if id, ok := primary[r]; !ok || n.ID < id {
+				primary[r] = n.ID
+			}
+		}
+	}
+	for _, n := range s.nodes {
+		n.AllowedIPs = append([]netaddr.IPPrefix(nil), n.Addresses...)
+		n.PrimaryRoutes = nil
+		for _, r := range s.servedRoutesLocked(n) {
+			n.AllowedIPs = append(n.AllowedIPs, r)
+			if primary[r] == n.ID {
+				n.PrimaryRoutes = append(n.PrimaryRoutes, r)
+			}
+		}
+	}
+}
+
+// servedRoutesLocked returns the routes that n both advertises and is
+// approved for.
+//
+// s.mu must be held.
+func (s *Server) servedRoutesLocked(n *tailcfg.Node) []netaddr.IPPrefix {
+	approved := s.approvedRoutes[n.ID]
+	if len(approved) == 0 || !n.Hostinfo.Valid() {
+		return nil
+	}
+	var ret []netaddr.IPPrefix
+	advertised := n.Hostinfo.RoutableIPs()
+	for i := 0; i < advertised.Len(); i++ {
+		if r := advertised.At(i); slicesContain(approved, r) {
+			ret = append(ret, r)
+		}
+	}
+	return ret
+}
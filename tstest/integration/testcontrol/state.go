@@ -0,0 +1,131 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package testcontrol
+
+import (
+	"errors"
+	"sort"
+
+	"inet.af/netaddr"
+	"tailscale.com/policyfile"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+)
+
+// State is the state of a Server that needs to survive a restart for
+// its nodes to stay connected: its keys, nodes, users, auth keys,
+// approved routes and policy. It can be encoded as JSON.
+type State struct {
+	PrivateKey      key.ControlPrivate
+	NoisePrivateKey key.ControlPrivate
+
+	Nodes []*tailcfg.Node
+
+	// Users and Logins are keyed by node key. They include entries
+	// for node keys that no longer exist.
+	Users  map[key.NodePublic]*tailcfg.User
+	Logins map[key.NodePublic]*tailcfg.Login
+
+	AuthKeys       []*AuthKey                            `json:",omitempty"`
+	KeyTags        map[tailcfg.NodeID][]string           `json:",omitempty"`
+	ApprovedRoutes map[tailcfg.NodeID][]netaddr.IPPrefix `json:",omitempty"`
+	Policy         *policyfile.Policy                    `json:",omitempty"`
+}
+
+// State returns a copy of the server's current state.
+func (s *Server) State() *State {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ensureKeyPairLocked()
+	st := &State{
+		PrivateKey:      s.privKey,
+		NoisePrivateKey: s.noisePrivKey,
+		Users:           map[key.NodePublic]*tailcfg.User{},
+		Logins:          map[key.NodePublic]*tailcfg.Login{},
+		KeyTags:         map[tailcfg.NodeID][]string{},
+		ApprovedRoutes:  map[tailcfg.NodeID][]netaddr.IPPrefix{},
+		Policy:          s.policy,
+	}
+	for _, n := range s.nodes {
+		n = n.Clone()
+		// Connection state isn't worth persisting.
+		n.Online = nil
+		st.Nodes = append(st.Nodes, n)
+	}
+	sort.Slice(st.Nodes, func(i, j int) bool { return st.Nodes[i].ID < st.Nodes[j].ID })
+	for nk, u := range s.users {
+		st.Users[nk] = u.Clone()
+	}
+	for nk, l := range s.logins {
+		st.Logins[nk] = l.Clone()
+	}
+	for _, k := range s.authKeys {
+		st.AuthKeys = append(st.AuthKeys, k.clone())
+	}
+	sort.Slice(st.AuthKeys, func(i, j int) bool { return st.AuthKeys[i].Created.Before(st.AuthKeys[j].Created) })
+	for id, tags := range s.keyTags {
+		st.KeyTags[id] = append([]string(nil), tags...)
+	}
+	for id, routes := range s.approvedRoutes {
+		st.ApprovedRoutes[id] = append([]netaddr.IPPrefix(nil), routes...)
+	}
+	return st
+}
+
+// Restore replaces the server's state with st, as previously
+// returned by State. It must be called before s serves any requests.
+// All restored nodes are considered authenticated.
+func (s *Server) Restore(st *State) error {
+	if st.PrivateKey.IsZero() || st.NoisePrivateKey.IsZero() {
+		return errors.New("state has no server keys")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.privKey = st.PrivateKey
+	s.pubKey = st.PrivateKey.Public()
+	s.noisePrivKey = st.NoisePrivateKey
+	s.noisePubKey = st.NoisePrivateKey.Public()
+
+	s.nodes = map[key.NodePublic]*tailcfg.Node{}
+	s.nodeKeyAuthed = map[key.NodePublic]bool{}
+	for _, n := range st.Nodes {
+		s.nodes[n.Key] = n.Clone()
+		s.nodeKeyAuthed[n.Key] = true
+	}
+	s.users = map[key.NodePublic]*tailcfg.User{}
+	for nk, u := range st.Users {
+		s.users[nk] = u.Clone()
+	}
+	s.logins = map[key.NodePublic]*tailcfg.Login{}
+	for nk, l := range st.Logins {
+		s.logins[nk] = l.Clone()
+	}
+	s.authKeys = map[string]*AuthKey{}
+	for _, k := range st.AuthKeys {
+		s.authKeys[k.Key] = k.clone()
+	}
+	s.keyTags = map[tailcfg.NodeID][]string{}
+	for id, tags := range st.KeyTags {
+		s.keyTags[id] = append([]string(nil), tags...)
+	}
+	s.approvedRoutes = map[tailcfg.NodeID][]netaddr.IPPrefix{}
+	for id, routes := range st.ApprovedRoutes {
+		s.approvedRoutes[id] = append([]netaddr.IPPrefix(nil), routes...)
+	}
+	s.policy = st.Policy
+	for _, n := range s.nodes {
+		s.scheduleExpiryLocked(n)
+	}
+	return nil
+}
+
+// stateChanged calls s.OnStateChange, if set.
+//
+// s.mu must not be held.
+func (s *Server) stateChanged() {
+	if f := s.OnStateChange; f != nil {
+		f()
+	}
+}
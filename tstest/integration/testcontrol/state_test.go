@@ -0,0 +1,176 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package testcontrol
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/policyfile"
+	"tailscale.com/tailcfg"
+)
+
+func TestStateRestore(t *testing.T) {
+	s := new(Server)
+	s.AddFakeNode()
+	s.AddFakeNode()
+	nodes := s.AllNodes()
+	ak := s.NewAuthKey(true, time.Time{}, []string{"tag:ci"})
+	p, err := policyfile.Parse([]byte(`{"acls": [{"action": "accept", "src": ["*"], "dst": ["*:22"]}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetPolicy(p)
+	route := netaddr.MustParseIPPrefix("10.0.0.0/24")
+	n := nodes[0]
+	n.Hostinfo = (&tailcfg.Hostinfo{Hostname: "router", RoutableIPs: []netaddr.IPPrefix{route}}).View()
+	s.UpdateNode(n)
+	nodes[1].Hostinfo = (&tailcfg.Hostinfo{Hostname: "other"}).View()
+	s.UpdateNode(nodes[1])
+	if !s.SetApprovedRoutes(n.ID, []netaddr.IPPrefix{route}) {
+		t.Fatal("SetApprovedRoutes failed")
+	}
+
+	js, err := json.Marshal(s.State())
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := new(State)
+	if err := json.Unmarshal(js, st); err != nil {
+		t.Fatal(err)
+	}
+	s2 := new(Server)
+	if err := s2.Restore(st); err != nil {
+		t.Fatal(err)
+	}
+
+	got, want := s2.AllNodes(), s.AllNodes()
+	if len(got) != len(want) {
+		t.Fatalf("restored %d nodes; want %d", len(got), len(want))
+	}
+	for i := range got {
+		if !got[i].Equal(want[i]) {
+			t.Errorf("restored node %d differs:\n got: %+v\nwant: %+v", i, got[i], want[i])
+		}
+	}
+	if got := s2.AuthKeys(); len(got) != 1 || got[0].Key != ak.Key || !reflect.DeepEqual(got[0].Tags, ak.Tags) {
+		t.Errorf("restored auth keys = %+v; want %+v", got, ak)
+	}
+	if got := s2.ApprovedRoutes(n.ID); !reflect.DeepEqual(got, []netaddr.IPPrefix{route}) {
+		t.Errorf("restored approved routes = %v", got)
+	}
+	if s2.Policy() == nil {
+		t.Errorf("policy not restored")
+	}
+	noise1, legacy1 := s.publicKeys()
+	noise2, legacy2 := s2.publicKeys()
+	if noise1 != noise2 || legacy1 != legacy2 {
+		t.Errorf("server keys not restored")
+	}
+
+	if err := new(Server).Restore(new(State)); err == nil {
+		t.Errorf("restored state without server keys")
+	}
+}
+
+func TestUseAuthKey(t *testing.T) {
+	s := new(Server)
+	once := s.NewAuthKey(false, time.Time{}, nil)
+	reusable := s.NewAuthKey(true, time.Time{}, nil)
+	expired := s.NewAuthKey(true, time.Now().Add(-time.Minute), nil)
+	revoked := s.NewAuthKey(true, time.Time{}, nil)
+	s.DeleteAuthKey(revoked.Key)
+
+	tests := []struct {
+		key     string
+		wantErr bool
+	}{
+		{once.Key, false},
+		{once.Key, true},
+		{reusable.Key, false},
+		{reusable.Key, false},
+		{expired.Key, true},
+		{revoked.Key, true},
+		{"tskey-bogus", true},
+	}
+	for i, tt := range tests {
+		s.mu.Lock()
+		_, err := s.useAuthKeyLocked(tt.key)
+		s.mu.Unlock()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%d. useAuthKeyLocked(%q) = %v; want error: %v", i, tt.key, err, tt.wantErr)
+		}
+	}
+}
+
+func TestApprovedRoutes(t *testing.T) {
+	s := new(Server)
+	s.AddFakeNode()
+	n := s.AllNodes()[0]
+	adv := netaddr.MustParseIPPrefix("10.0.0.0/24")
+	notAdv := netaddr.MustParseIPPrefix("10.1.0.0/24")
+	n.Hostinfo = (&tailcfg.Hostinfo{RoutableIPs: []netaddr.IPPrefix{adv}}).View()
+	s.UpdateNode(n)
+
+	if !s.SetApprovedRoutes(n.ID, []netaddr.IPPrefix{adv, notAdv}) {
+		t.Fatal("SetApprovedRoutes failed")
+	}
+	got := s.Node(n.Key)
+	wantAllowed := append(append([]netaddr.IPPrefix(nil), n.Addresses...), adv)
+	if !reflect.DeepEqual(got.AllowedIPs, wantAllowed) {
+		t.Errorf("AllowedIPs = %v; want %v", got.AllowedIPs, wantAllowed)
+	}
+	if !reflect.DeepEqual(got.PrimaryRoutes, []netaddr.IPPrefix{adv}) {
+		t.Errorf("PrimaryRoutes = %v; want [%v]", got.PrimaryRoutes, adv)
+	}
+
+	s.SetApprovedRoutes(n.ID, nil)
+	if got := s.Node(n.Key); !reflect.DeepEqual(got.AllowedIPs, n.Addresses) || got.PrimaryRoutes != nil {
+		t.Errorf("after unapproving: AllowedIPs = %v, PrimaryRoutes = %v", got.AllowedIPs, got.PrimaryRoutes)
+	}
+	if s.SetApprovedRoutes(12345, nil) {
+		t.Errorf("SetApprovedRoutes succeeded for unknown node")
+	}
+}
+
+func TestSharedRoutePrimary(t *testing.T) {
+	s := new(Server)
+	s.AddFakeNode()
+	s.AddFakeNode()
+	route := netaddr.MustParseIPPrefix("10.0.0.0/24")
+	nodes := s.AllNodes()
+	for _, n := range nodes {
+		n.Hostinfo = (&tailcfg.Hostinfo{RoutableIPs: []netaddr.IPPrefix{route}}).View()
+		s.UpdateNode(n)
+		s.SetApprovedRoutes(n.ID, []netaddr.IPPrefix{route})
+	}
+	first, second := nodes[0], nodes[1]
+	if first.ID > second.ID {
+		first, second = second, first
+	}
+
+	check := func(n *tailcfg.Node, wantPrimary bool) {
+		t.Helper()
+		got := s.Node(n.Key)
+		if !slicesContain(got.AllowedIPs, route) {
+			t.Errorf("node %v AllowedIPs = %v; want %v included", n.ID, got.AllowedIPs, route)
+		}
+		if isPrimary := slicesContain(got.PrimaryRoutes, route); isPrimary != wantPrimary {
+			t.Errorf("node %v PrimaryRoutes = %v; want primary %v", n.ID, got.PrimaryRoutes, wantPrimary)
+		}
+	}
+	check(first, true)
+	check(second, false)
+
+	// Unapproving the primary's route moves it to the other node.
+	s.SetApprovedRoutes(first.ID, nil)
+	check(second, true)
+	if got := s.Node(first.Key); slicesContain(got.AllowedIPs, route) {
+		t.Errorf("unapproved node %v AllowedIPs = %v; want no %v", first.ID, got.AllowedIPs, route)
+	}
+}
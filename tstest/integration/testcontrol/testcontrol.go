@@ -20,6 +20,7 @@
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"reflect"
 	"sort"
 	"strings"
 	"sync"
@@ -29,10 +30,12 @@
 	"go4.org/mem"
 	"inet.af/netaddr"
 	"tailscale.com/net/tsaddr"
+	"tailscale.com/policyfile"
 	"tailscale.com/smallzstd"
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/key"
 	"tailscale.com/types/logger"
+	"tailscale.com/util/mak"
 )
 
 const msgLimit = 1 << 20 // encrypted message length limit
@@ -46,6 +49,22 @@ type Server struct {
 	Verbose     bool
 	DNSConfig   *tailcfg.DNSConfig // nil means no DNS config
 
+	// DeltaPeers, if true, makes streamed map responses after the
+	// first one carry only the changes to the peer list (using
+	// PeersChangedPatch where possible) to clients that support
+	// it, like the real control plane does.
+	DeltaPeers bool
+
+	// NodeKeyExpiry, if non-zero, is how long a node key is valid
+	// for after it's first registered. Zero means node keys never
+	// expire.
+	NodeKeyExpiry time.Duration
+
+	// OnStateChange, if non-nil, is called (without any locks held)
+	// after the state returned by State changes, so it can be
+	// persisted.
+	OnStateChange func()
+
 	// ExplicitBaseURL or HTTPTestServer must be set.
 	ExplicitBaseURL string           // e.g. "http://127.0.0.1:1234" with no trailing URL
 	HTTPTestServer  *httptest.Server // if non-nil, used to get BaseURL
@@ -69,7 +88,13 @@ type Server struct {
 	authPath      map[string]*AuthPath
 	nodeKeyAuthed map[key.NodePublic]bool // key => true once authenticated
 	pingReqsToAdd map[key.NodePublic]*tailcfg.PingRequest
-	allExpired    bool // All nodes will be told their node key is expired.
+	allExpired    bool               // All nodes will be told their node key is expired.
+	policy        *policyfile.Policy // or nil to allow all traffic
+
+	authKeys       map[string]*AuthKey
+	keyTags        map[tailcfg.NodeID][]string // tags applied by the auth key a node registered with
+	approvedRoutes map[tailcfg.NodeID][]netaddr.IPPrefix
+	expiryTimers   map[tailcfg.NodeID]*time.Timer
 }
 
 // BaseURL returns the server's base URL, without trailing slash.
@@ -170,6 +195,198 @@ func (s *Server) SetExpireAllNodes(expired bool) {
 	}
 }
 
+// SetPolicy sets the tailnet policy used to generate each node's
+// packet filter and SSH policy, and sends all connected nodes an
+// updated netmap. A nil policy, the default, allows all traffic.
+func (s *Server) SetPolicy(p *policyfile.Policy) {
+	s.mu.Lock()
+	s.policy = p
+	for nk, n := range s.nodes {
+		n.Tags = s.nodeTagsLocked(nk, n.Hostinfo)
+	}
+	s.updateLocked("SetPolicy", s.nodeIDsLocked())
+	s.mu.Unlock()
+	s.stateChanged()
+}
+
+// Policy returns the current tailnet policy, or nil if all traffic
+// is allowed.
+func (s *Server) Policy() *policyfile.Policy {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.policy
+}
+
+// nodeTagsLocked returns the tags of the node with node key nk: those
+// from the auth key it registered with, plus those from hi.RequestTags
+// that its user is permitted to use by the current policy.
+//
+// s.mu must be held.
+func (s *Server) nodeTagsLocked(nk key.NodePublic, hi tailcfg.HostinfoView) []string {
+	var tags []string
+	if n := s.nodes[nk]; n != nil {
+		tags = append(tags, s.keyTags[n.ID]...)
+	}
+	u, ok := s.users[nk]
+	if s.policy == nil || !ok || !hi.Valid() {
+		return tags
+	}
+	for _, t := range tagsAllowed(s.policy, hi.RequestTags().AsSlice(), u.LoginName) {
+		if !slicesContain(tags, t) {
+			tags = append(tags, t)
+		}
+	}
+	return tags
+}
+
+// ExpireNode expires the node key of the node with the given ID now,
+// and reports whether there was such a node.
+func (s *Server) ExpireNode(id tailcfg.NodeID) bool {
+	s.mu.Lock()
+	n := s.nodeByIDLocked(id)
+	if n == nil {
+		s.mu.Unlock()
+		return false
+	}
+	n.KeyExpiry = time.Now().UTC()
+	s.scheduleExpiryLocked(n)
+	s.updateLocked("ExpireNode", s.nodeIDsLocked())
+	s.mu.Unlock()
+	s.stateChanged()
+	return true
+}
+
+// DeleteNode removes the node with the given ID from the tailnet,
+// and reports whether there was such a node. It will need to
+// authenticate again to rejoin.
+func (s *Server) DeleteNode(id tailcfg.NodeID) bool {
+	s.mu.Lock()
+	n := s.nodeByIDLocked(id)
+	if n == nil {
+		s.mu.Unlock()
+		return false
+	}
+	s.mu.Unlock()
+	s.removeNode(n.Key, n.Machine)
+	return true
+}
+
+// removeNode removes the node with node key nk, if it belongs to
+// machine mkey, and tells all nodes about it.
+func (s *Server) removeNode(nk key.NodePublic, mkey key.MachinePublic) {
+	s.mu.Lock()
+	n := s.nodes[nk]
+	if n == nil || n.Machine != mkey {
+		s.mu.Unlock()
+		return
+	}
+	delete(s.nodes, nk)
+	delete(s.nodeKeyAuthed, nk)
+	delete(s.keyTags, n.ID)
+	delete(s.approvedRoutes, n.ID)
+	if t := s.expiryTimers[n.ID]; t != nil {
+		t.Stop()
+		delete(s.expiryTimers, n.ID)
+	}
+	s.refreshRoutesLocked()
+	// Wake up the removed node's own map poll too, so it ends.
+	s.updateLocked("removeNode", append(s.nodeIDsLocked(), n.ID))
+	s.mu.Unlock()
+	s.stateChanged()
+}
+
+// rekeyLocked moves the node with node key old to node key nk, keeping
+// its user (and thus its ID and addresses).
+//
+// s.mu must be held.
+func (s *Server) rekeyLocked(old, nk key.NodePublic) {
+	// The old key's user entries are kept, as user IDs are
+	// allocated by counting them.
+	mak.Set(&s.users, nk, s.users[old])
+	mak.Set(&s.logins, nk, s.logins[old])
+	delete(s.nodes, old)
+	delete(s.nodeKeyAuthed, old)
+}
+
+// nodeKeyExpiredLocked reports whether n's node key has expired.
+//
+// s.mu must be held.
+func (s *Server) nodeKeyExpiredLocked(n *tailcfg.Node) bool {
+	return !n.KeyExpiry.IsZero() && !n.KeyExpiry.After(time.Now())
+}
+
+// scheduleExpiryLocked arranges for all nodes to be sent a new netmap
+// when n's node key expires, so n and its peers notice.
+//
+// s.mu must be held.
+func (s *Server) scheduleExpiryLocked(n *tailcfg.Node) {
+	if t := s.expiryTimers[n.ID]; t != nil {
+		t.Stop()
+		delete(s.expiryTimers, n.ID)
+	}
+	if n.KeyExpiry.IsZero() {
+		return
+	}
+	mak.Set(&s.expiryTimers, n.ID, time.AfterFunc(time.Until(n.KeyExpiry), func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.updateLocked("expiry", s.nodeIDsLocked())
+	}))
+}
+
+// nodeByIDLocked returns the node with the given ID, or nil.
+// The result is not cloned.
+//
+// s.mu must be held.
+func (s *Server) nodeByIDLocked(id tailcfg.NodeID) *tailcfg.Node {
+	for _, n := range s.nodes {
+		if n.ID == id {
+			return n
+		}
+	}
+	return nil
+}
+
+// nodeIDsLocked returns the IDs of all nodes.
+//
+// s.mu must be held.
+func (s *Server) nodeIDsLocked() []tailcfg.NodeID {
+	ids := make([]tailcfg.NodeID, 0, len(s.nodes))
+	for _, n := range s.nodes {
+		ids = append(ids, n.ID)
+	}
+	return ids
+}
+
+func slicesContain[T comparable](s []T, v T) bool {
+	for _, e := range s {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
+
+// policyViewLocked returns the current policy bound to the current set
+// of nodes, or nil if there's no policy.
+//
+// s.mu must be held.
+func (s *Server) policyViewLocked() *policyView {
+	if s.policy == nil {
+		return nil
+	}
+	v := &policyView{p: s.policy}
+	for nk, n := range s.nodes {
+		pn := policyNode{node: n}
+		if u, ok := s.users[nk]; ok && len(n.Tags) == 0 {
+			pn.loginName = u.LoginName
+		}
+		v.nodes = append(v.nodes, pn)
+	}
+	sort.Slice(v.nodes, func(i, j int) bool { return v.nodes[i].node.ID < v.nodes[j].node.ID })
+	return v
+}
+
 type AuthPath struct {
 	nodeKey key.NodePublic
 
@@ -466,6 +683,39 @@ func (s *Server) serveRegister(w http.ResponseWriter, r *http.Request, mkey key.
 
 	nk := req.NodeKey
 
+	if !req.Expiry.IsZero() && req.Expiry.Before(time.Now()) {
+		// The client is logging out.
+		s.removeNode(nk, mkey)
+		s.sendRegisterResponse(w, mkey, tailcfg.RegisterResponse{NodeKeyExpired: true})
+		return
+	}
+
+	s.mu.Lock()
+	if old := s.nodes[nk]; old != nil && old.Machine == mkey && s.nodeKeyExpiredLocked(old) {
+		s.mu.Unlock()
+		s.sendRegisterResponse(w, mkey, tailcfg.RegisterResponse{NodeKeyExpired: true})
+		return
+	}
+	var authKey *AuthKey
+	if req.Auth.AuthKey != "" && !s.nodeKeyAuthed[nk] {
+		var err error
+		authKey, err = s.useAuthKeyLocked(req.Auth.AuthKey)
+		if err != nil {
+			s.mu.Unlock()
+			s.sendRegisterResponse(w, mkey, tailcfg.RegisterResponse{Error: err.Error()})
+			return
+		}
+		if s.nodeKeyAuthed == nil {
+			s.nodeKeyAuthed = map[key.NodePublic]bool{}
+		}
+		s.nodeKeyAuthed[nk] = true
+	}
+	if old := s.nodes[req.OldNodeKey]; old != nil && old.Machine == mkey && s.nodes[nk] == nil {
+		// Node key rotation: the node keeps its user, ID and addresses.
+		s.rekeyLocked(req.OldNodeKey, nk)
+	}
+	s.mu.Unlock()
+
 	user, login := s.getUser(nk)
 	s.mu.Lock()
 	if s.nodes == nil {
@@ -482,23 +732,40 @@ func (s *Server) serveRegister(w http.ResponseWriter, r *http.Request, mkey key.
 		v6Prefix,
 	}
 
+	now := time.Now().UTC()
+	created, keyExpiry := now, time.Time{}
+	if old := s.nodes[nk]; old != nil {
+		// Refreshing an existing node key doesn't extend its expiry.
+		created, keyExpiry = old.Created, old.KeyExpiry
+	} else if s.NodeKeyExpiry > 0 {
+		keyExpiry = now.Add(s.NodeKeyExpiry)
+	}
 	s.nodes[nk] = &tailcfg.Node{
 		ID:                tailcfg.NodeID(user.ID),
 		StableID:          tailcfg.StableNodeID(fmt.Sprintf("TESTCTRL%08x", int(user.ID))),
 		User:              user.ID,
 		Machine:           mkey,
 		Key:               req.NodeKey,
+		KeyExpiry:         keyExpiry,
 		MachineAuthorized: machineAuthorized,
 		Addresses:         allowedIPs,
 		AllowedIPs:        allowedIPs,
 		Hostinfo:          req.Hostinfo.View(),
+		Created:           created,
 	}
+	if authKey != nil && len(authKey.Tags) > 0 {
+		mak.Set(&s.keyTags, s.nodes[nk].ID, append([]string(nil), authKey.Tags...))
+	}
+	s.nodes[nk].Tags = s.nodeTagsLocked(nk, s.nodes[nk].Hostinfo)
+	s.refreshRoutesLocked()
+	s.scheduleExpiryLocked(s.nodes[nk])
 	requireAuth := s.RequireAuth
 	if requireAuth && s.nodeKeyAuthed[nk] {
 		requireAuth = false
 	}
 	allExpired := s.allExpired
 	s.mu.Unlock()
+	s.stateChanged()
 
 	authURL := ""
 	if requireAuth {
@@ -509,13 +776,17 @@ func (s *Server) serveRegister(w http.ResponseWriter, r *http.Request, mkey key.
 		authURL = s.BaseURL() + authPath
 	}
 
-	res, err := s.encode(mkey, false, tailcfg.RegisterResponse{
+	s.sendRegisterResponse(w, mkey, tailcfg.RegisterResponse{
 		User:              *user,
 		Login:             *login,
 		NodeKeyExpired:    allExpired,
 		MachineAuthorized: machineAuthorized,
 		AuthURL:           authURL,
 	})
+}
+
+func (s *Server) sendRegisterResponse(w http.ResponseWriter, mkey key.MachinePublic, resp tailcfg.RegisterResponse) {
+	res, err := s.encode(mkey, false, resp)
 	if err != nil {
 		go panic(fmt.Sprintf("serveRegister: encode: %v", err))
 	}
@@ -636,6 +907,10 @@ func (s *Server) serveMap(w http.ResponseWriter, r *http.Request, mkey key.Machi
 			}
 		}
 		peersToUpdate = s.UpdateNode(node)
+		s.mu.Lock()
+		s.refreshRoutesLocked()
+		s.mu.Unlock()
+		s.stateChanged()
 	}
 
 	nodeID := node.ID
@@ -664,6 +939,8 @@ func (s *Server) serveMap(w http.ResponseWriter, r *http.Request, mkey key.Machi
 	compress := req.Compress != ""
 
 	w.WriteHeader(200)
+	var lastPeers []*tailcfg.Node // as last sent, if DeltaPeers
+	sentPeers := false
 	for {
 		res, err := s.MapResponse(req)
 		if err != nil {
@@ -673,6 +950,14 @@ func (s *Server) serveMap(w http.ResponseWriter, r *http.Request, mkey key.Machi
 		if res == nil {
 			return // done
 		}
+		if s.DeltaPeers && streaming && req.Version >= 34 {
+			peers := res.Peers
+			if sentPeers {
+				res.Peers = nil
+				res.PeersChanged, res.PeersRemoved, res.PeersChangedPatch = PeerDelta(lastPeers, peers)
+			}
+			lastPeers, sentPeers = peers, true
+		}
 
 		s.mu.Lock()
 		allExpired := s.allExpired
@@ -721,6 +1006,84 @@ func (s *Server) serveMap(w http.ResponseWriter, r *http.Request, mkey key.Machi
 	}
 }
 
+// PeerDelta returns the changes needed to turn the peer list prev into
+// cur, both sorted by Node.ID, in the form of the MapResponse fields
+// PeersChanged, PeersRemoved and PeersChangedPatch. Peers whose only
+// differences can be expressed as a tailcfg.PeerChange are returned
+// as patches rather than as whole changed nodes.
+func PeerDelta(prev, cur []*tailcfg.Node) (changed []*tailcfg.Node, removed []tailcfg.NodeID, patches []*tailcfg.PeerChange) {
+	for len(prev) > 0 || len(cur) > 0 {
+		switch {
+		case len(cur) == 0 || (len(prev) > 0 && prev[0].ID < cur[0].ID):
+			removed = append(removed, prev[0].ID)
+			prev = prev[1:]
+		case len(prev) == 0 || cur[0].ID < prev[0].ID:
+			changed = append(changed, cur[0])
+			cur = cur[1:]
+		default:
+			was, n := prev[0], cur[0]
+			prev, cur = prev[1:], cur[1:]
+			if was.Equal(n) {
+				continue
+			}
+			if pc, ok := peerChange(was, n); ok {
+				patches = append(patches, pc)
+			} else {
+				changed = append(changed, n)
+			}
+		}
+	}
+	return changed, removed, patches
+}
+
+// peerChange returns the tailcfg.PeerChange that turns was into n,
+// if the differences between the two can be expressed as one.
+func peerChange(was, n *tailcfg.Node) (pc *tailcfg.PeerChange, ok bool) {
+	pc = &tailcfg.PeerChange{NodeID: n.ID}
+	patched := was.Clone()
+	if n.DERP != was.DERP {
+		ipp, err := netaddr.ParseIPPort(n.DERP)
+		if err != nil || ipp.IP().String() != tailcfg.DerpMagicIP || ipp.Port() == 0 {
+			return nil, false
+		}
+		pc.DERPRegion = int(ipp.Port())
+		patched.DERP = n.DERP
+	}
+	if len(n.Endpoints) > 0 && !reflect.DeepEqual(n.Endpoints, was.Endpoints) {
+		pc.Endpoints = n.Endpoints
+		patched.Endpoints = n.Endpoints
+	}
+	if n.Key != was.Key {
+		k := n.Key
+		pc.Key = &k
+		patched.Key = k
+	}
+	if n.DiscoKey != was.DiscoKey {
+		k := n.DiscoKey
+		pc.DiscoKey = &k
+		patched.DiscoKey = k
+	}
+	if !n.KeyExpiry.Equal(was.KeyExpiry) {
+		t := n.KeyExpiry
+		pc.KeyExpiry = &t
+		patched.KeyExpiry = t
+	}
+	if n.Online != nil && (was.Online == nil || *was.Online != *n.Online) {
+		pc.Online = n.Online
+		patched.Online = n.Online
+	}
+	if n.LastSeen != nil && (was.LastSeen == nil || !was.LastSeen.Equal(*n.LastSeen)) {
+		pc.LastSeen = n.LastSeen
+		patched.LastSeen = n.LastSeen
+	}
+	if !reflect.DeepEqual(n.Capabilities, was.Capabilities) {
+		caps := n.Capabilities
+		pc.Capabilities = &caps
+		patched.Capabilities = caps
+	}
+	return pc, patched.Equal(n)
+}
+
 var keepAliveMsg = &struct {
 	KeepAlive bool
 }{
@@ -767,10 +1130,20 @@ func (s *Server) MapResponse(req *tailcfg.MapRequest) (res *tailcfg.MapResponse,
 		v4Prefix,
 		v6Prefix,
 	}
-	res.Node.AllowedIPs = res.Node.Addresses
 
 	// Consume the PingRequest while protected by mutex if it exists
 	s.mu.Lock()
+	if pv := s.policyViewLocked(); pv != nil {
+		res.PacketFilter = pv.filterForNode(res.Node)
+		self := policyNode{node: res.Node}
+		if len(res.Node.Tags) == 0 {
+			self.loginName = user.LoginName
+		}
+		res.SSHPolicy = pv.sshPolicyForNode(self)
+		if res.SSHPolicy == nil {
+			res.SSHPolicy = new(tailcfg.SSHPolicy) // nil means unchanged
+		}
+	}
 	if pr, ok := s.pingReqsToAdd[nk]; ok {
 		res.PingRequest = pr
 		delete(s.pingReqsToAdd, nk)
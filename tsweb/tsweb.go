@@ -427,15 +427,49 @@ type PrometheusVar interface {
 	WritePrometheus(w io.Writer, prefix string)
 }
 
+// OpenMetricsVar is an optional interface for a PrometheusVar to
+// implement if its OpenMetrics exposition differs from its Prometheus
+// one, such as by having exemplars or counters. Without it, VarzHandler
+// uses WritePrometheus for both formats.
+type OpenMetricsVar interface {
+	PrometheusVar
+
+	// WriteOpenMetrics is like WritePrometheus, but writes in the
+	// OpenMetrics text format.
+	WriteOpenMetrics(w io.Writer, prefix string)
+}
+
 // WritePrometheusExpvar writes kv to w in Prometheus metrics format.
 //
 // See VarzHandler for conventions. This is exported primarily for
 // people to test their varz.
 func WritePrometheusExpvar(w io.Writer, kv expvar.KeyValue) {
-	writePromExpVar(w, "", kv)
+	writePromExpVar(w, "", kv, false)
 }
 
-func writePromExpVar(w io.Writer, prefix string, kv expvar.KeyValue) {
+// writeSample writes a single sample of the metric name with value v,
+// preceded by a TYPE line if typ is non-empty. In the OpenMetrics
+// format, counter samples are suffixed with "_total".
+func writeSample(w io.Writer, name, typ string, v any, openMetrics bool) {
+	family, sample := name, name
+	if openMetrics && typ == "counter" {
+		family, sample = metrics.CounterNames(name)
+	}
+	if typ != "" {
+		fmt.Fprintf(w, "# TYPE %s %s\n", family, typ)
+	}
+	fmt.Fprintf(w, "%s %v\n", sample, v)
+}
+
+// writePromExpVar writes kv to w in the Prometheus text format, or the
+// OpenMetrics text format if openMetrics is true.
+func writePromExpVar(w io.Writer, prefix string, kv expvar.KeyValue, openMetrics bool) {
+	// OpenMetrics doesn't permit arbitrary comments.
+	skipping := func(format string, args ...any) {
+		if !openMetrics {
+			fmt.Fprintf(w, format, args...)
+		}
+	}
 	key := kv.Key
 	var typ string
 	var label string
@@ -457,6 +491,13 @@ func writePromExpVar(w io.Writer, prefix string, kv expvar.KeyValue) {
 	name := prefix + key
 
 	switch v := kv.Value.(type) {
+	case OpenMetricsVar:
+		if openMetrics {
+			v.WriteOpenMetrics(w, name)
+		} else {
+			v.WritePrometheus(w, name)
+		}
+		return
 	case PrometheusVar:
 		v.WritePrometheus(w, name)
 		return
@@ -464,17 +505,17 @@ func writePromExpVar(w io.Writer, prefix string, kv expvar.KeyValue) {
 		if typ == "" {
 			typ = "counter"
 		}
-		fmt.Fprintf(w, "# TYPE %s %s\n%s %v\n", name, typ, name, v.Value())
+		writeSample(w, name, typ, v.Value(), openMetrics)
 		return
 	case *expvar.Float:
 		if typ == "" {
 			typ = "gauge"
 		}
-		fmt.Fprintf(w, "# TYPE %s %s\n%s %v\n", name, typ, name, v.Value())
+		writeSample(w, name, typ, v.Value(), openMetrics)
 		return
 	case *metrics.Set:
 		v.Do(func(kv expvar.KeyValue) {
-			writePromExpVar(w, name+"_", kv)
+			writePromExpVar(w, name+"_", kv, openMetrics)
 		})
 		return
 	case PrometheusMetricsReflectRooter:
@@ -487,24 +528,24 @@ func writePromExpVar(w io.Writer, prefix string, kv expvar.KeyValue) {
 			rv = rv.Elem()
 		}
 		if rv.Type().Kind() != reflect.Struct {
-			fmt.Fprintf(w, "# skipping expvar %q; unknown root type\n", name)
+			skipping("# skipping expvar %q; unknown root type\n", name)
 			return
 		}
 		foreachExportedStructField(rv, func(fieldOrJSONName, metricType string, rv reflect.Value) {
 			mname := name + "_" + fieldOrJSONName
 			switch rv.Kind() {
 			case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-				fmt.Fprintf(w, "# TYPE %s %s\n%s %v\n", mname, metricType, mname, rv.Int())
+				writeSample(w, mname, metricType, rv.Int(), openMetrics)
 			case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
-				fmt.Fprintf(w, "# TYPE %s %s\n%s %v\n", mname, metricType, mname, rv.Uint())
+				writeSample(w, mname, metricType, rv.Uint(), openMetrics)
 			case reflect.Float32, reflect.Float64:
-				fmt.Fprintf(w, "# TYPE %s %s\n%s %v\n", mname, metricType, mname, rv.Float())
+				writeSample(w, mname, metricType, rv.Float(), openMetrics)
 			case reflect.Struct:
 				if rv.CanAddr() {
 					// Slight optimization, not copying big structs if they're addressable:
-					writePromExpVar(w, name+"_", expvar.KeyValue{Key: fieldOrJSONName, Value: expVarPromStructRoot{rv.Addr().Interface()}})
+					writePromExpVar(w, name+"_", expvar.KeyValue{Key: fieldOrJSONName, Value: expVarPromStructRoot{rv.Addr().Interface()}}, openMetrics)
 				} else {
-					writePromExpVar(w, name+"_", expvar.KeyValue{Key: fieldOrJSONName, Value: expVarPromStructRoot{rv.Interface()}})
+					writePromExpVar(w, name+"_", expvar.KeyValue{Key: fieldOrJSONName, Value: expVarPromStructRoot{rv.Interface()}}, openMetrics)
 				}
 			}
 			return
@@ -517,7 +558,7 @@ func writePromExpVar(w io.Writer, prefix string, kv expvar.KeyValue) {
 		if f, ok := kv.Value.(expvar.Func); ok {
 			v := f()
 			if ms, ok := v.(runtime.MemStats); ok && name == "memstats" {
-				writeMemstats(w, &ms)
+				writeMemstats(w, &ms, openMetrics)
 				return
 			}
 			switch v := v.(type) {
@@ -529,7 +570,7 @@ funcRet = fmt.Sprintf(" returning %T", v)
 		}
 		switch kv.Value.(type) {
 		default:
-			fmt.Fprintf(w, "# skipping expvar %q (Go type %T%s) with undeclared Prometheus type\n", name, kv.Value, funcRet)
+			skipping("# skipping expvar %q (Go type %T%s) with undeclared Prometheus type\n", name, kv.Value, funcRet)
 			return
 		case *metrics.LabelMap, *expvar.Map:
 			// Permit typeless LabelMap and expvar.Map for
@@ -543,25 +584,33 @@ funcRet = fmt.Sprintf(" returning %T", v)
 		val := v()
 		switch val.(type) {
 		case float64, int64, int:
-			fmt.Fprintf(w, "# TYPE %s %s\n%s %v\n", name, typ, name, val)
+			writeSample(w, name, typ, val, openMetrics)
 		default:
-			fmt.Fprintf(w, "# skipping expvar func %q returning unknown type %T\n", name, val)
+			skipping("# skipping expvar func %q returning unknown type %T\n", name, val)
 		}
 
 	case *metrics.LabelMap:
+		family, sample := name, name
+		if openMetrics && typ == "counter" {
+			family, sample = metrics.CounterNames(name)
+		}
 		if typ != "" {
-			fmt.Fprintf(w, "# TYPE %s %s\n", name, typ)
+			fmt.Fprintf(w, "# TYPE %s %s\n", family, typ)
 		}
 		// IntMap uses expvar.Map on the inside, which presorts
 		// keys. The output ordering is deterministic.
 		v.Do(func(kv expvar.KeyValue) {
-			fmt.Fprintf(w, "%s{%s=%q} %v\n", name, v.Label, kv.Key, kv.Value)
+			fmt.Fprintf(w, "%s{%s=%q} %v\n", sample, v.Label, kv.Key, kv.Value)
 		})
 	case *expvar.Map:
 		if label != "" && typ != "" {
-			fmt.Fprintf(w, "# TYPE %s %s\n", name, typ)
+			family, sample := name, name
+			if openMetrics && typ == "counter" {
+				family, sample = metrics.CounterNames(name)
+			}
+			fmt.Fprintf(w, "# TYPE %s %s\n", family, typ)
 			v.Do(func(kv expvar.KeyValue) {
-				fmt.Fprintf(w, "%s{%s=%q} %v\n", name, label, kv.Key, kv.Value)
+				fmt.Fprintf(w, "%s{%s=%q} %v\n", sample, label, kv.Key, kv.Value)
 			})
 		} else {
 			v.Do(func(kv expvar.KeyValue) {
@@ -586,13 +635,44 @@ funcRet = fmt.Sprintf(" returning %T", v)
 //   * anything else is untyped and thus not exported.
 //   * expvar.Func can return an int or int64 (for now) and anything else
 //     is not exported.
+//   * a PrometheusVar, such as a *tailscale/metrics.Histogram or
+//     *tailscale/metrics.MultiLabelMap, writes itself.
+//
+// If the request accepts the OpenMetrics text format, as Prometheus
+// scrapers do, the response is in that format instead, which adds
+// histogram exemplars and "_total" suffixes on counter samples:
+//
+//   https://github.com/OpenObservability/OpenMetrics/blob/main/specification/OpenMetrics.md
 //
 // This will evolve over time, or perhaps be replaced.
 func VarzHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	openMetrics := acceptsOpenMetrics(r)
+	if openMetrics {
+		w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	}
 	expvarDo(func(kv expvar.KeyValue) {
-		writePromExpVar(w, "", kv)
+		writePromExpVar(w, "", kv, openMetrics)
 	})
+	if openMetrics {
+		io.WriteString(w, "# EOF\n")
+	}
+}
+
+// acceptsOpenMetrics reports whether r's Accept header includes the
+// OpenMetrics text format.
+func acceptsOpenMetrics(r *http.Request) bool {
+	remain := r.Header.Get("Accept")
+	for len(remain) > 0 {
+		var part string
+		part, remain, _ = strings.Cut(remain, ",")
+		part, _, _ = strings.Cut(part, ";")
+		if strings.TrimSpace(part) == "application/openmetrics-text" {
+			return true
+		}
+	}
+	return false
 }
 
 // PrometheusMetricsReflectRooter is an optional interface that expvar.Var implementations
@@ -607,12 +687,12 @@ type PrometheusMetricsReflectRooter interface {
 
 var expvarDo = expvar.Do // pulled out for tests
 
-func writeMemstats(w io.Writer, ms *runtime.MemStats) {
+func writeMemstats(w io.Writer, ms *runtime.MemStats, openMetrics bool) {
 	out := func(name, typ string, v uint64, help string) {
 		if help != "" {
 			fmt.Fprintf(w, "# HELP memstats_%s %s\n", name, help)
 		}
-		fmt.Fprintf(w, "# TYPE memstats_%s %s\nmemstats_%s %v\n", name, typ, name, v)
+		writeSample(w, "memstats_"+name, typ, v, openMetrics)
 	}
 	g := func(name string, v uint64, help string) { out(name, "gauge", v, help) }
 	c := func(name string, v uint64, help string) { out(name, "counter", v, help) }
@@ -526,6 +526,28 @@ func() *expvar.Map {
 			promWriter{},
 			"custom_var_value 42\n",
 		},
+		{
+			"metrics_multi_label_map",
+			"counter_m",
+			(func() *metrics.MultiLabelMap {
+				m := &metrics.MultiLabelMap{Type: "counter", Labels: []string{"a", "b"}}
+				m.Get("x", "y").Add(2)
+				m.Get("x", "z").Add(1)
+				return m
+			})(),
+			"# TYPE m counter\nm{a=\"x\",b=\"y\"} 2\nm{a=\"x\",b=\"z\"} 1\n",
+		},
+		{
+			"metrics_histogram",
+			"h",
+			(func() *metrics.Histogram {
+				h := metrics.NewHistogram([]float64{1})
+				h.Observe(0.5)
+				h.ObserveWithExemplar(2, map[string]string{"id": "x"})
+				return h
+			})(),
+			"# TYPE h histogram\nh_bucket{le=\"1\"} 1\nh_bucket{le=\"+Inf\"} 2\nh_sum 2.5\nh_count 2\n",
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -542,6 +564,72 @@ func() *expvar.Map {
 	}
 }
 
+func TestVarzHandlerOpenMetrics(t *testing.T) {
+	c := new(expvar.Int)
+	c.Set(3)
+	g := new(expvar.Int)
+	g.Set(4)
+	lm := &metrics.LabelMap{Label: "reason"}
+	lm.Add("x", 1)
+	mlm := &metrics.MultiLabelMap{Type: "counter", Labels: []string{"a", "b"}}
+	mlm.Get("x", "y").Add(5)
+	set := new(metrics.Set)
+	set.Set("requests_total", c)
+	vars := []expvar.KeyValue{
+		{Key: "counter_c", Value: c},
+		{Key: "gauge_g", Value: g},
+		{Key: "counter_lm", Value: lm},
+		{Key: "mlm", Value: mlm},
+		{Key: "set", Value: set},
+		{Key: "untyped", Value: new(expvar.String)},
+		{Key: "custom_var", Value: promWriter{}},
+	}
+	defer func() { expvarDo = expvar.Do }()
+	expvarDo = func(f func(expvar.KeyValue)) {
+		for _, kv := range vars {
+			f(kv)
+		}
+	}
+
+	for _, accept := range []string{
+		"application/openmetrics-text;version=1.0.0,application/openmetrics-text;version=0.0.1;q=0.75,text/plain;version=0.0.4;q=0.5,*/*;q=0.1",
+		"application/openmetrics-text",
+	} {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept", accept)
+		VarzHandler(rec, req)
+		if got, want := rec.Header().Get("Content-Type"), "application/openmetrics-text; version=1.0.0; charset=utf-8"; got != want {
+			t.Errorf("Accept %q: Content-Type = %q; want %q", accept, got, want)
+		}
+		want := strings.Join([]string{
+			"# TYPE c counter",
+			"c_total 3",
+			"# TYPE g gauge",
+			"g 4",
+			"# TYPE lm counter",
+			`lm_total{reason="x"} 1`,
+			"# TYPE mlm counter",
+			`mlm_total{a="x",b="y"} 5`,
+			"# TYPE set_requests counter",
+			"set_requests_total 3",
+			"custom_var_value 42",
+			"# EOF",
+		}, "\n") + "\n"
+		if got := rec.Body.String(); got != want {
+			t.Errorf("Accept %q: mismatch\n got: %s\nwant: %s", accept, got, want)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept", "text/plain")
+	VarzHandler(rec, req)
+	if got := rec.Body.String(); strings.Contains(got, "# EOF") || !strings.Contains(got, "\nc 3\n") {
+		t.Errorf("Accept text/plain: got OpenMetrics:\n%s", got)
+	}
+}
+
 type SomeNested struct {
 	FooG int64 `json:"foo" metrictype:"gauge"`
 	BarC int64 `json:"bar" metrictype:"counter"`
@@ -15,8 +15,9 @@ type Resolver struct {
 	//  - A plain IP address for a "classic" UDP+TCP DNS resolver.
 	//    This is the common format as sent by the control plane.
 	//  - An IP:port, for tests.
-	//  - [TODO] "tls://resolver.com" for DNS over TCP+TLS
-	//  - [TODO] "https://resolver.com/query-tmpl" for DNS over HTTPS
+	//  - "tls://resolver.com" or "tls://resolver.com:853" for DNS over
+	//    TCP+TLS (RFC 7858).
+	//  - "https://resolver.com/dns-query" for DNS over HTTPS (RFC 8484).
 	Addr string `json:",omitempty"`
 
 	// BootstrapResolution is an optional suggested resolution for the
@@ -24,8 +25,20 @@ type Resolver struct {
 	// address directly.
 	// BootstrapResolution may be empty, in which case clients should
 	// look up the DoT/DoH server using their local "classic" DNS
-	// resolver.
+	// resolver. tailscaled doesn't, as that resolver may be itself,
+	// and requires BootstrapResolution for DoT/DoH resolvers named
+	// by hostname.
 	BootstrapResolution []netaddr.IP `json:",omitempty"`
+
+	// TLSPins optionally pins the certificates of a DoT/DoH resolver.
+	// Each is a base64 (standard encoding) SHA-256 hash of a
+	// certificate's SubjectPublicKeyInfo, as used by RFC 7469.
+	//
+	// If empty, the resolver's certificate is verified against the
+	// system roots as usual. Otherwise, either the resolver's leaf
+	// certificate must match a pin, or its chain must verify against
+	// the system roots and contain a certificate matching a pin.
+	TLSPins []string `json:",omitempty"`
 }
 
 // IPPort returns r.Addr as an IP address and port if either
@@ -19,6 +19,7 @@ func (src *Resolver) Clone() *Resolver {
 	dst := new(Resolver)
 	*dst = *src
 	dst.BootstrapResolution = append(src.BootstrapResolution[:0:0], src.BootstrapResolution...)
+	dst.TLSPins = append(src.TLSPins[:0:0], src.TLSPins...)
 	return dst
 }
 
@@ -26,6 +27,7 @@ func (src *Resolver) Clone() *Resolver {
 var _ResolverCloneNeedsRegeneration = Resolver(struct {
 	Addr                string
 	BootstrapResolution []netaddr.IP
+	TLSPins             []string
 }{})
 
 // Clone duplicates src into dst and reports whether it succeeded.
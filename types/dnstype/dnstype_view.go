@@ -61,9 +61,11 @@ func (v ResolverView) Addr() string { return v.ж.Addr }
 func (v ResolverView) BootstrapResolution() views.Slice[netaddr.IP] {
 	return views.SliceOf(v.ж.BootstrapResolution)
 }
+func (v ResolverView) TLSPins() views.Slice[string] { return views.SliceOf(v.ж.TLSPins) }
 
 // A compilation failure here means this code must be regenerated, with the command at the top of this file.
 var _ResolverViewNeedsRegeneration = Resolver(struct {
 	Addr                string
 	BootstrapResolution []netaddr.IP
+	TLSPins             []string
 }{})
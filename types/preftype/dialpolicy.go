@@ -0,0 +1,151 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package preftype
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"inet.af/netaddr"
+	"tailscale.com/net/dstmatch"
+)
+
+// Values of DialRule.Via.
+//
+// There's no route via a particular peer: each destination is routed
+// via the one peer whose WireGuard AllowedIPs contain it, regardless
+// of the dial.
+const (
+	DialDirect      = "direct"    // the system network, bypassing Tailscale
+	DialViaExitNode = "exit-node" // the exit node in use
+)
+
+// DialRule is an entry of a dial policy, which routes the dials
+// tailscaled makes on behalf of users (e.g. for its SOCKS5 and HTTP
+// proxies) in userspace-networking mode. The first rule matching a
+// dial decides its route.
+//
+// Rules are matched using a DialPolicy, which parses them once.
+type DialRule struct {
+	// Dst is the destinations matched: "*" for any, a domain name,
+	// "*." and a domain for its subdomains, or an IP address or CIDR
+	// prefix. See dstmatch.Parse.
+	Dst string
+
+	// Ports, if non-empty, restricts the rule to a port ("443") or
+	// range of ports ("8000-8999").
+	Ports string `json:",omitempty"`
+
+	// Via is where matching dials go: DialDirect or DialViaExitNode.
+	Via string
+}
+
+// String returns r in the DST[:PORTS]=VIA form parsed by
+// ParseDialRules.
+func (r DialRule) String() string {
+	dst := r.Dst
+	if r.Ports != "" {
+		if strings.Contains(dst, ":") {
+			dst = "[" + dst + "]"
+		}
+		dst += ":" + r.Ports
+	}
+	return dst + "=" + r.Via
+}
+
+// Validate reports whether r is well-formed.
+func (r DialRule) Validate() error {
+	_, err := r.parse()
+	return err
+}
+
+// parsedDialRule is a DialRule parsed for matching.
+type parsedDialRule struct {
+	rule DialRule
+	dst  dstmatch.Pattern
+}
+
+func (r DialRule) parse() (pr parsedDialRule, err error) {
+	pr.rule = r
+	if r.Dst == "" {
+		return pr, errors.New("dial rule has no destination")
+	}
+	if pr.dst, err = dstmatch.New(r.Dst, r.Ports); err != nil {
+		return pr, fmt.Errorf("invalid dial rule: %w", err)
+	}
+	switch r.Via {
+	case DialDirect, DialViaExitNode:
+	default:
+		return pr, fmt.Errorf("invalid dial rule route %q; want %q or %q", r.Via, DialDirect, DialViaExitNode)
+	}
+	return pr, nil
+}
+
+// DialPolicy is a list of dial rules, parsed once for matching dials.
+type DialPolicy struct {
+	rules []parsedDialRule
+}
+
+// NewDialPolicy returns the DialPolicy of rules. Invalid rules match
+// nothing; they're reported in the returned error, if any, along with
+// a usable DialPolicy of the valid rules.
+func NewDialPolicy(rules []DialRule) (*DialPolicy, error) {
+	p := &DialPolicy{rules: make([]parsedDialRule, 0, len(rules))}
+	var errs []string
+	for _, r := range rules {
+		pr, err := r.parse()
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		p.rules = append(p.rules, pr)
+	}
+	if len(errs) > 0 {
+		return p, errors.New(strings.Join(errs, "; "))
+	}
+	return p, nil
+}
+
+// Match returns the first rule matching a dial to port of the
+// lowercase hostname name, if any, resolved to ip.
+func (p *DialPolicy) Match(name string, ip netaddr.IP, port uint16) (r DialRule, ok bool) {
+	if p == nil {
+		return r, false
+	}
+	for i := range p.rules {
+		if pr := &p.rules[i]; pr.dst.Match(name, ip, port) {
+			return pr.rule, true
+		}
+	}
+	return r, false
+}
+
+// ParseDialRules parses a comma-separated list of DST[:PORTS]=VIA dial
+// rules, such as "*.corp.example.com:443=exit-node,10.0.0.0/8=direct".
+// IPv6 destinations followed by PORTS must be in brackets.
+func ParseDialRules(s string) ([]DialRule, error) {
+	var rules []DialRule
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		dst, via, ok := strings.Cut(f, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid dial rule %q; want DST[:PORTS]=VIA", f)
+		}
+		host, ports, err := dstmatch.SplitHostPorts(dst)
+		if err != nil {
+			return nil, fmt.Errorf("invalid dial rule %q: %w", f, err)
+		}
+		r := DialRule{Dst: host, Ports: ports, Via: via}
+		if err := r.Validate(); err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
@@ -0,0 +1,96 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package preftype
+
+import (
+	"reflect"
+	"testing"
+
+	"inet.af/netaddr"
+)
+
+func TestParseDialRules(t *testing.T) {
+	const in = "*.Example.com:443=exit-node, [fd7a::/16]:8000-8999=exit-node,10.0.0.1=direct,*=direct"
+	got, err := ParseDialRules(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []DialRule{
+		{Dst: "*.Example.com", Ports: "443", Via: DialViaExitNode},
+		{Dst: "fd7a::/16", Ports: "8000-8999", Via: DialViaExitNode},
+		{Dst: "10.0.0.1", Via: DialDirect},
+		{Dst: "*", Via: DialDirect},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v; want %+v", got, want)
+	}
+	for _, r := range got {
+		back, err := ParseDialRules(r.String())
+		if err != nil || len(back) != 1 || back[0] != r {
+			t.Errorf("round trip of %q = %+v, %v", r.String(), back, err)
+		}
+	}
+
+	for _, bad := range []string{
+		"example.com",
+		"=direct",
+		"example.com=nowhere",
+		"example.com:99999=direct",
+		"example.com:9-8=direct",
+		"foo*bar.com=direct",
+		"example.com=100.64.0.1",
+		"example.com=require-peer:100.64.0.1",
+	} {
+		if _, err := ParseDialRules(bad); err == nil {
+			t.Errorf("ParseDialRules(%q) succeeded; want error", bad)
+		}
+	}
+}
+
+func TestDialPolicyMatch(t *testing.T) {
+	ip := netaddr.MustParseIP
+	tests := []struct {
+		rule DialRule
+		name string
+		ip   netaddr.IP
+		port uint16
+		want bool
+	}{
+		{DialRule{Dst: "example.com"}, "example.com", ip("1.2.3.4"), 80, true},
+		{DialRule{Dst: "example.com"}, "www.example.com", ip("1.2.3.4"), 80, false},
+		{DialRule{Dst: "*.example.com."}, "www.example.com", ip("1.2.3.4"), 80, true},
+		{DialRule{Dst: "*.example.com"}, "example.com", ip("1.2.3.4"), 80, false},
+		{DialRule{Dst: "example.com"}, "notexample.com", ip("1.2.3.4"), 80, false},
+		{DialRule{Dst: "example.com"}, "", ip("1.2.3.4"), 80, false},
+		{DialRule{Dst: "10.0.0.0/8"}, "", ip("10.9.9.9"), 80, true},
+		{DialRule{Dst: "10.0.0.0/8"}, "foo.internal", ip("10.9.9.9"), 80, true},
+		{DialRule{Dst: "10.0.0.0/8"}, "", ip("11.0.0.1"), 80, false},
+		{DialRule{Dst: "*", Ports: "80-90"}, "", ip("1.2.3.4"), 85, true},
+		{DialRule{Dst: "*", Ports: "80-90"}, "", ip("1.2.3.4"), 91, false},
+		{DialRule{Dst: "bad*"}, "bad", ip("1.2.3.4"), 80, false},
+	}
+	for _, tt := range tests {
+		tt.rule.Via = DialDirect
+		p, _ := NewDialPolicy([]DialRule{tt.rule})
+		if _, got := p.Match(tt.name, tt.ip, tt.port); got != tt.want {
+			t.Errorf("%+v.Match(%q, %v, %d) = %v; want %v", tt.rule, tt.name, tt.ip, tt.port, got, tt.want)
+		}
+	}
+
+	p, err := NewDialPolicy([]DialRule{
+		{Dst: "bad*", Via: DialDirect},
+		{Dst: "10.0.0.0/8", Via: DialViaExitNode},
+		{Dst: "*", Via: DialDirect},
+	})
+	if err == nil {
+		t.Error("invalid rule not reported")
+	}
+	if r, ok := p.Match("", ip("10.1.2.3"), 80); !ok || r.Dst != "10.0.0.0/8" {
+		t.Errorf("Match = %+v, %v; want the exit node rule", r, ok)
+	}
+	if r, ok := p.Match("bad", ip("1.2.3.4"), 80); !ok || r.Dst != "*" {
+		t.Errorf("Match = %+v, %v; want the catch-all rule", r, ok)
+	}
+}
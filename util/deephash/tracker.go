@@ -0,0 +1,167 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package deephash
+
+import (
+	"crypto/sha256"
+	"reflect"
+)
+
+// Tracker tracks the hashes of the fields of successive values of the
+// struct type T, to report which fields changed between them. For
+// fields that are slices, it also reports which elements changed, so
+// that, for example, only changed peers need to be reconfigured.
+//
+// Update hashes each field and slice element once, so a Tracker can
+// replace a Hash of the whole value at no extra cost; the savings come
+// from callers only redoing work for what changed. The zero value is
+// ready for use. A Tracker is not safe for concurrent use.
+type Tracker[T any] struct {
+	last []fieldSum // by field index; nil before the first Update
+}
+
+type fieldSum struct {
+	sum   Sum
+	elems []Sum // of each element, for slice fields
+}
+
+// Changes describes what changed between two values passed to
+// Tracker.Update.
+type Changes struct {
+	// Fields are the names of the top-level fields that changed, in
+	// declaration order. After the first Update, that's all of them.
+	Fields []string
+
+	// Elems describes how the elements of each changed slice field
+	// in Fields changed.
+	Elems map[string]ElemChanges
+}
+
+// Any reports whether anything changed.
+func (c Changes) Any() bool { return len(c.Fields) > 0 }
+
+// Changed reports whether the named top-level field changed.
+func (c Changes) Changed(field string) bool {
+	for _, f := range c.Fields {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+// ElemChanges describes how the elements of a slice changed.
+//
+// Elements are matched by their hash, regardless of their position, so
+// an element that was modified is both removed from the old slice and
+// added to the new one, and a slice that was only reordered has no
+// element changes.
+type ElemChanges struct {
+	Added   []int // indexes in the new slice of elements not in the old one
+	Removed []int // indexes in the old slice of elements not in the new one
+}
+
+// Update records the hashes of the fields of v and reports what
+// changed since the previous call. It panics if T isn't a struct type.
+func (t *Tracker[T]) Update(v *T) Changes {
+	rv := reflect.ValueOf(v).Elem()
+	typ := rv.Type()
+	if typ.Kind() != reflect.Struct {
+		panic("deephash: Tracker of non-struct type " + typ.String())
+	}
+	seedOnce.Do(initSeed)
+
+	sums := make([]fieldSum, typ.NumField())
+	for i := range sums {
+		sums[i] = hashField(rv.Field(i))
+	}
+	var c Changes
+	for i := range sums {
+		if t.last != nil && sums[i].sum == t.last[i].sum {
+			continue
+		}
+		name := typ.Field(i).Name
+		c.Fields = append(c.Fields, name)
+		if typ.Field(i).Type.Kind() == reflect.Slice {
+			var old []Sum
+			if t.last != nil {
+				old = t.last[i].elems
+			}
+			if c.Elems == nil {
+				c.Elems = map[string]ElemChanges{}
+			}
+			c.Elems[name] = diffElems(old, sums[i].elems)
+		}
+	}
+	t.last = sums
+	return c
+}
+
+// hashField returns the hash of v, a struct field. For slices, it also
+// returns the hash of each element, and the field's hash is derived
+// from those rather than hashing everything twice.
+func hashField(v reflect.Value) fieldSum {
+	h := hasherPool.Get().(*hasher)
+	defer hasherPool.Put(h)
+	if v.Kind() != reflect.Slice {
+		h.reset()
+		h.hashUint64(seed)
+		h.hashValue(v, false)
+		return fieldSum{sum: h.sum()}
+	}
+
+	n := v.Len()
+	fs := fieldSum{elems: make([]Sum, n)}
+	ti := getTypeInfo(v.Type().Elem())
+	for i := 0; i < n; i++ {
+		h.reset()
+		h.hashUint64(seed)
+		h.hashValueWithType(v.Index(i), ti, false)
+		fs.elems[i] = h.sum()
+	}
+
+	h.reset()
+	h.hashUint64(seed)
+	if v.IsNil() {
+		h.hashUint8(0)
+	} else {
+		h.hashUint8(1)
+	}
+	h.hashLen(n)
+	for _, s := range fs.elems {
+		h.bw.Write(s.sum[:])
+	}
+	fs.sum = h.sum()
+	return fs
+}
+
+// diffElems returns which elements of the new slice aren't in old and
+// vice versa, matching duplicates one to one.
+func diffElems(old, new []Sum) ElemChanges {
+	count := make(map[[sha256.Size]byte]int, len(old))
+	for _, s := range old {
+		count[s.sum]++
+	}
+	var ec ElemChanges
+	for i, s := range new {
+		if count[s.sum] > 0 {
+			count[s.sum]--
+		} else {
+			ec.Added = append(ec.Added, i)
+		}
+	}
+	// What's left in count is what's in old but not new. Walk old
+	// backwards so that with duplicates, the last ones are removed.
+	for i := len(old) - 1; i >= 0; i-- {
+		if count[old[i].sum] > 0 {
+			count[old[i].sum]--
+			ec.Removed = append(ec.Removed, i)
+		}
+	}
+	for i, j := 0, len(ec.Removed)-1; i < j; i, j = i+1, j-1 {
+		ec.Removed[i], ec.Removed[j] = ec.Removed[j], ec.Removed[i]
+	}
+	return ec
+}
@@ -0,0 +1,204 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package deephash
+
+import (
+	"reflect"
+	"testing"
+
+	"inet.af/netaddr"
+	"tailscale.com/types/key"
+	"tailscale.com/wgengine/wgcfg"
+)
+
+type trackedConfig struct {
+	Name  string
+	Port  int
+	Peers []string
+	Opts  map[string]bool
+}
+
+func TestTracker(t *testing.T) {
+	var tr Tracker[trackedConfig]
+	cfg := trackedConfig{
+		Name:  "a",
+		Port:  1,
+		Peers: []string{"p0", "p1", "p2"},
+	}
+
+	tests := []struct {
+		name   string
+		change func(*trackedConfig)
+		want   Changes
+	}{
+		{
+			name:   "first",
+			change: func(*trackedConfig) {},
+			want: Changes{
+				Fields: []string{"Name", "Port", "Peers", "Opts"},
+				Elems:  map[string]ElemChanges{"Peers": {Added: []int{0, 1, 2}}},
+			},
+		},
+		{
+			name:   "none",
+			change: func(*trackedConfig) {},
+		},
+		{
+			name:   "field",
+			change: func(c *trackedConfig) { c.Port = 2 },
+			want:   Changes{Fields: []string{"Port"}},
+		},
+		{
+			name:   "map",
+			change: func(c *trackedConfig) { c.Opts = map[string]bool{"x": true} },
+			want:   Changes{Fields: []string{"Opts"}},
+		},
+		{
+			name:   "modify-elem",
+			change: func(c *trackedConfig) { c.Peers = []string{"p0", "p1x", "p2"} },
+			want: Changes{
+				Fields: []string{"Peers"},
+				Elems:  map[string]ElemChanges{"Peers": {Added: []int{1}, Removed: []int{1}}},
+			},
+		},
+		{
+			name:   "append",
+			change: func(c *trackedConfig) { c.Peers = append(c.Peers, "p3") },
+			want: Changes{
+				Fields: []string{"Peers"},
+				Elems:  map[string]ElemChanges{"Peers": {Added: []int{3}}},
+			},
+		},
+		{
+			name:   "remove",
+			change: func(c *trackedConfig) { c.Peers = []string{"p0", "p2", "p3"} },
+			want: Changes{
+				Fields: []string{"Peers"},
+				Elems:  map[string]ElemChanges{"Peers": {Removed: []int{1}}},
+			},
+		},
+		{
+			name:   "reorder",
+			change: func(c *trackedConfig) { c.Peers = []string{"p3", "p2", "p0"} },
+			want: Changes{
+				Fields: []string{"Peers"},
+				Elems:  map[string]ElemChanges{"Peers": {}},
+			},
+		},
+		{
+			name:   "duplicates",
+			change: func(c *trackedConfig) { c.Peers = []string{"p3", "p3", "p2", "p0", "p3"} },
+			want: Changes{
+				Fields: []string{"Peers"},
+				Elems:  map[string]ElemChanges{"Peers": {Added: []int{1, 4}}},
+			},
+		},
+		{
+			name:   "dedup",
+			change: func(c *trackedConfig) { c.Peers = []string{"p3", "p2", "p0"} },
+			want: Changes{
+				Fields: []string{"Peers"},
+				Elems:  map[string]ElemChanges{"Peers": {Removed: []int{1, 4}}},
+			},
+		},
+		{
+			name:   "nil-vs-empty",
+			change: func(c *trackedConfig) { c.Peers = nil; c.Name = "b" },
+			want: Changes{
+				Fields: []string{"Name", "Peers"},
+				Elems:  map[string]ElemChanges{"Peers": {Removed: []int{0, 1, 2}}},
+			},
+		},
+		{
+			name:   "empty",
+			change: func(c *trackedConfig) { c.Peers = []string{} },
+			want: Changes{
+				Fields: []string{"Peers"},
+				Elems:  map[string]ElemChanges{"Peers": {}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		tt.change(&cfg)
+		got := tr.Update(&cfg)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %+v; want %+v", tt.name, got, tt.want)
+		}
+		if got.Any() != (len(tt.want.Fields) > 0) {
+			t.Errorf("%s: Any = %v", tt.name, got.Any())
+		}
+	}
+}
+
+func TestTrackerNonStruct(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("no panic")
+		}
+	}()
+	var tr Tracker[int]
+	v := 1
+	tr.Update(&v)
+}
+
+// getPeersConfig returns a wgcfg.Config with n peers.
+func getPeersConfig(n int) *wgcfg.Config {
+	cfg := &wgcfg.Config{
+		Name:      "tailscale0",
+		Addresses: []netaddr.IPPrefix{netaddr.MustParseIPPrefix("100.64.0.1/32")},
+		Peers:     make([]wgcfg.Peer, n),
+	}
+	for i := range cfg.Peers {
+		ip := netaddr.IPv4(100, 64+byte(i>>16), byte(i>>8), byte(i))
+		cfg.Peers[i] = wgcfg.Peer{
+			PublicKey:  key.NewNode().Public(),
+			DiscoKey:   key.NewDisco().Public(),
+			AllowedIPs: []netaddr.IPPrefix{netaddr.IPPrefixFrom(ip, 32)},
+		}
+	}
+	return cfg
+}
+
+func TestTrackerPeers(t *testing.T) {
+	cfg := getPeersConfig(100)
+	var tr Tracker[wgcfg.Config]
+	tr.Update(cfg)
+
+	cfg.Peers[42].DiscoKey = key.NewDisco().Public()
+	got := tr.Update(cfg)
+	want := Changes{
+		Fields: []string{"Peers"},
+		Elems:  map[string]ElemChanges{"Peers": {Added: []int{42}, Removed: []int{42}}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v; want %+v", got, want)
+	}
+	if !got.Changed("Peers") || got.Changed("Addresses") {
+		t.Errorf("Changed wrong for %+v", got)
+	}
+}
+
+func BenchmarkHash10kPeers(b *testing.B) {
+	b.ReportAllocs()
+	cfg := getPeersConfig(10000)
+	for i := 0; i < b.N; i++ {
+		cfg.Peers[i%len(cfg.Peers)].PersistentKeepalive++
+		sink = Hash(cfg)
+	}
+}
+
+func BenchmarkTracker10kPeers(b *testing.B) {
+	b.ReportAllocs()
+	cfg := getPeersConfig(10000)
+	var tr Tracker[wgcfg.Config]
+	tr.Update(cfg)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cfg.Peers[i%len(cfg.Peers)].PersistentKeepalive++
+		if c := tr.Update(cfg); len(c.Elems["Peers"].Added) != 1 {
+			b.Fatalf("unexpected changes: %+v", c)
+		}
+	}
+}
@@ -299,6 +299,12 @@ func (f *Filter) logRateLimit(runflags RunFlags, q *packet.Parsed, dir direction
 // CheckTCP determines whether TCP traffic from srcIP to dstIP:dstPort
 // is allowed.
 func (f *Filter) CheckTCP(srcIP, dstIP netaddr.IP, dstPort uint16) Response {
+	return f.Check(srcIP, dstIP, dstPort, ipproto.TCP)
+}
+
+// Check determines whether new traffic of protocol proto from srcIP
+// to dstIP:dstPort is allowed. For TCP, that's a SYN packet.
+func (f *Filter) Check(srcIP, dstIP netaddr.IP, dstPort uint16, proto ipproto.Proto) Response {
 	pkt := &packet.Parsed{}
 	pkt.Decode(dummyPacket) // initialize private fields
 	switch {
@@ -315,8 +321,10 @@ func (f *Filter) CheckTCP(srcIP, dstIP netaddr.IP, dstPort uint16) Response {
 	}
 	pkt.Src = netaddr.IPPortFrom(srcIP, 0)
 	pkt.Dst = netaddr.IPPortFrom(dstIP, dstPort)
-	pkt.IPProto = ipproto.TCP
-	pkt.TCPFlags = packet.TCPSyn
+	pkt.IPProto = proto
+	if proto == ipproto.TCP {
+		pkt.TCPFlags = packet.TCPSyn
+	}
 
 	return f.RunIn(pkt, 0)
 }
@@ -152,6 +152,9 @@ type InOut struct {
 			if got, why := aclFunc(&test.p); test.want != got {
 				t.Errorf("#%d runIn (UDP) got=%v want=%v why=%q packet:%v", i, got, test.want, why, test.p)
 			}
+			if got := acl.Check(test.p.Src.IP(), test.p.Dst.IP(), test.p.Dst.Port(), ipproto.UDP); test.want != got {
+				t.Errorf("#%d Check (UDP) got=%v want=%v packet:%v", i, got, test.want, test.p)
+			}
 		}
 		// Update UDP state
 		_, _ = acl.runOut(&test.p)
@@ -2299,7 +2299,7 @@ func nodesEqual(x, y []*tailcfg.Node) bool {
 		return false
 	}
 	for i := range x {
-		if !x[i].Equal(y[i]) {
+		if x[i] != y[i] && !x[i].Equal(y[i]) {
 			return false
 		}
 	}
@@ -2336,6 +2336,10 @@ func (c *Conn) SetNetworkMap(nm *netmap.NetworkMap) {
 	if numNoDisco != 0 {
 		c.logf("[v1] magicsock: %d DERP-only peers (no discokey)", numNoDisco)
 	}
+	var oldPeers []*tailcfg.Node // sorted by Node.ID
+	if c.netMap != nil {
+		oldPeers = c.netMap.Peers
+	}
 	c.netMap = nm
 
 	// Try a pass of just upserting nodes and creating missing
@@ -2344,7 +2348,17 @@ func (c *Conn) SetNetworkMap(nm *netmap.NetworkMap) {
 	// we'll fall through to the next pass, which allocates but can
 	// handle full set updates.
 	for _, n := range nm.Peers {
+		// Nodes carried over unchanged from the previous netmap
+		// (controlclient shares them between netmaps) are already
+		// up to date.
+		for len(oldPeers) > 0 && oldPeers[0].ID < n.ID {
+			oldPeers = oldPeers[1:]
+		}
+		unchanged := len(oldPeers) > 0 && oldPeers[0] == n
 		if ep, ok := c.peerMap.endpointForNodeKey(n.Key); ok {
+			if unchanged {
+				continue
+			}
 			oldDiscoKey := ep.discoKey
 			ep.updateFromNode(n)
 			c.peerMap.upsertEndpoint(ep, oldDiscoKey) // maybe update discokey mappings in peerMap
@@ -526,7 +526,10 @@ func (ns *Impl) peerAPIPortAtomic(ip netaddr.IP) *uint32 {
 	}
 }
 
-var viaRange = tsaddr.TailscaleViaRange()
+var (
+	viaRange   = tsaddr.TailscaleViaRange()
+	nat64Range = tsaddr.TailscaleNAT64Range()
+)
 
 // shouldProcessInbound reports whether an inbound packet (a packet from a
 // WireGuard peer) should be handled by netstack.
@@ -553,6 +556,11 @@ func (ns *Impl) shouldProcessInbound(p *packet.Parsed, t *tstun.Wrapper) bool {
 	if p.IPVersion == 6 && viaRange.Contains(p.Dst.IP()) {
 		return ns.lb != nil && ns.lb.ShouldHandleViaIP(p.Dst.IP())
 	}
+	if p.IPVersion == 6 && nat64Range.Contains(p.Dst.IP()) {
+		// Only TCP and UDP are forwarded to the embedded IPv4
+		// address; ICMP to NAT64 addresses isn't handled.
+		return ns.lb != nil && ns.lb.ShouldHandleNAT64IP(p.Dst.IP())
+	}
 	if !ns.ProcessLocalIPs && !ns.ProcessSubnets {
 		// Fast path for common case (e.g. Linux server in TUN mode) where
 		// netstack isn't used at all; don't even do an isLocalIP lookup.
@@ -726,19 +734,24 @@ func (ns *Impl) acceptTCP(r *tcp.ForwarderRequest) {
 		return
 	}
 
-	dialIP := netaddrIPFromNetstackIP(reqDetails.LocalAddress)
+	localIP := netaddrIPFromNetstackIP(reqDetails.LocalAddress)
+	dialIP := localIP
 	isTailscaleIP := tsaddr.IsTailscaleIP(dialIP)
 
-	if viaRange.Contains(dialIP) {
+	switch {
+	case viaRange.Contains(dialIP):
 		isTailscaleIP = false
 		dialIP = tsaddr.UnmapVia(dialIP)
+	case nat64Range.Contains(dialIP):
+		isTailscaleIP = false
+		dialIP = tsaddr.UnmapNAT64(dialIP)
 	}
 
 	defer func() {
 		if !isTailscaleIP {
 			// if this is a subnet IP, we added this in before the TCP handshake
 			// so netstack is happy TCP-handshaking as a subnet IP
-			ns.removeSubnetAddress(dialIP)
+			ns.removeSubnetAddress(localIP)
 		}
 	}()
 	var wq waiter.Queue
@@ -954,8 +967,11 @@ func (ns *Impl) forwardUDP(client *gonet.UDPConn, wq *waiter.Queue, clientAddr,
 		backendRemoteAddr = &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: int(port)}
 		backendListenAddr = &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: int(srcPort)}
 	} else {
-		if dstIP := dstAddr.IP(); viaRange.Contains(dstIP) {
+		switch dstIP := dstAddr.IP(); {
+		case viaRange.Contains(dstIP):
 			dstAddr = netaddr.IPPortFrom(tsaddr.UnmapVia(dstIP), dstAddr.Port())
+		case nat64Range.Contains(dstIP):
+			dstAddr = netaddr.IPPortFrom(tsaddr.UnmapNAT64(dstIP), dstAddr.Port())
 		}
 		backendRemoteAddr = dstAddr.UDPAddr()
 		if dstAddr.IP().Is4() {
@@ -5,14 +5,24 @@
 package netstack
 
 import (
+	"net"
 	"runtime"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"gvisor.dev/gvisor/pkg/refs"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
 	"inet.af/netaddr"
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnlocal"
+	"tailscale.com/ipn/store/mem"
 	"tailscale.com/net/packet"
+	"tailscale.com/net/tsaddr"
 	"tailscale.com/net/tsdial"
 	"tailscale.com/net/tstun"
+	"tailscale.com/types/ipproto"
 	"tailscale.com/wgengine"
 	"tailscale.com/wgengine/filter"
 )
@@ -84,3 +94,215 @@ func TestNetstackLeakMode(t *testing.T) {
 		t.Fatalf("refs.leakMode is 0, want a non-zero value")
 	}
 }
+
+// newNAT64TestImpl returns a netstack Impl with a LocalBackend, for
+// testing NAT64. The packets netstack sends can be read from the
+// returned Wrapper, which the engine doesn't use.
+func newNAT64TestImpl(t *testing.T) (*Impl, *tstun.Wrapper, *ipnlocal.LocalBackend) {
+	// Forwarding goroutines may log after the test is done.
+	var done int32
+	logf := func(format string, args ...any) {
+		if !t.Failed() && atomic.LoadInt32(&done) == 0 {
+			t.Logf(format, args...)
+		}
+	}
+	tunDev := tstun.NewFake()
+	dialer := new(tsdial.Dialer)
+	eng, err := wgengine.NewUserspaceEngine(logf, wgengine.Config{
+		Tun:    tunDev,
+		Dialer: dialer,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(eng.Close)
+	ig, ok := eng.(wgengine.InternalsGetter)
+	if !ok {
+		t.Fatal("not an InternalsGetter")
+	}
+	_, magicSock, dns, ok := ig.GetInternals()
+	if !ok {
+		t.Fatal("failed to get internals")
+	}
+	tunWrap := tstun.Wrap(logf, tstun.NewFake())
+	t.Cleanup(func() { tunWrap.Close() })
+	ns, err := Create(logf, tunWrap, eng, magicSock, dialer, dns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ns.Close() })
+
+	lb, err := ipnlocal.NewLocalBackend(logf, "logid", new(mem.Store), dialer, eng, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(lb.Shutdown)
+	if err := lb.Start(ipn.Options{StateKey: ipn.GlobalDaemonStateKey}); err != nil {
+		t.Fatal(err)
+	}
+	ns.SetLocalBackend(lb)
+	t.Cleanup(func() { atomic.StoreInt32(&done, 1) })
+	return ns, tunWrap, lb
+}
+
+// setNAT64Prefs sets lb's advertised routes to route, and whether it
+// advertises them via NAT64.
+func setNAT64Prefs(t *testing.T, lb *ipnlocal.LocalBackend, route string, nat64 bool) {
+	t.Helper()
+	_, err := lb.EditPrefs(&ipn.MaskedPrefs{
+		Prefs: ipn.Prefs{
+			AdvertiseRoutes: []netaddr.IPPrefix{netaddr.MustParseIPPrefix(route)},
+			AdvertiseNAT64:  nat64,
+		},
+		AdvertiseRoutesSet: true,
+		AdvertiseNAT64Set:  true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// nat64TestPeer is the source of the test packets to NAT64 addresses.
+var nat64TestPeer = netaddr.MustParseIPPort("[fd7a:115c:a1e0::1]:12345")
+
+func nat64UDPPacket(dst netaddr.IPPort, payload []byte) *packet.Parsed {
+	b := packet.Generate(packet.UDP6Header{
+		IP6Header: packet.IP6Header{
+			IPProto: ipproto.UDP,
+			Src:     nat64TestPeer.IP(),
+			Dst:     dst.IP(),
+		},
+		SrcPort: nat64TestPeer.Port(),
+		DstPort: dst.Port(),
+	}, payload)
+	p := new(packet.Parsed)
+	p.Decode(b)
+	return p
+}
+
+func nat64TCPPacket(dst netaddr.IPPort, flags header.TCPFlags, seq, ack uint32) *packet.Parsed {
+	tcp := header.TCP(make([]byte, header.TCPMinimumSize))
+	tcp.Encode(&header.TCPFields{
+		SrcPort:    nat64TestPeer.Port(),
+		DstPort:    dst.Port(),
+		SeqNum:     seq,
+		AckNum:     ack,
+		DataOffset: header.TCPMinimumSize,
+		Flags:      flags,
+		WindowSize: 65535,
+	})
+	src, dstIP := nat64TestPeer.IP().As16(), dst.IP().As16()
+	xsum := header.PseudoHeaderChecksum(header.TCPProtocolNumber, tcpip.Address(src[:]), tcpip.Address(dstIP[:]), uint16(len(tcp)))
+	tcp.SetChecksum(^tcp.CalculateChecksum(xsum))
+
+	b := packet.Generate(packet.IP6Header{
+		IPProto: ipproto.TCP,
+		Src:     nat64TestPeer.IP(),
+		Dst:     dst.IP(),
+	}, tcp)
+	p := new(packet.Parsed)
+	p.Decode(b)
+	return p
+}
+
+// TestShouldProcessInboundNAT64 tests that netstack handles packets to
+// the Tailscale NAT64 addresses of the subnets this node advertises
+// with NAT64, and only those.
+func TestShouldProcessInboundNAT64(t *testing.T) {
+	ns, tunWrap, lb := newNAT64TestImpl(t)
+
+	tests := []struct {
+		dst   string
+		nat64 bool
+		want  bool
+	}{
+		{"fd7a:115c:a1e0:64::c0a8:101", true, true},   // 192.168.1.1
+		{"fd7a:115c:a1e0:64::c0a8:201", true, false},  // 192.168.2.1, not advertised
+		{"fd7a:115c:a1e0:64::c0a8:101", false, false}, // NAT64 not advertised
+	}
+	for _, tt := range tests {
+		setNAT64Prefs(t, lb, "192.168.1.0/24", tt.nat64)
+		p := nat64UDPPacket(netaddr.IPPortFrom(netaddr.MustParseIP(tt.dst), 53), []byte("payload"))
+		if got := ns.shouldProcessInbound(p, tunWrap); got != tt.want {
+			t.Errorf("shouldProcessInbound(%v) with nat64=%v = %v; want %v", tt.dst, tt.nat64, got, tt.want)
+		}
+	}
+}
+
+// TestNAT64Forwarding tests that TCP and UDP traffic to a Tailscale
+// NAT64 address reaches the IPv4 address embedded in it.
+func TestNAT64Forwarding(t *testing.T) {
+	ns, tunWrap, lb := newNAT64TestImpl(t)
+	if err := ns.Start(); err != nil {
+		t.Fatal(err)
+	}
+	setNAT64Prefs(t, lb, "127.0.0.0/8", true)
+	nat64Loopback := tsaddr.MapNAT64(netaddr.IPv4(127, 0, 0, 1))
+
+	t.Run("tcp", func(t *testing.T) {
+		ln, err := net.Listen("tcp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		accepted := make(chan error, 1)
+		go func() {
+			c, err := ln.Accept()
+			if err == nil {
+				c.Close()
+			}
+			accepted <- err
+		}()
+
+		// Netstack completes the handshake before forwarding.
+		dst := netaddr.IPPortFrom(nat64Loopback, uint16(ln.Addr().(*net.TCPAddr).Port))
+		if got := ns.injectInbound(nat64TCPPacket(dst, header.TCPFlagSyn, 1, 0), tunWrap); got != filter.DropSilently {
+			t.Fatalf("injectInbound = %v; want %v", got, filter.DropSilently)
+		}
+		var synAck header.TCP
+		buf := make([]byte, tstun.MaxPacketSize)
+		for synAck == nil {
+			n, err := tunWrap.Read(buf, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var p packet.Parsed
+			p.Decode(buf[:n])
+			if p.IPProto == ipproto.TCP && p.TCPFlags&packet.TCPSynAck == packet.TCPSynAck {
+				synAck = header.TCP(p.Transport())
+			}
+		}
+		ns.injectInbound(nat64TCPPacket(dst, header.TCPFlagAck, 2, synAck.SequenceNumber()+1), tunWrap)
+		select {
+		case err := <-accepted:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("connection not forwarded to 127.0.0.1")
+		}
+	})
+
+	t.Run("udp", func(t *testing.T) {
+		pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer pc.Close()
+
+		port := uint16(pc.LocalAddr().(*net.UDPAddr).Port)
+		p := nat64UDPPacket(netaddr.IPPortFrom(nat64Loopback, port), []byte("hello"))
+		if got := ns.injectInbound(p, tunWrap); got != filter.DropSilently {
+			t.Fatalf("injectInbound = %v; want %v", got, filter.DropSilently)
+		}
+		pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 100)
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("datagram not forwarded to 127.0.0.1: %v", err)
+		}
+		if got := string(buf[:n]); got != "hello" {
+			t.Errorf("got %q; want %q", got, "hello")
+		}
+	})
+}
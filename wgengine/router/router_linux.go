@@ -292,7 +292,16 @@ func (r *linuxRouter) Set(cfg *Config) error {
 		errs = append(errs, err)
 	}
 
-	newLocalRoutes, err := cidrDiff("localRoute", r.localRoutes, cfg.LocalRoutes, r.addThrowRoute, r.delThrowRoute, r.logf)
+	// A throw route would replace a route into Tailscale for the same
+	// prefix in our table, so such local routes are skipped: as with
+	// more specific routes, the route via the peer wins.
+	localRoutes := make([]netaddr.IPPrefix, 0, len(cfg.LocalRoutes))
+	for _, lr := range cfg.LocalRoutes {
+		if !containsPrefix(cfg.Routes, lr) {
+			localRoutes = append(localRoutes, lr)
+		}
+	}
+	newLocalRoutes, err := cidrDiff("localRoute", r.localRoutes, localRoutes, r.addThrowRoute, r.delThrowRoute, r.logf)
 	if err != nil {
 		errs = append(errs, err)
 	}
@@ -1433,6 +1442,16 @@ func cidrDiff(kind string, old map[netaddr.IPPrefix]bool, new []netaddr.IPPrefix
 	return ret, nil
 }
 
+// containsPrefix reports whether pp contains p.
+func containsPrefix(pp []netaddr.IPPrefix, p netaddr.IPPrefix) bool {
+	for _, q := range pp {
+		if q == p {
+			return true
+		}
+	}
+	return false
+}
+
 // tsChain returns the name of the tailscale sub-chain corresponding
 // to the given "parent" chain (e.g. INPUT, FORWARD, ...).
 func tsChain(chain string) string {
@@ -315,6 +315,23 @@ func TestRouterStates(t *testing.T) {
 ip route add throw 10.0.0.0/8 table 52
 ip route add throw 192.168.0.0/24 table 52` + basic,
 		},
+		{
+			name: "local routes overlapping routes",
+			in: &Config{
+				LocalAddrs:    mustCIDRs("100.101.102.104/10"),
+				Routes:        mustCIDRs("100.100.100.100/32", "0.0.0.0/0", "192.168.0.0/24"),
+				LocalRoutes:   mustCIDRs("10.0.0.0/8", "192.168.0.0/24", "192.168.0.128/25"),
+				NetfilterMode: netfilterOff,
+			},
+			want: `
+up
+ip addr add 100.101.102.104/10 dev tailscale0
+ip route add 0.0.0.0/0 dev tailscale0 table 52
+ip route add 100.100.100.100/32 dev tailscale0 table 52
+ip route add 192.168.0.0/24 dev tailscale0 table 52
+ip route add throw 10.0.0.0/8 table 52
+ip route add throw 192.168.0.128/25 table 52` + basic,
+		},
 	}
 
 	mon, err := monitor.New(logger.Discard)
@@ -117,8 +117,11 @@ type userspaceEngine struct {
 	lastCfgFull         wgcfg.Config
 	lastNMinPeers       int
 	lastRouterSig       deephash.Sum // of router.Config
-	lastEngineSigFull   deephash.Sum // of full wireguard config
-	lastEngineSigTrim   deephash.Sum // of trimmed wireguard config
+	lastDNSSig          deephash.Sum // of dns.Config
+	engineCfgTracker    deephash.Tracker[wgcfg.Config]
+	fullCfgChanged      bool             // lastCfgFull changed since wgdev was last configured
+	lastMinPeers        []key.NodePublic // peers in the trimmed config wgdev was last given
+	lastCfgMin          *wgcfg.Config    // trimmed config wgdev was last given, or nil if unknown
 	lastDNSConfig       *dns.Config
 	lastIsSubnetRouter  bool // was the node a primary subnet router in the last run.
 	recvActivityAt      map[key.NodePublic]mono.Time
@@ -704,10 +707,18 @@ func (e *userspaceEngine) maybeReconfigWireguardLocked(discoChanged map[key.Node
 	}
 	e.lastNMinPeers = len(min.Peers)
 
-	if !deephash.Update(&e.lastEngineSigTrim, &min, trimmedNodes, trackNodes, trackIPs) {
+	// trimmedNodes, trackNodes and trackIPs are all derived from the
+	// full config and the set of peers kept in min, so only those
+	// need comparing.
+	if !e.fullCfgChanged && sameMinPeers(e.lastMinPeers, min.Peers) {
 		// No changes
 		return nil
 	}
+	e.fullCfgChanged = false
+	e.lastMinPeers = e.lastMinPeers[:0]
+	for _, p := range min.Peers {
+		e.lastMinPeers = append(e.lastMinPeers, p.PublicKey)
+	}
 
 	e.trimmedNodes = trimmedNodes
 
@@ -726,21 +737,53 @@ func (e *userspaceEngine) maybeReconfigWireguardLocked(discoChanged map[key.Node
 		}
 		if numRemove > 0 {
 			e.logf("wgengine: Reconfig: removing session keys for %d peers", numRemove)
-			if err := wgcfg.ReconfigDevice(e.wgdev, &minner, e.logf); err != nil {
-				e.logf("wgdev.Reconfig: %v", err)
+			if err := e.reconfigDeviceLocked(&minner); err != nil {
 				return err
 			}
 		}
 	}
 
 	e.logf("wgengine: Reconfig: configuring userspace WireGuard config (with %d/%d peers)", len(min.Peers), len(full.Peers))
-	if err := wgcfg.ReconfigDevice(e.wgdev, &min, e.logf); err != nil {
+	return e.reconfigDeviceLocked(&min)
+}
+
+// reconfigDeviceLocked sends wgdev the changes from the config it was
+// last given to cfg, without reading its config back when that's
+// known. On failure, the device's config is read back next time.
+//
+// e.wgLock must be held.
+func (e *userspaceEngine) reconfigDeviceLocked(cfg *wgcfg.Config) error {
+	var err error
+	if e.lastCfgMin != nil {
+		err = wgcfg.ReconfigDeviceFrom(e.wgdev, e.lastCfgMin, cfg, e.logf)
+	} else {
+		err = wgcfg.ReconfigDevice(e.wgdev, cfg, e.logf)
+	}
+	if err != nil {
 		e.logf("wgdev.Reconfig: %v", err)
+		e.lastCfgMin = nil
+		e.lastMinPeers = nil
+		e.fullCfgChanged = true
 		return err
 	}
+	e.lastCfgMin = cfg.Clone()
 	return nil
 }
 
+// sameMinPeers reports whether peers has the same public keys, in the
+// same order, as keys.
+func sameMinPeers(keys []key.NodePublic, peers []wgcfg.Peer) bool {
+	if len(keys) != len(peers) {
+		return false
+	}
+	for i := range peers {
+		if peers[i].PublicKey != keys[i] {
+			return false
+		}
+	}
+	return true
+}
+
 // updateActivityMapsLocked updates the data structures used for tracking the activity
 // of wireguard peers that we might add/remove dynamically from the real config
 // as given to wireguard-go.
@@ -855,9 +898,10 @@ func (e *userspaceEngine) Reconfig(cfg *wgcfg.Config, routerCfg *router.Config,
 	}
 	isSubnetRouterChanged := isSubnetRouter != e.lastIsSubnetRouter
 
-	engineChanged := deephash.Update(&e.lastEngineSigFull, cfg)
-	routerChanged := deephash.Update(&e.lastRouterSig, routerCfg, dnsCfg)
-	if !engineChanged && !routerChanged && listenPort == e.magicConn.LocalPort() && !isSubnetRouterChanged {
+	engineChanges := e.engineCfgTracker.Update(cfg)
+	routerChanged := deephash.Update(&e.lastRouterSig, routerCfg)
+	dnsChanged := deephash.Update(&e.lastDNSSig, dnsCfg)
+	if !engineChanges.Any() && !routerChanged && !dnsChanged && listenPort == e.magicConn.LocalPort() && !isSubnetRouterChanged {
 		return ErrNoChanges
 	}
 
@@ -872,15 +916,16 @@ func (e *userspaceEngine) Reconfig(cfg *wgcfg.Config, routerCfg *router.Config,
 	// If so, we need to update the wireguard-go/device.Device in two phases:
 	// once without the node which has restarted, to clear its wireguard session key,
 	// and a second time with it.
+	// Only peers that changed at all need to be looked at.
 	discoChanged := make(map[key.NodePublic]bool)
-	{
+	if pc, ok := engineChanges.Elems["Peers"]; ok {
 		prevEP := make(map[key.NodePublic]key.DiscoPublic)
-		for i := range e.lastCfgFull.Peers {
+		for _, i := range pc.Removed {
 			if p := &e.lastCfgFull.Peers[i]; !p.DiscoKey.IsZero() {
 				prevEP[p.PublicKey] = p.DiscoKey
 			}
 		}
-		for i := range cfg.Peers {
+		for _, i := range pc.Added {
 			p := &cfg.Peers[i]
 			if p.DiscoKey.IsZero() {
 				continue
@@ -894,6 +939,9 @@ func (e *userspaceEngine) Reconfig(cfg *wgcfg.Config, routerCfg *router.Config,
 	}
 
 	e.lastCfgFull = *cfg.Clone()
+	if engineChanges.Any() {
+		e.fullCfgChanged = true
+	}
 
 	// Tell magicsock about the new (or initial) private key
 	// (which is needed by DERP) before wgdev gets it, as wgdev
@@ -919,11 +967,13 @@ func (e *userspaceEngine) Reconfig(cfg *wgcfg.Config, routerCfg *router.Config,
 		if err != nil {
 			return err
 		}
+	}
+	if routerChanged || dnsChanged {
 		// Keep DNS configuration after router configuration, as some
 		// DNS managers refuse to apply settings if the device has no
 		// assigned address.
 		e.logf("wgengine: Reconfig: configuring DNS")
-		err = e.dns.Set(*dnsCfg)
+		err := e.dns.Set(*dnsCfg)
 		health.SetDNSHealth(err)
 		if err != nil {
 			return err
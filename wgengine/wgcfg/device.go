@@ -54,7 +54,29 @@ func ReconfigDevice(d *device.Device, cfg *Config, logf logger.Logf) (err error)
 	if err != nil {
 		return err
 	}
+	return reconfigDevice(d, prev, cfg, logf)
+}
+
+// ReconfigDeviceFrom is like ReconfigDevice, but takes the config d
+// was last successfully given as prev rather than reading it from d,
+// so only the peers that differ between prev and cfg are sent to d.
+func ReconfigDeviceFrom(d *device.Device, prev, cfg *Config, logf logger.Logf) (err error) {
+	defer func() {
+		if err != nil {
+			logf("wgcfg.Reconfig failed: %v", err)
+		}
+	}()
+	// ToUAPI set each of prev's peers' endpoint to its public key.
+	applied := *prev
+	applied.Peers = make([]Peer, len(prev.Peers))
+	for i, p := range prev.Peers {
+		p.WGEndpoint = p.PublicKey
+		applied.Peers[i] = p
+	}
+	return reconfigDevice(d, &applied, cfg, logf)
+}
 
+func reconfigDevice(d *device.Device, prev, cfg *Config, logf logger.Logf) error {
 	r, w := io.Pipe()
 	errc := make(chan error, 1)
 	go func() {
@@ -199,6 +199,45 @@ func TestDeviceConfig(t *testing.T) {
 			t.Error("reconfig failed to remove peer")
 		}
 	})
+
+	t.Run("device1 reconfig from prev", func(t *testing.T) {
+		prev := cfg1.Clone()
+		cfg1.Peers = []Peer{
+			{PublicKey: k2, AllowedIPs: []netaddr.IPPrefix{ip2}, PersistentKeepalive: 25},
+			{PublicKey: k3, AllowedIPs: []netaddr.IPPrefix{ip3}},
+		}
+		sort.Slice(cfg1.Peers, func(i, j int) bool {
+			return cfg1.Peers[i].PublicKey.Less(cfg1.Peers[j].PublicKey)
+		})
+		if err := ReconfigDeviceFrom(device1, prev, cfg1, t.Logf); err != nil {
+			t.Fatal(err)
+		}
+		cmp(t, device1, cfg1)
+	})
+}
+
+func TestToUAPIUnchangedPeers(t *testing.T) {
+	k1, k2 := key.NewNode().Public(), key.NewNode().Public()
+	peer := func(k key.NodePublic, ip string) Peer {
+		return Peer{
+			PublicKey:  k,
+			WGEndpoint: k,
+			AllowedIPs: []netaddr.IPPrefix{netaddr.MustParseIPPrefix(ip)},
+		}
+	}
+	prev := &Config{Peers: []Peer{peer(k1, "10.0.0.1/32"), peer(k2, "10.0.0.2/32")}}
+	cfg := &Config{Peers: []Peer{peer(k1, "10.0.0.1/32"), peer(k2, "10.0.0.3/32")}}
+	var buf strings.Builder
+	if err := cfg.ToUAPI(t.Logf, &buf, prev); err != nil {
+		t.Fatal(err)
+	}
+	got := buf.String()
+	if strings.Contains(got, k1.UntypedHexString()) {
+		t.Errorf("unchanged peer was written:\n%s", got)
+	}
+	if want := "allowed_ip=10.0.0.3/32\n"; !strings.Contains(got, want) {
+		t.Errorf("missing %q:\n%s", want, got)
+	}
 }
 
 // TODO: replace with a loopback tunnel
@@ -8,6 +8,7 @@
 import (
 	"bytes"
 	"fmt"
+	"sort"
 	"strings"
 
 	"inet.af/netaddr"
@@ -15,6 +16,7 @@
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/logger"
 	"tailscale.com/types/netmap"
+	"tailscale.com/util/mak"
 	"tailscale.com/wgengine/wgcfg"
 )
 
@@ -49,8 +51,77 @@ func cidrIsSubnet(node *tailcfg.Node, cidr netaddr.IPPrefix) bool {
 	return true
 }
 
+// SubnetRouterCandidates returns, for each subnet route that more than
+// one peer in nm offers, the peers offering it in order of preference:
+// control's primary router for it first, then the others by node ID.
+//
+// A peer offers a route only if control put the route in its
+// AllowedIPs, which it does for every router it approved for the
+// route, marking the one to use by default in PrimaryRoutes. Routes a
+// peer merely advertises in its Hostinfo.RoutableIPs don't count, as
+// any node can claim those.
+func SubnetRouterCandidates(nm *netmap.NetworkMap) map[netaddr.IPPrefix][]*tailcfg.Node {
+	var all map[netaddr.IPPrefix][]*tailcfg.Node
+	for _, peer := range nm.Peers {
+		for _, r := range peer.AllowedIPs {
+			if cidrIsSubnet(peer, r) && !hasNode(all[r], peer.StableID) {
+				mak.Set(&all, r, append(all[r], peer))
+			}
+		}
+	}
+	ret := map[netaddr.IPPrefix][]*tailcfg.Node{}
+	for r, peers := range all {
+		if len(peers) < 2 {
+			continue
+		}
+		sort.SliceStable(peers, func(i, j int) bool {
+			ri, rj := routerRank(peers[i], r), routerRank(peers[j], r)
+			if ri != rj {
+				return ri < rj
+			}
+			return peers[i].ID < peers[j].ID
+		})
+		ret[r] = peers
+	}
+	return ret
+}
+
+// routerRank returns how preferred n is as the router for r, lowest
+// first: control's primary for r, or another router approved for r.
+func routerRank(n *tailcfg.Node, r netaddr.IPPrefix) int {
+	if containsPrefix(n.PrimaryRoutes, r) {
+		return 0
+	}
+	return 1
+}
+
+func containsPrefix(ps []netaddr.IPPrefix, p netaddr.IPPrefix) bool {
+	for _, q := range ps {
+		if q == p {
+			return true
+		}
+	}
+	return false
+}
+
+func hasNode(nodes []*tailcfg.Node, id tailcfg.StableNodeID) bool {
+	for _, n := range nodes {
+		if n.StableID == id {
+			return true
+		}
+	}
+	return false
+}
+
 // WGCfg returns the NetworkMaps's WireGuard configuration.
-func WGCfg(nm *netmap.NetworkMap, logf logger.Logf, flags netmap.WGConfigFlags, exitNode tailcfg.StableNodeID) (*wgcfg.Config, error) {
+//
+// subnetRouters optionally selects, for subnet routes that more than
+// one peer offers, which of them to route via. Routes offered by
+// several peers that aren't in subnetRouters are routed via the first
+// of SubnetRouterCandidates, as are those whose selected peer no
+// longer offers them. Only the selected peer gets such a route in its
+// AllowedIPs.
+func WGCfg(nm *netmap.NetworkMap, logf logger.Logf, flags netmap.WGConfigFlags, exitNode tailcfg.StableNodeID, subnetRouters map[netaddr.IPPrefix]tailcfg.StableNodeID) (*wgcfg.Config, error) {
 	cfg := &wgcfg.Config{
 		Name:       "tailscale",
 		PrivateKey: nm.PrivateKey,
@@ -62,6 +133,19 @@ func WGCfg(nm *netmap.NetworkMap, logf logger.Logf, flags netmap.WGConfigFlags,
 	skippedUnselected := new(bytes.Buffer)
 	skippedIPs := new(bytes.Buffer)
 	skippedSubnets := new(bytes.Buffer)
+	skippedStandby := new(bytes.Buffer)
+
+	// selected is the peer to route each shared subnet route via.
+	var selected map[netaddr.IPPrefix]tailcfg.StableNodeID
+	if flags&netmap.AllowSubnetRoutes != 0 {
+		for r, cands := range SubnetRouterCandidates(nm) {
+			want, ok := subnetRouters[r]
+			if !ok || !hasNode(cands, want) {
+				want = cands[0].StableID
+			}
+			mak.Set(&selected, r, want)
+		}
+	}
 
 	for _, peer := range nm.Peers {
 		if peer.DiscoKey.IsZero() && peer.DERP == "" {
@@ -106,6 +190,15 @@ func WGCfg(nm *netmap.NetworkMap, logf logger.Logf, flags netmap.WGConfigFlags,
 					fmt.Fprintf(skippedSubnets, "%v from %q (%v)", allowedIP, nodeDebugName(peer), peer.Key.ShortString())
 					continue
 				}
+				if want, ok := selected[allowedIP]; ok {
+					if peer.StableID != want {
+						if skippedStandby.Len() > 0 {
+							skippedStandby.WriteString(", ")
+						}
+						fmt.Fprintf(skippedStandby, "%v from %q (%v)", allowedIP, nodeDebugName(peer), peer.Key.ShortString())
+						continue
+					}
+				}
 			}
 			cpeer.AllowedIPs = append(cpeer.AllowedIPs, allowedIP)
 		}
@@ -120,6 +213,9 @@ func WGCfg(nm *netmap.NetworkMap, logf logger.Logf, flags netmap.WGConfigFlags,
 	if skippedSubnets.Len() > 0 {
 		logf("[v1] wgcfg: did not accept subnet routes: %s", skippedSubnets)
 	}
+	if skippedStandby.Len() > 0 {
+		logf("[v1] wgcfg: standby subnet routes: %s", skippedStandby)
+	}
 
 	return cfg, nil
 }
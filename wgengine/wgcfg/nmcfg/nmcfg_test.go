@@ -0,0 +1,113 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nmcfg
+
+import (
+	"reflect"
+	"testing"
+
+	"inet.af/netaddr"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+	"tailscale.com/types/logger"
+	"tailscale.com/types/netmap"
+)
+
+func TestSubnetRouterCandidates(t *testing.T) {
+	shared := netaddr.MustParseIPPrefix("10.0.0.0/24")
+	own := netaddr.MustParseIPPrefix("10.1.0.0/24")
+	unapproved := netaddr.MustParseIPPrefix("10.2.0.0/24")
+	// peer returns a node that advertises the routes advertised, of
+	// which control approved it for approved and made it the primary
+	// router for primary, as control does: approved routes are in
+	// AllowedIPs, and primary ones also in PrimaryRoutes.
+	peer := func(id tailcfg.NodeID, ip string, primary, approved, advertised []netaddr.IPPrefix) *tailcfg.Node {
+		addr := netaddr.MustParseIPPrefix(ip + "/32")
+		return &tailcfg.Node{
+			ID:            id,
+			Name:          ip + ".ts.net.",
+			StableID:      tailcfg.StableNodeID(ip),
+			Key:           key.NewNode().Public(),
+			DiscoKey:      key.NewDisco().Public(),
+			Addresses:     []netaddr.IPPrefix{addr},
+			AllowedIPs:    append([]netaddr.IPPrefix{addr}, approved...),
+			PrimaryRoutes: primary,
+			Hostinfo:      (&tailcfg.Hostinfo{RoutableIPs: advertised}).View(),
+		}
+	}
+	routes := func(rs ...netaddr.IPPrefix) []netaddr.IPPrefix { return rs }
+	nm := &netmap.NetworkMap{
+		Peers: []*tailcfg.Node{
+			peer(1, "100.64.0.1", nil, routes(shared), routes(shared)),
+			peer(2, "100.64.0.2", routes(shared), routes(shared), routes(shared)),
+			peer(3, "100.64.0.3", routes(own), routes(shared, own), routes(shared, own, unapproved)),
+			peer(4, "100.64.0.4", nil, nil, nil),
+			peer(5, "100.64.0.5", nil, nil, routes(unapproved)),
+			// Advertises the shared route, but isn't approved for it.
+			peer(6, "100.64.0.6", nil, nil, routes(shared)),
+		},
+	}
+
+	cands := SubnetRouterCandidates(nm)
+	var got []tailcfg.NodeID
+	for _, n := range cands[shared] {
+		got = append(got, n.ID)
+	}
+	if want := []tailcfg.NodeID{2, 1, 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("candidates for %v = %v; want %v", shared, got, want)
+	}
+	if len(cands) != 1 {
+		t.Errorf("got candidates for %d routes; want 1", len(cands))
+	}
+
+	routerFor := func(subnetRouters map[netaddr.IPPrefix]tailcfg.StableNodeID) []tailcfg.StableNodeID {
+		cfg, err := WGCfg(nm, logger.Discard, netmap.AllowSingleHosts|netmap.AllowSubnetRoutes, "", subnetRouters)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ret []tailcfg.StableNodeID
+		for i, p := range cfg.Peers {
+			for _, r := range p.AllowedIPs {
+				if r == shared {
+					ret = append(ret, nm.Peers[i].StableID)
+				}
+			}
+		}
+		return ret
+	}
+	tests := []struct {
+		name          string
+		subnetRouters map[netaddr.IPPrefix]tailcfg.StableNodeID
+		want          tailcfg.StableNodeID
+	}{
+		{"default", nil, "100.64.0.2"},
+		{"selected", map[netaddr.IPPrefix]tailcfg.StableNodeID{shared: "100.64.0.3"}, "100.64.0.3"},
+		{"selected_gone", map[netaddr.IPPrefix]tailcfg.StableNodeID{shared: "100.64.0.9"}, "100.64.0.2"},
+		{"selected_unapproved", map[netaddr.IPPrefix]tailcfg.StableNodeID{shared: "100.64.0.6"}, "100.64.0.2"},
+	}
+	for _, tt := range tests {
+		got := routerFor(tt.subnetRouters)
+		if len(got) != 1 || got[0] != tt.want {
+			t.Errorf("%s: %v routed via %v; want only %v", tt.name, shared, got, tt.want)
+		}
+	}
+
+	// Routes that are only advertised are never routed, whatever the
+	// client selected.
+	cfg, err := WGCfg(nm, logger.Discard, netmap.AllowSingleHosts|netmap.AllowSubnetRoutes, "", map[netaddr.IPPrefix]tailcfg.StableNodeID{
+		shared:     "100.64.0.6",
+		unapproved: "100.64.0.5",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, p := range cfg.Peers {
+		for _, r := range p.AllowedIPs {
+			if r == unapproved || (r == shared && nm.Peers[i].ID == 6) {
+				t.Errorf("unapproved route %v routed via %v", r, nm.Peers[i].StableID)
+			}
+		}
+	}
+}
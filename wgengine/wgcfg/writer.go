@@ -49,6 +49,12 @@ func (cfg *Config) ToUAPI(logf logger.Logf, w io.Writer, prev *Config) error {
 	// Add/configure all new peers.
 	for _, p := range cfg.Peers {
 		oldPeer, wasPresent := old[p.PublicKey]
+		if wasPresent && oldPeer.WGEndpoint == p.PublicKey &&
+			cidrsEqual(oldPeer.AllowedIPs, p.AllowedIPs) &&
+			oldPeer.PersistentKeepalive == p.PersistentKeepalive {
+			// Nothing WireGuard knows about changed.
+			continue
+		}
 		setPeer(p)
 		set("protocol_version", "1")
 